@@ -0,0 +1,481 @@
+package aperture
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// adminInstancesPath is the path of the admin API endpoint that lists
+	// all registered instances.
+	adminInstancesPath = "/v1/instances"
+
+	// adminServicesPath is the path prefix of the admin API endpoints of
+	// individual services.
+	adminServicesPath = "/v1/services/"
+
+	// adminMaintenanceSuffix is the path suffix of the admin API endpoint
+	// that controls the maintenance mode of a service.
+	adminMaintenanceSuffix = "/maintenance"
+
+	// adminFaultsSuffix is the path suffix of the admin API endpoint that
+	// controls the faults injected into the requests of a service.
+	adminFaultsSuffix = "/faults"
+
+	// adminCapturesSuffix is the path suffix of the admin API endpoint
+	// that returns the recorded exchanges of a service.
+	adminCapturesSuffix = "/captures"
+
+	// adminRefundsPath is the path of the admin API endpoint that refunds
+	// the unused balance of a token.
+	adminRefundsPath = "/v1/refunds"
+
+	// adminTokensPath is the path of the admin API endpoints that find
+	// tokens by their metadata and issue batches of tokens.
+	adminTokensPath = "/v1/tokens"
+
+	// adminExplainPath is the path of the admin API endpoint that explains
+	// how a hypothetical request would be routed.
+	adminExplainPath = "/v1/explain"
+
+	// adminConfigPath is the path of the admin API endpoint that returns
+	// the effective configuration of the instance.
+	adminConfigPath = "/v1/config"
+
+	// adminConnectionsPath is the path of the admin API endpoint that
+	// returns the open client connections and requests in flight.
+	adminConnectionsPath = "/v1/connections"
+
+	// adminMetricsPath is the path the Prometheus metrics are served at.
+	adminMetricsPath = "/metrics"
+)
+
+// adminMaintenance is the maintenance mode of a service in the admin API.
+type adminMaintenance struct {
+	Service    string `json:"service"`
+	Enabled    bool   `json:"enabled"`
+	Message    string `json:"message,omitempty"`
+	RetryAfter string `json:"retryafter,omitempty"`
+}
+
+// newAdminHandler creates the handler of the admin API.
+func (a *Aperture) newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminInstancesPath, a.handleListInstances)
+	mux.HandleFunc(adminServicesPath, a.handleServices)
+	mux.HandleFunc(adminRefundsPath, a.handleRefund)
+	mux.HandleFunc(adminTokensPath, a.handleTokens)
+	mux.HandleFunc(adminTokensPath+"/", a.handleTokens)
+	mux.HandleFunc(adminExplainPath, a.handleExplain)
+	mux.HandleFunc(adminConfigPath, a.handleConfig)
+	mux.HandleFunc(adminConnectionsPath, a.handleConnections)
+	mux.Handle(adminMetricsPath, promhttp.Handler())
+	return auditHandler(a.auditLog, mux)
+}
+
+// startAdminServer starts the HTTP server of the admin API. The admin API isn't
+// authenticated, so it should only listen on an interface that isn't reachable
+// from the outside world.
+func (a *Aperture) startAdminServer(errChan chan error) error {
+	a.adminServer = &http.Server{
+		Addr:    a.cfg.Admin.ListenAddr,
+		Handler: a.newAdminHandler(),
+	}
+
+	log.Infof("Starting the admin API, listening on %s.",
+		a.cfg.Admin.ListenAddr)
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+
+		err := a.adminServer.ListenAndServe()
+		if err == http.ErrServerClosed {
+			return
+		}
+
+		select {
+		case errChan <- err:
+		case <-a.quit:
+		}
+	}()
+
+	return nil
+}
+
+// handleListInstances returns the registrations of all running instances.
+func (a *Aperture) handleListInstances(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if a.etcdClient == nil {
+		http.Error(w, "instances require etcd", http.StatusNotFound)
+		return
+	}
+
+	instances, err := listInstances(r.Context(), a.etcdClient)
+	if err != nil {
+		log.Errorf("Error listing instances: %v", err)
+		http.Error(w, "unable to list instances", http.StatusBadGateway)
+		return
+	}
+
+	writeAdminJSON(w, struct {
+		Instances []*instanceInfo `json:"instances"`
+	}{instances})
+}
+
+// handleServices dispatches the requests of the admin API endpoints of
+// individual services at /v1/services/<name>/<endpoint>.
+func (a *Aperture) handleServices(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, adminServicesPath)
+	switch {
+	case strings.HasSuffix(name, adminMaintenanceSuffix):
+		a.handleMaintenance(
+			w, r, strings.TrimSuffix(name, adminMaintenanceSuffix),
+		)
+
+	case strings.HasSuffix(name, adminFaultsSuffix) &&
+		a.cfg.Admin.FaultInjection:
+
+		a.handleFaults(
+			w, r, strings.TrimSuffix(name, adminFaultsSuffix),
+		)
+
+	case strings.HasSuffix(name, adminCapturesSuffix):
+		a.handleCaptures(
+			w, r, strings.TrimSuffix(name, adminCapturesSuffix),
+		)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleMaintenance shows, sets or clears the maintenance mode of the service
+// with the given name. A mode that is set through the admin API overrides the
+// configured one until it's cleared again.
+func (a *Aperture) handleMaintenance(w http.ResponseWriter, r *http.Request,
+	name string) {
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut:
+		var req adminMaintenance
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		cfg := &proxy.MaintenanceConfig{
+			Enabled: req.Enabled,
+			Message: req.Message,
+		}
+		if req.RetryAfter != "" {
+			retryAfter, err := time.ParseDuration(req.RetryAfter)
+			if err != nil {
+				http.Error(
+					w, "invalid retry after duration",
+					http.StatusBadRequest,
+				)
+				return
+			}
+			cfg.RetryAfter = retryAfter
+		}
+
+		if !a.setMaintenance(w, name, cfg) {
+			return
+		}
+		log.Infof("Maintenance mode of service %s set to %v through "+
+			"the admin API.", name, cfg.Enabled)
+
+	case http.MethodDelete:
+		if !a.setMaintenance(w, name, nil) {
+			return
+		}
+		log.Infof("Maintenance mode of service %s reset through the "+
+			"admin API.", name)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cfg, ok := a.proxy.Maintenance(name)
+	if !ok {
+		http.Error(w, "unknown service", http.StatusNotFound)
+		return
+	}
+
+	resp := adminMaintenance{
+		Service: name,
+		Enabled: cfg.Enabled,
+		Message: cfg.Message,
+	}
+	if cfg.RetryAfter != 0 {
+		resp.RetryAfter = cfg.RetryAfter.String()
+	}
+	writeAdminJSON(w, resp)
+}
+
+// adminFaults are the faults injected into the requests of a service in the
+// admin API.
+type adminFaults struct {
+	Service     string  `json:"service"`
+	Delay       string  `json:"delay,omitempty"`
+	ErrorRate   float64 `json:"error_rate,omitempty"`
+	ErrorStatus int     `json:"error_status,omitempty"`
+	ResetRate   float64 `json:"reset_rate,omitempty"`
+}
+
+// handleFaults shows, sets or clears the faults that are injected into the
+// requests of the service with the given name.
+func (a *Aperture) handleFaults(w http.ResponseWriter, r *http.Request,
+	name string) {
+
+	var (
+		ok  bool
+		err error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		_, ok = a.proxy.Faults(name)
+
+	case http.MethodPut:
+		var req adminFaults
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		cfg := &proxy.FaultConfig{
+			ErrorRate:   req.ErrorRate,
+			ErrorStatus: req.ErrorStatus,
+			ResetRate:   req.ResetRate,
+		}
+		if req.Delay != "" {
+			cfg.Delay, err = time.ParseDuration(req.Delay)
+			if err != nil {
+				http.Error(
+					w, "invalid delay",
+					http.StatusBadRequest,
+				)
+				return
+			}
+		}
+
+		ok, err = a.proxy.SetFaults(name, cfg)
+		if ok && err == nil {
+			log.Warnf("Injecting faults into service %s through "+
+				"the admin API: %+v", name, *cfg)
+		}
+
+	case http.MethodDelete:
+		ok, err = a.proxy.SetFaults(name, nil)
+		if ok && err == nil {
+			log.Infof("Stopped injecting faults into service %s.",
+				name)
+		}
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+
+	case !ok:
+		http.Error(w, "unknown service", http.StatusNotFound)
+		return
+	}
+
+	cfg, _ := a.proxy.Faults(name)
+	resp := adminFaults{
+		Service:     name,
+		ErrorRate:   cfg.ErrorRate,
+		ErrorStatus: cfg.ErrorStatus,
+		ResetRate:   cfg.ResetRate,
+	}
+	if cfg.Delay != 0 {
+		resp.Delay = cfg.Delay.String()
+	}
+	writeAdminJSON(w, resp)
+}
+
+// handleCaptures returns or clears the recorded exchanges of the service with
+// the given name.
+func (a *Aperture) handleCaptures(w http.ResponseWriter, r *http.Request,
+	name string) {
+
+	switch r.Method {
+	case http.MethodGet:
+		exchanges, ok := a.proxy.Captures(name)
+		if !ok {
+			http.Error(w, "unknown service", http.StatusNotFound)
+			return
+		}
+
+		writeAdminJSON(w, struct {
+			Exchanges []*proxy.CapturedExchange `json:"exchanges"`
+		}{exchanges})
+
+	case http.MethodDelete:
+		if !a.proxy.ClearCaptures(name) {
+			http.Error(w, "unknown service", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// setMaintenance sets the maintenance mode of the service with the given name
+// and writes an error response if it can't be set.
+func (a *Aperture) setMaintenance(w http.ResponseWriter, name string,
+	cfg *proxy.MaintenanceConfig) bool {
+
+	ok, err := a.proxy.SetMaintenance(name, cfg)
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+
+	case !ok:
+		http.Error(w, "unknown service", http.StatusNotFound)
+		return false
+	}
+
+	return true
+}
+
+// handleTokens returns the metadata of the token with the given ID at
+// /v1/tokens/<id>, or of all tokens whose metadata has the keys and values of
+// the query parameters at /v1/tokens. A POST request to /v1/tokens issues a
+// batch of tokens.
+func (a *Aperture) handleTokens(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, adminTokensPath)
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		a.handleIssueBatch(w, r)
+		return
+
+	case r.Method != http.MethodGet:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+
+	case a.etcdClient == nil:
+		http.Error(
+			w, "token metadata requires etcd", http.StatusNotFound,
+		)
+		return
+	}
+	store := newMetadataStore(a.etcdClient)
+
+	if id != "" {
+		tokenID, err := lsat.MakeIDFromString(
+			strings.TrimPrefix(id, "/"),
+		)
+		if err != nil {
+			http.Error(w, "invalid token ID", http.StatusBadRequest)
+			return
+		}
+
+		metadata, err := store.metadata(r.Context(), tokenID)
+		if err != nil {
+			log.Errorf("Error reading token metadata: %v", err)
+			http.Error(
+				w, "unable to read token metadata",
+				http.StatusBadGateway,
+			)
+			return
+		}
+		if metadata == nil {
+			http.Error(w, "unknown token", http.StatusNotFound)
+			return
+		}
+
+		writeAdminJSON(w, metadata)
+		return
+	}
+
+	filter := make(map[string]string)
+	for key, values := range r.URL.Query() {
+		filter[key] = values[0]
+	}
+	tokens, err := store.find(r.Context(), filter)
+	if err != nil {
+		log.Errorf("Error finding tokens: %v", err)
+		http.Error(w, "unable to find tokens", http.StatusBadGateway)
+		return
+	}
+
+	writeAdminJSON(w, struct {
+		Tokens []*tokenMetadata `json:"tokens"`
+	}{tokens})
+}
+
+// handleExplain explains which service a request for the host, path and method
+// of the query parameters would match, and which authentication level, price
+// rule and header changes apply to it. Nothing is sent to the backend.
+func (a *Aperture) handleExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	path := query.Get("path")
+	if !strings.HasPrefix(path, "/") {
+		http.Error(w, "path must start with /", http.StatusBadRequest)
+		return
+	}
+
+	writeAdminJSON(w, a.proxy.Explain(
+		query.Get("host"), path, query.Get("method"),
+	))
+}
+
+// handleConfig returns the configuration the instance runs with as YAML, with
+// the values of secrets redacted.
+func (a *Aperture) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config, err := a.effectiveConfig()
+	if err != nil {
+		log.Errorf("Error encoding effective config: %v", err)
+		http.Error(w, "unable to encode config",
+			http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	if _, err := w.Write(config); err != nil {
+		log.Errorf("Error writing admin API response: %v", err)
+	}
+}
+
+// writeAdminJSON writes the given value as the JSON encoded response of an
+// admin API request.
+func writeAdminJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Errorf("Error writing admin API response: %v", err)
+	}
+}
@@ -1,32 +1,46 @@
 package aperture
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	gateway "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	flags "github.com/jessevdk/go-flags"
+	"github.com/lightninglabs/aperture/audit"
 	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/freebie"
+	"github.com/lightninglabs/aperture/geoip"
+	"github.com/lightninglabs/aperture/kms"
+	"github.com/lightninglabs/aperture/lsat"
 	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightninglabs/aperture/proof"
 	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightninglabs/aperture/vault"
 	"github.com/lightninglabs/lightning-node-connect/hashmailrpc"
+	"github.com/lightninglabs/lndclient"
 	"github.com/lightningnetwork/lnd"
 	"github.com/lightningnetwork/lnd/build"
-	"github.com/lightningnetwork/lnd/cert"
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/lightningnetwork/lnd/signal"
 	"github.com/lightningnetwork/lnd/tor"
@@ -98,7 +112,31 @@ var (
 // Main is the true entrypoint of Aperture.
 func Main() {
 	// TODO: Prevent from running twice.
-	err := run()
+	var command string
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	var err error
+	switch command {
+	case loadTestCommand:
+		err = runLoadTest(os.Args[2:], os.Stdout)
+
+	case explainCommand:
+		err = runExplain(os.Args[2:], os.Stdout)
+
+	case replayCommand:
+		err = runReplay(os.Args[2:], os.Stdout)
+
+	case configSchemaCommand:
+		err = runConfigSchema(os.Args[2:], os.Stdout)
+
+	case configDumpCommand:
+		err = runConfigDump(os.Args[2:], os.Stdout)
+
+	default:
+		err = run()
+	}
 
 	// Unwrap our error and check whether help was requested from our flag
 	// library. If the error is not wrapped, Unwrap returns nil. It is
@@ -136,21 +174,44 @@ func run() error {
 		return fmt.Errorf("unable to set up logging: %v", err)
 	}
 
+	// A self-test only checks our dependencies, we don't start serving
+	// requests.
+	if cfg.SelfTest {
+		return runSelfTest(cfg, os.Stdout)
+	}
+
 	errChan := make(chan error)
 	a := NewAperture(cfg)
 	if err := a.Start(errChan); err != nil {
 		return fmt.Errorf("unable to start aperture: %v", err)
 	}
 
-	select {
-	case <-interceptor.ShutdownChannel():
-		log.Infof("Received interrupt signal, shutting down aperture.")
+	// If we're the upgraded binary of a previous process, it can stop
+	// accepting connections now.
+	notifyUpgradeReady()
 
-	case err := <-errChan:
-		log.Errorf("Error while running aperture: %v", err)
-	}
+	upgradeChan := upgradeSignal()
+	for {
+		select {
+		case <-interceptor.ShutdownChannel():
+			log.Infof("Received interrupt signal, shutting down " +
+				"aperture.")
+
+		case err := <-errChan:
+			log.Errorf("Error while running aperture: %v", err)
+
+		case <-upgradeChan:
+			log.Infof("Received upgrade signal, handing over to " +
+				"new aperture binary.")
+			if err := a.Upgrade(); err != nil {
+				log.Errorf("Upgrade failed, continuing to "+
+					"serve requests: %v", err)
+				continue
+			}
+		}
 
-	return a.Stop()
+		return a.Stop()
+	}
 }
 
 // Aperture is the main type of the aperture service. It holds all components
@@ -165,6 +226,71 @@ type Aperture struct {
 	proxy         *proxy.Proxy
 	proxyCleanup  func()
 
+	// staticServices serve the static mounts and the protected static
+	// files. They are kept next to the configured services when those are
+	// updated at run time.
+	staticServices []*proxy.Service
+
+	// servicesMtx guards the configured services and the ones discovered
+	// in Kubernetes, which are combined whenever one of them changes.
+	servicesMtx        sync.Mutex
+	configuredServices []*proxy.Service
+	kubeServices       []*proxy.Service
+
+	leader        *leaderElector
+	configWatcher *fleetConfigWatcher
+	secretCache   *cachedSecretStore
+	kubeWatcher   *kubernetesWatcher
+	registry      *instanceRegistry
+	adminServer   *http.Server
+
+	// certRenewer renews the self-signed TLS certificate while we're
+	// running, if we use one.
+	certRenewer *certRenewer
+
+	// conns keeps track of the open client connections of our servers.
+	conns *connTracker
+
+	// collector exports the open connections and requests in flight as
+	// Prometheus metrics.
+	collector *activityCollector
+
+	// listeners are the listening sockets of our servers, mapped by their
+	// name, so they can be handed over to an upgraded binary.
+	listeners map[string]net.Listener
+
+	// auditLog records security relevant events, if enabled.
+	auditLog *audit.Log
+
+	// vaultClient is connected to Vault, if credentials are read from it.
+	vaultClient *vault.Client
+
+	// lndConn is the connection to lnd, if we created it ourselves with
+	// credentials from Vault.
+	lndConn *grpc.ClientConn
+
+	// devNode creates and settles the invoices in development mode.
+	devNode *devNode
+
+	// refundClient sends the refunds of unused token balances, if they
+	// are enabled.
+	refundClient RefundClient
+
+	// mint mints the tokens of all services and records them in the audit
+	// log. It's used directly to issue tokens in bulk through the admin
+	// API.
+	mint *auditMinter
+
+	// etcdReadClient is only connected to the nearest etcd endpoint and is
+	// used for secret lookups, if enabled.
+	etcdReadClient *clientv3.Client
+
+	// stateMtx guards the state we report in the instance registry that
+	// changes at run time.
+	stateMtx   sync.Mutex
+	onionAddrs []string
+	draining   bool
+
 	wg   sync.WaitGroup
 	quit chan struct{}
 }
@@ -172,8 +298,10 @@ type Aperture struct {
 // NewAperture creates a new instance of the Aperture service.
 func NewAperture(cfg *Config) *Aperture {
 	return &Aperture{
-		cfg:  cfg,
-		quit: make(chan struct{}),
+		cfg:       cfg,
+		listeners: make(map[string]net.Listener),
+		conns:     newConnTracker(),
+		quit:      make(chan struct{}),
 	}
 }
 
@@ -181,33 +309,201 @@ func NewAperture(cfg *Config) *Aperture {
 func (a *Aperture) Start(errChan chan error) error {
 	var err error
 
-	// Initialize our etcd client.
-	a.etcdClient, err = clientv3.New(clientv3.Config{
-		Endpoints:   []string{a.cfg.Etcd.Host},
-		DialTimeout: 5 * time.Second,
-		Username:    a.cfg.Etcd.User,
-		Password:    a.cfg.Etcd.Password,
-	})
-	if err != nil {
-		return fmt.Errorf("unable to connect to etcd: %v", err)
+	// Open the audit log first, so it covers everything that happens
+	// afterwards.
+	if a.cfg.Audit != nil && a.cfg.Audit.File != "" {
+		var key []byte
+		if a.cfg.Audit.KeyFile != "" {
+			key, err = ioutil.ReadFile(a.cfg.Audit.KeyFile)
+			if err != nil {
+				return fmt.Errorf("unable to read audit "+
+					"log key: %v", err)
+			}
+			key = bytes.TrimSpace(key)
+			if len(key) == 0 {
+				return fmt.Errorf("audit log key file %s is "+
+					"empty", a.cfg.Audit.KeyFile)
+			}
+		}
+
+		a.auditLog, err = audit.New(&audit.Config{
+			File:        a.cfg.Audit.File,
+			MaxFileSize: a.cfg.Audit.MaxFileSize * 1024 * 1024,
+			MaxFiles:    a.cfg.Audit.MaxFiles,
+			MaxAge:      a.cfg.Audit.MaxAge,
+			Key:         key,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to open audit log: %v", err)
+		}
+	}
+
+	// If configured, credentials are read from Vault instead of files, so
+	// we need to connect to it first.
+	vaultCfg := a.cfg.Vault
+	if vaultCfg != nil && vaultCfg.Address != "" {
+		a.vaultClient, err = vault.NewClient(
+			vaultCfg.Address, vaultCfg.TokenFile, vaultCfg.Mount,
+		)
+		if err != nil {
+			return err
+		}
+		if err := a.vaultClient.Start(); err != nil {
+			return err
+		}
+
+		if vaultCfg.EtcdPath != "" {
+			err := applyVaultEtcdCredentials(
+				a.vaultClient, vaultCfg.EtcdPath, a.cfg.Etcd,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		vaultCfg = nil
+	}
+
+	// The secrets are kept in etcd unless we only need them in memory.
+	var secrets mint.SecretStore
+	if a.cfg.Store == storeMemory {
+		log.Warnf("Keeping all state in memory, it is lost on restart!")
+		secrets = newMemSecretStore()
+	} else {
+		secrets, err = a.connectEtcd()
+		if err != nil {
+			return err
+		}
+	}
+
+	// If a KMS is configured, the secrets are derived from a root key that
+	// never leaves it instead of being stored in etcd.
+	if a.cfg.KMS != nil && a.cfg.KMS.Provider != "" {
+		signer, err := kms.NewSigner(&kms.Config{
+			Provider: a.cfg.KMS.Provider,
+			KeyID:    a.cfg.KMS.KeyID,
+			Region:   a.cfg.KMS.Region,
+			Command:  a.cfg.KMS.Command,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to set up KMS: %v", err)
+		}
+		secrets = newKMSSecretStore(a.etcdClient, signer)
+	}
+
+	if vaultCfg != nil && vaultCfg.SecretsPath != "" {
+		secrets = newVaultSecretStore(
+			a.vaultClient, vaultCfg.SecretsPath,
+		)
+	}
+
+	if a.auditLog != nil {
+		secrets = &auditSecretStore{
+			SecretStore: secrets,
+			auditLog:    a.auditLog,
+		}
+	}
+
+	// Background tasks that must not run on multiple replicas at the same
+	// time are only run by the elected leader.
+	var electionClient *clientv3.Client
+	if a.cfg.Etcd.LeaderElection {
+		electionClient = a.etcdClient
+	}
+	a.leader = newLeaderElector(
+		electionClient, instanceID(a.cfg.Etcd.InstanceID),
+		a.cfg.Etcd.LeaderTTL, errChan,
+	)
+
+	// The secrets and state of expired and revoked tokens are removed
+	// periodically, so the store doesn't grow without bounds.
+	if a.cfg.Pruning != nil && a.cfg.Pruning.Enabled {
+		pruner := newTokenPruner(a.cfg.Pruning, a.etcdClient, secrets)
+		a.leader.AddTask("token pruning", pruner.run)
 	}
 
 	// Create our challenger that uses our backing lnd node to create
 	// invoices and check their settlement status.
 	genInvoiceReq := func(price int64) (*lnrpc.Invoice, error) {
+		// LNURL wallets only pay invoices that commit to the
+		// metadata they were shown.
+		if a.cfg.Authenticator.LNURL {
+			return &lnrpc.Invoice{
+				DescriptionHash: proxy.LNURLDescriptionHash(),
+				Value:           price,
+			}, nil
+		}
+
 		return &lnrpc.Invoice{
 			Memo:  "LSAT",
 			Value: price,
 		}, nil
 	}
 
-	if !a.cfg.Authenticator.Disable {
+	switch {
+	case a.cfg.Authenticator.Disable:
+
+	case a.cfg.Dev:
+		log.Warnf("Running in development mode, invoices are settled " +
+			"without being paid!")
+		a.devNode, err = newDevNode(
+			a.cfg.DevSettleDelay, a.cfg.DevManualSettle,
+		)
+		if err != nil {
+			return err
+		}
+		a.challenger, err = NewLndChallengerWithClient(
+			a.cfg.Authenticator, a.devNode, genInvoiceReq, errChan,
+		)
+		if err != nil {
+			return err
+		}
+
+	case vaultCfg != nil && vaultCfg.LndPath != "":
+		var client lnrpc.LightningClient
+		client, a.lndConn, err = newVaultLndClient(
+			a.vaultClient, vaultCfg.LndPath,
+			a.cfg.Authenticator.LndHost,
+		)
+		if err != nil {
+			return err
+		}
+		a.challenger, err = NewLndChallengerWithClient(
+			a.cfg.Authenticator, client, genInvoiceReq, errChan,
+		)
+		if err != nil {
+			return err
+		}
+		if a.refundsEnabled() {
+			a.refundClient = client
+		}
+
+	default:
 		a.challenger, err = NewLndChallenger(
 			a.cfg.Authenticator, genInvoiceReq, errChan,
 		)
 		if err != nil {
 			return err
 		}
+
+		// Refunds need a macaroon that may send payments, which the
+		// invoice macaroon of the challenger can't.
+		if a.refundsEnabled() {
+			auth := a.cfg.Authenticator
+			a.refundClient, err = lndclient.NewBasicClient(
+				auth.LndHost, auth.TLSPath, auth.MacDir,
+				auth.Network, lndclient.MacFilename(
+					a.cfg.Admin.RefundMacaroon,
+				),
+			)
+			if err != nil {
+				return fmt.Errorf("unable to connect to lnd "+
+					"for refunds: %v", err)
+			}
+		}
+	}
+
+	if a.challenger != nil {
 		err = a.challenger.Start()
 		if err != nil {
 			return err
@@ -215,19 +511,103 @@ func (a *Aperture) Start(errChan chan error) error {
 	}
 
 	// Create the proxy and connect it to lnd.
-	a.proxy, a.proxyCleanup, err = createProxy(
-		a.cfg, a.challenger, a.etcdClient,
+	a.staticServices, err = newStaticServices(a.cfg, a.newStaticPageData)
+	if err != nil {
+		return err
+	}
+	a.proxy, a.mint, a.proxyCleanup, err = createProxy(
+		a.cfg, a.challenger, a.devNode, a.etcdClient, secrets,
+		a.auditLog, a.staticServices, a.newStaticPageData,
 	)
 	if err != nil {
 		return err
 	}
-	handler := http.HandlerFunc(a.proxy.ServeHTTP)
+	a.configuredServices = a.cfg.Services
+
+	// Export the open connections and requests in flight, so operators
+	// can see what a restart would interrupt.
+	a.collector = &activityCollector{conns: a.conns, proxy: a.proxy}
+	if err := prometheus.Register(a.collector); err != nil {
+		log.Warnf("Unable to register connection metrics: %v", err)
+	}
+
+	// Apply the configuration that was published for all instances and
+	// keep it up to date.
+	if a.cfg.Etcd.WatchConfig {
+		a.configWatcher = newFleetConfigWatcher(
+			a.etcdClient, instanceID(a.cfg.Etcd.InstanceID),
+			a.applyFleetConfig,
+		)
+		if err := a.configWatcher.Start(); err != nil {
+			return err
+		}
+	}
+
+	// Serve the annotated services of the Kubernetes namespace and keep
+	// their endpoints in sync.
+	if a.cfg.Kubernetes != nil && a.cfg.Kubernetes.Enabled {
+		a.kubeWatcher, err = newKubernetesWatcher(
+			a.cfg.Kubernetes, a.updateKubernetesServices,
+		)
+		if err != nil {
+			return fmt.Errorf("unable to create Kubernetes "+
+				"watcher: %v", err)
+		}
+		if err := a.kubeWatcher.Start(); err != nil {
+			return fmt.Errorf("unable to sync Kubernetes "+
+				"services: %v", err)
+		}
+	}
+
+	var handler http.Handler = http.HandlerFunc(a.proxy.ServeHTTP)
+	if a.cfg.ValidateOnly {
+		log.Infof("Running in validation-only sidecar mode, requests " +
+			"won't be proxied to any backend.")
+		handler = http.HandlerFunc(a.proxy.ServeValidation)
+	}
+
+	// In strict HTTP mode, requests that could be framed differently by
+	// us and an HTTP/1.1 backend are rejected.
+	if a.cfg.StrictHTTP {
+		handler = strictHTTPHandler(handler)
+	}
+
+	// The flow control windows of HTTP/2 connections are shared by the
+	// requests to all services.
+	http2Server := proxy.NewHTTP2Server(a.cfg.Services)
+
+	// The pings of clients are only checked if a policy is configured.
+	var keepalive *KeepaliveConfig
+	if a.cfg.Keepalive != nil && a.cfg.Keepalive.MinTime > 0 {
+		keepalive = a.cfg.Keepalive
+	}
+
 	a.httpsServer = &http.Server{
 		Addr:         a.cfg.ListenAddr,
 		Handler:      handler,
 		IdleTimeout:  0,
 		ReadTimeout:  0,
 		WriteTimeout: 0,
+		ConnState:    a.conns.hook(mainListenerName),
+	}
+
+	listener, err := a.listen(mainListenerName, a.cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	// Behind an L4 load balancer, the address of the client is only known
+	// from the PROXY protocol header in front of its connection.
+	if a.cfg.ProxyProtocol != nil && a.cfg.ProxyProtocol.Enabled {
+		listener, err = newProxyProtocolListener(
+			listener, a.cfg.ProxyProtocol,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if a.cfg.StrictHTTP {
+		a.httpsServer.ConnContext = strictConnContext
 	}
 
 	// Create TLS configuration by either creating new self-signed certs or
@@ -239,20 +619,69 @@ func (a *Aperture) Start(errChan chan error) error {
 		// support and that gRPC uses when the grpc.WithInsecure()
 		// option is used. The default HTTP handler doesn't support it
 		// though so we need to add a special h2c handler here.
-		serveFn = a.httpsServer.ListenAndServe
-		a.httpsServer.Handler = h2c.NewHandler(handler, &http2.Server{})
+		serveListener := listener
+		if a.cfg.StrictHTTP {
+			serveListener = &strictListener{Listener: listener}
+		}
+		if keepalive != nil {
+			serveListener = &keepaliveListener{
+				Listener: serveListener,
+				policy:   keepalive,
+			}
+		}
+		serveFn = func() error {
+			return a.httpsServer.Serve(serveListener)
+		}
+		a.httpsServer.Handler = h2c.NewHandler(handler, http2Server)
 	} else {
-		a.httpsServer.TLSConfig, err = getTLSConfig(
-			a.cfg.ServerName, a.cfg.BaseDir, a.cfg.AutoCert,
-		)
+		if vaultCfg != nil && vaultCfg.TLSPath != "" {
+			a.httpsServer.TLSConfig, err = newVaultTLSConfig(
+				a.vaultClient, vaultCfg.TLSPath,
+			)
+		} else {
+			var tlsConfig *tls.Config
+			tlsConfig, a.certRenewer, err = getTLSConfig(
+				a.cfg.ServerName, a.cfg.BaseDir,
+				a.cfg.AutoCert, a.etcdClient,
+			)
+			a.httpsServer.TLSConfig = tlsConfig
+		}
 		if err != nil {
 			return err
 		}
+		if a.certRenewer != nil {
+			a.certRenewer.Start()
+		}
+
+		// Clients are only asked for a certificate if a service
+		// accepts them. They are verified by its authenticator.
+		if proxy.RequestsClientCerts(a.cfg.Services) {
+			a.httpsServer.TLSConfig.ClientAuth =
+				tls.RequestClientCert
+		}
+		err = http2.ConfigureServer(a.httpsServer, http2Server)
+		if err != nil {
+			return err
+		}
+		if keepalive != nil {
+			enforceKeepalive(a.httpsServer, http2Server, keepalive)
+		}
 		serveFn = func() error {
 			// The httpsServer.TLSConfig contains certificates at
 			// this point so we don't need to pass in certificate
 			// and key file names.
-			return a.httpsServer.ListenAndServeTLS("", "")
+			return a.httpsServer.ServeTLS(listener, "", "")
+		}
+
+		// To inspect the requests, we need to terminate TLS
+		// ourselves.
+		if a.cfg.StrictHTTP {
+			tlsListener := newStrictTLSListener(
+				listener, a.httpsServer.TLSConfig,
+			)
+			serveFn = func() error {
+				return a.httpsServer.Serve(tlsListener)
+			}
 		}
 	}
 
@@ -277,47 +706,282 @@ func (a *Aperture) Start(errChan chan error) error {
 	// provide encryption, so running this additional HTTP server should be
 	// relatively safe.
 	if a.cfg.Tor != nil && (a.cfg.Tor.V2 || a.cfg.Tor.V3) {
-		torController, err := initTorListener(a.cfg, a.etcdClient)
+		// All replicas share the same onion service keys, so only the
+		// leader registers the onion services with its Tor server.
+		a.leader.AddTask("onion registration", a.registerOnions)
+
+		a.torHTTPServer = &http.Server{
+			Addr: fmt.Sprintf(
+				"localhost:%d", a.cfg.Tor.ListenPort,
+			),
+			Handler:   h2c.NewHandler(handler, http2Server),
+			ConnState: a.conns.hook(torListenerName),
+		}
+		torListener, err := a.listen(
+			torListenerName, a.torHTTPServer.Addr,
+		)
 		if err != nil {
 			return err
 		}
-		defer func() {
-			_ = torController.Stop()
-		}()
-
-		a.torHTTPServer = &http.Server{
-			Addr:    fmt.Sprintf("localhost:%d", a.cfg.Tor.ListenPort),
-			Handler: h2c.NewHandler(handler, &http2.Server{}),
+		if a.cfg.StrictHTTP {
+			torListener = &strictListener{Listener: torListener}
+		}
+		if keepalive != nil {
+			torListener = &keepaliveListener{
+				Listener: torListener,
+				policy:   keepalive,
+			}
 		}
 		a.wg.Add(1)
 		go func() {
 			defer a.wg.Done()
 
 			select {
-			case errChan <- a.torHTTPServer.ListenAndServe():
+			case errChan <- a.torHTTPServer.Serve(torListener):
 			case <-a.quit:
 			}
 		}()
 	}
 
+	a.leader.Start()
+
+	// Let operators see this instance next to all others in the registry.
+	if a.cfg.Etcd.Register {
+		a.registry = newInstanceRegistry(
+			a.etcdClient, instanceID(a.cfg.Etcd.InstanceID),
+			a.instanceInfo,
+		)
+		if err := a.registry.Start(); err != nil {
+			return fmt.Errorf("unable to register instance: %v", err)
+		}
+	}
+
+	if a.cfg.Admin != nil && a.cfg.Admin.ListenAddr != "" {
+		if err := a.startAdminServer(errChan); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// instanceInfo returns the current state of this instance for the registry.
+func (a *Aperture) instanceInfo() *instanceInfo {
+	a.stateMtx.Lock()
+	defer a.stateMtx.Unlock()
+
+	listenAddrs := make([]string, 0, len(a.listeners))
+	for _, name := range []string{mainListenerName, torListenerName} {
+		if listener, ok := a.listeners[name]; ok {
+			listenAddrs = append(listenAddrs, listener.Addr().String())
+		}
+	}
+
+	health := instanceHealthServing
+	if a.draining {
+		health = instanceHealthDraining
+	}
+
+	return &instanceInfo{
+		Version:     buildVersion(),
+		ListenAddrs: listenAddrs,
+		OnionAddrs:  a.onionAddrs,
+		Health:      health,
+		Leader:      !a.cfg.Etcd.LeaderElection,
+	}
+}
+
+// listen creates the listener with the given name for the given address and
+// remembers it, so it can be handed over to an upgraded binary later.
+func (a *Aperture) listen(name, addr string) (net.Listener, error) {
+	listener, err := listen(name, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	a.listeners[name] = listener
+	return listener, nil
+}
+
+// Addr returns the address the main listener accepts client connections on,
+// or nil if aperture wasn't started yet. This is useful to find out the port
+// that was picked if the listen address has port 0.
+func (a *Aperture) Addr() net.Addr {
+	a.stateMtx.Lock()
+	defer a.stateMtx.Unlock()
+
+	listener, ok := a.listeners[mainListenerName]
+	if !ok {
+		return nil
+	}
+
+	return listener.Addr()
+}
+
+// registerOnions creates the onion services of the proxy and keeps them
+// registered until the given context is canceled.
+func (a *Aperture) registerOnions(ctx context.Context) error {
+	torController, onionAddrs, err := initTorListener(a.cfg, a.etcdClient)
+	if err != nil {
+		return err
+	}
+
+	a.stateMtx.Lock()
+	a.onionAddrs = onionAddrs
+	a.stateMtx.Unlock()
+
+	<-ctx.Done()
+
+	a.stateMtx.Lock()
+	a.onionAddrs = nil
+	a.stateMtx.Unlock()
+
+	return torController.Stop()
+}
+
 // UpdateServices instructs the proxy to re-initialize its internal
 // configuration of backend services. This can be used to add or remove backends
 // at run time or enable/disable authentication on the fly.
 func (a *Aperture) UpdateServices(services []*proxy.Service) error {
-	return a.proxy.UpdateServices(services)
+	a.servicesMtx.Lock()
+	defer a.servicesMtx.Unlock()
+
+	if err := a.applyServices(services, a.kubeServices); err != nil {
+		return err
+	}
+	a.configuredServices = services
+
+	return nil
+}
+
+// updateKubernetesServices replaces the services that were discovered in
+// Kubernetes.
+func (a *Aperture) updateKubernetesServices(services []*proxy.Service) error {
+	a.servicesMtx.Lock()
+	defer a.servicesMtx.Unlock()
+
+	if err := a.applyServices(a.configuredServices, services); err != nil {
+		return err
+	}
+	a.kubeServices = services
+
+	return nil
+}
+
+// applyServices replaces the services of the proxy with the given configured
+// and discovered ones and the static services. Configured services take
+// precedence over discovered ones that match the same requests.
+//
+// NOTE: The services mutex must be held.
+func (a *Aperture) applyServices(configured,
+	discovered []*proxy.Service) error {
+
+	allServices := make(
+		[]*proxy.Service, 0,
+		len(configured)+len(discovered)+len(a.staticServices),
+	)
+	allServices = append(allServices, configured...)
+	allServices = append(allServices, discovered...)
+	allServices = append(allServices, a.staticServices...)
+
+	return a.proxy.UpdateServices(allServices)
+}
+
+// applyFleetConfig applies the configuration that was published in etcd. The
+// services are validated and replaced in one step, so requests are never
+// served by a partially updated configuration.
+func (a *Aperture) applyFleetConfig(cfg *fleetConfig) error {
+	err := a.updateFleetConfig(cfg)
+
+	fields := map[string]string{
+		"services":   strconv.Itoa(len(cfg.Services)),
+		"debuglevel": cfg.DebugLevel,
+		"result":     "applied",
+	}
+	if err != nil {
+		fields["result"] = err.Error()
+	}
+	recordAudit(a.auditLog, audit.EventConfigReload, fields)
+
+	return err
+}
+
+// updateFleetConfig replaces the services and debug level with the ones of the
+// given configuration.
+func (a *Aperture) updateFleetConfig(cfg *fleetConfig) error {
+	if cfg.Services != nil {
+		if err := a.UpdateServices(cfg.Services); err != nil {
+			return err
+		}
+	}
+
+	if cfg.DebugLevel != "" {
+		return build.ParseAndSetDebugLevels(cfg.DebugLevel, logWriter)
+	}
+
+	return nil
 }
 
 // Stop gracefully shuts down the Aperture service.
 func (a *Aperture) Stop() error {
 	var returnErr error
 
+	// Stop the singleton tasks first so the leadership is given up while
+	// we can still reach etcd.
+	if a.leader != nil {
+		a.leader.Stop()
+	}
+
+	if a.registry != nil {
+		a.registry.Stop()
+	}
+
+	if a.adminServer != nil {
+		if err := a.adminServer.Close(); err != nil {
+			returnErr = err
+		}
+	}
+
+	if a.configWatcher != nil {
+		a.configWatcher.Stop()
+	}
+
+	if a.collector != nil {
+		prometheus.Unregister(a.collector)
+	}
+
+	if a.certRenewer != nil {
+		a.certRenewer.Stop()
+	}
+
+	if a.secretCache != nil {
+		a.secretCache.Stop()
+	}
+
+	if a.kubeWatcher != nil {
+		a.kubeWatcher.Stop()
+	}
+
 	if a.challenger != nil {
 		a.challenger.Stop()
 	}
 
+	if a.lndConn != nil {
+		if err := a.lndConn.Close(); err != nil {
+			log.Errorf("Error closing lnd connection: %v", err)
+		}
+	}
+
+	if a.vaultClient != nil {
+		a.vaultClient.Stop()
+	}
+
+	if a.etcdReadClient != nil {
+		if err := a.etcdReadClient.Close(); err != nil {
+			log.Errorf("Error terminating etcd read client: %v", err)
+		}
+	}
+
 	// Stop everything that was started alongside the proxy, for example the
 	// gRPC and REST servers.
 	if a.proxyCleanup != nil {
@@ -339,6 +1003,18 @@ func (a *Aperture) Stop() error {
 	close(a.quit)
 	a.wg.Wait()
 
+	// The audit log is closed last, so it records everything until the
+	// end. Its head is logged, so entries cut off the end of the chain
+	// can be detected by comparing it to the file.
+	if a.auditLog != nil {
+		if err := a.auditLog.Close(); err != nil {
+			log.Errorf("Error closing audit log: %v", err)
+		}
+		seq, hash := a.auditLog.Head()
+		log.Infof("Audit log closed at entry %d with hash %s", seq,
+			hash)
+	}
+
 	return returnErr
 }
 
@@ -353,6 +1029,61 @@ func fileExists(name string) bool {
 	return true
 }
 
+// connectEtcd connects to the etcd cluster and returns the secret store that
+// is backed by it.
+func (a *Aperture) connectEtcd() (mint.SecretStore, error) {
+	var err error
+
+	// Initialize our etcd client.
+	endpoints := etcdEndpoints(a.cfg.Etcd)
+	a.etcdClient, err = newEtcdClient(a.cfg.Etcd, endpoints)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to etcd: %v", err)
+	}
+
+	// Secrets are looked up on every request, so in a cluster that spans
+	// multiple regions we can look them up through the nearest member.
+	store := newSecretStore(a.etcdClient)
+	if a.cfg.Etcd.PreferNearest || a.cfg.Etcd.SerializableReads {
+		readClient := a.etcdClient
+		if a.cfg.Etcd.PreferNearest && len(endpoints) > 1 {
+			nearest, rtt, err := nearestEtcdEndpoint(
+				a.etcdClient, endpoints,
+			)
+			if err != nil {
+				return nil, err
+			}
+
+			log.Infof("Looking up secrets through nearest etcd "+
+				"endpoint %s (%v)", nearest, rtt)
+			a.etcdReadClient, err = newEtcdClient(
+				a.cfg.Etcd, []string{nearest},
+			)
+			if err != nil {
+				return nil, fmt.Errorf("unable to connect to "+
+					"etcd: %v", err)
+			}
+			readClient = a.etcdReadClient
+		}
+
+		store = newSecretStoreWithReads(
+			a.etcdClient, readClient, a.cfg.Etcd.SerializableReads,
+		)
+	}
+
+	// Secrets can also be kept in memory, which saves the round trip to
+	// etcd entirely for tokens that were seen before.
+	if a.cfg.Etcd.SecretCacheSize > 0 {
+		a.secretCache = newCachedSecretStore(
+			store, a.cfg.Etcd.SecretCacheSize,
+		)
+		a.secretCache.Start()
+		return a.secretCache, nil
+	}
+
+	return store, nil
+}
+
 // getConfig loads and parses the configuration file then checks it for valid
 // content.
 func getConfig() (*Config, error) {
@@ -395,6 +1126,18 @@ func getConfig() (*Config, error) {
 			return nil, err
 		}
 
+		// Strict parsing can be turned on in the file itself or on the
+		// command line, so we only know whether it's wanted once the
+		// file was read. The file is then parsed again into an empty
+		// config only to find the fields that don't exist.
+		if cfg.StrictConfig {
+			err := yaml.UnmarshalStrict(b, &Config{})
+			if err != nil {
+				return nil, fmt.Errorf("invalid config file "+
+					"%v: %w", configFile, err)
+			}
+		}
+
 	// If the error is unrelated to the existence of the file, we must
 	// always return it.
 	case !os.IsNotExist(err):
@@ -421,6 +1164,13 @@ func getConfig() (*Config, error) {
 	cfg.Authenticator.MacDir = lnd.CleanAndExpandPath(
 		cfg.Authenticator.MacDir,
 	)
+	if cfg.Audit != nil {
+		cfg.Audit.File = lnd.CleanAndExpandPath(cfg.Audit.File)
+	}
+	if cfg.GeoIP != nil {
+		cfg.GeoIP.Database = lnd.CleanAndExpandPath(cfg.GeoIP.Database)
+	}
+	cfg.ProofKeyFile = lnd.CleanAndExpandPath(cfg.ProofKeyFile)
 
 	// Then check the configuration that we got from the config file, all
 	// required values need to be set at this point.
@@ -456,9 +1206,12 @@ func setupLogging(cfg *Config, interceptor signal.Interceptor) error {
 }
 
 // getTLSConfig returns a TLS configuration for either a self-signed certificate
-// or one obtained through Let's Encrypt.
-func getTLSConfig(serverName, baseDir string, autoCert bool) (
-	*tls.Config, error) {
+// or one obtained through Let's Encrypt. Certificates obtained through Let's
+// Encrypt are cached in etcd, so all instances share them. For a self-signed
+// certificate, the renewer that has to be started to keep it valid is returned
+// too.
+func getTLSConfig(serverName, baseDir string, autoCert bool,
+	etcdClient *clientv3.Client) (*tls.Config, *certRenewer, error) {
 
 	// Use our default data dir unless a base dir is set.
 	apertureDir := apertureDataDir
@@ -474,16 +1227,23 @@ func getTLSConfig(serverName, baseDir string, autoCert bool) (
 	if autoCert {
 		serverName := serverName
 		if serverName == "" {
-			return nil, fmt.Errorf("servername option is " +
+			return nil, nil, fmt.Errorf("servername option is " +
 				"required for secure operation")
 		}
 
+		// Certificates that were cached in the local directory
+		// before are moved to etcd on first use. Without etcd, they're
+		// only cached in the local directory.
 		certDir := filepath.Join(apertureDir, "autocert")
-		log.Infof("Configuring autocert for server %v with cache dir "+
-			"%v", serverName, certDir)
+		log.Infof("Configuring autocert for server %v", serverName)
+
+		var cache autocert.Cache = autocert.DirCache(certDir)
+		if etcdClient != nil {
+			cache = newAutocertCache(etcdClient, cache)
+		}
 
 		manager := autocert.Manager{
-			Cache:      autocert.DirCache(certDir),
+			Cache:      cache,
 			Prompt:     autocert.AcceptTOS,
 			HostPolicy: autocert.HostWhitelist(serverName),
 		}
@@ -500,147 +1260,172 @@ func getTLSConfig(serverName, baseDir string, autoCert bool) (
 			GetCertificate: manager.GetCertificate,
 			CipherSuites:   http2TLSCipherSuites,
 			MinVersion:     tls.VersionTLS10,
-		}, nil
+		}, nil, nil
 	}
 
 	// If we're not using autocert, we want to create self-signed TLS certs
 	// and save them at the specified location (if they don't already
-	// exist).
+	// exist). They're renewed in the background while we're running.
 	tlsKeyFile := filepath.Join(apertureDir, defaultTLSKeyFilename)
 	tlsCertFile := filepath.Join(apertureDir, defaultTLSCertFilename)
-	tlsExtraDomains := []string{serverName}
-	if !fileExists(tlsCertFile) && !fileExists(tlsKeyFile) {
-		log.Infof("Generating TLS certificates...")
-		err := cert.GenCertPair(
-			selfSignedCertOrganization, tlsCertFile, tlsKeyFile,
-			nil, tlsExtraDomains, false, selfSignedCertValidity,
-		)
-		if err != nil {
-			return nil, err
-		}
-		log.Infof("Done generating TLS certificates")
-	}
-
-	// Load the certs now so we can inspect it and return a complete TLS
-	// config later.
-	certData, parsedCert, err := cert.LoadCert(tlsCertFile, tlsKeyFile)
+	renewer, err := newCertRenewer(
+		tlsCertFile, tlsKeyFile, []string{serverName},
+	)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// The margin is negative, so adding it to the expiry date should give
-	// us a date in about the middle of it's validity period.
-	expiryWithMargin := parsedCert.NotAfter.Add(
-		-1 * selfSignedCertExpiryMargin,
-	)
-
-	// We only want to renew a certificate that we created ourselves. If
-	// we are using a certificate that was passed to us (perhaps created by
-	// an externally running Let's Encrypt process) we aren't going to try
-	// to replace it.
-	isSelfSigned := len(parsedCert.Subject.Organization) > 0 &&
-		parsedCert.Subject.Organization[0] == selfSignedCertOrganization
-
-	// If the certificate expired or it was outdated, delete it and the TLS
-	// key and generate a new pair.
-	if isSelfSigned && time.Now().After(expiryWithMargin) {
-		log.Info("TLS certificate will expire soon, generating a " +
-			"new one")
-
-		err := os.Remove(tlsCertFile)
-		if err != nil {
-			return nil, err
-		}
-
-		err = os.Remove(tlsKeyFile)
-		if err != nil {
-			return nil, err
-		}
-
-		log.Infof("Renewing TLS certificates...")
-		err = cert.GenCertPair(
-			selfSignedCertOrganization, tlsCertFile, tlsKeyFile,
-			nil, nil, false, selfSignedCertValidity,
-		)
-		if err != nil {
-			return nil, err
-		}
-		log.Infof("Done renewing TLS certificates")
-
-		// Reload the certificate data.
-		certData, _, err = cert.LoadCert(tlsCertFile, tlsKeyFile)
-		if err != nil {
-			return nil, err
-		}
-	}
 	return &tls.Config{
-		Certificates: []tls.Certificate{certData},
-		CipherSuites: http2TLSCipherSuites,
-		MinVersion:   tls.VersionTLS10,
-	}, nil
+		GetCertificate: renewer.GetCertificate,
+		CipherSuites:   http2TLSCipherSuites,
+		MinVersion:     tls.VersionTLS10,
+	}, renewer, nil
 }
 
 // initTorListener initiates a Tor controller instance with the Tor server
 // specified in the config. Onion services will be created over which the proxy
-// can be reached at.
-func initTorListener(cfg *Config, etcd *clientv3.Client) (*tor.Controller, error) {
+// can be reached at. The addresses of the onion services are returned.
+func initTorListener(cfg *Config,
+	etcd *clientv3.Client) (*tor.Controller, []string, error) {
+
+	// The keys of the onion services are only kept in memory if there is
+	// no etcd, so their addresses change on restart.
+	var store tor.OnionStore = newMemOnionStore()
+	if etcd != nil {
+		store = newOnionStore(etcd)
+	}
+
 	// Establish a controller connection with the backing Tor server and
 	// proceed to create the requested onion services.
 	onionCfg := tor.AddOnionConfig{
 		VirtualPort: int(cfg.Tor.VirtualPort),
 		TargetPorts: []int{int(cfg.Tor.ListenPort)},
-		Store:       newOnionStore(etcd),
+		Store:       store,
 	}
 	torController := tor.NewController(cfg.Tor.Control, "", "")
 	if err := torController.Start(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	var addrs []string
+
 	if cfg.Tor.V2 {
 		onionCfg.Type = tor.V2
 		addr, err := torController.AddOnion(onionCfg)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		log.Infof("Listening over Tor on %v", addr)
+		addrs = append(addrs, addr.String())
 	}
 
 	if cfg.Tor.V3 {
 		onionCfg.Type = tor.V3
 		addr, err := torController.AddOnion(onionCfg)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		log.Infof("Listening over Tor on %v", addr)
+		addrs = append(addrs, addr.String())
 	}
 
-	return torController, nil
+	return torController, addrs, nil
 }
 
-// createProxy creates the proxy with all the services it needs.
-func createProxy(cfg *Config, challenger *LndChallenger,
-	etcdClient *clientv3.Client) (*proxy.Proxy, func(), error) {
+// urlSigningKey derives the key signed URLs are signed with from the key of the
+// response proofs, so instances that share one also accept the signed URLs of
+// each other.
+func urlSigningKey(proofKey ed25519.PrivateKey) []byte {
+	mac := hmac.New(sha256.New, proofKey.Seed())
+	_, _ = mac.Write([]byte("aperture signed url key"))
+	return mac.Sum(nil)
+}
+
+// newClientIPResolver creates the resolver of the addresses of clients behind
+// the configured trusted proxies.
+func newClientIPResolver(cfg *ClientIPConfig) (*proxy.ClientIPResolver,
+	error) {
+
+	trusted, err := parseNetworks(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
 
-	minter := mint.New(&mint.Config{
+	return proxy.NewClientIPResolver(cfg.Header, trusted)
+}
+
+// createProxy creates the proxy with all the services it needs and the mint it
+// issues tokens with.
+func createProxy(cfg *Config, challenger *LndChallenger, devNode *devNode,
+	etcdClient *clientv3.Client, secrets mint.SecretStore,
+	auditLog *audit.Log,
+	staticServices []*proxy.Service,
+	pageData func() *staticPageData) (*proxy.Proxy, *auditMinter, func(),
+	error) {
+
+	// The static mounts are served after all configured services.
+	services := make(
+		[]*proxy.Service, 0, len(cfg.Services)+len(staticServices),
+	)
+	services = append(services, cfg.Services...)
+	services = append(services, staticServices...)
+
+	mintCfg := &mint.Config{
 		Challenger:     challenger,
-		Secrets:        newSecretStore(etcdClient),
-		ServiceLimiter: newStaticServiceLimiter(cfg.Services),
-	})
-	authenticator := auth.NewLsatAuthenticator(minter, challenger)
+		Secrets:        secrets,
+		ServiceLimiter: newStaticServiceLimiter(services),
+	}
+	if etcdClient != nil {
+		mintCfg.Metadata = newMetadataStore(etcdClient)
+	}
+	if etcdClient != nil && cfg.Pruning != nil && cfg.Pruning.Enabled {
+		mintCfg.Index = newTokenIndex(etcdClient)
+	}
+
+	// All tokens are minted through the audited mint, so each of them is
+	// recorded in the audit log if there is one.
+	baseMint := &auditMinter{Mint: mint.New(mintCfg), auditLog: auditLog}
+
+	var checker auth.InvoiceChecker = challenger
+	if auditLog != nil {
+		checker = &auditInvoiceChecker{
+			InvoiceChecker: checker,
+			auditLog:       auditLog,
+		}
+	}
+
+	scheme := lsat.SchemeLSAT
+	if cfg.Authenticator != nil && cfg.Authenticator.Scheme != "" {
+		scheme = cfg.Authenticator.Scheme
+	}
+	authenticator := auth.NewLsatAuthenticatorWithScheme(
+		baseMint, checker, scheme,
+	)
+	if cfg.Authenticator != nil {
+		authenticator.SetCache(
+			cfg.Authenticator.CacheSize, cfg.Authenticator.CacheTTL,
+		)
+	}
 
 	// By default the static file server only returns 404 answers for
 	// security reasons. Serving files from the staticRoot directory has to
 	// be enabled intentionally.
 	staticServer := http.NotFoundHandler()
 	if cfg.ServeStatic {
-		if len(strings.TrimSpace(cfg.StaticRoot)) == 0 {
-			return nil, nil, fmt.Errorf("staticroot cannot be " +
-				"empty, must contain path to directory that " +
-				"contains index.html")
+		if len(strings.TrimSpace(cfg.StaticRoot)) == 0 &&
+			!cfg.StaticBucket.enabled() && cfg.StaticFS == nil {
+
+			return nil, nil, nil, fmt.Errorf("staticroot cannot " +
+				"be empty, must contain path to directory " +
+				"that contains index.html")
+		}
+		server, err := newRootStaticServer(cfg, pageData)
+		if err != nil {
+			return nil, nil, nil, err
 		}
-		staticServer = http.FileServer(http.Dir(cfg.StaticRoot))
+		staticServer = &staticMountHandler{server: server}
 	}
 
 	var (
@@ -651,7 +1436,7 @@ func createProxy(cfg *Config, challenger *LndChallenger,
 	if cfg.HashMail.Enabled {
 		hashMailServices, cleanup, err := createHashMailServer(cfg)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 
 		// Ensure we spin up the necessary HTTP server to allow
@@ -667,6 +1452,45 @@ func createProxy(cfg *Config, challenger *LndChallenger,
 		proxyCleanup = cleanup
 	}
 
+	if cfg.GRPCReflection {
+		reflectionService, cleanup, err := createReflectionServer(
+			cfg.Services,
+		)
+		if err != nil {
+			proxyCleanup()
+			return nil, nil, nil, err
+		}
+
+		localServices = append(localServices, reflectionService)
+		prevCleanup := proxyCleanup
+		proxyCleanup = func() {
+			cleanup()
+			prevCleanup()
+		}
+	}
+
+	if cfg.HealthCheck != nil && cfg.HealthCheck.Enabled {
+		healthService, cleanup, err := createHealthServer(
+			cfg.HealthCheck, cfg.Services,
+		)
+		if err != nil {
+			proxyCleanup()
+			return nil, nil, nil, err
+		}
+
+		localServices = append(localServices, healthService)
+		prevCleanup := proxyCleanup
+		proxyCleanup = func() {
+			cleanup()
+			prevCleanup()
+		}
+	}
+
+	// Invoices of the dev mode can be settled on demand.
+	if devNode != nil {
+		localServices = append(localServices, devNode.settleService())
+	}
+
 	// The static file server must be last since it will match all calls
 	// that make it to it.
 	localServices = append(localServices, proxy.NewLocalService(
@@ -675,8 +1499,145 @@ func createProxy(cfg *Config, challenger *LndChallenger,
 		},
 	))
 
-	prxy, err := proxy.New(authenticator, cfg.Services, localServices...)
-	return prxy, proxyCleanup, err
+	// Freebie counters are shared with all other instances through etcd if
+	// requested, otherwise each instance counts on its own.
+	var newFreebieDB freebie.DBCreator
+	if cfg.Etcd != nil && cfg.Etcd.SharedFreebies {
+		newFreebieDB = newFreebieStoreCreator(etcdClient)
+	}
+
+	prxy, err := proxy.NewWithFreebieDB(
+		authenticator, services, newFreebieDB, localServices...,
+	)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Response proofs and receipts are signed with a key that is loaded if
+	// any service signs its responses or receipts or a key was configured
+	// explicitly, so services that are added at run time can sign their
+	// responses as well. The key of signed URLs is derived from it.
+	signResponses := cfg.ProofKeyFile != ""
+	for _, service := range services {
+		signResponses = signResponses || service.SignResponses ||
+			service.Receipts || service.SignedURLs.Enabled
+	}
+	if signResponses {
+		keyFile := cfg.ProofKeyFile
+		if keyFile == "" {
+			baseDir := apertureDataDir
+			if cfg.BaseDir != "" {
+				baseDir = cfg.BaseDir
+			}
+			keyFile = filepath.Join(baseDir, defaultProofKeyFilename)
+		}
+
+		key, err := proof.LoadOrCreateKey(keyFile)
+		if err != nil {
+			proxyCleanup()
+			return nil, nil, nil, fmt.Errorf("unable to load "+
+				"proof key: %v", err)
+		}
+		prxy.SetResponseSigner(key)
+		prxy.SetURLSigningKey(urlSigningKey(key))
+		prxy.SetTokenChecker(baseMint)
+	}
+
+	// The nonces of requests, the delegated tokens and the request counts,
+	// message balances, top-ups, upgrades and transferred bytes of tokens
+	// are always kept in etcd, otherwise a request could be replayed and a
+	// balance or quota be spent again against another instance.
+	if etcdClient != nil {
+		prxy.SetNonceStore(newNonceStore(etcdClient))
+		prxy.SetBalanceStore(newBalanceStore(etcdClient))
+		prxy.SetTopUpStore(newTopUpStore(etcdClient))
+		prxy.SetUsageStore(newUsageStore(etcdClient))
+		prxy.SetTransferStore(newTransferStore(etcdClient))
+		prxy.SetUpgradeStore(newUpgradeStore(etcdClient))
+	}
+
+	// Delegated tokens are derived from their parent tokens by the proxy,
+	// so they're recorded in the audit log once they're stored.
+	delegations := proxy.NewMemDelegationStore()
+	if etcdClient != nil {
+		delegations = newDelegationStore(etcdClient)
+	}
+	if auditLog != nil {
+		delegations = &auditDelegationStore{
+			DelegationStore: delegations,
+			auditLog:        auditLog,
+		}
+	}
+	prxy.SetDelegationStore(delegations)
+
+	if cfg.CopyBufferSize > 0 {
+		prxy.SetCopyBufferSize(cfg.CopyBufferSize)
+	}
+
+	// The addresses of backends are cached and looked up with the
+	// configured DNS servers instead of the resolver of the system.
+	if cfg.DNS != nil && cfg.DNS.Enabled {
+		resolver, err := proxy.NewDNSResolver(cfg.DNS)
+		if err != nil {
+			proxyCleanup()
+			return nil, nil, nil, fmt.Errorf("unable to create "+
+				"DNS resolver: %v", err)
+		}
+		prxy.SetDNSResolver(resolver)
+	}
+
+	// Behind a CDN or other proxies, the address of clients is read from
+	// the header field the trusted ones forward it with.
+	if cfg.ClientIP != nil && cfg.ClientIP.Header != "" {
+		resolver, err := newClientIPResolver(cfg.ClientIP)
+		if err != nil {
+			proxyCleanup()
+			return nil, nil, nil, fmt.Errorf("unable to create "+
+				"client IP resolver: %v", err)
+		}
+		prxy.SetClientIPResolver(resolver)
+	}
+
+	// Single requests can be traced in detail with the trace secret.
+	if cfg.DebugTrace != nil && cfg.DebugTrace.Secret != "" {
+		prxy.SetTraceConfig(cfg.DebugTrace)
+	}
+
+	// The country of clients is looked up in a GeoIP database for the
+	// country rules of the services and their pricers.
+	if cfg.GeoIP != nil && cfg.GeoIP.Database != "" {
+		reader, err := geoip.Open(cfg.GeoIP.Database)
+		if err != nil {
+			proxyCleanup()
+			return nil, nil, nil, fmt.Errorf("unable to open "+
+				"GeoIP database: %v", err)
+		}
+		prxy.SetCountryResolver(&geoIPResolver{reader: reader})
+	}
+
+	// The payment page can look up the preimage of paid invoices and the
+	// amount paid for tokens through our challenger, as long as we have
+	// one. The invoices of top-ups and tier upgrades are created with it
+	// too.
+	if challenger != nil {
+		prxy.SetPreimageFetcher(challenger)
+		prxy.SetMacaroonVerifier(baseMint)
+		prxy.SetQueueReporter(challenger)
+		prxy.SetPaymentFetcher(challenger)
+		prxy.SetTopUpChallenger(challenger)
+		prxy.SetUpgradeChallenger(challenger)
+		prxy.SetTokenIssuer(baseMint)
+
+		if cfg.Authenticator.LNURL {
+			prxy.SetInvoiceFetcher(challenger)
+		}
+	}
+
+	// Trial tokens aren't paid for, so they are minted without the
+	// challenger.
+	prxy.SetTrialIssuer(baseMint)
+
+	return prxy, baseMint, proxyCleanup, nil
 }
 
 // createHashMailServer creates the gRPC server for the hash mail message
@@ -768,12 +1729,16 @@ func createHashMailServer(cfg *Config) ([]proxy.LocalService, func(), error) {
 }
 
 // cleanup closes the given server and shuts down the log rotator.
-func cleanup(etcdClient io.Closer, server io.Closer, proxy io.Closer) {
+func cleanup(etcdClient *clientv3.Client, server io.Closer,
+	proxy io.Closer) {
+
 	if err := proxy.Close(); err != nil {
 		log.Errorf("Error terminating proxy: %v", err)
 	}
-	if err := etcdClient.Close(); err != nil {
-		log.Errorf("Error terminating etcd client: %v", err)
+	if etcdClient != nil {
+		if err := etcdClient.Close(); err != nil {
+			log.Errorf("Error terminating etcd client: %v", err)
+		}
 	}
 	err := server.Close()
 	if err != nil {
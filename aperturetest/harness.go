@@ -0,0 +1,174 @@
+// Package aperturetest provides the building blocks to test LSAT integrations
+// against aperture hermetically: an in-process aperture that needs neither lnd
+// nor etcd and whose invoices are paid with fake payments, and mocks of the
+// lnd services in the lndmock package.
+package aperturetest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/lightninglabs/aperture"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/proxy/interoptest"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// MaxCost is the maximum price in satoshis the clients of the harness
+	// pay for a token.
+	MaxCost btcutil.Amount = 1000000
+
+	// settlePathPrefix is the path of the endpoint of the dev mode of
+	// aperture that settles an invoice and returns its preimage.
+	settlePathPrefix = "/.aperture/dev/settle/"
+)
+
+var (
+	// ChainParams are the parameters of the chain the invoices of the
+	// harness are issued for.
+	ChainParams = &chaincfg.RegressionNetParams
+)
+
+// Harness is an in-process aperture that runs in development mode. Its
+// invoices are created in memory and only settled when they're paid through
+// the harness, and all state is kept in memory.
+type Harness struct {
+	// Aperture is the running aperture instance.
+	Aperture *aperture.Aperture
+
+	// Addr is the address aperture listens on. It accepts plain text
+	// HTTP/1.1 and h2c requests.
+	Addr string
+
+	mu       sync.Mutex
+	payments int
+}
+
+// NewHarness starts aperture with the given configuration on a random local
+// port. The options aperture needs to run without lnd and etcd are set on the
+// configuration, so usually only the services need to be given. Aperture is
+// stopped once the test is done.
+func NewHarness(t *testing.T, cfg *aperture.Config) *Harness {
+	if cfg == nil {
+		cfg = &aperture.Config{}
+	}
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.Insecure = true
+	cfg.Dev = true
+	cfg.DevManualSettle = true
+	cfg.Store = "memory"
+	if cfg.Etcd == nil {
+		cfg.Etcd = &aperture.EtcdConfig{}
+	}
+	if cfg.Authenticator == nil {
+		cfg.Authenticator = &aperture.AuthConfig{}
+	}
+	if cfg.HashMail == nil {
+		cfg.HashMail = &aperture.HashMailConfig{}
+	}
+
+	a := aperture.NewAperture(cfg)
+	require.NoError(t, a.Start(make(chan error, 1)))
+	t.Cleanup(func() {
+		require.NoError(t, a.Stop())
+	})
+
+	return &Harness{
+		Aperture: a,
+		Addr:     a.Addr().String(),
+	}
+}
+
+// URL returns the base URL of aperture.
+func (h *Harness) URL() string {
+	return "http://" + h.Addr
+}
+
+// Pay settles the invoice of a payment challenge of aperture and returns its
+// preimage. It has the signature of an lsat.PayFunc, so it can be used to pay
+// the challenges of LSAT clients.
+func (h *Harness) Pay(ctx context.Context, payReq string,
+	_ btcutil.Amount) (*lsat.PaymentResult, error) {
+
+	invoice, err := zpay32.Decode(payReq, ChainParams)
+	if err != nil {
+		return nil, err
+	}
+	if invoice.PaymentHash == nil {
+		return nil, fmt.Errorf("invoice without payment hash")
+	}
+	hash := lntypes.Hash(*invoice.PaymentHash)
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, h.URL()+settlePathPrefix+hash.String(),
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to settle invoice %v: %v", hash,
+			resp.Status)
+	}
+
+	var settled struct {
+		Preimage string `json:"preimage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&settled); err != nil {
+		return nil, err
+	}
+	preimage, err := lntypes.MakePreimageFromStr(settled.Preimage)
+	if err != nil {
+		return nil, err
+	}
+
+	var amount lnwire.MilliSatoshi
+	if invoice.MilliSat != nil {
+		amount = *invoice.MilliSat
+	}
+
+	h.mu.Lock()
+	h.payments++
+	h.mu.Unlock()
+
+	return &lsat.PaymentResult{
+		Preimage:   preimage,
+		AmountPaid: amount,
+	}, nil
+}
+
+// NumPayments returns the number of invoices the harness paid so far.
+func (h *Harness) NumPayments() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.payments
+}
+
+// HTTPClient returns an HTTP client that pays the payment challenges of
+// aperture through the harness. Every client pays for its own token, which it
+// then attaches to all of its requests.
+func (h *Harness) HTTPClient() *http.Client {
+	return &http.Client{
+		Transport: lsat.NewTransportWithPayFunc(
+			nil, h.Pay, ChainParams, interoptest.NewTokenStore(),
+			MaxCost, 0,
+		),
+	}
+}
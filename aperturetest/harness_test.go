@@ -0,0 +1,53 @@
+package aperturetest_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/lightninglabs/aperture"
+	"github.com/lightninglabs/aperture/aperturetest"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightninglabs/aperture/proxy/interoptest"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHarness tests that clients of the harness pay for a token through the
+// dev mode of aperture once and then reach the backend with it.
+func TestHarness(t *testing.T) {
+	backend := interoptest.StartHTTPBackend(t, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("Hello"))
+		},
+	))
+	h := aperturetest.NewHarness(t, &aperture.Config{
+		Services: []*proxy.Service{{
+			Name:       "http",
+			Address:    backend,
+			Protocol:   "http",
+			HostRegexp: ".*",
+			PathRegexp: "^/http/.*$",
+			Auth:       "on",
+			Price:      10,
+		}},
+	})
+
+	// Clients without a token are challenged.
+	resp, err := http.Get(h.URL() + "/http/hello")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusPaymentRequired, resp.StatusCode)
+
+	client := h.HTTPClient()
+	for i := 0; i < 2; i++ {
+		resp, err = client.Get(h.URL() + "/http/hello")
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "Hello", string(body))
+		require.Equal(t, 1, h.NumPayments())
+	}
+}
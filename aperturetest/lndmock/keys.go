@@ -1,4 +1,4 @@
-package test
+package lndmock
 
 import (
 	"github.com/btcsuite/btcd/btcec"
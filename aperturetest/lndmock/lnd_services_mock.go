@@ -1,4 +1,6 @@
-package test
+// Package lndmock provides in-memory mocks of the lnd services, so code that
+// talks to lnd through lndclient can be tested without a Lightning node.
+package lndmock
 
 import (
 	"context"
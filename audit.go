@@ -0,0 +1,307 @@
+package aperture
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/aperture/audit"
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
+)
+
+// recordAudit records an event in the audit log, if there is one. A failure to
+// write the audit log doesn't fail the operation that is audited, it's only
+// logged.
+func recordAudit(auditLog *audit.Log, event string,
+	fields map[string]string) {
+
+	if auditLog == nil {
+		return
+	}
+
+	if err := auditLog.Record(event, fields); err != nil {
+		log.Errorf("Unable to record %s event in audit log: %v", event,
+			err)
+	}
+}
+
+// auditMinter records all tokens minted by the mint, like those paid for by
+// clients, batches, trial tokens and upgrades, and failed token verifications
+// in the audit log. Without an audit log, it only mints and verifies them.
+type auditMinter struct {
+	*mint.Mint
+
+	auditLog *audit.Log
+}
+
+// A compile-time constraint to ensure auditMinter implements auth.Minter.
+var _ auth.Minter = (*auditMinter)(nil)
+
+// recordMinted records the given newly minted tokens for the target services
+// in the audit log. The kind tells how they were minted if they weren't paid
+// for by a client directly.
+func (m *auditMinter) recordMinted(kind string, services []lsat.Service,
+	macs ...*macaroon.Macaroon) {
+
+	names := make([]string, 0, len(services))
+	for _, service := range services {
+		names = append(names, service.Name)
+	}
+
+	for _, mac := range macs {
+		fields := map[string]string{
+			"services": strings.Join(names, ","),
+		}
+		if kind != "" {
+			fields["kind"] = kind
+		}
+		id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+		if err == nil {
+			fields["token_id"] = id.TokenID.String()
+			fields["payment_hash"] = id.PaymentHash.String()
+		}
+		recordAudit(m.auditLog, audit.EventTokenMinted, fields)
+	}
+}
+
+// MintLSAT mints a new LSAT for the target services.
+//
+// NOTE: This is part of the auth.Minter interface.
+func (m *auditMinter) MintLSAT(ctx context.Context,
+	services ...lsat.Service) (*macaroon.Macaroon, string, error) {
+
+	mac, paymentRequest, err := m.Mint.MintLSAT(ctx, services...)
+	if err != nil {
+		return nil, "", err
+	}
+	m.recordMinted("", services, mac)
+
+	return mac, paymentRequest, nil
+}
+
+// MintLSATs mints the given number of LSATs for the target services that are
+// all paid for with a single invoice of their total price.
+func (m *auditMinter) MintLSATs(ctx context.Context, count int,
+	services ...lsat.Service) ([]*macaroon.Macaroon, string, error) {
+
+	macs, paymentRequest, err := m.Mint.MintLSATs(ctx, count, services...)
+	if err != nil {
+		return nil, "", err
+	}
+	m.recordMinted("batch", services, macs...)
+
+	return macs, paymentRequest, nil
+}
+
+// IssueLSAT mints a new LSAT for the target services that is paid for with the
+// invoice of the given payment hash.
+//
+// NOTE: This is part of the proxy.TokenIssuer interface.
+func (m *auditMinter) IssueLSAT(ctx context.Context, paymentHash lntypes.Hash,
+	services ...lsat.Service) (*macaroon.Macaroon, error) {
+
+	mac, err := m.Mint.IssueLSAT(ctx, paymentHash, services...)
+	if err != nil {
+		return nil, err
+	}
+	m.recordMinted("upgrade", services, mac)
+
+	return mac, nil
+}
+
+// MintTrialLSAT mints a new trial LSAT for the target services that doesn't
+// need to be paid for.
+//
+// NOTE: This is part of the proxy.TrialIssuer interface.
+func (m *auditMinter) MintTrialLSAT(ctx context.Context,
+	services ...lsat.Service) (*macaroon.Macaroon, lntypes.Preimage,
+	error) {
+
+	mac, preimage, err := m.Mint.MintTrialLSAT(ctx, services...)
+	if err != nil {
+		return nil, lntypes.Preimage{}, err
+	}
+	m.recordMinted("trial", services, mac)
+
+	return mac, preimage, nil
+}
+
+// VerifyLSAT attempts to verify an LSAT with the given parameters.
+//
+// NOTE: This is part of the auth.Minter interface.
+func (m *auditMinter) VerifyLSAT(ctx context.Context,
+	params *mint.VerificationParams) error {
+
+	err := m.Mint.VerifyLSAT(ctx, params)
+	if err != nil {
+		fields := map[string]string{
+			"service": params.TargetService,
+			"reason":  err.Error(),
+		}
+		id, decodeErr := lsat.DecodeIdentifier(
+			bytes.NewReader(params.Macaroon.Id()),
+		)
+		if decodeErr == nil {
+			fields["token_id"] = id.TokenID.String()
+		}
+		recordAudit(m.auditLog, audit.EventAuthFailure, fields)
+	}
+
+	return err
+}
+
+// auditDelegationStore records the tokens that were delegated by their holders
+// and revoked delegations in the audit log. Delegated tokens are derived from
+// the token of their holder by the proxy instead of the mint, so they're
+// recorded once they're stored.
+type auditDelegationStore struct {
+	proxy.DelegationStore
+
+	auditLog *audit.Log
+}
+
+// A compile-time constraint to ensure auditDelegationStore implements
+// proxy.DelegationStore.
+var _ proxy.DelegationStore = (*auditDelegationStore)(nil)
+
+// AddDelegation stores a new delegation.
+//
+// NOTE: This is part of the proxy.DelegationStore interface.
+func (s *auditDelegationStore) AddDelegation(ctx context.Context,
+	delegation *proxy.Delegation) error {
+
+	err := s.DelegationStore.AddDelegation(ctx, delegation)
+	if err == nil {
+		fields := map[string]string{
+			"kind":          "delegation",
+			"delegation_id": delegation.ID,
+			"owner":         delegation.Owner,
+		}
+		recordAudit(s.auditLog, audit.EventTokenMinted, fields)
+	}
+
+	return err
+}
+
+// RevokeDelegation revokes the delegation with the given ID if it belongs to
+// the given owner.
+//
+// NOTE: This is part of the proxy.DelegationStore interface.
+func (s *auditDelegationStore) RevokeDelegation(ctx context.Context, owner,
+	id string) (bool, error) {
+
+	ok, err := s.DelegationStore.RevokeDelegation(ctx, owner, id)
+	if err == nil && ok {
+		fields := map[string]string{
+			"delegation_id": id,
+			"owner":         owner,
+		}
+		recordAudit(s.auditLog, audit.EventTokenRevoked, fields)
+	}
+
+	return ok, err
+}
+
+// auditInvoiceChecker records tokens that were rejected because their invoice
+// wasn't paid in the audit log.
+type auditInvoiceChecker struct {
+	auth.InvoiceChecker
+
+	auditLog *audit.Log
+}
+
+// A compile-time constraint to ensure auditInvoiceChecker implements
+// auth.InvoiceChecker.
+var _ auth.InvoiceChecker = (*auditInvoiceChecker)(nil)
+
+// VerifyInvoiceStatus checks that an invoice identified by a payment hash has
+// the desired status.
+//
+// NOTE: This is part of the auth.InvoiceChecker interface.
+func (c *auditInvoiceChecker) VerifyInvoiceStatus(hash lntypes.Hash,
+	state lnrpc.Invoice_InvoiceState, timeout time.Duration) error {
+
+	err := c.InvoiceChecker.VerifyInvoiceStatus(hash, state, timeout)
+	if err != nil {
+		recordAudit(c.auditLog, audit.EventAuthFailure, map[string]string{
+			"payment_hash": hash.String(),
+			"reason":       err.Error(),
+		})
+	}
+
+	return err
+}
+
+// auditSecretStore records revoked secrets in the audit log.
+type auditSecretStore struct {
+	mint.SecretStore
+
+	auditLog *audit.Log
+}
+
+// A compile-time constraint to ensure auditSecretStore implements
+// mint.SecretStore.
+var _ mint.SecretStore = (*auditSecretStore)(nil)
+
+// RevokeSecret removes the cryptographically random secret that corresponds to
+// the given hash.
+//
+// NOTE: This is part of the mint.SecretStore interface.
+func (s *auditSecretStore) RevokeSecret(ctx context.Context,
+	id [sha256.Size]byte) error {
+
+	err := s.SecretStore.RevokeSecret(ctx, id)
+	if err == nil {
+		recordAudit(s.auditLog, audit.EventTokenRevoked, map[string]string{
+			"id_hash": hex.EncodeToString(id[:]),
+		})
+	}
+
+	return err
+}
+
+// auditResponseWriter remembers the status code of a response.
+type auditResponseWriter struct {
+	http.ResponseWriter
+
+	status int
+}
+
+// WriteHeader remembers the status code and sends it.
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// auditHandler records every request to the given handler in the audit log.
+func auditHandler(auditLog *audit.Log, next http.Handler) http.Handler {
+	if auditLog == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writer := &auditResponseWriter{
+			ResponseWriter: w,
+			status:         http.StatusOK,
+		}
+		next.ServeHTTP(writer, r)
+
+		recordAudit(auditLog, audit.EventAdminCall, map[string]string{
+			"method": r.Method,
+			"path":   r.URL.Path,
+			"remote": r.RemoteAddr,
+			"status": strconv.Itoa(writer.status),
+		})
+	})
+}
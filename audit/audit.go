@@ -0,0 +1,417 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// EventTokenMinted is recorded when a new token was minted.
+	EventTokenMinted = "token_minted"
+
+	// EventTokenRevoked is recorded when the secret of a token was
+	// revoked.
+	EventTokenRevoked = "token_revoked"
+
+	// EventAuthFailure is recorded when a client presented a token that
+	// was rejected.
+	EventAuthFailure = "auth_failure"
+
+	// EventAdminCall is recorded for every call to the admin API.
+	EventAdminCall = "admin_call"
+
+	// EventConfigReload is recorded when a new configuration was applied
+	// at run time.
+	EventConfigReload = "config_reload"
+
+	// DefaultMaxFileSize is the default size in bytes after which the
+	// audit log file is rotated.
+	DefaultMaxFileSize = 100 * 1024 * 1024
+
+	// rotatedTimeFormat is the time format used in the names of rotated
+	// audit log files. It sorts in chronological order.
+	rotatedTimeFormat = "20060102T150405.000000000Z"
+)
+
+var (
+	// ErrChainBroken is returned when verifying an audit log whose entries
+	// were modified, removed or reordered.
+	ErrChainBroken = errors.New("audit log hash chain broken")
+)
+
+// Config holds the settings of the audit log.
+type Config struct {
+	// File is the path of the current audit log file. Rotated files are
+	// placed next to it.
+	File string
+
+	// MaxFileSize is the size in bytes after which the file is rotated.
+	MaxFileSize int64
+
+	// MaxFiles is the number of rotated files that are kept. Zero keeps
+	// all of them.
+	MaxFiles int
+
+	// MaxAge is the time after which rotated files are removed. Zero keeps
+	// them forever.
+	MaxAge time.Duration
+
+	// Key is the secret the hashes of the entries are keyed with. Without
+	// it, anyone who can write the file can also rewrite the whole chain,
+	// so only the key makes the log tamper-evident.
+	Key []byte
+}
+
+// Entry is a single event of the audit log. Every entry contains the hash of
+// the previous one, so modifying, removing or reordering entries breaks the
+// chain, which is detected by Verify. If the log has a key, the hashes are
+// keyed with it, so the chain can't be recalculated without it. Entries that
+// are cut off at the end can only be detected by comparing the head of the
+// chain with one recorded elsewhere, see Log.Head.
+type Entry struct {
+	// Seq is the sequence number of the entry, starting at one.
+	Seq uint64 `json:"seq"`
+
+	// Time is the time the event was recorded.
+	Time time.Time `json:"time"`
+
+	// Event is the type of the event.
+	Event string `json:"event"`
+
+	// Fields are the details of the event.
+	Fields map[string]string `json:"fields,omitempty"`
+
+	// PrevHash is the hash of the previous entry, empty for the first
+	// entry.
+	PrevHash string `json:"prev_hash"`
+
+	// Hash is the hash of this entry, calculated over all other fields.
+	Hash string `json:"hash"`
+}
+
+// hash calculates the hash of the entry over all fields except the hash
+// itself, keyed with the given key if there is one.
+func (e *Entry) hash(key []byte) (string, error) {
+	unhashed := *e
+	unhashed.Hash = ""
+
+	// Map keys are sorted by the JSON encoder, so the encoding is stable.
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+
+	if len(key) == 0 {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:]), nil
+	}
+
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Log is an append-only audit log. It's kept separate from the debug log, so
+// it has its own file and retention settings and isn't affected by the debug
+// level.
+type Log struct {
+	cfg Config
+
+	file     *os.File
+	size     int64
+	lastSeq  uint64
+	lastHash string
+
+	now func() time.Time
+	mtx sync.Mutex
+}
+
+// New opens the audit log file of the configuration. If the file already
+// exists, new entries continue its hash chain.
+func New(cfg *Config) (*Log, error) {
+	if cfg.File == "" {
+		return nil, fmt.Errorf("audit log file must be set")
+	}
+
+	l := &Log{
+		cfg: *cfg,
+		now: time.Now,
+	}
+	if l.cfg.MaxFileSize <= 0 {
+		l.cfg.MaxFileSize = DefaultMaxFileSize
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cfg.File), 0700); err != nil {
+		return nil, err
+	}
+
+	// Continue the chain of the current file or, if it's still empty, the
+	// one of the most recently rotated file.
+	last, err := lastEntry(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	if last == nil {
+		rotated, err := RotatedFiles(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		if len(rotated) > 0 {
+			last, err = lastEntry(rotated[len(rotated)-1])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if last != nil {
+		l.lastSeq, l.lastHash = last.Seq, last.Hash
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// open opens the current audit log file for appending.
+func (l *Log) open() error {
+	file, err := os.OpenFile(
+		l.cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600,
+	)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// Record appends an event with the given details to the audit log.
+func (l *Log) Record(event string, fields map[string]string) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.file == nil {
+		return fmt.Errorf("audit log closed")
+	}
+
+	entry := &Entry{
+		Seq:      l.lastSeq + 1,
+		Time:     l.now().UTC(),
+		Event:    event,
+		Fields:   fields,
+		PrevHash: l.lastHash,
+	}
+	hash, err := entry.hash(l.cfg.Key)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if l.size > 0 && l.size+int64(len(line)) > l.cfg.MaxFileSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("unable to rotate audit log: %v", err)
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	l.lastSeq, l.lastHash = entry.Seq, entry.Hash
+	return nil
+}
+
+// Head returns the sequence number and hash of the last entry of the log. They
+// can be recorded outside of the log, so entries that are cut off at its end
+// are detected.
+func (l *Log) Head() (uint64, string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.lastSeq, l.lastHash
+}
+
+// Close closes the audit log file.
+func (l *Log) Close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// rotate moves the current file aside, opens a new one and removes rotated
+// files that are no longer retained. The hash chain continues in the new file.
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+
+	rotated := l.cfg.File + "." + l.now().UTC().Format(rotatedTimeFormat)
+	if err := os.Rename(l.cfg.File, rotated); err != nil {
+		return err
+	}
+
+	if err := l.open(); err != nil {
+		return err
+	}
+
+	return l.prune()
+}
+
+// prune removes the rotated files that exceed the configured retention.
+func (l *Log) prune() error {
+	files, err := RotatedFiles(l.cfg.File)
+	if err != nil {
+		return err
+	}
+
+	var remove []string
+	if l.cfg.MaxFiles > 0 && len(files) > l.cfg.MaxFiles {
+		remove = files[:len(files)-l.cfg.MaxFiles]
+		files = files[len(files)-l.cfg.MaxFiles:]
+	}
+
+	if l.cfg.MaxAge > 0 {
+		cutoff := l.now().UTC().Add(-l.cfg.MaxAge)
+		for _, file := range files {
+			rotatedAt, err := time.Parse(
+				rotatedTimeFormat,
+				strings.TrimPrefix(file, l.cfg.File+"."),
+			)
+			if err == nil && rotatedAt.Before(cutoff) {
+				remove = append(remove, file)
+			}
+		}
+	}
+
+	for _, file := range remove {
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RotatedFiles returns the rotated files of the given audit log file, oldest
+// first.
+func RotatedFiles(file string) ([]string, error) {
+	matches, err := filepath.Glob(file + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// Verify reads all entries of an audit log and checks that they form an
+// unbroken hash chain starting after the entry with the given hash, keyed with
+// the given key of the log if it has one. The hash of the last entry is
+// returned, so the rotated files of a log can be verified one after another,
+// starting with an empty hash for the oldest one.
+func Verify(r io.Reader, prevHash string, key []byte) (string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+
+	var prevSeq uint64
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return "", fmt.Errorf("invalid audit log entry: %v", err)
+		}
+
+		hash, err := entry.hash(key)
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case !hmac.Equal([]byte(hash), []byte(entry.Hash)):
+			return "", fmt.Errorf("%w: entry %d was modified",
+				ErrChainBroken, entry.Seq)
+
+		case entry.PrevHash != prevHash:
+			return "", fmt.Errorf("%w: entry %d doesn't follow the "+
+				"previous entry", ErrChainBroken, entry.Seq)
+
+		case prevSeq != 0 && entry.Seq != prevSeq+1:
+			return "", fmt.Errorf("%w: entry %d follows entry %d",
+				ErrChainBroken, entry.Seq, prevSeq)
+		}
+
+		prevHash, prevSeq = entry.Hash, entry.Seq
+	}
+
+	return prevHash, scanner.Err()
+}
+
+// lastEntry returns the last entry of the given audit log file, or nil if the
+// file doesn't exist or is empty.
+func lastEntry(file string) (*Entry, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+
+	var last []byte
+	for scanner.Scan() {
+		last = append(last[:0], scanner.Bytes()...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(last) == 0 {
+		return nil, nil
+	}
+
+	var entry Entry
+	if err := json.Unmarshal(last, &entry); err != nil {
+		return nil, fmt.Errorf("invalid last entry in audit log %s: %v",
+			file, err)
+	}
+	return &entry, nil
+}
@@ -0,0 +1,197 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// verifyFiles verifies the rotated files and the current file of an audit log
+// with the given key as one chain.
+func verifyFiles(t *testing.T, file string, key []byte) error {
+	rotated, err := RotatedFiles(file)
+	require.NoError(t, err)
+
+	var prevHash string
+	for _, f := range append(rotated, file) {
+		data, err := ioutil.ReadFile(f)
+		require.NoError(t, err)
+
+		prevHash, err = Verify(bytes.NewReader(data), prevHash, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// TestAuditLogChain tests that the entries of the audit log form a hash chain
+// that continues across restarts and rotations and that tampering with it is
+// detected.
+func TestAuditLogChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "audit.log")
+	now := time.Unix(1600000000, 0)
+
+	newLog := func() *Log {
+		l, err := New(&Config{File: file, MaxFileSize: 600})
+		require.NoError(t, err)
+		l.now = func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		}
+		return l
+	}
+
+	l := newLog()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, l.Record(EventTokenMinted, map[string]string{
+			"service": "service1",
+		}))
+	}
+	require.NoError(t, l.Close())
+
+	// A restarted log continues the chain and rotates once the file is
+	// full.
+	l = newLog()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, l.Record(EventAuthFailure, map[string]string{
+			"reason": "invalid preimage",
+		}))
+	}
+	require.NoError(t, l.Close())
+	require.Equal(t, uint64(8), l.lastSeq)
+
+	rotated, err := RotatedFiles(file)
+	require.NoError(t, err)
+	require.NotEmpty(t, rotated)
+	require.NoError(t, verifyFiles(t, file, nil))
+
+	// Changing a single field of an entry must be detected.
+	data, err := ioutil.ReadFile(rotated[0])
+	require.NoError(t, err)
+	tampered := bytes.Replace(
+		data, []byte("service1"), []byte("service2"), 1,
+	)
+	require.NoError(t, ioutil.WriteFile(rotated[0], tampered, 0600))
+
+	err = verifyFiles(t, file, nil)
+	require.True(t, errors.Is(err, ErrChainBroken))
+
+	// Removing an entry must be detected as well.
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	removed := bytes.Join(append(lines[:1:1], lines[2:]...), nil)
+	require.NoError(t, ioutil.WriteFile(rotated[0], removed, 0600))
+
+	err = verifyFiles(t, file, nil)
+	require.True(t, errors.Is(err, ErrChainBroken))
+}
+
+// TestAuditLogKey tests that the chain of an audit log with a key can't be
+// recalculated without it.
+func TestAuditLogKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "audit.log")
+	key := []byte("audit key")
+	l, err := New(&Config{File: file, Key: key})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, l.Record(EventTokenMinted, map[string]string{
+			"service": "service1",
+		}))
+	}
+	seq, head := l.Head()
+	require.Equal(t, uint64(3), seq)
+	require.NoError(t, l.Close())
+
+	require.NoError(t, verifyFiles(t, file, key))
+	require.Error(t, verifyFiles(t, file, []byte("other key")))
+
+	// Rewriting the whole chain without the key is detected.
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	var (
+		rewritten bytes.Buffer
+		prevHash  string
+	)
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var entry Entry
+		require.NoError(t, json.Unmarshal(line, &entry))
+		entry.Fields["service"] = "service2"
+		entry.PrevHash = prevHash
+		entry.Hash, err = entry.hash(nil)
+		require.NoError(t, err)
+		prevHash = entry.Hash
+
+		line, err := json.Marshal(&entry)
+		require.NoError(t, err)
+		rewritten.Write(append(line, '\n'))
+	}
+	require.NoError(t, ioutil.WriteFile(file, rewritten.Bytes(), 0600))
+
+	require.NoError(t, verifyFiles(t, file, nil))
+	err = verifyFiles(t, file, key)
+	require.True(t, errors.Is(err, ErrChainBroken))
+
+	// A restarted log continues at the head of the chain.
+	require.NoError(t, ioutil.WriteFile(file, data, 0600))
+	l, err = New(&Config{File: file, Key: key})
+	require.NoError(t, err)
+	defer l.Close()
+	seq, hash := l.Head()
+	require.Equal(t, uint64(3), seq)
+	require.Equal(t, head, hash)
+}
+
+// TestAuditLogRetention tests that rotated files are removed according to the
+// retention settings.
+func TestAuditLogRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "audit.log")
+	l, err := New(&Config{File: file, MaxFileSize: 1, MaxFiles: 2})
+	require.NoError(t, err)
+	defer l.Close()
+
+	now := time.Unix(1600000000, 0)
+	l.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	// Every entry exceeds the maximum size, so each one after the first
+	// rotates the file.
+	for i := 0; i < 5; i++ {
+		require.NoError(t, l.Record(EventAdminCall, nil))
+	}
+
+	rotated, err := RotatedFiles(file)
+	require.NoError(t, err)
+	require.Len(t, rotated, 2)
+
+	// With a maximum age, files that were rotated too long ago are
+	// removed as well.
+	l.cfg.MaxAge = 5 * time.Minute
+	now = now.Add(10 * time.Minute)
+	require.NoError(t, l.Record(EventAdminCall, nil))
+
+	rotated, err = RotatedFiles(file)
+	require.NoError(t, err)
+	require.Len(t, rotated, 1)
+}
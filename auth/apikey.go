@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// DefaultAPIKeyHeader is the default header field that carries the API
+	// key of a request.
+	DefaultAPIKeyHeader = "X-Api-Key"
+
+	// bearerPrefix is the prefix of API keys that are sent in the
+	// Authorization header field.
+	bearerPrefix = "Bearer "
+)
+
+// APIKeyAuthenticator is an authenticator that accepts requests that carry one
+// of a fixed set of API keys in a header field. It can't issue challenges, so
+// it's meant to be chained with an authenticator that can.
+type APIKeyAuthenticator struct {
+	header string
+	hashes [][sha256.Size]byte
+}
+
+// A compile time flag to ensure the APIKeyAuthenticator satisfies the
+// ContextAuthenticator interface.
+var _ ContextAuthenticator = (*APIKeyAuthenticator)(nil)
+
+// NewAPIKeyAuthenticator creates a new authenticator that accepts the given
+// keys in the given header field, or DefaultAPIKeyHeader if it's empty. Keys
+// in the Authorization header field are sent with the Bearer scheme.
+func NewAPIKeyAuthenticator(header string, keys []string) *APIKeyAuthenticator {
+	if header == "" {
+		header = DefaultAPIKeyHeader
+	}
+
+	// Only the hashes of the keys are compared, so the comparison takes
+	// the same time for keys of all lengths.
+	hashes := make([][sha256.Size]byte, 0, len(keys))
+	for _, key := range keys {
+		hashes = append(hashes, sha256.Sum256([]byte(key)))
+	}
+
+	return &APIKeyAuthenticator{
+		header: http.CanonicalHeaderKey(header),
+		hashes: hashes,
+	}
+}
+
+// Accept returns whether or not the header successfully authenticates the user
+// to a given backend service.
+//
+// NOTE: This is part of the Authenticator interface.
+func (a *APIKeyAuthenticator) Accept(header *http.Header,
+	serviceName string) bool {
+
+	return a.AcceptContext(context.Background(), header, serviceName)
+}
+
+// AcceptContext returns whether or not the header carries one of the API keys.
+//
+// NOTE: This is part of the ContextAuthenticator interface.
+func (a *APIKeyAuthenticator) AcceptContext(ctx context.Context,
+	header *http.Header, _ string) bool {
+
+	key := header.Get(a.header)
+	if a.header == "Authorization" {
+		if !strings.HasPrefix(key, bearerPrefix) {
+			key = ""
+		}
+		key = strings.TrimPrefix(key, bearerPrefix)
+	}
+	if key == "" {
+		lsat.Trace(ctx, "No API key in header field %s", a.header)
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(key))
+	var match int
+	for _, candidate := range a.hashes {
+		match |= subtle.ConstantTimeCompare(hash[:], candidate[:])
+	}
+	if match != 1 {
+		log.Debugf("Deny: Unknown API key")
+		lsat.Trace(ctx, "Unknown API key in header field %s", a.header)
+		return false
+	}
+
+	lsat.Trace(ctx, "API key accepted")
+	return true
+}
+
+// FreshChallengeHeader always returns ErrNoChallenge since clients can't obtain
+// an API key by completing a challenge.
+//
+// NOTE: This is part of the Authenticator interface.
+func (a *APIKeyAuthenticator) FreshChallengeHeader(*http.Request, string,
+	int64) (http.Header, error) {
+
+	return nil, ErrNoChallenge
+}
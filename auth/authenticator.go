@@ -1,14 +1,19 @@
 package auth
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"fmt"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/lightninglabs/aperture/lsat"
 	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
 )
 
 // LsatAuthenticator is an authenticator that uses the LSAT protocol to
@@ -16,21 +21,54 @@ import (
 type LsatAuthenticator struct {
 	minter  Minter
 	checker InvoiceChecker
+	scheme  string
+	cache   *verificationCache
 }
 
 // A compile time flag to ensure the LsatAuthenticator satisfies the
-// Authenticator interface.
-var _ Authenticator = (*LsatAuthenticator)(nil)
+// ContextAuthenticator interface.
+var _ ContextAuthenticator = (*LsatAuthenticator)(nil)
+
+// A compile time flag to ensure the LsatAuthenticator satisfies the
+// RenewalAuthenticator interface.
+var _ RenewalAuthenticator = (*LsatAuthenticator)(nil)
 
 // NewLsatAuthenticator creates a new authenticator that authenticates requests
-// based on LSAT tokens.
+// based on LSAT tokens. Challenges are issued with the legacy LSAT scheme name.
 func NewLsatAuthenticator(minter Minter,
 	checker InvoiceChecker) *LsatAuthenticator {
 
+	return NewLsatAuthenticatorWithScheme(minter, checker, lsat.SchemeLSAT)
+}
+
+// NewLsatAuthenticatorWithScheme creates a new authenticator that
+// authenticates requests based on LSAT tokens and issues challenges with the
+// given scheme name. Tokens are accepted under both the LSAT and the L402
+// scheme name, independent of the advertised one.
+func NewLsatAuthenticatorWithScheme(minter Minter, checker InvoiceChecker,
+	scheme string) *LsatAuthenticator {
+
 	return &LsatAuthenticator{
 		minter:  minter,
 		checker: checker,
+		scheme:  scheme,
+	}
+}
+
+// SetCache makes the authenticator cache up to size successful verifications
+// of tokens for ttl, or DefaultCacheTTL if it's zero. Tokens that are accepted
+// from the cache aren't verified against the secret store and lnd again, so
+// revoked tokens are accepted until their verifications expire. A size of zero
+// disables the cache.
+func (l *LsatAuthenticator) SetCache(size int, ttl time.Duration) {
+	if size <= 0 {
+		l.cache = nil
+		return
+	}
+	if ttl == 0 {
+		ttl = DefaultCacheTTL
 	}
+	l.cache = newVerificationCache(size, ttl)
 }
 
 // Accept returns whether or not the header successfully authenticates the user
@@ -38,26 +76,60 @@ func NewLsatAuthenticator(minter Minter,
 //
 // NOTE: This is part of the Authenticator interface.
 func (l *LsatAuthenticator) Accept(header *http.Header, serviceName string) bool {
+	return l.AcceptContext(context.Background(), header, serviceName)
+}
+
+// AcceptContext returns whether or not the header successfully authenticates
+// the user to a given backend service. LSATs that are bound to a client are
+// verified against the client IP and TLS channel binding found in the context.
+//
+// NOTE: This is part of the ContextAuthenticator interface.
+func (l *LsatAuthenticator) AcceptContext(ctx context.Context,
+	header *http.Header, serviceName string) bool {
+
 	// Try reading the macaroon and preimage from the HTTP header. This can
 	// be in different header fields depending on the implementation and/or
 	// protocol.
 	mac, preimage, err := lsat.FromHeader(header)
 	if err != nil {
 		log.Debugf("Deny: %v", err)
+		lsat.Trace(ctx, "No valid LSAT in request: %v", err)
 		return false
 	}
 
-	verificationParams := &mint.VerificationParams{
-		Macaroon:      mac,
-		Preimage:      preimage,
-		TargetService: serviceName,
+	// Hot clients send the same token with the same request properties
+	// over and over, which only needs to be verified once in a while.
+	params := verificationParams(ctx, mac, preimage, serviceName)
+	var (
+		key       cacheKey
+		cacheable bool
+	)
+	if l.cache != nil {
+		key, cacheable = verificationKey(params)
+	}
+	if cacheable && l.cache.get(key, time.Now()) {
+		lsat.Trace(ctx, "LSAT accepted for %s from cache", serviceName)
+		return true
 	}
-	err = l.minter.VerifyLSAT(context.Background(), verificationParams)
+
+	err = l.minter.VerifyLSAT(ctx, params)
 	if err != nil {
 		log.Debugf("Deny: LSAT validation failed: %v", err)
+		lsat.Trace(ctx, "LSAT validation for %s failed: %v",
+			serviceName, err)
 		return false
 	}
 
+	// Trial LSATs don't have an invoice.
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err == nil && lsat.IsTrialIdentifier(id) {
+		lsat.Trace(ctx, "Trial LSAT accepted for %s", serviceName)
+		if cacheable {
+			l.cache.put(key, params, time.Now())
+		}
+		return true
+	}
+
 	// Make sure the backend has the invoice recorded as settled.
 	err = l.checker.VerifyInvoiceStatus(
 		preimage.Hash(), lnrpc.Invoice_SETTLED,
@@ -65,12 +137,92 @@ func (l *LsatAuthenticator) Accept(header *http.Header, serviceName string) bool
 	)
 	if err != nil {
 		log.Debugf("Deny: Invoice status mismatch: %v", err)
+		lsat.Trace(ctx, "Invoice %v of LSAT not settled: %v",
+			preimage.Hash(), err)
 		return false
 	}
 
+	if cacheable {
+		l.cache.put(key, params, time.Now())
+	}
+	lsat.Trace(ctx, "LSAT accepted for %s", serviceName)
 	return true
 }
 
+// ExpiredToken returns the ID and expiry of the token in the header if it's a
+// valid, paid token for the given backend service that is only rejected
+// because it expired and its grace period is over.
+//
+// NOTE: This is part of the RenewalAuthenticator interface.
+func (l *LsatAuthenticator) ExpiredToken(ctx context.Context,
+	header *http.Header, serviceName string) (lsat.TokenID, time.Time,
+	bool) {
+
+	mac, preimage, err := lsat.FromHeader(header)
+	if err != nil {
+		return lsat.TokenID{}, time.Time{}, false
+	}
+
+	// The token must be expired for the service, but valid in all other
+	// respects at the moment it expired.
+	expiry, ok := lsat.ValidUntil(mac, serviceName)
+	if !ok {
+		return lsat.TokenID{}, time.Time{}, false
+	}
+	params := verificationParams(ctx, mac, preimage, serviceName)
+	if !time.Now().After(expiry.Add(params.GracePeriod)) {
+		return lsat.TokenID{}, time.Time{}, false
+	}
+	params.Now = expiry
+	if err := l.minter.VerifyLSAT(ctx, params); err != nil {
+		return lsat.TokenID{}, time.Time{}, false
+	}
+
+	err = l.checker.VerifyInvoiceStatus(
+		preimage.Hash(), lnrpc.Invoice_SETTLED,
+		DefaultInvoiceLookupTimeout,
+	)
+	if err != nil {
+		return lsat.TokenID{}, time.Time{}, false
+	}
+
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return lsat.TokenID{}, time.Time{}, false
+	}
+
+	return id.TokenID, expiry, true
+}
+
+// verificationParams returns the parameters to verify an LSAT for the given
+// backend service with, using the client properties found in the given
+// context.
+func verificationParams(ctx context.Context, mac *macaroon.Macaroon,
+	preimage lntypes.Preimage,
+	serviceName string) *mint.VerificationParams {
+
+	clientIP, _ := lsat.FromContext(ctx, lsat.KeyClientIP).(net.IP)
+	tlsBinding, _ := lsat.FromContext(ctx, lsat.KeyTLSBinding).([]byte)
+	targetPath, _ := lsat.FromContext(ctx, lsat.KeyRequestPath).(string)
+	targetMethod, _ := lsat.FromContext(
+		ctx, lsat.KeyRequestMethod,
+	).(string)
+	gracePeriod, _ := lsat.FromContext(
+		ctx, lsat.KeyGracePeriod,
+	).(time.Duration)
+
+	return &mint.VerificationParams{
+		Macaroon:      mac,
+		Preimage:      preimage,
+		TargetService: serviceName,
+		ClientIP:      clientIP,
+		TLSBinding:    tlsBinding,
+		TargetPath:    targetPath,
+		TargetMethod:  targetMethod,
+		GracePeriod:   gracePeriod,
+	}
+}
+
 // FreshChallengeHeader returns a header containing a challenge for the user to
 // complete.
 //
@@ -83,9 +235,7 @@ func (l *LsatAuthenticator) FreshChallengeHeader(r *http.Request,
 		Tier:  lsat.BaseTier,
 		Price: servicePrice,
 	}
-	mac, paymentRequest, err := l.minter.MintLSAT(
-		context.Background(), service,
-	)
+	mac, paymentRequest, err := l.minter.MintLSAT(r.Context(), service)
 	if err != nil {
 		log.Errorf("Error minting LSAT: %v", err)
 		return nil, err
@@ -95,7 +245,7 @@ func (l *LsatAuthenticator) FreshChallengeHeader(r *http.Request,
 		log.Errorf("Error serializing LSAT: %v", err)
 	}
 
-	str := fmt.Sprintf("LSAT macaroon=\"%s\", invoice=\"%s\"",
+	str := fmt.Sprintf("%s macaroon=\"%s\", invoice=\"%s\"", l.scheme,
 		base64.StdEncoding.EncodeToString(macBytes), paymentRequest)
 	header := r.Header
 	header.Set("WWW-Authenticate", str)
@@ -1,11 +1,16 @@
 package auth_test
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/lightninglabs/aperture/auth"
 	"github.com/lightninglabs/aperture/lsat"
@@ -109,6 +114,16 @@ func TestLsatAuthenticator(t *testing.T) {
 				},
 				result: true,
 			},
+			{
+				id: "valid L402 auth header",
+				header: &http.Header{
+					lsat.HeaderAuthorization: []string{
+						"L402 " + testMacBase64 + ":" +
+							testPreimage,
+					},
+				},
+				result: true,
+			},
 			{
 				id: "valid macaroon metadata header",
 				header: &http.Header{
@@ -150,3 +165,69 @@ func TestLsatAuthenticator(t *testing.T) {
 		}
 	}
 }
+
+// TestLsatAuthenticatorScheme tests that challenges are issued with the
+// configured scheme name.
+func TestLsatAuthenticatorScheme(t *testing.T) {
+	schemes := map[*auth.LsatAuthenticator]string{
+		auth.NewLsatAuthenticator(
+			&mockMint{}, &mockChecker{},
+		): lsat.SchemeLSAT,
+		auth.NewLsatAuthenticatorWithScheme(
+			&mockMint{}, &mockChecker{}, lsat.SchemeL402,
+		): lsat.SchemeL402,
+	}
+	for a, scheme := range schemes {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		header, err := a.FreshChallengeHeader(req, "test", 1)
+		if err != nil {
+			t.Fatalf("unable to create challenge: %v", err)
+		}
+
+		challenge := header.Get("WWW-Authenticate")
+		if !strings.HasPrefix(challenge, scheme+" macaroon=") {
+			t.Fatalf("expected %s challenge, got %s", scheme,
+				challenge)
+		}
+	}
+}
+
+// TestLsatAuthenticatorCache tests that successful verifications are cached
+// for the same request properties until they expire.
+func TestLsatAuthenticatorCache(t *testing.T) {
+	testPreimage := "49349dfea4abed3cd14f6d356afa83de" +
+		"9787b609f088c8df09bacc7b4bd21b39"
+	header := &http.Header{
+		lsat.HeaderMacaroon: []string{createDummyMacHex(testPreimage)},
+	}
+	clientCtx := func(ip string) context.Context {
+		return lsat.AddToContext(
+			context.Background(), lsat.KeyClientIP, net.ParseIP(ip),
+		)
+	}
+
+	c := &mockChecker{}
+	a := auth.NewLsatAuthenticator(&mockMint{}, c)
+	a.SetCache(10, 50*time.Millisecond)
+	if !a.AcceptContext(clientCtx("192.0.2.1"), header, "test") {
+		t.Fatalf("expected token to be accepted")
+	}
+
+	// The invoice can't be looked up anymore, so only the cached
+	// verification lets the token pass.
+	c.err = fmt.Errorf("nope")
+	if !a.AcceptContext(clientCtx("192.0.2.1"), header, "test") {
+		t.Fatalf("expected token to be accepted from cache")
+	}
+	if a.AcceptContext(clientCtx("192.0.2.2"), header, "test") {
+		t.Fatalf("expected other client not to be accepted from cache")
+	}
+	if a.AcceptContext(clientCtx("192.0.2.1"), header, "other") {
+		t.Fatalf("expected other service not to be accepted from cache")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if a.AcceptContext(clientCtx("192.0.2.1"), header, "test") {
+		t.Fatalf("expected cached verification to expire")
+	}
+}
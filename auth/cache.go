@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+)
+
+const (
+	// DefaultCacheTTL is the default time a successful verification of a
+	// token is cached for.
+	DefaultCacheTTL = 5 * time.Second
+)
+
+var (
+	// keyHashers are the hashers cache keys are derived with. A key is
+	// derived for every request, so they're reused.
+	keyHashers = sync.Pool{
+		New: func() interface{} {
+			return sha256.New()
+		},
+	}
+)
+
+// cacheKey identifies the verification of a token for a request. It's a hash
+// of the token, which includes its ID and caveats, and all request properties
+// the caveats can be checked against.
+type cacheKey [sha256.Size]byte
+
+// cacheEntry is a cached successful verification.
+type cacheEntry struct {
+	key    cacheKey
+	expiry time.Time
+}
+
+// verificationCache is a bounded LRU cache of successful token verifications,
+// so the tokens of clients that make many requests don't need to be verified
+// against the secret store and lnd on every request. Revoked tokens are still
+// accepted until their cached verifications expire, which is why the TTL is
+// meant to be short.
+type verificationCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[cacheKey]*list.Element
+}
+
+// newVerificationCache creates a new cache of at most size verifications that
+// are kept for ttl each.
+func newVerificationCache(size int, ttl time.Duration) *verificationCache {
+	return &verificationCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[cacheKey]*list.Element, size),
+	}
+}
+
+// verificationKey returns the cache key of the verification with the given
+// parameters, or false if the token can't be encoded.
+func verificationKey(params *mint.VerificationParams) (cacheKey, bool) {
+	macBytes, err := params.Macaroon.MarshalBinary()
+	if err != nil {
+		return cacheKey{}, false
+	}
+
+	h := keyHashers.Get().(hash.Hash)
+	defer keyHashers.Put(h)
+	h.Reset()
+
+	// All variable length fields are prefixed with their length, so no
+	// two sets of parameters share a key.
+	write := func(data []byte) {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(data)))
+		_, _ = h.Write(length[:])
+		_, _ = h.Write(data)
+	}
+	write(macBytes)
+	write(params.Preimage[:])
+	write([]byte(params.TargetService))
+	write(params.ClientIP)
+	write(params.TLSBinding)
+	write([]byte(params.TargetPath))
+	write([]byte(params.TargetMethod))
+
+	var grace [8]byte
+	binary.BigEndian.PutUint64(grace[:], uint64(params.GracePeriod))
+	write(grace[:])
+
+	var key cacheKey
+	h.Sum(key[:0])
+	return key, true
+}
+
+// get returns true if a verification with the given key is cached and hasn't
+// expired yet.
+func (c *verificationCache) get(key cacheKey, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expiry) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return false
+	}
+
+	c.order.MoveToFront(elem)
+	return true
+}
+
+// put caches a successful verification of the given token. The verification
+// expires after the TTL of the cache, or earlier when the token expires for
+// the service it was verified for.
+func (c *verificationCache) put(key cacheKey,
+	params *mint.VerificationParams, now time.Time) {
+
+	expiry := now.Add(c.ttl)
+	validUntil, ok := lsat.ValidUntil(
+		params.Macaroon, params.TargetService,
+	)
+	if ok && validUntil.Add(params.GracePeriod).Before(expiry) {
+		expiry = validUntil.Add(params.GracePeriod)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).expiry = expiry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{
+		key:    key,
+		expiry: expiry,
+	})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+// ChainAuthenticator is an authenticator that tries a list of authenticators in
+// priority order, so different access models can be mixed on one service. The
+// first authenticator that accepts a request wins. Challenges are issued by the
+// last authenticator that can issue them.
+type ChainAuthenticator struct {
+	authenticators []Authenticator
+}
+
+// A compile time flag to ensure the ChainAuthenticator satisfies the
+// ContextAuthenticator interface.
+var _ ContextAuthenticator = (*ChainAuthenticator)(nil)
+
+// A compile time flag to ensure the ChainAuthenticator satisfies the
+// RenewalAuthenticator interface.
+var _ RenewalAuthenticator = (*ChainAuthenticator)(nil)
+
+// NewChainAuthenticator creates a new authenticator that tries the given
+// authenticators in order.
+func NewChainAuthenticator(
+	authenticators ...Authenticator) *ChainAuthenticator {
+
+	return &ChainAuthenticator{
+		authenticators: authenticators,
+	}
+}
+
+// Accept returns whether or not the header successfully authenticates the user
+// to a given backend service with any of the authenticators.
+//
+// NOTE: This is part of the Authenticator interface.
+func (c *ChainAuthenticator) Accept(header *http.Header,
+	serviceName string) bool {
+
+	return c.AcceptContext(context.Background(), header, serviceName)
+}
+
+// AcceptContext returns whether or not the header successfully authenticates
+// the user to a given backend service with any of the authenticators, using
+// the client properties found in the given context.
+//
+// NOTE: This is part of the ContextAuthenticator interface.
+func (c *ChainAuthenticator) AcceptContext(ctx context.Context,
+	header *http.Header, serviceName string) bool {
+
+	_, ok := c.AcceptedBy(ctx, header, serviceName)
+	return ok
+}
+
+// AcceptedBy returns the index of the first authenticator that accepts the
+// header for the given backend service. The remaining authenticators aren't
+// asked. False is returned if none of them accepts it.
+func (c *ChainAuthenticator) AcceptedBy(ctx context.Context,
+	header *http.Header, serviceName string) (int, bool) {
+
+	for i, authenticator := range c.authenticators {
+		var ok bool
+		ctxAuth, isCtxAuth := authenticator.(ContextAuthenticator)
+		if isCtxAuth {
+			ok = ctxAuth.AcceptContext(ctx, header, serviceName)
+		} else {
+			ok = authenticator.Accept(header, serviceName)
+		}
+
+		if ok {
+			return i, true
+		}
+		lsat.Trace(ctx, "Authenticator %d of %d denied the request",
+			i+1, len(c.authenticators))
+	}
+
+	return 0, false
+}
+
+// ExpiredToken returns the ID and expiry of the expired token in the header as
+// found by the first authenticator that supports renewals and finds one.
+//
+// NOTE: This is part of the RenewalAuthenticator interface.
+func (c *ChainAuthenticator) ExpiredToken(ctx context.Context,
+	header *http.Header, serviceName string) (lsat.TokenID, time.Time,
+	bool) {
+
+	for _, authenticator := range c.authenticators {
+		renewalAuth, ok := authenticator.(RenewalAuthenticator)
+		if !ok {
+			continue
+		}
+
+		id, expiry, ok := renewalAuth.ExpiredToken(
+			ctx, header, serviceName,
+		)
+		if ok {
+			return id, expiry, true
+		}
+	}
+
+	return lsat.TokenID{}, time.Time{}, false
+}
+
+// FreshChallengeHeader returns the challenge of the last authenticator that
+// can issue one, so the challenge matches the access model of last resort.
+// ErrNoChallenge is returned if none of them can.
+//
+// NOTE: This is part of the Authenticator interface.
+func (c *ChainAuthenticator) FreshChallengeHeader(r *http.Request,
+	serviceName string, servicePrice int64) (http.Header, error) {
+
+	for i := len(c.authenticators) - 1; i >= 0; i-- {
+		header, err := c.authenticators[i].FreshChallengeHeader(
+			r, serviceName, servicePrice,
+		)
+		if err == ErrNoChallenge {
+			continue
+		}
+
+		return header, err
+	}
+
+	return nil, ErrNoChallenge
+}
@@ -0,0 +1,81 @@
+package auth_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestChainAuthenticator tests that the chain accepts a header if any of its
+// authenticators does, reports the first that accepts it and issues the
+// challenge of the last authenticator that can issue one.
+func TestChainAuthenticator(t *testing.T) {
+	apiKeys := auth.NewAPIKeyAuthenticator("", []string{"key-1", "key-2"})
+	chain := auth.NewChainAuthenticator(
+		apiKeys, auth.NewMockAuthenticator(),
+	)
+	ctx := context.Background()
+
+	testCases := []struct {
+		name   string
+		header http.Header
+		index  int
+		accept bool
+	}{{
+		name:   "no credentials",
+		header: http.Header{},
+	}, {
+		name: "known API key",
+		header: http.Header{
+			auth.DefaultAPIKeyHeader: []string{"key-2"},
+		},
+		index:  0,
+		accept: true,
+	}, {
+		name: "unknown API key",
+		header: http.Header{
+			auth.DefaultAPIKeyHeader: []string{"key-3"},
+		},
+	}, {
+		name: "unknown API key and token",
+		header: http.Header{
+			auth.DefaultAPIKeyHeader: []string{"key-3"},
+			"Authorization":          []string{"LSAT dummy"},
+		},
+		index:  1,
+		accept: true,
+	}}
+	for _, tc := range testCases {
+		index, ok := chain.AcceptedBy(ctx, &tc.header, "svc")
+		if ok != tc.accept || (ok && index != tc.index) {
+			t.Fatalf("test case %s failed. got %v/%d expected "+
+				"%v/%d", tc.name, ok, index, tc.accept,
+				tc.index)
+		}
+	}
+
+	// The API key authenticator comes last, but can't issue challenges.
+	reversed := auth.NewChainAuthenticator(
+		auth.NewMockAuthenticator(), apiKeys,
+	)
+	req, err := http.NewRequest("GET", "http://localhost/", nil)
+	if err != nil {
+		t.Fatalf("unable to create request: %v", err)
+	}
+	challenge, err := reversed.FreshChallengeHeader(req, "svc", 10)
+	if err != nil {
+		t.Fatalf("unable to create challenge: %v", err)
+	}
+	if challenge.Get("WWW-Authenticate") == "" {
+		t.Fatalf("expected challenge of mock authenticator")
+	}
+
+	_, err = auth.NewChainAuthenticator(apiKeys).FreshChallengeHeader(
+		req, "svc", 10,
+	)
+	if err != auth.ErrNoChallenge {
+		t.Fatalf("expected ErrNoChallenge, got %v", err)
+	}
+}
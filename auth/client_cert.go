@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+// ClientCertAuthenticator is an authenticator that accepts requests made on TLS
+// connections on which the client presented a certificate issued by one of a
+// set of certificate authorities. It can't issue challenges, so it's meant to
+// be chained with an authenticator that can.
+type ClientCertAuthenticator struct {
+	roots    *x509.CertPool
+	subjects map[string]bool
+}
+
+// A compile time flag to ensure the ClientCertAuthenticator satisfies the
+// ContextAuthenticator interface.
+var _ ContextAuthenticator = (*ClientCertAuthenticator)(nil)
+
+// NewClientCertAuthenticator creates a new authenticator that accepts client
+// certificates issued by the given certificate authorities. If subjects are
+// given, only certificates with one of them as their common name are accepted.
+func NewClientCertAuthenticator(roots *x509.CertPool,
+	subjects []string) *ClientCertAuthenticator {
+
+	var allowed map[string]bool
+	if len(subjects) > 0 {
+		allowed = make(map[string]bool, len(subjects))
+		for _, subject := range subjects {
+			allowed[subject] = true
+		}
+	}
+
+	return &ClientCertAuthenticator{
+		roots:    roots,
+		subjects: allowed,
+	}
+}
+
+// Accept always returns false since the client certificate is only known from
+// the request context.
+//
+// NOTE: This is part of the Authenticator interface.
+func (a *ClientCertAuthenticator) Accept(header *http.Header,
+	serviceName string) bool {
+
+	return a.AcceptContext(context.Background(), header, serviceName)
+}
+
+// AcceptContext returns whether or not the client presented a valid certificate
+// of one of the certificate authorities on its connection.
+//
+// NOTE: This is part of the ContextAuthenticator interface.
+func (a *ClientCertAuthenticator) AcceptContext(ctx context.Context,
+	_ *http.Header, _ string) bool {
+
+	certs, _ := lsat.FromContext(
+		ctx, lsat.KeyPeerCertificates,
+	).([]*x509.Certificate)
+	if len(certs) == 0 {
+		lsat.Trace(ctx, "No client certificate presented")
+		return false
+	}
+
+	// The client may send the intermediate certificates of its own one
+	// along with it.
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         a.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		log.Debugf("Deny: Invalid client certificate: %v", err)
+		lsat.Trace(ctx, "Invalid client certificate: %v", err)
+		return false
+	}
+
+	subject := certs[0].Subject.CommonName
+	if a.subjects != nil && !a.subjects[subject] {
+		log.Debugf("Deny: Client certificate of unknown subject %q",
+			subject)
+		lsat.Trace(ctx, "Client certificate of unknown subject %q",
+			subject)
+		return false
+	}
+
+	lsat.Trace(ctx, "Client certificate of %q accepted", subject)
+	return true
+}
+
+// FreshChallengeHeader always returns ErrNoChallenge since clients can't obtain
+// a certificate by completing a challenge.
+//
+// NOTE: This is part of the Authenticator interface.
+func (a *ClientCertAuthenticator) FreshChallengeHeader(*http.Request, string,
+	int64) (http.Header, error) {
+
+	return nil, ErrNoChallenge
+}
@@ -28,6 +28,14 @@ func (l Level) IsFreebie() bool {
 	return strings.HasPrefix(l.lower(), "freebie")
 }
 
+func (l Level) IsTrial() bool {
+	return l.lower() == "trial"
+}
+
+func (l Level) IsNostr() bool {
+	return l.lower() == "nostr"
+}
+
 func (l Level) FreebieCount() freebie.Count {
 	parts := strings.Split(l.lower(), " ")
 	if len(parts) != 2 {
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"time"
 
@@ -18,6 +19,16 @@ const (
 	DefaultInvoiceLookupTimeout = 3 * time.Second
 )
 
+var (
+	// ErrInvoiceNotSettled is the error returned by a PreimageFetcher if
+	// the invoice hasn't been paid yet.
+	ErrInvoiceNotSettled = errors.New("invoice not settled")
+
+	// ErrNoChallenge is the error returned by authenticators that can't
+	// issue challenges, like those that accept static credentials.
+	ErrNoChallenge = errors.New("authenticator issues no challenges")
+)
+
 // Authenticator is the generic interface for validating client headers and
 // returning new challenge headers.
 type Authenticator interface {
@@ -30,6 +41,31 @@ type Authenticator interface {
 	FreshChallengeHeader(*http.Request, string, int64) (http.Header, error)
 }
 
+// ContextAuthenticator is an Authenticator that can also take the properties
+// of the client's connection into account that are stored in the request
+// context, like the IP address or TLS channel binding tokens can be bound to.
+type ContextAuthenticator interface {
+	Authenticator
+
+	// AcceptContext returns whether or not the header successfully
+	// authenticates the user to a given backend service, using the
+	// client properties found in the given context.
+	AcceptContext(context.Context, *http.Header, string) bool
+}
+
+// RenewalAuthenticator is an Authenticator that can tell whether a request was
+// made with a token that expired, so the challenge for a new token can be
+// issued as its renewal.
+type RenewalAuthenticator interface {
+	Authenticator
+
+	// ExpiredToken returns the ID and expiry of the token in the header if
+	// it's a valid, paid token for the given backend service that is only
+	// rejected because it expired.
+	ExpiredToken(context.Context, *http.Header, string) (lsat.TokenID,
+		time.Time, bool)
+}
+
 // Minter is an entity that is able to mint and verify LSATs for a set of
 // services.
 type Minter interface {
@@ -50,3 +86,21 @@ type InvoiceChecker interface {
 	VerifyInvoiceStatus(lntypes.Hash, lnrpc.Invoice_InvoiceState,
 		time.Duration) error
 }
+
+// PreimageFetcher is an entity that is able to look up the preimage of an
+// invoice once it has been paid. This allows clients that pay through a wallet
+// that doesn't reveal the preimage to obtain a valid LSAT anyway.
+type PreimageFetcher interface {
+	// FetchPreimage returns the preimage of the settled invoice identified
+	// by the given payment hash or ErrInvoiceNotSettled if it wasn't paid
+	// yet.
+	FetchPreimage(context.Context, lntypes.Hash) (lntypes.Preimage, error)
+}
+
+// InvoiceFetcher is an entity that is able to look up the invoice of a
+// challenge by its payment hash.
+type InvoiceFetcher interface {
+	// FetchInvoice returns the invoice identified by the given payment
+	// hash.
+	FetchInvoice(context.Context, lntypes.Hash) (*lnrpc.Invoice, error)
+}
@@ -20,7 +20,15 @@ var _ auth.Minter = (*mockMint)(nil)
 func (m *mockMint) MintLSAT(_ context.Context,
 	services ...lsat.Service) (*macaroon.Macaroon, string, error) {
 
-	return nil, "", nil
+	mac, err := macaroon.New(
+		[]byte("aabbccddeeff00112233445566778899"), []byte("AA=="),
+		"aperture", macaroon.LatestVersion,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return mac, "lnbc1invoice", nil
 }
 
 func (m *mockMint) VerifyLSAT(_ context.Context, p *mint.VerificationParams) error {
@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil/bech32"
+)
+
+const (
+	// SchemeNostr is the authentication scheme NIP-98 auth events are sent
+	// with in the Authorization header field.
+	SchemeNostr = "Nostr"
+
+	// KindHTTPAuth is the kind of NIP-98 HTTP auth events.
+	KindHTTPAuth = 27235
+
+	// DefaultNIP98MaxAge is the default time an HTTP auth event may have
+	// been created before or after the request it authenticates.
+	DefaultNIP98MaxAge = time.Minute
+
+	// npubPrefix is the human readable part of bech32 encoded nostr public
+	// keys.
+	npubPrefix = "npub"
+
+	// challengeTag is the BIP-340 tag of the hash that is signed.
+	challengeTag = "BIP0340/challenge"
+)
+
+// NostrEvent is a nostr event as defined by NIP-01.
+type NostrEvent struct {
+	ID        string     `json:"id"`
+	PubKey    string     `json:"pubkey"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int        `json:"kind"`
+	Tags      [][]string `json:"tags"`
+	Content   string     `json:"content"`
+	Sig       string     `json:"sig"`
+}
+
+// Tag returns the first value of the first tag of the event with the given
+// name.
+func (e *NostrEvent) Tag(name string) (string, bool) {
+	for _, tag := range e.Tags {
+		if len(tag) >= 2 && tag[0] == name {
+			return tag[1], true
+		}
+	}
+	return "", false
+}
+
+// Hash returns the hash of the serialized event its ID is made of.
+func (e *NostrEvent) Hash() ([sha256.Size]byte, error) {
+	tags := e.Tags
+	if tags == nil {
+		tags = [][]string{}
+	}
+
+	// The serialization is a JSON array without whitespace. HTML
+	// characters are not escaped by nostr clients, so they mustn't be
+	// here either.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode([]interface{}{
+		0, e.PubKey, e.CreatedAt, e.Kind, tags, e.Content,
+	})
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+
+	return sha256.Sum256(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), nil
+}
+
+// ParseNostrPubKey parses a nostr public key given as npub or hex and returns
+// it hex encoded.
+func ParseNostrPubKey(key string) (string, error) {
+	key = strings.ToLower(strings.TrimSpace(key))
+	if !strings.HasPrefix(key, npubPrefix+"1") {
+		keyBytes, err := hex.DecodeString(key)
+		if err != nil || len(keyBytes) != 32 {
+			return "", fmt.Errorf("invalid public key %q", key)
+		}
+		return key, nil
+	}
+
+	hrp, data, err := bech32.Decode(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid npub %q: %v", key, err)
+	}
+	keyBytes, err := bech32.ConvertBits(data, 5, 8, false)
+	if err != nil {
+		return "", fmt.Errorf("invalid npub %q: %v", key, err)
+	}
+	if hrp != npubPrefix || len(keyBytes) != 32 {
+		return "", fmt.Errorf("invalid npub %q", key)
+	}
+
+	return hex.EncodeToString(keyBytes), nil
+}
+
+// VerifyNIP98 verifies the NIP-98 HTTP auth event in the value of the
+// Authorization header field of the request and returns the hex encoded public
+// key that signed it. The event must have been created within maxAge of now
+// and be bound to the URL and method of the request. The scheme of the URL
+// isn't compared, since TLS may be terminated in front of the proxy. The
+// payload tag isn't checked either, since that would need the whole body.
+func VerifyNIP98(authHeader string, r *http.Request, maxAge time.Duration,
+	now time.Time) (string, error) {
+
+	if !strings.HasPrefix(authHeader, SchemeNostr+" ") {
+		return "", errors.New("no nostr auth event")
+	}
+	eventJSON, err := base64.StdEncoding.DecodeString(
+		strings.TrimSpace(strings.TrimPrefix(authHeader, SchemeNostr)),
+	)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 encoding: %v", err)
+	}
+	var event NostrEvent
+	if err := json.Unmarshal(eventJSON, &event); err != nil {
+		return "", fmt.Errorf("invalid event: %v", err)
+	}
+
+	if event.Kind != KindHTTPAuth {
+		return "", fmt.Errorf("invalid event kind %d", event.Kind)
+	}
+	created := time.Unix(event.CreatedAt, 0)
+	if created.Before(now.Add(-maxAge)) || created.After(now.Add(maxAge)) {
+		return "", fmt.Errorf("event created at %v is outside the "+
+			"allowed window of %v", created, maxAge)
+	}
+
+	method, _ := event.Tag("method")
+	if !strings.EqualFold(method, r.Method) {
+		return "", fmt.Errorf("event is for method %q", method)
+	}
+	rawURL, _ := event.Tag("u")
+	eventURL, err := url.Parse(rawURL)
+	if err != nil || !strings.EqualFold(eventURL.Host, r.Host) ||
+		eventURL.RequestURI() != r.URL.RequestURI() {
+
+		return "", fmt.Errorf("event is for URL %q", rawURL)
+	}
+
+	hash, err := event.Hash()
+	if err != nil {
+		return "", err
+	}
+	if hex.EncodeToString(hash[:]) != strings.ToLower(event.ID) {
+		return "", errors.New("event ID doesn't match its content")
+	}
+	pubKey, err := hex.DecodeString(event.PubKey)
+	if err != nil || len(pubKey) != 32 {
+		return "", fmt.Errorf("invalid public key %q", event.PubKey)
+	}
+	sig, err := hex.DecodeString(event.Sig)
+	if err != nil || len(sig) != 64 {
+		return "", errors.New("invalid signature encoding")
+	}
+	if !verifySchnorr(pubKey, hash[:], sig) {
+		return "", errors.New("invalid signature")
+	}
+
+	return strings.ToLower(event.PubKey), nil
+}
+
+// verifySchnorr verifies a BIP-340 schnorr signature of the message with the
+// x-only public key.
+func verifySchnorr(pubKey, msg, sig []byte) bool {
+	curve := btcec.S256()
+
+	// The public key is the point with the given x coordinate and an even
+	// y coordinate.
+	px := new(big.Int).SetBytes(pubKey)
+	if px.Cmp(curve.P) >= 0 {
+		return false
+	}
+	c := new(big.Int).Exp(px, big.NewInt(3), curve.P)
+	c.Add(c, big.NewInt(7))
+	c.Mod(c, curve.P)
+	py := new(big.Int).ModSqrt(c, curve.P)
+	if py == nil {
+		return false
+	}
+	if py.Bit(0) == 1 {
+		py.Sub(curve.P, py)
+	}
+
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if r.Cmp(curve.P) >= 0 || s.Cmp(curve.N) >= 0 {
+		return false
+	}
+
+	// R = s*G - e*P must be a point with an even y coordinate and the x
+	// coordinate r.
+	e := new(big.Int).SetBytes(
+		taggedHash(challengeTag, sig[:32], pubKey, msg),
+	)
+	e.Mod(e, curve.N)
+	e.Sub(curve.N, e)
+	e.Mod(e, curve.N)
+
+	sx, sy := curve.ScalarBaseMult(sig[32:])
+	ex, ey := curve.ScalarMult(px, py, e.Bytes())
+	rx, ry := curve.Add(sx, sy, ex, ey)
+	if rx.Sign() == 0 && ry.Sign() == 0 {
+		return false
+	}
+
+	return ry.Bit(0) == 0 && rx.Cmp(r) == 0
+}
+
+// taggedHash returns the BIP-340 tagged hash of the given data.
+func taggedHash(tag string, data ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	_, _ = h.Write(tagHash[:])
+	_, _ = h.Write(tagHash[:])
+	for _, d := range data {
+		_, _ = h.Write(d)
+	}
+	return h.Sum(nil)
+}
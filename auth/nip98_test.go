@@ -0,0 +1,193 @@
+package auth_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// signEvent sets the public key, ID and BIP-340 signature of the event.
+func signEvent(t *testing.T, key *btcec.PrivateKey, event *auth.NostrEvent) {
+	curve := btcec.S256()
+
+	// Signing keys are negated if their point has an odd y coordinate,
+	// since only the x coordinate is published.
+	pub := key.PubKey()
+	d := new(big.Int).Set(key.D)
+	if pub.Y.Bit(0) == 1 {
+		d.Sub(curve.N, d)
+	}
+	pubX := pub.X.FillBytes(make([]byte, 32))
+	event.PubKey = hex.EncodeToString(pubX)
+
+	hash, err := event.Hash()
+	if err != nil {
+		t.Fatalf("unable to hash event: %v", err)
+	}
+	event.ID = hex.EncodeToString(hash[:])
+
+	nonce, err := btcec.NewPrivateKey(curve)
+	if err != nil {
+		t.Fatalf("unable to create nonce: %v", err)
+	}
+	k := new(big.Int).Set(nonce.D)
+	if nonce.PubKey().Y.Bit(0) == 1 {
+		k.Sub(curve.N, k)
+	}
+	r := nonce.PubKey().X.FillBytes(make([]byte, 32))
+
+	tagHash := sha256.Sum256([]byte("BIP0340/challenge"))
+	h := sha256.New()
+	_, _ = h.Write(tagHash[:])
+	_, _ = h.Write(tagHash[:])
+	_, _ = h.Write(r)
+	_, _ = h.Write(pubX)
+	_, _ = h.Write(hash[:])
+	e := new(big.Int).SetBytes(h.Sum(nil))
+
+	s := e.Mul(e, d)
+	s.Add(s, k)
+	s.Mod(s, curve.N)
+	event.Sig = hex.EncodeToString(
+		append(r, s.FillBytes(make([]byte, 32))...),
+	)
+}
+
+// authHeader returns the value of the Authorization header field that carries
+// the event.
+func authHeader(t *testing.T, event *auth.NostrEvent) string {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("unable to encode event: %v", err)
+	}
+	return "Nostr " + base64.StdEncoding.EncodeToString(eventJSON)
+}
+
+// TestVerifyNIP98 tests that only NIP-98 auth events signed for the URL and
+// method of a request within the allowed time are accepted.
+func TestVerifyNIP98(t *testing.T) {
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to create key: %v", err)
+	}
+	now := time.Now()
+	reqURL := "https://example.com/api/x?y=1"
+	newEvent := func() *auth.NostrEvent {
+		return &auth.NostrEvent{
+			CreatedAt: now.Unix(),
+			Kind:      auth.KindHTTPAuth,
+			Tags: [][]string{
+				{"u", reqURL},
+				{"method", "GET"},
+			},
+		}
+	}
+
+	testCases := []struct {
+		name   string
+		modify func(*auth.NostrEvent)
+		resign bool
+		valid  bool
+	}{{
+		name:   "valid",
+		modify: func(*auth.NostrEvent) {},
+		valid:  true,
+	}, {
+		name: "wrong method",
+		modify: func(e *auth.NostrEvent) {
+			e.Tags[1][1] = "POST"
+		},
+		resign: true,
+	}, {
+		name: "wrong url",
+		modify: func(e *auth.NostrEvent) {
+			e.Tags[0][1] = "https://example.com/api/z"
+		},
+		resign: true,
+	}, {
+		name: "expired",
+		modify: func(e *auth.NostrEvent) {
+			e.CreatedAt = now.Add(-2 * time.Minute).Unix()
+		},
+		resign: true,
+	}, {
+		name: "wrong kind",
+		modify: func(e *auth.NostrEvent) {
+			e.Kind = 1
+		},
+		resign: true,
+	}, {
+		name: "tampered content",
+		modify: func(e *auth.NostrEvent) {
+			e.Content = "tampered"
+		},
+	}, {
+		name: "tampered signature",
+		modify: func(e *auth.NostrEvent) {
+			sig := []byte(e.Sig)
+			if sig[0] == 'a' {
+				sig[0] = 'b'
+			} else {
+				sig[0] = 'a'
+			}
+			e.Sig = string(sig)
+		},
+	}}
+	for _, tc := range testCases {
+		event := newEvent()
+		if tc.resign {
+			tc.modify(event)
+			signEvent(t, key, event)
+		} else {
+			signEvent(t, key, event)
+			tc.modify(event)
+		}
+
+		req := httptest.NewRequest("GET", reqURL, nil)
+		pubKey, err := auth.VerifyNIP98(
+			authHeader(t, event), req, auth.DefaultNIP98MaxAge, now,
+		)
+		switch {
+		case tc.valid && err != nil:
+			t.Fatalf("%s: expected event to be valid: %v", tc.name,
+				err)
+
+		case tc.valid && pubKey != event.PubKey:
+			t.Fatalf("%s: unexpected public key %s", tc.name,
+				pubKey)
+
+		case !tc.valid && err == nil:
+			t.Fatalf("%s: expected event to be invalid", tc.name)
+		}
+	}
+}
+
+// TestParseNostrPubKey tests that public keys are accepted as npub and hex.
+func TestParseNostrPubKey(t *testing.T) {
+	const (
+		npub   = "npub10elfcs4fr0l0r8af98jlmgdh9c8tcxjvz9qkw038js35mp4dma8qzvjptg"
+		pubHex = "7e7e9c42a91bfef19fa929e5fda1b72e0ebc1a4c1141673e2794234d86addf4e"
+	)
+
+	for _, key := range []string{npub, pubHex} {
+		parsed, err := auth.ParseNostrPubKey(key)
+		if err != nil {
+			t.Fatalf("unable to parse %s: %v", key, err)
+		}
+		if parsed != pubHex {
+			t.Fatalf("unexpected public key %s for %s", parsed, key)
+		}
+	}
+
+	if _, err := auth.ParseNostrPubKey("npub1invalid"); err == nil {
+		t.Fatalf("expected invalid npub to be rejected")
+	}
+}
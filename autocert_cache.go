@@ -0,0 +1,100 @@
+package aperture
+
+import (
+	"context"
+	"strings"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	// autocertPrefix is the key we'll use to prefix all entries of the
+	// autocert cache with when storing them in an etcd cluster.
+	autocertPrefix = "autocert"
+)
+
+// autocertKey returns the full key to store an autocert cache entry in the
+// database. Cache keys are host names or account identifiers that never
+// contain the etcd key delimeter.
+//
+// The resulting path of the certificate of example.com within etcd would look
+// like:
+//
+//	lsat/proxy/autocert/example.com
+func autocertKey(key string) string {
+	return strings.Join(
+		[]string{topLevelKey, autocertPrefix, key}, etcdKeyDelimeter,
+	)
+}
+
+// autocertCache is an autocert.Cache backed by an etcd cluster. All instances
+// that share the cluster use the same ACME account and certificates, and can
+// answer the HTTP challenges of certificates that were requested by others.
+type autocertCache struct {
+	*clientv3.Client
+
+	// fallback is an optional cache that is consulted if an entry doesn't
+	// exist in etcd. Entries found in it are copied to etcd, which allows
+	// us to take over certificates that were obtained before the cache
+	// was shared.
+	fallback autocert.Cache
+}
+
+// A compile-time constraint to ensure autocertCache implements autocert.Cache.
+var _ autocert.Cache = (*autocertCache)(nil)
+
+// newAutocertCache creates a new autocert cache backed by an etcd cluster.
+func newAutocertCache(client *clientv3.Client,
+	fallback autocert.Cache) *autocertCache {
+
+	return &autocertCache{Client: client, fallback: fallback}
+}
+
+// Get returns the cache entry with the given key or autocert.ErrCacheMiss if
+// there is none.
+func (c *autocertCache) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := c.Client.Get(ctx, autocertKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) > 0 {
+		return resp.Kvs[0].Value, nil
+	}
+
+	if c.fallback == nil {
+		return nil, autocert.ErrCacheMiss
+	}
+	data, err := c.fallback.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Moving autocert cache entry %s to etcd", key)
+	if err := c.Put(ctx, key, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Put stores the given data under the given key.
+func (c *autocertCache) Put(ctx context.Context, key string,
+	data []byte) error {
+
+	_, err := c.Client.Put(ctx, autocertKey(key), string(data))
+	return err
+}
+
+// Delete removes the cache entry with the given key. This acts as a NOP if the
+// entry does not exist.
+func (c *autocertCache) Delete(ctx context.Context, key string) error {
+	_, err := c.Client.Delete(ctx, autocertKey(key))
+	if err != nil {
+		return err
+	}
+
+	if c.fallback != nil {
+		return c.fallback.Delete(ctx, key)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package aperture
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TestAutocertCache tests that the etcd backed autocert cache stores entries
+// and takes over the entries of its fallback cache.
+func TestAutocertCache(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	tempDir, err := ioutil.TempDir("", "autocert")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ctx := context.Background()
+	dirCache := autocert.DirCache(tempDir)
+	cache := newAutocertCache(etcdClient, dirCache)
+
+	// A missing entry must be reported as such.
+	if _, err := cache.Get(ctx, "example.com"); err != autocert.ErrCacheMiss {
+		t.Fatalf("expected cache miss, got %v", err)
+	}
+
+	// An entry that was stored can be read again, also by another
+	// instance without a fallback.
+	if err := cache.Put(ctx, "example.com", []byte("cert")); err != nil {
+		t.Fatalf("unable to store cache entry: %v", err)
+	}
+	otherCache := newAutocertCache(etcdClient, nil)
+	data, err := otherCache.Get(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("unable to get cache entry: %v", err)
+	}
+	if !bytes.Equal(data, []byte("cert")) {
+		t.Fatalf("unexpected cache entry %x", data)
+	}
+
+	// Entries of the fallback cache are copied to etcd on first use.
+	err = dirCache.Put(ctx, "acme_account+key", []byte("key"))
+	if err != nil {
+		t.Fatalf("unable to store fallback cache entry: %v", err)
+	}
+	if _, err := cache.Get(ctx, "acme_account+key"); err != nil {
+		t.Fatalf("unable to get fallback cache entry: %v", err)
+	}
+	data, err = otherCache.Get(ctx, "acme_account+key")
+	if err != nil {
+		t.Fatalf("unable to get moved cache entry: %v", err)
+	}
+	if !bytes.Equal(data, []byte("key")) {
+		t.Fatalf("unexpected cache entry %x", data)
+	}
+
+	// Deleted entries are gone for all instances.
+	if err := cache.Delete(ctx, "example.com"); err != nil {
+		t.Fatalf("unable to delete cache entry: %v", err)
+	}
+	_, err = otherCache.Get(ctx, "example.com")
+	if err != autocert.ErrCacheMiss {
+		t.Fatalf("expected cache miss, got %v", err)
+	}
+}
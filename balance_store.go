@@ -0,0 +1,172 @@
+package aperture
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/proxy"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	// balancePrefix is the key we'll use to prefix the number of messages
+	// delivered with all tokens with when storing them in an etcd cluster.
+	balancePrefix = "balance"
+
+	// errBalanceConflict is returned if the spent messages of a token were
+	// changed by someone else between reading and updating them.
+	errBalanceConflict = fmt.Errorf("balance changed concurrently")
+)
+
+// balanceKey returns the full key to store the number of messages delivered
+// with a token in the database.
+//
+// The resulting path of the balance of the token with the ID "abc" within etcd
+// would look like:
+//
+//	lsat/proxy/balance/abc
+func balanceKey(tokenID lsat.TokenID) string {
+	return strings.Join(
+		[]string{topLevelKey, balancePrefix, tokenID.String()},
+		etcdKeyDelimeter,
+	)
+}
+
+// balanceStore is a balance store backed by an etcd cluster. All aperture
+// instances that share the cluster also share the balances, so the messages a
+// token paid for can't be spent again against a different instance.
+type balanceStore struct {
+	*clientv3.Client
+}
+
+// A compile-time constraint to ensure balanceStore implements
+// proxy.BalanceStore.
+var _ proxy.BalanceStore = (*balanceStore)(nil)
+
+// newBalanceStore creates a new balance store backed by the given etcd client.
+func newBalanceStore(client *clientv3.Client) *balanceStore {
+	return &balanceStore{Client: client}
+}
+
+// Spent returns the number of messages that were delivered with the token so
+// far.
+//
+// NOTE: This is part of the proxy.BalanceStore interface.
+func (s *balanceStore) Spent(ctx context.Context,
+	tokenID lsat.TokenID) (uint64, error) {
+
+	resp, err := s.Get(ctx, balanceKey(tokenID))
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+
+	return decodeSpent(resp.Kvs[0].Value)
+}
+
+// Spend atomically records that a message was delivered with the token if its
+// balance isn't used up yet. If a concurrent stream spent a message in the
+// meantime, the update is retried with the new value.
+//
+// NOTE: This is part of the proxy.BalanceStore interface.
+func (s *balanceStore) Spend(ctx context.Context, tokenID lsat.TokenID,
+	balance uint64) (bool, error) {
+
+	n, err := s.spendRetry(ctx, tokenID, balance, 1)
+	return n > 0, err
+}
+
+// SpendAll atomically records that all messages that are left of the balance
+// were used up at once. If a concurrent stream spent a message in the
+// meantime, the update is retried with the new value.
+//
+// NOTE: This is part of the proxy.BalanceStore interface.
+func (s *balanceStore) SpendAll(ctx context.Context, tokenID lsat.TokenID,
+	balance uint64) (uint64, error) {
+
+	return s.spendRetry(ctx, tokenID, balance, balance)
+}
+
+// spendRetry spends up to the given number of messages of the balance of the
+// token and retries on concurrent changes. The number of spent messages is
+// returned.
+func (s *balanceStore) spendRetry(ctx context.Context, tokenID lsat.TokenID,
+	balance, n uint64) (uint64, error) {
+
+	key := balanceKey(tokenID)
+	for {
+		spent, err := s.spend(ctx, key, balance, n)
+		switch {
+		case err == errBalanceConflict:
+			continue
+
+		case err != nil:
+			return 0, err
+
+		default:
+			return spent, nil
+		}
+	}
+}
+
+// spend tries to spend up to the given number of messages of the balance with
+// the given key once.
+func (s *balanceStore) spend(ctx context.Context, key string,
+	balance, n uint64) (uint64, error) {
+
+	resp, err := s.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	// Only write the new value if the key wasn't modified since we read
+	// it. A mod revision of zero means the key doesn't exist yet.
+	var (
+		spent       uint64
+		modRevision int64
+	)
+	if len(resp.Kvs) > 0 {
+		spent, err = decodeSpent(resp.Kvs[0].Value)
+		if err != nil {
+			return 0, err
+		}
+		modRevision = resp.Kvs[0].ModRevision
+	}
+	if spent >= balance {
+		return 0, nil
+	}
+	if n > balance-spent {
+		n = balance - spent
+	}
+
+	var newSpent [8]byte
+	binary.BigEndian.PutUint64(newSpent[:], spent+n)
+	txnResp, err := s.Txn(ctx).
+		If(clientv3.Compare(
+			clientv3.ModRevision(key), "=", modRevision,
+		)).
+		Then(clientv3.OpPut(key, string(newSpent[:]))).
+		Commit()
+	if err != nil {
+		return 0, err
+	}
+	if !txnResp.Succeeded {
+		return 0, errBalanceConflict
+	}
+
+	return n, nil
+}
+
+// decodeSpent decodes the number of spent messages stored in the database.
+func decodeSpent(value []byte) (uint64, error) {
+	if len(value) != 8 {
+		return 0, fmt.Errorf("invalid balance size %v", len(value))
+	}
+
+	return binary.BigEndian.Uint64(value), nil
+}
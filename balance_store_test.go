@@ -0,0 +1,83 @@
+package aperture
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBalanceStore tests that the etcd backed balance stores of two instances
+// share the spent messages of tokens and never spend more than the balance,
+// even if messages are spent concurrently.
+func TestBalanceStore(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	var (
+		ctx    = context.Background()
+		stores = []*balanceStore{
+			newBalanceStore(etcdClient), newBalanceStore(etcdClient),
+		}
+		tokenID    = lsat.TokenID{1}
+		otherToken = lsat.TokenID{2}
+	)
+
+	spent, err := stores[0].Spent(ctx, tokenID)
+	require.NoError(t, err)
+	require.Zero(t, spent)
+
+	// Spend more messages than the balance concurrently on both instances.
+	// Only as many as the balance may succeed.
+	var (
+		wg       sync.WaitGroup
+		mtx      sync.Mutex
+		accepted int
+	)
+	for i := 0; i < 10; i++ {
+		store := stores[i%len(stores)]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ok, err := store.Spend(ctx, tokenID, 4)
+			if err != nil {
+				t.Errorf("unable to spend message: %v", err)
+				return
+			}
+			if ok {
+				mtx.Lock()
+				accepted++
+				mtx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 4, accepted)
+
+	spent, err = stores[1].Spent(ctx, tokenID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), spent)
+
+	// The balances of other tokens are independent.
+	ok, err := stores[0].Spend(ctx, otherToken, 5)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// The rest of a balance can be used up at once, but only once.
+	left, err := stores[1].SpendAll(ctx, otherToken, 5)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), left)
+
+	left, err = stores[0].SpendAll(ctx, otherToken, 5)
+	require.NoError(t, err)
+	require.Zero(t, left)
+
+	ok, err = stores[0].Spend(ctx, otherToken, 5)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
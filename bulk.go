@@ -0,0 +1,166 @@
+package aperture
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightninglabs/aperture/proxy"
+)
+
+const (
+	// maxBulkTokens is the maximum number of tokens that can be issued in
+	// a single batch.
+	maxBulkTokens = 10000
+)
+
+// adminBatchRequest is a request to issue a batch of tokens in the admin API.
+type adminBatchRequest struct {
+	Service  string            `json:"service"`
+	Tier     lsat.ServiceTier  `json:"tier"`
+	Path     string            `json:"path"`
+	Count    int               `json:"count"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// adminBatch is a batch of tokens that is paid for with a single invoice in
+// the admin API.
+type adminBatch struct {
+	Service     string   `json:"service"`
+	Count       int      `json:"count"`
+	Price       int64    `json:"price"`
+	Invoice     string   `json:"invoice"`
+	PaymentHash string   `json:"payment_hash"`
+	Macaroons   []string `json:"macaroons"`
+}
+
+// handleIssueBatch issues a batch of tokens for a service, like access codes
+// that are distributed through resellers or promotions. All tokens of the
+// batch are paid for with one invoice of their total price and share its
+// preimage, so they become valid together once it's paid. The batch is
+// returned as a JSON file to download.
+func (a *Aperture) handleIssueBatch(w http.ResponseWriter, r *http.Request) {
+	var req adminBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Count <= 0 || req.Count > maxBulkTokens {
+		http.Error(
+			w, fmt.Sprintf("count must be between 1 and %d",
+				maxBulkTokens),
+			http.StatusBadRequest,
+		)
+		return
+	}
+
+	// Only the base tier is minted with the capabilities and constraints
+	// of a service.
+	if req.Tier != lsat.BaseTier {
+		http.Error(w, "unknown tier", http.StatusBadRequest)
+		return
+	}
+
+	var target *proxy.Service
+	for _, service := range a.proxy.Services() {
+		if service.Name == req.Service {
+			target = service
+			break
+		}
+	}
+	if target == nil {
+		http.Error(w, "unknown service", http.StatusNotFound)
+		return
+	}
+
+	// The tokens are priced like the challenges of requests for the path,
+	// so dynamically priced services charge their current price.
+	path := req.Path
+	if path == "" {
+		path = "/"
+	}
+	price, err := target.GetPrice(r.Context(), path)
+	if err != nil {
+		log.Errorf("Error getting price of batch for %s: %v",
+			target.Name, err)
+		http.Error(
+			w, "failure fetching resource price",
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	if price <= 0 {
+		http.Error(w, "resource is free", http.StatusBadRequest)
+		return
+	}
+
+	// The batch carries the metadata of the tokens of its service, like
+	// the name of the plan, together with its own, like the reseller.
+	metadata := make(map[string]string)
+	for key, value := range target.Metadata.Values {
+		metadata[key] = value
+	}
+	for key, value := range req.Metadata {
+		metadata[key] = value
+	}
+	ctx := lsat.AddToContext(r.Context(), lsat.KeyMetadata, metadata)
+
+	macs, invoice, err := a.mint.MintLSATs(ctx, req.Count, lsat.Service{
+		Name:  target.ResourceName(path),
+		Tier:  req.Tier,
+		Price: price,
+	})
+	switch {
+	case err == mint.ErrChallengerBusy:
+		http.Error(w, "challenger busy", http.StatusServiceUnavailable)
+		return
+
+	case err != nil:
+		log.Errorf("Error issuing batch of %d tokens: %v", req.Count,
+			err)
+		http.Error(w, "unable to issue tokens", http.StatusBadGateway)
+		return
+	}
+
+	batch := &adminBatch{
+		Service:   target.Name,
+		Count:     len(macs),
+		Price:     price * int64(len(macs)),
+		Invoice:   invoice,
+		Macaroons: make([]string, 0, len(macs)),
+	}
+	for _, mac := range macs {
+		macBytes, err := mac.MarshalBinary()
+		if err != nil {
+			log.Errorf("Error serializing token: %v", err)
+			http.Error(
+				w, "unable to issue tokens",
+				http.StatusInternalServerError,
+			)
+			return
+		}
+		batch.Macaroons = append(
+			batch.Macaroons,
+			base64.StdEncoding.EncodeToString(macBytes),
+		)
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(macs[0].Id()))
+	if err == nil {
+		batch.PaymentHash = id.PaymentHash.String()
+	}
+
+	log.Infof("Issued batch of %d tokens for service %s with payment "+
+		"hash %s.", batch.Count, batch.Service, batch.PaymentHash)
+
+	w.Header().Set(
+		"Content-Disposition", fmt.Sprintf(
+			"attachment; filename=\"tokens-%s-%s.json\"",
+			batch.Service, batch.PaymentHash,
+		),
+	)
+	writeAdminJSON(w, batch)
+}
@@ -0,0 +1,173 @@
+package aperture
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/cert"
+)
+
+const (
+	// certRenewalInterval is how often the TLS certificate files are
+	// checked while we're running.
+	certRenewalInterval = 12 * time.Hour
+)
+
+// certRenewer serves the TLS certificate from the files in the base dir. The
+// files are checked periodically, so a self-signed certificate is renewed and
+// a certificate that was replaced by an external process is picked up without
+// a restart.
+type certRenewer struct {
+	certFile     string
+	keyFile      string
+	extraDomains []string
+
+	cert *tls.Certificate
+	mtx  sync.RWMutex
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newCertRenewer creates the self-signed certificate if the files don't exist
+// yet, renews it if it's about to expire and loads it.
+func newCertRenewer(certFile, keyFile string,
+	extraDomains []string) (*certRenewer, error) {
+
+	r := &certRenewer{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		extraDomains: extraDomains,
+		quit:         make(chan struct{}),
+	}
+	if err := r.renew(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// renew creates or renews the self-signed certificate if needed, and loads the
+// certificate from the files.
+func (r *certRenewer) renew(now time.Time) error {
+	if !fileExists(r.certFile) && !fileExists(r.keyFile) {
+		log.Infof("Generating TLS certificates...")
+		err := cert.GenCertPair(
+			selfSignedCertOrganization, r.certFile, r.keyFile,
+			nil, r.extraDomains, false, selfSignedCertValidity,
+		)
+		if err != nil {
+			return err
+		}
+		log.Infof("Done generating TLS certificates")
+	}
+
+	// Load the certs now so we can inspect it.
+	certData, parsedCert, err := cert.LoadCert(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	// The margin is negative, so adding it to the expiry date should give
+	// us a date in about the middle of it's validity period.
+	expiryWithMargin := parsedCert.NotAfter.Add(
+		-1 * selfSignedCertExpiryMargin,
+	)
+
+	// We only want to renew a certificate that we created ourselves. If
+	// we are using a certificate that was passed to us (perhaps created by
+	// an externally running Let's Encrypt process) we aren't going to try
+	// to replace it.
+	isSelfSigned := len(parsedCert.Subject.Organization) > 0 &&
+		parsedCert.Subject.Organization[0] == selfSignedCertOrganization
+
+	// If the certificate expired or it was outdated, delete it and the TLS
+	// key and generate a new pair.
+	if isSelfSigned && now.After(expiryWithMargin) {
+		log.Info("TLS certificate will expire soon, generating a " +
+			"new one")
+
+		err := os.Remove(r.certFile)
+		if err != nil {
+			return err
+		}
+
+		err = os.Remove(r.keyFile)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Renewing TLS certificates...")
+		err = cert.GenCertPair(
+			selfSignedCertOrganization, r.certFile, r.keyFile,
+			nil, r.extraDomains, false, selfSignedCertValidity,
+		)
+		if err != nil {
+			return err
+		}
+		log.Infof("Done renewing TLS certificates")
+
+		// Reload the certificate data.
+		certData, parsedCert, err = cert.LoadCert(
+			r.certFile, r.keyFile,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if now.After(parsedCert.NotAfter) {
+		log.Warnf("TLS certificate %s expired at %v", r.certFile,
+			parsedCert.NotAfter)
+	}
+
+	r.mtx.Lock()
+	r.cert = &certData
+	r.mtx.Unlock()
+
+	return nil
+}
+
+// GetCertificate returns the current certificate.
+func (r *certRenewer) GetCertificate(_ *tls.ClientHelloInfo) (
+	*tls.Certificate, error) {
+
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	return r.cert, nil
+}
+
+// Start checks the certificate files periodically in the background. If they
+// can't be renewed or loaded, the current certificate is kept until the next
+// attempt.
+func (r *certRenewer) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(certRenewalInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				if err := r.renew(now); err != nil {
+					log.Errorf("Unable to renew TLS "+
+						"certificate: %v", err)
+				}
+
+			case <-r.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops checking the certificate files.
+func (r *certRenewer) Stop() {
+	close(r.quit)
+	r.wg.Wait()
+}
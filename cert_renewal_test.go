@@ -0,0 +1,57 @@
+package aperture
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCertRenewer tests that a self-signed certificate is created, renewed once
+// it's about to expire and served without a restart.
+func TestCertRenewer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aperture-cert")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, defaultTLSCertFilename)
+	keyFile := filepath.Join(dir, defaultTLSKeyFilename)
+	renewer, err := newCertRenewer(certFile, keyFile, []string{"localhost"})
+	if err != nil {
+		t.Fatalf("unable to create certificate: %v", err)
+	}
+	if !fileExists(certFile) || !fileExists(keyFile) {
+		t.Fatalf("certificate files weren't created")
+	}
+
+	first, err := renewer.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("unable to get certificate: %v", err)
+	}
+
+	// A certificate that isn't about to expire is kept.
+	if err := renewer.renew(time.Now()); err != nil {
+		t.Fatalf("unable to check certificate: %v", err)
+	}
+	current, _ := renewer.GetCertificate(nil)
+	if !bytes.Equal(current.Certificate[0], first.Certificate[0]) {
+		t.Fatalf("certificate was renewed too early")
+	}
+
+	// Once it's about to expire, a new one is served.
+	later := time.Now().Add(selfSignedCertValidity - time.Hour)
+	if err := renewer.renew(later); err != nil {
+		t.Fatalf("unable to renew certificate: %v", err)
+	}
+	current, _ = renewer.GetCertificate(nil)
+	if bytes.Equal(current.Certificate[0], first.Certificate[0]) {
+		t.Fatalf("certificate wasn't renewed")
+	}
+
+	renewer.Start()
+	renewer.Stop()
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/lightninglabs/aperture/auth"
 	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightninglabs/aperture/proxy"
 	"github.com/lightninglabs/lndclient"
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/lightningnetwork/lnd/lntypes"
@@ -36,6 +37,10 @@ type InvoiceClient interface {
 	// AddInvoice adds a new invoice to lnd.
 	AddInvoice(ctx context.Context, in *lnrpc.Invoice,
 		opts ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error)
+
+	// LookupInvoice looks up a single invoice by its payment hash.
+	LookupInvoice(ctx context.Context, in *lnrpc.PaymentHash,
+		opts ...grpc.CallOption) (*lnrpc.Invoice, error)
 }
 
 // LndChallenger is a challenger that uses an lnd backend to create new LSAT
@@ -49,6 +54,12 @@ type LndChallenger struct {
 	invoicesCancel func()
 	invoicesCond   *sync.Cond
 
+	// invoicePool holds pre-created invoices, if enabled.
+	invoicePool *invoicePool
+
+	// workers limits the number of concurrent calls to lnd, if enabled.
+	workers *workerPool
+
 	errChan chan<- error
 
 	quit chan struct{}
@@ -56,9 +67,13 @@ type LndChallenger struct {
 }
 
 // A compile time flag to ensure the LndChallenger satisfies the
-// mint.Challenger and auth.InvoiceChecker interface.
+// mint.Challenger interface and the invoice related interfaces of the auth
+// package.
 var _ mint.Challenger = (*LndChallenger)(nil)
 var _ auth.InvoiceChecker = (*LndChallenger)(nil)
+var _ auth.PreimageFetcher = (*LndChallenger)(nil)
+var _ auth.InvoiceFetcher = (*LndChallenger)(nil)
+var _ proxy.QueueReporter = (*LndChallenger)(nil)
 
 const (
 	// invoiceMacaroonName is the name of the invoice macaroon belonging
@@ -71,10 +86,6 @@ const (
 func NewLndChallenger(cfg *AuthConfig, genInvoiceReq InvoiceRequestGenerator,
 	errChan chan<- error) (*LndChallenger, error) {
 
-	if genInvoiceReq == nil {
-		return nil, fmt.Errorf("genInvoiceReq cannot be nil")
-	}
-
 	client, err := lndclient.NewBasicClient(
 		cfg.LndHost, cfg.TLSPath, cfg.MacDir, cfg.Network,
 		lndclient.MacFilename(invoiceMacaroonName),
@@ -83,8 +94,21 @@ func NewLndChallenger(cfg *AuthConfig, genInvoiceReq InvoiceRequestGenerator,
 		return nil, err
 	}
 
+	return NewLndChallengerWithClient(cfg, client, genInvoiceReq, errChan)
+}
+
+// NewLndChallengerWithClient creates a new challenger that uses the given,
+// already connected client to create payment challenges.
+func NewLndChallengerWithClient(cfg *AuthConfig, client InvoiceClient,
+	genInvoiceReq InvoiceRequestGenerator,
+	errChan chan<- error) (*LndChallenger, error) {
+
+	if genInvoiceReq == nil {
+		return nil, fmt.Errorf("genInvoiceReq cannot be nil")
+	}
+
 	invoicesMtx := &sync.Mutex{}
-	return &LndChallenger{
+	challenger := &LndChallenger{
 		client:        client,
 		genInvoiceReq: genInvoiceReq,
 		invoiceStates: make(map[lntypes.Hash]lnrpc.Invoice_InvoiceState),
@@ -92,7 +116,20 @@ func NewLndChallenger(cfg *AuthConfig, genInvoiceReq InvoiceRequestGenerator,
 		invoicesCond:  sync.NewCond(invoicesMtx),
 		quit:          make(chan struct{}),
 		errChan:       errChan,
-	}, nil
+	}
+
+	if cfg.Workers > 0 {
+		challenger.workers = newWorkerPool(cfg.Workers, cfg.WorkerQueue)
+	}
+
+	if cfg.InvoicePoolSize > 0 {
+		challenger.invoicePool = newInvoicePool(
+			cfg.InvoicePoolSize, cfg.InvoicePoolMaxAge,
+			challenger.addInvoice,
+		)
+	}
+
+	return challenger, nil
 }
 
 // Start starts the challenger's main work which is to keep track of all
@@ -167,6 +204,10 @@ func (l *LndChallenger) Start() error {
 		l.readInvoiceStream(subscriptionResp)
 	}()
 
+	if l.invoicePool != nil {
+		l.invoicePool.Start()
+	}
+
 	return nil
 }
 
@@ -252,9 +293,36 @@ func (l *LndChallenger) readInvoiceStream(
 
 // Stop shuts down the challenger.
 func (l *LndChallenger) Stop() {
+	if l.invoicePool != nil {
+		l.invoicePool.Stop()
+	}
 	l.invoicesCancel()
 	close(l.quit)
 	l.wg.Wait()
+
+	if l.workers != nil {
+		l.workers.Stop()
+	}
+}
+
+// runWorker runs the given call to lnd on a worker, if the number of
+// concurrent calls is limited, or directly otherwise.
+func (l *LndChallenger) runWorker(ctx context.Context, fn func() error) error {
+	if l.workers == nil {
+		return fn()
+	}
+	return l.workers.run(ctx, fn)
+}
+
+// QueueDepth returns the number of calls that are waiting for a free worker.
+// Without a worker pool, calls never wait.
+//
+// NOTE: This is part of the proxy.QueueReporter interface.
+func (l *LndChallenger) QueueDepth() int {
+	if l.workers == nil {
+		return 0
+	}
+	return l.workers.queueDepth()
 }
 
 // NewChallenge creates a new LSAT payment challenge, returning a payment
@@ -262,15 +330,32 @@ func (l *LndChallenger) Stop() {
 //
 // NOTE: This is part of the mint.Challenger interface.
 func (l *LndChallenger) NewChallenge(price int64) (string, lntypes.Hash, error) {
-	// Obtain a new invoice from lnd first. We need to know the payment hash
-	// so we can add it as a caveat to the macaroon.
+	// Hand out a pre-created invoice if we have one, saving the round trip
+	// to lnd.
+	if l.invoicePool != nil {
+		if invoice, ok := l.invoicePool.take(price); ok {
+			return invoice.paymentRequest, invoice.paymentHash, nil
+		}
+	}
+
+	return l.addInvoice(price)
+}
+
+// addInvoice obtains a new invoice for the given price from lnd. We need to
+// know the payment hash so we can add it as a caveat to the macaroon.
+func (l *LndChallenger) addInvoice(price int64) (string, lntypes.Hash, error) {
 	invoice, err := l.genInvoiceReq(price)
 	if err != nil {
 		log.Errorf("Error generating invoice request: %v", err)
 		return "", lntypes.ZeroHash, err
 	}
 	ctx := context.Background()
-	response, err := l.client.AddInvoice(ctx, invoice)
+	var response *lnrpc.AddInvoiceResponse
+	err = l.runWorker(ctx, func() error {
+		var err error
+		response, err = l.client.AddInvoice(ctx, invoice)
+		return err
+	})
 	if err != nil {
 		log.Errorf("Error adding invoice: %v", err)
 		return "", lntypes.ZeroHash, err
@@ -384,3 +469,44 @@ func invoiceIrrelevant(invoice *lnrpc.Invoice) bool {
 
 	return expired && notSettled
 }
+
+// FetchPreimage returns the preimage of the settled invoice identified by the
+// given payment hash or auth.ErrInvoiceNotSettled if it wasn't paid yet.
+//
+// NOTE: This is part of the auth.PreimageFetcher interface.
+func (l *LndChallenger) FetchPreimage(ctx context.Context,
+	hash lntypes.Hash) (lntypes.Preimage, error) {
+
+	// We keep track of all invoice states, so we don't need to bother lnd
+	// if we know the invoice isn't settled.
+	l.invoicesMtx.Lock()
+	state, ok := l.invoiceStates[hash]
+	l.invoicesMtx.Unlock()
+	if !ok || state != lnrpc.Invoice_SETTLED {
+		return lntypes.Preimage{}, auth.ErrInvoiceNotSettled
+	}
+
+	invoice, err := l.FetchInvoice(ctx, hash)
+	if err != nil {
+		return lntypes.Preimage{}, err
+	}
+
+	return lntypes.MakePreimage(invoice.RPreimage)
+}
+
+// FetchInvoice returns the invoice identified by the given payment hash.
+//
+// NOTE: This is part of the auth.InvoiceFetcher interface.
+func (l *LndChallenger) FetchInvoice(ctx context.Context,
+	hash lntypes.Hash) (*lnrpc.Invoice, error) {
+
+	var invoice *lnrpc.Invoice
+	err := l.runWorker(ctx, func() error {
+		var err error
+		invoice, err = l.client.LookupInvoice(ctx, &lnrpc.PaymentHash{
+			RHash: hash[:],
+		})
+		return err
+	})
+	return invoice, err
+}
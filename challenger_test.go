@@ -1,12 +1,14 @@
 package aperture
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/lightningnetwork/lnd/lntypes"
 	"github.com/stretchr/testify/require"
@@ -84,6 +86,19 @@ func (m *mockInvoiceClient) AddInvoice(_ context.Context, in *lnrpc.Invoice,
 	}, nil
 }
 
+// LookupInvoice looks up a single invoice by its payment hash.
+func (m *mockInvoiceClient) LookupInvoice(_ context.Context,
+	in *lnrpc.PaymentHash, _ ...grpc.CallOption) (*lnrpc.Invoice, error) {
+
+	for _, invoice := range m.invoices {
+		if bytes.Equal(invoice.RHash, in.RHash) {
+			return invoice, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invoice not found")
+}
+
 func (m *mockInvoiceClient) stop() {
 	close(m.quit)
 }
@@ -251,3 +266,104 @@ func TestLndChallenger(t *testing.T) {
 	invoiceMock.stop()
 	c.Stop()
 }
+
+// TestInvoicePool tests that the invoice pool hands out every pre-created
+// invoice only once, refills itself and discards invoices that are too old.
+func TestInvoicePool(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		created int
+	)
+	addInvoice := func(price int64) (string, lntypes.Hash, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		created++
+		hash := lntypes.Hash{byte(created)}
+		return fmt.Sprintf("invoice-%d-%d", price, created), hash, nil
+	}
+	numCreated := func() int {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return created
+	}
+
+	const poolSize = 3
+	pool := newInvoicePool(poolSize, time.Minute, addInvoice)
+	pool.Start()
+
+	// The first challenge of a price can't be served from the pool yet,
+	// but makes the pool create invoices for that price.
+	_, ok := pool.take(100)
+	require.False(t, ok)
+	require.Eventually(t, func() bool {
+		return numCreated() == poolSize
+	}, time.Second, 10*time.Millisecond)
+
+	// Every pooled invoice is only handed out once and the pool is
+	// refilled after each one.
+	seen := make(map[lntypes.Hash]bool)
+	for i := 0; i < 2*poolSize; i++ {
+		var invoice *pooledInvoice
+		require.Eventually(t, func() bool {
+			invoice, ok = pool.take(100)
+			return ok
+		}, time.Second, 10*time.Millisecond)
+
+		require.False(t, seen[invoice.paymentHash])
+		seen[invoice.paymentHash] = true
+	}
+
+	// Invoices that are too old are never handed out. We stop the refill
+	// first so no new invoices are added in the meantime.
+	pool.Stop()
+	pool.mtx.Lock()
+	for _, invoice := range pool.tiers[100].invoices {
+		invoice.created = time.Now().Add(-2 * time.Minute)
+	}
+	pool.mtx.Unlock()
+	_, ok = pool.take(100)
+	require.False(t, ok)
+}
+
+// TestWorkerPool tests that calls are rejected as busy once all workers are
+// occupied and the queue is full.
+func TestWorkerPool(t *testing.T) {
+	pool := newWorkerPool(1, 1)
+	defer pool.Stop()
+
+	var (
+		ctx     = context.Background()
+		started = make(chan struct{})
+		release = make(chan struct{})
+		results = make(chan error, 2)
+	)
+	blockingCall := func() error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+
+	// The first call occupies the only worker, the second one waits in the
+	// queue.
+	go func() {
+		results <- pool.run(ctx, blockingCall)
+	}()
+	<-started
+	go func() {
+		results <- pool.run(ctx, blockingCall)
+	}()
+	require.Eventually(t, func() bool {
+		return len(pool.jobs) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Any further call is rejected right away.
+	err := pool.run(ctx, func() error { return nil })
+	require.Equal(t, mint.ErrChallengerBusy, err)
+
+	// Once the worker is free again, the queued call runs too.
+	close(release)
+	<-started
+	require.NoError(t, <-results)
+	require.NoError(t, <-results)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/lndclient"
+	"github.com/lightningnetwork/lnd"
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+// buyCommand requests an LSAT protected URL and pays for a token if required.
+type buyCommand struct {
+	Insecure bool  `long:"insecure" description:"Don't verify the TLS certificate of the server, for example if aperture uses a self-signed certificate."`
+	MaxCost  int64 `long:"maxcost" description:"The maximum amount in satoshis to pay for a token, not including routing fees." default:"1000"`
+	MaxFee   int64 `long:"maxfee" description:"The maximum routing fee in satoshis to pay for a token." default:"10"`
+	Output   bool  `long:"output" description:"Print the response body of the request to stdout."`
+
+	Args struct {
+		URL string `positional-arg-name:"url" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+// Execute runs the buy command.
+func (c *buyCommand) Execute(_ []string) error {
+	store, err := hostStore(c.Args.URL)
+	if err != nil {
+		return err
+	}
+
+	lndServices, err := lndclient.NewLndServices(
+		&lndclient.LndServicesConfig{
+			LndAddress:  cfg.LndHost,
+			Network:     lndclient.Network(cfg.Network),
+			MacaroonDir: lnd.CleanAndExpandPath(cfg.MacDir),
+			TLSPath:     lnd.CleanAndExpandPath(cfg.TLSPath),
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("unable to connect to lnd: %v", err)
+	}
+	defer lndServices.Close()
+
+	baseTransport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.Insecure {
+		baseTransport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+	client := &http.Client{
+		Transport: lsat.NewTransport(
+			baseTransport, &lndServices.LndServices, store,
+			btcutil.Amount(c.MaxCost), btcutil.Amount(c.MaxFee),
+		),
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), lsat.PaymentTimeout+30*time.Second,
+	)
+	defer cancel()
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, c.Args.URL, nil,
+	)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	_, _ = fmt.Fprintf(os.Stderr, "Server responded with %s\n", resp.Status)
+	if c.Output {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		if err != nil {
+			return err
+		}
+	}
+
+	token, err := store.CurrentToken()
+	if err != nil {
+		return fmt.Errorf("no token acquired: %v", err)
+	}
+	return printJSON(newTokenInfo(hostName(c.Args.URL), "", token))
+}
+
+// listCommand lists the tokens of all hosts in the token directory.
+type listCommand struct{}
+
+// Execute runs the list command.
+func (c *listCommand) Execute(_ []string) error {
+	dir, err := tokenDir()
+	if err != nil {
+		return err
+	}
+
+	tokens, err := dir.AllTokens()
+	if err != nil {
+		return err
+	}
+
+	return printJSON(newTokenInfos(tokens))
+}
+
+// pruneCommand removes all expired tokens from the token directory.
+type pruneCommand struct{}
+
+// Execute runs the prune command.
+func (c *pruneCommand) Execute(_ []string) error {
+	dir, err := tokenDir()
+	if err != nil {
+		return err
+	}
+
+	pruned, err := dir.PruneExpired(time.Now())
+	if err != nil {
+		return err
+	}
+
+	return printJSON(newTokenInfos(pruned))
+}
+
+// hostArgs are the positional arguments of the commands that work on the
+// current token of a host.
+type hostArgs struct {
+	Host string `positional-arg-name:"host" description:"The host or URL to use the token of." required:"yes"`
+}
+
+// showCommand shows the details of the current token of a host.
+type showCommand struct {
+	Args hostArgs `positional-args:"yes"`
+}
+
+// Execute runs the show command.
+func (c *showCommand) Execute(_ []string) error {
+	store, err := hostStore(c.Args.Host)
+	if err != nil {
+		return err
+	}
+
+	token, err := store.CurrentToken()
+	if err != nil {
+		return err
+	}
+	return printJSON(newTokenInfo(hostName(c.Args.Host), "", token))
+}
+
+// exportCommand prints the current token of a host as an HTTP Authorization
+// header.
+type exportCommand struct {
+	ValueOnly bool `long:"valueonly" description:"Only print the header value, without the header name."`
+
+	Args hostArgs `positional-args:"yes"`
+}
+
+// Execute runs the export command.
+func (c *exportCommand) Execute(_ []string) error {
+	store, err := hostStore(c.Args.Host)
+	if err != nil {
+		return err
+	}
+
+	token, err := store.CurrentToken()
+	if err != nil {
+		return err
+	}
+	if token.Preimage == (lntypes.Preimage{}) {
+		return fmt.Errorf("current token is still pending, use the " +
+			"buy command to complete the payment")
+	}
+
+	header := http.Header{}
+	err = lsat.SetHeader(&header, token.BaseMacaroon(), token.Preimage)
+	if err != nil {
+		return err
+	}
+
+	value := header.Get(lsat.HeaderAuthorization)
+	if c.ValueOnly {
+		fmt.Println(value)
+		return nil
+	}
+	fmt.Printf("%s: %s\n", lsat.HeaderAuthorization, value)
+	return nil
+}
+
+// tokenInfo is the JSON representation of a token.
+type tokenInfo struct {
+	Host          string `json:"host"`
+	File          string `json:"file,omitempty"`
+	TokenID       string `json:"token_id"`
+	PaymentHash   string `json:"payment_hash"`
+	Preimage      string `json:"preimage,omitempty"`
+	AmountPaidSat int64  `json:"amount_paid_sat"`
+	RoutingFeeSat int64  `json:"routing_fee_paid_sat"`
+	TimeCreated   string `json:"time_created"`
+	Expiry        string `json:"expiry,omitempty"`
+	Pending       bool   `json:"pending"`
+	Expired       bool   `json:"expired"`
+}
+
+// newTokenInfos creates the JSON representation of the given stored tokens.
+func newTokenInfos(tokens []*lsat.StoredToken) []*tokenInfo {
+	infos := make([]*tokenInfo, 0, len(tokens))
+	for _, token := range tokens {
+		infos = append(
+			infos, newTokenInfo(token.Host, token.File, token.Token),
+		)
+	}
+	return infos
+}
+
+// newTokenInfo creates the JSON representation of a token.
+func newTokenInfo(host, file string, token *lsat.Token) *tokenInfo {
+	pending := token.Preimage == (lntypes.Preimage{})
+	info := &tokenInfo{
+		Host:          host,
+		File:          file,
+		PaymentHash:   token.PaymentHash.String(),
+		AmountPaidSat: int64(token.AmountPaid.ToSatoshis()),
+		RoutingFeeSat: int64(token.RoutingFeePaid.ToSatoshis()),
+		TimeCreated:   token.TimeCreated.Format(time.RFC3339),
+		Pending:       pending,
+		Expired:       !token.IsValid(),
+	}
+	if !token.Expiry.IsZero() {
+		info.Expiry = token.Expiry.Format(time.RFC3339)
+	}
+	if !pending {
+		info.Preimage = token.Preimage.String()
+	}
+
+	id, err := lsat.DecodeIdentifier(
+		bytes.NewReader(token.BaseMacaroon().Id()),
+	)
+	if err == nil {
+		info.TokenID = hex.EncodeToString(id.TokenID[:])
+	}
+
+	return info
+}
+
+// hostName returns the host of the given URL. If the value isn't a URL, it is
+// used as host name as is.
+func hostName(hostOrURL string) string {
+	if !strings.Contains(hostOrURL, "://") {
+		return hostOrURL
+	}
+
+	u, err := url.Parse(hostOrURL)
+	if err != nil {
+		return hostOrURL
+	}
+	return u.Host
+}
+
+// printJSON prints the given value as indented JSON to stdout.
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(b))
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/btcsuite/btcutil"
+	flags "github.com/jessevdk/go-flags"
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+var (
+	// defaultTokenDir is the default directory the tokens are stored in.
+	defaultTokenDir = btcutil.AppDataDir("lsatcli", false)
+)
+
+// config contains the options that are shared between all commands.
+type config struct {
+	TokenDir string `long:"tokendir" description:"The directory to store the LSAT token files in. The directory can be shared with all other tools that use the same token file format."`
+
+	LndHost string `long:"lndhost" description:"The host:port of the lnd node to pay invoices with." default:"localhost:10009"`
+	TLSPath string `long:"tlspath" description:"Path to lnd's TLS certificate."`
+	MacDir  string `long:"macdir" description:"Path to lnd's macaroon directory."`
+	Network string `long:"network" description:"The network lnd is connected to." default:"mainnet" choice:"regtest" choice:"simnet" choice:"testnet" choice:"mainnet"`
+}
+
+// cfg is the global configuration that is populated by the flag parser before
+// any command is executed.
+var cfg = &config{}
+
+// tokenDir opens the configured token directory.
+func tokenDir() (*lsat.TokenDir, error) {
+	dir := cfg.TokenDir
+	if dir == "" {
+		dir = defaultTokenDir
+	}
+
+	return lsat.NewTokenDir(dir)
+}
+
+// hostStore opens the token store of the host of the given URL or host name.
+func hostStore(hostOrURL string) (*lsat.HostStore, error) {
+	host := hostName(hostOrURL)
+	if host == "" {
+		return nil, fmt.Errorf("no host in %s", hostOrURL)
+	}
+
+	dir, err := tokenDir()
+	if err != nil {
+		return nil, err
+	}
+	return dir.HostStore(host)
+}
+
+func main() {
+	parser := flags.NewParser(cfg, flags.Default)
+	_, _ = parser.AddCommand(
+		"buy", "Buy a token for an LSAT protected URL",
+		"Request the given URL and pay the LSAT challenge the server "+
+			"responds with, if it does. The paid token is saved "+
+			"in the token directory and used for all subsequent "+
+			"requests to the same host.", &buyCommand{},
+	)
+	_, _ = parser.AddCommand(
+		"list", "List all stored tokens",
+		"List the tokens of all hosts in the token directory, "+
+			"including pending and expired ones.", &listCommand{},
+	)
+	_, _ = parser.AddCommand(
+		"prune", "Remove expired tokens",
+		"Remove all paid tokens that are expired from the token "+
+			"directory and list the removed tokens.",
+		&pruneCommand{},
+	)
+	_, _ = parser.AddCommand(
+		"show", "Show the current token of a host",
+		"Show the details of the token that is currently in use for "+
+			"the given host or URL.", &showCommand{},
+	)
+	_, _ = parser.AddCommand(
+		"export", "Export the current token of a host as HTTP header",
+		"Print the current token of the given host or URL in the "+
+			"format of the Authorization header, for example to "+
+			"be used with curl -H.", &exportCommand{},
+	)
+
+	if _, err := parser.Parse(); err != nil {
+		var flagErr *flags.Error
+		if errors.As(err, &flagErr) && flagErr.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+
+		// The flags library already prints parse errors, only errors
+		// of the commands themselves need to be printed.
+		if !errors.As(err, &flagErr) {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
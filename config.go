@@ -3,27 +3,153 @@ package aperture
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/btcsuite/btcutil"
+	"github.com/lightninglabs/aperture/lsat"
 	"github.com/lightninglabs/aperture/proxy"
 )
 
 var (
-	apertureDataDir        = btcutil.AppDataDir("aperture", false)
-	defaultConfigFilename  = "aperture.yaml"
-	defaultTLSKeyFilename  = "tls.key"
-	defaultTLSCertFilename = "tls.cert"
-	defaultLogLevel        = "info"
-	defaultLogFilename     = "aperture.log"
-	defaultMaxLogFiles     = 3
-	defaultMaxLogFileSize  = 10
+	apertureDataDir         = btcutil.AppDataDir("aperture", false)
+	defaultConfigFilename   = "aperture.yaml"
+	defaultTLSKeyFilename   = "tls.key"
+	defaultTLSCertFilename  = "tls.cert"
+	defaultProofKeyFilename = "proof.key"
+	defaultLogLevel         = "info"
+	defaultLogFilename      = "aperture.log"
+	defaultMaxLogFiles      = 3
+	defaultMaxLogFileSize   = 10
 )
 
 type EtcdConfig struct {
-	Host     string `long:"host" description:"host:port of an active etcd instance"`
+	Host     string `long:"host" description:"host:port of an active etcd instance, or a comma separated list of the host:port of multiple members of the same cluster"`
 	User     string `long:"user" description:"user authorized to access the etcd host"`
-	Password string `long:"password" description:"password of the etcd user"`
+	Password string `long:"password" description:"password of the etcd user" secret:"true"`
+
+	// InstanceID identifies this instance among all instances that share
+	// the same etcd cluster. It defaults to the host name.
+	InstanceID string `long:"instanceid" description:"ID of this instance among all instances using this etcd cluster (default: host name)"`
+
+	// WatchConfig makes the instance apply the configuration that is
+	// published in etcd for all instances, merged with the overrides for
+	// this instance, whenever it changes.
+	WatchConfig bool `long:"watchconfig" description:"Apply the fleet configuration published in etcd at lsat/proxy/config/fleet and the overrides at lsat/proxy/config/instances/<instanceid> whenever they change"`
+
+	// LeaderElection makes the instances that share the same etcd cluster
+	// elect a leader that is the only one to run background tasks like the
+	// onion service registration.
+	LeaderElection bool `long:"leaderelection" description:"Elect a leader among all instances using this etcd cluster that is the only one to run singleton background tasks"`
+
+	// LeaderTTL is the time after which the leadership of an unresponsive
+	// instance expires.
+	LeaderTTL time.Duration `long:"leaderttl" description:"Time after which the leadership of an instance that lost its etcd connection expires (default: 10s)"`
+
+	// SharedFreebies stores the freebie counters in etcd so all instances
+	// that share the cluster also share the free requests of a client.
+	SharedFreebies bool `long:"sharedfreebies" description:"Store the freebie counters in etcd to share them with all instances using this etcd cluster"`
+
+	// Register makes the instance register itself in etcd and keep its
+	// registration alive through heartbeats, so all instances that share
+	// the cluster can be listed.
+	Register bool `long:"register" description:"Register this instance at lsat/proxy/instances/<instanceid> with a heartbeat lease"`
+
+	// PreferNearest makes secret lookups use the etcd endpoint with the
+	// lowest latency instead of any of the configured endpoints.
+	PreferNearest bool `long:"prefernearest" description:"Look up secrets through the configured etcd endpoint with the lowest latency"`
+
+	// SerializableReads allows secret lookups to be answered by an etcd
+	// follower without asking the cluster leader.
+	SerializableReads bool `long:"serializablereads" description:"Allow secret lookups to be answered by etcd followers without a round trip to the leader"`
+
+	// SecretCacheSize is the number of secrets that are kept in memory
+	// after they were looked up the first time. Revoked secrets are
+	// removed through a watch on the secrets prefix.
+	SecretCacheSize int `long:"secretcachesize" description:"The number of secrets to keep in memory, invalidated through a watch on the secrets prefix. Zero disables the cache."`
+}
+
+type KMSConfig struct {
+	// Provider is the key management service the root key of the LSAT
+	// secrets lives in. No KMS is used if it isn't set.
+	Provider string `long:"provider" description:"The key management service that derives the LSAT secrets from a root key that never leaves it. The secrets are stored in etcd if not set." choice:"aws" choice:"gcp" choice:"command"`
+
+	// KeyID identifies the root key within the KMS.
+	KeyID string `long:"keyid" description:"The key ID or ARN of the AWS KMS HMAC key, or the resource name of the GCP Cloud KMS MAC key version."`
+
+	// Region is the AWS region of the key.
+	Region string `long:"region" description:"The AWS region of the key. Defaults to the AWS_REGION environment variable."`
+
+	// Command is the command that computes the MAC for the command
+	// provider, for example through the tools of a PKCS#11 HSM.
+	Command string `long:"command" description:"The command that reads the data from stdin and writes its MAC under the root key to stdout, for the command provider."`
+}
+
+type VaultConfig struct {
+	// Address is the address of the Vault server. Vault is not used if it
+	// isn't set.
+	Address string `long:"address" description:"The address of the Vault server, for example https://vault.example.com:8200. Vault is not used if empty."`
+
+	// TokenFile is the file the Vault token is read from.
+	TokenFile string `long:"tokenfile" description:"The file the Vault token is read from. Defaults to the VAULT_TOKEN environment variable."`
+
+	// Mount is the mount path of the KV version 2 secrets engine.
+	Mount string `long:"mount" description:"The mount path of the KV version 2 secrets engine (default: secret)."`
+
+	// LndPath is the path of the secret that holds the lnd credentials.
+	LndPath string `long:"lndpath" description:"The path of the secret with the fields macaroon (hex encoded invoice macaroon) and tlscert (PEM encoded lnd TLS certificate). Replaces authenticator.tlspath and authenticator.macdir."`
+
+	// EtcdPath is the path of the secret that holds the etcd credentials.
+	EtcdPath string `long:"etcdpath" description:"The path of the secret with the fields user and password of etcd. Replaces etcd.user and etcd.password."`
+
+	// TLSPath is the path of the secret that holds the TLS certificate
+	// and key of the server.
+	TLSPath string `long:"tlspath" description:"The path of the secret with the fields cert and key (PEM encoded) of the server's TLS certificate. The certificate is read again every hour."`
+
+	// SecretsPath is the path below which the LSAT secrets are stored.
+	SecretsPath string `long:"secretspath" description:"Store the LSAT secrets below this path in Vault instead of etcd."`
+}
+
+type AdminConfig struct {
+	// ListenAddr is the address the admin API listens on. The admin API is
+	// disabled if it isn't set.
+	ListenAddr string `long:"listenaddr" description:"The interface the unauthenticated admin API should listen on, for example localhost:8082. The admin API is disabled if empty."`
+
+	// RefundMacaroon is the name of the macaroon in the macaroon directory
+	// of lnd that refunds are sent with. Refunds are disabled if it isn't
+	// set.
+	RefundMacaroon string `long:"refundmacaroon" description:"The macaroon in the macdir of lnd that may send payments, like admin.macaroon. Enables refunds of unused token balances via keysend. With lnd credentials from Vault, the macaroon from Vault is used instead."`
+
+	// MaxRefundFee is the maximum routing fee in satoshis of a refund.
+	MaxRefundFee int64 `long:"maxrefundfee" description:"The maximum routing fee in satoshis of a refund (default: 10)."`
+
+	// FaultInjection can be set to enable the admin API endpoints that
+	// inject faults into the requests of services.
+	FaultInjection bool `long:"faultinjection" description:"Enable the admin API endpoints that inject delays, errors and connection resets into the requests of services. Only meant for staging environments."`
+}
+
+type AuditConfig struct {
+	// File is the path of the audit log. The audit log is disabled if it
+	// isn't set.
+	File string `long:"file" description:"The file security relevant events are appended to. The audit log is disabled if empty."`
+
+	// MaxFileSize is the size in MB after which the audit log is rotated.
+	MaxFileSize int64 `long:"maxfilesize" description:"The size in MB after which the audit log file is rotated (default: 100)."`
+
+	// MaxFiles is the number of rotated audit log files that are kept.
+	MaxFiles int `long:"maxfiles" description:"The number of rotated audit log files to keep. Zero keeps all of them."`
+
+	// MaxAge is the time after which rotated audit log files are removed.
+	MaxAge time.Duration `long:"maxage" description:"The time after which rotated audit log files are removed, for example 2160h. Zero keeps them forever."`
+
+	// KeyFile is the path of the file with the secret key the hashes of
+	// the entries are calculated with.
+	KeyFile string `long:"keyfile" description:"The file with the secret key the entries are chained with, so they can't be rewritten without it. The hashes are unkeyed if empty."`
+}
+
+type GeoIPConfig struct {
+	// Database is the path of the GeoIP database.
+	Database string `long:"database" description:"The path of a MaxMind DB file with country data, for example GeoLite2-Country.mmdb. Required for the allowcountries and denycountries options of services."`
 }
 
 type AuthConfig struct {
@@ -37,11 +163,55 @@ type AuthConfig struct {
 	Network string `long:"network" description:"The network LND is connected to." choice:"regtest" choice:"simnet" choice:"testnet" choice:"mainnet"`
 
 	Disable bool `long:"disable" description:"Whether to disable LND auth."`
+
+	// LNURL enables the LNURL-pay endpoints that allow wallets that only
+	// speak LNURL to pay challenges. The invoices of all challenges are
+	// then created with a description hash instead of a memo.
+	LNURL bool `long:"lnurl" description:"Offer LNURL-pay endpoints for the invoices of challenges."`
+
+	// Scheme is the name of the authentication scheme that is advertised
+	// in challenges. Tokens are always accepted under both names.
+	Scheme string `long:"scheme" description:"The authentication scheme name advertised in challenges. Tokens are accepted under both names." choice:"LSAT" choice:"L402"`
+
+	// InvoicePoolSize is the number of invoices per price that are created
+	// ahead of time, so challenges can be issued without waiting for lnd.
+	InvoicePoolSize int `long:"invoicepoolsize" description:"The number of invoices per price to create ahead of time. Zero disables the invoice pool."`
+
+	// InvoicePoolMaxAge is the maximum age of a pre-created invoice before
+	// it's discarded.
+	InvoicePoolMaxAge time.Duration `long:"invoicepoolmaxage" description:"The maximum age of a pre-created invoice before it's discarded in favor of a new one (default: 10m)."`
+
+	// Workers is the maximum number of concurrent calls to lnd for
+	// creating and looking up invoices.
+	Workers int `long:"workers" description:"The maximum number of concurrent calls to lnd for creating and looking up invoices. Zero means no limit."`
+
+	// WorkerQueue is the number of calls to lnd that can wait for a free
+	// worker before requests are rejected as busy.
+	WorkerQueue int `long:"workerqueue" description:"The number of calls to lnd that can wait for a free worker before requests are rejected with 503 Service Unavailable (default: 100)."`
+
+	// CacheSize is the number of successful token verifications that are
+	// cached, so hot clients don't need to be verified on every request.
+	CacheSize int `long:"cachesize" description:"The number of successful token verifications to cache. Zero disables the cache."`
+
+	// CacheTTL is the time a successful token verification is cached for.
+	CacheTTL time.Duration `long:"cachettl" description:"The time a successful token verification is cached for. Revoked tokens are accepted until then (default: 5s)."`
 }
 
-func (a *AuthConfig) validate() error {
-	// If we're disabled, we don't mind what these values are.
-	if a.Disable {
+func (a *AuthConfig) validate(credentialsFromVault, devMode bool) error {
+	switch a.Scheme {
+	case "", lsat.SchemeLSAT, lsat.SchemeL402:
+	default:
+		return fmt.Errorf("invalid authentication scheme %s, must be "+
+			"%s or %s", a.Scheme, lsat.SchemeLSAT, lsat.SchemeL402)
+	}
+
+	if a.CacheSize < 0 || a.CacheTTL < 0 {
+		return errors.New("cache size and TTL must not be negative")
+	}
+
+	// If we're disabled or don't use lnd in dev mode, we don't mind what
+	// these values are.
+	if a.Disable || devMode {
 		return nil
 	}
 
@@ -49,6 +219,11 @@ func (a *AuthConfig) validate() error {
 		return errors.New("lnd host required")
 	}
 
+	// The TLS certificate and macaroon can also be read from Vault.
+	if credentialsFromVault {
+		return nil
+	}
+
 	if a.TLSPath == "" {
 		return errors.New("lnd tls required")
 	}
@@ -78,6 +253,62 @@ type TorConfig struct {
 	V3          bool   `long:"v3" description:"Whether we should listen for client requests through a v3 onion service."`
 }
 
+type HealthCheckConfig struct {
+	// Enabled can be set to offer the gRPC health checking service.
+	Enabled bool `long:"enabled" description:"Whether to offer the gRPC health checking service that reports the health of the backends."`
+
+	// Interval is the interval in which the backends are checked.
+	Interval time.Duration `long:"interval" description:"The interval in which the health of the backends is checked."`
+
+	// Timeout is the maximum duration of a single backend health check.
+	Timeout time.Duration `long:"timeout" description:"The time to wait for a single backend health check to complete."`
+}
+
+type KeepaliveConfig struct {
+	// MinTime is the minimum time clients must wait between the HTTP/2
+	// pings they send. Clients that ping more often are disconnected.
+	MinTime time.Duration `long:"mintime" description:"The minimum time clients must wait between HTTP/2 pings. Clients that ping more often are disconnected. Zero disables the enforcement."`
+
+	// PermitWithoutStream can be set to allow clients to ping connections
+	// without active streams. Otherwise they may only do so every two
+	// hours.
+	PermitWithoutStream bool `long:"permitwithoutstream" description:"Allow clients to ping connections that don't have active streams."`
+}
+
+// ProxyProtocolConfig holds the options to read the PROXY protocol header L4
+// load balancers send in front of the connections they forward.
+type ProxyProtocolConfig struct {
+	// Enabled can be set to read the address of the client from the
+	// PROXY protocol header of the connections to the main listener.
+	Enabled bool `long:"enabled" description:"Read the client address from the PROXY protocol v1 or v2 header of connections to the main listener."`
+
+	// Required can be set to close connections of trusted sources that
+	// don't start with a header.
+	Required bool `long:"required" description:"Close connections from trusted sources that don't start with a PROXY protocol header."`
+
+	// TrustedSources are the networks of the load balancers that may send
+	// a header. The headers of other peers are not read, so clients can't
+	// spoof their address. At least one is required.
+	TrustedSources []string `long:"trustedsource" description:"A network in CIDR notation or an IP address of a load balancer that may send PROXY protocol headers. At least one is required."`
+
+	// HeaderTimeout is the maximum time to wait for the header of a
+	// connection.
+	HeaderTimeout time.Duration `long:"headertimeout" description:"The maximum time to wait for the PROXY protocol header of a connection (default 5s)."`
+}
+
+// ClientIPConfig holds the options to read the address of clients from a
+// header field of the requests trusted proxies, like a CDN, forward.
+type ClientIPConfig struct {
+	// Header is the header field the trusted proxies tell the address of
+	// the client with. If it's empty, the address of the peer is used.
+	Header string `long:"header" description:"The header field trusted proxies tell the client IP address with, one of X-Forwarded-For, CF-Connecting-IP or X-Real-IP."`
+
+	// TrustedProxies are the networks of the proxies whose header field
+	// is read. The header field of other peers is ignored, so clients
+	// can't spoof their address.
+	TrustedProxies []string `long:"trustedproxy" description:"A network in CIDR notation or an IP address of a proxy whose client IP header field is trusted."`
+}
+
 type Config struct {
 	// ListenAddr is the listening address that we should use to allow Aperture
 	// to listen for requests.
@@ -98,16 +329,179 @@ type Config struct {
 	// is located.
 	StaticRoot string `long:"staticroot" description:"The folder where the static content is located."`
 
+	// StaticBucket is an S3-compatible bucket the static content is read
+	// from instead of the StaticRoot directory.
+	StaticBucket *StaticBucket `group:"staticbucket" namespace:"staticbucket"`
+
+	// StaticFS is a file system the static content is read from instead
+	// of the StaticRoot directory. It can't be configured, but lets
+	// embedders serve content that is compiled into their binary, like an
+	// embed.FS wrapped by http.FS.
+	StaticFS http.FileSystem `json:"-" yaml:"-"`
+
 	// ServeStatic defines if static content should be served from the
 	// directory defined by StaticRoot.
 	ServeStatic bool `long:"servestatic" description:"Flag to enable or disable static content serving."`
 
+	// StaticSPA can be set to serve the index.html of the static root for
+	// paths that don't exist, so the client-side routes of a single-page
+	// app don't end in a 404 answer.
+	StaticSPA bool `long:"staticspa" description:"Serve the index.html of the static root for paths that don't exist, for single-page app routing."`
+
+	// StaticNoListing can be set to answer requests for directories of
+	// the static root that don't contain an index.html with a 404 instead
+	// of a listing of their content.
+	StaticNoListing bool `long:"staticnolisting" description:"Don't list the content of static directories that don't contain an index.html."`
+
+	// StaticTemplates can be set to render the HTML files of the static
+	// root as templates with the live configuration of the proxy.
+	StaticTemplates bool `long:"statictemplates" description:"Render the static HTML files as templates with the live configuration, like the services and their prices."`
+
+	// StaticMarkdown can be set to render the Markdown files of the static
+	// root as HTML pages, for example to publish API docs.
+	StaticMarkdown bool `long:"staticmarkdown" description:"Render the static Markdown files as styled HTML pages."`
+
+	// StaticMarkdownTemplate is the HTML template file the Markdown pages
+	// of the static root are rendered with instead of the built-in one.
+	StaticMarkdownTemplate string `long:"staticmarkdowntemplate" description:"The HTML template file static Markdown pages are rendered with instead of the built-in one."`
+
+	// StaticProtected is a list of path patterns of files of the static
+	// root that require a paid LSAT, like /reports/*.pdf.
+	StaticProtected []string `long:"staticprotected" description:"Path patterns of static files that require a paid LSAT, like /reports/*.pdf or /**.zip."`
+
+	// StaticPrice is the price in satoshis of an LSAT for the protected
+	// files of the static root.
+	StaticPrice int64 `long:"staticprice" description:"The price in satoshis of an LSAT for the protected static files."`
+
+	// StaticPrices maps path patterns of files of the static root to the
+	// price in satoshis of each of the matching files. An LSAT bought for
+	// such a file only unlocks that file.
+	StaticPrices map[string]int64 `long:"staticprices" description:"Path patterns of static files that are sold one by one, mapped to the price of each file, like /downloads/*.zip:500."`
+
+	// StaticSignedURLs holds the options to hand out signed, expiring
+	// URLs of the paid files of the static root.
+	StaticSignedURLs *proxy.SignedURLConfig `group:"staticsignedurls" namespace:"staticsignedurls"`
+
+	// StaticQuota holds the number of bytes of the paid files of the
+	// static root each LSAT pays for.
+	StaticQuota *proxy.QuotaConfig `group:"staticquota" namespace:"staticquota"`
+
+	// StaticMounts are directories of static files that are served below
+	// their own URL path prefix, each with its own authentication level.
+	// They take precedence over the static root but not over the
+	// services.
+	StaticMounts []*StaticMount `long:"staticmount" description:"Directories of static files served below a URL path prefix, with their own authentication."`
+
+	// ValidateOnly can be set to run aperture as a validation-only sidecar
+	// next to an application server. No requests are proxied in that mode,
+	// every incoming request is treated as a request to verify the LSAT of
+	// an original client request instead.
+	ValidateOnly bool `long:"validateonly" description:"Only validate LSATs on behalf of a colocated application server instead of proxying requests to backend services."`
+
+	// GRPCReflection can be set to offer the gRPC server reflection
+	// service on the public listener. The reflection data is aggregated
+	// from all backend services that have reflection enabled.
+	GRPCReflection bool `long:"grpcreflection" description:"Offer gRPC server reflection aggregated from all backends that opted in."`
+
+	// StrictHTTP can be set to reject requests that could be framed
+	// differently by aperture and an HTTP/1.1 backend, for example
+	// because they contain both a Content-Length and a Transfer-Encoding
+	// header.
+	StrictHTTP bool `long:"stricthttp" description:"Reject requests with conflicting Content-Length and Transfer-Encoding headers, malformed header names or absolute-form request targets."`
+
+	// CopyBufferSize is the size of the buffers the response bodies of the
+	// backends are copied to clients with. The buffers are pooled, so
+	// larger ones speed up large downloads without an allocation per
+	// response.
+	CopyBufferSize int `long:"copybuffersize" description:"The size in bytes of the pooled buffers response bodies are copied to clients with (default 32 KiB)"`
+
+	// ProofKeyFile is the path to the Ed25519 key the proofs of the
+	// responses of services with response signing enabled are signed
+	// with. It's created if it doesn't exist.
+	ProofKeyFile string `long:"proofkeyfile" description:"Path to the Ed25519 key response proofs are signed with, created if it doesn't exist. Defaults to proof.key in the base dir."`
+
+	// SelfTest can be set to check the connections to all external
+	// dependencies and exit instead of serving requests.
+	SelfTest bool `long:"selftest" description:"Check the connections to lnd, etcd, Tor and all backends, mint and verify a throwaway token, print a summary and exit."`
+
+	// Dev can be set to create and settle invoices with an in-memory mock
+	// of lnd instead of a real node, so the full payment flow can be
+	// exercised during development.
+	Dev bool `long:"dev" description:"Development mode: create regtest invoices without a Lightning node and settle them automatically. Never use this in production."`
+
+	// DevSettleDelay is the time after which the invoices of the dev mode
+	// are settled.
+	DevSettleDelay time.Duration `long:"devsettledelay" description:"The time after which invoices are settled in development mode."`
+
+	// DevManualSettle can be set to only settle the invoices of the dev
+	// mode through the settle endpoint.
+	DevManualSettle bool `long:"devmanualsettle" description:"Only settle invoices in development mode when POST /.aperture/dev/settle/<payment hash> is called."`
+
+	// DrainTimeout is the maximum time to wait for open connections to
+	// finish after the listening sockets were handed over to an upgraded
+	// binary.
+	DrainTimeout time.Duration `long:"draintimeout" description:"Maximum time to wait for open connections to finish after handing over to an upgraded binary on SIGUSR2. Zero means no limit."`
+
+	// HealthCheck is the configuration section for the gRPC health
+	// checking service.
+	HealthCheck *HealthCheckConfig `group:"healthcheck" namespace:"healthcheck"`
+
+	// Store is the store the state of aperture, like the LSAT secrets, the
+	// onion service keys and the freebie counters, is kept in.
+	Store string `long:"store" description:"The store the LSAT secrets, onion service keys and freebie counters are kept in. The memory store loses everything on restart and can't be shared by multiple instances." choice:"etcd" choice:"memory"`
+
 	Etcd *EtcdConfig `group:"etcd" namespace:"etcd"`
 
 	Authenticator *AuthConfig `group:"authenticator" namespace:"authenticator"`
 
 	Tor *TorConfig `group:"tor" namespace:"tor"`
 
+	// KMS is the configuration section for deriving the LSAT secrets
+	// through a key management service.
+	KMS *KMSConfig `group:"kms" namespace:"kms"`
+
+	// Vault is the configuration section for reading credentials from and
+	// storing LSAT secrets in HashiCorp Vault.
+	Vault *VaultConfig `group:"vault" namespace:"vault"`
+
+	// Admin is the configuration section for the admin API.
+	Admin *AdminConfig `group:"admin" namespace:"admin"`
+
+	// GeoIP is the configuration section for looking up the country of
+	// clients.
+	GeoIP *GeoIPConfig `group:"geoip" namespace:"geoip"`
+
+	// Audit is the configuration section for the audit log.
+	Audit *AuditConfig `group:"audit" namespace:"audit"`
+
+	// Keepalive is the configuration section for the enforcement policy
+	// of the HTTP/2 pings clients send.
+	Keepalive *KeepaliveConfig `group:"keepalive" namespace:"keepalive"`
+
+	// ProxyProtocol is the configuration section for reading the PROXY
+	// protocol headers of load balancers.
+	ProxyProtocol *ProxyProtocolConfig `group:"proxyprotocol" namespace:"proxyprotocol"`
+
+	// DNS is the configuration section for the resolver the addresses of
+	// backends are looked up with.
+	DNS *proxy.DNSConfig `group:"dns" namespace:"dns"`
+
+	// Kubernetes is the configuration section for serving the annotated
+	// services of a Kubernetes namespace.
+	Kubernetes *KubernetesConfig `group:"kubernetes" namespace:"kubernetes"`
+
+	// ClientIP is the configuration section for reading the address of
+	// clients behind trusted proxies.
+	ClientIP *ClientIPConfig `group:"clientip" namespace:"clientip"`
+
+	// DebugTrace is the configuration section for tracing single requests
+	// that carry a secret header field.
+	DebugTrace *proxy.TraceConfig `group:"debugtrace" namespace:"debugtrace"`
+
+	// Pruning is the configuration section for the job that prunes
+	// expired and revoked tokens.
+	Pruning *PruningConfig `group:"pruning" namespace:"pruning"`
+
 	// Services is a list of JSON objects in string format, which specify
 	// each backend service to Aperture.
 	Services []*proxy.Service `long:"service" description:"Configurations for each Aperture backend service."`
@@ -125,18 +519,132 @@ type Config struct {
 
 	// BaseDir is a custom directory to store all aperture flies.
 	BaseDir string `long:"basedir" description:"Directory to place all of aperture's files in."`
+
+	// StrictConfig can be set to reject config files with fields that
+	// don't exist, like misspelled options, instead of ignoring them.
+	StrictConfig bool `long:"strictconfig" description:"Reject unknown or misspelled fields in the config file instead of ignoring them."`
 }
 
 func (c *Config) validate() error {
+	vaultEnabled := c.Vault != nil && c.Vault.Address != ""
 	if c.Authenticator != nil {
-		if err := c.Authenticator.validate(); err != nil {
+		err := c.Authenticator.validate(
+			vaultEnabled && c.Vault.LndPath != "", c.Dev,
+		)
+		if err != nil {
 			return err
 		}
 	}
 
+	if vaultEnabled && c.Vault.SecretsPath != "" && c.KMS != nil &&
+		c.KMS.Provider != "" {
+
+		return fmt.Errorf("LSAT secrets can either be stored in Vault " +
+			"or derived through a KMS, not both")
+	}
+
 	if c.ListenAddr == "" {
 		return fmt.Errorf("missing listen address for server")
 	}
 
+	geoIPEnabled := c.GeoIP != nil && c.GeoIP.Database != ""
+	for _, service := range c.Services {
+		if service.HasCountryRules() && !geoIPEnabled {
+			return fmt.Errorf("service %s has country rules but no "+
+				"GeoIP database is configured", service.Name)
+		}
+	}
+
+	if c.Pruning != nil {
+		if err := c.Pruning.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Store == storeMemory {
+		if err := c.validateMemoryStore(); err != nil {
+			return err
+		}
+	}
+
+	if c.CopyBufferSize != 0 && c.CopyBufferSize < 1024 {
+		return fmt.Errorf("copy buffer size must be at least 1024 " +
+			"bytes")
+	}
+
+	if c.Keepalive != nil && c.Keepalive.MinTime < 0 {
+		return fmt.Errorf("negative minimum keepalive ping time")
+	}
+
+	if c.ProxyProtocol != nil && c.ProxyProtocol.Enabled {
+		if c.ProxyProtocol.HeaderTimeout < 0 {
+			return fmt.Errorf("negative PROXY protocol header " +
+				"timeout")
+		}
+		if len(c.ProxyProtocol.TrustedSources) == 0 {
+			return fmt.Errorf("PROXY protocol needs at least one " +
+				"trusted source")
+		}
+		_, err := parseNetworks(c.ProxyProtocol.TrustedSources)
+		if err != nil {
+			return fmt.Errorf("invalid PROXY protocol trusted "+
+				"source: %v", err)
+		}
+	}
+
+	if c.DNS != nil && c.DNS.Enabled {
+		if _, err := proxy.NewDNSResolver(c.DNS); err != nil {
+			return fmt.Errorf("invalid DNS configuration: %v", err)
+		}
+	}
+
+	if c.Kubernetes != nil && c.Kubernetes.ResyncInterval < 0 {
+		return fmt.Errorf("negative Kubernetes resync interval")
+	}
+
+	if c.ClientIP != nil && c.ClientIP.Header != "" {
+		if _, err := newClientIPResolver(c.ClientIP); err != nil {
+			return fmt.Errorf("invalid client IP configuration: %v",
+				err)
+		}
+	}
+
+	if c.DebugTrace != nil {
+		if err := c.DebugTrace.Validate(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+// validateMemoryStore makes sure that no feature that needs etcd is enabled if
+// the state is only kept in memory.
+func (c *Config) validateMemoryStore() error {
+	var feature string
+	switch {
+	case c.Etcd != nil && c.Etcd.WatchConfig:
+		feature = "watching the fleet configuration"
+
+	case c.Etcd != nil && c.Etcd.LeaderElection:
+		feature = "leader election"
+
+	case c.Etcd != nil && c.Etcd.SharedFreebies:
+		feature = "shared freebies"
+
+	case c.Etcd != nil && c.Etcd.Register:
+		feature = "the instance registry"
+
+	case c.KMS != nil && c.KMS.Provider != "":
+		feature = "deriving secrets through a KMS"
+
+	case c.Pruning != nil && c.Pruning.Enabled:
+		feature = "token pruning"
+
+	default:
+		return nil
+	}
+
+	return fmt.Errorf("%s requires etcd and can't be used with the "+
+		"memory store", feature)
+}
@@ -0,0 +1,159 @@
+package aperture
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/lightninglabs/aperture/proxy"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// configDumpCommand is the name of the command that asks the admin API
+	// of a running aperture for its effective configuration.
+	configDumpCommand = "configdump"
+)
+
+// configDumpConfig holds the options of the configdump command.
+type configDumpConfig struct {
+	AdminAddr string        `long:"adminaddr" description:"The address of the admin API of the aperture instance to ask." default:"localhost:8082"`
+	Timeout   time.Duration `long:"timeout" description:"The timeout of the request to the admin API." default:"10s"`
+}
+
+// runConfigDump parses the options of the configdump command from the given
+// arguments, fetches the effective configuration of the running instance from
+// the admin API and writes it to the given writer.
+func runConfigDump(args []string, out io.Writer) error {
+	cfg := &configDumpConfig{}
+	if _, err := flags.ParseArgs(cfg, args); err != nil {
+		return fmt.Errorf("unable to parse configdump options: %w", err)
+	}
+
+	configURL := url.URL{
+		Scheme: "http",
+		Host:   cfg.AdminAddr,
+		Path:   adminConfigPath,
+	}
+
+	client := &http.Client{Timeout: cfg.Timeout}
+	resp, err := client.Get(configURL.String())
+	if err != nil {
+		return fmt.Errorf("unable to reach admin API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("admin API returned %v: %s", resp.Status,
+			bytes.TrimSpace(body))
+	}
+
+	_, err = out.Write(body)
+	return err
+}
+
+// effectiveConfig returns the configuration the instance runs with as YAML, in
+// the format of the config file. It holds the values after the file and the
+// command line were merged, paths were expanded and defaults were set. The
+// services are the ones the proxy currently serves, including those added at
+// run time. Fields with zero values are left out and the values of fields
+// tagged with secret:"true" are redacted.
+func (a *Aperture) effectiveConfig() ([]byte, error) {
+	cfg := *a.cfg
+	if a.proxy != nil {
+		cfg.Services = a.proxy.Services()
+	}
+
+	dump, _ := dumpValue(reflect.ValueOf(cfg), false)
+	return yaml.Marshal(dump)
+}
+
+// dumpValue returns the value in a form that is marshaled like the config file,
+// with the fields of structs in the order they're declared in. False is
+// returned if the value is empty and should be left out. All values are
+// replaced with a placeholder if secret is set.
+func dumpValue(v reflect.Value, secret bool) (interface{}, bool) {
+	if v.IsZero() {
+		return nil, false
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return dumpValue(v.Elem(), secret)
+
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			return v.Interface(), true
+		}
+
+		var fields yaml.MapSlice
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+
+			name := strings.ToLower(field.Name)
+			yamlTag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			switch yamlTag {
+			case "-":
+				continue
+
+			case "":
+
+			default:
+				name = yamlTag
+			}
+
+			fieldSecret := secret || field.Tag.Get("secret") != ""
+			value, ok := dumpValue(v.Field(i), fieldSecret)
+			if !ok {
+				continue
+			}
+			fields = append(fields, yaml.MapItem{
+				Key:   name,
+				Value: value,
+			})
+		}
+		return fields, len(fields) > 0
+
+	case reflect.Slice, reflect.Array:
+		items := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			item, _ := dumpValue(v.Index(i), secret)
+			items = append(items, item)
+		}
+		return items, true
+
+	// Only the values of maps are secret, like the values of the header
+	// fields of a service, so the keys are kept.
+	case reflect.Map:
+		entries := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			value, _ := dumpValue(iter.Value(), secret)
+			entries[fmt.Sprint(iter.Key().Interface())] = value
+		}
+		return entries, true
+
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return nil, false
+
+	default:
+		if secret {
+			return proxy.RedactedValue, true
+		}
+		return v.Interface(), true
+	}
+}
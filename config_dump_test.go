@@ -0,0 +1,76 @@
+package aperture
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"gopkg.in/yaml.v2"
+)
+
+// TestEffectiveConfig tests that the effective configuration is written in the
+// format of the config file, without options that aren't set and with the
+// values of secrets redacted.
+func TestEffectiveConfig(t *testing.T) {
+	a := &Aperture{
+		cfg: &Config{
+			ListenAddr: "localhost:8081",
+			Etcd: &EtcdConfig{
+				Host:     "localhost:2379",
+				User:     "aperture",
+				Password: "etcd-password",
+			},
+			DebugTrace: &proxy.TraceConfig{
+				Secret: "trace-secret-of-16",
+			},
+			Services: []*proxy.Service{{
+				Name:       "svc",
+				HostRegexp: "example.com",
+				Address:    "localhost:8080",
+				Headers: map[string]string{
+					"Authorization": "Bearer backend-token",
+				},
+				Keepalive: proxy.KeepaliveConfig{
+					Time: time.Minute,
+				},
+			}},
+		},
+	}
+
+	config, err := a.effectiveConfig()
+	if err != nil {
+		t.Fatalf("unable to dump config: %v", err)
+	}
+
+	for _, secret := range []string{
+		"etcd-password", "trace-secret-of-16", "backend-token",
+	} {
+		if strings.Contains(string(config), secret) {
+			t.Fatalf("secret %q wasn't redacted:\n%s", secret,
+				config)
+		}
+	}
+	if strings.Contains(string(config), "staticroot") {
+		t.Fatalf("option that isn't set was dumped:\n%s", config)
+	}
+
+	// The dump must be a valid config file itself.
+	var parsed Config
+	if err := yaml.UnmarshalStrict(config, &parsed); err != nil {
+		t.Fatalf("dump isn't a valid config: %v\n%s", err, config)
+	}
+	if parsed.ListenAddr != "localhost:8081" ||
+		parsed.Etcd.User != "aperture" ||
+		parsed.Etcd.Password != proxy.RedactedValue {
+
+		t.Fatalf("unexpected etcd config %+v", parsed.Etcd)
+	}
+	if len(parsed.Services) != 1 ||
+		parsed.Services[0].Keepalive.Time != time.Minute ||
+		parsed.Services[0].Headers["Authorization"] !=
+			proxy.RedactedValue {
+
+		t.Fatalf("unexpected services %+v", parsed.Services)
+	}
+}
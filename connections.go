@@ -0,0 +1,167 @@
+package aperture
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// connCount is the number of open client connections of a listener.
+type connCount struct {
+	Listener string `json:"listener"`
+	Active   int    `json:"active"`
+	Idle     int    `json:"idle"`
+}
+
+// connTracker keeps track of the open client connections of our servers by
+// the name of their listener.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[string]map[net.Conn]http.ConnState
+}
+
+// newConnTracker creates a new tracker without any connections.
+func newConnTracker() *connTracker {
+	return &connTracker{
+		conns: make(map[string]map[net.Conn]http.ConnState),
+	}
+}
+
+// hook returns the ConnState hook of a server that accepts connections on the
+// listener with the given name. Hijacked connections, like those of upgraded
+// requests and HTTP/2 connections without TLS, aren't counted anymore once
+// they're hijacked. Their requests are still counted as requests in flight of
+// the services.
+func (c *connTracker) hook(listener string) func(net.Conn, http.ConnState) {
+	c.mu.Lock()
+	if c.conns[listener] == nil {
+		c.conns[listener] = make(map[net.Conn]http.ConnState)
+	}
+	c.mu.Unlock()
+
+	return func(conn net.Conn, state http.ConnState) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		switch state {
+		case http.StateClosed, http.StateHijacked:
+			delete(c.conns[listener], conn)
+
+		default:
+			c.conns[listener][conn] = state
+		}
+	}
+}
+
+// counts returns the number of open connections of each listener, sorted by
+// the name of the listener. New connections that haven't sent a request yet
+// are counted as active.
+func (c *connTracker) counts() []*connCount {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := make([]*connCount, 0, len(c.conns))
+	for listener, conns := range c.conns {
+		count := &connCount{Listener: listener}
+		for _, state := range conns {
+			if state == http.StateIdle {
+				count.Idle++
+			} else {
+				count.Active++
+			}
+		}
+		counts = append(counts, count)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].Listener < counts[j].Listener
+	})
+
+	return counts
+}
+
+var (
+	connectionsDesc = prometheus.NewDesc(
+		"aperture_client_connections",
+		"The number of open client connections.",
+		[]string{"listener", "state"}, nil,
+	)
+	inFlightDesc = prometheus.NewDesc(
+		"aperture_service_requests_in_flight",
+		"The number of requests a service is currently handling.",
+		[]string{"service"}, nil,
+	)
+	grpcStreamsDesc = prometheus.NewDesc(
+		"aperture_service_grpc_streams",
+		"The number of gRPC calls a service is currently handling.",
+		[]string{"service"}, nil,
+	)
+)
+
+// activityCollector exports the open client connections and the requests in
+// flight of the services as Prometheus metrics.
+type activityCollector struct {
+	conns *connTracker
+	proxy *proxy.Proxy
+}
+
+// A compile-time constraint to ensure activityCollector implements
+// prometheus.Collector.
+var _ prometheus.Collector = (*activityCollector)(nil)
+
+// Describe sends the descriptors of the metrics to the given channel.
+//
+// NOTE: This is part of the prometheus.Collector interface.
+func (c *activityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connectionsDesc
+	ch <- inFlightDesc
+	ch <- grpcStreamsDesc
+}
+
+// Collect sends the current values of the metrics to the given channel.
+//
+// NOTE: This is part of the prometheus.Collector interface.
+func (c *activityCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, count := range c.conns.counts() {
+		ch <- prometheus.MustNewConstMetric(
+			connectionsDesc, prometheus.GaugeValue,
+			float64(count.Active), count.Listener, "active",
+		)
+		ch <- prometheus.MustNewConstMetric(
+			connectionsDesc, prometheus.GaugeValue,
+			float64(count.Idle), count.Listener, "idle",
+		)
+	}
+
+	for _, service := range c.proxy.Activity() {
+		ch <- prometheus.MustNewConstMetric(
+			inFlightDesc, prometheus.GaugeValue,
+			float64(service.InFlight), service.Service,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			grpcStreamsDesc, prometheus.GaugeValue,
+			float64(service.GRPCStreams), service.Service,
+		)
+	}
+}
+
+// handleConnections returns the open client connections and the requests in
+// flight of every service.
+func (a *Aperture) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := struct {
+		Connections []*connCount             `json:"connections"`
+		Services    []*proxy.ServiceActivity `json:"services"`
+	}{
+		Connections: a.conns.counts(),
+		Services:    a.proxy.Activity(),
+	}
+	writeAdminJSON(w, resp)
+}
@@ -0,0 +1,104 @@
+package aperture
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/proxy"
+)
+
+// TestConnectionAccounting tests that open client connections and the
+// requests in flight of services are counted.
+func TestConnectionAccounting(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	prxy, err := proxy.New(auth.NewMockAuthenticator(), []*proxy.Service{{
+		Name:       "slow",
+		HostRegexp: ".*",
+		Auth:       "off",
+		Handler: http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/wait" {
+					close(started)
+					<-release
+				}
+				_, _ = w.Write([]byte("ok"))
+			},
+		),
+	}})
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	conns := newConnTracker()
+	server := httptest.NewUnstartedServer(prxy)
+	server.Config.ConnState = conns.hook(mainListenerName)
+	server.Start()
+	defer server.Close()
+
+	assertCounts := func(active, idle int, inFlight int64) {
+		t.Helper()
+
+		// The server reports the state of a connection after it
+		// changed, so we might have to wait for it.
+		var counts []*connCount
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			counts = conns.counts()
+			if len(counts) == 1 && counts[0].Active == active &&
+				counts[0].Idle == idle {
+
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if len(counts) != 1 || counts[0].Active != active ||
+			counts[0].Idle != idle {
+
+			t.Fatalf("expected %d active and %d idle connections, "+
+				"got %+v", active, idle, counts)
+		}
+
+		activity := prxy.Activity()
+		if len(activity) != 1 || activity[0].InFlight != inFlight {
+			t.Fatalf("expected %d requests in flight, got %+v",
+				inFlight, activity)
+		}
+	}
+	assertCounts(0, 0, 0)
+
+	// A connection that is kept alive after its request is idle.
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("unable to send request: %v", err)
+	}
+	_, _ = ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assertCounts(0, 1, 0)
+
+	// A request that is handled keeps its connection active.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		resp, err := http.Get(server.URL + "/wait")
+		if err == nil {
+			_, _ = ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+		}
+	}()
+	<-started
+	assertCounts(1, 0, 1)
+
+	close(release)
+	<-done
+	assertCounts(0, 1, 0)
+
+	// Closed connections aren't counted anymore.
+	http.DefaultClient.CloseIdleConnections()
+	assertCounts(0, 0, 0)
+}
@@ -0,0 +1,245 @@
+package aperture
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lightninglabs/aperture/proxy"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	// delegationPrefix is the key we'll use to prefix the delegated tokens
+	// with when storing them in an etcd cluster.
+	delegationPrefix = "delegation"
+
+	// ownerPrefix is the key we'll use to prefix the index of the
+	// delegated tokens of each owner with.
+	ownerPrefix = "delegations"
+
+	// errDelegationConflict is returned if a delegation was changed by
+	// someone else between reading and updating it.
+	errDelegationConflict = fmt.Errorf("delegation changed concurrently")
+)
+
+// delegationKey returns the full key to store a delegated token in the
+// database.
+//
+// The resulting path of the delegation with the ID "abc" within etcd would
+// look like:
+//
+//	lsat/proxy/delegation/abc
+func delegationKey(id string) string {
+	return strings.Join(
+		[]string{topLevelKey, delegationPrefix, id}, etcdKeyDelimeter,
+	)
+}
+
+// ownerKey returns the full key of the index entry of a delegated token of an
+// owner. An empty ID returns the prefix of all delegations of the owner.
+//
+// The resulting path of the delegation with the ID "abc" of the owner "def"
+// within etcd would look like:
+//
+//	lsat/proxy/delegations/def/abc
+func ownerKey(owner, id string) string {
+	return strings.Join(
+		[]string{topLevelKey, ownerPrefix, owner, id},
+		etcdKeyDelimeter,
+	)
+}
+
+// delegationStore is a delegation store backed by an etcd cluster. All
+// aperture instances that share the cluster also share the delegations, so a
+// revoked token is rejected by all of them and the requests of a token are
+// counted together.
+type delegationStore struct {
+	*clientv3.Client
+}
+
+// A compile-time constraint to ensure delegationStore implements
+// proxy.DelegationStore.
+var _ proxy.DelegationStore = (*delegationStore)(nil)
+
+// newDelegationStore creates a new delegation store backed by the given etcd
+// client.
+func newDelegationStore(client *clientv3.Client) *delegationStore {
+	return &delegationStore{Client: client}
+}
+
+// AddDelegation stores a new delegation together with its index entry.
+//
+// NOTE: This is part of the proxy.DelegationStore interface.
+func (s *delegationStore) AddDelegation(ctx context.Context,
+	delegation *proxy.Delegation) error {
+
+	value, err := json.Marshal(delegation)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Txn(ctx).Then(
+		clientv3.OpPut(delegationKey(delegation.ID), string(value)),
+		clientv3.OpPut(ownerKey(delegation.Owner, delegation.ID), ""),
+	).Commit()
+	return err
+}
+
+// Delegation returns the delegation with the given ID, or nil if there is none.
+//
+// NOTE: This is part of the proxy.DelegationStore interface.
+func (s *delegationStore) Delegation(ctx context.Context,
+	id string) (*proxy.Delegation, error) {
+
+	delegation, _, err := s.get(ctx, id)
+	return delegation, err
+}
+
+// Delegations returns the delegations of the given owner.
+//
+// NOTE: This is part of the proxy.DelegationStore interface.
+func (s *delegationStore) Delegations(ctx context.Context,
+	owner string) ([]*proxy.Delegation, error) {
+
+	prefix := ownerKey(owner, "")
+	resp, err := s.Get(
+		ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	delegations := make([]*proxy.Delegation, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		id := strings.TrimPrefix(string(kv.Key), prefix)
+		delegation, _, err := s.get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if delegation != nil {
+			delegations = append(delegations, delegation)
+		}
+	}
+
+	return delegations, nil
+}
+
+// RevokeDelegation revokes the delegation with the given ID if it belongs to
+// the given owner.
+//
+// NOTE: This is part of the proxy.DelegationStore interface.
+func (s *delegationStore) RevokeDelegation(ctx context.Context, owner,
+	id string) (bool, error) {
+
+	return s.update(ctx, id, func(delegation *proxy.Delegation) bool {
+		if delegation.Owner != owner {
+			return false
+		}
+
+		delegation.Revoked = true
+		return true
+	})
+}
+
+// UseDelegation atomically records a request made with the delegated token if
+// it isn't revoked and hasn't used up its requests. If a concurrent request
+// was recorded in the meantime, the update is retried with the new value.
+//
+// NOTE: This is part of the proxy.DelegationStore interface.
+func (s *delegationStore) UseDelegation(ctx context.Context,
+	id string) (bool, error) {
+
+	return s.update(ctx, id, func(delegation *proxy.Delegation) bool {
+		if delegation.Revoked {
+			return false
+		}
+		if delegation.Requests > 0 &&
+			delegation.Used >= delegation.Requests {
+
+			return false
+		}
+
+		delegation.Used++
+		return true
+	})
+}
+
+// get returns the delegation with the given ID and the revision it was last
+// modified at, or nil if there is none.
+func (s *delegationStore) get(ctx context.Context,
+	id string) (*proxy.Delegation, int64, error) {
+
+	resp, err := s.Get(ctx, delegationKey(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+
+	delegation := &proxy.Delegation{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, delegation); err != nil {
+		return nil, 0, err
+	}
+
+	return delegation, resp.Kvs[0].ModRevision, nil
+}
+
+// update atomically applies the given change to the delegation with the given
+// ID. If the change returns false, the delegation is left as it is and false
+// is returned. Concurrent changes are retried.
+func (s *delegationStore) update(ctx context.Context, id string,
+	change func(*proxy.Delegation) bool) (bool, error) {
+
+	for {
+		ok, err := s.tryUpdate(ctx, id, change)
+		switch {
+		case err == errDelegationConflict:
+			continue
+
+		case err != nil:
+			return false, err
+
+		default:
+			return ok, nil
+		}
+	}
+}
+
+// tryUpdate tries to apply the change to the delegation with the given ID once.
+func (s *delegationStore) tryUpdate(ctx context.Context, id string,
+	change func(*proxy.Delegation) bool) (bool, error) {
+
+	delegation, modRevision, err := s.get(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	if delegation == nil || !change(delegation) {
+		return false, nil
+	}
+
+	value, err := json.Marshal(delegation)
+	if err != nil {
+		return false, err
+	}
+
+	// Only write the new value if the key wasn't modified since we read
+	// it.
+	key := delegationKey(id)
+	txnResp, err := s.Txn(ctx).
+		If(clientv3.Compare(
+			clientv3.ModRevision(key), "=", modRevision,
+		)).
+		Then(clientv3.OpPut(key, string(value))).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	if !txnResp.Succeeded {
+		return false, errDelegationConflict
+	}
+
+	return true, nil
+}
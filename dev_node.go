@@ -0,0 +1,385 @@
+package aperture
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"google.golang.org/grpc"
+)
+
+const (
+	// devSettlePathPrefix is the prefix of the endpoint that settles an
+	// invoice of the dev node right away. The invoice is identified by the
+	// hex encoded payment hash following the prefix.
+	devSettlePathPrefix = "/.aperture/dev/settle/"
+
+	// defaultDevInvoiceExpiry is the expiry of the invoices of the dev
+	// node that don't request one, the same default lnd uses.
+	defaultDevInvoiceExpiry = int64(24 * time.Hour / time.Second)
+)
+
+var (
+	// devChainParams are the parameters of the chain the invoices of the
+	// dev node are issued for.
+	devChainParams = &chaincfg.RegressionNetParams
+)
+
+// devNode is an in-memory stand-in for the invoice part of lnd. It settles the
+// invoices it creates on its own after a delay, or when they are settled
+// through its settle endpoint, so the full payment flow can be exercised
+// without a Lightning node or wallet.
+type devNode struct {
+	privKey      *btcec.PrivateKey
+	settleDelay  time.Duration
+	manualSettle bool
+
+	mu            sync.Mutex
+	invoices      map[lntypes.Hash]*lnrpc.Invoice
+	addIndex      uint64
+	settleIndex   uint64
+	subscriptions map[*devSubscription]struct{}
+}
+
+// A compile-time constraint to ensure devNode implements InvoiceClient.
+var _ InvoiceClient = (*devNode)(nil)
+
+// newDevNode creates a new dev node with a random node key that settles its
+// invoices after the given delay. If manualSettle is set, invoices are only
+// settled through the settle endpoint.
+func newDevNode(settleDelay time.Duration, manualSettle bool) (*devNode,
+	error) {
+
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+
+	return &devNode{
+		privKey:       privKey,
+		settleDelay:   settleDelay,
+		manualSettle:  manualSettle,
+		invoices:      make(map[lntypes.Hash]*lnrpc.Invoice),
+		subscriptions: make(map[*devSubscription]struct{}),
+	}, nil
+}
+
+// ListInvoices returns all invoices of the dev node.
+//
+// NOTE: This is part of the InvoiceClient interface.
+func (n *devNode) ListInvoices(_ context.Context, _ *lnrpc.ListInvoiceRequest,
+	_ ...grpc.CallOption) (*lnrpc.ListInvoiceResponse, error) {
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	resp := &lnrpc.ListInvoiceResponse{}
+	for _, invoice := range n.invoices {
+		resp.Invoices = append(resp.Invoices, copyInvoice(invoice))
+	}
+
+	return resp, nil
+}
+
+// SubscribeInvoices subscribes to the updates of all invoices that are added
+// or settled from now on. Past updates aren't replayed.
+//
+// NOTE: This is part of the InvoiceClient interface.
+func (n *devNode) SubscribeInvoices(ctx context.Context,
+	_ *lnrpc.InvoiceSubscription, _ ...grpc.CallOption) (
+	lnrpc.Lightning_SubscribeInvoicesClient, error) {
+
+	sub := &devSubscription{
+		ctx:     ctx,
+		updates: make(chan *lnrpc.Invoice),
+	}
+
+	n.mu.Lock()
+	n.subscriptions[sub] = struct{}{}
+	n.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		n.mu.Lock()
+		delete(n.subscriptions, sub)
+		n.mu.Unlock()
+	}()
+
+	return sub, nil
+}
+
+// AddInvoice creates a new signed regtest invoice with a random preimage and
+// schedules its settlement.
+//
+// NOTE: This is part of the InvoiceClient interface.
+func (n *devNode) AddInvoice(_ context.Context, in *lnrpc.Invoice,
+	_ ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error) {
+
+	var preimage lntypes.Preimage
+	if _, err := rand.Read(preimage[:]); err != nil {
+		return nil, err
+	}
+	hash := preimage.Hash()
+
+	expiry := in.Expiry
+	if expiry == 0 {
+		expiry = defaultDevInvoiceExpiry
+	}
+	created := time.Now()
+	amount := lnwire.NewMSatFromSatoshis(btcutil.Amount(in.Value))
+	opts := []func(*zpay32.Invoice){
+		zpay32.Expiry(time.Duration(expiry) * time.Second),
+	}
+	if amount > 0 {
+		opts = append(opts, zpay32.Amount(amount))
+	}
+	if len(in.DescriptionHash) == 32 {
+		var descHash [32]byte
+		copy(descHash[:], in.DescriptionHash)
+		opts = append(opts, zpay32.DescriptionHash(descHash))
+	} else {
+		opts = append(opts, zpay32.Description(in.Memo))
+	}
+
+	payReq, err := zpay32.NewInvoice(devChainParams, hash, created, opts...)
+	if err != nil {
+		return nil, err
+	}
+	payReqString, err := payReq.Encode(zpay32.MessageSigner{
+		SignCompact: func(hash []byte) ([]byte, error) {
+			return btcec.SignCompact(
+				btcec.S256(), n.privKey, hash, true,
+			)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	n.addIndex++
+	invoice := &lnrpc.Invoice{
+		Memo:            in.Memo,
+		DescriptionHash: in.DescriptionHash,
+		RPreimage:       preimage[:],
+		RHash:           hash[:],
+		Value:           in.Value,
+		ValueMsat:       int64(amount),
+		CreationDate:    created.Unix(),
+		Expiry:          expiry,
+		PaymentRequest:  payReqString,
+		AddIndex:        n.addIndex,
+		State:           lnrpc.Invoice_OPEN,
+	}
+	n.invoices[hash] = invoice
+	update := copyInvoice(invoice)
+	n.mu.Unlock()
+
+	// The update of the new invoice is delivered before the invoice can
+	// be settled, so subscribers never see the settlement first.
+	n.notify(update)
+
+	if !n.manualSettle {
+		time.AfterFunc(n.settleDelay, func() {
+			if _, _, err := n.settle(hash); err != nil {
+				log.Errorf("Error settling dev invoice %v: %v",
+					hash, err)
+			}
+		})
+	}
+
+	return &lnrpc.AddInvoiceResponse{
+		RHash:          hash[:],
+		PaymentRequest: payReqString,
+		AddIndex:       invoice.AddIndex,
+	}, nil
+}
+
+// LookupInvoice returns the invoice with the given payment hash.
+//
+// NOTE: This is part of the InvoiceClient interface.
+func (n *devNode) LookupInvoice(_ context.Context, in *lnrpc.PaymentHash,
+	_ ...grpc.CallOption) (*lnrpc.Invoice, error) {
+
+	hash, err := lntypes.MakeHash(in.RHash)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	invoice, ok := n.invoices[hash]
+	if !ok {
+		return nil, fmt.Errorf("unable to locate invoice %v", hash)
+	}
+
+	return copyInvoice(invoice), nil
+}
+
+// settle marks the open invoice with the given payment hash as paid in full
+// and notifies the subscribers. The preimage of the invoice is returned, just
+// like a payer learns it, together with false if the invoice was already
+// settled.
+func (n *devNode) settle(hash lntypes.Hash) (lntypes.Preimage, bool, error) {
+	n.mu.Lock()
+	invoice, ok := n.invoices[hash]
+	if !ok {
+		n.mu.Unlock()
+		return lntypes.Preimage{}, false, fmt.Errorf("unable to "+
+			"locate invoice %v", hash)
+	}
+	preimage, err := lntypes.MakePreimage(invoice.RPreimage)
+	if err != nil {
+		n.mu.Unlock()
+		return lntypes.Preimage{}, false, err
+	}
+	if invoice.State != lnrpc.Invoice_OPEN {
+		n.mu.Unlock()
+		return preimage, false, nil
+	}
+
+	n.settleIndex++
+	invoice.State = lnrpc.Invoice_SETTLED
+	invoice.Settled = true
+	invoice.SettleDate = time.Now().Unix()
+	invoice.SettleIndex = n.settleIndex
+	invoice.AmtPaidSat = invoice.Value
+	invoice.AmtPaidMsat = invoice.ValueMsat
+	update := copyInvoice(invoice)
+	n.mu.Unlock()
+
+	log.Infof("Settled dev invoice %v.", hash)
+	n.notify(update)
+	return preimage, true, nil
+}
+
+// notify sends the update of an invoice to all subscribers.
+func (n *devNode) notify(update *lnrpc.Invoice) {
+	n.mu.Lock()
+	subs := make([]*devSubscription, 0, len(n.subscriptions))
+	for sub := range n.subscriptions {
+		subs = append(subs, sub)
+	}
+	n.mu.Unlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.updates <- update:
+		case <-sub.ctx.Done():
+		}
+	}
+}
+
+// devSettleResponse is the JSON body of the response of the settle endpoint.
+type devSettleResponse struct {
+	PaymentHash string `json:"payment_hash"`
+	Preimage    string `json:"preimage"`
+	Settled     bool   `json:"settled"`
+}
+
+// settleService returns the local service of the endpoint that settles an
+// invoice of the dev node right away and returns its preimage, so clients can
+// pay the invoices of the dev mode with a simple request.
+func (n *devNode) settleService() proxy.LocalService {
+	handler := http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		if r.Method != http.MethodPost {
+			http.Error(
+				w, "method not allowed",
+				http.StatusMethodNotAllowed,
+			)
+			return
+		}
+
+		hash, err := lntypes.MakeHashFromStr(
+			strings.TrimPrefix(r.URL.Path, devSettlePathPrefix),
+		)
+		if err != nil {
+			http.Error(
+				w, "invalid payment hash",
+				http.StatusBadRequest,
+			)
+			return
+		}
+
+		preimage, settled, err := n.settle(hash)
+		if err != nil {
+			http.Error(w, "unknown invoice", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(&devSettleResponse{
+			PaymentHash: hash.String(),
+			Preimage:    preimage.String(),
+			Settled:     settled,
+		})
+		if err != nil {
+			log.Errorf("Error sending settle response: %v", err)
+		}
+	})
+
+	return proxy.NewLocalService(handler, func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, devSettlePathPrefix)
+	})
+}
+
+// devSubscription is a subscription to the invoice updates of the dev node.
+type devSubscription struct {
+	// ClientStream is embedded to satisfy the interface of the stream,
+	// only Recv is ever called on it.
+	grpc.ClientStream
+
+	ctx     context.Context
+	updates chan *lnrpc.Invoice
+}
+
+// Recv blocks until the next invoice update arrives or the subscription is
+// canceled.
+func (s *devSubscription) Recv() (*lnrpc.Invoice, error) {
+	select {
+	case update := <-s.updates:
+		return update, nil
+
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+// copyInvoice returns a copy of the fields of an invoice the dev node sets.
+func copyInvoice(invoice *lnrpc.Invoice) *lnrpc.Invoice {
+	return &lnrpc.Invoice{
+		Memo:            invoice.Memo,
+		DescriptionHash: invoice.DescriptionHash,
+		RPreimage:       invoice.RPreimage,
+		RHash:           invoice.RHash,
+		Value:           invoice.Value,
+		ValueMsat:       invoice.ValueMsat,
+		Settled:         invoice.Settled,
+		CreationDate:    invoice.CreationDate,
+		SettleDate:      invoice.SettleDate,
+		Expiry:          invoice.Expiry,
+		PaymentRequest:  invoice.PaymentRequest,
+		AddIndex:        invoice.AddIndex,
+		SettleIndex:     invoice.SettleIndex,
+		AmtPaidSat:      invoice.AmtPaidSat,
+		AmtPaidMsat:     invoice.AmtPaidMsat,
+		State:           invoice.State,
+	}
+}
@@ -0,0 +1,99 @@
+package aperture
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDevNode tests that the challenger settles the invoices of the dev node
+// on its own after the delay or right away through the settle endpoint.
+func TestDevNode(t *testing.T) {
+	genInvoiceReq := func(price int64) (*lnrpc.Invoice, error) {
+		return &lnrpc.Invoice{Memo: "LSAT", Value: price}, nil
+	}
+	newDevChallenger := func(delay time.Duration,
+		manual bool) (*LndChallenger, *devNode) {
+
+		node, err := newDevNode(delay, manual)
+		require.NoError(t, err)
+		challenger, err := NewLndChallengerWithClient(
+			&AuthConfig{}, node, genInvoiceReq, make(chan error, 1),
+		)
+		require.NoError(t, err)
+		require.NoError(t, challenger.Start())
+		t.Cleanup(challenger.Stop)
+
+		return challenger, node
+	}
+
+	// Invoices are settled on their own after the delay.
+	challenger, _ := newDevChallenger(50*time.Millisecond, false)
+	payReq, hash, err := challenger.NewChallenge(21)
+	require.NoError(t, err)
+
+	invoice, err := zpay32.Decode(payReq, devChainParams)
+	require.NoError(t, err)
+	require.Equal(t, hash[:], invoice.PaymentHash[:])
+	require.EqualValues(t, 21000, *invoice.MilliSat)
+
+	_, err = challenger.FetchPreimage(context.Background(), hash)
+	require.Equal(t, auth.ErrInvoiceNotSettled, err)
+
+	err = challenger.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_SETTLED, time.Second,
+	)
+	require.NoError(t, err)
+	preimage, err := challenger.FetchPreimage(context.Background(), hash)
+	require.NoError(t, err)
+	require.Equal(t, hash, preimage.Hash())
+
+	// With manual settlement, invoices stay open until the settle
+	// endpoint is called.
+	challenger, node := newDevChallenger(0, true)
+	_, hash, err = challenger.NewChallenge(21)
+	require.NoError(t, err)
+
+	err = challenger.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_SETTLED, 100*time.Millisecond,
+	)
+	require.Error(t, err)
+
+	settle := func(hash string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(
+			"POST", "http://localhost"+devSettlePathPrefix+hash,
+			nil,
+		)
+		rec := httptest.NewRecorder()
+		service := node.settleService()
+		require.True(t, service.IsHandling(req))
+		service.ServeHTTP(rec, req)
+		return rec
+	}
+	unknown := lntypes.Hash{}
+	require.Equal(t, http.StatusBadRequest, settle("xx").Code)
+	require.Equal(t, http.StatusNotFound, settle(unknown.String()).Code)
+
+	rec := settle(hash.String())
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp devSettleResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.True(t, resp.Settled)
+	preimage, err = lntypes.MakePreimageFromStr(resp.Preimage)
+	require.NoError(t, err)
+	require.Equal(t, hash, preimage.Hash())
+
+	err = challenger.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_SETTLED, time.Second,
+	)
+	require.NoError(t, err)
+}
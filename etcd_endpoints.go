@@ -0,0 +1,82 @@
+package aperture
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// etcdDialTimeout is the maximum time we wait for a connection to etcd.
+	etcdDialTimeout = 5 * time.Second
+
+	// etcdProbeTimeout is the maximum time we wait for a single etcd
+	// endpoint to answer when looking for the nearest one.
+	etcdProbeTimeout = 2 * time.Second
+)
+
+// etcdEndpoints returns the etcd endpoints of the configuration. Multiple
+// endpoints of the same cluster can be configured as a comma separated list.
+func etcdEndpoints(cfg *EtcdConfig) []string {
+	var endpoints []string
+	for _, endpoint := range strings.Split(cfg.Host, ",") {
+		endpoint = strings.TrimSpace(endpoint)
+		if endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// newEtcdClient creates an etcd client that uses the given endpoints.
+func newEtcdClient(cfg *EtcdConfig, endpoints []string) (*clientv3.Client,
+	error) {
+
+	return clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: etcdDialTimeout,
+		Username:    cfg.User,
+		Password:    cfg.Password,
+	})
+}
+
+// nearestEtcdEndpoint returns the endpoint that answers a status request the
+// fastest. Endpoints that don't answer at all are skipped.
+func nearestEtcdEndpoint(client *clientv3.Client,
+	endpoints []string) (string, time.Duration, error) {
+
+	var (
+		nearest    string
+		nearestRTT time.Duration
+	)
+	for _, endpoint := range endpoints {
+		ctx, cancel := context.WithTimeout(
+			context.Background(), etcdProbeTimeout,
+		)
+		start := time.Now()
+		_, err := client.Status(ctx, endpoint)
+		rtt := time.Since(start)
+		cancel()
+
+		if err != nil {
+			log.Warnf("Unable to reach etcd endpoint %s: %v",
+				endpoint, err)
+			continue
+		}
+
+		log.Debugf("etcd endpoint %s answered in %v", endpoint, rtt)
+		if nearest == "" || rtt < nearestRTT {
+			nearest = endpoint
+			nearestRTT = rtt
+		}
+	}
+
+	if nearest == "" {
+		return "", 0, fmt.Errorf("none of the etcd endpoints %v answered",
+			endpoints)
+	}
+	return nearest, nearestRTT, nil
+}
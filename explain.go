@@ -0,0 +1,72 @@
+package aperture
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+)
+
+const (
+	// explainCommand is the name of the command that asks the admin API
+	// of a running aperture how it would route a request.
+	explainCommand = "explain"
+)
+
+// explainConfig holds the options of the explain command.
+type explainConfig struct {
+	AdminAddr string `long:"adminaddr" description:"The address of the admin API of the aperture instance to ask." default:"localhost:8082"`
+	Host      string `long:"host" description:"The host of the hypothetical request, as sent in the Host header."`
+	Path      string `long:"path" description:"The path of the URL of the hypothetical request." required:"true"`
+	Method    string `long:"method" description:"The method of the hypothetical request." default:"GET"`
+}
+
+// runExplain parses the options of the explain command from the given
+// arguments, asks the admin API how the request they describe would be routed
+// and writes the indented answer to the given writer.
+func runExplain(args []string, out io.Writer) error {
+	cfg := &explainConfig{}
+	if _, err := flags.ParseArgs(cfg, args); err != nil {
+		return fmt.Errorf("unable to parse explain options: %w", err)
+	}
+
+	query := url.Values{}
+	query.Set("host", cfg.Host)
+	query.Set("path", cfg.Path)
+	query.Set("method", cfg.Method)
+	explainURL := url.URL{
+		Scheme:   "http",
+		Host:     cfg.AdminAddr,
+		Path:     adminExplainPath,
+		RawQuery: query.Encode(),
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(explainURL.String())
+	if err != nil {
+		return fmt.Errorf("unable to reach admin API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("admin API returned %v: %s", resp.Status,
+			bytes.TrimSpace(body))
+	}
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, body, "", "  "); err != nil {
+		return err
+	}
+	_, err = indented.WriteTo(out)
+	return err
+}
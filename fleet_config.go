@@ -0,0 +1,283 @@
+package aperture
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// fleetConfigDir is the directory we'll use to store the configuration
+	// that is distributed to all instances.
+	fleetConfigDir = "config"
+
+	// fleetConfigName is the name of the key that holds the configuration
+	// of all instances.
+	fleetConfigName = "fleet"
+
+	// fleetConfigInstancesDir is the directory of the keys that hold the
+	// overrides of individual instances.
+	fleetConfigInstancesDir = "instances"
+
+	// fleetConfigRetryDelay is the time we wait before we watch the
+	// configuration again after the watch failed.
+	fleetConfigRetryDelay = 5 * time.Second
+)
+
+// fleetConfigKey returns the key of the configuration of all instances.
+//
+// The resulting path within etcd would look like:
+//
+//	lsat/proxy/config/fleet
+func fleetConfigKey() string {
+	return strings.Join(
+		[]string{topLevelKey, fleetConfigDir, fleetConfigName},
+		etcdKeyDelimeter,
+	)
+}
+
+// instanceConfigKey returns the key of the configuration overrides of the
+// instance with the given ID.
+//
+// The resulting path of the instance "eu-1" within etcd would look like:
+//
+//	lsat/proxy/config/instances/eu-1
+func instanceConfigKey(id string) string {
+	return strings.Join(
+		[]string{
+			topLevelKey, fleetConfigDir, fleetConfigInstancesDir,
+			id,
+		}, etcdKeyDelimeter,
+	)
+}
+
+// fleetConfig is the part of the configuration that can be published to etcd
+// and is applied by all instances at run time. It uses the same YAML format as
+// the config file.
+type fleetConfig struct {
+	// Services replaces the list of backend services. Services in the
+	// overrides of an instance replace the services with the same name,
+	// all others are appended.
+	Services []*proxy.Service
+
+	// DebugLevel replaces the debug level, if it is set.
+	DebugLevel string
+}
+
+// merge applies the given overrides of an instance to the configuration.
+func (c *fleetConfig) merge(overrides *fleetConfig) {
+	if overrides.DebugLevel != "" {
+		c.DebugLevel = overrides.DebugLevel
+	}
+
+	for _, override := range overrides.Services {
+		replaced := false
+		for idx, service := range c.Services {
+			if service.Name == override.Name {
+				c.Services[idx] = override
+				replaced = true
+				break
+			}
+		}
+
+		if !replaced {
+			c.Services = append(c.Services, override)
+		}
+	}
+}
+
+// parseFleetConfig parses a YAML encoded fleet configuration.
+func parseFleetConfig(key string, value []byte) (*fleetConfig, error) {
+	cfg := &fleetConfig{}
+	if err := yaml.UnmarshalStrict(value, cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration in %s: %v", key,
+			err)
+	}
+	return cfg, nil
+}
+
+// fleetConfigWatcher watches the fleet configuration and the overrides of this
+// instance in etcd and applies them whenever one of them changes.
+type fleetConfigWatcher struct {
+	client     *clientv3.Client
+	instanceID string
+	apply      func(*fleetConfig) error
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newFleetConfigWatcher creates a new watcher for the configuration of the
+// instance with the given ID.
+func newFleetConfigWatcher(client *clientv3.Client, instanceID string,
+	apply func(*fleetConfig) error) *fleetConfigWatcher {
+
+	return &fleetConfigWatcher{
+		client:     client,
+		instanceID: instanceID,
+		apply:      apply,
+		quit:       make(chan struct{}),
+	}
+}
+
+// Start applies the current configuration, if there is one, and then watches
+// it for changes in the background.
+func (w *fleetConfigWatcher) Start() error {
+	revision, err := w.load(context.Background())
+	if err != nil {
+		return err
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		for {
+			var err error
+			revision, err = w.watch(revision)
+
+			select {
+			case <-w.quit:
+				return
+			default:
+			}
+
+			if err != nil {
+				log.Errorf("Error watching fleet configuration, "+
+					"retrying in %v: %v",
+					fleetConfigRetryDelay, err)
+			}
+
+			select {
+			case <-time.After(fleetConfigRetryDelay):
+			case <-w.quit:
+				return
+			}
+
+			// We might have missed changes while we weren't
+			// watching, or our revision might have been compacted
+			// already, so we start over with the current state.
+			newRevision, err := w.load(context.Background())
+			if err != nil {
+				log.Errorf("Error loading fleet configuration: "+
+					"%v", err)
+			}
+			if newRevision > revision {
+				revision = newRevision
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops watching the configuration.
+func (w *fleetConfigWatcher) Stop() {
+	close(w.quit)
+	w.wg.Wait()
+}
+
+// load reads the fleet configuration and the overrides of this instance in a
+// single transaction, so both are from the same revision, and applies them. The
+// revision of the read is returned.
+func (w *fleetConfigWatcher) load(ctx context.Context) (int64, error) {
+	fleetKey := fleetConfigKey()
+	instanceKey := instanceConfigKey(w.instanceID)
+	resp, err := w.client.Txn(ctx).Then(
+		clientv3.OpGet(fleetKey), clientv3.OpGet(instanceKey),
+	).Commit()
+	if err != nil {
+		return 0, err
+	}
+	revision := resp.Header.Revision
+
+	fleetResp := resp.Responses[0].GetResponseRange()
+	if len(fleetResp.Kvs) == 0 {
+		log.Debugf("No fleet configuration published in %s", fleetKey)
+		return revision, nil
+	}
+	cfg, err := parseFleetConfig(fleetKey, fleetResp.Kvs[0].Value)
+	if err != nil {
+		return revision, err
+	}
+
+	instanceResp := resp.Responses[1].GetResponseRange()
+	if len(instanceResp.Kvs) > 0 {
+		overrides, err := parseFleetConfig(
+			instanceKey, instanceResp.Kvs[0].Value,
+		)
+		if err != nil {
+			return revision, err
+		}
+		cfg.merge(overrides)
+	}
+
+	if err := w.apply(cfg); err != nil {
+		return revision, fmt.Errorf("unable to apply fleet "+
+			"configuration of revision %d: %v", revision, err)
+	}
+
+	log.Infof("Applied fleet configuration of revision %d", revision)
+	return revision, nil
+}
+
+// watch waits for changes of the configuration after the given revision and
+// loads it again on every change, until we're shutting down or the watch fails.
+// The revision of the last load is returned.
+func (w *fleetConfigWatcher) watch(revision int64) (int64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-w.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	fleetKey := fleetConfigKey()
+	instanceKey := instanceConfigKey(w.instanceID)
+	watchChan := w.client.Watch(
+		clientv3.WithRequireLeader(ctx),
+		strings.Join(
+			[]string{topLevelKey, fleetConfigDir}, etcdKeyDelimeter,
+		), clientv3.WithPrefix(), clientv3.WithRev(revision+1),
+	)
+	for resp := range watchChan {
+		if err := resp.Err(); err != nil {
+			return revision, err
+		}
+
+		// Only react to our own keys, not to the overrides of other
+		// instances.
+		relevant := false
+		for _, event := range resp.Events {
+			key := string(event.Kv.Key)
+			if key == fleetKey || key == instanceKey {
+				relevant = true
+			}
+		}
+		if !relevant {
+			continue
+		}
+
+		// A configuration that can't be applied is logged but doesn't
+		// stop us from applying the next one.
+		newRevision, err := w.load(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("Error loading fleet configuration: %v", err)
+		}
+		if newRevision > revision {
+			revision = newRevision
+		}
+	}
+
+	return revision, ctx.Err()
+}
@@ -0,0 +1,105 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestFleetConfigWatcher tests that the fleet configuration merged with the
+// overrides of the instance is applied on start and on every change, while
+// changes to the overrides of other instances are ignored.
+func TestFleetConfigWatcher(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	ctx := context.Background()
+	put := func(key, value string) {
+		t.Helper()
+
+		if _, err := etcdClient.Put(ctx, key, value); err != nil {
+			t.Fatalf("unable to store configuration: %v", err)
+		}
+	}
+	put(fleetConfigKey(), `
+debuglevel: info
+services:
+  - name: svc1
+    price: 1
+  - name: svc2
+    price: 2
+`)
+	put(instanceConfigKey("eu-1"), `
+services:
+  - name: svc2
+    price: 20
+  - name: svc3
+    price: 3
+`)
+
+	applied := make(chan *fleetConfig, 10)
+	watcher := newFleetConfigWatcher(
+		etcdClient, "eu-1", func(cfg *fleetConfig) error {
+			applied <- cfg
+			return nil
+		},
+	)
+	if err := watcher.Start(); err != nil {
+		t.Fatalf("unable to start watcher: %v", err)
+	}
+	defer watcher.Stop()
+
+	nextConfig := func() *fleetConfig {
+		t.Helper()
+
+		select {
+		case cfg := <-applied:
+			return cfg
+
+		case <-time.After(5 * time.Second):
+			t.Fatalf("configuration wasn't applied")
+			return nil
+		}
+	}
+	assertPrices := func(cfg *fleetConfig, prices map[string]int64) {
+		t.Helper()
+
+		if len(cfg.Services) != len(prices) {
+			t.Fatalf("expected %d services, got %d", len(prices),
+				len(cfg.Services))
+		}
+		for _, service := range cfg.Services {
+			if service.Price != prices[service.Name] {
+				t.Fatalf("unexpected price %d of service %s",
+					service.Price, service.Name)
+			}
+		}
+	}
+
+	cfg := nextConfig()
+	if cfg.DebugLevel != "info" {
+		t.Fatalf("unexpected debug level %s", cfg.DebugLevel)
+	}
+	assertPrices(cfg, map[string]int64{"svc1": 1, "svc2": 20, "svc3": 3})
+
+	// Overrides of other instances must not trigger an update, changes to
+	// the fleet configuration must.
+	put(instanceConfigKey("us-1"), "debuglevel: trace")
+	put(fleetConfigKey(), `
+services:
+  - name: svc1
+    price: 10
+`)
+	assertPrices(nextConfig(), map[string]int64{"svc1": 10, "svc2": 20,
+		"svc3": 3})
+
+	// An invalid configuration is never applied.
+	put(fleetConfigKey(), "unknown: option")
+	select {
+	case <-applied:
+		t.Fatalf("invalid configuration was applied")
+
+	case <-time.After(time.Second):
+	}
+}
@@ -11,5 +11,12 @@ import (
 type DB interface {
 	CanPass(*http.Request, net.IP) (bool, error)
 
+	// TallyFreebie counts a free request of the given IP address. The
+	// check and the update must be atomic, if the IP address has no free
+	// requests left when the request is counted, false is returned.
 	TallyFreebie(*http.Request, net.IP) (bool, error)
 }
+
+// DBCreator creates the freebie store of the service with the given name that
+// allows the given number of free requests per IP address.
+type DBCreator func(serviceName string, numFreebies Count) DB
@@ -3,6 +3,14 @@ package freebie
 import (
 	"net"
 	"net/http"
+	"sync"
+)
+
+const (
+	// numShards is the number of shards the counters of the in-memory
+	// store are spread over, so concurrent requests from different
+	// address ranges rarely wait for the same lock.
+	numShards = 64
 )
 
 var (
@@ -11,30 +19,82 @@ var (
 
 type Count uint16
 
+// memKey identifies the counter of an address range in the in-memory store
+// like IPMaskKey, without allocating a string for every request. IPv6
+// addresses can't be masked with the IPv4 mask, so they share the zero key
+// like they share the key of IPMaskKey.
+type memKey struct {
+	ipv4 [net.IPv4len]byte
+	ok   bool
+}
+
+// memShard holds the counters of the address ranges whose keys map to it.
+type memShard struct {
+	mtx            sync.Mutex
+	freebieCounter map[memKey]Count
+
+	// The shards are padded to the size of a cache line, so the locks of
+	// neighboring shards don't share one.
+	_ [48]byte
+}
+
 type memStore struct {
-	numFreebies    Count
-	freebieCounter map[string]Count
+	numFreebies Count
+	shards      [numShards]memShard
 }
 
-func (m *memStore) getKey(ip net.IP) string {
+// IPMaskKey returns the key under which the free requests of the given IP
+// address are counted. The last byte of the address is discarded so all
+// addresses of the same range share the same counter.
+func IPMaskKey(ip net.IP) string {
 	return ip.Mask(defaultIPMask).String()
 }
 
-func (m *memStore) currentCount(ip net.IP) Count {
-	counter, ok := m.freebieCounter[m.getKey(ip)]
-	if !ok {
-		return 0
+// maskKey returns the key of the counter of the given IP address.
+func maskKey(ip net.IP) memKey {
+	var key memKey
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := range key.ipv4 {
+			key.ipv4[i] = ip4[i] & defaultIPMask[i]
+		}
+		key.ok = true
 	}
-	return counter
+	return key
+}
+
+// shard returns the shard of the counter with the given key.
+func (m *memStore) shard(key memKey) *memShard {
+	h := uint32(2166136261)
+	for _, b := range key.ipv4 {
+		h = (h ^ uint32(b)) * 16777619
+	}
+	return &m.shards[h%numShards]
 }
 
 func (m *memStore) CanPass(r *http.Request, ip net.IP) (bool, error) {
-	return m.currentCount(ip) < m.numFreebies, nil
+	key := maskKey(ip)
+	shard := m.shard(key)
+
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+
+	return shard.freebieCounter[key] < m.numFreebies, nil
 }
 
+// TallyFreebie counts a free request of the given IP address. It returns false
+// if all free requests were used up by a concurrent request in the meantime.
 func (m *memStore) TallyFreebie(r *http.Request, ip net.IP) (bool, error) {
-	counter := m.currentCount(ip) + 1
-	m.freebieCounter[m.getKey(ip)] = counter
+	key := maskKey(ip)
+	shard := m.shard(key)
+
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+
+	counter := shard.freebieCounter[key]
+	if counter >= m.numFreebies {
+		return false, nil
+	}
+	shard.freebieCounter[key] = counter + 1
 	return true, nil
 }
 
@@ -43,8 +103,9 @@ func (m *memStore) TallyFreebie(r *http.Request, ip net.IP) (bool, error) {
 // address is discarded for the mapping to reduce risk of abuse by users that
 // have a whole range of IPs at their disposal.
 func NewMemIPMaskStore(numFreebies Count) DB {
-	return &memStore{
-		numFreebies:    numFreebies,
-		freebieCounter: make(map[string]Count),
+	m := &memStore{numFreebies: numFreebies}
+	for i := range m.shards {
+		m.shards[i].freebieCounter = make(map[memKey]Count)
 	}
+	return m
 }
@@ -0,0 +1,94 @@
+package freebie
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestMemStore ensures that free requests are counted per address range and
+// that concurrent requests can't use more than the allowed number.
+func TestMemStore(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemIPMaskStore(2)
+	tally := func(ip string, expected bool) {
+		t.Helper()
+
+		ok, err := store.TallyFreebie(nil, net.ParseIP(ip))
+		if err != nil {
+			t.Fatalf("unable to tally freebie: %v", err)
+		}
+		if ok != expected {
+			t.Fatalf("expected tally of %s to be %v", ip, expected)
+		}
+	}
+
+	// Addresses of the same range share their free requests.
+	tally("192.0.2.1", true)
+	tally("192.0.2.2", true)
+	tally("192.0.2.3", false)
+	if ok, _ := store.CanPass(nil, net.ParseIP("192.0.2.4")); ok {
+		t.Fatalf("expected range to be used up")
+	}
+
+	// Other ranges are counted separately.
+	if ok, _ := store.CanPass(nil, net.ParseIP("192.0.3.1")); !ok {
+		t.Fatalf("expected other range to pass")
+	}
+	tally("192.0.3.1", true)
+
+	// IPv6 addresses can't be masked, so they share a counter.
+	tally("2001:db8::1", true)
+	tally("2001:db8:1::1", true)
+	tally("2001:db8:2::1", false)
+
+	// Concurrent requests of one range don't exceed the free requests.
+	store = NewMemIPMaskStore(100)
+	var (
+		wg     sync.WaitGroup
+		passed int64
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				ok, _ := store.TallyFreebie(
+					nil, net.ParseIP("198.51.100.1"),
+				)
+				if ok {
+					atomic.AddInt64(&passed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if passed != 100 {
+		t.Fatalf("expected 100 free requests, got %d", passed)
+	}
+}
+
+// BenchmarkMemStoreParallel measures counting the free requests of many
+// address ranges concurrently.
+func BenchmarkMemStoreParallel(b *testing.B) {
+	store := NewMemIPMaskStore(Count(^uint16(0)))
+	var next uint32
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		// Each goroutine sends the requests of its own range.
+		n := atomic.AddUint32(&next, 1)
+		ip := net.IPv4(10, byte(n>>8), byte(n), 1)
+		for pb.Next() {
+			if _, err := store.CanPass(nil, ip); err != nil {
+				b.Fatalf("unable to check freebie: %v", err)
+			}
+			if _, err := store.TallyFreebie(nil, ip); err != nil {
+				b.Fatalf("unable to tally freebie: %v", err)
+			}
+		}
+	})
+}
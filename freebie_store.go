@@ -0,0 +1,155 @@
+package aperture
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lightninglabs/aperture/freebie"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	// freebiePrefix is the key we'll use to prefix all freebie counters
+	// with when storing them in an etcd cluster.
+	freebiePrefix = "freebie"
+
+	// errFreebieConflict is returned if the freebie counter was changed by
+	// someone else between reading and updating it.
+	errFreebieConflict = fmt.Errorf("freebie counter changed concurrently")
+)
+
+// freebieKey returns the full key to store the freebie counter of an IP address
+// range for a service in the database. The service name is escaped in order to
+// prevent conflicts with the etcd key delimeter.
+//
+// The resulting path of the counter of 1.2.3.0 for the service "svc" within
+// etcd would look like:
+//
+//	lsat/proxy/freebie/svc/1.2.3.0
+func freebieKey(serviceName string, ip net.IP) string {
+	return strings.Join(
+		[]string{
+			topLevelKey, freebiePrefix,
+			url.PathEscape(serviceName), freebie.IPMaskKey(ip),
+		}, etcdKeyDelimeter,
+	)
+}
+
+// freebieStore is a freebie store backed by an etcd cluster. All aperture
+// instances that share the cluster also share the freebie counters, so clients
+// can't get more free requests by reaching different instances.
+type freebieStore struct {
+	*clientv3.Client
+
+	serviceName string
+	numFreebies freebie.Count
+}
+
+// A compile-time constraint to ensure freebieStore implements freebie.DB.
+var _ freebie.DB = (*freebieStore)(nil)
+
+// newFreebieStoreCreator returns a function that creates the etcd backed
+// freebie stores of the services.
+func newFreebieStoreCreator(client *clientv3.Client) freebie.DBCreator {
+	return func(serviceName string, numFreebies freebie.Count) freebie.DB {
+		return &freebieStore{
+			Client:      client,
+			serviceName: serviceName,
+			numFreebies: numFreebies,
+		}
+	}
+}
+
+// CanPass returns true if the IP address has free requests left.
+func (s *freebieStore) CanPass(r *http.Request, ip net.IP) (bool, error) {
+	resp, err := s.Get(r.Context(), freebieKey(s.serviceName, ip))
+	if err != nil {
+		return false, err
+	}
+
+	count, err := freebieCount(resp)
+	if err != nil {
+		return false, err
+	}
+	return count < s.numFreebies, nil
+}
+
+// TallyFreebie atomically increments the freebie counter of the IP address if
+// it has free requests left. If a concurrent request changed the counter in
+// the meantime, the update is retried with the new value.
+func (s *freebieStore) TallyFreebie(r *http.Request, ip net.IP) (bool, error) {
+	key := freebieKey(s.serviceName, ip)
+	for {
+		ok, err := s.tally(r.Context(), key)
+		switch {
+		case err == errFreebieConflict:
+			continue
+
+		case err != nil:
+			return false, err
+
+		default:
+			return ok, nil
+		}
+	}
+}
+
+// tally tries to increment the freebie counter with the given key once.
+func (s *freebieStore) tally(ctx context.Context, key string) (bool, error) {
+	resp, err := s.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := freebieCount(resp)
+	if err != nil {
+		return false, err
+	}
+	if count >= s.numFreebies {
+		return false, nil
+	}
+
+	// Only write the new value if the key wasn't modified since we read
+	// it. A mod revision of zero means the key doesn't exist yet.
+	var modRevision int64
+	if len(resp.Kvs) > 0 {
+		modRevision = resp.Kvs[0].ModRevision
+	}
+
+	var newCount [2]byte
+	binary.BigEndian.PutUint16(newCount[:], uint16(count+1))
+	txnResp, err := s.Txn(ctx).
+		If(clientv3.Compare(
+			clientv3.ModRevision(key), "=", modRevision,
+		)).
+		Then(clientv3.OpPut(key, string(newCount[:]))).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	if !txnResp.Succeeded {
+		return false, errFreebieConflict
+	}
+
+	return true, nil
+}
+
+// freebieCount decodes the freebie counter of a get response. A missing key
+// means no free requests were made yet.
+func freebieCount(resp *clientv3.GetResponse) (freebie.Count, error) {
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+
+	value := resp.Kvs[0].Value
+	if len(value) != 2 {
+		return 0, fmt.Errorf("invalid freebie counter size %v",
+			len(value))
+	}
+	return freebie.Count(binary.BigEndian.Uint16(value)), nil
+}
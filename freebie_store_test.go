@@ -0,0 +1,90 @@
+package aperture
+
+import (
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/lightninglabs/aperture/freebie"
+)
+
+// TestFreebieStore tests that the etcd backed freebie stores of two instances
+// share their counters and never allow more free requests than configured,
+// even if the requests happen concurrently.
+func TestFreebieStore(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	const numFreebies = 5
+	var (
+		newStore = newFreebieStoreCreator(etcdClient)
+		stores   = []freebie.DB{
+			newStore("svc", numFreebies),
+			newStore("svc", numFreebies),
+		}
+		otherService = newStore("other", numFreebies)
+		req          = httptest.NewRequest("GET", "/", nil)
+		ip           = net.ParseIP("1.2.3.4")
+		sameRangeIP  = net.ParseIP("1.2.3.5")
+	)
+
+	// Tally many more free requests than allowed concurrently on both
+	// instances.
+	var (
+		wg      sync.WaitGroup
+		mtx     sync.Mutex
+		granted int
+	)
+	for i := 0; i < 4*numFreebies; i++ {
+		store := stores[i%len(stores)]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ok, err := store.TallyFreebie(req, ip)
+			if err != nil {
+				t.Errorf("unable to tally freebie: %v", err)
+				return
+			}
+			if ok {
+				mtx.Lock()
+				granted++
+				mtx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if granted != numFreebies {
+		t.Fatalf("expected %d granted freebies, got %d", numFreebies,
+			granted)
+	}
+
+	// Both instances as well as the other IP of the same range must be out
+	// of free requests now.
+	for _, store := range stores {
+		for _, addr := range []net.IP{ip, sameRangeIP} {
+			ok, err := store.CanPass(req, addr)
+			if err != nil {
+				t.Fatalf("unable to query freebie store: %v",
+					err)
+			}
+			if ok {
+				t.Fatalf("expected %v to have no freebies left",
+					addr)
+			}
+		}
+	}
+
+	// The counters of other services are independent.
+	ok, err := otherService.CanPass(req, ip)
+	if err != nil {
+		t.Fatalf("unable to query freebie store: %v", err)
+	}
+	if !ok {
+		t.Fatalf("expected other service to have freebies left")
+	}
+}
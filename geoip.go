@@ -0,0 +1,29 @@
+package aperture
+
+import (
+	"net"
+
+	"github.com/lightninglabs/aperture/geoip"
+	"github.com/lightninglabs/aperture/proxy"
+)
+
+// geoIPResolver looks up the country of clients in a GeoIP database.
+type geoIPResolver struct {
+	reader *geoip.Reader
+}
+
+// A compile-time constraint to ensure geoIPResolver implements
+// proxy.CountryResolver.
+var _ proxy.CountryResolver = (*geoIPResolver)(nil)
+
+// Country returns the country code of the given IP address, or an empty string
+// if the database doesn't contain it.
+//
+// NOTE: This is part of the proxy.CountryResolver interface.
+func (g *geoIPResolver) Country(ip net.IP) (string, error) {
+	country, err := g.reader.Country(ip)
+	if err == geoip.ErrNotFound {
+		return "", nil
+	}
+	return country, err
+}
@@ -0,0 +1,399 @@
+// Package geoip looks up the country of IP addresses in a MaxMind DB file, for
+// example the free GeoLite2 Country database.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+var (
+	// metadataMarker precedes the metadata section at the end of a MaxMind
+	// DB file.
+	metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+	// ErrNotFound is returned if the database contains no record for an
+	// IP address.
+	ErrNotFound = errors.New("no record for IP address")
+)
+
+const (
+	// dataSectionSeparatorSize is the number of zero bytes between the
+	// search tree and the data section.
+	dataSectionSeparatorSize = 16
+
+	// Data types of the MaxMind DB format.
+	typeExtended  = 0
+	typePointer   = 1
+	typeString    = 2
+	typeDouble    = 3
+	typeBytes     = 4
+	typeUint16    = 5
+	typeUint32    = 6
+	typeMap       = 7
+	typeInt32     = 8
+	typeUint64    = 9
+	typeUint128   = 10
+	typeArray     = 11
+	typeContainer = 12
+	typeEndMarker = 13
+	typeBool      = 14
+	typeFloat     = 15
+)
+
+// Reader looks up records in a MaxMind DB file that was read into memory.
+type Reader struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+
+	// ipv4Start is the node at which IPv4 addresses are looked up in an
+	// IPv6 database.
+	ipv4Start uint
+}
+
+// Open reads the MaxMind DB file at the given path.
+func Open(path string) (*Reader, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewReader(content)
+}
+
+// NewReader creates a reader for the content of a MaxMind DB file.
+func NewReader(content []byte) (*Reader, error) {
+	markerPos := bytes.LastIndex(content, metadataMarker)
+	if markerPos < 0 {
+		return nil, fmt.Errorf("not a MaxMind DB file")
+	}
+
+	metaStart := markerPos + len(metadataMarker)
+	meta := &decoder{buf: content[metaStart:]}
+	value, _, err := meta.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid metadata")
+	}
+
+	nodeCount, _ := metadata["node_count"].(uint64)
+	recordSize, _ := metadata["record_size"].(uint64)
+	ipVersion, _ := metadata["ip_version"].(uint64)
+	switch {
+	case recordSize != 24 && recordSize != 28 && recordSize != 32:
+		return nil, fmt.Errorf("unsupported record size %d", recordSize)
+
+	case ipVersion != 4 && ipVersion != 6:
+		return nil, fmt.Errorf("unsupported IP version %d", ipVersion)
+	}
+
+	treeSize := nodeCount * recordSize / 4
+	if treeSize+dataSectionSeparatorSize > uint64(markerPos) {
+		return nil, fmt.Errorf("search tree exceeds file size")
+	}
+
+	r := &Reader{
+		tree:       content[:treeSize],
+		data:       content[treeSize+dataSectionSeparatorSize : markerPos],
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+	}
+
+	// IPv4 addresses are stored below ::/96 in IPv6 databases.
+	if r.ipVersion == 6 {
+		for i := 0; i < 96 && r.ipv4Start < r.nodeCount; i++ {
+			r.ipv4Start = r.readNode(r.ipv4Start, 0)
+		}
+	}
+
+	return r, nil
+}
+
+// Lookup returns the record of the network the given IP address belongs to.
+func (r *Reader) Lookup(ip net.IP) (map[string]interface{}, error) {
+	node := uint(0)
+	addr := ip.To4()
+	switch {
+	case addr != nil && r.ipVersion == 6:
+		node = r.ipv4Start
+
+	case addr == nil && r.ipVersion == 4:
+		return nil, ErrNotFound
+
+	case addr == nil:
+		addr = ip.To16()
+		if addr == nil {
+			return nil, fmt.Errorf("invalid IP address %v", ip)
+		}
+	}
+
+	for i := 0; i < len(addr)*8 && node < r.nodeCount; i++ {
+		bit := (addr[i/8] >> (7 - uint(i%8))) & 1
+		node = r.readNode(node, uint(bit))
+	}
+
+	if node == r.nodeCount {
+		return nil, ErrNotFound
+	}
+	if node < r.nodeCount {
+		return nil, fmt.Errorf("invalid search tree")
+	}
+
+	offset := node - r.nodeCount - dataSectionSeparatorSize
+	value, _, err := (&decoder{buf: r.data}).decode(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	record, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("record is not a map")
+	}
+	return record, nil
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country the given IP
+// address is located in. If the location is unknown, the country the network
+// is registered in is returned instead.
+func (r *Reader) Country(ip net.IP) (string, error) {
+	record, err := r.Lookup(ip)
+	if err != nil {
+		return "", err
+	}
+
+	for _, key := range []string{"country", "registered_country"} {
+		country, ok := record[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if code, ok := country["iso_code"].(string); ok && code != "" {
+			return code, nil
+		}
+	}
+
+	return "", ErrNotFound
+}
+
+// readNode returns the left (bit 0) or right (bit 1) record of a node of the
+// search tree.
+func (r *Reader) readNode(node, bit uint) uint {
+	offset := node * r.recordSize / 4
+	if int(offset+r.recordSize/4) > len(r.tree) {
+		// Treat a truncated tree as missing data.
+		return r.nodeCount
+	}
+	b := r.tree[offset:]
+
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 |
+				uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 |
+			uint(b[6])
+
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// decoder decodes values of the data section of a MaxMind DB file.
+type decoder struct {
+	buf []byte
+}
+
+// read returns the next n bytes at the given offset.
+func (d *decoder) read(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.buf)) || offset+n < offset {
+		return nil, fmt.Errorf("unexpected end of data")
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+// uint decodes a big endian unsigned integer of the given size.
+func (d *decoder) uint(offset, size uint) (uint64, error) {
+	if size > 8 {
+		return 0, fmt.Errorf("invalid integer size %d", size)
+	}
+
+	b, err := d.read(offset, size)
+	if err != nil {
+		return 0, err
+	}
+
+	var value uint64
+	for _, c := range b {
+		value = value<<8 | uint64(c)
+	}
+	return value, nil
+}
+
+// decode decodes the value at the given offset and returns it together with
+// the offset of the next value.
+func (d *decoder) decode(offset uint) (interface{}, uint, error) {
+	ctrl, err := d.read(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+
+	dataType := uint(ctrl[0] >> 5)
+	if dataType == typePointer {
+		return d.decodePointer(ctrl[0], offset)
+	}
+
+	if dataType == typeExtended {
+		ext, err := d.read(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		dataType = 7 + uint(ext[0])
+		offset++
+	}
+
+	size := uint(ctrl[0] & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		value, err := d.uint(offset, extra)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += extra
+
+		switch size {
+		case 29:
+			size = 29 + uint(value)
+		case 30:
+			size = 285 + uint(value)
+		default:
+			size = 65821 + uint(value)
+		}
+	}
+
+	switch dataType {
+	case typeString:
+		b, err := d.read(offset, size)
+		return string(b), offset + size, err
+
+	case typeBytes, typeUint128:
+		b, err := d.read(offset, size)
+		return b, offset + size, err
+
+	case typeDouble:
+		value, err := d.uint(offset, 8)
+		return math.Float64frombits(value), offset + 8, err
+
+	case typeFloat:
+		value, err := d.uint(offset, 4)
+		return float64(math.Float32frombits(uint32(value))), offset + 4,
+			err
+
+	case typeUint16, typeUint32, typeUint64:
+		value, err := d.uint(offset, size)
+		return value, offset + size, err
+
+	case typeInt32:
+		value, err := d.uint(offset, size)
+		return int64(int32(value)), offset + size, err
+
+	case typeBool:
+		return size != 0, offset, nil
+
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			key, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is not a " +
+					"string")
+			}
+			m[keyString] = value
+		}
+		return m, offset, nil
+
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+
+	case typeContainer, typeEndMarker:
+		return nil, offset, nil
+
+	default:
+		return nil, 0, fmt.Errorf("unknown data type %d", dataType)
+	}
+}
+
+// decodePointer decodes the value a pointer points to. The returned offset is
+// the one after the pointer itself.
+func (d *decoder) decodePointer(ctrl byte, offset uint) (interface{}, uint,
+	error) {
+
+	size := uint(ctrl>>3) & 0x3
+	value, err := d.uint(offset, size+1)
+	if err != nil {
+		return nil, 0, err
+	}
+	next := offset + size + 1
+
+	prefix := uint64(ctrl & 0x7)
+	var target uint64
+	switch size {
+	case 0:
+		target = prefix<<8 | value
+	case 1:
+		target = (prefix<<16 | value) + 2048
+	case 2:
+		target = (prefix<<24 | value) + 526336
+	default:
+		target = value
+	}
+
+	// Pointers to pointers aren't valid, following them could loop
+	// forever.
+	ctrlTarget, err := d.read(uint(target), 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ctrlTarget[0]>>5 == typePointer {
+		return nil, 0, fmt.Errorf("pointer to pointer at offset %d",
+			offset)
+	}
+
+	result, _, err := d.decode(uint(target))
+	return result, next, err
+}
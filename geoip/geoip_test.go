@@ -0,0 +1,155 @@
+package geoip
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// encodeValue encodes a string, unsigned integer or map in the MaxMind DB data
+// format.
+func encodeValue(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		buf.WriteByte(typeString<<5 | byte(len(v)))
+		buf.WriteString(v)
+
+	case uint32:
+		buf.WriteByte(typeUint32<<5 | 4)
+		buf.Write([]byte{
+			byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v),
+		})
+
+	case map[string]interface{}:
+		buf.WriteByte(typeMap<<5 | byte(len(v)))
+
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			encodeValue(buf, key)
+			encodeValue(buf, v[key])
+		}
+	}
+}
+
+// buildIPv4DB builds a MaxMind DB file with 24 bit records that maps the given
+// IPv4 networks to the given country codes.
+func buildIPv4DB(t *testing.T, networks map[string]string) []byte {
+	type node struct {
+		children [2]*node
+		data     int
+	}
+	root := &node{data: -1}
+
+	var data bytes.Buffer
+	for cidr, country := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		ones, _ := network.Mask.Size()
+
+		offset := data.Len()
+		encodeValue(&data, map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": country},
+		})
+
+		n := root
+		for i := 0; i < ones; i++ {
+			bit := (network.IP.To4()[i/8] >> (7 - uint(i%8))) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &node{data: -1}
+			}
+			n = n.children[bit]
+		}
+		n.data = offset
+	}
+
+	// Number the inner nodes in breadth first order.
+	var nodes []*node
+	queue := []*node{root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if n.data >= 0 {
+			continue
+		}
+		nodes = append(nodes, n)
+		for _, child := range n.children {
+			if child != nil {
+				queue = append(queue, child)
+			}
+		}
+	}
+	index := make(map[*node]int, len(nodes))
+	for i, n := range nodes {
+		index[n] = i
+	}
+
+	var tree bytes.Buffer
+	for _, n := range nodes {
+		for _, child := range n.children {
+			record := len(nodes)
+			switch {
+			case child == nil:
+			case child.data >= 0:
+				record = len(nodes) + dataSectionSeparatorSize +
+					child.data
+			default:
+				record = index[child]
+			}
+			tree.Write([]byte{
+				byte(record >> 16), byte(record >> 8),
+				byte(record),
+			})
+		}
+	}
+
+	var db bytes.Buffer
+	db.Write(tree.Bytes())
+	db.Write(make([]byte, dataSectionSeparatorSize))
+	db.Write(data.Bytes())
+	db.Write(metadataMarker)
+	encodeValue(&db, map[string]interface{}{
+		"node_count":  uint32(len(nodes)),
+		"record_size": uint32(24),
+		"ip_version":  uint32(4),
+	})
+	return db.Bytes()
+}
+
+// TestCountry tests that the countries of IP addresses are looked up in a
+// MaxMind DB file.
+func TestCountry(t *testing.T) {
+	reader, err := NewReader(buildIPv4DB(t, map[string]string{
+		"1.0.0.0/8":      "AU",
+		"2.16.0.0/13":    "FR",
+		"203.0.113.0/24": "NL",
+	}))
+	require.NoError(t, err)
+
+	tests := []struct {
+		ip      string
+		country string
+		err     error
+	}{
+		{ip: "1.2.3.4", country: "AU"},
+		{ip: "2.20.1.1", country: "FR"},
+		{ip: "203.0.113.77", country: "NL"},
+		{ip: "2.24.0.1", err: ErrNotFound},
+		{ip: "192.168.1.1", err: ErrNotFound},
+		{ip: "2001:db8::1", err: ErrNotFound},
+	}
+	for _, test := range tests {
+		country, err := reader.Country(net.ParseIP(test.ip))
+		require.Equal(t, test.err, err, test.ip)
+		require.Equal(t, test.country, country, test.ip)
+	}
+
+	_, err = NewReader([]byte("not a database"))
+	require.Error(t, err)
+}
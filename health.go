@@ -0,0 +1,210 @@
+package aperture
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// healthGRPCPrefix is the prefix a gRPC request URI has when it is
+	// meant for the health checking service.
+	healthGRPCPrefix = "/grpc.health.v1.Health/"
+
+	// defaultHealthCheckInterval is the default interval in which the
+	// backends are checked.
+	defaultHealthCheckInterval = 10 * time.Second
+
+	// defaultHealthCheckTimeout is the default time we wait for a single
+	// backend health check to complete.
+	defaultHealthCheckTimeout = 5 * time.Second
+)
+
+// healthBackend is a gRPC backend that is health checked periodically.
+type healthBackend struct {
+	name    string
+	conn    *grpc.ClientConn
+	client  grpc_health_v1.HealthClient
+	headers metadata.MD
+}
+
+// healthChecker periodically checks the health of all backends that opted in
+// and reports the results through the standard gRPC health checking protocol.
+// Each backend is reported under the name of its aperture service, the
+// overall status (empty service name) is only serving if all backends are.
+type healthChecker struct {
+	interval time.Duration
+	timeout  time.Duration
+
+	server   *health.Server
+	backends []*healthBackend
+
+	wg   sync.WaitGroup
+	quit chan struct{}
+}
+
+// newHealthChecker creates a new health checker for all services that have
+// health checking enabled.
+func newHealthChecker(cfg *HealthCheckConfig,
+	services []*proxy.Service) (*healthChecker, error) {
+
+	h := &healthChecker{
+		interval: cfg.Interval,
+		timeout:  cfg.Timeout,
+		server:   health.NewServer(),
+		quit:     make(chan struct{}),
+	}
+	if h.interval == 0 {
+		h.interval = defaultHealthCheckInterval
+	}
+	if h.timeout == 0 {
+		h.timeout = defaultHealthCheckTimeout
+	}
+
+	for _, service := range services {
+		if !service.HealthCheck {
+			continue
+		}
+
+		conn, headers, err := dialService(service)
+		if err != nil {
+			h.closeConns()
+			return nil, err
+		}
+
+		h.backends = append(h.backends, &healthBackend{
+			name:    service.Name,
+			conn:    conn,
+			client:  grpc_health_v1.NewHealthClient(conn),
+			headers: headers,
+		})
+
+		// Until the first check completes we don't know anything
+		// about the backend.
+		h.server.SetServingStatus(
+			service.Name,
+			grpc_health_v1.HealthCheckResponse_UNKNOWN,
+		)
+	}
+
+	return h, nil
+}
+
+// start starts the periodic health checks.
+func (h *healthChecker) start() {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+
+		for {
+			h.checkAll()
+
+			select {
+			case <-ticker.C:
+			case <-h.quit:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the periodic health checks and closes all backend connections.
+func (h *healthChecker) stop() {
+	close(h.quit)
+	h.wg.Wait()
+
+	h.server.Shutdown()
+	h.closeConns()
+}
+
+// closeConns closes the connections to all backends.
+func (h *healthChecker) closeConns() {
+	for _, backend := range h.backends {
+		if err := backend.conn.Close(); err != nil {
+			log.Errorf("Error closing health check connection to "+
+				"service %s: %v", backend.name, err)
+		}
+	}
+}
+
+// checkAll checks the health of all backends and updates the reported status.
+func (h *healthChecker) checkAll() {
+	overall := grpc_health_v1.HealthCheckResponse_SERVING
+	for _, backend := range h.backends {
+		servingStatus := h.check(backend)
+		if servingStatus != grpc_health_v1.HealthCheckResponse_SERVING {
+			overall = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+		}
+
+		h.server.SetServingStatus(backend.name, servingStatus)
+	}
+
+	h.server.SetServingStatus("", overall)
+}
+
+// check runs a single health check against the given backend.
+func (h *healthChecker) check(
+	backend *healthBackend) grpc_health_v1.HealthCheckResponse_ServingStatus {
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	ctx = metadata.NewOutgoingContext(ctx, backend.headers)
+	resp, err := backend.client.Check(
+		ctx, &grpc_health_v1.HealthCheckRequest{},
+	)
+	switch {
+	// A backend that doesn't implement the health checking protocol is
+	// considered healthy as long as it can be reached.
+	case status.Code(err) == codes.Unimplemented:
+		return grpc_health_v1.HealthCheckResponse_SERVING
+
+	case err != nil:
+		log.Debugf("Health check of service %s failed: %v",
+			backend.name, err)
+		return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+
+	default:
+		return resp.Status
+	}
+}
+
+// createHealthServer creates the gRPC server for the health checking service
+// and starts checking the backends.
+func createHealthServer(cfg *HealthCheckConfig,
+	services []*proxy.Service) (proxy.LocalService, func(), error) {
+
+	checker, err := newHealthChecker(cfg, services)
+	if err != nil {
+		return nil, nil, err
+	}
+	checker.start()
+
+	healthGRPC := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(healthGRPC, checker.server)
+
+	cleanup := func() {
+		healthGRPC.Stop()
+		checker.stop()
+	}
+	localService := proxy.NewLocalService(
+		healthGRPC, func(r *http.Request) bool {
+			return strings.HasPrefix(r.URL.Path, healthGRPCPrefix)
+		},
+	)
+
+	return localService, cleanup, nil
+}
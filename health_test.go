@@ -0,0 +1,95 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// TestHealthCheckerAggregation makes sure the health checker reports the status
+// of each backend and an overall status that is only serving if all backends
+// are.
+func TestHealthCheckerAggregation(t *testing.T) {
+	ctx := context.Background()
+
+	healthyServer := health.NewServer()
+	healthyAddr := startReflectionBackend(t, func(s *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(s, healthyServer)
+	})
+	sickServer := health.NewServer()
+	sickAddr := startReflectionBackend(t, func(s *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(s, sickServer)
+	})
+	sickServer.SetServingStatus(
+		"", grpc_health_v1.HealthCheckResponse_NOT_SERVING,
+	)
+
+	// The last backend doesn't implement the health checking protocol.
+	plainAddr := startReflectionBackend(t, func(*grpc.Server) {})
+
+	services := []*proxy.Service{{
+		Name:        "healthy",
+		Address:     healthyAddr,
+		Protocol:    "http",
+		HealthCheck: true,
+	}, {
+		Name:        "sick",
+		Address:     sickAddr,
+		Protocol:    "http",
+		HealthCheck: true,
+	}, {
+		Name:        "plain",
+		Address:     plainAddr,
+		Protocol:    "http",
+		HealthCheck: true,
+	}, {
+		Name:     "unchecked",
+		Address:  "localhost:1",
+		Protocol: "http",
+	}}
+	checker, err := newHealthChecker(&HealthCheckConfig{}, services)
+	require.NoError(t, err)
+	defer checker.closeConns()
+
+	checkStatus := func(service string,
+		expected grpc_health_v1.HealthCheckResponse_ServingStatus) {
+
+		t.Helper()
+
+		resp, err := checker.server.Check(
+			ctx, &grpc_health_v1.HealthCheckRequest{
+				Service: service,
+			},
+		)
+		require.NoError(t, err)
+		require.Equal(t, expected, resp.Status)
+	}
+
+	// Before the first check, nothing is known about the backends.
+	checkStatus("healthy", grpc_health_v1.HealthCheckResponse_UNKNOWN)
+
+	checker.checkAll()
+	checkStatus("healthy", grpc_health_v1.HealthCheckResponse_SERVING)
+	checkStatus("sick", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	checkStatus("plain", grpc_health_v1.HealthCheckResponse_SERVING)
+	checkStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	// Services that aren't checked are unknown to the health server.
+	_, err = checker.server.Check(ctx, &grpc_health_v1.HealthCheckRequest{
+		Service: "unchecked",
+	})
+	require.Error(t, err)
+
+	// Once the sick backend recovers, the overall status is serving too.
+	sickServer.SetServingStatus(
+		"", grpc_health_v1.HealthCheckResponse_SERVING,
+	)
+	checker.checkAll()
+	checkStatus("sick", grpc_health_v1.HealthCheckResponse_SERVING)
+	checkStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+}
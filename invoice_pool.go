@@ -0,0 +1,199 @@
+package aperture
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+const (
+	// defaultInvoicePoolMaxAge is the default maximum age of a pre-created
+	// invoice. Older invoices are discarded so clients always get enough
+	// time to pay before the invoice expires.
+	defaultInvoicePoolMaxAge = 10 * time.Minute
+
+	// maxInvoicePoolTiers is the maximum number of different prices we
+	// keep invoices for. Dynamic prices can take any value, so we don't try
+	// to keep invoices for all of them.
+	maxInvoicePoolTiers = 32
+)
+
+// pooledInvoice is an invoice that was created before it was needed.
+type pooledInvoice struct {
+	paymentRequest string
+	paymentHash    lntypes.Hash
+	created        time.Time
+}
+
+// invoiceTier holds the pre-created invoices of a single price.
+type invoiceTier struct {
+	invoices []*pooledInvoice
+	lastUsed time.Time
+}
+
+// invoicePool keeps a number of invoices per price ready, so a challenge can
+// be issued without waiting for lnd to create an invoice. The prices are
+// learned from the challenges that are requested. Every invoice is handed out
+// at most once.
+type invoicePool struct {
+	size       int
+	maxAge     time.Duration
+	addInvoice func(price int64) (string, lntypes.Hash, error)
+
+	tiers map[int64]*invoiceTier
+	mtx   sync.Mutex
+
+	refill chan struct{}
+	quit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// newInvoicePool creates a pool that keeps size invoices per price, created
+// with the given function, for at most maxAge.
+func newInvoicePool(size int, maxAge time.Duration,
+	addInvoice func(price int64) (string, lntypes.Hash,
+		error)) *invoicePool {
+
+	if maxAge == 0 {
+		maxAge = defaultInvoicePoolMaxAge
+	}
+
+	return &invoicePool{
+		size:       size,
+		maxAge:     maxAge,
+		addInvoice: addInvoice,
+		tiers:      make(map[int64]*invoiceTier),
+		refill:     make(chan struct{}, 1),
+		quit:       make(chan struct{}),
+	}
+}
+
+// Start starts refilling the pool in the background.
+func (p *invoicePool) Start() {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		// Expired invoices are also removed if no challenges are
+		// requested at all.
+		ticker := time.NewTicker(p.maxAge / 4)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.refill:
+			case <-ticker.C:
+			case <-p.quit:
+				return
+			}
+
+			p.fill()
+		}
+	}()
+}
+
+// Stop stops refilling the pool. Unused invoices simply expire in lnd.
+func (p *invoicePool) Stop() {
+	close(p.quit)
+	p.wg.Wait()
+}
+
+// take returns a pre-created invoice for the given price, if there is one. In
+// any case the pool is refilled in the background, so the next challenge for
+// the same price can be served from the pool.
+func (p *invoicePool) take(price int64) (*pooledInvoice, bool) {
+	defer p.triggerRefill()
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	now := time.Now()
+	tier, ok := p.tiers[price]
+	if !ok {
+		if len(p.tiers) >= maxInvoicePoolTiers {
+			return nil, false
+		}
+		tier = &invoiceTier{}
+		p.tiers[price] = tier
+	}
+	tier.lastUsed = now
+
+	for len(tier.invoices) > 0 {
+		invoice := tier.invoices[0]
+		tier.invoices = tier.invoices[1:]
+
+		if now.Sub(invoice.created) < p.maxAge {
+			return invoice, true
+		}
+	}
+
+	return nil, false
+}
+
+// triggerRefill wakes up the background refill without blocking.
+func (p *invoicePool) triggerRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// fill removes expired invoices and tiers that weren't used for a while and
+// creates new invoices until every tier is full.
+func (p *invoicePool) fill() {
+	p.mtx.Lock()
+	now := time.Now()
+	missing := make(map[int64]int)
+	for price, tier := range p.tiers {
+		if now.Sub(tier.lastUsed) > p.maxAge {
+			delete(p.tiers, price)
+			continue
+		}
+
+		valid := tier.invoices[:0]
+		for _, invoice := range tier.invoices {
+			if now.Sub(invoice.created) < p.maxAge {
+				valid = append(valid, invoice)
+			}
+		}
+		tier.invoices = valid
+
+		if len(tier.invoices) < p.size {
+			missing[price] = p.size - len(tier.invoices)
+		}
+	}
+	p.mtx.Unlock()
+
+	// We don't hold the lock while talking to lnd, so challenges can still
+	// be served from the pool in the meantime.
+	for price, num := range missing {
+		for i := 0; i < num; i++ {
+			select {
+			case <-p.quit:
+				return
+			default:
+			}
+
+			created := time.Now()
+			payReq, hash, err := p.addInvoice(price)
+			if err != nil {
+				log.Errorf("Error pre-creating invoice: %v", err)
+				return
+			}
+
+			p.mtx.Lock()
+			tier, ok := p.tiers[price]
+			if !ok || len(tier.invoices) >= p.size {
+				p.mtx.Unlock()
+				break
+			}
+			tier.invoices = append(tier.invoices, &pooledInvoice{
+				paymentRequest: payReq,
+				paymentHash:    hash,
+				created:        created,
+			})
+			p.mtx.Unlock()
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package aperture
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	// h2FrameHeaderSize is the size of the header of each HTTP/2 frame.
+	h2FrameHeaderSize = 9
+
+	// HTTP/2 frame types and flags the keepalive enforcement looks at.
+	h2FrameData      = 0x0
+	h2FrameHeaders   = 0x1
+	h2FrameRSTStream = 0x3
+	h2FramePing      = 0x6
+	h2FrameGoAway    = 0x7
+	h2FlagEndStream  = 0x1
+	h2FlagAck        = 0x1
+
+	// streamEndedByClient and streamEndedByServer mark the sides that
+	// ended a stream.
+	streamEndedByClient = 0x1
+	streamEndedByServer = 0x2
+
+	// h2ErrEnhanceYourCalm is the HTTP/2 error code a connection is closed
+	// with if the client sends too many pings.
+	h2ErrEnhanceYourCalm = 0xb
+
+	// maxPingStrikes is the number of pings a client may send in violation
+	// of the enforcement policy before its connection is closed. This is
+	// the same as in gRPC.
+	maxPingStrikes = 2
+
+	// noStreamPingTime is the minimum time between pings on connections
+	// without active streams, if those pings aren't permitted outright.
+	// This is the same as in gRPC.
+	noStreamPingTime = 2 * time.Hour
+)
+
+var (
+	// h2ClientPreface is the connection preface every HTTP/2 client sends
+	// before its first frame.
+	h2ClientPreface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+	// tooManyPings is the debug data of the GOAWAY frame a connection is
+	// closed with if the client sends too many pings. gRPC clients that
+	// receive it double their keepalive time.
+	tooManyPings = []byte("too_many_pings")
+)
+
+// h2FrameParser follows the frames in one direction of an HTTP/2 connection.
+type h2FrameParser struct {
+	// preface is the number of bytes of the client preface that are still
+	// expected.
+	preface int
+
+	header    [h2FrameHeaderSize]byte
+	headerLen int
+
+	// payload is the number of bytes of the current frame's payload that
+	// are still expected.
+	payload uint32
+}
+
+// atBoundary returns true if the parser is between two frames.
+func (p *h2FrameParser) atBoundary() bool {
+	return p.preface == 0 && p.headerLen == 0 && p.payload == 0
+}
+
+// parse follows the frames in the given bytes and calls the given function
+// with the type, flags and stream ID of every frame once its header is
+// complete. It returns false if the bytes don't start with the client preface
+// although it was expected.
+func (p *h2FrameParser) parse(data []byte,
+	frame func(typ, flags byte, streamID uint32)) bool {
+
+	for len(data) > 0 {
+		switch {
+		case p.preface > 0:
+			offset := len(h2ClientPreface) - p.preface
+			n := p.preface
+			if len(data) < n {
+				n = len(data)
+			}
+			expected := h2ClientPreface[offset : offset+n]
+			if string(data[:n]) != string(expected) {
+				return false
+			}
+			p.preface -= n
+			data = data[n:]
+
+		case p.payload > 0:
+			n := p.payload
+			if uint32(len(data)) < n {
+				n = uint32(len(data))
+			}
+			p.payload -= n
+			data = data[n:]
+
+		default:
+			n := copy(p.header[p.headerLen:], data)
+			p.headerLen += n
+			data = data[n:]
+			if p.headerLen < h2FrameHeaderSize {
+				continue
+			}
+
+			p.headerLen = 0
+			p.payload = uint32(p.header[0])<<16 |
+				uint32(p.header[1])<<8 | uint32(p.header[2])
+			streamID := binary.BigEndian.Uint32(p.header[5:]) &
+				(1<<31 - 1)
+			frame(p.header[3], p.header[4], streamID)
+		}
+	}
+
+	return true
+}
+
+// keepaliveConn enforces the keepalive policy on the HTTP/2 pings a client
+// sends over a connection. Like gRPC, clients that ping more often than the
+// policy allows get strikes, and the connection is closed with a GOAWAY frame
+// once they exceed the maximum.
+type keepaliveConn struct {
+	net.Conn
+
+	policy *KeepaliveConfig
+
+	// active is false if the connection doesn't carry HTTP/2 and isn't
+	// inspected.
+	active bool
+
+	// outActive is set once the frames the server writes are followed.
+	// Until the client preface was read, a connection that isn't known to
+	// be HTTP/2 might still turn out to carry something else.
+	outActive bool
+
+	in  h2FrameParser
+	out h2FrameParser
+
+	// streams holds the open streams, with the flags of the sides that
+	// ended them.
+	streams      map[uint32]byte
+	lastStreamID uint32
+	lastPing     time.Time
+	strikes      int
+
+	// mtx guards the state of the connection, writeMtx the writes to it,
+	// so a GOAWAY frame is never sent in the middle of another frame.
+	mtx      sync.Mutex
+	writeMtx sync.Mutex
+}
+
+// newKeepaliveConn wraps the given connection to enforce the keepalive policy.
+// If the connection is known to carry HTTP/2, frames written to it are
+// followed right away. Otherwise the connection is only inspected if the
+// client starts it with the HTTP/2 preface.
+func newKeepaliveConn(conn net.Conn, policy *KeepaliveConfig,
+	knownH2 bool) *keepaliveConn {
+
+	return &keepaliveConn{
+		Conn:      conn,
+		policy:    policy,
+		active:    true,
+		outActive: knownH2,
+		in:        h2FrameParser{preface: len(h2ClientPreface)},
+		streams:   make(map[uint32]byte),
+	}
+}
+
+// Read reads from the connection and follows the frames the client sends.
+func (c *keepaliveConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n == 0 {
+		return n, err
+	}
+
+	c.mtx.Lock()
+	if c.active && !c.in.parse(p[:n], c.clientFrame) {
+		c.active = false
+	}
+	if c.in.preface == 0 {
+		c.outActive = true
+	}
+	violated := c.active && c.strikes > maxPingStrikes
+	c.mtx.Unlock()
+
+	if violated {
+		log.Infof("Closing connection of %v for too many pings",
+			c.RemoteAddr())
+		c.goAway()
+		return 0, fmt.Errorf("too many pings")
+	}
+
+	return n, err
+}
+
+// Write writes to the connection and follows the frames the server sends.
+func (c *keepaliveConn) Write(p []byte) (int, error) {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+
+	n, err := c.Conn.Write(p)
+
+	c.mtx.Lock()
+	if c.active && c.outActive {
+		c.out.parse(p[:n], c.serverFrame)
+	}
+	c.mtx.Unlock()
+
+	return n, err
+}
+
+// clientFrame updates the state of the connection with a frame the client
+// sent.
+//
+// NOTE: The mutex must be held when calling this method.
+func (c *keepaliveConn) clientFrame(typ, flags byte, streamID uint32) {
+	switch typ {
+	case h2FrameHeaders:
+		if streamID > c.lastStreamID {
+			c.lastStreamID = streamID
+			c.streams[streamID] = 0
+		}
+		c.endStream(streamID, flags, streamEndedByClient)
+
+	case h2FrameData:
+		c.endStream(streamID, flags, streamEndedByClient)
+
+	case h2FrameRSTStream:
+		delete(c.streams, streamID)
+
+	case h2FramePing:
+		if flags&h2FlagAck != 0 {
+			return
+		}
+		c.ping(time.Now())
+	}
+}
+
+// serverFrame updates the state of the connection with a frame the server
+// sent.
+//
+// NOTE: The mutex must be held when calling this method.
+func (c *keepaliveConn) serverFrame(typ, flags byte, streamID uint32) {
+	switch typ {
+	// Like gRPC, a client may ping as often as it wants while the server
+	// is sending it data.
+	case h2FrameHeaders, h2FrameData:
+		c.strikes = 0
+		c.lastPing = time.Time{}
+		c.endStream(streamID, flags, streamEndedByServer)
+
+	case h2FrameRSTStream:
+		delete(c.streams, streamID)
+	}
+}
+
+// endStream marks the stream as ended by one side if the END_STREAM flag is
+// set. Once both sides ended it, the stream is closed.
+//
+// NOTE: The mutex must be held when calling this method.
+func (c *keepaliveConn) endStream(streamID uint32, flags, side byte) {
+	ended, ok := c.streams[streamID]
+	if !ok || flags&h2FlagEndStream == 0 {
+		return
+	}
+
+	ended |= side
+	if ended == streamEndedByClient|streamEndedByServer {
+		delete(c.streams, streamID)
+		return
+	}
+	c.streams[streamID] = ended
+}
+
+// ping checks a ping of the client against the enforcement policy and gives
+// it a strike if it violates it.
+//
+// NOTE: The mutex must be held when calling this method.
+func (c *keepaliveConn) ping(now time.Time) {
+	minTime := c.policy.MinTime
+	if len(c.streams) == 0 && !c.policy.PermitWithoutStream {
+		minTime = noStreamPingTime
+	}
+
+	if !c.lastPing.IsZero() && now.Sub(c.lastPing) < minTime {
+		c.strikes++
+	}
+	c.lastPing = now
+}
+
+// goAway sends a GOAWAY frame with the ENHANCE_YOUR_CALM error code, if the
+// server isn't in the middle of a frame, and closes the connection.
+func (c *keepaliveConn) goAway() {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+
+	c.mtx.Lock()
+	atBoundary := c.out.atBoundary()
+	lastStreamID := c.lastStreamID
+	c.mtx.Unlock()
+
+	if atBoundary {
+		frame := make([]byte, h2FrameHeaderSize+8, h2FrameHeaderSize+8+
+			len(tooManyPings))
+		length := 8 + len(tooManyPings)
+		frame[0] = byte(length >> 16)
+		frame[1] = byte(length >> 8)
+		frame[2] = byte(length)
+		frame[3] = h2FrameGoAway
+		binary.BigEndian.PutUint32(frame[9:], lastStreamID)
+		binary.BigEndian.PutUint32(frame[13:], h2ErrEnhanceYourCalm)
+		frame = append(frame, tooManyPings...)
+
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_, _ = c.Conn.Write(frame)
+	}
+
+	_ = c.Conn.Close()
+}
+
+// keepaliveListener wraps the connections of a plain text listener to enforce
+// the keepalive policy on those that carry HTTP/2 with prior knowledge.
+type keepaliveListener struct {
+	net.Listener
+
+	policy *KeepaliveConfig
+}
+
+// Accept waits for the next connection and wraps it.
+func (l *keepaliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newKeepaliveConn(conn, l.policy, false), nil
+}
+
+// keepaliveTLSConn is a keepalive enforcing connection that still reports the
+// TLS state of the underlying connection to the HTTP/2 server.
+type keepaliveTLSConn struct {
+	*keepaliveConn
+
+	tlsConn *tls.Conn
+}
+
+// ConnectionState returns the state of the TLS connection.
+func (c *keepaliveTLSConn) ConnectionState() tls.ConnectionState {
+	return c.tlsConn.ConnectionState()
+}
+
+// enforceKeepalive makes the HTTP/2 server of the given TLS server enforce the
+// keepalive policy. The server must already be configured for HTTP/2.
+func enforceKeepalive(server *http.Server, h2Server *http2.Server,
+	policy *KeepaliveConfig) {
+
+	server.TLSNextProto[http2.NextProtoTLS] = func(hs *http.Server,
+		conn *tls.Conn, handler http.Handler) {
+
+		// The HTTP server passes the context of the connection in a
+		// wrapper of the handler.
+		var ctx context.Context
+		type baseContexter interface {
+			BaseContext() context.Context
+		}
+		if bc, ok := handler.(baseContexter); ok {
+			ctx = bc.BaseContext()
+		}
+
+		h2Server.ServeConn(&keepaliveTLSConn{
+			keepaliveConn: newKeepaliveConn(conn, policy, true),
+			tlsConn:       conn,
+		}, &http2.ServeConnOpts{
+			Context:    ctx,
+			Handler:    handler,
+			BaseConfig: hs,
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package aperture
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// h2Frame encodes an HTTP/2 frame.
+func h2Frame(typ, flags byte, streamID uint32, payload []byte) []byte {
+	frame := make([]byte, h2FrameHeaderSize, h2FrameHeaderSize+len(payload))
+	frame[0] = byte(len(payload) >> 16)
+	frame[1] = byte(len(payload) >> 8)
+	frame[2] = byte(len(payload))
+	frame[3] = typ
+	frame[4] = flags
+	binary.BigEndian.PutUint32(frame[5:], streamID)
+	return append(frame, payload...)
+}
+
+// TestH2FrameParser tests that frames are followed no matter how they are split
+// into reads and that connections without the preface are detected.
+func TestH2FrameParser(t *testing.T) {
+	var stream []byte
+	stream = append(stream, h2ClientPreface...)
+	stream = append(stream, h2Frame(0x4, 0, 0, make([]byte, 18))...)
+	stream = append(stream, h2Frame(h2FrameHeaders, 0x4, 1, []byte{1})...)
+	stream = append(stream, h2Frame(h2FrameData, 0x1, 1, []byte("hi"))...)
+	stream = append(stream, h2Frame(h2FramePing, 0, 0, make([]byte, 8))...)
+
+	type frame struct {
+		typ, flags byte
+		streamID   uint32
+	}
+	expected := []frame{
+		{0x4, 0, 0}, {h2FrameHeaders, 0x4, 1}, {h2FrameData, 0x1, 1},
+		{h2FramePing, 0, 0},
+	}
+
+	for _, chunkSize := range []int{1, 7, len(stream)} {
+		parser := h2FrameParser{preface: len(h2ClientPreface)}
+
+		var frames []frame
+		for i := 0; i < len(stream); i += chunkSize {
+			end := i + chunkSize
+			if end > len(stream) {
+				end = len(stream)
+			}
+			ok := parser.parse(stream[i:end], func(typ, flags byte,
+				streamID uint32) {
+
+				frames = append(frames, frame{typ, flags, streamID})
+			})
+			require.True(t, ok)
+		}
+		require.Equal(t, expected, frames)
+		require.True(t, parser.atBoundary())
+	}
+
+	parser := h2FrameParser{preface: len(h2ClientPreface)}
+	require.False(t, parser.parse([]byte("GET / HTTP/1.1\r\n"), nil))
+}
+
+// TestKeepaliveConn tests that clients that ping too often get strikes unless
+// the server is sending them data, and that they are disconnected with a GOAWAY
+// frame once they exceed the maximum.
+func TestKeepaliveConn(t *testing.T) {
+	policy := &KeepaliveConfig{MinTime: time.Hour}
+
+	conn := newKeepaliveConn(nil, policy, true)
+	conn.clientFrame(h2FrameHeaders, 0, 1)
+	for i := 0; i < 5; i++ {
+		conn.clientFrame(h2FramePing, 0, 0)
+		conn.serverFrame(h2FrameData, 0, 1)
+	}
+	require.Zero(t, conn.strikes)
+	for i := 0; i < 3; i++ {
+		conn.clientFrame(h2FramePing, 0, 0)
+	}
+	require.Equal(t, 2, conn.strikes)
+
+	// Pings without active streams are only permitted if the policy says
+	// so.
+	conn.serverFrame(h2FrameHeaders, h2FlagEndStream, 1)
+	conn.clientFrame(h2FrameData, h2FlagEndStream, 1)
+	require.Empty(t, conn.streams)
+	conn.clientFrame(h2FramePing, 0, 0)
+	conn.lastPing = time.Now().Add(-policy.MinTime - time.Minute)
+	conn.clientFrame(h2FramePing, 0, 0)
+	require.Equal(t, 1, conn.strikes)
+
+	policy.PermitWithoutStream = true
+	conn.lastPing = time.Now().Add(-policy.MinTime - time.Minute)
+	conn.clientFrame(h2FramePing, 0, 0)
+	require.Equal(t, 1, conn.strikes)
+
+	// A client that keeps pinging is disconnected.
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn = newKeepaliveConn(server, policy, false)
+	serverErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, conn)
+		serverErr <- err
+	}()
+
+	ping := h2Frame(h2FramePing, 0, 0, make([]byte, 8))
+	write := func(b []byte) {
+		_, err := client.Write(b)
+		require.NoError(t, err)
+	}
+	write(h2ClientPreface)
+	write(h2Frame(h2FrameHeaders, 0, 1, []byte{1}))
+	for i := 0; i < 4; i++ {
+		write(ping)
+	}
+
+	goAway := make([]byte, h2FrameHeaderSize+8+len(tooManyPings))
+	_, err := io.ReadFull(client, goAway)
+	require.NoError(t, err)
+	require.Equal(t, byte(h2FrameGoAway), goAway[3])
+	require.Equal(t, uint32(1), binary.BigEndian.Uint32(goAway[9:]))
+	require.Equal(
+		t, uint32(h2ErrEnhanceYourCalm),
+		binary.BigEndian.Uint32(goAway[13:]),
+	)
+	require.Equal(t, tooManyPings, goAway[17:])
+
+	require.Error(t, <-serverErr)
+	_, err = client.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,214 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// awsMacAlgorithm is the MAC algorithm of the HMAC key in AWS KMS.
+	awsMacAlgorithm = "HMAC_SHA_256"
+
+	// awsTarget is the API operation we use.
+	awsTarget = "TrentService.GenerateMac"
+
+	// awsContentType is the content type of AWS KMS API requests.
+	awsContentType = "application/x-amz-json-1.1"
+
+	// awsTimeFormat is the format of the request time in signed requests.
+	awsTimeFormat = "20060102T150405Z"
+)
+
+// awsCredentials are the credentials requests to AWS are signed with.
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// AWSSigner computes codes with an HMAC key in AWS KMS. The credentials are
+// read from the standard AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables.
+type AWSSigner struct {
+	client   *http.Client
+	endpoint string
+	region   string
+	keyID    string
+	creds    awsCredentials
+
+	// now returns the current time and can be replaced in tests.
+	now func() time.Time
+}
+
+// A compile-time constraint to ensure AWSSigner implements Signer.
+var _ Signer = (*AWSSigner)(nil)
+
+// NewAWSSigner creates a signer for the HMAC key with the given ID or ARN in
+// the given region.
+func NewAWSSigner(client *http.Client, region, keyID string) (*AWSSigner,
+	error) {
+
+	creds := awsCredentials{
+		accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.accessKeyID == "" || creds.secretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and " +
+			"AWS_SECRET_ACCESS_KEY must be set")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" || keyID == "" {
+		return nil, fmt.Errorf("AWS KMS region and key ID required")
+	}
+
+	return &AWSSigner{
+		client:   client,
+		endpoint: fmt.Sprintf("https://kms.%s.amazonaws.com/", region),
+		region:   region,
+		keyID:    keyID,
+		creds:    creds,
+		now:      time.Now,
+	}, nil
+}
+
+// MAC returns the HMAC-SHA256 of the given data under the KMS key.
+//
+// NOTE: This is part of the Signer interface.
+func (s *AWSSigner) MAC(ctx context.Context, data []byte) ([]byte, error) {
+	body, err := json.Marshal(struct {
+		KeyID        string `json:"KeyId"`
+		Message      []byte `json:"Message"`
+		MacAlgorithm string `json:"MacAlgorithm"`
+	}{s.keyID, data, awsMacAlgorithm})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(
+		http.MethodPost, s.endpoint, bytes.NewReader(body),
+	)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", awsContentType)
+	req.Header.Set("X-Amz-Target", awsTarget)
+	s.sign(req, body)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("AWS KMS returned status %d: %s",
+			resp.StatusCode, respBody)
+	}
+
+	var result struct {
+		Mac []byte `json:"Mac"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Mac) == 0 {
+		return nil, fmt.Errorf("AWS KMS returned empty MAC")
+	}
+	return result.Mac, nil
+}
+
+// sign adds the AWS signature version 4 of the request.
+func (s *AWSSigner) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format(awsTimeFormat)
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.creds.sessionToken)
+	}
+
+	// The signed header names must be lower case and sorted.
+	headers := map[string]string{
+		"content-type": req.Header.Get("Content-Type"),
+		"host":         req.URL.Host,
+		"x-amz-date":   amzDate,
+		"x-amz-target": req.Header.Get("X-Amz-Target"),
+	}
+	if s.creds.sessionToken != "" {
+		headers["x-amz-security-token"] = s.creds.sessionToken
+	}
+	names := []string{
+		"content-type", "host", "x-amz-date", "x-amz-security-token",
+		"x-amz-target",
+	}
+	var canonicalHeaders, signedHeaders []string
+	for _, name := range names {
+		value, ok := headers[name]
+		if !ok {
+			continue
+		}
+		canonicalHeaders = append(
+			canonicalHeaders, name+":"+strings.TrimSpace(value)+"\n",
+		)
+		signedHeaders = append(signedHeaders, name)
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, req.URL.RawQuery,
+		strings.Join(canonicalHeaders, ""),
+		strings.Join(signedHeaders, ";"),
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := strings.Join(
+		[]string{date, s.region, "kms", "aws4_request"}, "/",
+	)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.creds.secretAccessKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "kms")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, "+
+			"Signature=%s", s.creds.accessKeyID, scope,
+		strings.Join(signedHeaders, ";"), signature,
+	))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the given data.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,52 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// CommandSigner computes codes by running an external command. This allows
+// using keys in hardware security modules through their PKCS#11 tools without
+// linking aperture against a vendor library. The command gets the data on its
+// standard input and must write the raw code to its standard output.
+type CommandSigner struct {
+	name string
+	args []string
+}
+
+// A compile-time constraint to ensure CommandSigner implements Signer.
+var _ Signer = (*CommandSigner)(nil)
+
+// NewCommandSigner creates a signer that runs the given command line. The
+// arguments are separated by white space, quoting isn't supported.
+func NewCommandSigner(command string) (*CommandSigner, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("KMS command required")
+	}
+
+	return &CommandSigner{name: args[0], args: args[1:]}, nil
+}
+
+// MAC runs the command with the given data on its standard input.
+//
+// NOTE: This is part of the Signer interface.
+func (s *CommandSigner) MAC(ctx context.Context, data []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.name, s.args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("KMS command failed: %v: %s", err,
+			bytes.TrimSpace(stderr.Bytes()))
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("KMS command returned empty MAC")
+	}
+	return stdout.Bytes(), nil
+}
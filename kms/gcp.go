@@ -0,0 +1,160 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// gcpEndpoint is the endpoint of the Cloud KMS REST API.
+	gcpEndpoint = "https://cloudkms.googleapis.com/v1/"
+
+	// gcpTokenURL is the URL of the metadata server that returns access
+	// tokens of the service account of the instance.
+	gcpTokenURL = "http://metadata.google.internal/computeMetadata/v1/" +
+		"instance/service-accounts/default/token"
+
+	// gcpTokenEnv is the environment variable that can contain an access
+	// token, for running outside of Google Cloud.
+	gcpTokenEnv = "GOOGLE_OAUTH_ACCESS_TOKEN"
+
+	// gcpTokenMargin is how long before its expiry we replace a token.
+	gcpTokenMargin = time.Minute
+)
+
+// GCPSigner computes codes with a MAC key in Google Cloud KMS. It authenticates
+// as the service account of the instance it runs on, unless an access token is
+// set in the GOOGLE_OAUTH_ACCESS_TOKEN environment variable.
+type GCPSigner struct {
+	client     *http.Client
+	endpoint   string
+	tokenURL   string
+	keyVersion string
+
+	token       string
+	tokenExpiry time.Time
+	tokenMtx    sync.Mutex
+}
+
+// A compile-time constraint to ensure GCPSigner implements Signer.
+var _ Signer = (*GCPSigner)(nil)
+
+// NewGCPSigner creates a signer for the MAC key version with the given
+// resource name, for example
+// projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1.
+func NewGCPSigner(client *http.Client, keyVersion string) (*GCPSigner,
+	error) {
+
+	if keyVersion == "" {
+		return nil, fmt.Errorf("GCP KMS key version required")
+	}
+
+	return &GCPSigner{
+		client:     client,
+		endpoint:   gcpEndpoint,
+		tokenURL:   gcpTokenURL,
+		keyVersion: keyVersion,
+		token:      os.Getenv(gcpTokenEnv),
+	}, nil
+}
+
+// MAC returns the code of the given data under the KMS key.
+//
+// NOTE: This is part of the Signer interface.
+func (s *GCPSigner) MAC(ctx context.Context, data []byte) ([]byte, error) {
+	token, err := s.accessToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get access token: %v", err)
+	}
+
+	body, err := json.Marshal(struct {
+		Data []byte `json:"data"`
+	}{data})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(
+		http.MethodPost, s.endpoint+s.keyVersion+":macSign",
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	var result struct {
+		Mac []byte `json:"mac"`
+	}
+	if err := s.do(req, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Mac) == 0 {
+		return nil, fmt.Errorf("GCP KMS returned empty MAC")
+	}
+	return result.Mac, nil
+}
+
+// accessToken returns a valid access token, fetching a new one from the
+// metadata server if necessary.
+func (s *GCPSigner) accessToken(ctx context.Context) (string, error) {
+	s.tokenMtx.Lock()
+	defer s.tokenMtx.Unlock()
+
+	// A token from the environment doesn't have a known expiry.
+	if s.token != "" &&
+		(s.tokenExpiry.IsZero() || time.Now().Before(s.tokenExpiry)) {
+
+		return s.token, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.tokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := s.do(req, &result); err != nil {
+		return "", err
+	}
+
+	s.token = result.AccessToken
+	s.tokenExpiry = time.Now().Add(
+		time.Duration(result.ExpiresIn)*time.Second - gcpTokenMargin,
+	)
+	return s.token, nil
+}
+
+// do sends the request and decodes the JSON response into the given value.
+func (s *GCPSigner) do(req *http.Request, result interface{}) error {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d: %s", req.URL.Host,
+			resp.StatusCode, body)
+	}
+
+	return json.Unmarshal(body, result)
+}
@@ -0,0 +1,61 @@
+package kms
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// requestTimeout is the maximum time a single request to a key
+	// management service may take.
+	requestTimeout = 5 * time.Second
+)
+
+// Signer computes message authentication codes with a root key that never
+// leaves the key management service or hardware security module it lives in.
+type Signer interface {
+	// MAC returns the message authentication code of the given data
+	// under the root key. The same data must always result in the same
+	// code.
+	MAC(ctx context.Context, data []byte) ([]byte, error)
+}
+
+// Config is the configuration of a signer.
+type Config struct {
+	// Provider is the name of the key management service, one of "aws",
+	// "gcp" or "command".
+	Provider string
+
+	// KeyID identifies the root key. For AWS KMS this is the key ID or ARN
+	// of an HMAC key, for GCP Cloud KMS the resource name of a MAC key
+	// version.
+	KeyID string
+
+	// Region is the AWS region of the key.
+	Region string
+
+	// Command is the command that computes the code for the "command"
+	// provider.
+	Command string
+}
+
+// NewSigner creates the signer of the configured provider.
+func NewSigner(cfg *Config) (Signer, error) {
+	client := &http.Client{Timeout: requestTimeout}
+
+	switch cfg.Provider {
+	case "aws":
+		return NewAWSSigner(client, cfg.Region, cfg.KeyID)
+
+	case "gcp":
+		return NewGCPSigner(client, cfg.KeyID)
+
+	case "command":
+		return NewCommandSigner(cfg.Command)
+
+	default:
+		return nil, fmt.Errorf("unknown KMS provider %q", cfg.Provider)
+	}
+}
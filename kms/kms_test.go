@@ -0,0 +1,128 @@
+package kms
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestAWSSigner tests that requests to AWS KMS are signed and the MAC is
+// decoded from the response.
+func TestAWSSigner(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, awsTarget, r.Header.Get("X-Amz-Target"))
+			require.Equal(t, "20210801T120000Z",
+				r.Header.Get("X-Amz-Date"))
+
+			auth := r.Header.Get("Authorization")
+			require.True(t, strings.HasPrefix(auth,
+				"AWS4-HMAC-SHA256 Credential=AKID/20210801/"+
+					"us-east-1/kms/aws4_request, "+
+					"SignedHeaders=content-type;host;"+
+					"x-amz-date;x-amz-target, Signature=",
+			), auth)
+
+			var req struct {
+				KeyID   string `json:"KeyId"`
+				Message []byte `json:"Message"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			require.Equal(t, "key", req.KeyID)
+
+			_ = json.NewEncoder(w).Encode(struct {
+				Mac []byte `json:"Mac"`
+			}{append([]byte("mac:"), req.Message...)})
+		},
+	))
+	defer server.Close()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	os.Unsetenv("AWS_SESSION_TOKEN")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	signer, err := NewAWSSigner(server.Client(), "us-east-1", "key")
+	require.NoError(t, err)
+	signer.endpoint = server.URL + "/"
+	signer.now = func() time.Time {
+		return time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	}
+
+	mac, err := signer.MAC(context.Background(), []byte("data"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("mac:data"), mac)
+}
+
+// TestGCPSigner tests that an access token is fetched from the metadata server
+// and used for the MAC request.
+func TestGCPSigner(t *testing.T) {
+	const keyVersion = "projects/p/locations/l/keyRings/r/cryptoKeys/k/" +
+		"cryptoKeyVersions/1"
+
+	var tokenRequests int
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/token" {
+				tokenRequests++
+				require.Equal(t, "Google",
+					r.Header.Get("Metadata-Flavor"))
+				_, _ = w.Write([]byte(`{"access_token":"tok",` +
+					`"expires_in":3600}`))
+				return
+			}
+
+			require.Equal(t, "/"+keyVersion+":macSign", r.URL.Path)
+			require.Equal(t, "Bearer tok",
+				r.Header.Get("Authorization"))
+
+			var req struct {
+				Data []byte `json:"data"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			_ = json.NewEncoder(w).Encode(struct {
+				Mac []byte `json:"mac"`
+			}{append([]byte("mac:"), req.Data...)})
+		},
+	))
+	defer server.Close()
+
+	os.Unsetenv(gcpTokenEnv)
+	signer, err := NewGCPSigner(server.Client(), keyVersion)
+	require.NoError(t, err)
+	signer.endpoint = server.URL + "/"
+	signer.tokenURL = server.URL + "/token"
+
+	for i := 0; i < 2; i++ {
+		mac, err := signer.MAC(context.Background(), []byte("data"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("mac:data"), mac)
+	}
+
+	// The token is reused until it expires.
+	require.Equal(t, 1, tokenRequests)
+}
+
+// TestCommandSigner tests that the command gets the data on stdin and its
+// output is returned as MAC.
+func TestCommandSigner(t *testing.T) {
+	signer, err := NewCommandSigner("cat")
+	require.NoError(t, err)
+
+	mac, err := signer.MAC(context.Background(), []byte("data"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), mac)
+
+	signer, err = NewCommandSigner("false")
+	require.NoError(t, err)
+	_, err = signer.MAC(context.Background(), []byte("data"))
+	require.Error(t, err)
+}
@@ -0,0 +1,108 @@
+package aperture
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/lightninglabs/aperture/kms"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	// kmsSecretsPrefix is the key we'll use to prefix the markers of all
+	// LSAT identifiers whose secrets are derived through a KMS.
+	kmsSecretsPrefix = "kmssecrets"
+)
+
+// kmsIDKey returns the key of the marker of an LSAT identifier whose secret is
+// derived through a KMS.
+//
+// The resulting path of the identifier bff4ee83 within etcd would look like:
+//
+//	lsat/proxy/kmssecrets/bff4ee83
+func kmsIDKey(id [sha256.Size]byte) string {
+	return strings.Join(
+		[]string{topLevelKey, kmsSecretsPrefix, hex.EncodeToString(id[:])},
+		etcdKeyDelimeter,
+	)
+}
+
+// kmsSecretStore is a store of LSAT secrets that never stores the secrets
+// themselves. Each secret is derived from the identifier through a root key in
+// a KMS or HSM instead, so neither etcd nor a backup of it contains anything
+// that could be used to forge tokens. Only an empty marker is stored in etcd
+// per identifier, so secrets can still be revoked and unknown identifiers are
+// rejected without asking the KMS.
+type kmsSecretStore struct {
+	*clientv3.Client
+
+	signer kms.Signer
+}
+
+// A compile-time constraint to ensure kmsSecretStore implements
+// mint.SecretStore.
+var _ mint.SecretStore = (*kmsSecretStore)(nil)
+
+// newKMSSecretStore instantiates a new LSAT secrets store that derives the
+// secrets with the given signer.
+func newKMSSecretStore(client *clientv3.Client,
+	signer kms.Signer) *kmsSecretStore {
+
+	return &kmsSecretStore{Client: client, signer: signer}
+}
+
+// NewSecret derives the secret of the given hash and marks it as valid.
+func (s *kmsSecretStore) NewSecret(ctx context.Context,
+	id [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
+
+	secret, err := s.deriveSecret(ctx, id)
+	if err != nil {
+		return secret, err
+	}
+
+	_, err = s.Put(ctx, kmsIDKey(id), "")
+	return secret, err
+}
+
+// GetSecret derives the secret of the given hash if it was created and not
+// revoked. If there is no secret, then mint.ErrSecretNotFound is returned.
+func (s *kmsSecretStore) GetSecret(ctx context.Context,
+	id [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
+
+	resp, err := s.Get(ctx, kmsIDKey(id), clientv3.WithCountOnly())
+	if err != nil {
+		return [lsat.SecretSize]byte{}, err
+	}
+	if resp.Count == 0 {
+		return [lsat.SecretSize]byte{}, mint.ErrSecretNotFound
+	}
+
+	return s.deriveSecret(ctx, id)
+}
+
+// RevokeSecret removes the marker of the given hash, so its secret is no
+// longer derived. This acts as a NOP if the secret does not exist.
+func (s *kmsSecretStore) RevokeSecret(ctx context.Context,
+	id [sha256.Size]byte) error {
+
+	_, err := s.Delete(ctx, kmsIDKey(id))
+	return err
+}
+
+// deriveSecret derives the secret of the given hash from the root key. The code
+// returned by the KMS is hashed, so the secret has the right size no matter
+// which MAC algorithm the key uses.
+func (s *kmsSecretStore) deriveSecret(ctx context.Context,
+	id [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
+
+	mac, err := s.signer.MAC(ctx, id[:])
+	if err != nil {
+		return [lsat.SecretSize]byte{}, err
+	}
+
+	return sha256.Sum256(mac), nil
+}
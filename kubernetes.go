@@ -0,0 +1,604 @@
+package aperture
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// kubernetesServiceAnnotation is the annotation of the Kubernetes
+	// services aperture serves. Its value is the YAML configuration of
+	// the aperture service, in the same format as the config file.
+	kubernetesServiceAnnotation = "aperture.lightninglabs.com/service"
+
+	// kubernetesPortAnnotation is the annotation that selects the port of
+	// a Kubernetes service requests are forwarded to, by name or number.
+	// Without it, the first port is used.
+	kubernetesPortAnnotation = "aperture.lightninglabs.com/port"
+
+	// kubernetesServiceNameLabel is the label of endpoint slices that
+	// tells the service they belong to.
+	kubernetesServiceNameLabel = "kubernetes.io/service-name"
+
+	// kubernetesAddressPrefix is the prefix of the addresses of the
+	// services created for Kubernetes services. They are never dialed,
+	// requests are sent to the endpoints of the service instead.
+	kubernetesAddressPrefix = "k8s+"
+
+	// defaultKubernetesResyncInterval is the default interval in which
+	// the services and endpoints are listed again, even if no change was
+	// watched.
+	defaultKubernetesResyncInterval = 5 * time.Minute
+
+	// kubernetesRetryDelay is the time we wait before we list the
+	// services again after listing or watching them failed.
+	kubernetesRetryDelay = 5 * time.Second
+)
+
+var (
+	// kubernetesServiceAccountDir is the directory the credentials of the
+	// service account of a pod are mounted to.
+	kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/" +
+		"serviceaccount"
+)
+
+// KubernetesConfig holds the options of the discovery of backends from the
+// annotated services of a Kubernetes cluster.
+type KubernetesConfig struct {
+	// Enabled can be set to serve the annotated services of the namespace
+	// and forward their requests to their ready endpoints.
+	Enabled bool `long:"enabled" description:"Serve the Kubernetes services with the aperture.lightninglabs.com/service annotation and forward their requests to their ready endpoints."`
+
+	// Namespace is the namespace whose services are watched. It defaults
+	// to the namespace of the pod aperture runs in.
+	Namespace string `long:"namespace" description:"The namespace whose services are watched (default: the namespace of the pod)."`
+
+	// APIServer is the URL of the Kubernetes API server. It defaults to
+	// the one that is reachable from within the cluster.
+	APIServer string `long:"apiserver" description:"The URL of the Kubernetes API server (default: the in-cluster API server)."`
+
+	// TokenFile is the file the bearer token for the API server is read
+	// from before each request, so rotated tokens are picked up.
+	TokenFile string `long:"tokenfile" description:"The file of the bearer token for the API server (default: the token of the service account)."`
+
+	// CAFile is the file of the certificate authority the certificate of
+	// the API server is verified with.
+	CAFile string `long:"cafile" description:"The CA certificate the API server is verified with (default: the CA of the service account)."`
+
+	// ResyncInterval is the interval in which everything is listed again,
+	// even if no change was watched.
+	ResyncInterval time.Duration `long:"resyncinterval" description:"List the services and endpoints again after this time, even if no change was watched (default 5m)."`
+}
+
+// kubernetesObjectMeta is the metadata of a Kubernetes object.
+type kubernetesObjectMeta struct {
+	Name        string            `json:"name"`
+	Annotations map[string]string `json:"annotations"`
+	Labels      map[string]string `json:"labels"`
+}
+
+// kubernetesPort is a port of a service or endpoint slice.
+type kubernetesPort struct {
+	Name string `json:"name"`
+	Port int    `json:"port"`
+}
+
+// kubernetesList is a list of Kubernetes objects.
+type kubernetesList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+}
+
+// kubernetesServiceList is the list of the services of a namespace.
+type kubernetesServiceList struct {
+	kubernetesList
+
+	Items []struct {
+		Metadata kubernetesObjectMeta `json:"metadata"`
+		Spec     struct {
+			Ports []kubernetesPort `json:"ports"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// kubernetesEndpointSliceList is the list of the endpoint slices of a
+// namespace.
+type kubernetesEndpointSliceList struct {
+	kubernetesList
+
+	Items []kubernetesEndpointSlice `json:"items"`
+}
+
+// kubernetesEndpointSlice is a part of the endpoints of a service.
+type kubernetesEndpointSlice struct {
+	Metadata    kubernetesObjectMeta `json:"metadata"`
+	AddressType string               `json:"addressType"`
+	Endpoints   []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []kubernetesPort `json:"ports"`
+}
+
+// kubernetesClient is a minimal client of the Kubernetes API that lists and
+// watches the objects of a namespace.
+type kubernetesClient struct {
+	baseURL   string
+	namespace string
+	tokenFile string
+	client    *http.Client
+}
+
+// newKubernetesClient creates a client with the given options, using the
+// in-cluster defaults for those that aren't set.
+func newKubernetesClient(cfg *KubernetesConfig) (*kubernetesClient, error) {
+	c := &kubernetesClient{
+		baseURL:   cfg.APIServer,
+		namespace: cfg.Namespace,
+		tokenFile: cfg.TokenFile,
+	}
+
+	if c.baseURL == "" {
+		host := os.Getenv("KUBERNETES_SERVICE_HOST")
+		port := os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("not running in a Kubernetes " +
+				"cluster and no API server set")
+		}
+		c.baseURL = "https://" + net.JoinHostPort(host, port)
+	}
+	c.baseURL = strings.TrimSuffix(c.baseURL, "/")
+
+	if c.tokenFile == "" {
+		c.tokenFile = filepath.Join(
+			kubernetesServiceAccountDir, "token",
+		)
+	}
+
+	if c.namespace == "" {
+		namespace, err := ioutil.ReadFile(filepath.Join(
+			kubernetesServiceAccountDir, "namespace",
+		))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read namespace: %v",
+				err)
+		}
+		c.namespace = strings.TrimSpace(string(namespace))
+	}
+
+	caFile := cfg.CAFile
+	if caFile == "" && cfg.APIServer == "" {
+		caFile = filepath.Join(kubernetesServiceAccountDir, "ca.crt")
+	}
+	tlsConfig := &tls.Config{}
+	if caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA "+
+				"certificate: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("invalid CA certificate %s",
+				caFile)
+		}
+	}
+	c.client = &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+
+	return c, nil
+}
+
+// request sends a GET request for the given resource of the namespace.
+func (c *kubernetesClient) request(ctx context.Context, resource string,
+	query url.Values) (*http.Response, error) {
+
+	path := "/api/v1/namespaces/" + c.namespace + "/" + resource
+	if resource == "endpointslices" {
+		path = "/apis/discovery.k8s.io/v1/namespaces/" + c.namespace +
+			"/" + resource
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, c.baseURL+path+"?"+query.Encode(), nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := ioutil.ReadFile(c.tokenFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to read token: %v", err)
+	}
+	if len(token) > 0 {
+		req.Header.Set(
+			"Authorization",
+			"Bearer "+strings.TrimSpace(string(token)),
+		)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unable to get %s: %s: %s", resource,
+			resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return resp, nil
+}
+
+// list lists the objects of the resource into the given list.
+func (c *kubernetesClient) list(ctx context.Context, resource string,
+	list interface{}) error {
+
+	resp, err := c.request(ctx, resource, url.Values{})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(list)
+}
+
+// watch watches the objects of the resource from the given resource version
+// and returns once one of them changed or the API server ended the watch.
+func (c *kubernetesClient) watch(ctx context.Context, resource,
+	resourceVersion string, timeout time.Duration) error {
+
+	resp, err := c.request(ctx, resource, url.Values{
+		"watch":           {"1"},
+		"resourceVersion": {resourceVersion},
+		"timeoutSeconds":  {strconv.Itoa(int(timeout.Seconds()))},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var event struct {
+		Type   string          `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&event)
+	switch {
+	// The watch timed out without a change.
+	case err == io.EOF:
+		return nil
+
+	case err != nil:
+		return err
+
+	// The resource version is too old to watch from, for example.
+	case event.Type == "ERROR":
+		return fmt.Errorf("unable to watch %s: %s", resource,
+			event.Object)
+	}
+
+	return nil
+}
+
+// kubernetesBackend is a Kubernetes service that is served as an aperture
+// service.
+type kubernetesBackend struct {
+	// config is the annotations the service was created from. The service
+	// is only created again if they change.
+	config string
+
+	service *proxy.Service
+}
+
+// kubernetesWatcher watches the annotated services of a namespace and their
+// endpoint slices and keeps the aperture services created for them and their
+// endpoints up to date.
+type kubernetesWatcher struct {
+	client         *kubernetesClient
+	resyncInterval time.Duration
+	apply          func([]*proxy.Service) error
+
+	backends map[string]*kubernetesBackend
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newKubernetesWatcher creates a watcher with the given options that applies
+// the services it creates with the given function.
+func newKubernetesWatcher(cfg *KubernetesConfig,
+	apply func([]*proxy.Service) error) (*kubernetesWatcher, error) {
+
+	client, err := newKubernetesClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	resyncInterval := cfg.ResyncInterval
+	if resyncInterval == 0 {
+		resyncInterval = defaultKubernetesResyncInterval
+	}
+
+	return &kubernetesWatcher{
+		client:         client,
+		resyncInterval: resyncInterval,
+		apply:          apply,
+		backends:       make(map[string]*kubernetesBackend),
+		quit:           make(chan struct{}),
+	}, nil
+}
+
+// Start applies the current services and then watches them and their endpoints
+// for changes in the background.
+func (w *kubernetesWatcher) Start() error {
+	versions, err := w.sync(context.Background())
+	if err != nil {
+		return err
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		for {
+			err := w.watch(versions)
+
+			select {
+			case <-w.quit:
+				return
+			default:
+			}
+
+			if err != nil {
+				log.Errorf("Error watching Kubernetes "+
+					"services, retrying in %v: %v",
+					kubernetesRetryDelay, err)
+
+				select {
+				case <-time.After(kubernetesRetryDelay):
+				case <-w.quit:
+					return
+				}
+			}
+
+			newVersions, err := w.sync(context.Background())
+			if err != nil {
+				log.Errorf("Error syncing Kubernetes "+
+					"services: %v", err)
+				continue
+			}
+			versions = newVersions
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops watching the services.
+func (w *kubernetesWatcher) Stop() {
+	close(w.quit)
+	w.wg.Wait()
+}
+
+// watch watches the services and endpoint slices from the given resource
+// versions and returns once one of them changed or the resync interval is
+// over.
+func (w *kubernetesWatcher) watch(versions [2]string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errChan := make(chan error, 2)
+	for i, resource := range []string{"services", "endpointslices"} {
+		resource, version := resource, versions[i]
+		go func() {
+			errChan <- w.client.watch(
+				ctx, resource, version, w.resyncInterval,
+			)
+		}()
+	}
+
+	select {
+	case err := <-errChan:
+		return err
+
+	case <-w.quit:
+		return nil
+	}
+}
+
+// sync lists the services and endpoint slices and applies the services
+// created for the annotated ones. Services whose annotations didn't change
+// are kept and only their endpoints are updated, so their state, like the
+// freebie counts, isn't lost. The resource versions of both lists are
+// returned.
+func (w *kubernetesWatcher) sync(ctx context.Context) ([2]string, error) {
+	var (
+		services kubernetesServiceList
+		slices   kubernetesEndpointSliceList
+	)
+	if err := w.client.list(ctx, "services", &services); err != nil {
+		return [2]string{}, err
+	}
+	if err := w.client.list(ctx, "endpointslices", &slices); err != nil {
+		return [2]string{}, err
+	}
+	versions := [2]string{
+		services.Metadata.ResourceVersion,
+		slices.Metadata.ResourceVersion,
+	}
+
+	slicesByService := make(map[string][]kubernetesEndpointSlice)
+	for _, slice := range slices.Items {
+		name := slice.Metadata.Labels[kubernetesServiceNameLabel]
+		slicesByService[name] = append(slicesByService[name], slice)
+	}
+
+	changed := false
+	backends := make(map[string]*kubernetesBackend)
+	for _, item := range services.Items {
+		name := item.Metadata.Name
+		annotations := item.Metadata.Annotations
+		serviceConfig, ok := annotations[kubernetesServiceAnnotation]
+		if !ok {
+			continue
+		}
+
+		// The endpoint slices tell the names of the ports, so we need
+		// the name of the selected port of the service.
+		portName, err := selectKubernetesPort(
+			annotations[kubernetesPortAnnotation],
+			item.Spec.Ports,
+		)
+		if err != nil {
+			log.Errorf("Skipping Kubernetes service %s: %v", name,
+				err)
+			continue
+		}
+		addrs := readyEndpoints(slicesByService[name], portName)
+
+		config := serviceConfig + "\n" + portName
+		backend, ok := w.backends[name]
+		if ok && backend.config == config {
+			backend.service.Endpoints.Set(addrs)
+			backends[name] = backend
+			continue
+		}
+
+		service := &proxy.Service{}
+		err = yaml.UnmarshalStrict([]byte(serviceConfig), service)
+		if err != nil {
+			log.Errorf("Skipping Kubernetes service %s: invalid "+
+				"annotation %s: %v", name,
+				kubernetesServiceAnnotation, err)
+			continue
+		}
+		if service.Name == "" {
+			service.Name = name
+		}
+		service.Address = kubernetesAddressPrefix + name + "." +
+			w.client.namespace
+		service.Endpoints = proxy.NewEndpoints(addrs)
+
+		backends[name] = &kubernetesBackend{
+			config:  config,
+			service: service,
+		}
+		changed = true
+	}
+	if len(backends) != len(w.backends) {
+		changed = true
+	}
+	w.backends = backends
+
+	if !changed {
+		return versions, nil
+	}
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	serviceList := make([]*proxy.Service, 0, len(names))
+	for _, name := range names {
+		serviceList = append(serviceList, backends[name].service)
+	}
+	log.Infof("Applying %d Kubernetes services", len(serviceList))
+
+	// If the services can't be applied, we try again with the next sync.
+	if err := w.apply(serviceList); err != nil {
+		w.backends = make(map[string]*kubernetesBackend)
+		return versions, fmt.Errorf("unable to apply Kubernetes "+
+			"services: %v", err)
+	}
+
+	return versions, nil
+}
+
+// selectKubernetesPort returns the name of the port of a service that is
+// selected by the given name or number, or of its first port if none is
+// given.
+func selectKubernetesPort(selector string,
+	ports []kubernetesPort) (string, error) {
+
+	if len(ports) == 0 {
+		return "", fmt.Errorf("service has no ports")
+	}
+	if selector == "" {
+		return ports[0].Name, nil
+	}
+
+	for _, port := range ports {
+		number := strconv.Itoa(port.Port)
+		if port.Name == selector || number == selector {
+			return port.Name, nil
+		}
+	}
+
+	return "", fmt.Errorf("service has no port %s", selector)
+}
+
+// readyEndpoints returns the addresses of the ready endpoints of the given
+// endpoint slices with the port of the given name, sorted so the list only
+// changes with the endpoints.
+func readyEndpoints(slices []kubernetesEndpointSlice,
+	portName string) []string {
+
+	var addrs []string
+	for _, slice := range slices {
+		if slice.AddressType != "IPv4" && slice.AddressType != "IPv6" {
+			continue
+		}
+
+		port := 0
+		for _, slicePort := range slice.Ports {
+			if slicePort.Name == portName {
+				port = slicePort.Port
+			}
+		}
+		if port == 0 {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			ready := endpoint.Conditions.Ready
+			if ready != nil && !*ready {
+				continue
+			}
+
+			for _, addr := range endpoint.Addresses {
+				addrs = append(addrs, net.JoinHostPort(
+					addr, strconv.Itoa(port),
+				))
+			}
+		}
+	}
+	sort.Strings(addrs)
+
+	return addrs
+}
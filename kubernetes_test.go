@@ -0,0 +1,174 @@
+package aperture
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// testKubernetesAPI serves the services and endpoint slices of a namespace
+// like the Kubernetes API server.
+type testKubernetesAPI struct {
+	mtx      sync.Mutex
+	services string
+	slices   string
+}
+
+// ServeHTTP serves the lists of the namespace "ns". Watches end right away
+// with a change.
+func (a *testKubernetesAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var items string
+	switch r.URL.Path {
+	case "/api/v1/namespaces/ns/services":
+		items = a.services
+
+	case "/apis/discovery.k8s.io/v1/namespaces/ns/endpointslices":
+		items = a.slices
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.URL.Query().Get("watch") == "1" {
+		fmt.Fprint(w, `{"type":"MODIFIED","object":{}}`)
+		return
+	}
+	fmt.Fprintf(w, `{"metadata":{"resourceVersion":"1"},"items":[%s]}`,
+		items)
+}
+
+// set replaces the services and endpoint slices.
+func (a *testKubernetesAPI) set(services, slices string) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	a.services, a.slices = services, slices
+}
+
+// kubernetesService returns a service with the given annotations.
+func kubernetesService(name string, annotations map[string]string) string {
+	annotationsJSON, _ := json.Marshal(annotations)
+	return fmt.Sprintf(`{"metadata":{"name":%q,"annotations":%s},`+
+		`"spec":{"ports":[{"name":"grpc","port":10009},`+
+		`{"name":"http","port":80}]}}`, name, annotationsJSON)
+}
+
+// kubernetesSlice returns an endpoint slice of the given service with a ready
+// and a terminating endpoint.
+func kubernetesSlice(service, readyIP string) string {
+	return fmt.Sprintf(`{"metadata":{"labels":{%q:%q}},`+
+		`"addressType":"IPv4","ports":[{"name":"http","port":8080}],`+
+		`"endpoints":[{"addresses":[%q],"conditions":{"ready":true}},`+
+		`{"addresses":["10.0.0.99"],"conditions":{"ready":false}}]}`,
+		kubernetesServiceNameLabel, service, readyIP)
+}
+
+// TestKubernetesWatcher tests that the annotated Kubernetes services are
+// applied as services and their ready endpoints are kept up to date.
+func TestKubernetesWatcher(t *testing.T) {
+	api := &testKubernetesAPI{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	tokenFile, err := ioutil.TempFile("", "token")
+	require.NoError(t, err)
+	defer os.Remove(tokenFile.Name())
+	_, err = tokenFile.WriteString("token\n")
+	require.NoError(t, err)
+	require.NoError(t, tokenFile.Close())
+
+	annotations := map[string]string{
+		kubernetesServiceAnnotation: "pathregexp: '^/api/.*$'\n" +
+			"price: 5",
+		kubernetesPortAnnotation: "http",
+	}
+	api.set(
+		kubernetesService("api", annotations)+","+
+			kubernetesService("other", nil),
+		kubernetesSlice("api", "10.0.0.1")+","+
+			kubernetesSlice("other", "10.0.0.2"),
+	)
+
+	var (
+		applyMtx sync.Mutex
+		applied  [][]*proxy.Service
+	)
+	watcher, err := newKubernetesWatcher(&KubernetesConfig{
+		Namespace:      "ns",
+		APIServer:      server.URL,
+		TokenFile:      tokenFile.Name(),
+		ResyncInterval: time.Second,
+	}, func(services []*proxy.Service) error {
+		applyMtx.Lock()
+		defer applyMtx.Unlock()
+
+		applied = append(applied, services)
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, watcher.Start())
+	defer watcher.Stop()
+
+	lastApplied := func() []*proxy.Service {
+		applyMtx.Lock()
+		defer applyMtx.Unlock()
+
+		return applied[len(applied)-1]
+	}
+
+	// Only the annotated service is served, at its ready endpoints.
+	services := lastApplied()
+	require.Len(t, services, 1)
+	service := services[0]
+	require.Equal(t, "api", service.Name)
+	require.Equal(t, "^/api/.*$", service.PathRegexp)
+	require.EqualValues(t, 5, service.Price)
+	require.Equal(t, "k8s+api.ns", service.Address)
+	require.Equal(
+		t, []string{"10.0.0.1:8080"}, service.Endpoints.Addresses(),
+	)
+
+	// A change of the endpoints only updates the endpoints of the service
+	// that was already applied.
+	api.set(
+		kubernetesService("api", annotations),
+		kubernetesSlice("api", "10.0.0.3"),
+	)
+	require.Eventually(t, func() bool {
+		addrs := service.Endpoints.Addresses()
+		return len(addrs) == 1 && addrs[0] == "10.0.0.3:8080"
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Same(t, service, lastApplied()[0])
+
+	// A change of the annotations creates the service again.
+	annotations[kubernetesPortAnnotation] = "grpc"
+	api.set(kubernetesService("api", annotations), "")
+	require.Eventually(t, func() bool {
+		return lastApplied()[0] != service
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Empty(t, lastApplied()[0].Endpoints.Addresses())
+
+	// Services without the annotation are removed.
+	api.set(kubernetesService("api", nil), "")
+	require.Eventually(t, func() bool {
+		return len(lastApplied()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,239 @@
+package aperture
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+const (
+	// leaderDir is the directory we'll use for the leader election of all
+	// aperture instances that share the same etcd cluster.
+	leaderDir = "leader"
+
+	// defaultLeaderTTL is the default time after which the leadership of
+	// an instance that stopped refreshing its etcd session expires.
+	defaultLeaderTTL = 10 * time.Second
+
+	// leaderRetryDelay is the time we wait before we try to join the
+	// election again after an etcd error.
+	leaderRetryDelay = 5 * time.Second
+
+	// leaderResignTimeout is the maximum time we wait for etcd when giving
+	// up the leadership on shutdown.
+	leaderResignTimeout = 5 * time.Second
+)
+
+// singletonTask is a background task that must only run on one instance at a
+// time. The task runs until its context is canceled, which happens when the
+// instance loses its leadership or shuts down.
+type singletonTask struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// leaderElector runs the singleton tasks of an instance while it is the leader
+// of all instances that share the same etcd cluster. If leader election is
+// disabled, the instance is assumed to be the only one and is always the
+// leader.
+type leaderElector struct {
+	client   *clientv3.Client
+	id       string
+	ttl      time.Duration
+	disabled bool
+
+	tasks []*singletonTask
+
+	errChan chan<- error
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newLeaderElector creates a new leader elector that campaigns under the given
+// instance ID. If client is nil, leader election is disabled. In that case
+// there is no other instance that could take over, so a failing task is
+// reported on the error channel.
+func newLeaderElector(client *clientv3.Client, id string, ttl time.Duration,
+	errChan chan<- error) *leaderElector {
+
+	if ttl == 0 {
+		ttl = defaultLeaderTTL
+	}
+
+	return &leaderElector{
+		client:   client,
+		id:       id,
+		ttl:      ttl,
+		disabled: client == nil,
+		errChan:  errChan,
+		quit:     make(chan struct{}),
+	}
+}
+
+// AddTask registers a task that is run while this instance is the leader. All
+// tasks must be added before the elector is started.
+func (l *leaderElector) AddTask(name string,
+	run func(ctx context.Context) error) {
+
+	l.tasks = append(l.tasks, &singletonTask{name: name, run: run})
+}
+
+// Start starts campaigning for the leadership in the background.
+func (l *leaderElector) Start() {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+
+		if l.disabled {
+			ctx, cancel := context.WithCancel(context.Background())
+			l.runTasks(ctx, cancel)
+			return
+		}
+
+		for {
+			err := l.campaign()
+			select {
+			case <-l.quit:
+				return
+			default:
+			}
+
+			if err != nil {
+				log.Errorf("Leader election failed, retrying "+
+					"in %v: %v", leaderRetryDelay, err)
+			}
+
+			select {
+			case <-time.After(leaderRetryDelay):
+			case <-l.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop cancels all running tasks and gives up the leadership if we hold it.
+func (l *leaderElector) Stop() {
+	close(l.quit)
+	l.wg.Wait()
+}
+
+// campaign waits until this instance is elected and runs the tasks until the
+// leadership is lost or we're shutting down.
+func (l *leaderElector) campaign() error {
+	session, err := concurrency.NewSession(
+		l.client, concurrency.WithTTL(int(l.ttl.Seconds())),
+	)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Shutting down or losing the etcd session both end our campaign and
+	// our leadership.
+	go func() {
+		select {
+		case <-l.quit:
+		case <-session.Done():
+			log.Warnf("Lost etcd session, giving up leadership")
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	election := concurrency.NewElection(session, leaderPrefix())
+	if err := election.Campaign(ctx, l.id); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	log.Infof("Instance %s was elected leader, starting singleton tasks",
+		l.id)
+	l.runTasks(ctx, cancel)
+
+	// Make sure the next leader doesn't have to wait for our session to
+	// expire.
+	resignCtx, resignCancel := context.WithTimeout(
+		context.Background(), leaderResignTimeout,
+	)
+	defer resignCancel()
+	if err := election.Resign(resignCtx); err != nil {
+		log.Errorf("Error resigning leadership: %v", err)
+	}
+
+	return nil
+}
+
+// runTasks runs all tasks until the given context is canceled. A task that
+// fails cancels all other tasks too, so the leadership can be taken over by an
+// instance that is able to run them.
+func (l *leaderElector) runTasks(ctx context.Context, cancel func()) {
+	var wg sync.WaitGroup
+	for _, task := range l.tasks {
+		task := task
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			log.Debugf("Starting singleton task %s", task.name)
+			err := task.run(ctx)
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+
+			log.Errorf("Singleton task %s failed: %v", task.name,
+				err)
+			cancel()
+
+			if l.disabled {
+				select {
+				case l.errChan <- err:
+				case <-l.quit:
+				default:
+				}
+			}
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-l.quit:
+		cancel()
+	}
+	wg.Wait()
+}
+
+// instanceID returns the ID that identifies this instance among all instances
+// that share the same etcd cluster. Unless an ID is configured, the host name
+// is used.
+func instanceID(configured string) string {
+	if configured != "" {
+		return configured
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Sprintf("unknown-%d", os.Getpid())
+	}
+	return hostname
+}
+
+// leaderPrefix returns the etcd key prefix of the leader election.
+func leaderPrefix() string {
+	return strings.Join([]string{topLevelKey, leaderDir}, etcdKeyDelimeter)
+}
@@ -0,0 +1,87 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestLeaderElection makes sure only one of two instances runs the singleton
+// tasks and that the other instance takes over once the leader stops.
+func TestLeaderElection(t *testing.T) {
+	client, cleanup := etcdSetup(t)
+	defer cleanup()
+
+	// Each instance signals when its task starts and stops.
+	newInstance := func(id string) (*leaderElector, chan bool) {
+		running := make(chan bool, 2)
+		elector := newLeaderElector(client, id, time.Second, nil)
+		elector.AddTask("test", func(ctx context.Context) error {
+			running <- true
+			<-ctx.Done()
+			running <- false
+			return nil
+		})
+		return elector, running
+	}
+	assertRunning := func(running chan bool, expected bool) {
+		t.Helper()
+
+		select {
+		case state := <-running:
+			if state != expected {
+				t.Fatalf("expected task running state %v, got %v",
+					expected, state)
+			}
+
+		case <-time.After(5 * time.Second):
+			t.Fatalf("task running state didn't change to %v",
+				expected)
+		}
+	}
+
+	first, firstRunning := newInstance("first")
+	first.Start()
+	assertRunning(firstRunning, true)
+
+	// The second instance must not run its task while the first one is
+	// the leader.
+	second, secondRunning := newInstance("second")
+	second.Start()
+	defer second.Stop()
+	select {
+	case <-secondRunning:
+		t.Fatalf("task of second instance started while first " +
+			"instance is leader")
+
+	case <-time.After(time.Second):
+	}
+
+	// Once the first instance stops, it gives up the leadership and the
+	// second instance takes over.
+	first.Stop()
+	assertRunning(firstRunning, false)
+	assertRunning(secondRunning, true)
+}
+
+// TestLeaderElectionDisabled makes sure the tasks are run right away if leader
+// election is disabled and that a failing task is reported.
+func TestLeaderElectionDisabled(t *testing.T) {
+	errChan := make(chan error, 1)
+	elector := newLeaderElector(nil, "single", 0, errChan)
+	elector.AddTask("failing", func(ctx context.Context) error {
+		return context.DeadlineExceeded
+	})
+	elector.Start()
+	defer elector.Stop()
+
+	select {
+	case err := <-errChan:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatalf("task error wasn't reported")
+	}
+}
@@ -0,0 +1,498 @@
+package aperture
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	flags "github.com/jessevdk/go-flags"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/zpay32"
+)
+
+const (
+	// loadTestCommand is the name of the command that runs a load test
+	// against an aperture instance instead of starting one.
+	loadTestCommand = "loadtest"
+
+	// stageUnauthenticated is the load test stage that sends requests
+	// without a token, which are answered with a payment challenge.
+	stageUnauthenticated = "unauthenticated"
+
+	// stageFreebie is the load test stage that sends requests to a
+	// service with freebies without a token.
+	stageFreebie = "freebie"
+
+	// stageLSAT is the load test stage that pays for one token per client
+	// and sends all requests of the client with it.
+	stageLSAT = "lsat"
+
+	// loadTestMaxCost is the maximum price in satoshis the clients of a
+	// load test pay for a token.
+	loadTestMaxCost btcutil.Amount = 1000000
+)
+
+var (
+	// defaultLoadTestStages are the stages that are run if none are
+	// given.
+	defaultLoadTestStages = []string{
+		stageUnauthenticated, stageFreebie, stageLSAT,
+	}
+)
+
+// loadTestConfig holds the options of the load test command.
+type loadTestConfig struct {
+	Target             string        `long:"target" description:"The base URL of the aperture instance to test, like https://localhost:8081. It must run in dev mode for the LSAT stage." required:"true"`
+	Path               string        `long:"path" description:"The path of the requests of the unauthenticated and LSAT stages. It must belong to a service with authentication." default:"/"`
+	FreebiePath        string        `long:"freebiepath" description:"The path of the requests of the freebie stage. It must belong to a service with freebies, the stage is skipped if empty."`
+	ClientIPHeader     string        `long:"clientipheader" description:"Send a random client IP in this header with every freebie request, for targets that trust it to tell clients apart."`
+	Stages             []string      `long:"stage" description:"A stage to run, can be given multiple times. All stages are run if none is given." choice:"unauthenticated" choice:"freebie" choice:"lsat"`
+	Concurrency        int           `long:"concurrency" description:"The number of concurrent clients of each stage." default:"10"`
+	Requests           int64         `long:"requests" description:"The number of requests of each stage. If zero, each stage runs for the whole duration." default:"1000"`
+	Duration           time.Duration `long:"duration" description:"The maximum duration of each stage." default:"30s"`
+	Timeout            time.Duration `long:"timeout" description:"The timeout of each request." default:"10s"`
+	InsecureSkipVerify bool          `long:"insecureskipverify" description:"Don't verify the TLS certificate of the target, for example if it's self-signed."`
+}
+
+// stageResult holds the measurements of one load test stage.
+type stageResult struct {
+	name      string
+	duration  time.Duration
+	latencies []time.Duration
+	statuses  map[int]int
+	errors    int
+
+	mu sync.Mutex
+}
+
+// newStageResult creates a new, empty result of the stage with the given name.
+func newStageResult(name string) *stageResult {
+	return &stageResult{
+		name:     name,
+		statuses: make(map[int]int),
+	}
+}
+
+// record adds the outcome of a request to the result.
+func (r *stageResult) record(latency time.Duration, status int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.errors++
+		return
+	}
+
+	r.latencies = append(r.latencies, latency)
+	r.statuses[status]++
+}
+
+// sortLatencies sorts the recorded latencies, which is required before their
+// percentiles can be calculated.
+func (r *stageResult) sortLatencies() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sort.Slice(r.latencies, func(i, j int) bool {
+		return r.latencies[i] < r.latencies[j]
+	})
+}
+
+// percentile returns the latency that the given fraction of the successful
+// requests didn't exceed.
+func (r *stageResult) percentile(fraction float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+
+	i := int(math.Ceil(fraction*float64(len(r.latencies)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return r.latencies[i]
+}
+
+// statusSummary returns the number of responses of each status code.
+func (r *stageResult) statusSummary() string {
+	codes := make([]int, 0, len(r.statuses))
+	for code := range r.statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	summary := make([]string, 0, len(codes))
+	for _, code := range codes {
+		summary = append(
+			summary, fmt.Sprintf("%d:%d", code, r.statuses[code]),
+		)
+	}
+	return strings.Join(summary, " ")
+}
+
+// loadTest drives the traffic of the load test against the target.
+type loadTest struct {
+	cfg *loadTestConfig
+
+	// transport is the transport all clients send their requests with.
+	transport *http.Transport
+}
+
+// runLoadTest parses the options of the load test command from the given
+// arguments, runs all stages and writes a report of their latencies to the
+// given writer.
+func runLoadTest(args []string, out io.Writer) error {
+	cfg := &loadTestConfig{}
+	if _, err := flags.ParseArgs(cfg, args); err != nil {
+		return fmt.Errorf("unable to parse load test options: %w", err)
+	}
+	if cfg.Concurrency <= 0 {
+		return fmt.Errorf("concurrency must be positive")
+	}
+	if cfg.Requests <= 0 && cfg.Duration <= 0 {
+		return fmt.Errorf("either requests or duration must be " +
+			"positive")
+	}
+
+	stages := cfg.Stages
+	if len(stages) == 0 {
+		stages = defaultLoadTestStages
+	}
+
+	l := newLoadTest(cfg)
+	var results []*stageResult
+	for _, stage := range stages {
+		switch stage {
+		case stageUnauthenticated:
+			results = append(results, l.runUnauthenticated())
+
+		case stageFreebie:
+			if cfg.FreebiePath == "" {
+				log.Infof("Skipping freebie stage, no " +
+					"freebie path given")
+				continue
+			}
+			results = append(results, l.runFreebie())
+
+		case stageLSAT:
+			results = append(results, l.runLSAT()...)
+		}
+	}
+
+	return writeLoadTestReport(out, results)
+}
+
+// newLoadTest creates a new load test with the given options.
+func newLoadTest(cfg *loadTestConfig) *loadTest {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = cfg.Concurrency
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify, // nolint:gosec
+	}
+
+	return &loadTest{
+		cfg:       cfg,
+		transport: transport,
+	}
+}
+
+// runUnauthenticated runs the stage that sends requests without a token.
+func (l *loadTest) runUnauthenticated() *stageResult {
+	client := &http.Client{Transport: l.transport, Timeout: l.cfg.Timeout}
+
+	return l.runStage(stageUnauthenticated, func() func(*stageResult) {
+		return func(result *stageResult) {
+			l.measure(result, client, l.cfg.Path, nil)
+		}
+	})
+}
+
+// runFreebie runs the stage that sends requests to a service with freebies,
+// optionally from a random client IP each.
+func (l *loadTest) runFreebie() *stageResult {
+	client := &http.Client{Transport: l.transport, Timeout: l.cfg.Timeout}
+
+	return l.runStage(stageFreebie, func() func(*stageResult) {
+		return func(result *stageResult) {
+			l.measure(
+				result, client, l.cfg.FreebiePath,
+				l.randomClientIP,
+			)
+		}
+	})
+}
+
+// runLSAT runs the stage in which every client first pays for a token and
+// then sends all of its other requests with it. The requests that paid for the
+// tokens are reported separately, but count towards the requests of the stage.
+func (l *loadTest) runLSAT() []*stageResult {
+	payments := newStageResult(stageLSAT + " payment")
+
+	result := l.runStage(stageLSAT, func() func(*stageResult) {
+		client := &http.Client{
+			Transport: lsat.NewTransportWithPayFunc(
+				l.transport, l.pay, devChainParams,
+				&loadTestTokenStore{}, loadTestMaxCost, 0,
+			),
+			Timeout: l.cfg.Timeout,
+		}
+
+		paid := false
+		return func(result *stageResult) {
+			if paid {
+				l.measure(result, client, l.cfg.Path, nil)
+				return
+			}
+
+			// The first request of the client pays for its token.
+			// It's retried until the payment succeeds.
+			paid = l.measure(payments, client, l.cfg.Path, nil)
+		}
+	})
+	payments.sortLatencies()
+
+	return []*stageResult{payments, result}
+}
+
+// runStage runs a stage with the configured number of concurrent clients until
+// the configured number of requests was sent or the duration is up. Every
+// client sends each of its requests with the function newClient creates for
+// it, which records the outcome in the given result.
+func (l *loadTest) runStage(name string,
+	newClient func() func(*stageResult)) *stageResult {
+
+	log.Infof("Running load test stage %s", name)
+
+	ctx := context.Background()
+	if l.cfg.Duration > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, l.cfg.Duration)
+		defer cancel()
+	}
+
+	result := newStageResult(name)
+	var (
+		sent  int64
+		wg    sync.WaitGroup
+		start = time.Now()
+	)
+	for i := 0; i < l.cfg.Concurrency; i++ {
+		send := newClient()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for ctx.Err() == nil {
+				n := atomic.AddInt64(&sent, 1)
+				if l.cfg.Requests > 0 && n > l.cfg.Requests {
+					return
+				}
+
+				send(result)
+			}
+		}()
+	}
+	wg.Wait()
+
+	result.duration = time.Since(start)
+	result.sortLatencies()
+	return result
+}
+
+// measure sends a GET request for the given path of the target with the
+// client and records its latency and status code in the result. True is
+// returned if a response was received.
+func (l *loadTest) measure(result *stageResult, client *http.Client,
+	path string, prepare func(*http.Request)) bool {
+
+	start := time.Now()
+	status, err := l.send(client, path, prepare)
+	result.record(time.Since(start), status, err)
+
+	return err == nil
+}
+
+// send sends a GET request for the given path of the target with the client
+// and returns the status code of the response.
+func (l *loadTest) send(client *http.Client, path string,
+	prepare func(*http.Request)) (int, error) {
+
+	req, err := http.NewRequest(
+		http.MethodGet, strings.TrimSuffix(l.cfg.Target, "/")+path, nil,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if prepare != nil {
+		prepare(req)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+// randomClientIP sets a random client IP in the configured header of the
+// request.
+func (l *loadTest) randomClientIP(req *http.Request) {
+	if l.cfg.ClientIPHeader == "" {
+		return
+	}
+
+	// nolint:gosec
+	ip := fmt.Sprintf(
+		"10.%d.%d.%d", rand.Intn(256), rand.Intn(256), rand.Intn(256),
+	)
+	req.Header.Set(l.cfg.ClientIPHeader, ip)
+}
+
+// pay pays the invoice of a payment challenge through the settle endpoint of
+// the dev mode of the target and returns its preimage.
+func (l *loadTest) pay(ctx context.Context, invoice string,
+	_ btcutil.Amount) (*lsat.PaymentResult, error) {
+
+	payReq, err := zpay32.Decode(invoice, devChainParams)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode invoice, target must "+
+			"run in dev mode: %v", err)
+	}
+	hash := lntypes.Hash(*payReq.PaymentHash)
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, strings.TrimSuffix(l.cfg.Target, "/")+
+			devSettlePathPrefix+hash.String(), nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: l.transport, Timeout: l.cfg.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to settle invoice, target must "+
+			"run in dev mode: %v", resp.Status)
+	}
+
+	var settled devSettleResponse
+	if err := json.NewDecoder(resp.Body).Decode(&settled); err != nil {
+		return nil, err
+	}
+	preimage, err := lntypes.MakePreimageFromStr(settled.Preimage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lsat.PaymentResult{Preimage: preimage}, nil
+}
+
+// writeLoadTestReport writes the request counts and latency percentiles of
+// the given stages as a table.
+func writeLoadTestReport(out io.Writer, results []*stageResult) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(
+		w, "STAGE\tREQUESTS\tERRORS\tRPS\tP50\tP90\tP99\tMAX\tSTATUS",
+	)
+	for _, r := range results {
+		requests := len(r.latencies)
+		rps := 0.0
+		if r.duration > 0 {
+			rps = float64(requests) / r.duration.Seconds()
+		}
+
+		_, _ = fmt.Fprintf(
+			w, "%s\t%d\t%d\t%.1f\t%v\t%v\t%v\t%v\t%s\n", r.name,
+			requests, r.errors, rps, r.percentile(0.5),
+			r.percentile(0.9), r.percentile(0.99),
+			r.percentile(1), r.statusSummary(),
+		)
+	}
+
+	return w.Flush()
+}
+
+// loadTestTokenStore is an in-memory LSAT token store of a load test client.
+// It holds a single current token that is either pending or paid.
+type loadTestTokenStore struct {
+	mu    sync.Mutex
+	token *lsat.Token
+}
+
+// A compile-time check to make sure loadTestTokenStore implements lsat.Store.
+var _ lsat.Store = (*loadTestTokenStore)(nil)
+
+// CurrentToken returns the current token or lsat.ErrNoToken if there is none.
+//
+// NOTE: This is part of the lsat.Store interface.
+func (s *loadTestTokenStore) CurrentToken() (*lsat.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token == nil {
+		return nil, lsat.ErrNoToken
+	}
+	return s.token, nil
+}
+
+// AllTokens returns the current token, keyed by its payment hash.
+//
+// NOTE: This is part of the lsat.Store interface.
+func (s *loadTestTokenStore) AllTokens() (map[string]*lsat.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := make(map[string]*lsat.Token)
+	if s.token != nil {
+		tokens[s.token.PaymentHash.String()] = s.token
+	}
+	return tokens, nil
+}
+
+// StoreToken replaces the current token.
+//
+// NOTE: This is part of the lsat.Store interface.
+func (s *loadTestTokenStore) StoreToken(token *lsat.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.token = token
+	return nil
+}
+
+// RemovePendingToken removes the current token if it wasn't paid yet or
+// returns lsat.ErrNoToken otherwise.
+//
+// NOTE: This is part of the lsat.Store interface.
+func (s *loadTestTokenStore) RemovePendingToken() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token == nil || s.token.Preimage != (lntypes.Preimage{}) {
+		return lsat.ErrNoToken
+	}
+
+	s.token = nil
+	return nil
+}
@@ -0,0 +1,74 @@
+package aperture
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightninglabs/aperture/proxy/interoptest"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLoadTest tests that the load test command drives the traffic of all
+// stages against aperture in dev mode and reports every stage.
+func TestLoadTest(t *testing.T) {
+	backend := interoptest.StartHTTPBackend(t, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("Hello"))
+		},
+	))
+	newService := func(name string, level auth.Level) *proxy.Service {
+		return &proxy.Service{
+			Name:       name,
+			Address:    backend,
+			Protocol:   "http",
+			HostRegexp: ".*",
+			PathRegexp: "^/" + name + "/.*$",
+			Auth:       level,
+			Price:      10,
+		}
+	}
+
+	a := NewAperture(&Config{
+		ListenAddr:      "127.0.0.1:0",
+		Insecure:        true,
+		Dev:             true,
+		DevManualSettle: true,
+		Store:           storeMemory,
+		Etcd:            &EtcdConfig{},
+		Authenticator:   &AuthConfig{},
+		HashMail:        &HashMailConfig{},
+		Services: []*proxy.Service{
+			newService("paid", "on"),
+			newService("free", "freebie 5"),
+		},
+	})
+	require.NoError(t, a.Start(make(chan error, 1)))
+	t.Cleanup(func() {
+		require.NoError(t, a.Stop())
+	})
+
+	var out bytes.Buffer
+	err := runLoadTest([]string{
+		"--target=http://" + a.Addr().String(), "--path=/paid/hello",
+		"--freebiepath=/free/hello", "--concurrency=4",
+		"--requests=40",
+	}, &out)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 5)
+	require.Regexp(t, `^unauthenticated\s+40\s+0\s.*\s402:40$`, lines[1])
+	require.Regexp(t, `^freebie\s+40\s+0\s.*\s200:\d+ 402:\d+$`, lines[2])
+	require.Regexp(t, `^lsat payment\s+4\s+0\s.*\s200:4$`, lines[3])
+	require.Regexp(t, `^lsat\s+36\s+0\s.*\s200:36$`, lines[4])
+
+	// Invalid options are rejected before any traffic is sent.
+	err = runLoadTest([]string{
+		"--target=http://" + a.Addr().String(), "--concurrency=0",
+	}, &out)
+	require.Error(t, err)
+}
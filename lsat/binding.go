@@ -0,0 +1,193 @@
+package lsat
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	// CondClientIP is the condition used for a caveat that binds an LSAT
+	// to a network prefix of the client's IP address, for example
+	// `client_ip=203.0.113.0/24`.
+	CondClientIP = "client_ip"
+
+	// CondTLSBinding is the condition used for a caveat that binds an LSAT
+	// to the TLS connection it was obtained on. Its value is the hex
+	// encoded tls-exporter channel binding of the connection as defined in
+	// RFC 9266.
+	CondTLSBinding = "tls_binding"
+
+	// CondPath is the condition used for a caveat that binds an LSAT to
+	// the URL path of the resource it was bought for, for example
+	// `path=/downloads/dataset.zip`.
+	CondPath = "path"
+
+	// tlsExporterLabel is the label of the tls-exporter channel binding.
+	tlsExporterLabel = "EXPORTER-Channel-Binding"
+
+	// tlsExporterSize is the size of the tls-exporter channel binding in
+	// bytes.
+	tlsExporterSize = 32
+)
+
+var (
+	// ErrNoTLSBinding is an error returned when the channel binding of a
+	// TLS connection is requested but can't be derived securely. This is
+	// the case for TLS versions below 1.3 without the extended master
+	// secret extension, as well as for connections without TLS at all.
+	ErrNoTLSBinding = errors.New("TLS channel binding not available")
+)
+
+// TLSBinding returns the tls-exporter channel binding of the TLS connection
+// with the given state.
+func TLSBinding(state *tls.ConnectionState) ([]byte, error) {
+	if state == nil || !state.HandshakeComplete {
+		return nil, ErrNoTLSBinding
+	}
+
+	// Before TLS 1.3, the exported keying material is only unique to the
+	// connection if the extended master secret extension was negotiated.
+	// The standard library refuses to export it otherwise, which is what
+	// we want.
+	binding, err := state.ExportKeyingMaterial(
+		tlsExporterLabel, nil, tlsExporterSize,
+	)
+	if err != nil {
+		return nil, ErrNoTLSBinding
+	}
+
+	return binding, nil
+}
+
+// NewClientIPCaveat creates a new caveat that binds an LSAT to the network of
+// the given IP address with the given prefix length.
+func NewClientIPCaveat(ip net.IP, prefixLen int) (Caveat, error) {
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 8 * net.IPv4len
+	}
+	if ip == nil || prefixLen < 0 || prefixLen > bits {
+		return Caveat{}, fmt.Errorf("invalid client IP %v/%d", ip,
+			prefixLen)
+	}
+
+	network := &net.IPNet{
+		IP:   ip.Mask(net.CIDRMask(prefixLen, bits)),
+		Mask: net.CIDRMask(prefixLen, bits),
+	}
+	return NewCaveat(CondClientIP, network.String()), nil
+}
+
+// NewTLSBindingCaveat creates a new caveat that binds an LSAT to the TLS
+// connection with the given channel binding.
+func NewTLSBindingCaveat(binding []byte) Caveat {
+	return NewCaveat(CondTLSBinding, hex.EncodeToString(binding))
+}
+
+// NewClientIPSatisfier implements a satisfier to determine whether an LSAT is
+// used from within the network it was bound to. The IP address of the client
+// may be nil if it isn't known, in which case bound LSATs are rejected.
+func NewClientIPSatisfier(clientIP net.IP) Satisfier {
+	return Satisfier{
+		Condition: CondClientIP,
+		SatisfyPrevious: func(prev, cur Caveat) error {
+			// The current network must be contained in the previous
+			// one, otherwise a client could widen it.
+			_, prevNetwork, err := net.ParseCIDR(prev.Value)
+			if err != nil {
+				return err
+			}
+			_, curNetwork, err := net.ParseCIDR(cur.Value)
+			if err != nil {
+				return err
+			}
+
+			prevOnes, _ := prevNetwork.Mask.Size()
+			curOnes, _ := curNetwork.Mask.Size()
+			if !prevNetwork.Contains(curNetwork.IP) ||
+				curOnes < prevOnes {
+
+				return fmt.Errorf("network %v not contained "+
+					"in previous network %v", curNetwork,
+					prevNetwork)
+			}
+
+			return nil
+		},
+		SatisfyFinal: func(c Caveat) error {
+			_, network, err := net.ParseCIDR(c.Value)
+			if err != nil {
+				return err
+			}
+			if clientIP == nil || !network.Contains(clientIP) {
+				return fmt.Errorf("client IP %v not in bound "+
+					"network %v", clientIP, network)
+			}
+			return nil
+		},
+	}
+}
+
+// NewTLSBindingSatisfier implements a satisfier to determine whether an LSAT
+// is used on the TLS connection it was bound to. The channel binding may be nil
+// if the connection doesn't have one, in which case bound LSATs are rejected.
+func NewTLSBindingSatisfier(binding []byte) Satisfier {
+	return Satisfier{
+		Condition: CondTLSBinding,
+		SatisfyPrevious: func(prev, cur Caveat) error {
+			// A token can only be bound to a single connection.
+			if prev.Value != cur.Value {
+				return fmt.Errorf("TLS binding %v differs from "+
+					"previous binding %v", cur.Value,
+					prev.Value)
+			}
+			return nil
+		},
+		SatisfyFinal: func(c Caveat) error {
+			bound, err := hex.DecodeString(c.Value)
+			if err != nil {
+				return err
+			}
+			if binding == nil || !bytes.Equal(bound, binding) {
+				return fmt.Errorf("TLS channel binding " +
+					"mismatch")
+			}
+			return nil
+		},
+	}
+}
+
+// NewPathCaveat creates a new caveat that binds an LSAT to the resource at the
+// given URL path.
+func NewPathCaveat(path string) Caveat {
+	return NewCaveat(CondPath, path)
+}
+
+// NewPathSatisfier implements a satisfier to determine whether an LSAT is used
+// for the resource it was bound to.
+func NewPathSatisfier(targetPath string) Satisfier {
+	return Satisfier{
+		Condition: CondPath,
+		SatisfyPrevious: func(prev, cur Caveat) error {
+			// A token can only be bound to a single resource.
+			if prev.Value != cur.Value {
+				return fmt.Errorf("path %v differs from "+
+					"previous path %v", cur.Value,
+					prev.Value)
+			}
+			return nil
+		},
+		SatisfyFinal: func(c Caveat) error {
+			if c.Value != targetPath {
+				return fmt.Errorf("target path %v not "+
+					"authorized", targetPath)
+			}
+			return nil
+		},
+	}
+}
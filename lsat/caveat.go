@@ -3,6 +3,7 @@ package lsat
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"gopkg.in/macaroon.v2"
@@ -11,6 +12,17 @@ import (
 const (
 	// PreimageKey is the key used for a payment preimage caveat.
 	PreimageKey = "preimage"
+
+	// CondNonce is the condition used for a caveat that requires each
+	// request made with an LSAT to carry a nonce that is greater than the
+	// nonces of all previous requests, so captured requests can't be
+	// replayed. Its value is ignored.
+	CondNonce = "nonce"
+
+	// CondBatch is the condition used for a caveat of the number of LSATs
+	// that were minted together and share an invoice of their total
+	// price, so the amount paid for each of them is known.
+	CondBatch = "batch"
 )
 
 var (
@@ -38,6 +50,15 @@ func NewCaveat(condition string, value string) Caveat {
 	return Caveat{Condition: condition, Value: value}
 }
 
+// NewBatchCaveat creates a new caveat of the number of LSATs that share the
+// invoice of an LSAT.
+func NewBatchCaveat(size int) Caveat {
+	return Caveat{
+		Condition: CondBatch,
+		Value:     strconv.Itoa(size),
+	}
+}
+
 // String returns a user-friendly view of a caveat.
 func (c Caveat) String() string {
 	return EncodeCaveat(c)
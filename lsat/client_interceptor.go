@@ -9,9 +9,12 @@ import (
 	"sync"
 	"time"
 
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcutil"
+	"github.com/lightninglabs/aperture/challengerpc"
 	"github.com/lightninglabs/lndclient"
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
 	"github.com/lightningnetwork/lnd/lnwire"
 	"github.com/lightningnetwork/lnd/zpay32"
 	"google.golang.org/grpc"
@@ -23,7 +26,12 @@ import (
 const (
 	// GRPCErrCode is the error code we receive from a gRPC call if the
 	// server expects a payment.
-	GRPCErrCode = codes.Internal
+	GRPCErrCode = codes.Unauthenticated
+
+	// GRPCLegacyErrCode is the error code older servers, or servers that
+	// are configured to stay compatible with older clients, signal that a
+	// payment is required with.
+	GRPCLegacyErrCode = codes.Internal
 
 	// GRPCErrMessage is the error message we receive from a gRPC call in
 	// conjunction with the GRPCErrCode to signal the client that a payment
@@ -57,7 +65,7 @@ var (
 	// authHeaderRegex is the regular expression the payment challenge must
 	// match for us to be able to parse the macaroon and invoice.
 	authHeaderRegex = regexp.MustCompile(
-		"LSAT macaroon=\"(.*?)\", invoice=\"(.*?)\"",
+		"(?:LSAT|L402) macaroon=\"(.*?)\", invoice=\"(.*?)\"",
 	)
 
 	// errPaymentFailedTerminally is signaled by the payment tracking method
@@ -67,11 +75,58 @@ var (
 		"failure state")
 )
 
+// PaymentResult is the outcome of a successful payment of an LSAT invoice.
+type PaymentResult struct {
+	// Preimage is the preimage of the paid invoice.
+	Preimage lntypes.Preimage
+
+	// AmountPaid is the amount that was paid, not including routing fees.
+	AmountPaid lnwire.MilliSatoshi
+
+	// RoutingFeePaid is the amount that was paid in routing fees.
+	RoutingFeePaid lnwire.MilliSatoshi
+}
+
+// PayFunc is a function that pays the given BOLT11 invoice, spending at most
+// maxFee in routing fees. It must block until the payment either succeeded or
+// failed, or the context is canceled.
+type PayFunc func(ctx context.Context, invoice string,
+	maxFee btcutil.Amount) (*PaymentResult, error)
+
+// LndPayFunc returns a PayFunc that pays invoices through the given lnd node.
+func LndPayFunc(lnd *lndclient.LndServices) PayFunc {
+	return func(ctx context.Context, invoice string,
+		maxFee btcutil.Amount) (*PaymentResult, error) {
+
+		respChan := lnd.Client.PayInvoice(ctx, invoice, maxFee, nil)
+		select {
+		case result := <-respChan:
+			if result.Err != nil {
+				return nil, result.Err
+			}
+			return &PaymentResult{
+				Preimage: result.Preimage,
+				AmountPaid: lnwire.NewMSatFromSatoshis(
+					result.PaidAmt,
+				),
+				RoutingFeePaid: lnwire.NewMSatFromSatoshis(
+					result.PaidFee,
+				),
+			}, nil
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
 // ClientInterceptor is a gRPC client interceptor that can handle LSAT
 // authentication challenges with embedded payment requests. It uses a
 // connection to lnd to automatically pay for an authentication token.
 type ClientInterceptor struct {
 	lnd           *lndclient.LndServices
+	payFunc       PayFunc
+	chainParams   *chaincfg.Params
 	store         Store
 	callTimeout   time.Duration
 	maxCost       btcutil.Amount
@@ -89,6 +144,33 @@ func NewInterceptor(lnd *lndclient.LndServices, store Store,
 
 	return &ClientInterceptor{
 		lnd:           lnd,
+		payFunc:       LndPayFunc(lnd),
+		chainParams:   lnd.ChainParams,
+		store:         store,
+		callTimeout:   rpcCallTimeout,
+		maxCost:       maxCost,
+		maxFee:        maxFee,
+		allowInsecure: allowInsecure,
+	}
+}
+
+// NewInterceptorWithPayFunc creates a new gRPC client interceptor that uses the
+// provided payment function to pay for LSAT tokens, unless the indicated store
+// already contains a usable token. This allows the interceptor to be used with
+// any kind of Lightning wallet. The chain parameters are used to decode the
+// invoices of the payment challenges.
+//
+// NOTE: Because the payment function has no way of looking up the state of a
+// previous payment, a pending token that is left in the store after an
+// interrupted payment can't be resumed automatically and needs to be removed
+// manually.
+func NewInterceptorWithPayFunc(payFunc PayFunc, chainParams *chaincfg.Params,
+	store Store, rpcCallTimeout time.Duration, maxCost,
+	maxFee btcutil.Amount, allowInsecure bool) *ClientInterceptor {
+
+	return &ClientInterceptor{
+		payFunc:       payFunc,
+		chainParams:   chainParams,
 		store:         store,
 		callTimeout:   rpcCallTimeout,
 		maxCost:       maxCost,
@@ -100,10 +182,11 @@ func NewInterceptor(lnd *lndclient.LndServices, store Store,
 // interceptContext is a struct that contains all information about a call that
 // is intercepted by the interceptor.
 type interceptContext struct {
-	mainCtx  context.Context
-	opts     []grpc.CallOption
-	metadata *metadata.MD
-	token    *Token
+	mainCtx   context.Context
+	opts      []grpc.CallOption
+	metadata  *metadata.MD
+	token     *Token
+	challenge *challengerpc.PaymentChallenge
 }
 
 // UnaryInterceptor is an interceptor method that can be used directly by gRPC
@@ -138,6 +221,7 @@ func (i *ClientInterceptor) UnaryInterceptor(ctx context.Context, method string,
 	if !isPaymentRequired(err) {
 		return err
 	}
+	iCtx.challenge = challengeFromStatus(err)
 
 	// Find out if we need to pay for a new token or perhaps resume
 	// a previously aborted payment.
@@ -186,6 +270,7 @@ func (i *ClientInterceptor) StreamInterceptor(ctx context.Context,
 	if !isPaymentRequired(err) {
 		return stream, err
 	}
+	iCtx.challenge = challengeFromStatus(err)
 
 	// Find out if we need to pay for a new token or perhaps resume
 	// a previously aborted payment.
@@ -270,9 +355,7 @@ func (i *ClientInterceptor) handlePayment(iCtx *interceptContext) error {
 			// Let's try again by paying for the new token.
 			log.Infof("Retrying payment of LSAT token invoice")
 			var err error
-			iCtx.token, err = i.payLsatToken(
-				iCtx.mainCtx, iCtx.metadata,
-			)
+			iCtx.token, err = i.payLsatToken(iCtx)
 			if err != nil {
 				return err
 			}
@@ -288,7 +371,7 @@ func (i *ClientInterceptor) handlePayment(iCtx *interceptContext) error {
 		// We don't have a token yet, get a new one.
 		log.Infof("Payment of LSAT token is required, paying invoice")
 		var err error
-		iCtx.token, err = i.payLsatToken(iCtx.mainCtx, iCtx.metadata)
+		iCtx.token, err = i.payLsatToken(iCtx)
 		if err != nil {
 			return err
 		}
@@ -321,33 +404,60 @@ func (i *ClientInterceptor) addLsatCredentials(iCtx *interceptContext) error {
 	return nil
 }
 
-// payLsatToken reads the payment challenge from the response metadata and tries
-// to pay the invoice encoded in them, returning a paid LSAT token if
-// successful.
-func (i *ClientInterceptor) payLsatToken(ctx context.Context, md *metadata.MD) (
-	*Token, error) {
+// payLsatToken reads the payment challenge from the status or the response
+// metadata of the call and tries to pay the invoice encoded in it, returning a
+// paid LSAT token if successful.
+func (i *ClientInterceptor) payLsatToken(iCtx *interceptContext) (*Token,
+	error) {
 
-	// First parse the authentication header that was stored in the
+	// Servers that attach the challenge to the status of the call spare us
+	// parsing the header.
+	if iCtx.challenge != nil {
+		return i.payInvoice(
+			iCtx.mainCtx, iCtx.challenge.Macaroon,
+			iCtx.challenge.Invoice,
+		)
+	}
+
+	// Otherwise parse the authentication header that was stored in the
 	// metadata.
-	authHeader := md.Get(AuthHeader)
+	authHeader := iCtx.metadata.Get(AuthHeader)
 	if len(authHeader) == 0 {
 		return nil, fmt.Errorf("auth header not found in response")
 	}
-	matches := authHeaderRegex.FindStringSubmatch(authHeader[0])
+
+	return i.payChallenge(iCtx.mainCtx, authHeader[0])
+}
+
+// payChallenge tries to pay the invoice encoded in the given payment challenge,
+// returning a paid LSAT token if successful.
+func (i *ClientInterceptor) payChallenge(ctx context.Context,
+	challenge string) (*Token, error) {
+
+	matches := authHeaderRegex.FindStringSubmatch(challenge)
 	if len(matches) != 3 {
 		return nil, fmt.Errorf("invalid auth header "+
-			"format: %s", authHeader[0])
+			"format: %s", challenge)
 	}
 
-	// Decode the base64 macaroon and the invoice so we can store the
-	// information in our store later.
+	// Decode the base64 macaroon so we can store it in our store later.
 	macBase64, invoiceStr := matches[1], matches[2]
 	macBytes, err := base64.StdEncoding.DecodeString(macBase64)
 	if err != nil {
 		return nil, fmt.Errorf("base64 decode of macaroon failed: "+
 			"%v", err)
 	}
-	invoice, err := zpay32.Decode(invoiceStr, i.lnd.ChainParams)
+
+	return i.payInvoice(ctx, macBytes, invoiceStr)
+}
+
+// payInvoice tries to pay the invoice of a payment challenge, returning the
+// paid LSAT token of the given macaroon if successful.
+func (i *ClientInterceptor) payInvoice(ctx context.Context, macBytes []byte,
+	invoiceStr string) (*Token, error) {
+
+	// Decode the invoice so we can store its payment hash with the token.
+	invoice, err := zpay32.Decode(invoiceStr, i.chainParams)
 	if err != nil {
 		return nil, fmt.Errorf("unable to decode invoice: %v", err)
 	}
@@ -375,34 +485,37 @@ func (i *ClientInterceptor) payLsatToken(ctx context.Context, md *metadata.MD) (
 	// being canceled.
 	payCtx, cancel := context.WithTimeout(ctx, PaymentTimeout)
 	defer cancel()
-	respChan := i.lnd.Client.PayInvoice(
-		payCtx, invoiceStr, i.maxFee, nil,
-	)
-	select {
-	case result := <-respChan:
-		if result.Err != nil {
-			return nil, result.Err
-		}
+	result, err := i.payFunc(payCtx, invoiceStr, i.maxFee)
+	switch {
+	case err == nil:
 		token.Preimage = result.Preimage
-		token.AmountPaid = lnwire.NewMSatFromSatoshis(result.PaidAmt)
-		token.RoutingFeePaid = lnwire.NewMSatFromSatoshis(
-			result.PaidFee,
-		)
+		token.AmountPaid = result.AmountPaid
+		token.RoutingFeePaid = result.RoutingFeePaid
 		return token, i.store.StoreToken(token)
 
-	case <-payCtx.Done():
+	case ctx.Err() != nil:
+		return nil, fmt.Errorf("parent context canceled. try again to"+
+			"track payment. %s", manualRetryHint)
+
+	case payCtx.Err() != nil:
 		return nil, fmt.Errorf("payment timed out. try again to track "+
 			"payment. %s", manualRetryHint)
 
-	case <-ctx.Done():
-		return nil, fmt.Errorf("parent context canceled. try again to"+
-			"track payment. %s", manualRetryHint)
+	default:
+		return nil, err
 	}
 }
 
 // trackPayment tries to resume a pending payment by tracking its state and
 // waiting for a conclusive result.
 func (i *ClientInterceptor) trackPayment(ctx context.Context, token *Token) error {
+	// Without a connection to lnd we have no way of finding out what
+	// happened to the payment.
+	if i.lnd == nil {
+		return fmt.Errorf("cannot track payment of pending token. %s",
+			manualRetryHint)
+	}
+
 	// Lookup state of the payment.
 	paymentStateCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -471,7 +584,26 @@ func isPaymentRequired(err error) bool {
 	statusErr, ok := status.FromError(err)
 	return ok &&
 		statusErr.Message() == GRPCErrMessage &&
-		statusErr.Code() == GRPCErrCode
+		(statusErr.Code() == GRPCErrCode ||
+			statusErr.Code() == GRPCLegacyErrCode)
+}
+
+// challengeFromStatus returns the payment challenge attached to the status of
+// the given gRPC error, if there is one.
+func challengeFromStatus(err error) *challengerpc.PaymentChallenge {
+	statusErr, ok := status.FromError(err)
+	if !ok {
+		return nil
+	}
+
+	for _, detail := range statusErr.Details() {
+		challenge, ok := detail.(*challengerpc.PaymentChallenge)
+		if ok {
+			return challenge
+		}
+	}
+
+	return nil
 }
 
 // extractPaymentDetails extracts the preimage and amounts paid for a payment
@@ -9,12 +9,16 @@ import (
 	"testing"
 	"time"
 
-	"github.com/lightninglabs/aperture/internal/test"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/lightninglabs/aperture/aperturetest/lndmock"
+	"github.com/lightninglabs/aperture/challengerpc"
 	"github.com/lightninglabs/lndclient"
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/lightningnetwork/lnd/lntypes"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"gopkg.in/macaroon.v2"
 )
@@ -26,8 +30,8 @@ type interceptTestCase struct {
 	resetCb             func()
 	expectLndCall       bool
 	expectSecondLndCall bool
-	sendPaymentCb       func(*testing.T, test.PaymentChannelMessage)
-	trackPaymentCb      func(*testing.T, test.TrackPaymentMessage)
+	sendPaymentCb       func(*testing.T, lndmock.PaymentChannelMessage)
+	trackPaymentCb      func(*testing.T, lndmock.TrackPaymentMessage)
 	expectToken         bool
 	expectInterceptErr  string
 	expectBackendCalls  int
@@ -61,7 +65,7 @@ func (s *mockStore) RemovePendingToken() error {
 }
 
 var (
-	lnd         = test.NewMockLnd()
+	lnd         = lndmock.NewMockLnd()
 	store       = &mockStore{}
 	testTimeout = 5 * time.Second
 	interceptor = NewInterceptor(
@@ -101,7 +105,7 @@ var (
 		},
 		expectLndCall: true,
 		sendPaymentCb: func(t *testing.T,
-			msg test.PaymentChannelMessage) {
+			msg lndmock.PaymentChannelMessage) {
 
 			require.Len(t, callMD, 0)
 
@@ -115,7 +119,7 @@ var (
 			}
 		},
 		trackPaymentCb: func(t *testing.T,
-			msg test.TrackPaymentMessage) {
+			msg lndmock.TrackPaymentMessage) {
 
 			t.Fatal("didn't expect call to trackPayment")
 		},
@@ -145,12 +149,12 @@ var (
 		},
 		expectLndCall: true,
 		sendPaymentCb: func(t *testing.T,
-			msg test.PaymentChannelMessage) {
+			msg lndmock.PaymentChannelMessage) {
 
 			t.Fatal("didn't expect call to sendPayment")
 		},
 		trackPaymentCb: func(t *testing.T,
-			msg test.TrackPaymentMessage) {
+			msg lndmock.TrackPaymentMessage) {
 
 			// The next call to the "backend" shouldn't return an
 			// error.
@@ -177,7 +181,7 @@ var (
 		expectLndCall:       true,
 		expectSecondLndCall: true,
 		sendPaymentCb: func(t *testing.T,
-			msg test.PaymentChannelMessage) {
+			msg lndmock.PaymentChannelMessage) {
 
 			require.Len(t, callMD, 0)
 
@@ -191,7 +195,7 @@ var (
 			}
 		},
 		trackPaymentCb: func(t *testing.T,
-			msg test.TrackPaymentMessage) {
+			msg lndmock.TrackPaymentMessage) {
 
 			// The next call to the "backend" shouldn't return an
 			// error.
@@ -444,3 +448,110 @@ func makeAuthHeader(macBytes []byte) string {
 	return fmt.Sprintf("LSAT macaroon=\"%s\", invoice=\"%s\"",
 		base64.StdEncoding.EncodeToString(macBytes), invoice)
 }
+
+// TestInterceptorPayFunc makes sure an interceptor that uses a custom payment
+// function pays for a new token and retries the call with it.
+func TestInterceptorPayFunc(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	var paidInvoices []string
+	payFunc := func(_ context.Context, invoice string,
+		maxFee btcutil.Amount) (*PaymentResult, error) {
+
+		require.EqualValues(t, DefaultMaxRoutingFeeSats, maxFee)
+		paidInvoices = append(paidInvoices, invoice)
+
+		return &PaymentResult{
+			Preimage:       paidPreimage,
+			AmountPaid:     500_000,
+			RoutingFeePaid: 1_000,
+		}, nil
+	}
+	payStore := &mockStore{}
+	payInterceptor := NewInterceptorWithPayFunc(
+		payFunc, &chaincfg.TestNet3Params, payStore, testTimeout,
+		DefaultMaxCostSats, DefaultMaxRoutingFeeSats, false,
+	)
+
+	numCalls := 0
+	unaryInvoker := func(_ context.Context, _ string,
+		_ interface{}, _ interface{}, _ *grpc.ClientConn,
+		opts ...grpc.CallOption) error {
+
+		numCalls++
+		for _, opt := range opts {
+			_, ok := opt.(grpc.PerRPCCredsCallOption)
+			if ok {
+				return nil
+			}
+		}
+
+		for _, opt := range opts {
+			trailer, ok := opt.(grpc.TrailerCallOption)
+			if ok {
+				trailer.TrailerAddr.Set(
+					AuthHeader, makeAuthHeader(testMacBytes),
+				)
+			}
+		}
+		return status.New(GRPCErrCode, GRPCErrMessage).Err()
+	}
+
+	err := payInterceptor.UnaryInterceptor(
+		ctx, "", nil, nil, nil, unaryInvoker,
+	)
+	require.NoError(t, err)
+	require.Equal(t, 2, numCalls)
+	require.Len(t, paidInvoices, 1)
+
+	token, err := payStore.CurrentToken()
+	require.NoError(t, err)
+	require.Equal(t, paidPreimage, token.Preimage)
+	require.EqualValues(t, 500_000, token.AmountPaid)
+	require.EqualValues(t, 1_000, token.RoutingFeePaid)
+}
+
+// TestIsPaymentRequired tests that payment challenges are recognized with both
+// the current and the legacy gRPC status code.
+func TestIsPaymentRequired(t *testing.T) {
+	require.True(t, isPaymentRequired(
+		status.New(GRPCErrCode, GRPCErrMessage).Err(),
+	))
+	require.True(t, isPaymentRequired(
+		status.New(GRPCLegacyErrCode, GRPCErrMessage).Err(),
+	))
+	require.False(t, isPaymentRequired(
+		status.New(GRPCErrCode, "invalid token").Err(),
+	))
+	require.False(t, isPaymentRequired(
+		status.New(codes.Unavailable, GRPCErrMessage).Err(),
+	))
+	require.False(t, isPaymentRequired(fmt.Errorf("payment required")))
+}
+
+// TestChallengeFromStatus tests that the payment challenge attached to the
+// status of a call is found among its details.
+func TestChallengeFromStatus(t *testing.T) {
+	challenge := &challengerpc.PaymentChallenge{
+		Scheme:   SchemeL402,
+		Macaroon: []byte("macaroon"),
+		Invoice:  "lnbc1",
+		PriceSat: 10,
+	}
+	st, err := status.New(GRPCErrCode, GRPCErrMessage).WithDetails(
+		challenge,
+	)
+	require.NoError(t, err)
+
+	found := challengeFromStatus(st.Err())
+	require.NotNil(t, found)
+	require.Equal(t, challenge.Invoice, found.Invoice)
+	require.Equal(t, challenge.Macaroon, found.Macaroon)
+
+	// Servers that only send the header don't attach a challenge.
+	require.Nil(t, challengeFromStatus(
+		status.New(GRPCErrCode, GRPCErrMessage).Err(),
+	))
+	require.Nil(t, challengeFromStatus(fmt.Errorf("payment required")))
+}
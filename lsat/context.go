@@ -17,8 +17,56 @@ var (
 	// KeyTokenID is the key under which we store the client's token ID in
 	// the request context.
 	KeyTokenID = ContextKey{"tokenid"}
+
+	// KeyClientIP is the key under which we store the IP address of the
+	// client in the request context, so LSATs bound to it can be verified.
+	KeyClientIP = ContextKey{"clientip"}
+
+	// KeyTLSBinding is the key under which we store the TLS channel binding
+	// of the client's connection in the request context, so LSATs bound to
+	// it can be verified.
+	KeyTLSBinding = ContextKey{"tlsbinding"}
+
+	// KeyPeerCertificates is the key under which we store the certificate
+	// chain the client presented on its TLS connection in the request
+	// context, so it can be authenticated with it.
+	KeyPeerCertificates = ContextKey{"peercertificates"}
+
+	// KeyRequestPath is the key under which we store the URL path of the
+	// client's request in the request context, so LSATs bound to it can be
+	// verified.
+	KeyRequestPath = ContextKey{"requestpath"}
+
+	// KeyRequestMethod is the key under which we store the HTTP method of
+	// the client's request in the request context, so LSATs restricted to
+	// some methods can be verified.
+	KeyRequestMethod = ContextKey{"requestmethod"}
+
+	// KeyBindingCaveats is the key under which the caveats that bind a new
+	// LSAT to its client, or otherwise restrict it for the request that it
+	// was issued for like its expiry, are stored in the context of a mint
+	// request.
+	KeyBindingCaveats = ContextKey{"bindingcaveats"}
+
+	// KeyGracePeriod is the key under which we store the time an expired
+	// LSAT is still accepted for by the service of the client's request in
+	// the request context.
+	KeyGracePeriod = ContextKey{"graceperiod"}
+
+	// KeyMetadata is the key under which the metadata the operator
+	// attaches to a new LSAT, like the campaign it was sold in, is stored
+	// in the context of a mint request.
+	KeyMetadata = ContextKey{"metadata"}
+
+	// KeyTrace is the key under which the TraceFunc of a request that is
+	// traced for debugging is stored in the request context.
+	KeyTrace = ContextKey{"trace"}
 )
 
+// TraceFunc records a step of the handling of a single request that is traced
+// for debugging.
+type TraceFunc func(format string, args ...interface{})
+
 // FromContext tries to extract a value from the given context.
 func FromContext(ctx context.Context, key ContextKey) interface{} {
 	return ctx.Value(key)
@@ -30,3 +78,14 @@ func AddToContext(ctx context.Context, key ContextKey,
 
 	return context.WithValue(ctx, key, value)
 }
+
+// Trace records a step of the handling of the request the context belongs to if
+// the request is traced. Otherwise it does nothing.
+func Trace(ctx context.Context, format string, args ...interface{}) {
+	trace, ok := FromContext(ctx, KeyTrace).(TraceFunc)
+	if !ok {
+		return
+	}
+
+	trace(format, args...)
+}
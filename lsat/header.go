@@ -24,37 +24,57 @@ const (
 	// HeaderMacaroon is the HTTP header field name that is used to send the
 	// LSAT by our own gRPC clients.
 	HeaderMacaroon = "Macaroon"
+
+	// SchemeLSAT is the legacy name of the authentication scheme that is
+	// used in the Authorization and WWW-Authenticate headers.
+	SchemeLSAT = "LSAT"
+
+	// SchemeL402 is the current name of the authentication scheme that is
+	// used in the Authorization and WWW-Authenticate headers.
+	SchemeL402 = "L402"
+
+	// CookieName is the name of the HTTP cookie that is used to send the
+	// LSAT by browsers that obtained it through the payment page.
+	CookieName = "lsat"
 )
 
 var (
-	authRegex  = regexp.MustCompile("LSAT (.*?):([a-f0-9]{64})")
-	authFormat = "LSAT %s:%s"
+	authRegex    = regexp.MustCompile("(?:LSAT|L402) (.*?):([a-f0-9]{64})")
+	cookieRegex  = regexp.MustCompile("^(.*?):([a-f0-9]{64})$")
+	cookieFormat = "%s:%s"
 )
 
 // FromHeader tries to extract authentication information from HTTP headers.
 // There are two supported formats that can be sent in three different header
-// fields:
+// fields and one cookie:
 //    1.      Authorization: LSAT <macBase64>:<preimageHex>
+//            (or L402 instead of LSAT)
 //    2.      Grpc-Metadata-Macaroon: <macHex>
 //    3.      Macaroon: <macHex>
+//    4.      Cookie: lsat=<macBase64>:<preimageHex>
 // If only the macaroon is sent in header 2 or three then it is expected to have
 // a caveat with the preimage attached to it.
 func FromHeader(header *http.Header) (*macaroon.Macaroon, lntypes.Preimage, error) {
-	var authHeader string
+	// Each header field is only looked up once, the token is parsed for
+	// every request.
+	var (
+		authHeader  = header.Get(HeaderAuthorization)
+		macMDHeader = header.Get(HeaderMacaroonMD)
+		macHeader   = header.Get(HeaderMacaroon)
+		authCookie  string
+	)
+	if authHeader == "" && macMDHeader == "" && macHeader == "" {
+		authCookie = cookieValue(header)
+	}
 
 	switch {
 	// Header field 1 contains the macaroon and the preimage as distinct
 	// values separated by a colon.
-	case header.Get(HeaderAuthorization) != "":
+	case authHeader != "":
 		// Parse the content of the header field and check that it is in
 		// the correct format.
-		authHeader = header.Get(HeaderAuthorization)
 		log.Debugf("Trying to authorize with header value [%s].",
 			authHeader)
-		if !authRegex.MatchString(authHeader) {
-			return nil, lntypes.Preimage{}, fmt.Errorf("invalid "+
-				"auth header format: %s", authHeader)
-		}
 		matches := authRegex.FindStringSubmatch(authHeader)
 		if len(matches) != 3 {
 			return nil, lntypes.Preimage{}, fmt.Errorf("invalid "+
@@ -62,35 +82,26 @@ func FromHeader(header *http.Header) (*macaroon.Macaroon, lntypes.Preimage, erro
 		}
 
 		// Decode the content of the two parts of the header value.
-		macBase64, preimageHex := matches[1], matches[2]
-		macBytes, err := base64.StdEncoding.DecodeString(macBase64)
-		if err != nil {
-			return nil, lntypes.Preimage{}, fmt.Errorf("base64 "+
-				"decode of macaroon failed: %v", err)
-		}
-		mac := &macaroon.Macaroon{}
-		err = mac.UnmarshalBinary(macBytes)
-		if err != nil {
-			return nil, lntypes.Preimage{}, fmt.Errorf("unable to "+
-				"unmarshal macaroon: %v", err)
-		}
-		preimage, err := lntypes.MakePreimageFromStr(preimageHex)
-		if err != nil {
-			return nil, lntypes.Preimage{}, fmt.Errorf("hex "+
-				"decode of preimage failed: %v", err)
-		}
-
-		// All done, we don't need to extract anything from the
-		// macaroon since the preimage was presented separately.
-		return mac, preimage, nil
+		return parseMacPreimage(matches[1], matches[2])
 
 	// Header field 2: Contains only the macaroon.
-	case header.Get(HeaderMacaroonMD) != "":
-		authHeader = header.Get(HeaderMacaroonMD)
+	case macMDHeader != "":
+		authHeader = macMDHeader
 
 	// Header field 3: Contains only the macaroon.
-	case header.Get(HeaderMacaroon) != "":
-		authHeader = header.Get(HeaderMacaroon)
+	case macHeader != "":
+		authHeader = macHeader
+
+	// Cookie 4: Contains the macaroon and the preimage in the same format
+	// as header field 1, just without the LSAT prefix.
+	case authCookie != "":
+		matches := cookieRegex.FindStringSubmatch(authCookie)
+		if len(matches) != 3 {
+			return nil, lntypes.Preimage{}, fmt.Errorf("invalid "+
+				"auth cookie format: %s", authCookie)
+		}
+
+		return parseMacPreimage(matches[1], matches[2])
 
 	default:
 		return nil, lntypes.Preimage{}, fmt.Errorf("no auth header " +
@@ -125,7 +136,8 @@ func FromHeader(header *http.Header) (*macaroon.Macaroon, lntypes.Preimage, erro
 }
 
 // SetHeader sets the provided authentication elements as the default/standard
-// HTTP header for the LSAT protocol.
+// HTTP header for the LSAT protocol. The legacy LSAT scheme name is used
+// because it is understood by older servers too.
 func SetHeader(header *http.Header, mac *macaroon.Macaroon,
 	preimage fmt.Stringer) error {
 
@@ -133,10 +145,69 @@ func SetHeader(header *http.Header, mac *macaroon.Macaroon,
 	if err != nil {
 		return err
 	}
-	value := fmt.Sprintf(
-		authFormat, base64.StdEncoding.EncodeToString(macBytes),
-		preimage.String(),
-	)
-	header.Set(HeaderAuthorization, value)
+	// The header is set for every proxied request, so it's built in a
+	// single buffer instead of formatting it.
+	preimageHex := preimage.String()
+	macLen := base64.StdEncoding.EncodedLen(len(macBytes))
+	value := make([]byte, 0, len(SchemeLSAT)+macLen+len(preimageHex)+2)
+	value = append(value, SchemeLSAT+" "...)
+	value = value[:len(value)+macLen]
+	base64.StdEncoding.Encode(value[len(SchemeLSAT)+1:], macBytes)
+	value = append(value, ':')
+	value = append(value, preimageHex...)
+
+	header.Set(HeaderAuthorization, string(value))
 	return nil
 }
+
+// CookieValue encodes the provided authentication elements in the format of
+// the value of the LSAT cookie.
+func CookieValue(mac *macaroon.Macaroon, preimage fmt.Stringer) (string,
+	error) {
+
+	macBytes, err := mac.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(
+		cookieFormat, base64.StdEncoding.EncodeToString(macBytes),
+		preimage.String(),
+	), nil
+}
+
+// cookieValue returns the value of the LSAT cookie in the given header or an
+// empty string if there is no such cookie.
+func cookieValue(header *http.Header) string {
+	cookie, err := (&http.Request{Header: *header}).Cookie(CookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// parseMacPreimage decodes a base64 encoded macaroon and a hex encoded
+// preimage.
+func parseMacPreimage(macBase64, preimageHex string) (*macaroon.Macaroon,
+	lntypes.Preimage, error) {
+
+	macBytes, err := base64.StdEncoding.DecodeString(macBase64)
+	if err != nil {
+		return nil, lntypes.Preimage{}, fmt.Errorf("base64 "+
+			"decode of macaroon failed: %v", err)
+	}
+	mac := &macaroon.Macaroon{}
+	err = mac.UnmarshalBinary(macBytes)
+	if err != nil {
+		return nil, lntypes.Preimage{}, fmt.Errorf("unable to "+
+			"unmarshal macaroon: %v", err)
+	}
+	preimage, err := lntypes.MakePreimageFromStr(preimageHex)
+	if err != nil {
+		return nil, lntypes.Preimage{}, fmt.Errorf("hex "+
+			"decode of preimage failed: %v", err)
+	}
+
+	// All done, we don't need to extract anything from the macaroon since
+	// the preimage was presented separately.
+	return mac, preimage, nil
+}
@@ -0,0 +1,149 @@
+package lsat
+
+import (
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
+)
+
+// TestFromHeader ensures that tokens can be read from all supported header
+// fields and the cookie, and that the standard header is read back unchanged.
+func TestFromHeader(t *testing.T) {
+	t.Parallel()
+
+	mac, err := macaroon.New(
+		[]byte("root key"), []byte("id"), "", macaroon.LatestVersion,
+	)
+	if err != nil {
+		t.Fatalf("unable to create macaroon: %v", err)
+	}
+	var preimage lntypes.Preimage
+	copy(preimage[:], "preimage")
+
+	header := make(http.Header)
+	if err := SetHeader(&header, mac, preimage); err != nil {
+		t.Fatalf("unable to set header: %v", err)
+	}
+	cookie, err := CookieValue(mac, preimage)
+	if err != nil {
+		t.Fatalf("unable to encode cookie: %v", err)
+	}
+
+	// The macaroon-only header fields need the preimage as a caveat.
+	macWithPreimage := mac.Clone()
+	err = AddFirstPartyCaveats(macWithPreimage, Caveat{
+		Condition: PreimageKey,
+		Value:     preimage.String(),
+	})
+	if err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+	macBytes, err := macWithPreimage.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unable to encode macaroon: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		err    bool
+	}{{
+		name:   "authorization",
+		header: header,
+	}, {
+		name: "l402 scheme",
+		header: http.Header{HeaderAuthorization: []string{
+			"L402 " + header.Get(HeaderAuthorization)[5:],
+		}},
+	}, {
+		name: "grpc metadata",
+		header: http.Header{HeaderMacaroonMD: []string{
+			hex.EncodeToString(macBytes),
+		}},
+	}, {
+		name: "macaroon",
+		header: http.Header{HeaderMacaroon: []string{
+			hex.EncodeToString(macBytes),
+		}},
+	}, {
+		name: "cookie",
+		header: http.Header{"Cookie": []string{
+			CookieName + "=" + cookie,
+		}},
+	}, {
+		name: "invalid authorization",
+		header: http.Header{HeaderAuthorization: []string{
+			"LSAT invalid",
+		}},
+		err: true,
+	}, {
+		name:   "none",
+		header: http.Header{},
+		err:    true,
+	}}
+	for _, test := range tests {
+		parsedMac, parsedPreimage, err := FromHeader(&test.header)
+		switch {
+		case test.err && err == nil:
+			t.Fatalf("%s: expected error", test.name)
+
+		case test.err:
+			continue
+
+		case err != nil:
+			t.Fatalf("%s: unable to parse header: %v", test.name,
+				err)
+		}
+
+		if parsedPreimage != preimage {
+			t.Fatalf("%s: unexpected preimage %v", test.name,
+				parsedPreimage)
+		}
+		if string(parsedMac.Id()) != "id" {
+			t.Fatalf("%s: unexpected macaroon ID %x", test.name,
+				parsedMac.Id())
+		}
+	}
+
+	// Setting the header again results in the same value.
+	parsedMac, parsedPreimage, _ := FromHeader(&header)
+	again := make(http.Header)
+	if err := SetHeader(&again, parsedMac, parsedPreimage); err != nil {
+		t.Fatalf("unable to set header: %v", err)
+	}
+	if again.Get(HeaderAuthorization) != header.Get(HeaderAuthorization) {
+		t.Fatalf("header changed from %s to %s",
+			header.Get(HeaderAuthorization),
+			again.Get(HeaderAuthorization))
+	}
+}
+
+// BenchmarkFromHeader measures parsing the token of a request and setting it
+// again in the standard format, like the proxy does for every request.
+func BenchmarkFromHeader(b *testing.B) {
+	mac, err := macaroon.New(
+		[]byte("root key"), []byte("id"), "", macaroon.LatestVersion,
+	)
+	if err != nil {
+		b.Fatalf("unable to create macaroon: %v", err)
+	}
+	header := make(http.Header)
+	if err := SetHeader(&header, mac, lntypes.Preimage{}); err != nil {
+		b.Fatalf("unable to set header: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mac, preimage, err := FromHeader(&header)
+		if err != nil {
+			b.Fatalf("unable to parse header: %v", err)
+		}
+		if err := SetHeader(&header, mac, preimage); err != nil {
+			b.Fatalf("unable to set header: %v", err)
+		}
+	}
+}
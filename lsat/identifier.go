@@ -1,6 +1,7 @@
 package lsat
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -31,6 +32,10 @@ var (
 	// ErrUnknownVersion is an error returned when attempting to decode an
 	// LSAT identifier with an unknown version.
 	ErrUnknownVersion = errors.New("unknown LSAT version")
+
+	// trialPreimagePrefix is the prefix the preimages of trial LSATs are
+	// derived from their token ID with.
+	trialPreimagePrefix = []byte("trial")
 )
 
 // TokenID is the type that stores the token identifier of an LSAT token.
@@ -126,3 +131,23 @@ func DecodeIdentifier(r io.Reader) (*Identifier, error) {
 		return nil, fmt.Errorf("%w: %v", ErrUnknownVersion, version)
 	}
 }
+
+// TrialPreimage returns the preimage of the trial LSAT with the given token ID.
+// Trial LSATs aren't paid for, so their preimage is derived from their ID and
+// handed out together with the macaroon.
+func TrialPreimage(tokenID TokenID) lntypes.Preimage {
+	h := sha256.New()
+	_, _ = h.Write(trialPreimagePrefix)
+	_, _ = h.Write(tokenID[:])
+
+	var preimage lntypes.Preimage
+	copy(preimage[:], h.Sum(nil))
+	return preimage
+}
+
+// IsTrialIdentifier returns true if the identifier belongs to a trial LSAT.
+// Only the mint chooses the identifiers of the macaroons it signs, so this
+// can't be faked by a client.
+func IsTrialIdentifier(id *Identifier) bool {
+	return id.PaymentHash == TrialPreimage(id.TokenID).Hash()
+}
@@ -2,7 +2,9 @@ package lsat
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Satisfier provides a generic interface to satisfy a caveat based on its
@@ -115,3 +117,114 @@ func NewCapabilitiesSatisfier(service string, targetCapability string) Satisfier
 		},
 	}
 }
+
+// NewMessagesSatisfier implements a satisfier that makes sure the number of
+// messages of a service an LSAT pays for is never increased by a later caveat.
+func NewMessagesSatisfier(service string) Satisfier {
+	return Satisfier{
+		Condition: service + CondMessagesSuffix,
+		SatisfyPrevious: func(prev, cur Caveat) error {
+			prevMessages, err := strconv.ParseUint(prev.Value, 10, 64)
+			if err != nil {
+				return err
+			}
+			curMessages, err := strconv.ParseUint(cur.Value, 10, 64)
+			if err != nil {
+				return err
+			}
+			if curMessages > prevMessages {
+				return fmt.Errorf("number of messages %d greater "+
+					"than previously allowed", curMessages)
+			}
+			return nil
+		},
+		SatisfyFinal: func(c Caveat) error {
+			_, err := strconv.ParseUint(c.Value, 10, 64)
+			return err
+		},
+	}
+}
+
+// NewMethodsSatisfier implements a satisfier to determine whether an LSAT may
+// be used with the HTTP method of a request to a service. Later caveats may
+// only remove methods.
+func NewMethodsSatisfier(service string, targetMethod string) Satisfier {
+	return Satisfier{
+		Condition: service + CondMethodsSuffix,
+		SatisfyPrevious: func(prev, cur Caveat) error {
+			allowed := make(map[string]struct{})
+			for _, method := range strings.Split(prev.Value, ",") {
+				allowed[method] = struct{}{}
+			}
+
+			for _, method := range strings.Split(cur.Value, ",") {
+				if _, ok := allowed[method]; !ok {
+					return fmt.Errorf("method %v not "+
+						"previously allowed", method)
+				}
+			}
+
+			return nil
+		},
+		SatisfyFinal: func(c Caveat) error {
+			for _, method := range strings.Split(c.Value, ",") {
+				if method == targetMethod {
+					return nil
+				}
+			}
+			return fmt.Errorf("target method %v not authorized",
+				targetMethod)
+		},
+	}
+}
+
+// ExpiredError is returned by the expiry satisfier if an LSAT expired and its
+// grace period is over.
+type ExpiredError struct {
+	// Expiry is the moment the LSAT expired.
+	Expiry time.Time
+}
+
+// Error returns a human readable description of the error.
+func (e *ExpiredError) Error() string {
+	return fmt.Sprintf("LSAT expired at %v", e.Expiry)
+}
+
+// NewValidUntilSatisfier implements a satisfier that makes sure an LSAT hasn't
+// expired for a service at the given time. Expired LSATs are still accepted
+// for the given grace period, and the expiry can never be extended by a later
+// caveat.
+func NewValidUntilSatisfier(service string, now time.Time,
+	gracePeriod time.Duration) Satisfier {
+
+	return Satisfier{
+		Condition: service + CondValidUntilSuffix,
+		SatisfyPrevious: func(prev, cur Caveat) error {
+			prevExpiry, err := strconv.ParseInt(prev.Value, 10, 64)
+			if err != nil {
+				return err
+			}
+			curExpiry, err := strconv.ParseInt(cur.Value, 10, 64)
+			if err != nil {
+				return err
+			}
+			if curExpiry > prevExpiry {
+				return fmt.Errorf("expiry %d later than "+
+					"previously allowed", curExpiry)
+			}
+			return nil
+		},
+		SatisfyFinal: func(c Caveat) error {
+			value, err := strconv.ParseInt(c.Value, 10, 64)
+			if err != nil {
+				return err
+			}
+
+			expiry := time.Unix(value, 0)
+			if now.After(expiry.Add(gracePeriod)) {
+				return &ExpiredError{Expiry: expiry}
+			}
+			return nil
+		},
+	}
+}
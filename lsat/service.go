@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
+
+	"gopkg.in/macaroon.v2"
 )
 
 const (
@@ -15,6 +18,30 @@ const (
 	// capabilities caveat. For example, the condition of a capabilities
 	// caveat for a service named `loop` would be `loop_capabilities`.
 	CondCapabilitiesSuffix = "_capabilities"
+
+	// CondMessagesSuffix is the condition suffix used for the caveat of
+	// the number of streamed messages an LSAT pays for. For example, the
+	// condition of a messages caveat for a service named `feed` would be
+	// `feed_messages`.
+	CondMessagesSuffix = "_messages"
+
+	// CondValidUntilSuffix is the condition suffix used for the caveat of
+	// the moment an LSAT expires for a service, in seconds since the Unix
+	// epoch. For example, the condition of an expiry caveat for a service
+	// named `feed` would be `feed_valid_until`.
+	CondValidUntilSuffix = "_valid_until"
+
+	// CondDelegationSuffix is the condition suffix used for the caveat of
+	// the ID of a delegated LSAT, which was derived from the LSAT of its
+	// holder for a service. For example, the condition of a delegation
+	// caveat for a service named `feed` would be `feed_delegation`.
+	CondDelegationSuffix = "_delegation"
+
+	// CondMethodsSuffix is the condition suffix used for the caveat of the
+	// comma separated HTTP methods an LSAT may be used with for a service.
+	// For example, the condition of a methods caveat for a service named
+	// `feed` would be `feed_methods`.
+	CondMethodsSuffix = "_methods"
 )
 
 var (
@@ -63,6 +90,16 @@ func NewServicesCaveat(services ...Service) (Caveat, error) {
 	}, nil
 }
 
+// DecodeServicesCaveat decodes the services of the given services caveat.
+func DecodeServicesCaveat(caveat Caveat) ([]Service, error) {
+	if caveat.Condition != CondServices {
+		return nil, fmt.Errorf("expected %v caveat, got %v",
+			CondServices, caveat.Condition)
+	}
+
+	return decodeServicesCaveatValue(caveat.Value)
+}
+
 // encodeServicesCaveatValue encodes a list of services into the expected format
 // of a services caveat's value.
 func encodeServicesCaveatValue(services ...Service) (string, error) {
@@ -129,3 +166,55 @@ func NewCapabilitiesCaveat(serviceName string, capabilities string) Caveat {
 		Value:     capabilities,
 	}
 }
+
+// NewMessagesCaveat creates a new caveat of the number of messages of the given
+// service an LSAT pays for.
+func NewMessagesCaveat(serviceName string, messages uint64) Caveat {
+	return Caveat{
+		Condition: serviceName + CondMessagesSuffix,
+		Value:     strconv.FormatUint(messages, 10),
+	}
+}
+
+// NewValidUntilCaveat creates a new caveat of the moment an LSAT expires for
+// the given service.
+func NewValidUntilCaveat(serviceName string, expiry time.Time) Caveat {
+	return Caveat{
+		Condition: serviceName + CondValidUntilSuffix,
+		Value:     strconv.FormatInt(expiry.Unix(), 10),
+	}
+}
+
+// NewDelegationCaveat creates a new caveat of the ID of a delegated LSAT for
+// the given service.
+func NewDelegationCaveat(serviceName string, id string) Caveat {
+	return Caveat{
+		Condition: serviceName + CondDelegationSuffix,
+		Value:     id,
+	}
+}
+
+// NewMethodsCaveat creates a new caveat of the HTTP methods an LSAT may be used
+// with for the given service.
+func NewMethodsCaveat(serviceName string, methods ...string) Caveat {
+	return Caveat{
+		Condition: serviceName + CondMethodsSuffix,
+		Value:     strings.Join(methods, ","),
+	}
+}
+
+// ValidUntil returns the moment the given LSAT expires for the given service,
+// if it has an expiry caveat. The caveat isn't verified.
+func ValidUntil(mac *macaroon.Macaroon, serviceName string) (time.Time, bool) {
+	value, ok := HasCaveat(mac, serviceName+CondValidUntilSuffix)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	expiry, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(expiry, 0), true
+}
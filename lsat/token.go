@@ -40,6 +40,11 @@ type Token struct {
 	// TimeCreated is the moment when this token was created.
 	TimeCreated time.Time
 
+	// Expiry is the moment after which the token is no longer accepted by
+	// the server. A zero value means the token never expires. The expiry is
+	// only kept by the stores that use the JSON token file format.
+	Expiry time.Time
+
 	// baseMac is the base macaroon in its original form as baked by the
 	// authentication server. No client side caveats have been added to it
 	// yet.
@@ -88,12 +93,17 @@ func (t *Token) PaidMacaroon() (*macaroon.Macaroon, error) {
 	return mac, nil
 }
 
-// IsValid returns true if the timestamp contained in the base macaroon is not
-// yet expired.
+// IsValid returns true if the token is not yet expired.
 func (t *Token) IsValid() bool {
 	// TODO(guggero): Extract and validate from caveat once we add an
 	//  expiration date to the LSAT.
-	return true
+	return !t.expiredAt(time.Now())
+}
+
+// expiredAt returns true if the token has an expiry that is before the given
+// time.
+func (t *Token) expiredAt(now time.Time) bool {
+	return !t.Expiry.IsZero() && t.Expiry.Before(now)
 }
 
 // isPending returns true if the payment for the LSAT is still in flight and we
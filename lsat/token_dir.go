@@ -0,0 +1,409 @@
+package lsat
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"gopkg.in/macaroon.v2"
+)
+
+const (
+	// tokenFileVersion is the version of the JSON token file format.
+	tokenFileVersion = 1
+
+	// tokenFileExt is the extension of the JSON token files.
+	tokenFileExt = ".json"
+)
+
+// tokenFile is the on-disk format of a single token in a TokenDir. The format
+// is plain JSON so tools other than the ones using this package can read and
+// write it too.
+type tokenFile struct {
+	Version            int        `json:"version"`
+	Host               string     `json:"host"`
+	Macaroon           string     `json:"macaroon"`
+	PaymentHash        string     `json:"payment_hash"`
+	Preimage           string     `json:"preimage,omitempty"`
+	AmountPaidMsat     int64      `json:"amount_paid_msat"`
+	RoutingFeePaidMsat int64      `json:"routing_fee_paid_msat"`
+	TimeCreated        time.Time  `json:"time_created"`
+	Expiry             *time.Time `json:"expiry,omitempty"`
+}
+
+// StoredToken is a token of a TokenDir together with the host it belongs to
+// and the file it is stored in.
+type StoredToken struct {
+	*Token
+
+	// Host is the host the token was bought for.
+	Host string
+
+	// File is the full path of the token's file.
+	File string
+}
+
+// TokenDir is a token directory that is shared between all tools on a machine
+// that buy LSATs. Each host has its own sub directory that contains one JSON
+// file per token, named after the token's payment hash. A token that was
+// bought by one tool can therefore be used by all others.
+type TokenDir struct {
+	dir string
+}
+
+// NewTokenDir opens the token directory at the given path. If the directory
+// does not exist, it will be created.
+func NewTokenDir(dir string) (*TokenDir, error) {
+	if !fileExists(dir) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	return &TokenDir{dir: dir}, nil
+}
+
+// HostStore returns the token store for the given host. The host should be
+// given in the same form as it appears in URLs, for example
+// "example.com:8080".
+func (d *TokenDir) HostStore(host string) (*HostStore, error) {
+	host = strings.ToLower(host)
+	hostDir := filepath.Join(d.dir, hostDirName(host))
+	if !fileExists(hostDir) {
+		if err := os.MkdirAll(hostDir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	return &HostStore{host: host, dir: hostDir}, nil
+}
+
+// AllTokens returns the tokens of all hosts in the directory, sorted by host
+// and creation time.
+func (d *TokenDir) AllTokens() ([]*StoredToken, error) {
+	hostDirs, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []*StoredToken
+	for _, hostDir := range hostDirs {
+		if !hostDir.IsDir() {
+			continue
+		}
+
+		hostTokens, err := readTokenDir(
+			filepath.Join(d.dir, hostDir.Name()),
+		)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, hostTokens...)
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].Host != tokens[j].Host {
+			return tokens[i].Host < tokens[j].Host
+		}
+		return tokens[i].TimeCreated.Before(tokens[j].TimeCreated)
+	})
+
+	return tokens, nil
+}
+
+// PruneExpired removes all paid tokens that expired before the given time and
+// returns them. Pending tokens are never removed since their payment might
+// still complete.
+func (d *TokenDir) PruneExpired(now time.Time) ([]*StoredToken, error) {
+	tokens, err := d.AllTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	var pruned []*StoredToken
+	for _, token := range tokens {
+		if token.isPending() || !token.expiredAt(now) {
+			continue
+		}
+
+		if err := os.Remove(token.File); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, token)
+	}
+
+	return pruned, nil
+}
+
+// HostStore is the Store of a single host in a TokenDir. In contrast to the
+// FileStore, it keeps expired tokens, so a new token can be bought once the
+// current one expires.
+type HostStore struct {
+	host string
+	dir  string
+}
+
+// A compile-time flag to ensure that HostStore implements the Store interface.
+var _ Store = (*HostStore)(nil)
+
+// CurrentToken returns the newest paid token that didn't expire yet. If there
+// is no such token, the newest pending token is returned.
+//
+// NOTE: This is part of the Store interface.
+func (s *HostStore) CurrentToken() (*Token, error) {
+	tokens, err := readTokenDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var current *Token
+	for _, token := range tokens {
+		switch {
+		case !token.isPending() && !token.IsValid():
+			continue
+
+		// A paid token always beats a pending one.
+		case current != nil && current.isPending() != token.isPending():
+			if !token.isPending() {
+				current = token.Token
+			}
+
+		case current == nil ||
+			token.TimeCreated.After(current.TimeCreated):
+
+			current = token.Token
+		}
+	}
+
+	if current == nil {
+		return nil, ErrNoToken
+	}
+	return current, nil
+}
+
+// AllTokens returns all tokens of the host, including expired ones, mapped by
+// their file name.
+//
+// NOTE: This is part of the Store interface.
+func (s *HostStore) AllTokens() (map[string]*Token, error) {
+	tokens, err := readTokenDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	allTokens := make(map[string]*Token, len(tokens))
+	for _, token := range tokens {
+		allTokens[token.File] = token.Token
+	}
+	return allTokens, nil
+}
+
+// StoreToken saves a token to the store. A pending token can be replaced with
+// its paid version but a valid paid token is never replaced.
+//
+// NOTE: This is part of the Store interface.
+func (s *HostStore) StoreToken(newToken *Token) error {
+	currentToken, err := s.CurrentToken()
+	switch {
+	case err == ErrNoToken:
+
+	case err != nil:
+		return err
+
+	// Replace a pending token with a paid one. Both are stored in the same
+	// file, so writing the new one is enough.
+	case currentToken.isPending() && !newToken.isPending():
+		if currentToken.PaymentHash != newToken.PaymentHash {
+			return fmt.Errorf("new paid token doesn't match " +
+				"existing pending token")
+		}
+
+	default:
+		return errNoReplace
+	}
+
+	return writeTokenFile(
+		filepath.Join(s.dir, newToken.PaymentHash.String()+tokenFileExt),
+		s.host, newToken,
+	)
+}
+
+// RemovePendingToken removes all pending tokens of the host or returns
+// ErrNoToken if there are none.
+//
+// NOTE: This is part of the Store interface.
+func (s *HostStore) RemovePendingToken() error {
+	tokens, err := readTokenDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	removed := false
+	for _, token := range tokens {
+		if !token.isPending() {
+			continue
+		}
+
+		if err := os.Remove(token.File); err != nil {
+			return err
+		}
+		removed = true
+	}
+
+	if !removed {
+		return ErrNoToken
+	}
+	return nil
+}
+
+// hostDirName returns the name of the directory the tokens of a host are
+// stored in. Only characters that are safe in file names on all platforms are
+// kept, the real host name is part of each token file.
+func hostDirName(host string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.',
+			r == '-':
+
+			return r
+
+		default:
+			return '_'
+		}
+	}, host)
+}
+
+// readTokenDir reads all token files of a single host directory.
+func readTokenDir(dir string) ([]*StoredToken, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []*StoredToken
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != tokenFileExt {
+			continue
+		}
+
+		token, err := readJSONTokenFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, nil
+}
+
+// readJSONTokenFile reads a single token from a JSON token file.
+func readJSONTokenFile(fileName string) (*StoredToken, error) {
+	bytes, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var file tokenFile
+	if err := json.Unmarshal(bytes, &file); err != nil {
+		return nil, fmt.Errorf("unable to parse token file %s: %v",
+			fileName, err)
+	}
+	if file.Version != tokenFileVersion {
+		return nil, fmt.Errorf("token file %s has unknown version %d",
+			fileName, file.Version)
+	}
+
+	macBytes, err := base64.StdEncoding.DecodeString(file.Macaroon)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode macaroon of token "+
+			"file %s: %v", fileName, err)
+	}
+	mac := &macaroon.Macaroon{}
+	if err := mac.UnmarshalBinary(macBytes); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal macaroon of token "+
+			"file %s: %v", fileName, err)
+	}
+
+	hash, err := lntypes.MakeHashFromStr(file.PaymentHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payment hash in token file "+
+			"%s: %v", fileName, err)
+	}
+	token := &Token{
+		PaymentHash:    hash,
+		Preimage:       zeroPreimage,
+		AmountPaid:     lnwire.MilliSatoshi(file.AmountPaidMsat),
+		RoutingFeePaid: lnwire.MilliSatoshi(file.RoutingFeePaidMsat),
+		TimeCreated:    file.TimeCreated,
+		baseMac:        mac,
+	}
+	if file.Preimage != "" {
+		token.Preimage, err = lntypes.MakePreimageFromStr(file.Preimage)
+		if err != nil {
+			return nil, fmt.Errorf("invalid preimage in token file "+
+				"%s: %v", fileName, err)
+		}
+	}
+	if file.Expiry != nil {
+		token.Expiry = *file.Expiry
+	}
+
+	return &StoredToken{
+		Token: token,
+		Host:  file.Host,
+		File:  fileName,
+	}, nil
+}
+
+// writeTokenFile writes a token to a JSON token file. The file is replaced
+// atomically so other tools never read a partially written token.
+func writeTokenFile(fileName, host string, token *Token) error {
+	macBytes, err := token.baseMac.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	file := &tokenFile{
+		Version:            tokenFileVersion,
+		Host:               host,
+		Macaroon:           base64.StdEncoding.EncodeToString(macBytes),
+		PaymentHash:        token.PaymentHash.String(),
+		AmountPaidMsat:     int64(token.AmountPaid),
+		RoutingFeePaidMsat: int64(token.RoutingFeePaid),
+		TimeCreated:        token.TimeCreated,
+	}
+	if !token.isPending() {
+		file.Preimage = token.Preimage.String()
+	}
+	if !token.Expiry.IsZero() {
+		file.Expiry = &token.Expiry
+	}
+
+	bytes, err := json.MarshalIndent(file, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(fileName), ".token")
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(bytes)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), fileName)
+}
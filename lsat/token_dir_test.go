@@ -0,0 +1,177 @@
+package lsat
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+// TestTokenDir tests that tokens of different hosts are stored separately in
+// a token directory and that expired tokens are replaced and pruned.
+func TestTokenDir(t *testing.T) {
+	t.Parallel()
+
+	tempDirName, err := ioutil.TempDir("", "lsattokendir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDirName)
+
+	var (
+		now          = time.Now()
+		paidPreimage = lntypes.Preimage{1, 2, 3, 4, 5}
+		pendingToken = &Token{
+			PaymentHash:    paidPreimage.Hash(),
+			Preimage:       zeroPreimage,
+			AmountPaid:     1000,
+			RoutingFeePaid: 10,
+			TimeCreated:    now.Add(-time.Hour),
+			Expiry:         now.Add(-time.Minute),
+			baseMac:        makeMac(),
+		}
+		paidToken = &Token{
+			PaymentHash:    paidPreimage.Hash(),
+			Preimage:       paidPreimage,
+			AmountPaid:     1000,
+			RoutingFeePaid: 10,
+			TimeCreated:    now.Add(-time.Hour),
+			Expiry:         now.Add(-time.Minute),
+			baseMac:        makeMac(),
+		}
+		newToken = &Token{
+			PaymentHash: lntypes.Hash{9, 9, 9},
+			Preimage:    lntypes.Preimage{9},
+			TimeCreated: now,
+			baseMac:     makeMac(),
+		}
+	)
+
+	dir, err := NewTokenDir(tempDirName)
+	if err != nil {
+		t.Fatalf("could not create token dir: %v", err)
+	}
+	store, err := dir.HostStore("Example.com:8080")
+	if err != nil {
+		t.Fatalf("could not create host store: %v", err)
+	}
+	otherStore, err := dir.HostStore("other.example.com")
+	if err != nil {
+		t.Fatalf("could not create host store: %v", err)
+	}
+
+	// Store a pending token and replace it with its paid version.
+	if err := store.StoreToken(pendingToken); err != nil {
+		t.Fatalf("could not save pending token: %v", err)
+	}
+	token, err := store.CurrentToken()
+	if err != nil {
+		t.Fatalf("could not read pending token: %v", err)
+	}
+	if !token.isPending() {
+		t.Fatalf("expected token to be pending")
+	}
+	if err := store.StoreToken(paidToken); err != nil {
+		t.Fatalf("could not save paid token: %v", err)
+	}
+
+	// The paid token is expired, so it isn't the current token anymore
+	// but is still listed.
+	_, err = store.CurrentToken()
+	if err != ErrNoToken {
+		t.Fatalf("expected no current token but error was: %v", err)
+	}
+	tokens, err := store.AllTokens()
+	if err != nil {
+		t.Fatalf("unexpected error listing all tokens: %v", err)
+	}
+	if len(tokens) != 1 {
+		t.Fatalf("unexpected number of tokens, got %d expected %d",
+			len(tokens), 1)
+	}
+	for _, token := range tokens {
+		if token.Preimage != paidPreimage ||
+			token.AmountPaid != paidToken.AmountPaid ||
+			token.RoutingFeePaid != paidToken.RoutingFeePaid ||
+			!token.TimeCreated.Equal(paidToken.TimeCreated) ||
+			!token.Expiry.Equal(paidToken.Expiry) ||
+			!token.baseMac.Equal(paidToken.baseMac) {
+
+			t.Fatalf("expected token to match paid token")
+		}
+	}
+
+	// A new token can be bought now and becomes the current one. But it
+	// can't be replaced as long as it's valid.
+	if err := store.StoreToken(newToken); err != nil {
+		t.Fatalf("could not save new token: %v", err)
+	}
+	token, err = store.CurrentToken()
+	if err != nil {
+		t.Fatalf("could not read new token: %v", err)
+	}
+	if token.PaymentHash != newToken.PaymentHash {
+		t.Fatalf("expected new token to be the current token")
+	}
+	err = store.StoreToken(pendingToken)
+	if err != errNoReplace {
+		t.Fatalf("unexpected error. got %v, expected %v", err,
+			errNoReplace)
+	}
+
+	// The other host must not see any of the tokens.
+	_, err = otherStore.CurrentToken()
+	if err != ErrNoToken {
+		t.Fatalf("expected other store to be empty but error was: %v",
+			err)
+	}
+	if err := otherStore.StoreToken(pendingToken); err != nil {
+		t.Fatalf("could not save pending token: %v", err)
+	}
+
+	allTokens, err := dir.AllTokens()
+	if err != nil {
+		t.Fatalf("unexpected error listing all tokens: %v", err)
+	}
+	if len(allTokens) != 3 {
+		t.Fatalf("unexpected number of tokens, got %d expected %d",
+			len(allTokens), 3)
+	}
+	if allTokens[0].Host != "example.com:8080" ||
+		allTokens[2].Host != "other.example.com" {
+
+		t.Fatalf("unexpected hosts of tokens")
+	}
+
+	// Only the expired paid token should be pruned, the expired pending
+	// token might still be paid.
+	pruned, err := dir.PruneExpired(now)
+	if err != nil {
+		t.Fatalf("unexpected error pruning tokens: %v", err)
+	}
+	if len(pruned) != 1 || pruned[0].PaymentHash != paidToken.PaymentHash ||
+		pruned[0].Host != "example.com:8080" {
+
+		t.Fatalf("unexpected pruned tokens: %v", pruned)
+	}
+	allTokens, err = dir.AllTokens()
+	if err != nil {
+		t.Fatalf("unexpected error listing all tokens: %v", err)
+	}
+	if len(allTokens) != 2 {
+		t.Fatalf("unexpected number of tokens, got %d expected %d",
+			len(allTokens), 2)
+	}
+
+	// Finally, the pending token of the other host can be removed.
+	if err := otherStore.RemovePendingToken(); err != nil {
+		t.Fatalf("could not remove pending token: %v", err)
+	}
+	err = otherStore.RemovePendingToken()
+	if err != ErrNoToken {
+		t.Fatalf("unexpected error. got %v, expected %v", err,
+			ErrNoToken)
+	}
+}
@@ -0,0 +1,259 @@
+package lsat
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/lightninglabs/lndclient"
+)
+
+// Transport is an http.RoundTripper that can handle LSAT authentication
+// challenges with embedded payment requests. If a server answers a request with
+// 402 Payment Required, the invoice in the challenge is paid through lnd, the
+// resulting token is saved in the store and the request is sent again with the
+// token attached. If the store already contains a paid token, it is attached
+// to every request right away.
+type Transport struct {
+	base        http.RoundTripper
+	interceptor *ClientInterceptor
+}
+
+// A compile-time check to make sure Transport implements http.RoundTripper.
+var _ http.RoundTripper = (*Transport)(nil)
+
+// NewTransport creates a new LSAT aware HTTP transport that uses the provided
+// lnd connection to automatically acquire and pay for LSAT tokens, unless the
+// indicated store already contains a usable token. If base is nil,
+// http.DefaultTransport is used to send the actual requests.
+func NewTransport(base http.RoundTripper, lnd *lndclient.LndServices,
+	store Store, maxCost, maxFee btcutil.Amount) *Transport {
+
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &Transport{
+		base: base,
+		interceptor: NewInterceptor(
+			lnd, store, 0, maxCost, maxFee, false,
+		),
+	}
+}
+
+// NewTransportWithPayFunc creates a new LSAT aware HTTP transport that uses the
+// provided payment function to pay for LSAT tokens. See
+// NewInterceptorWithPayFunc for the limitations of this mode.
+func NewTransportWithPayFunc(base http.RoundTripper, payFunc PayFunc,
+	chainParams *chaincfg.Params, store Store, maxCost,
+	maxFee btcutil.Amount) *Transport {
+
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &Transport{
+		base: base,
+		interceptor: NewInterceptorWithPayFunc(
+			payFunc, chainParams, store, 0, maxCost, maxFee, false,
+		),
+	}
+}
+
+// RoundTrip sends the request to the server, attaching the current token if
+// there is one. If the server responds with an LSAT payment challenge, a new
+// token is paid for and the request is repeated.
+//
+// NOTE: This is part of the http.RoundTripper interface.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// We might need to send the request twice, so we need to be able to
+	// read the body twice as well.
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		body, err := ioutil.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+		req.Body, _ = req.GetBody()
+	}
+
+	token, err := t.paidToken()
+	if err != nil {
+		return nil, err
+	}
+	authReq, err := requestWithToken(req, token)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(authReq)
+	if err != nil || resp.StatusCode != http.StatusPaymentRequired {
+		return resp, err
+	}
+
+	// Servers might respond with 402 for other reasons than LSAT, in that
+	// case there is nothing we can do.
+	challenge := findChallenge(resp.Header)
+	if challenge == "" {
+		return resp, nil
+	}
+
+	newToken, err := t.acquireToken(req.Context(), challenge, token)
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, err
+	}
+
+	// If the token we already sent was rejected and there is no new one,
+	// we just return the server's response.
+	if newToken == nil {
+		return resp, nil
+	}
+
+	// Throw away the challenge response and send the request again, now
+	// with the paid token attached.
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	retryReq, err := requestWithToken(req, newToken)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetBody != nil {
+		retryReq.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t.base.RoundTrip(retryReq)
+}
+
+// paidToken returns the current token of the store if it was paid for already
+// or nil if there is no such token.
+func (t *Transport) paidToken() (*Token, error) {
+	t.interceptor.lock.Lock()
+	defer t.interceptor.lock.Unlock()
+
+	token, err := t.interceptor.store.CurrentToken()
+	switch {
+	case err == ErrNoToken:
+		return nil, nil
+
+	case err != nil:
+		return nil, fmt.Errorf("getting token from store failed: %v",
+			err)
+
+	// We never send a pending token since we know it's not valid. We only
+	// resume the payment once we know a token is required.
+	case token.isPending():
+		return nil, nil
+
+	default:
+		return token, nil
+	}
+}
+
+// acquireToken obtains a paid token after the server sent the given challenge
+// in response to a request with the given (possibly nil) token. Depending on
+// the state of the store, a pending payment is resumed or a new token is paid
+// for. If another request acquired a new token in the meantime, that token is
+// returned. If the sent token is still the current one, nil is returned.
+func (t *Transport) acquireToken(ctx context.Context, challenge string,
+	sentToken *Token) (*Token, error) {
+
+	// To avoid paying for a token twice if two parallel requests are
+	// happening, we require an exclusive lock here.
+	i := t.interceptor
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	token, err := i.store.CurrentToken()
+	switch {
+	// We don't have a token yet, get a new one.
+	case err == ErrNoToken:
+		log.Infof("Payment of LSAT token is required, paying invoice")
+		return i.payChallenge(ctx, challenge)
+
+	case err != nil:
+		return nil, fmt.Errorf("getting token from store failed: %v",
+			err)
+
+	// Resume/track a pending payment if it was interrupted for some reason.
+	case token.isPending():
+		log.Infof("Payment of LSAT token is required, resuming/" +
+			"tracking previous payment from pending LSAT token")
+		err := i.trackPayment(ctx, token)
+
+		// If the payment failed for good, it will never come back to a
+		// success state. We need to remove the pending token and try
+		// again.
+		if err == errPaymentFailedTerminally {
+			if err := i.store.RemovePendingToken(); err != nil {
+				return nil, fmt.Errorf("error removing "+
+					"pending token, cannot retry payment: "+
+					"%v", err)
+			}
+
+			log.Infof("Retrying payment of LSAT token invoice")
+			return i.payChallenge(ctx, challenge)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return token, nil
+
+	// The server rejected the token we sent and we don't have a newer one.
+	case sentToken != nil && sentToken.PaymentHash == token.PaymentHash:
+		log.Warnf("Server rejected current LSAT token")
+		return nil, nil
+
+	// Another request already paid for a new token while we were waiting
+	// for the lock.
+	default:
+		log.Debugf("Found valid LSAT token to add to request")
+		return token, nil
+	}
+}
+
+// requestWithToken returns a shallow copy of the request with the given token
+// attached in the Authorization header. If the token is nil, the original
+// request is returned.
+func requestWithToken(req *http.Request, token *Token) (*http.Request,
+	error) {
+
+	if token == nil {
+		return req, nil
+	}
+
+	// A round tripper must not modify the original request, so we need to
+	// clone it before setting the header.
+	newReq := req.Clone(req.Context())
+	err := SetHeader(&newReq.Header, token.BaseMacaroon(), token.Preimage)
+	if err != nil {
+		return nil, fmt.Errorf("adding macaroon failed: %v", err)
+	}
+
+	return newReq, nil
+}
+
+// findChallenge returns the first LSAT payment challenge in the given response
+// header or an empty string if there is none.
+func findChallenge(header http.Header) string {
+	for _, challenge := range header.Values(AuthHeader) {
+		if authHeaderRegex.MatchString(challenge) {
+			return challenge
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,101 @@
+package lsat
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/lndclient"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTransport makes sure the LSAT aware HTTP transport pays for a token when
+// the server sends a challenge and repeats the request with the paid token.
+func TestTransport(t *testing.T) {
+	var (
+		numCalls  int
+		lastAuth  string
+		lastBody  string
+		transport = NewTransport(
+			nil, &lnd.LndServices, store, DefaultMaxCostSats,
+			DefaultMaxRoutingFeeSats,
+		)
+	)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			numCalls++
+			lastAuth = r.Header.Get(HeaderAuthorization)
+			body, _ := ioutil.ReadAll(r.Body)
+			lastBody = string(body)
+
+			if lastAuth == "" {
+				w.Header().Set(
+					AuthHeader, makeAuthHeader(testMacBytes),
+				)
+				w.WriteHeader(http.StatusPaymentRequired)
+				return
+			}
+
+			_, _ = w.Write([]byte("paid content"))
+		},
+	))
+	defer server.Close()
+
+	client := &http.Client{Transport: transport}
+
+	// Without a token in the store, the challenge needs to be paid first.
+	// The payment happens in the background so we can serve the lnd mock.
+	store.token = nil
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	resultChan := make(chan result, 1)
+	go func() {
+		resp, err := client.Post(
+			server.URL, "text/plain", strings.NewReader("body"),
+		)
+		resultChan <- result{resp, err}
+	}()
+
+	select {
+	case payment := <-lnd.SendPaymentChannel:
+		payment.Done <- lndclient.PaymentResult{
+			Preimage: paidPreimage,
+			PaidAmt:  500,
+			PaidFee:  1,
+		}
+
+	case <-time.After(testTimeout):
+		t.Fatalf("no payment request received")
+	}
+
+	res := <-resultChan
+	require.NoError(t, res.err)
+	content, err := ioutil.ReadAll(res.resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.resp.Body.Close())
+
+	require.Equal(t, http.StatusOK, res.resp.StatusCode)
+	require.Equal(t, "paid content", string(content))
+	require.Equal(t, 2, numCalls)
+	require.Equal(t, "body", lastBody)
+	require.Contains(t, lastAuth, paidPreimage.String())
+
+	storeToken, err := store.CurrentToken()
+	require.NoError(t, err)
+	require.Equal(t, paidPreimage, storeToken.Preimage)
+
+	// With a paid token in the store, it's attached to the first request
+	// right away.
+	numCalls = 0
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 1, numCalls)
+	require.Contains(t, lastAuth, paidPreimage.String())
+}
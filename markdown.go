@@ -0,0 +1,829 @@
+package aperture
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	// mdHeadingRegexp matches an ATX heading like "## Title".
+	mdHeadingRegexp = regexp.MustCompile(
+		`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`,
+	)
+
+	// mdSetextRegexp matches the underline of a setext heading.
+	mdSetextRegexp = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+
+	// mdRuleRegexp matches a thematic break like "---" or "* * *".
+	mdRuleRegexp = regexp.MustCompile(
+		`^ {0,3}(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})$`,
+	)
+
+	// mdFenceRegexp matches the opening line of a fenced code block along
+	// with its info string.
+	mdFenceRegexp = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})[ \t]*([^`]*)$")
+
+	// mdListRegexp matches the first line of a list item, like "- item" or
+	// "2. item".
+	mdListRegexp = regexp.MustCompile(
+		`^( {0,3})([-*+]|[0-9]{1,9}[.)])([ \t]+|$)(.*)$`,
+	)
+
+	// mdTableSepRegexp matches the delimiter row below the header of a
+	// table, like "| --- | :-: |".
+	mdTableSepRegexp = regexp.MustCompile(
+		`^ {0,3}\|?[ \t]*:?-+:?[ \t]*(\|[ \t]*:?-+:?[ \t]*)*\|?[ \t]*$`,
+	)
+
+	// mdAutolinkRegexp matches an autolink like <https://example.com>.
+	mdAutolinkRegexp = regexp.MustCompile(
+		`^<((?:https?://|mailto:)[^\s<>]+)>`,
+	)
+
+	// mdTagRegexp matches the tags of rendered inline content.
+	mdTagRegexp = regexp.MustCompile(`<[^>]*>`)
+)
+
+// markdownRenderer renders Markdown documents as HTML. It supports the common
+// block and inline elements of CommonMark and the tables of GitHub flavored
+// Markdown. Raw HTML in documents is escaped and links may only use the http,
+// https and mailto schemes, so a document can't inject scripts into a page.
+type markdownRenderer struct {
+	out strings.Builder
+
+	// title is the text of the first top-level heading.
+	title string
+
+	// ids counts the headings with each anchor ID, so the IDs are unique.
+	ids map[string]int
+}
+
+// renderMarkdown renders the Markdown document as HTML and returns it along
+// with the text of its first top-level heading, which serves as its title.
+func renderMarkdown(src string) (string, string) {
+	r := &markdownRenderer{ids: make(map[string]int)}
+
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = expandIndent(line)
+	}
+	r.blocks(lines, false)
+
+	return r.out.String(), r.title
+}
+
+// blocks renders the block elements of the given lines. The paragraphs of
+// tight list items are rendered without paragraph tags.
+func (r *markdownRenderer) blocks(lines []string, tight bool) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+
+		case indent(line) >= 4:
+			i = r.indentedCode(lines, i)
+
+		case mdFenceRegexp.MatchString(line):
+			i = r.fencedCode(lines, i)
+
+		case mdHeadingRegexp.MatchString(line):
+			m := mdHeadingRegexp.FindStringSubmatch(line)
+			r.heading(len(m[1]), m[2])
+			i++
+
+		case mdRuleRegexp.MatchString(line):
+			r.out.WriteString("<hr>\n")
+			i++
+
+		case strings.HasPrefix(strings.TrimLeft(line, " "), ">"):
+			i = r.blockquote(lines, i)
+
+		case mdListRegexp.MatchString(line):
+			i = r.list(lines, i)
+
+		case isTableStart(lines, i):
+			i = r.table(lines, i)
+
+		default:
+			i = r.paragraph(lines, i, tight)
+		}
+	}
+}
+
+// heading renders a heading with an anchor ID derived from its text.
+func (r *markdownRenderer) heading(level int, text string) {
+	content := renderInline(text)
+	plain := plainText(content)
+	if level == 1 && r.title == "" {
+		r.title = plain
+	}
+
+	id := headingID(plain)
+	if n := r.ids[id]; n > 0 {
+		r.ids[id]++
+		id = fmt.Sprintf("%s-%d", id, n)
+	} else {
+		r.ids[id] = 1
+	}
+
+	fmt.Fprintf(&r.out, "<h%d id=\"%s\">%s</h%d>\n", level,
+		html.EscapeString(id), content, level)
+}
+
+// paragraph renders the paragraph that starts at the given line, which turns
+// into a heading if it's underlined. It returns the index of the line after
+// the paragraph.
+func (r *markdownRenderer) paragraph(lines []string, i int, tight bool) int {
+	var text []string
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if isBlank(line) {
+			break
+		}
+		if len(text) > 0 {
+			m := mdSetextRegexp.FindStringSubmatch(line)
+			if m != nil {
+				level := 1
+				if m[1][0] == '-' {
+					level = 2
+				}
+				r.heading(level, strings.Join(text, "\n"))
+				return i + 1
+			}
+			if startsBlock(line) {
+				break
+			}
+		}
+		text = append(text, strings.TrimLeft(line, " "))
+	}
+
+	content := renderInline(
+		strings.TrimRight(strings.Join(text, "\n"), " "),
+	)
+	if tight {
+		r.out.WriteString(content)
+		return i
+	}
+	r.out.WriteString("<p>" + content + "</p>\n")
+	return i
+}
+
+// fencedCode renders the fenced code block that starts at the given line. It
+// returns the index of the line after the closing fence.
+func (r *markdownRenderer) fencedCode(lines []string, i int) int {
+	m := mdFenceRegexp.FindStringSubmatch(lines[i])
+	fence, info := m[1], strings.Fields(m[2])
+	offset := indent(lines[i])
+
+	r.out.WriteString("<pre><code")
+	if len(info) > 0 {
+		fmt.Fprintf(&r.out, " class=\"language-%s\"",
+			html.EscapeString(info[0]))
+	}
+	r.out.WriteString(">")
+	for i++; i < len(lines); i++ {
+		closing := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(closing, fence) &&
+			strings.Trim(closing, fence[:1]) == "" {
+
+			i++
+			break
+		}
+		line := trimIndent(lines[i], offset)
+		r.out.WriteString(html.EscapeString(line) + "\n")
+	}
+	r.out.WriteString("</code></pre>\n")
+
+	return i
+}
+
+// indentedCode renders the indented code block that starts at the given line.
+// It returns the index of the line after the block.
+func (r *markdownRenderer) indentedCode(lines []string, i int) int {
+	var code []string
+	for ; i < len(lines); i++ {
+		if !isBlank(lines[i]) && indent(lines[i]) < 4 {
+			break
+		}
+		code = append(code, trimIndent(lines[i], 4))
+	}
+
+	// Trailing blank lines separate the block from the next one.
+	end := len(code)
+	for end > 0 && isBlank(code[end-1]) {
+		end--
+		i--
+	}
+
+	r.out.WriteString("<pre><code>")
+	for _, line := range code[:end] {
+		r.out.WriteString(html.EscapeString(line) + "\n")
+	}
+	r.out.WriteString("</code></pre>\n")
+
+	return i
+}
+
+// blockquote renders the block quote that starts at the given line. It
+// returns the index of the line after the quote.
+func (r *markdownRenderer) blockquote(lines []string, i int) int {
+	var quoted []string
+	for ; i < len(lines); i++ {
+		line := strings.TrimLeft(lines[i], " ")
+		if strings.HasPrefix(line, ">") && indent(lines[i]) < 4 {
+			line = strings.TrimPrefix(line[1:], " ")
+			quoted = append(quoted, line)
+			continue
+		}
+
+		// A paragraph of the quote may continue on lines without a
+		// marker.
+		last := len(quoted) - 1
+		if isBlank(lines[i]) || startsBlock(lines[i]) ||
+			isBlank(quoted[last]) {
+
+			break
+		}
+		quoted = append(quoted, lines[i])
+	}
+
+	r.out.WriteString("<blockquote>\n")
+	r.blocks(quoted, false)
+	r.out.WriteString("</blockquote>\n")
+
+	return i
+}
+
+// list renders the list that starts at the given line. Its items are tight,
+// so their paragraphs are rendered without paragraph tags, unless they're
+// separated by blank lines. It returns the index of the line after the list.
+func (r *markdownRenderer) list(lines []string, i int) int {
+	first := mdListRegexp.FindStringSubmatch(lines[i])
+	kind := listKind(first[2])
+
+	var (
+		items [][]string
+		tight = true
+	)
+	for i < len(lines) {
+		m := mdListRegexp.FindStringSubmatch(lines[i])
+		if m == nil || listKind(m[2]) != kind {
+			break
+		}
+
+		// The content of the item is indented to its first character.
+		offset := len(m[1]) + len(m[2]) + len(m[3])
+		if m[4] == "" || len(m[3]) > 4 {
+			offset = len(m[1]) + len(m[2]) + 1
+		}
+		item := []string{strings.TrimLeft(m[4], " \t")}
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if isBlank(line) {
+				next := i
+				for next < len(lines) && isBlank(lines[next]) {
+					next++
+				}
+				if next == len(lines) ||
+					indent(lines[next]) < offset {
+
+					break
+				}
+				item = append(item, "")
+				tight = false
+				continue
+			}
+			if indent(line) >= offset {
+				item = append(item, trimIndent(line, offset))
+				continue
+			}
+
+			// A paragraph of the item may continue on lines that
+			// aren't indented, unless they start the next item.
+			if startsBlock(line) || isBlank(item[len(item)-1]) ||
+				mdListRegexp.MatchString(line) {
+
+				break
+			}
+			item = append(item, line)
+		}
+		items = append(items, item)
+
+		// Items separated by blank lines make the list loose.
+		next := i
+		for next < len(lines) && isBlank(lines[next]) {
+			next++
+		}
+		if next > i {
+			if next == len(lines) {
+				break
+			}
+			m := mdListRegexp.FindStringSubmatch(lines[next])
+			if m == nil || listKind(m[2]) != kind {
+				break
+			}
+			tight = false
+			i = next
+		}
+	}
+
+	tag := "ul"
+	if kind == "." || kind == ")" {
+		tag = "ol"
+		start, _ := strconv.Atoi(first[2][:len(first[2])-1])
+		if start != 1 {
+			fmt.Fprintf(&r.out, "<ol start=\"%d\">\n", start)
+		} else {
+			r.out.WriteString("<ol>\n")
+		}
+	} else {
+		r.out.WriteString("<ul>\n")
+	}
+	for _, item := range items {
+		r.out.WriteString("<li>")
+		r.blocks(item, tight)
+		r.out.WriteString("</li>\n")
+	}
+	r.out.WriteString("</" + tag + ">\n")
+
+	return i
+}
+
+// table renders the table whose header is at the given line. It returns the
+// index of the line after the table.
+func (r *markdownRenderer) table(lines []string, i int) int {
+	header := tableCells(lines[i])
+	var aligns []string
+	for _, cell := range tableCells(lines[i+1]) {
+		left := strings.HasPrefix(cell, ":")
+		right := strings.HasSuffix(cell, ":")
+		switch {
+		case left && right:
+			aligns = append(aligns, "center")
+		case right:
+			aligns = append(aligns, "right")
+		case left:
+			aligns = append(aligns, "left")
+		default:
+			aligns = append(aligns, "")
+		}
+	}
+
+	row := func(cells []string, tag string) {
+		r.out.WriteString("<tr>\n")
+		for col := range header {
+			var cell string
+			if col < len(cells) {
+				cell = cells[col]
+			}
+			r.out.WriteString("<" + tag)
+			if col < len(aligns) && aligns[col] != "" {
+				fmt.Fprintf(&r.out, " style=\"text-align: %s\"",
+					aligns[col])
+			}
+			r.out.WriteString(">" + renderInline(cell))
+			r.out.WriteString("</" + tag + ">\n")
+		}
+		r.out.WriteString("</tr>\n")
+	}
+
+	r.out.WriteString("<table>\n<thead>\n")
+	row(header, "th")
+	r.out.WriteString("</thead>\n<tbody>\n")
+	for i += 2; i < len(lines); i++ {
+		if isBlank(lines[i]) || startsBlock(lines[i]) {
+			break
+		}
+		row(tableCells(lines[i]), "td")
+	}
+	r.out.WriteString("</tbody>\n</table>\n")
+
+	return i
+}
+
+// renderInline renders the inline elements of a block, like emphasis, code
+// spans and links. All other text is escaped.
+func renderInline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			b.WriteString("<br>\n")
+			i += 2
+
+		case c == '\\' && i+1 < len(s) && isPunct(s[i+1]):
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+
+		case c == '`':
+			n := runLen(s, i)
+			end := findRun(s, i+n, c, n)
+			if end < 0 {
+				b.WriteString(s[i : i+n])
+				i += n
+				break
+			}
+			code := strings.ReplaceAll(s[i+n:end], "\n", " ")
+			if len(code) > 2 && code[0] == ' ' &&
+				code[len(code)-1] == ' ' {
+
+				code = code[1 : len(code)-1]
+			}
+			b.WriteString("<code>" + html.EscapeString(code) +
+				"</code>")
+			i = end + n
+
+		case c == '!' && i+1 < len(s) && s[i+1] == '[':
+			if next, ok := writeLink(&b, s, i+1, true); ok {
+				i = next
+				break
+			}
+			b.WriteString("!")
+			i++
+
+		case c == '[':
+			if next, ok := writeLink(&b, s, i, false); ok {
+				i = next
+				break
+			}
+			b.WriteString("[")
+			i++
+
+		case c == '<':
+			m := mdAutolinkRegexp.FindStringSubmatch(s[i:])
+			if m != nil {
+				text := strings.TrimPrefix(m[1], "mailto:")
+				b.WriteString("<a href=\"" +
+					html.EscapeString(m[1]) + "\">" +
+					html.EscapeString(text) + "</a>")
+				i += len(m[0])
+				break
+			}
+			b.WriteString("&lt;")
+			i++
+
+		case c == '*' || c == '_':
+			if next, ok := writeEmphasis(&b, s, i); ok {
+				i = next
+				break
+			}
+			n := runLen(s, i)
+			b.WriteString(s[i : i+n])
+			i += n
+
+		case c == ' ':
+			// Two spaces at the end of a line are a hard break.
+			n := runLen(s, i)
+			if n >= 2 && i+n < len(s) && s[i+n] == '\n' {
+				b.WriteString("<br>\n")
+				i += n + 1
+				break
+			}
+			b.WriteString(s[i : i+n])
+			i += n
+
+		default:
+			next := i + 1
+			for next < len(s) && !strings.ContainsRune(
+				"\\`![<*_ ", rune(s[next]),
+			) {
+				next++
+			}
+			b.WriteString(html.EscapeString(s[i:next]))
+			i = next
+		}
+	}
+
+	return b.String()
+}
+
+// writeLink writes the link or image whose text starts with the bracket at
+// the given position. It returns the position after the link, or false if
+// there is no link.
+func writeLink(b *strings.Builder, s string, i int, image bool) (int, bool) {
+	end := matchingDelim(s, i, '[', ']')
+	if end < 0 || end+1 >= len(s) || s[end+1] != '(' {
+		return 0, false
+	}
+	closing := matchingDelim(s, end+1, '(', ')')
+	if closing < 0 {
+		return 0, false
+	}
+
+	// The destination may be followed by a title.
+	dest := strings.TrimSpace(s[end+2 : closing])
+	var title string
+	if k := strings.IndexAny(dest, " \t\n"); k >= 0 {
+		title = strings.Trim(strings.TrimSpace(dest[k:]), `"'`)
+		dest = dest[:k]
+	}
+	dest = strings.TrimSuffix(strings.TrimPrefix(dest, "<"), ">")
+	href := html.EscapeString(safeURL(dest))
+
+	text := s[i+1 : end]
+	if image {
+		b.WriteString("<img src=\"" + href + "\" alt=\"" +
+			html.EscapeString(plainText(renderInline(text))) + "\"")
+	} else {
+		b.WriteString("<a href=\"" + href + "\"")
+	}
+	if title != "" {
+		b.WriteString(" title=\"" + html.EscapeString(title) + "\"")
+	}
+	if image {
+		b.WriteString(">")
+	} else {
+		b.WriteString(">" + renderInline(text) + "</a>")
+	}
+
+	return closing + 1, true
+}
+
+// writeEmphasis writes the emphasis that is opened by the run of delimiters
+// at the given position. One delimiter emphasizes the text, two make it
+// strong and three both. It returns the position after the emphasis, or false
+// if it isn't closed.
+func writeEmphasis(b *strings.Builder, s string, i int) (int, bool) {
+	c := s[i]
+	n := runLen(s, i)
+	if n > 3 {
+		return 0, false
+	}
+
+	// An opening delimiter must be followed by text. Underscores also
+	// can't open an emphasis within a word, like in snake_case.
+	if i+n >= len(s) || unicode.IsSpace(rune(s[i+n])) {
+		return 0, false
+	}
+	if c == '_' && i > 0 && isWordChar(s[i-1]) {
+		return 0, false
+	}
+
+	for j := i + n; j < len(s); {
+		k := strings.IndexByte(s[j:], c)
+		if k < 0 {
+			return 0, false
+		}
+		k += j
+
+		// Skip code spans, so their content isn't emphasized.
+		if tick := strings.IndexByte(s[j:k], '`'); tick >= 0 {
+			tick += j
+			ticks := runLen(s, tick)
+			if end := findRun(s, tick+ticks, '`', ticks); end > 0 {
+				j = end + ticks
+				continue
+			}
+		}
+
+		run := runLen(s, k)
+		closes := run == n && !unicode.IsSpace(rune(s[k-1])) &&
+			(c != '_' || k+n >= len(s) || !isWordChar(s[k+n]))
+		if !closes {
+			j = k + run
+			continue
+		}
+
+		inner := renderInline(s[i+n : k])
+		switch n {
+		case 1:
+			b.WriteString("<em>" + inner + "</em>")
+		case 2:
+			b.WriteString("<strong>" + inner + "</strong>")
+		default:
+			b.WriteString("<em><strong>" + inner + "</strong></em>")
+		}
+		return k + n, true
+	}
+
+	return 0, false
+}
+
+// safeURL returns the link destination, or "#" if it uses a scheme other than
+// http, https or mailto, like javascript.
+func safeURL(dest string) string {
+	k := strings.IndexAny(dest, ":/?#")
+	if k <= 0 || dest[k] != ':' {
+		return dest
+	}
+
+	switch strings.ToLower(dest[:k]) {
+	case "http", "https", "mailto":
+		return dest
+
+	default:
+		return "#"
+	}
+}
+
+// startsBlock returns true if the line starts a block that interrupts a
+// paragraph.
+func startsBlock(line string) bool {
+	if indent(line) >= 4 {
+		return false
+	}
+	if mdFenceRegexp.MatchString(line) ||
+		mdHeadingRegexp.MatchString(line) ||
+		mdRuleRegexp.MatchString(line) ||
+		strings.HasPrefix(strings.TrimLeft(line, " "), ">") {
+
+		return true
+	}
+
+	// Ordered lists only interrupt a paragraph if they start with one.
+	m := mdListRegexp.FindStringSubmatch(line)
+	if m == nil || strings.TrimSpace(m[4]) == "" {
+		return false
+	}
+	kind := listKind(m[2])
+	return kind != "." && kind != ")" || m[2][:len(m[2])-1] == "1"
+}
+
+// isTableStart returns true if the given line is the header of a table.
+func isTableStart(lines []string, i int) bool {
+	return i+1 < len(lines) && strings.Contains(lines[i], "|") &&
+		strings.Contains(lines[i+1], "|") &&
+		mdTableSepRegexp.MatchString(lines[i+1])
+}
+
+// tableCells splits a row of a table into its cells. Escaped pipes are part
+// of a cell.
+func tableCells(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+
+	var (
+		cells []string
+		cell  strings.Builder
+	)
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+
+		case line[i] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+
+		default:
+			cell.WriteByte(line[i])
+		}
+	}
+
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+// listKind returns the bullet of an unordered list or the delimiter of an
+// ordered list, so items of different lists can be told apart.
+func listKind(marker string) string {
+	return marker[len(marker)-1:]
+}
+
+// headingID returns the anchor ID of a heading with the given text, like
+// "getting-started" for "Getting Started".
+func headingID(text string) string {
+	var id strings.Builder
+	for _, c := range strings.ToLower(text) {
+		switch {
+		case unicode.IsLetter(c) || unicode.IsDigit(c) || c == '-' ||
+			c == '_':
+
+			id.WriteRune(c)
+
+		case unicode.IsSpace(c):
+			id.WriteRune('-')
+		}
+	}
+	if id.Len() == 0 {
+		return "section"
+	}
+
+	return id.String()
+}
+
+// plainText returns the text of rendered inline content without its tags.
+func plainText(content string) string {
+	return html.UnescapeString(mdTagRegexp.ReplaceAllString(content, ""))
+}
+
+// matchingDelim returns the position of the delimiter that closes the one at
+// the given position, or -1 if it isn't closed.
+func matchingDelim(s string, i int, open, closing byte) int {
+	depth := 0
+	for ; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+
+		case open:
+			depth++
+
+		case closing:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// runLen returns the number of times the character at the given position is
+// repeated from there.
+func runLen(s string, i int) int {
+	n := 1
+	for i+n < len(s) && s[i+n] == s[i] {
+		n++
+	}
+
+	return n
+}
+
+// findRun returns the position of the next run of exactly n of the given
+// characters from the given position, or -1 if there is none.
+func findRun(s string, i int, c byte, n int) int {
+	for i < len(s) {
+		k := strings.IndexByte(s[i:], c)
+		if k < 0 {
+			return -1
+		}
+		k += i
+
+		run := runLen(s, k)
+		if run == n {
+			return k
+		}
+		i = k + run
+	}
+
+	return -1
+}
+
+// expandIndent replaces the tabs of the indentation of a line with spaces up
+// to the next multiple of four columns.
+func expandIndent(line string) string {
+	var (
+		expanded strings.Builder
+		col      int
+	)
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case ' ':
+			expanded.WriteByte(' ')
+			col++
+
+		case '\t':
+			n := 4 - col%4
+			expanded.WriteString(strings.Repeat(" ", n))
+			col += n
+
+		default:
+			return expanded.String() + line[i:]
+		}
+	}
+
+	return expanded.String()
+}
+
+// indent returns the number of spaces a line is indented with.
+func indent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// trimIndent removes up to n spaces of indentation from a line.
+func trimIndent(line string, n int) string {
+	if i := indent(line); i < n {
+		n = i
+	}
+
+	return line[n:]
+}
+
+// isBlank returns true if the line only contains whitespace.
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// isPunct returns true if the character is ASCII punctuation, which can be
+// escaped with a backslash.
+func isPunct(c byte) bool {
+	return c < 0x80 && (unicode.IsPunct(rune(c)) ||
+		unicode.IsSymbol(rune(c)))
+}
+
+// isWordChar returns true if the character is part of a word.
+func isWordChar(c byte) bool {
+	return c >= 0x80 || unicode.IsLetter(rune(c)) ||
+		unicode.IsDigit(rune(c))
+}
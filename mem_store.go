@@ -0,0 +1,143 @@
+package aperture
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/tor"
+)
+
+const (
+	// storeEtcd is the name of the store that keeps the state of aperture
+	// in an etcd cluster. It's the default.
+	storeEtcd = "etcd"
+
+	// storeMemory is the name of the store that keeps the state of
+	// aperture in memory only. Everything is lost on restart.
+	storeMemory = "memory"
+)
+
+// memSecretStore is a secret store that keeps the LSAT secrets in memory. All
+// tokens become invalid when aperture is restarted, which makes it only
+// suitable for tests, demos and ephemeral environments.
+type memSecretStore struct {
+	sync.Mutex
+	secrets map[[sha256.Size]byte][lsat.SecretSize]byte
+}
+
+// A compile-time constraint to ensure memSecretStore implements
+// mint.SecretStore.
+var _ mint.SecretStore = (*memSecretStore)(nil)
+
+// newMemSecretStore creates a new, empty in-memory secret store.
+func newMemSecretStore() *memSecretStore {
+	return &memSecretStore{
+		secrets: make(map[[sha256.Size]byte][lsat.SecretSize]byte),
+	}
+}
+
+// NewSecret creates a new cryptographically random secret which is keyed by the
+// given hash.
+//
+// NOTE: This is part of the mint.SecretStore interface.
+func (s *memSecretStore) NewSecret(_ context.Context,
+	id [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
+
+	var secret [lsat.SecretSize]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return secret, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.secrets[id] = secret
+	return secret, nil
+}
+
+// GetSecret returns the secret that corresponds to the given hash. If there is
+// no secret, then mint.ErrSecretNotFound is returned.
+//
+// NOTE: This is part of the mint.SecretStore interface.
+func (s *memSecretStore) GetSecret(_ context.Context,
+	id [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	secret, ok := s.secrets[id]
+	if !ok {
+		return secret, mint.ErrSecretNotFound
+	}
+
+	return secret, nil
+}
+
+// RevokeSecret removes the secret that corresponds to the given hash. This
+// acts as a NOP if the secret does not exist.
+//
+// NOTE: This is part of the mint.SecretStore interface.
+func (s *memSecretStore) RevokeSecret(_ context.Context,
+	id [sha256.Size]byte) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.secrets, id)
+	return nil
+}
+
+// memOnionStore is an in-memory implementation of tor.OnionStore. A new onion
+// address is created every time aperture is started.
+type memOnionStore struct {
+	sync.Mutex
+	keys map[tor.OnionType][]byte
+}
+
+// A compile-time constraint to ensure memOnionStore implements tor.OnionStore.
+var _ tor.OnionStore = (*memOnionStore)(nil)
+
+// newMemOnionStore creates a new, empty in-memory onion store.
+func newMemOnionStore() *memOnionStore {
+	return &memOnionStore{
+		keys: make(map[tor.OnionType][]byte),
+	}
+}
+
+// StorePrivateKey stores the given private key.
+func (s *memOnionStore) StorePrivateKey(onionType tor.OnionType,
+	privateKey []byte) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.keys[onionType] = append([]byte(nil), privateKey...)
+	return nil
+}
+
+// PrivateKey retrieves a stored private key. If it is not found, then
+// ErrNoPrivateKey is returned.
+func (s *memOnionStore) PrivateKey(onionType tor.OnionType) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	privateKey, ok := s.keys[onionType]
+	if !ok {
+		return nil, tor.ErrNoPrivateKey
+	}
+
+	return privateKey, nil
+}
+
+// DeletePrivateKey removes the private key from the store.
+func (s *memOnionStore) DeletePrivateKey(onionType tor.OnionType) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.keys, onionType)
+	return nil
+}
@@ -0,0 +1,139 @@
+package aperture
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	// metadataPrefix is the key we'll use to prefix the metadata of all
+	// tokens with when storing it in an etcd cluster.
+	metadataPrefix = "metadata"
+)
+
+// metadataKey returns the full key to store the metadata of a token in the
+// database. An empty token ID returns the prefix of the metadata of all
+// tokens.
+//
+// The resulting path of the metadata of the token with the ID "abc" within
+// etcd would look like:
+//
+//	lsat/proxy/metadata/abc
+func metadataKey(tokenID string) string {
+	return strings.Join(
+		[]string{topLevelKey, metadataPrefix, tokenID},
+		etcdKeyDelimeter,
+	)
+}
+
+// tokenMetadata is the metadata of a token as it's stored in the database and
+// returned by the admin API.
+type tokenMetadata struct {
+	TokenID  string            `json:"token_id"`
+	Created  time.Time         `json:"created"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// matches returns true if the metadata has all of the given keys and values.
+func (m *tokenMetadata) matches(filter map[string]string) bool {
+	for key, value := range filter {
+		if m.Metadata[key] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// metadataStore is a store of the metadata of tokens backed by an etcd
+// cluster, next to their secrets. The metadata is kept when a secret is
+// revoked, so tokens can still be reconciled afterwards.
+type metadataStore struct {
+	*clientv3.Client
+}
+
+// A compile-time constraint to ensure metadataStore implements
+// mint.MetadataStore.
+var _ mint.MetadataStore = (*metadataStore)(nil)
+
+// newMetadataStore creates a new metadata store backed by the given etcd
+// client.
+func newMetadataStore(client *clientv3.Client) *metadataStore {
+	return &metadataStore{Client: client}
+}
+
+// SetMetadata stores the metadata of the token with the given ID.
+//
+// NOTE: This is part of the mint.MetadataStore interface.
+func (s *metadataStore) SetMetadata(ctx context.Context, tokenID lsat.TokenID,
+	metadata map[string]string) error {
+
+	value, err := json.Marshal(&tokenMetadata{
+		TokenID:  tokenID.String(),
+		Created:  time.Now(),
+		Metadata: metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Put(ctx, metadataKey(tokenID.String()), string(value))
+	return err
+}
+
+// metadata returns the metadata of the token with the given ID, or nil if it
+// has none.
+func (s *metadataStore) metadata(ctx context.Context,
+	tokenID lsat.TokenID) (*tokenMetadata, error) {
+
+	resp, err := s.Get(ctx, metadataKey(tokenID.String()))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+
+	metadata := &tokenMetadata{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// find returns the metadata of all tokens that have the given keys and values,
+// oldest first.
+func (s *metadataStore) find(ctx context.Context,
+	filter map[string]string) ([]*tokenMetadata, error) {
+
+	resp, err := s.Get(
+		ctx, metadataKey(""), clientv3.WithPrefix(),
+		clientv3.WithSort(
+			clientv3.SortByCreateRevision, clientv3.SortAscend,
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]*tokenMetadata, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		metadata := &tokenMetadata{}
+		if err := json.Unmarshal(kv.Value, metadata); err != nil {
+			log.Errorf("Invalid token metadata %s: %v", kv.Key,
+				err)
+			continue
+		}
+		if metadata.matches(filter) {
+			tokens = append(tokens, metadata)
+		}
+	}
+
+	return tokens, nil
+}
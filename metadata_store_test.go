@@ -0,0 +1,54 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMetadataStore tests that the metadata of tokens can be looked up by
+// their ID and found by their keys and values.
+func TestMetadataStore(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	var (
+		ctx   = context.Background()
+		store = newMetadataStore(etcdClient)
+		pro   = lsat.TokenID{1}
+		basic = lsat.TokenID{2}
+	)
+
+	err := store.SetMetadata(ctx, pro, map[string]string{
+		"plan": "pro", "customer": "alice",
+	})
+	require.NoError(t, err)
+	err = store.SetMetadata(ctx, basic, map[string]string{
+		"plan": "basic", "customer": "alice",
+	})
+	require.NoError(t, err)
+
+	metadata, err := store.metadata(ctx, pro)
+	require.NoError(t, err)
+	require.Equal(t, pro.String(), metadata.TokenID)
+	require.Equal(t, "alice", metadata.Metadata["customer"])
+
+	metadata, err = store.metadata(ctx, lsat.TokenID{3})
+	require.NoError(t, err)
+	require.Nil(t, metadata)
+
+	tokens, err := store.find(ctx, map[string]string{"customer": "alice"})
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+	require.Equal(t, pro.String(), tokens[0].TokenID)
+
+	tokens, err = store.find(ctx, map[string]string{
+		"customer": "alice", "plan": "basic",
+	})
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	require.Equal(t, basic.String(), tokens[0].TokenID)
+}
@@ -7,6 +7,8 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"net"
+	"time"
 
 	"github.com/lightninglabs/aperture/lsat"
 	"github.com/lightningnetwork/lnd/lntypes"
@@ -17,6 +19,10 @@ var (
 	// ErrSecretNotFound is an error returned when we attempt to retrieve a
 	// secret by its key but it is not found.
 	ErrSecretNotFound = errors.New("secret not found")
+
+	// ErrChallengerBusy is an error returned by a challenger that is too
+	// busy to take on more work. The request can be retried later.
+	ErrChallengerBusy = errors.New("challenger busy")
 )
 
 // Challenger is an interface used to present requesters of LSATs with a
@@ -48,6 +54,23 @@ type SecretStore interface {
 	RevokeSecret(context.Context, [sha256.Size]byte) error
 }
 
+// MetadataStore is the store the metadata the operator attaches to LSATs is
+// kept in, so it can be reconciled with external billing systems later.
+type MetadataStore interface {
+	// SetMetadata stores the metadata of the LSAT with the given ID.
+	SetMetadata(context.Context, lsat.TokenID, map[string]string) error
+}
+
+// TokenIndex keeps track of the LSATs that were minted, so their secrets and
+// state can be pruned once they expired.
+type TokenIndex interface {
+	// AddToken records a new LSAT with the given ID, the hash its secret
+	// is keyed by and its expiry. A zero expiry means the LSAT doesn't
+	// expire.
+	AddToken(context.Context, lsat.TokenID, [sha256.Size]byte,
+		time.Time) error
+}
+
 // ServiceLimiter abstracts the source of caveats that should be applied to an
 // LSAT for a particular service.
 type ServiceLimiter interface {
@@ -76,6 +99,13 @@ type Config struct {
 	// ServiceLimiter provides us with how we should limit a new LSAT based
 	// on its target services.
 	ServiceLimiter ServiceLimiter
+
+	// Metadata is the optional store of the metadata of new LSATs. If it's
+	// nil, metadata in the context of mint requests is ignored.
+	Metadata MetadataStore
+
+	// Index is the optional index new LSATs are recorded in.
+	Index TokenIndex
 }
 
 // Mint is an entity that is able to mint and verify LSATs for a set of
@@ -105,17 +135,112 @@ func (m *Mint) MintLSAT(ctx context.Context,
 	}
 
 	// TODO(wilmer): remove invoice if any of the operations below fail?
+	mac, err := m.mintForHash(ctx, paymentHash, services...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return mac, paymentRequest, nil
+}
+
+// MintLSATs mints the given number of LSATs for the target services that are
+// all paid for with a single invoice of their total price, like a batch of
+// tokens a reseller pays for at once. All LSATs become valid once the invoice
+// is paid and share its preimage. Each of them carries the size of the batch,
+// so the amount paid for a single one can be told from the invoice.
+func (m *Mint) MintLSATs(ctx context.Context, count int,
+	services ...lsat.Service) ([]*macaroon.Macaroon, string, error) {
+
+	if count <= 0 {
+		return nil, "", fmt.Errorf("invalid number of LSATs %d", count)
+	}
+
+	price := maximumPrice(services) * int64(count)
+	paymentRequest, paymentHash, err := m.cfg.Challenger.NewChallenge(price)
+	if err != nil {
+		return nil, "", err
+	}
+
+	macs := make([]*macaroon.Macaroon, 0, count)
+	for i := 0; i < count; i++ {
+		mac, err := m.mintForHash(ctx, paymentHash, services...)
+		if err != nil {
+			return nil, "", err
+		}
+		err = lsat.AddFirstPartyCaveats(mac, lsat.NewBatchCaveat(count))
+		if err != nil {
+			return nil, "", err
+		}
+		macs = append(macs, mac)
+	}
+
+	return macs, paymentRequest, nil
+}
+
+// IssueLSAT mints a new LSAT for the target services that is paid for with the
+// invoice of the given payment hash, like the invoice of an upgrade of another
+// LSAT.
+func (m *Mint) IssueLSAT(ctx context.Context, paymentHash lntypes.Hash,
+	services ...lsat.Service) (*macaroon.Macaroon, error) {
+
+	return m.mintForHash(ctx, paymentHash, services...)
+}
+
+// MintTrialLSAT mints a new trial LSAT for the target services that doesn't
+// need to be paid for. Its preimage is derived from its ID and returned with
+// it, so the caller should restrict it with tight caveats.
+func (m *Mint) MintTrialLSAT(ctx context.Context,
+	services ...lsat.Service) (*macaroon.Macaroon, lntypes.Preimage,
+	error) {
+
+	tokenID, err := generateTokenID()
+	if err != nil {
+		return nil, lntypes.Preimage{}, err
+	}
+	preimage := lsat.TrialPreimage(tokenID)
+
+	mac, err := m.mintForID(ctx, preimage.Hash(), tokenID, services...)
+	if err != nil {
+		return nil, lntypes.Preimage{}, err
+	}
+
+	return mac, preimage, nil
+}
+
+// RevokeLSAT revokes the secret of the LSAT, so it can't be verified anymore.
+func (m *Mint) RevokeLSAT(ctx context.Context, mac *macaroon.Macaroon) error {
+	return m.cfg.Secrets.RevokeSecret(ctx, sha256.Sum256(mac.Id()))
+}
+
+// mintForHash mints a new LSAT for the target services that is paid for with
+// the invoice of the given payment hash.
+func (m *Mint) mintForHash(ctx context.Context, paymentHash lntypes.Hash,
+	services ...lsat.Service) (*macaroon.Macaroon, error) {
+
+	tokenID, err := generateTokenID()
+	if err != nil {
+		return nil, err
+	}
+
+	return m.mintForID(ctx, paymentHash, tokenID, services...)
+}
+
+// mintForID mints a new LSAT with the given ID for the target services that is
+// paid for with the invoice of the given payment hash.
+func (m *Mint) mintForID(ctx context.Context, paymentHash lntypes.Hash,
+	tokenID lsat.TokenID, services ...lsat.Service) (*macaroon.Macaroon,
+	error) {
 
 	// We can then proceed to mint the LSAT with a unique identifier that is
 	// mapped to a unique secret.
-	id, err := createUniqueIdentifier(paymentHash)
+	id, err := createIdentifier(paymentHash, tokenID)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 	idHash := sha256.Sum256(id)
 	secret, err := m.cfg.Secrets.NewSecret(ctx, idHash)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 	mac, err := macaroon.New(
 		secret[:], id, "lsat", macaroon.LatestVersion,
@@ -123,7 +248,7 @@ func (m *Mint) MintLSAT(ctx context.Context,
 	if err != nil {
 		// Attempt to revoke the secret to save space.
 		_ = m.cfg.Secrets.RevokeSecret(ctx, idHash)
-		return nil, "", err
+		return nil, err
 	}
 
 	// Include any restrictions that should be immediately applied to the
@@ -135,16 +260,69 @@ func (m *Mint) MintLSAT(ctx context.Context,
 		if err != nil {
 			// Attempt to revoke the secret to save space.
 			_ = m.cfg.Secrets.RevokeSecret(ctx, idHash)
-			return nil, "", err
+			return nil, err
 		}
 	}
+
+	// The caller can ask for the LSAT to be bound to the client that is
+	// going to pay for it.
+	bindingCaveats, ok := lsat.FromContext(
+		ctx, lsat.KeyBindingCaveats,
+	).([]lsat.Caveat)
+	if ok {
+		caveats = append(caveats, bindingCaveats...)
+	}
+
 	if err := lsat.AddFirstPartyCaveats(mac, caveats...); err != nil {
 		// Attempt to revoke the secret to save space.
 		_ = m.cfg.Secrets.RevokeSecret(ctx, idHash)
-		return nil, "", err
+		return nil, err
 	}
 
-	return mac, paymentRequest, nil
+	// The caller can attach metadata to the LSAT, which is stored next to
+	// its secret.
+	metadata, ok := lsat.FromContext(
+		ctx, lsat.KeyMetadata,
+	).(map[string]string)
+	if ok && len(metadata) > 0 && m.cfg.Metadata != nil {
+		err := m.cfg.Metadata.SetMetadata(ctx, tokenID, metadata)
+		if err != nil {
+			// Attempt to revoke the secret to save space.
+			_ = m.cfg.Secrets.RevokeSecret(ctx, idHash)
+			return nil, err
+		}
+	}
+
+	if m.cfg.Index != nil {
+		err := m.cfg.Index.AddToken(
+			ctx, tokenID, idHash, expiry(mac, services),
+		)
+		if err != nil {
+			// Attempt to revoke the secret to save space.
+			_ = m.cfg.Secrets.RevokeSecret(ctx, idHash)
+			return nil, err
+		}
+	}
+
+	return mac, nil
+}
+
+// expiry returns the time after which the LSAT can't be used for any of the
+// given services anymore, or the zero time if it can be used for one of them
+// forever.
+func expiry(mac *macaroon.Macaroon, services []lsat.Service) time.Time {
+	var latest time.Time
+	for _, service := range services {
+		validUntil, ok := lsat.ValidUntil(mac, service.Name)
+		if !ok {
+			return time.Time{}
+		}
+		if validUntil.After(latest) {
+			latest = validUntil
+		}
+	}
+
+	return latest
 }
 
 // maximumPrice determines the necessary price to use for a collection
@@ -161,13 +339,10 @@ func maximumPrice(services []lsat.Service) int64 {
 	return max
 }
 
-// createUniqueIdentifier creates a new LSAT identifier bound to a payment hash
-// and a randomly generated ID.
-func createUniqueIdentifier(paymentHash lntypes.Hash) ([]byte, error) {
-	tokenID, err := generateTokenID()
-	if err != nil {
-		return nil, err
-	}
+// createIdentifier creates a new LSAT identifier bound to a payment hash and
+// the given ID.
+func createIdentifier(paymentHash lntypes.Hash,
+	tokenID lsat.TokenID) ([]byte, error) {
 
 	id := &lsat.Identifier{
 		Version:     lsat.LatestVersion,
@@ -229,6 +404,29 @@ type VerificationParams struct {
 	// TargetService is the target service a user of an LSAT is attempting
 	// to access.
 	TargetService string
+
+	// ClientIP is the IP address of the client using the LSAT. LSATs bound
+	// to a network are rejected if it's nil.
+	ClientIP net.IP
+
+	// TLSBinding is the TLS channel binding of the connection the LSAT is
+	// used on. LSATs bound to a connection are rejected if it's nil.
+	TLSBinding []byte
+
+	// TargetPath is the URL path of the resource the LSAT is used for.
+	// LSATs bound to a path are only valid for that resource.
+	TargetPath string
+
+	// TargetMethod is the HTTP method of the request the LSAT is used for.
+	// LSATs restricted to some methods are only valid for those.
+	TargetMethod string
+
+	// Now is the time the expiry of the LSAT is checked against. If it's
+	// zero, the current time is used.
+	Now time.Time
+
+	// GracePeriod is the time an expired LSAT is still accepted for.
+	GracePeriod time.Duration
 }
 
 // VerifyLSAT attempts to verify an LSAT with the given parameters.
@@ -245,19 +443,48 @@ func (m *Mint) VerifyLSAT(ctx context.Context, params *VerificationParams) error
 	}
 
 	// If there was, then we'll ensure the LSAT was minted by us.
-	secret, err := m.cfg.Secrets.GetSecret(
-		ctx, sha256.Sum256(params.Macaroon.Id()),
-	)
-	if err != nil {
-		return err
-	}
-	rawCaveats, err := params.Macaroon.VerifySignature(secret[:], nil)
+	caveats, err := m.VerifyMacaroon(ctx, params.Macaroon)
 	if err != nil {
 		return err
 	}
 
 	// With the LSAT verified, we'll now inspect its caveats to ensure the
 	// target service is authorized.
+	now := params.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	lsat.Trace(ctx, "Checking caveats %v of LSAT %v", caveats, id.TokenID)
+	return lsat.VerifyCaveats(
+		caveats, lsat.NewServicesSatisfier(params.TargetService),
+		lsat.NewClientIPSatisfier(params.ClientIP),
+		lsat.NewTLSBindingSatisfier(params.TLSBinding),
+		lsat.NewPathSatisfier(params.TargetPath),
+		lsat.NewMethodsSatisfier(
+			params.TargetService, params.TargetMethod,
+		),
+		lsat.NewMessagesSatisfier(params.TargetService),
+		lsat.NewValidUntilSatisfier(
+			params.TargetService, now, params.GracePeriod,
+		),
+	)
+}
+
+// VerifyMacaroon ensures the macaroon of an LSAT was minted by us and wasn't
+// revoked, without requiring the preimage of its invoice. The first-party
+// caveats of the macaroon are returned, but not checked.
+func (m *Mint) VerifyMacaroon(ctx context.Context,
+	mac *macaroon.Macaroon) ([]lsat.Caveat, error) {
+
+	secret, err := m.cfg.Secrets.GetSecret(ctx, sha256.Sum256(mac.Id()))
+	if err != nil {
+		return nil, err
+	}
+	rawCaveats, err := mac.VerifySignature(secret[:], nil)
+	if err != nil {
+		return nil, err
+	}
+
 	caveats := make([]lsat.Caveat, 0, len(rawCaveats))
 	for _, rawCaveat := range rawCaveats {
 		// LSATs can contain third-party caveats that we're not aware
@@ -268,7 +495,29 @@ func (m *Mint) VerifyLSAT(ctx context.Context, params *VerificationParams) error
 		}
 		caveats = append(caveats, caveat)
 	}
-	return lsat.VerifyCaveats(
-		caveats, lsat.NewServicesSatisfier(params.TargetService),
-	)
+
+	return caveats, nil
+}
+
+// HasLSAT returns true if the LSAT with the given identifier was minted by us
+// and wasn't revoked since. Only the identifier is known, so the signature of
+// the LSAT isn't verified.
+func (m *Mint) HasLSAT(ctx context.Context, id *lsat.Identifier) (bool,
+	error) {
+
+	var buf bytes.Buffer
+	if err := lsat.EncodeIdentifier(&buf, id); err != nil {
+		return false, err
+	}
+
+	_, err := m.cfg.Secrets.GetSecret(ctx, sha256.Sum256(buf.Bytes()))
+	switch {
+	case errors.Is(err, ErrSecretNotFound):
+		return false, nil
+
+	case err != nil:
+		return false, err
+	}
+
+	return true, nil
 }
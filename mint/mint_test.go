@@ -1,10 +1,13 @@
 package mint
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
+	"net"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/lightninglabs/aperture/lsat"
 	"gopkg.in/macaroon.v2"
@@ -83,6 +86,53 @@ func TestAdminLSAT(t *testing.T) {
 	}
 }
 
+// TestBatchLSATs ensures that the LSATs of a batch are distinct, but all paid
+// for with the same invoice.
+func TestBatchLSATs(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+	})
+
+	macaroons, _, err := mint.MintLSATs(ctx, 3, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSATs: %v", err)
+	}
+	if len(macaroons) != 3 {
+		t.Fatalf("expected 3 LSATs, got %d", len(macaroons))
+	}
+
+	ids := make(map[string]struct{})
+	for _, macaroon := range macaroons {
+		ids[string(macaroon.Id())] = struct{}{}
+
+		size, ok := lsat.HasCaveat(macaroon, lsat.CondBatch)
+		if !ok || size != "3" {
+			t.Fatalf("expected batch size 3, got %q", size)
+		}
+
+		params := &VerificationParams{
+			Macaroon:      macaroon,
+			Preimage:      testPreimage,
+			TargetService: testService.Name,
+		}
+		if err := mint.VerifyLSAT(ctx, params); err != nil {
+			t.Fatalf("unable to verify LSAT: %v", err)
+		}
+	}
+	if len(ids) != 3 {
+		t.Fatalf("expected 3 distinct LSATs, got %d", len(ids))
+	}
+
+	if _, _, err := mint.MintLSATs(ctx, 0, testService); err == nil {
+		t.Fatal("expected empty batch to be rejected")
+	}
+}
+
 // TestRevokedLSAT ensures that we can no longer verify a revoked LSAT.
 func TestRevokedLSAT(t *testing.T) {
 	t.Parallel()
@@ -118,6 +168,41 @@ func TestRevokedLSAT(t *testing.T) {
 	}
 }
 
+// TestHasLSAT ensures that an LSAT is only known by its identifier until it's
+// revoked.
+func TestHasLSAT(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+	})
+
+	mac, _, err := mint.MintLSAT(ctx, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		t.Fatalf("unable to decode identifier: %v", err)
+	}
+	ok, err := mint.HasLSAT(ctx, id)
+	if err != nil || !ok {
+		t.Fatalf("expected LSAT to be known, got %v, %v", ok, err)
+	}
+
+	// Once it's revoked, it's no longer known.
+	if err := mint.RevokeLSAT(ctx, mac); err != nil {
+		t.Fatalf("unable to revoke LSAT: %v", err)
+	}
+	ok, err = mint.HasLSAT(ctx, id)
+	if err != nil || ok {
+		t.Fatalf("expected LSAT to be unknown, got %v, %v", ok, err)
+	}
+}
+
 // TestTamperedLSAT ensures that an LSAT that has been tampered with by
 // modifying its signature results in its verification failing.
 func TestTamperedLSAT(t *testing.T) {
@@ -162,6 +247,16 @@ func TestTamperedLSAT(t *testing.T) {
 	if !strings.Contains(err.Error(), "signature mismatch") {
 		t.Fatal("expected tampered LSAT to be invalid")
 	}
+
+	// The same goes for only verifying the macaroon, which succeeds for
+	// the valid one without a preimage.
+	if _, err := mint.VerifyMacaroon(ctx, mac); err != nil {
+		t.Fatalf("unable to verify macaroon: %v", err)
+	}
+	_, err = mint.VerifyMacaroon(ctx, &tampered)
+	if err == nil || !strings.Contains(err.Error(), "signature mismatch") {
+		t.Fatal("expected tampered macaroon to be invalid")
+	}
 }
 
 // TestDemotedServicesLSAT ensures that an LSAT which originally was authorized
@@ -225,3 +320,272 @@ func TestDemotedServicesLSAT(t *testing.T) {
 		t.Fatal("expected macaroon to be invalid")
 	}
 }
+
+// TestClientBoundLSAT ensures that an LSAT bound to a client network and TLS
+// connection is only authorized when used by that client.
+func TestClientBoundLSAT(t *testing.T) {
+	t.Parallel()
+
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+	})
+
+	clientIP := net.ParseIP("203.0.113.7")
+	ipCaveat, err := lsat.NewClientIPCaveat(clientIP, 24)
+	if err != nil {
+		t.Fatalf("unable to create client IP caveat: %v", err)
+	}
+	binding := []byte("channel binding")
+	ctx := lsat.AddToContext(
+		context.Background(), lsat.KeyBindingCaveats, []lsat.Caveat{
+			ipCaveat, lsat.NewTLSBindingCaveat(binding),
+		},
+	)
+
+	mac, _, err := mint.MintLSAT(ctx, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+
+	// It should be authorized from the same network and connection.
+	params := VerificationParams{
+		Macaroon:      mac,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+		ClientIP:      net.ParseIP("203.0.113.200"),
+		TLSBinding:    binding,
+	}
+	if err := mint.VerifyLSAT(ctx, &params); err != nil {
+		t.Fatalf("unable to verify LSAT: %v", err)
+	}
+
+	// It should not be authorized from another network.
+	otherNetworkParams := params
+	otherNetworkParams.ClientIP = net.ParseIP("198.51.100.7")
+	err = mint.VerifyLSAT(ctx, &otherNetworkParams)
+	if err == nil || !strings.Contains(err.Error(), "not in bound network") {
+		t.Fatal("expected LSAT from other network to be invalid")
+	}
+
+	// It should not be authorized on another connection or one without a
+	// binding.
+	otherConnParams := params
+	otherConnParams.TLSBinding = []byte("other binding")
+	err = mint.VerifyLSAT(ctx, &otherConnParams)
+	if err == nil || !strings.Contains(err.Error(), "binding mismatch") {
+		t.Fatal("expected LSAT on other connection to be invalid")
+	}
+	otherConnParams.TLSBinding = nil
+	err = mint.VerifyLSAT(ctx, &otherConnParams)
+	if err == nil || !strings.Contains(err.Error(), "binding mismatch") {
+		t.Fatal("expected LSAT without TLS binding to be invalid")
+	}
+
+	// The holder may narrow the network, but not widen it.
+	narrowCaveat, err := lsat.NewClientIPCaveat(clientIP, 28)
+	if err != nil {
+		t.Fatalf("unable to create client IP caveat: %v", err)
+	}
+	if err := lsat.AddFirstPartyCaveats(mac, narrowCaveat); err != nil {
+		t.Fatalf("unable to narrow LSAT: %v", err)
+	}
+	err = mint.VerifyLSAT(ctx, &params)
+	if err == nil || !strings.Contains(err.Error(), "not in bound network") {
+		t.Fatal("expected LSAT outside narrowed network to be invalid")
+	}
+	wideCaveat, err := lsat.NewClientIPCaveat(clientIP, 8)
+	if err != nil {
+		t.Fatalf("unable to create client IP caveat: %v", err)
+	}
+	if err := lsat.AddFirstPartyCaveats(mac, wideCaveat); err != nil {
+		t.Fatalf("unable to widen LSAT: %v", err)
+	}
+	params.ClientIP = clientIP
+	err = mint.VerifyLSAT(ctx, &params)
+	if err == nil || !strings.Contains(err.Error(), "not contained") {
+		t.Fatal("expected widened LSAT to be invalid")
+	}
+}
+
+// TestPathBoundLSAT ensures that an LSAT bound to the path of a resource is
+// only authorized for that resource.
+func TestPathBoundLSAT(t *testing.T) {
+	t.Parallel()
+
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+	})
+
+	ctx := lsat.AddToContext(
+		context.Background(), lsat.KeyBindingCaveats, []lsat.Caveat{
+			lsat.NewPathCaveat("/downloads/file.zip"),
+		},
+	)
+	mac, _, err := mint.MintLSAT(ctx, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+
+	params := VerificationParams{
+		Macaroon:      mac,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+		TargetPath:    "/downloads/file.zip",
+	}
+	if err := mint.VerifyLSAT(ctx, &params); err != nil {
+		t.Fatalf("unable to verify LSAT: %v", err)
+	}
+
+	// It should not be authorized for another resource.
+	otherParams := params
+	otherParams.TargetPath = "/downloads/other.zip"
+	err = mint.VerifyLSAT(ctx, &otherParams)
+	if err == nil || !strings.Contains(err.Error(), "not authorized") {
+		t.Fatal("expected LSAT for other path to be invalid")
+	}
+
+	// The holder can't bind it to another resource either.
+	otherCaveat := lsat.NewPathCaveat("/downloads/other.zip")
+	if err := lsat.AddFirstPartyCaveats(mac, otherCaveat); err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+	err = mint.VerifyLSAT(ctx, &otherParams)
+	if err == nil || !strings.Contains(err.Error(), "differs") {
+		t.Fatal("expected LSAT with changed path to be invalid")
+	}
+}
+
+// TestExpiringLSAT ensures that an LSAT with an expiry caveat is only accepted
+// until it expires or its grace period is over, and that its holder can't
+// extend it.
+func TestExpiringLSAT(t *testing.T) {
+	t.Parallel()
+
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+	})
+
+	expiry := time.Now().Add(time.Hour)
+	ctx := lsat.AddToContext(
+		context.Background(), lsat.KeyBindingCaveats, []lsat.Caveat{
+			lsat.NewValidUntilCaveat(testService.Name, expiry),
+		},
+	)
+	mac, _, err := mint.MintLSAT(ctx, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+
+	params := VerificationParams{
+		Macaroon:      mac,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+	}
+	if err := mint.VerifyLSAT(ctx, &params); err != nil {
+		t.Fatalf("unable to verify LSAT: %v", err)
+	}
+
+	// Once it expired, it's only accepted during the grace period.
+	expiredParams := params
+	expiredParams.Now = expiry.Add(time.Minute)
+	err = mint.VerifyLSAT(ctx, &expiredParams)
+	if _, ok := err.(*lsat.ExpiredError); !ok {
+		t.Fatalf("expected LSAT to be expired, got %v", err)
+	}
+	expiredParams.GracePeriod = 2 * time.Minute
+	if err := mint.VerifyLSAT(ctx, &expiredParams); err != nil {
+		t.Fatalf("unable to verify LSAT in grace period: %v", err)
+	}
+
+	// The holder can't extend it.
+	laterCaveat := lsat.NewValidUntilCaveat(
+		testService.Name, expiry.Add(time.Hour),
+	)
+	if err := lsat.AddFirstPartyCaveats(mac, laterCaveat); err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+	err = mint.VerifyLSAT(ctx, &params)
+	if err == nil || !strings.Contains(err.Error(), "later than") {
+		t.Fatal("expected LSAT with extended expiry to be invalid")
+	}
+}
+
+// TestTrialLSAT ensures that a trial LSAT is verified with its derived
+// preimage, is recognized as a trial by its identifier and is only accepted for
+// the methods it's restricted to.
+func TestTrialLSAT(t *testing.T) {
+	t.Parallel()
+
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+	})
+
+	ctx := lsat.AddToContext(
+		context.Background(), lsat.KeyBindingCaveats, []lsat.Caveat{
+			lsat.NewMethodsCaveat(testService.Name, "GET", "HEAD"),
+		},
+	)
+	mac, preimage, err := mint.MintTrialLSAT(ctx, testService)
+	if err != nil {
+		t.Fatalf("unable to mint trial LSAT: %v", err)
+	}
+
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		t.Fatalf("unable to decode identifier: %v", err)
+	}
+	if !lsat.IsTrialIdentifier(id) ||
+		preimage != lsat.TrialPreimage(id.TokenID) {
+
+		t.Fatal("expected trial identifier")
+	}
+
+	params := VerificationParams{
+		Macaroon:      mac,
+		Preimage:      preimage,
+		TargetService: testService.Name,
+		TargetMethod:  "GET",
+	}
+	if err := mint.VerifyLSAT(ctx, &params); err != nil {
+		t.Fatalf("unable to verify trial LSAT: %v", err)
+	}
+
+	// It should not be authorized for another method.
+	postParams := params
+	postParams.TargetMethod = "POST"
+	err = mint.VerifyLSAT(ctx, &postParams)
+	if err == nil || !strings.Contains(err.Error(), "not authorized") {
+		t.Fatal("expected trial LSAT for POST to be invalid")
+	}
+
+	// The holder can't allow another method either.
+	postCaveat := lsat.NewMethodsCaveat(testService.Name, "GET", "POST")
+	if err := lsat.AddFirstPartyCaveats(mac, postCaveat); err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+	err = mint.VerifyLSAT(ctx, &params)
+	if err == nil || !strings.Contains(err.Error(), "previously") {
+		t.Fatal("expected LSAT with extended methods to be invalid")
+	}
+
+	// Paid LSATs are no trials.
+	paidMac, _, err := mint.MintLSAT(context.Background(), testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+	paidID, err := lsat.DecodeIdentifier(bytes.NewReader(paidMac.Id()))
+	if err != nil {
+		t.Fatalf("unable to decode identifier: %v", err)
+	}
+	if lsat.IsTrialIdentifier(paidID) {
+		t.Fatal("expected paid LSAT not to be a trial")
+	}
+}
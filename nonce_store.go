@@ -0,0 +1,118 @@
+package aperture
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/proxy"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	// noncePrefix is the key we'll use to prefix the latest nonces of all
+	// tokens with when storing them in an etcd cluster.
+	noncePrefix = "nonce"
+
+	// errNonceConflict is returned if the nonce of a token was changed by
+	// someone else between reading and updating it.
+	errNonceConflict = fmt.Errorf("nonce changed concurrently")
+)
+
+// nonceKey returns the full key to store the latest nonce of a token in the
+// database.
+//
+// The resulting path of the nonce of the token with the ID "abc" within etcd
+// would look like:
+//
+//	lsat/proxy/nonce/abc
+func nonceKey(tokenID lsat.TokenID) string {
+	return strings.Join(
+		[]string{topLevelKey, noncePrefix, tokenID.String()},
+		etcdKeyDelimeter,
+	)
+}
+
+// nonceStore is a nonce store backed by an etcd cluster. All aperture
+// instances that share the cluster also share the nonces, so a request can't
+// be replayed against a different instance.
+type nonceStore struct {
+	*clientv3.Client
+}
+
+// A compile-time constraint to ensure nonceStore implements proxy.NonceStore.
+var _ proxy.NonceStore = (*nonceStore)(nil)
+
+// newNonceStore creates a new nonce store backed by the given etcd client.
+func newNonceStore(client *clientv3.Client) *nonceStore {
+	return &nonceStore{Client: client}
+}
+
+// UseNonce atomically records the nonce as the latest one of the token if it's
+// greater than all nonces previously used with the token. If a concurrent
+// request changed the nonce in the meantime, the update is retried with the
+// new value.
+//
+// NOTE: This is part of the proxy.NonceStore interface.
+func (s *nonceStore) UseNonce(ctx context.Context, tokenID lsat.TokenID,
+	nonce uint64) (bool, error) {
+
+	key := nonceKey(tokenID)
+	for {
+		ok, err := s.useNonce(ctx, key, nonce)
+		switch {
+		case err == errNonceConflict:
+			continue
+
+		case err != nil:
+			return false, err
+
+		default:
+			return ok, nil
+		}
+	}
+}
+
+// useNonce tries to record the nonce with the given key once.
+func (s *nonceStore) useNonce(ctx context.Context, key string,
+	nonce uint64) (bool, error) {
+
+	resp, err := s.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	// Only write the new value if the key wasn't modified since we read
+	// it. A mod revision of zero means the key doesn't exist yet.
+	var modRevision int64
+	if len(resp.Kvs) > 0 {
+		value := resp.Kvs[0].Value
+		if len(value) != 8 {
+			return false, fmt.Errorf("invalid nonce size %v",
+				len(value))
+		}
+		if nonce <= binary.BigEndian.Uint64(value) {
+			return false, nil
+		}
+		modRevision = resp.Kvs[0].ModRevision
+	}
+
+	var newNonce [8]byte
+	binary.BigEndian.PutUint64(newNonce[:], nonce)
+	txnResp, err := s.Txn(ctx).
+		If(clientv3.Compare(
+			clientv3.ModRevision(key), "=", modRevision,
+		)).
+		Then(clientv3.OpPut(key, string(newNonce[:]))).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	if !txnResp.Succeeded {
+		return false, errNonceConflict
+	}
+
+	return true, nil
+}
@@ -0,0 +1,71 @@
+package aperture
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNonceStore tests that the etcd backed nonce stores of two instances
+// share the nonces of tokens and accept each nonce only once, even if it's used
+// concurrently.
+func TestNonceStore(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	var (
+		ctx    = context.Background()
+		stores = []*nonceStore{
+			newNonceStore(etcdClient), newNonceStore(etcdClient),
+		}
+		tokenID    = lsat.TokenID{1}
+		otherToken = lsat.TokenID{2}
+	)
+
+	// Use the same nonce many times concurrently on both instances. Only
+	// one of the requests may succeed.
+	var (
+		wg       sync.WaitGroup
+		mtx      sync.Mutex
+		accepted int
+	)
+	for i := 0; i < 10; i++ {
+		store := stores[i%len(stores)]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ok, err := store.UseNonce(ctx, tokenID, 5)
+			if err != nil {
+				t.Errorf("unable to use nonce: %v", err)
+				return
+			}
+			if ok {
+				mtx.Lock()
+				accepted++
+				mtx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 1, accepted)
+
+	// Smaller nonces are rejected, greater ones accepted.
+	ok, err := stores[1].UseNonce(ctx, tokenID, 4)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	ok, err = stores[1].UseNonce(ctx, tokenID, 6)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// The nonces of other tokens are independent.
+	ok, err = stores[0].UseNonce(ctx, otherToken, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+}
@@ -10,7 +10,7 @@ import (
 // assertPrivateKeyExists is a helper to determine if the private key for an
 // onion service exists in the store. If it does, it's compared against what's
 // expected.
-func assertPrivateKeyExists(t *testing.T, store *onionStore,
+func assertPrivateKeyExists(t *testing.T, store tor.OnionStore,
 	onionType tor.OnionType, expPrivateKey *[]byte) {
 
 	t.Helper()
@@ -32,16 +32,21 @@ func assertPrivateKeyExists(t *testing.T, store *onionStore,
 	}
 }
 
-// TestOnionStore ensures the different operations of the onionStore behave as
-// espected.
+// TestOnionStore ensures the different operations of the onionStore and the
+// in-memory onion store behave as espected.
 func TestOnionStore(t *testing.T) {
 	etcdClient, serverCleanup := etcdSetup(t)
 	defer etcdClient.Close()
 	defer serverCleanup()
 
+	testOnionStore(t, newOnionStore(etcdClient))
+	testOnionStore(t, newMemOnionStore())
+}
+
+// testOnionStore runs the onion store operations against the given store.
+func testOnionStore(t *testing.T, store tor.OnionStore) {
 	// Upon a fresh initialization of the store, no private keys should
 	// exist for any onion service type.
-	store := newOnionStore(etcdClient)
 	assertPrivateKeyExists(t, store, tor.V2, nil)
 	assertPrivateKeyExists(t, store, tor.V3, nil)
 
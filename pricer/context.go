@@ -0,0 +1,19 @@
+package pricer
+
+import "context"
+
+// countryKey is the context key under which the country of a client is stored.
+type countryKey struct{}
+
+// ContextWithCountry returns a context that carries the ISO 3166-1 alpha-2
+// country code of the client whose request is being priced.
+func ContextWithCountry(ctx context.Context, country string) context.Context {
+	return context.WithValue(ctx, countryKey{}, country)
+}
+
+// CountryFromContext returns the country code of the client whose request is
+// being priced, or an empty string if it isn't known.
+func CountryFromContext(ctx context.Context) string {
+	country, _ := ctx.Value(countryKey{}).(string)
+	return country
+}
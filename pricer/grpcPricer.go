@@ -7,6 +7,13 @@ import (
 	"github.com/lightninglabs/aperture/pricesrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// CountryMetadataKey is the gRPC metadata key under which the country
+	// code of the client is sent to the price server, if it's known.
+	CountryMetadataKey = "aperture-country"
 )
 
 // Config holds all the config values required to initialise the GRPCPricer.
@@ -67,8 +74,15 @@ func NewGRPCPricer(cfg *Config) (*GRPCPricer, error) {
 }
 
 // GetPrice queries the server for the price of a resource path and returns the
-// price. GetPrice is part of the Pricer interface.
+// price. If the country of the client is known, it's sent along as metadata.
+// GetPrice is part of the Pricer interface.
 func (c GRPCPricer) GetPrice(ctx context.Context, path string) (int64, error) {
+	if country := CountryFromContext(ctx); country != "" {
+		ctx = metadata.AppendToOutgoingContext(
+			ctx, CountryMetadataKey, country,
+		)
+	}
+
 	resp, err := c.rpcClient.GetPrice(ctx, &pricesrpc.GetPriceRequest{
 		Path: path,
 	})
@@ -0,0 +1,79 @@
+package pricer
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+)
+
+// PathPrice is the price of the resources of a service whose URL path matches
+// a regular expression.
+type PathPrice struct {
+	// Path is the regular expression the URL path of a resource is
+	// matched against.
+	Path string `long:"path" description:"Regular expression the URL path of the resources is matched against"`
+
+	// Price is the price in satoshis of the matching resources.
+	Price int64 `long:"price" description:"The price in satoshis of the matching resources"`
+}
+
+// pathPrice is a path price with its compiled expression.
+type pathPrice struct {
+	path  *regexp.Regexp
+	price int64
+}
+
+// PathPricer prices each resource of a service by its URL path. It implements
+// the Pricer interface.
+type PathPricer struct {
+	prices       []pathPrice
+	defaultPrice int64
+}
+
+// NewPathPricer creates a pricer that returns the price of the first of the
+// given path prices that matches a resource, or the default price if none of
+// them does.
+func NewPathPricer(defaultPrice int64,
+	prices []*PathPrice) (*PathPricer, error) {
+
+	pricer := &PathPricer{
+		prices:       make([]pathPrice, 0, len(prices)),
+		defaultPrice: defaultPrice,
+	}
+	for _, price := range prices {
+		path, err := regexp.Compile(price.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %q: %v",
+				price.Path, err)
+		}
+		if price.Price < 0 {
+			return nil, fmt.Errorf("negative price for path %q",
+				price.Path)
+		}
+
+		pricer.prices = append(pricer.prices, pathPrice{
+			path:  path,
+			price: price.Price,
+		})
+	}
+
+	return pricer, nil
+}
+
+// GetPrice returns the price of the first path price that matches the path.
+// It is part of the Pricer interface.
+func (p *PathPricer) GetPrice(_ context.Context, path string) (int64, error) {
+	for _, price := range p.prices {
+		if price.path.MatchString(path) {
+			return price.price, nil
+		}
+	}
+
+	return p.defaultPrice, nil
+}
+
+// Close is part of the Pricer interface. For the PathPricer, the method does
+// nothing.
+func (p *PathPricer) Close() error {
+	return nil
+}
@@ -0,0 +1,184 @@
+package pricer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// defaultSurgeThreshold is the default load above which surge pricing
+	// starts to raise the price.
+	defaultSurgeThreshold = 0.5
+
+	// defaultSurgeMaxMultiplier is the default factor the price is
+	// multiplied with at full load.
+	defaultSurgeMaxMultiplier = 10
+)
+
+// SurgeConfig holds the options of surge pricing, which raises the price of a
+// service with its current load. Each load measure that has a limit configured
+// is turned into a utilization between 0 and 1, the highest of which is the
+// load of the service.
+type SurgeConfig struct {
+	// Enabled can be set to scale the price with the load of the service.
+	Enabled bool `long:"enabled" description:"Raise the price of the service with its current load"`
+
+	// Threshold is the load between 0 and 1 above which the price starts
+	// to rise.
+	Threshold float64 `long:"threshold" description:"The load between 0 and 1 above which the price starts to rise (default 0.5)"`
+
+	// MaxMultiplier is the factor the price is multiplied with at full
+	// load. Between the threshold and full load, the factor rises
+	// linearly.
+	MaxMultiplier float64 `long:"maxmultiplier" description:"The factor the price is multiplied with at full load (default 10)"`
+
+	// MaxInFlight is the number of requests that are forwarded to the
+	// backend at the same time at which the service is fully loaded. Zero
+	// ignores the number of in-flight requests.
+	MaxInFlight int `long:"maxinflight" description:"The number of in-flight requests at full load, 0 to ignore them"`
+
+	// TargetLatency is the backend latency up to which the service isn't
+	// considered loaded. Zero ignores the latency.
+	TargetLatency time.Duration `long:"targetlatency" description:"The backend latency up to which the service isn't loaded, 0 to ignore the latency"`
+
+	// MaxLatency is the backend latency at which the service is fully
+	// loaded.
+	MaxLatency time.Duration `long:"maxlatency" description:"The backend latency at full load"`
+
+	// MaxQueueDepth is the number of calls waiting for lnd at which the
+	// service is fully loaded. Zero ignores the queue.
+	MaxQueueDepth int `long:"maxqueuedepth" description:"The number of calls waiting for lnd at full load, 0 to ignore the queue"`
+}
+
+// Validate checks the surge pricing options and sets the defaults of the ones
+// that aren't set.
+func (c *SurgeConfig) Validate() error {
+	if c.Threshold == 0 {
+		c.Threshold = defaultSurgeThreshold
+	}
+	if c.MaxMultiplier == 0 {
+		c.MaxMultiplier = defaultSurgeMaxMultiplier
+	}
+
+	switch {
+	case c.Threshold < 0 || c.Threshold >= 1:
+		return fmt.Errorf("surge threshold must be in [0, 1)")
+
+	case c.MaxMultiplier < 1:
+		return fmt.Errorf("surge multiplier must be at least 1")
+
+	case c.MaxInFlight < 0 || c.MaxQueueDepth < 0:
+		return fmt.Errorf("negative surge limit")
+
+	case c.TargetLatency > 0 && c.MaxLatency <= c.TargetLatency:
+		return fmt.Errorf("maximum surge latency must be greater " +
+			"than the target latency")
+
+	case c.MaxInFlight == 0 && c.TargetLatency == 0 &&
+		c.MaxQueueDepth == 0:
+
+		return fmt.Errorf("surge pricing needs at least one load " +
+			"limit")
+	}
+
+	return nil
+}
+
+// Load is a snapshot of the load measures of a service.
+type Load struct {
+	// InFlight is the number of requests that are currently forwarded to
+	// the backend.
+	InFlight int
+
+	// Latency is the recent average time the backend takes to respond.
+	Latency time.Duration
+
+	// QueueDepth is the number of calls that are waiting for lnd.
+	QueueDepth int
+}
+
+// SurgePricer is a Pricer that multiplies the prices of another pricer with a
+// factor that rises with the load of the service.
+type SurgePricer struct {
+	base Pricer
+	cfg  SurgeConfig
+	load func() Load
+}
+
+// A compile-time constraint to ensure SurgePricer implements Pricer.
+var _ Pricer = (*SurgePricer)(nil)
+
+// NewSurgePricer creates a new surge pricer that raises the prices of the base
+// pricer with the load returned by the given function. The configuration must
+// be validated.
+func NewSurgePricer(base Pricer, cfg *SurgeConfig,
+	load func() Load) *SurgePricer {
+
+	return &SurgePricer{
+		base: base,
+		cfg:  *cfg,
+		load: load,
+	}
+}
+
+// GetPrice returns the price of the base pricer, multiplied with the current
+// surge factor and rounded up.
+//
+// NOTE: This is part of the Pricer interface.
+func (s *SurgePricer) GetPrice(ctx context.Context, path string) (int64,
+	error) {
+
+	price, err := s.base.GetPrice(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(math.Ceil(float64(price) * s.Multiplier())), nil
+}
+
+// Close closes the base pricer.
+//
+// NOTE: This is part of the Pricer interface.
+func (s *SurgePricer) Close() error {
+	return s.base.Close()
+}
+
+// Multiplier returns the factor prices are currently multiplied with.
+func (s *SurgePricer) Multiplier() float64 {
+	utilization := s.utilization(s.load())
+	if utilization <= s.cfg.Threshold {
+		return 1
+	}
+
+	surge := (utilization - s.cfg.Threshold) / (1 - s.cfg.Threshold)
+	return 1 + surge*(s.cfg.MaxMultiplier-1)
+}
+
+// utilization returns the load of the service between 0 and 1, which is the
+// highest utilization of all load measures that have a limit.
+func (s *SurgePricer) utilization(load Load) float64 {
+	var utilization float64
+	if s.cfg.MaxInFlight > 0 {
+		utilization = math.Max(
+			utilization,
+			float64(load.InFlight)/float64(s.cfg.MaxInFlight),
+		)
+	}
+	if s.cfg.TargetLatency > 0 {
+		utilization = math.Max(
+			utilization,
+			float64(load.Latency-s.cfg.TargetLatency)/
+				float64(s.cfg.MaxLatency-s.cfg.TargetLatency),
+		)
+	}
+	if s.cfg.MaxQueueDepth > 0 {
+		utilization = math.Max(
+			utilization,
+			float64(load.QueueDepth)/float64(s.cfg.MaxQueueDepth),
+		)
+	}
+
+	return math.Min(utilization, 1)
+}
@@ -0,0 +1,73 @@
+package pricer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestSurgePricer tests that the price rises linearly with the highest load
+// measure once the load is above the threshold.
+func TestSurgePricer(t *testing.T) {
+	cfg := &SurgeConfig{
+		Enabled:       true,
+		MaxMultiplier: 5,
+		MaxInFlight:   100,
+		TargetLatency: 100 * time.Millisecond,
+		MaxLatency:    300 * time.Millisecond,
+		MaxQueueDepth: 10,
+	}
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, defaultSurgeThreshold, cfg.Threshold)
+
+	var load Load
+	surgePricer := NewSurgePricer(
+		NewDefaultPricer(100), cfg, func() Load {
+			return load
+		},
+	)
+
+	testCases := []struct {
+		name  string
+		load  Load
+		price int64
+	}{{
+		name:  "idle",
+		price: 100,
+	}, {
+		name:  "below threshold",
+		load:  Load{InFlight: 50, Latency: 150 * time.Millisecond},
+		price: 100,
+	}, {
+		name:  "in-flight requests",
+		load:  Load{InFlight: 75},
+		price: 300,
+	}, {
+		name:  "latency",
+		load:  Load{InFlight: 10, Latency: 250 * time.Millisecond},
+		price: 300,
+	}, {
+		name:  "queue depth",
+		load:  Load{QueueDepth: 10},
+		price: 500,
+	}, {
+		name:  "overloaded",
+		load:  Load{InFlight: 1000},
+		price: 500,
+	}}
+	for _, tc := range testCases {
+		load = tc.load
+		price, err := surgePricer.GetPrice(context.Background(), "/")
+		require.NoError(t, err)
+		require.Equal(t, tc.price, price, tc.name)
+	}
+
+	// At least one load measure is needed.
+	require.Error(t, (&SurgeConfig{Enabled: true}).Validate())
+	require.Error(t, (&SurgeConfig{
+		TargetLatency: time.Second,
+		MaxLatency:    time.Second,
+	}).Validate())
+}
@@ -0,0 +1,164 @@
+// Package proof implements signed proof-of-service statements. Aperture can
+// sign a statement about each response it forwards from a backend, which
+// allows a paying client to later prove to a third party what a service
+// returned for a paid request.
+package proof
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Version is the version of the statement format. It is the first line
+	// of each signed message.
+	Version = "aperture-proof-v1"
+
+	// pemType is the type of the PEM block the signing key is stored in.
+	pemType = "PRIVATE KEY"
+)
+
+var (
+	// ErrInvalidSignature is returned if a signature doesn't match the
+	// statement and public key it is verified with.
+	ErrInvalidSignature = errors.New("invalid proof signature")
+)
+
+// Statement describes a response that was sent to a client for a request.
+type Statement struct {
+	// Timestamp is the time the response was sent at.
+	Timestamp time.Time
+
+	// TokenID is the hex encoded ID of the token the request was paid
+	// with. It is empty for requests that didn't need a token.
+	TokenID string
+
+	// Method is the HTTP method of the request.
+	Method string
+
+	// Host is the host the request was sent to.
+	Host string
+
+	// RequestURI is the path and query of the request.
+	RequestURI string
+
+	// Status is the HTTP status code of the response.
+	Status int
+
+	// ContentType is the content type of the response body.
+	ContentType string
+
+	// BodyDigest is the SHA-256 digest of the response body.
+	BodyDigest [sha256.Size]byte
+}
+
+// Message returns the canonical message that is signed for the statement. Each
+// field is written on its own line, so none of them may contain a line break.
+func (s *Statement) Message() ([]byte, error) {
+	fields := []string{
+		Version,
+		strconv.FormatInt(s.Timestamp.Unix(), 10),
+		s.TokenID,
+		s.Method,
+		s.Host,
+		s.RequestURI,
+		strconv.Itoa(s.Status),
+		s.ContentType,
+		hex.EncodeToString(s.BodyDigest[:]),
+	}
+	for _, field := range fields {
+		if strings.ContainsAny(field, "\r\n") {
+			return nil, fmt.Errorf("statement field %q contains "+
+				"a line break", field)
+		}
+	}
+
+	return []byte(strings.Join(fields, "\n")), nil
+}
+
+// Signable is a message that can be signed, like a statement or a receipt.
+type Signable interface {
+	// Message returns the canonical message that is signed.
+	Message() ([]byte, error)
+}
+
+// Sign signs the statement or receipt with the given signer. The signer must
+// use an Ed25519 key.
+func Sign(signer crypto.Signer, s Signable) ([]byte, error) {
+	msg, err := s.Message()
+	if err != nil {
+		return nil, err
+	}
+
+	return signer.Sign(rand.Reader, msg, crypto.Hash(0))
+}
+
+// Verify checks that the signature was created for the statement or receipt
+// with the private key of the given public key.
+func Verify(pubKey ed25519.PublicKey, s Signable, sig []byte) error {
+	msg, err := s.Message()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pubKey, msg, sig) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// LoadOrCreateKey loads the Ed25519 signing key from the PEM encoded PKCS #8
+// file at the given path. If the file doesn't exist, a new key is created and
+// written to it.
+func LoadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	keyPEM, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{
+			Type:  pemType,
+			Bytes: der,
+		})
+		if err := ioutil.WriteFile(path, keyPEM, 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+
+	case err != nil:
+		return nil, err
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != pemType {
+		return nil, fmt.Errorf("no private key found in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key in %s is not an Ed25519 key", path)
+	}
+
+	return edKey, nil
+}
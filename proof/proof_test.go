@@ -0,0 +1,86 @@
+package proof
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestSignVerify tests that signed statements can be verified and that any
+// change to a statement invalidates its signature.
+func TestSignVerify(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "proof")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	keyFile := filepath.Join(tempDir, "proof.key")
+	key, err := LoadOrCreateKey(keyFile)
+	require.NoError(t, err)
+
+	// Loading the key again must return the same key.
+	loadedKey, err := LoadOrCreateKey(keyFile)
+	require.NoError(t, err)
+	require.Equal(t, key, loadedKey)
+
+	statement := &Statement{
+		Timestamp:   time.Unix(1600000000, 0),
+		TokenID:     "abcd",
+		Method:      "GET",
+		Host:        "oracle.example.com",
+		RequestURI:  "/price?pair=btcusd",
+		Status:      200,
+		ContentType: "application/json",
+		BodyDigest:  sha256.Sum256([]byte(`{"price": 1}`)),
+	}
+	sig, err := Sign(key, statement)
+	require.NoError(t, err)
+
+	pubKey := key.Public().(ed25519.PublicKey)
+	require.NoError(t, Verify(pubKey, statement, sig))
+
+	tampered := *statement
+	tampered.BodyDigest = sha256.Sum256([]byte(`{"price": 2}`))
+	require.Equal(t, ErrInvalidSignature, Verify(pubKey, &tampered, sig))
+
+	tampered = *statement
+	tampered.Status = 500
+	require.Equal(t, ErrInvalidSignature, Verify(pubKey, &tampered, sig))
+
+	// Fields can't contain line breaks, otherwise they could be used to
+	// shift the other fields.
+	tampered = *statement
+	tampered.RequestURI = "/price\n200"
+	_, err = Sign(key, &tampered)
+	require.Error(t, err)
+}
+
+// TestSignVerifyReceipt tests that signed receipts can be verified and that
+// the amount of a receipt can't be changed.
+func TestSignVerifyReceipt(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	receipt := &Receipt{
+		Settled:     time.Unix(1600000000, 0),
+		TokenID:     "abcd",
+		Service:     "oracle",
+		PaymentHash: "0102",
+		Preimage:    "0304",
+		Amount:      1000,
+	}
+	sig, err := Sign(key, receipt)
+	require.NoError(t, err)
+
+	pubKey := key.Public().(ed25519.PublicKey)
+	require.NoError(t, Verify(pubKey, receipt, sig))
+
+	tampered := *receipt
+	tampered.Amount = 10000
+	require.Equal(t, ErrInvalidSignature, Verify(pubKey, &tampered, sig))
+}
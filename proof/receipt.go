@@ -0,0 +1,58 @@
+package proof
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ReceiptVersion is the version of the receipt format. It is the first
+	// line of each signed receipt.
+	ReceiptVersion = "aperture-receipt-v1"
+)
+
+// Receipt describes a settled payment for a token, which its holder can hand
+// in for expense reporting.
+type Receipt struct {
+	// Settled is the time the invoice of the token was paid at.
+	Settled time.Time
+
+	// TokenID is the hex encoded ID of the token that was paid for.
+	TokenID string
+
+	// Service is the name of the service the token was issued for.
+	Service string
+
+	// PaymentHash is the hex encoded payment hash of the invoice.
+	PaymentHash string
+
+	// Preimage is the hex encoded preimage that proves the payment.
+	Preimage string
+
+	// Amount is the amount that was paid in satoshis.
+	Amount int64
+}
+
+// Message returns the canonical message that is signed for the receipt. Each
+// field is written on its own line, so none of them may contain a line break.
+func (r *Receipt) Message() ([]byte, error) {
+	fields := []string{
+		ReceiptVersion,
+		strconv.FormatInt(r.Settled.Unix(), 10),
+		r.TokenID,
+		r.Service,
+		r.PaymentHash,
+		r.Preimage,
+		strconv.FormatInt(r.Amount, 10),
+	}
+	for _, field := range fields {
+		if strings.ContainsAny(field, "\r\n") {
+			return nil, fmt.Errorf("receipt field %q contains a "+
+				"line break", field)
+		}
+	}
+
+	return []byte(strings.Join(fields, "\n")), nil
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ServiceActivity is the number of requests a service is currently handling.
+type ServiceActivity struct {
+	// Service is the name of the service.
+	Service string `json:"service"`
+
+	// InFlight is the number of requests that are forwarded to the backend
+	// or served in process right now, including gRPC streams and upgraded
+	// connections.
+	InFlight int64 `json:"in_flight"`
+
+	// GRPCStreams is the number of the requests in flight that are gRPC
+	// calls.
+	GRPCStreams int64 `json:"grpc_streams"`
+}
+
+// activityCounter counts the requests in flight of a service.
+type activityCounter struct {
+	inFlight    int64
+	grpcStreams int64
+}
+
+// activityTracker counts the requests in flight by service name. The counters
+// outlive the services, so requests that are still handled by a service that
+// was replaced at run time are counted under its name.
+type activityTracker struct {
+	mu       sync.Mutex
+	counters map[string]*activityCounter
+}
+
+// counter returns the counter of the service with the given name.
+func (a *activityTracker) counter(name string) *activityCounter {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.counters == nil {
+		a.counters = make(map[string]*activityCounter)
+	}
+	counter, ok := a.counters[name]
+	if !ok {
+		counter = &activityCounter{}
+		a.counters[name] = counter
+	}
+	return counter
+}
+
+// start counts a request to the given service until the returned function is
+// called.
+func (a *activityTracker) start(target *Service, r *http.Request) func() {
+	counter := a.counter(target.Name)
+	grpc := strings.HasPrefix(r.Header.Get(hdrContentType), hdrTypeGrpc)
+
+	atomic.AddInt64(&counter.inFlight, 1)
+	if grpc {
+		atomic.AddInt64(&counter.grpcStreams, 1)
+	}
+
+	return func() {
+		atomic.AddInt64(&counter.inFlight, -1)
+		if grpc {
+			atomic.AddInt64(&counter.grpcStreams, -1)
+		}
+	}
+}
+
+// Activity returns the number of requests in flight of every current service,
+// followed by those of removed services that are still handling requests.
+func (p *Proxy) Activity() []*ServiceActivity {
+	services := p.currentServices()
+	current := make(map[string]bool, len(services))
+
+	var activity []*ServiceActivity
+	for _, service := range services {
+		if current[service.Name] {
+			continue
+		}
+		current[service.Name] = true
+
+		counter := p.activity.counter(service.Name)
+		activity = append(activity, &ServiceActivity{
+			Service:     service.Name,
+			InFlight:    atomic.LoadInt64(&counter.inFlight),
+			GRPCStreams: atomic.LoadInt64(&counter.grpcStreams),
+		})
+	}
+
+	p.activity.mu.Lock()
+	var removed []*ServiceActivity
+	for name, counter := range p.activity.counters {
+		inFlight := atomic.LoadInt64(&counter.inFlight)
+		if current[name] || inFlight == 0 {
+			continue
+		}
+		removed = append(removed, &ServiceActivity{
+			Service:     name,
+			InFlight:    inFlight,
+			GRPCStreams: atomic.LoadInt64(&counter.grpcStreams),
+		})
+	}
+	p.activity.mu.Unlock()
+
+	sort.Slice(removed, func(i, j int) bool {
+		return removed[i].Service < removed[j].Service
+	})
+	return append(activity, removed...)
+}
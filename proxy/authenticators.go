@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+const (
+	// AuthenticatorLSAT is the name of the authenticator that accepts the
+	// LSATs of the proxy and challenges clients to pay for new ones.
+	AuthenticatorLSAT = "lsat"
+
+	// AuthenticatorAPIKey is the name of the authenticator that accepts the
+	// static API keys of a service.
+	AuthenticatorAPIKey = "apikey"
+
+	// AuthenticatorClientCert is the name of the authenticator that
+	// accepts the TLS client certificates issued by the certificate
+	// authorities of a service.
+	AuthenticatorClientCert = "mtls"
+)
+
+// APIKeyConfig holds the API keys of a service that are accepted by the apikey
+// authenticator.
+type APIKeyConfig struct {
+	// Header is the header field that carries the key. Keys in the
+	// Authorization header field are sent with the Bearer scheme.
+	Header string `long:"header" description:"The header field that carries the API key, with the Bearer scheme for Authorization (default: X-Api-Key)"`
+
+	// Keys are the API keys that are accepted.
+	Keys []string `long:"key" description:"An API key that is accepted, can be given multiple times" secret:"true"`
+}
+
+// header returns the header field that carries the key.
+func (c *APIKeyConfig) header() string {
+	if c.Header == "" {
+		return auth.DefaultAPIKeyHeader
+	}
+	return http.CanonicalHeaderKey(c.Header)
+}
+
+// ClientCertConfig holds the certificate authorities whose client certificates
+// are accepted by the mtls authenticator.
+type ClientCertConfig struct {
+	// CAFile is the PEM file of the certificate authorities that issue the
+	// accepted client certificates.
+	CAFile string `long:"cafile" description:"The PEM file of the certificate authorities that issue the accepted client certificates"`
+
+	// Subjects can be set to only accept the certificates with one of the
+	// given common names.
+	Subjects []string `long:"subject" description:"A common name of the accepted client certificates, can be given multiple times (default: all)"`
+}
+
+// authenticator creates the authenticator of the client certificates of the
+// certificate authorities.
+func (c *ClientCertConfig) authenticator() (*auth.ClientCertAuthenticator,
+	error) {
+
+	if c.CAFile == "" {
+		return nil, fmt.Errorf("mtls authenticator needs a CA file")
+	}
+	pemCerts, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CA file: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pemCerts) {
+		return nil, fmt.Errorf("no certificates in CA file %s",
+			c.CAFile)
+	}
+
+	return auth.NewClientCertAuthenticator(roots, c.Subjects), nil
+}
+
+// RequestsClientCerts returns true if one of the services accepts client
+// certificates, so clients need to be asked for them during the TLS handshake.
+func RequestsClientCerts(services []*Service) bool {
+	for _, service := range services {
+		for _, name := range service.Authenticators {
+			if name == AuthenticatorClientCert {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prepareAuthenticators checks the authenticators of the service and creates
+// those that belong to it.
+func prepareAuthenticators(service *Service) error {
+	service.apiKeyAuth = nil
+	service.clientCertAuth = nil
+	seen := make(map[string]bool, len(service.Authenticators))
+	for _, name := range service.Authenticators {
+		if seen[name] {
+			return fmt.Errorf("authenticator %s listed twice", name)
+		}
+		seen[name] = true
+
+		switch name {
+		case AuthenticatorLSAT:
+
+		case AuthenticatorAPIKey:
+			if len(service.APIKey.Keys) == 0 {
+				return fmt.Errorf("apikey authenticator " +
+					"needs at least one key")
+			}
+			for _, key := range service.APIKey.Keys {
+				if key == "" {
+					return fmt.Errorf("empty API key")
+				}
+			}
+			service.apiKeyAuth = auth.NewAPIKeyAuthenticator(
+				service.APIKey.header(), service.APIKey.Keys,
+			)
+
+		case AuthenticatorClientCert:
+			var err error
+			service.clientCertAuth, err =
+				service.ClientCert.authenticator()
+			if err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("unknown authenticator %q", name)
+		}
+	}
+
+	return nil
+}
+
+// authenticatorNames returns the names of the authenticators of the service in
+// priority order. Services without authenticators only accept LSATs.
+func (s *Service) authenticatorNames() []string {
+	if len(s.Authenticators) == 0 {
+		return []string{AuthenticatorLSAT}
+	}
+	return s.Authenticators
+}
+
+// acceptsTokens returns true if the service accepts LSATs, which the features
+// that work with the token of a request depend on.
+func (s *Service) acceptsTokens() bool {
+	for _, name := range s.authenticatorNames() {
+		if name == AuthenticatorLSAT {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceAuthenticator returns the authenticator that tries the authenticators
+// of the service in their configured order.
+func (p *Proxy) serviceAuthenticator(target *Service) *auth.ChainAuthenticator {
+	names := target.authenticatorNames()
+	authenticators := make([]auth.Authenticator, 0, len(names))
+	for _, name := range names {
+		switch name {
+		case AuthenticatorLSAT:
+			authenticators = append(authenticators, p.authenticator)
+
+		case AuthenticatorAPIKey:
+			authenticators = append(
+				authenticators, target.apiKeyAuth,
+			)
+
+		case AuthenticatorClientCert:
+			authenticators = append(
+				authenticators, target.clientCertAuth,
+			)
+		}
+	}
+
+	return auth.NewChainAuthenticator(authenticators...)
+}
+
+// authenticate returns whether the request is authenticated for the given
+// resource of the service by one of its authenticators, and the name of the
+// one that accepted it. Only requests accepted by the lsat authenticator carry
+// a token.
+func (p *Proxy) authenticate(r *http.Request, target *Service,
+	resourceName string) (string, bool) {
+
+	// Services that only accept LSATs don't need the chain.
+	names := target.authenticatorNames()
+	if len(names) == 1 && names[0] == AuthenticatorLSAT {
+
+		if !p.accept(r, resourceName) {
+			return "", false
+		}
+		return AuthenticatorLSAT, true
+	}
+
+	i, ok := p.serviceAuthenticator(target).AcceptedBy(
+		r.Context(), &r.Header, resourceName,
+	)
+	if !ok {
+		return "", false
+	}
+
+	return names[i], true
+}
@@ -0,0 +1,292 @@
+package proxy_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestChainedAuthenticators tests that the requests of a service are accepted
+// by any of its authenticators and that rejected requests are challenged by
+// the last one that can issue challenges.
+func TestChainedAuthenticators(t *testing.T) {
+	handler := http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		},
+	)
+	services := []*proxy.Service{{
+		Name:           "mixed",
+		HostRegexp:     testHostRegexp,
+		PathRegexp:     "^/mixed/.*$",
+		Auth:           "on",
+		Price:          10,
+		Authenticators: []string{"apikey", "lsat"},
+		APIKey: proxy.APIKeyConfig{
+			Keys: []string{"partner-key"},
+		},
+		Handler: handler,
+	}, {
+		Name:           "keys",
+		HostRegexp:     testHostRegexp,
+		PathRegexp:     "^/keys/.*$",
+		Auth:           "on",
+		Price:          10,
+		Authenticators: []string{"apikey"},
+		APIKey: proxy.APIKeyConfig{
+			Header: "Authorization",
+			Keys:   []string{"partner-key"},
+		},
+		Handler: handler,
+	}}
+
+	p, err := proxy.New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		path   string
+		header string
+		value  string
+		status int
+	}{{
+		name:   "mixed without credentials",
+		path:   "/mixed/x",
+		status: http.StatusPaymentRequired,
+	}, {
+		name:   "mixed with API key",
+		path:   "/mixed/x",
+		header: "X-Api-Key",
+		value:  "partner-key",
+		status: http.StatusOK,
+	}, {
+		name:   "mixed with unknown API key",
+		path:   "/mixed/x",
+		header: "X-Api-Key",
+		value:  "other-key",
+		status: http.StatusPaymentRequired,
+	}, {
+		name:   "mixed with token",
+		path:   "/mixed/x",
+		header: "Authorization",
+		value:  "LSAT dummy",
+		status: http.StatusOK,
+	}, {
+		name:   "keys without credentials",
+		path:   "/keys/x",
+		status: http.StatusUnauthorized,
+	}, {
+		name:   "keys with bearer API key",
+		path:   "/keys/x",
+		header: "Authorization",
+		value:  "Bearer partner-key",
+		status: http.StatusOK,
+	}, {
+		name:   "keys with token",
+		path:   "/keys/x",
+		header: "Authorization",
+		value:  "LSAT dummy",
+		status: http.StatusUnauthorized,
+	}}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(
+			"GET", "http://localhost:8081"+tc.path, nil,
+		)
+		if tc.header != "" {
+			req.Header.Set(tc.header, tc.value)
+		}
+		rec := httptest.NewRecorder()
+
+		p.ServeHTTP(rec, req)
+		require.Equal(t, tc.status, rec.Code, tc.name)
+		if tc.status == http.StatusUnauthorized {
+			require.Empty(t, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	// Unknown authenticators, API key authenticators without keys and
+	// mtls authenticators without certificate authorities are rejected.
+	for _, name := range []string{"oauth", "apikey", "mtls"} {
+		err = p.UpdateServices([]*proxy.Service{{
+			Name:           "invalid",
+			HostRegexp:     testHostRegexp,
+			Authenticators: []string{name},
+		}})
+		require.Error(t, err, name)
+	}
+}
+
+// newClientCert creates a certificate authority in a PEM file in a temporary
+// directory and returns the file along with a client certificate it issued to
+// the given subject.
+func newClientCert(t *testing.T, subject string) (string, *x509.Certificate) {
+	t.Helper()
+
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		return key
+	}
+
+	caKey := newKey()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(
+		rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey,
+	)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	clientKey := newKey()
+	clientDER, err := x509.CreateCertificate(
+		rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: subject},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{
+				x509.ExtKeyUsageClientAuth,
+			},
+		}, ca, &clientKey.PublicKey, caKey,
+	)
+	require.NoError(t, err)
+	client, err := x509.ParseCertificate(clientDER)
+	require.NoError(t, err)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: caDER,
+	}), 0600)
+	require.NoError(t, err)
+
+	return caFile, client
+}
+
+// TestClientCertAuthenticator tests that the mtls authenticator accepts the
+// client certificates of its certificate authority in a chain of
+// authenticators, and that rejected requests get the challenge of the last
+// authenticator, or none if it can't issue one.
+func TestClientCertAuthenticator(t *testing.T) {
+	caFile, cert := newClientCert(t, "ci.example.com")
+	_, foreignCert := newClientCert(t, "ci.example.com")
+	_, otherCert := newClientCert(t, "other.example.com")
+
+	handler := http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		},
+	)
+	newService := func(name string,
+		authenticators ...string) *proxy.Service {
+
+		return &proxy.Service{
+			Name:           name,
+			HostRegexp:     testHostRegexp,
+			PathRegexp:     "^/" + name + "/.*$",
+			Auth:           "on",
+			Price:          10,
+			Authenticators: authenticators,
+			APIKey: proxy.APIKeyConfig{
+				Keys: []string{"partner-key"},
+			},
+			ClientCert: proxy.ClientCertConfig{
+				CAFile:   caFile,
+				Subjects: []string{"ci.example.com"},
+			},
+			Handler: handler,
+		}
+	}
+	services := []*proxy.Service{
+		newService("paid", "apikey", "mtls", "lsat"),
+		newService("partners", "apikey", "mtls"),
+	}
+	require.True(t, proxy.RequestsClientCerts(services))
+
+	p, err := proxy.New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		path   string
+		cert   *x509.Certificate
+		status int
+	}{{
+		name:   "paid without credentials",
+		path:   "/paid/x",
+		status: http.StatusPaymentRequired,
+	}, {
+		name:   "paid with certificate",
+		path:   "/paid/x",
+		cert:   cert,
+		status: http.StatusOK,
+	}, {
+		name:   "paid with certificate of other CA",
+		path:   "/paid/x",
+		cert:   foreignCert,
+		status: http.StatusPaymentRequired,
+	}, {
+		name:   "paid with certificate of other subject",
+		path:   "/paid/x",
+		cert:   otherCert,
+		status: http.StatusPaymentRequired,
+	}, {
+		name:   "partners without credentials",
+		path:   "/partners/x",
+		status: http.StatusUnauthorized,
+	}, {
+		name:   "partners with certificate",
+		path:   "/partners/x",
+		cert:   cert,
+		status: http.StatusOK,
+	}, {
+		name:   "partners with certificate of other CA",
+		path:   "/partners/x",
+		cert:   foreignCert,
+		status: http.StatusUnauthorized,
+	}}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(
+			"GET", "https://localhost:8081"+tc.path, nil,
+		)
+		if tc.cert != nil {
+			req.TLS.PeerCertificates = []*x509.Certificate{tc.cert}
+		}
+		rec := httptest.NewRecorder()
+
+		p.ServeHTTP(rec, req)
+		require.Equal(t, tc.status, rec.Code, tc.name)
+
+		// The LSAT authenticator comes last and challenges the
+		// rejected requests, the mtls authenticator can't.
+		challenge := rec.Header().Get("WWW-Authenticate")
+		if tc.status == http.StatusPaymentRequired {
+			require.NotEmpty(t, challenge, tc.name)
+		} else {
+			require.Empty(t, challenge, tc.name)
+		}
+	}
+}
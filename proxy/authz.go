@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultAuthzTimeout is the default time the authorization endpoint of
+	// a service has to answer.
+	defaultAuthzTimeout = 2 * time.Second
+
+	// maxAuthzMessageSize is the maximum number of bytes of the body of a
+	// denial of the authorization endpoint that are relayed to the client.
+	maxAuthzMessageSize = 512
+
+	// authzDeniedMessage is the message sent to clients whose request was
+	// denied by an authorization endpoint that didn't give a reason.
+	authzDeniedMessage = "request denied"
+)
+
+var (
+	// authzClient is the client the authorization endpoints are called
+	// with. The timeout of each call is set through its context.
+	authzClient = &http.Client{}
+)
+
+// AuthzConfig holds the options to let the application behind a service decide
+// whether a request may pass before it's forwarded, for example to enforce the
+// limits of a plan or to ban users, while the proxy still handles the payment.
+type AuthzConfig struct {
+	// URL is the authorization endpoint a summary of each request is
+	// POSTed to as JSON. A 2xx response lets the request pass, a 4xx
+	// response denies it with the same status code and the body of the
+	// response as the message.
+	URL string `long:"url" description:"The authorization endpoint a JSON summary of each request is POSTed to before it's forwarded (disabled if empty)"`
+
+	// Secret is sent to the endpoint as a bearer token in the
+	// Authorization header field, so it can tell the calls of the proxy
+	// apart.
+	Secret string `long:"secret" description:"A bearer token the endpoint can check to make sure the proxy calls it" secret:"true"`
+
+	// Timeout is the time the endpoint has to answer.
+	Timeout time.Duration `long:"timeout" description:"The time the endpoint has to answer (default 2s)"`
+
+	// FailOpen can be set to let requests pass if the endpoint can't be
+	// reached or fails. They are answered with a 503 response otherwise.
+	FailOpen bool `long:"failopen" description:"Let requests pass if the endpoint can't be reached or fails"`
+}
+
+// validate checks the authorization options and sets the defaults.
+func (c *AuthzConfig) validate() error {
+	if c.URL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid URL %q", c.URL)
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = defaultAuthzTimeout
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %v", c.Timeout)
+	}
+
+	return nil
+}
+
+// authzRequest is the summary of a request that is sent to an authorization
+// endpoint.
+type authzRequest struct {
+	Service  string `json:"service"`
+	TokenID  string `json:"token_id,omitempty"`
+	Method   string `json:"method"`
+	Host     string `json:"host"`
+	Path     string `json:"path"`
+	Query    string `json:"query,omitempty"`
+	ClientIP string `json:"client_ip,omitempty"`
+}
+
+// authzDecision is the decision of an authorization endpoint about a request.
+type authzDecision struct {
+	status     int
+	message    string
+	retryAfter string
+}
+
+// checkAuthz asks the authorization endpoint of the target service whether the
+// request may pass. Denied requests are answered with the status code and
+// message of the endpoint and false is returned.
+func checkAuthz(w http.ResponseWriter, r *http.Request, target *Service,
+	authenticated bool, remoteIP net.IP, prefixLog *PrefixLog) bool {
+
+	var tokenID string
+	if authenticated {
+		if id, err := tokenIDFromHeader(r.Header); err == nil {
+			tokenID = id.String()
+		}
+	}
+
+	return checkAuthzToken(w, r, target, tokenID, remoteIP, prefixLog)
+}
+
+// checkAuthzToken asks the authorization endpoint of the target service
+// whether the request made with the token of the given ID may pass, like
+// checkAuthz. The ID is empty for requests made without a token.
+func checkAuthzToken(w http.ResponseWriter, r *http.Request, target *Service,
+	tokenID string, remoteIP net.IP, prefixLog *PrefixLog) bool {
+
+	cfg := &target.Authz
+	summary := &authzRequest{
+		Service: target.Name,
+		TokenID: tokenID,
+		Method:  r.Method,
+		Host:    r.Host,
+		Path:    r.URL.Path,
+		Query:   r.URL.RawQuery,
+	}
+	if remoteIP != nil {
+		summary.ClientIP = remoteIP.String()
+	}
+
+	decision, err := callAuthz(r.Context(), cfg, summary)
+	switch {
+	case err != nil && cfg.FailOpen:
+		prefixLog.Errorf("Authorization endpoint failed, letting "+
+			"request pass: %v", err)
+		return true
+
+	case err != nil:
+		prefixLog.Errorf("Authorization endpoint failed: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusServiceUnavailable,
+			"authorization unavailable",
+		)
+		return false
+
+	case decision.status >= 200 && decision.status < 300:
+		traceFromRequest(r).logf("Authorization endpoint allowed the " +
+			"request")
+		return true
+	}
+
+	prefixLog.Infof("Authorization endpoint denied request with status "+
+		"%d", decision.status)
+	traceFromRequest(r).logf("Authorization endpoint denied the request "+
+		"with status %d: %s", decision.status, decision.message)
+
+	// Plan limits may tell the client when to try again.
+	if decision.retryAfter != "" {
+		w.Header().Set(hdrRetryAfter, decision.retryAfter)
+	}
+	message := decision.message
+	if message == "" {
+		message = authzDeniedMessage
+	}
+	sendDirectResponse(w, r, decision.status, message)
+	return false
+}
+
+// callAuthz POSTs the summary of a request to the authorization endpoint and
+// returns its decision. Errors are returned if the endpoint can't be reached
+// or answers with a status that is neither a 2xx nor a 4xx one.
+func callAuthz(ctx context.Context, cfg *AuthzConfig,
+	summary *authzRequest) (*authzDecision, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, cfg.URL, bytes.NewReader(body),
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(hdrContentType, "application/json")
+	if cfg.Secret != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Secret)
+	}
+
+	resp, err := authzClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	decision := &authzDecision{status: resp.StatusCode}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return decision, nil
+	}
+	if resp.StatusCode < 400 || resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	message, err := ioutil.ReadAll(
+		io.LimitReader(resp.Body, maxAuthzMessageSize),
+	)
+	if err != nil {
+		return nil, err
+	}
+	decision.message = strings.TrimSpace(string(message))
+	decision.retryAfter = resp.Header.Get(hdrRetryAfter)
+
+	return decision, nil
+}
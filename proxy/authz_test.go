@@ -0,0 +1,104 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAuthz tests that the authorization endpoint of a service is asked about
+// each request and that its denials are relayed to the client.
+func TestAuthz(t *testing.T) {
+	summaries := make(chan map[string]string, 10)
+	endpoint := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "Bearer secret", r.Header.Get(
+				"Authorization",
+			))
+
+			summary := make(map[string]string)
+			err := json.NewDecoder(r.Body).Decode(&summary)
+			require.NoError(t, err)
+			summaries <- summary
+
+			switch summary["path"] {
+			case "/banned":
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte("user banned"))
+
+			case "/limited":
+				w.Header().Set("Retry-After", "30")
+				w.WriteHeader(http.StatusTooManyRequests)
+
+			case "/broken":
+				w.WriteHeader(http.StatusInternalServerError)
+
+			default:
+				w.WriteHeader(http.StatusNoContent)
+			}
+		},
+	))
+	defer endpoint.Close()
+
+	service := testHandlerService(
+		"authz", "", func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		},
+	)
+	service.Auth = "off"
+	service.Authz = proxy.AuthzConfig{
+		URL:    endpoint.URL,
+		Secret: "secret",
+	}
+	p, err := proxy.New(auth.NewMockAuthenticator(), []*proxy.Service{
+		service,
+	})
+	require.NoError(t, err)
+
+	send := func(path string) *httptest.ResponseRecorder {
+		return serveTestRequest(p, "GET", path+"?a=b", "", nil)
+	}
+
+	// Allowed requests reach the backend and the endpoint gets their
+	// summary.
+	rec := send("/allowed")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "ok", rec.Body.String())
+	summary := <-summaries
+	require.Equal(t, "authz", summary["service"])
+	require.Equal(t, "GET", summary["method"])
+	require.Equal(t, "a=b", summary["query"])
+	require.Equal(t, "192.0.2.1", summary["client_ip"])
+	require.Empty(t, summary["token_id"])
+
+	// Denials are relayed with their status, message and retry time.
+	rec = send("/banned")
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Contains(t, rec.Body.String(), "user banned")
+	<-summaries
+
+	rec = send("/limited")
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	require.Equal(t, "30", rec.Header().Get("Retry-After"))
+	<-summaries
+
+	// Requests aren't let through if the endpoint fails.
+	rec = send("/broken")
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	<-summaries
+
+	// Invalid endpoints are rejected.
+	err = p.UpdateServices([]*proxy.Service{{
+		Name:       "invalid",
+		HostRegexp: testHostRegexp,
+		Authz: proxy.AuthzConfig{
+			URL: "ftp://localhost",
+		},
+	}})
+	require.Error(t, err)
+}
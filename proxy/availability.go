@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/aperture/pricer"
+)
+
+const (
+	// defaultClosedMessage is the default body of the responses of a
+	// service outside its availability windows.
+	defaultClosedMessage = "service closed"
+
+	// dayLength is the length of a day in wall clock time.
+	dayLength = 24 * time.Hour
+)
+
+var (
+	// weekdays are the abbreviations of the days of the week in windows,
+	// in the order of time.Weekday.
+	weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// AvailabilityConfig holds the windows of time a service is open in, like the
+// hours of a market for a data product. Outside of them, its requests are
+// answered with a 503 response, or charged another price.
+type AvailabilityConfig struct {
+	// Windows are the windows the service is open in, each of the form
+	// "<days> <HH:MM>-<HH:MM>". Days are a comma separated list of days
+	// like mon or ranges like mon-fri, or * for every day. A window that
+	// ends before it starts ends on the next day.
+	Windows []string `long:"window" description:"A window the service is open in, like \"mon-fri 09:30-16:00\", can be given multiple times (default: always open)"`
+
+	// TimeZone is the IANA name of the time zone the windows are in.
+	TimeZone string `long:"timezone" description:"The IANA time zone of the windows, like America/New_York (default: UTC)"`
+
+	// Message is the body of the responses outside the windows, or the
+	// gRPC status message for gRPC clients.
+	Message string `long:"message" description:"The body of the responses outside the windows (default: service closed)"`
+
+	// ClosedPrice is the price of the service outside the windows. If it's
+	// set, the service stays reachable outside them at this price instead
+	// of answering with a 503 response.
+	ClosedPrice int64 `long:"closedprice" description:"The price in satoshis outside the windows, which keeps the service reachable instead of answering with a 503 response"`
+}
+
+// window is a parsed availability window.
+type window struct {
+	days       [7]bool
+	start, end time.Duration
+}
+
+// availability is the compiled form of an AvailabilityConfig.
+type availability struct {
+	windows []window
+	loc     *time.Location
+}
+
+// newAvailability compiles the windows of an availability configuration. If
+// there are none, nil is returned.
+func newAvailability(cfg *AvailabilityConfig) (*availability, error) {
+	if cfg.ClosedPrice < 0 || cfg.ClosedPrice > maxServicePrice {
+		return nil, fmt.Errorf("invalid closed price %d",
+			cfg.ClosedPrice)
+	}
+	if len(cfg.Windows) == 0 {
+		return nil, nil
+	}
+
+	a := &availability{loc: time.UTC}
+	if cfg.TimeZone != "" {
+		loc, err := time.LoadLocation(cfg.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone: %v", err)
+		}
+		a.loc = loc
+	}
+
+	for _, value := range cfg.Windows {
+		w, err := parseWindow(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid window %q: %v", value,
+				err)
+		}
+		a.windows = append(a.windows, w)
+	}
+
+	return a, nil
+}
+
+// parseWindow parses a window of the form "<days> <HH:MM>-<HH:MM>".
+func parseWindow(value string) (window, error) {
+	var w window
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return w, fmt.Errorf("must be of the form <days> " +
+			"<HH:MM>-<HH:MM>")
+	}
+
+	for _, days := range strings.Split(strings.ToLower(fields[0]), ",") {
+		if days == "*" {
+			for i := range w.days {
+				w.days[i] = true
+			}
+			continue
+		}
+
+		bounds := strings.SplitN(days, "-", 2)
+		first, err := parseWeekday(bounds[0])
+		if err != nil {
+			return w, err
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = parseWeekday(bounds[1])
+			if err != nil {
+				return w, err
+			}
+		}
+
+		// Ranges may wrap around the end of the week, like sat-mon.
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	times := strings.SplitN(fields[1], "-", 2)
+	if len(times) != 2 {
+		return w, fmt.Errorf("times must be of the form HH:MM-HH:MM")
+	}
+	var err error
+	if w.start, err = parseTimeOfDay(times[0]); err != nil {
+		return w, err
+	}
+	if w.end, err = parseTimeOfDay(times[1]); err != nil {
+		return w, err
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("window must not be empty")
+	}
+
+	return w, nil
+}
+
+// parseWeekday parses the abbreviation of a day of the week.
+func parseWeekday(value string) (int, error) {
+	for i, weekday := range weekdays {
+		if value == weekday {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q", value)
+}
+
+// parseTimeOfDay parses a time of day of the form HH:MM, where 24:00 is the
+// end of the day.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || len(parts[1]) != 2 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+
+	offset := time.Duration(hours)*time.Hour +
+		time.Duration(minutes)*time.Minute
+	if hours < 0 || minutes < 0 || minutes > 59 || offset > dayLength {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+
+	return offset, nil
+}
+
+// open returns true if the given time is within one of the windows.
+func (a *availability) open(t time.Time) bool {
+	// Windows are in wall clock time, so they don't move on the days
+	// daylight saving time changes.
+	t = t.In(a.loc)
+	offset := time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	today := int(t.Weekday())
+	yesterday := (today + 6) % 7
+
+	for _, w := range a.windows {
+		if w.start < w.end {
+			if w.days[today] && offset >= w.start &&
+				offset < w.end {
+
+				return true
+			}
+			continue
+		}
+
+		// Windows that end before they start run into the next day.
+		if (w.days[today] && offset >= w.start) ||
+			(w.days[yesterday] && offset < w.end) {
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// nextOpen returns the time the next window after the given time opens.
+func (a *availability) nextOpen(t time.Time) time.Time {
+	t = t.In(a.loc)
+	var next time.Time
+	for d := 0; d <= 7; d++ {
+		date := time.Date(
+			t.Year(), t.Month(), t.Day()+d, 0, 0, 0, 0, a.loc,
+		)
+		for _, w := range a.windows {
+			start := time.Date(
+				date.Year(), date.Month(), date.Day(), 0,
+				int(w.start/time.Minute), 0, 0, a.loc,
+			)
+			if !w.days[date.Weekday()] || !start.After(t) {
+				continue
+			}
+			if next.IsZero() || start.Before(next) {
+				next = start
+			}
+		}
+		if !next.IsZero() {
+			return next
+		}
+	}
+
+	return t.Add(dayLength)
+}
+
+// checkAvailability makes sure the target service is open. Requests to a
+// closed service that isn't reachable at another price are answered with a 503
+// response that tells the client when it opens again, and false is returned.
+func checkAvailability(w http.ResponseWriter, r *http.Request,
+	target *Service) bool {
+
+	a := target.availability
+	if a == nil || target.Availability.ClosedPrice > 0 {
+		return true
+	}
+
+	now := time.Now()
+	if a.open(now) {
+		return true
+	}
+
+	message := target.Availability.Message
+	if message == "" {
+		message = defaultClosedMessage
+	}
+
+	// The header field is in whole seconds, which we round up so clients
+	// don't come back too early.
+	seconds := int64(math.Ceil(a.nextOpen(now).Sub(now).Seconds()))
+	w.Header().Set(hdrRetryAfter, strconv.FormatInt(seconds, 10))
+	addCorsHeaders(w.Header())
+	sendDirectResponse(w, r, http.StatusServiceUnavailable, message)
+	return false
+}
+
+// closedPricer is a Pricer that returns a fixed price while a service is
+// outside its availability windows and the price of another pricer otherwise.
+type closedPricer struct {
+	base         pricer.Pricer
+	availability *availability
+	price        int64
+}
+
+// A compile-time constraint to ensure closedPricer implements Pricer.
+var _ pricer.Pricer = (*closedPricer)(nil)
+
+// GetPrice returns the closed price if the service is closed, otherwise the
+// price of the base pricer.
+//
+// NOTE: This is part of the Pricer interface.
+func (c *closedPricer) GetPrice(ctx context.Context, path string) (int64,
+	error) {
+
+	if !c.availability.open(time.Now()) {
+		return c.price, nil
+	}
+	return c.base.GetPrice(ctx, path)
+}
+
+// Close closes the base pricer.
+//
+// NOTE: This is part of the Pricer interface.
+func (c *closedPricer) Close() error {
+	return c.base.Close()
+}
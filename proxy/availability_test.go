@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestAvailability tests that services are only open within their windows and
+// that the next opening is found.
+func TestAvailability(t *testing.T) {
+	for _, value := range []string{
+		"mon 09:00", "xyz 09:00-10:00", "mon 9-10", "mon 09:00-09:00",
+		"mon 09:60-10:00", "mon 09:00-25:00",
+	} {
+		_, err := newAvailability(&AvailabilityConfig{
+			Windows: []string{value},
+		})
+		require.Error(t, err, value)
+	}
+
+	a, err := newAvailability(&AvailabilityConfig{})
+	require.NoError(t, err)
+	require.Nil(t, a)
+
+	a, err = newAvailability(&AvailabilityConfig{
+		Windows: []string{"mon-fri 09:30-16:00", "sat 22:00-02:00"},
+	})
+	require.NoError(t, err)
+
+	// June 7th 2021 is a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2021, 6, day, hour, minute, 0, 0, time.UTC)
+	}
+	testCases := []struct {
+		name string
+		time time.Time
+		open bool
+		next time.Time
+	}{{
+		name: "before opening",
+		time: at(7, 9, 29),
+		next: at(7, 9, 30),
+	}, {
+		name: "opening",
+		time: at(7, 9, 30),
+		open: true,
+	}, {
+		name: "closing",
+		time: at(11, 16, 0),
+		next: at(12, 22, 0),
+	}, {
+		name: "saturday night",
+		time: at(12, 23, 0),
+		open: true,
+	}, {
+		name: "after midnight",
+		time: at(13, 1, 59),
+		open: true,
+	}, {
+		name: "sunday",
+		time: at(13, 2, 0),
+		next: at(14, 9, 30),
+	}}
+	for _, tc := range testCases {
+		require.Equal(t, tc.open, a.open(tc.time), tc.name)
+		if !tc.open {
+			require.Equal(t, tc.next, a.nextOpen(tc.time), tc.name)
+		}
+	}
+
+	// The windows are in the configured time zone.
+	a, err = newAvailability(&AvailabilityConfig{
+		Windows:  []string{"* 09:00-17:00"},
+		TimeZone: "America/New_York",
+	})
+	require.NoError(t, err)
+	require.False(t, a.open(at(7, 9, 0)))
+	require.True(t, a.open(at(7, 14, 0)))
+}
@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"gopkg.in/macaroon.v2"
+)
+
+var (
+	// ErrBalanceExhausted is returned if a message can't be delivered
+	// because the token of the stream has used up all the messages it paid
+	// for.
+	ErrBalanceExhausted = errors.New("prepaid message balance exhausted")
+)
+
+// BillingConfig holds the options to charge for the messages of gRPC streams.
+// By default, a token pays for access to a service, no matter how many
+// messages a stream established with it delivers.
+type BillingConfig struct {
+	// PerMessage can be set to charge for every message the backend sends
+	// on a gRPC stream instead. Each message is deducted from the balance
+	// the token was issued with, and once it's used up, the stream ends
+	// and new streams are answered with a fresh challenge.
+	PerMessage bool `long:"permessage" description:"Deduct every gRPC message the backend sends from the prepaid balance of the token"`
+
+	// Messages is the number of messages a new token pays for. The holder
+	// of a token can lower the balance with a messages caveat before
+	// handing it to someone else.
+	Messages uint64 `long:"messages" description:"The number of messages a token pays for if billing per message"`
+
+	// TopUp can be set to let the holders of tokens buy more messages for
+	// the same token once they run low, instead of a new token.
+	TopUp bool `long:"topup" description:"Let the holders of tokens top up their message balance at the price of the service"`
+}
+
+// validate checks the billing options.
+func (c *BillingConfig) validate() error {
+	if c.PerMessage && c.Messages == 0 {
+		return fmt.Errorf("number of messages required for billing " +
+			"per message")
+	}
+	if c.TopUp && !c.PerMessage {
+		return fmt.Errorf("top-ups require billing per message")
+	}
+
+	return nil
+}
+
+// BalanceStore is an entity that keeps track of the number of messages that
+// were delivered with each token, so the prepaid balance of a token can be
+// enforced.
+type BalanceStore interface {
+	// Spent returns the number of messages that were delivered with the
+	// token so far.
+	Spent(context.Context, lsat.TokenID) (uint64, error)
+
+	// Spend records that a message was delivered with the token if fewer
+	// than the given balance of messages were delivered with it before.
+	// If the balance is used up, false is returned and nothing is changed.
+	Spend(context.Context, lsat.TokenID, uint64) (bool, error)
+
+	// SpendAll records that all messages that are left of the given
+	// balance were used up at once, for example because they were refunded.
+	// The number of messages that were left is returned.
+	SpendAll(context.Context, lsat.TokenID, uint64) (uint64, error)
+}
+
+// memBalanceStore is a BalanceStore that keeps the spent messages in memory.
+type memBalanceStore struct {
+	sync.Mutex
+	spent map[lsat.TokenID]uint64
+}
+
+// A compile-time constraint to ensure memBalanceStore implements BalanceStore.
+var _ BalanceStore = (*memBalanceStore)(nil)
+
+// newMemBalanceStore creates a new, empty in-memory balance store.
+func newMemBalanceStore() *memBalanceStore {
+	return &memBalanceStore{
+		spent: make(map[lsat.TokenID]uint64),
+	}
+}
+
+// Spent returns the number of messages that were delivered with the token so
+// far.
+//
+// NOTE: This is part of the BalanceStore interface.
+func (s *memBalanceStore) Spent(_ context.Context,
+	tokenID lsat.TokenID) (uint64, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.spent[tokenID], nil
+}
+
+// Spend records that a message was delivered with the token if its balance
+// isn't used up yet.
+//
+// NOTE: This is part of the BalanceStore interface.
+func (s *memBalanceStore) Spend(_ context.Context, tokenID lsat.TokenID,
+	balance uint64) (bool, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.spent[tokenID] >= balance {
+		return false, nil
+	}
+	s.spent[tokenID]++
+	return true, nil
+}
+
+// SpendAll records that all messages that are left of the balance were used up
+// at once.
+//
+// NOTE: This is part of the BalanceStore interface.
+func (s *memBalanceStore) SpendAll(_ context.Context, tokenID lsat.TokenID,
+	balance uint64) (uint64, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	spent := s.spent[tokenID]
+	if spent >= balance {
+		return 0, nil
+	}
+	s.spent[tokenID] = balance
+	return balance - spent, nil
+}
+
+// messageMeter deducts the messages of a stream from the balance of the token
+// the stream was established with.
+type messageMeter struct {
+	store   BalanceStore
+	tokenID lsat.TokenID
+	balance uint64
+
+	// topUps holds the messages credited to the token, which are added
+	// to the balance it was issued with. If it's nil, the balance can't
+	// be topped up.
+	topUps      TopUpStore
+	baseBalance uint64
+}
+
+// spend deducts one message from the balance of the token. If the balance is
+// used up, ErrBalanceExhausted is returned, unless it was topped up while the
+// stream was open.
+func (m *messageMeter) spend(ctx context.Context) error {
+	ok, err := m.store.Spend(ctx, m.tokenID, m.balance)
+	if err != nil {
+		return fmt.Errorf("unable to spend message: %v", err)
+	}
+	if ok {
+		return nil
+	}
+
+	if m.topUps == nil {
+		return ErrBalanceExhausted
+	}
+	credited, err := m.topUps.Credited(ctx, m.tokenID)
+	if err != nil {
+		return fmt.Errorf("unable to query top-ups: %v", err)
+	}
+	if m.baseBalance+credited <= m.balance {
+		return ErrBalanceExhausted
+	}
+
+	m.balance = m.baseBalance + credited
+	return m.spend(ctx)
+}
+
+// meterKey is the context key under which the message meter of a request is
+// stored.
+type meterKey struct{}
+
+// contextWithMeter returns a context that carries the meter the messages of the
+// response are deducted with.
+func contextWithMeter(ctx context.Context,
+	meter *messageMeter) context.Context {
+
+	return context.WithValue(ctx, meterKey{}, meter)
+}
+
+// meterFromContext returns the meter the messages of the response are deducted
+// with, or nil if they aren't billed.
+func meterFromContext(ctx context.Context) *messageMeter {
+	meter, _ := ctx.Value(meterKey{}).(*messageMeter)
+	return meter
+}
+
+// tokenMessages returns the number of messages the token was issued with. The
+// caveat was already verified to not raise the balance the service issues new
+// tokens with.
+func tokenMessages(mac *macaroon.Macaroon, target *Service) (uint64, error) {
+	cond := target.Name + lsat.CondMessagesSuffix
+	value, ok := lsat.HasCaveat(mac, cond)
+	if !ok {
+		return target.Billing.Messages, nil
+	}
+
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// meterMessages attaches a meter to an authenticated request to a service that
+// is billed per message, so every message of the response is deducted from the
+// balance of the token. If the balance is already used up, a fresh challenge is
+// sent to the client and false is returned.
+func (p *Proxy) meterMessages(w http.ResponseWriter, r *http.Request,
+	target *Service, prefixLog *PrefixLog) (*http.Request, bool) {
+
+	mac, _, err := lsat.FromHeader(&r.Header)
+	if err != nil {
+		prefixLog.Errorf("Error reading token for billing: %v", err)
+		sendDirectResponse(w, r, http.StatusUnauthorized, "invalid token")
+		return nil, false
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		prefixLog.Errorf("Error decoding token for billing: %v", err)
+		sendDirectResponse(w, r, http.StatusUnauthorized, "invalid token")
+		return nil, false
+	}
+
+	balance, err := tokenMessages(mac, target)
+	if err != nil {
+		prefixLog.Infof("Invalid messages caveat: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "invalid token",
+		)
+		return nil, false
+	}
+
+	// Top-ups add to the balance the token was issued with.
+	meter := &messageMeter{
+		store:       p.balanceStore,
+		tokenID:     id.TokenID,
+		balance:     balance,
+		baseBalance: balance,
+	}
+	if target.Billing.TopUp {
+		credited, err := p.topUpStore.Credited(r.Context(), id.TokenID)
+		if err != nil {
+			prefixLog.Errorf("Error querying top-ups: %v", err)
+			sendDirectResponse(
+				w, r, http.StatusInternalServerError,
+				"balance failure",
+			)
+			return nil, false
+		}
+		meter.topUps = p.topUpStore
+		meter.balance += credited
+	}
+
+	spent, err := p.balanceStore.Spent(r.Context(), id.TokenID)
+	if err != nil {
+		prefixLog.Errorf("Error querying message balance: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "balance failure",
+		)
+		return nil, false
+	}
+	if spent >= meter.balance {
+		price, err := target.pricer.GetPrice(r.Context(), r.URL.Path)
+		if err != nil {
+			prefixLog.Errorf("error getting resource price: %v",
+				err)
+			sendDirectResponse(
+				w, r, http.StatusInternalServerError,
+				"failure fetching resource price",
+			)
+			return nil, false
+		}
+
+		prefixLog.Infof("Message balance of token used up. Sending " +
+			"402.")
+		p.handlePaymentRequired(
+			w, r, target, target.ResourceName(r.URL.Path), price,
+		)
+		return nil, false
+	}
+
+	return r.WithContext(contextWithMeter(r.Context(), meter)), true
+}
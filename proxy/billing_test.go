@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+// TestMeteredResponse tests that every message of a billed stream is deducted
+// from the balance of its token and that the stream ends once the balance is
+// used up.
+func TestMeteredResponse(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		store  = newMemBalanceStore()
+		target = &Service{
+			Limits: LimitsConfig{MaxMessageSize: 16},
+			Billing: BillingConfig{
+				PerMessage: true,
+				Messages:   3,
+			},
+		}
+		meter = &messageMeter{
+			store:   store,
+			tokenID: lsat.TokenID{1},
+			balance: target.Billing.Messages,
+		}
+	)
+
+	newResponse := func(stream []byte) *http.Response {
+		req := httptest.NewRequest("POST", "/pkg.Service/Method", nil)
+		reqCtx := contextWithMeter(contextWithService(ctx, target), meter)
+
+		res := &http.Response{
+			Header:  http.Header{},
+			Body:    ioutil.NopCloser(bytes.NewReader(stream)),
+			Request: req.WithContext(reqCtx),
+		}
+		res.Header.Set(hdrContentType, hdrTypeGrpc)
+		require.NoError(t, limitResponse(res))
+
+		return res
+	}
+	requireStatus := func(res *http.Response, code codes.Code) {
+		require.NoError(t, res.Body.Close())
+		require.Equal(
+			t, strconv.Itoa(int(code)), res.Trailer.Get(hdrGrpcStatus),
+		)
+	}
+
+	// A message that is too large isn't billed.
+	res := newResponse(grpcMessages(4, 32))
+	read, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, grpcMessages(4), read)
+	requireStatus(res, codes.ResourceExhausted)
+
+	spent, err := store.Spent(ctx, meter.tokenID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), spent)
+
+	// The stream ends once the balance is used up.
+	res = newResponse(grpcMessages(1, 2, 3))
+	read, err = ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, grpcMessages(1, 2), read)
+	requireStatus(res, codes.ResourceExhausted)
+	require.Contains(
+		t, res.Trailer.Get(hdrGrpcMessage), ErrBalanceExhausted.Error(),
+	)
+
+	spent, err = store.Spent(ctx, meter.tokenID)
+	require.NoError(t, err)
+	require.Equal(t, target.Billing.Messages, spent)
+
+	// Responses without a meter aren't billed.
+	target.Limits.MaxMessageSize = 0
+	req := httptest.NewRequest("POST", "/pkg.Service/Method", nil)
+	res = &http.Response{
+		Header:  http.Header{},
+		Body:    ioutil.NopCloser(bytes.NewReader(grpcMessages(1))),
+		Request: req.WithContext(contextWithService(ctx, target)),
+	}
+	res.Header.Set(hdrContentType, hdrTypeGrpc)
+	require.NoError(t, limitResponse(res))
+	_, ok := res.Body.(*limitResponseBody)
+	require.False(t, ok)
+}
+
+// TestBillingConfig tests that billing per message requires a balance.
+func TestBillingConfig(t *testing.T) {
+	require.NoError(t, (&BillingConfig{}).validate())
+	require.Error(t, (&BillingConfig{PerMessage: true}).validate())
+	require.NoError(
+		t, (&BillingConfig{PerMessage: true, Messages: 10}).validate(),
+	)
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// defaultBindingIPv4Prefix is the default length of the IPv4 network
+	// prefix tokens are bound to.
+	defaultBindingIPv4Prefix = 24
+
+	// defaultBindingIPv6Prefix is the default length of the IPv6 network
+	// prefix tokens are bound to.
+	defaultBindingIPv6Prefix = 64
+)
+
+// BindingConfig holds the options to bind the tokens of a service to the
+// client that paid for them, so a stolen token can't be used from elsewhere.
+type BindingConfig struct {
+	// IP can be set to bind new tokens to the network prefix of the IP
+	// address of the client they are issued to.
+	IP bool `long:"ip" description:"Bind new tokens to the network prefix of the client's IP address"`
+
+	// IPv4Prefix is the length of the network prefix IPv4 addresses are
+	// bound with.
+	IPv4Prefix int `long:"ipv4prefix" description:"The length of the network prefix of IPv4 clients (default 24)"`
+
+	// IPv6Prefix is the length of the network prefix IPv6 addresses are
+	// bound with.
+	IPv6Prefix int `long:"ipv6prefix" description:"The length of the network prefix of IPv6 clients (default 64)"`
+
+	// TLS can be set to bind new tokens to the TLS connection they are
+	// issued on. Such a token can only be used as long as the client keeps
+	// the connection open, which makes it suited for long-lived HTTP/2
+	// connections like those of gRPC clients.
+	TLS bool `long:"tls" description:"Bind new tokens to the TLS connection they are issued on"`
+
+	// Path can be set to bind new tokens to the URL path of the request
+	// they are issued for, so a token only unlocks the single resource it
+	// was bought for, like a file that is priced on its own.
+	Path bool `long:"path" description:"Bind new tokens to the URL path of the resource they are bought for"`
+}
+
+// validate checks the binding options and sets the default prefix lengths.
+func (c *BindingConfig) validate() error {
+	if c.IPv4Prefix == 0 {
+		c.IPv4Prefix = defaultBindingIPv4Prefix
+	}
+	if c.IPv6Prefix == 0 {
+		c.IPv6Prefix = defaultBindingIPv6Prefix
+	}
+
+	if c.IPv4Prefix < 0 || c.IPv4Prefix > 8*net.IPv4len {
+		return fmt.Errorf("invalid IPv4 prefix length %d",
+			c.IPv4Prefix)
+	}
+	if c.IPv6Prefix < 0 || c.IPv6Prefix > 8*net.IPv6len {
+		return fmt.Errorf("invalid IPv6 prefix length %d",
+			c.IPv6Prefix)
+	}
+
+	return nil
+}
+
+// caveats returns the caveats that bind a new token to the client of the given
+// request context.
+func (c *BindingConfig) caveats(ctx context.Context) ([]lsat.Caveat, error) {
+	var caveats []lsat.Caveat
+
+	if c.IP {
+		clientIP, _ := lsat.FromContext(ctx, lsat.KeyClientIP).(net.IP)
+		if clientIP == nil {
+			return nil, fmt.Errorf("client IP unknown")
+		}
+
+		prefixLen := c.IPv6Prefix
+		if clientIP.To4() != nil {
+			prefixLen = c.IPv4Prefix
+		}
+		caveat, err := lsat.NewClientIPCaveat(clientIP, prefixLen)
+		if err != nil {
+			return nil, err
+		}
+		caveats = append(caveats, caveat)
+	}
+
+	if c.TLS {
+		binding, _ := lsat.FromContext(ctx, lsat.KeyTLSBinding).([]byte)
+		if binding == nil {
+			return nil, lsat.ErrNoTLSBinding
+		}
+		caveats = append(caveats, lsat.NewTLSBindingCaveat(binding))
+	}
+
+	if c.Path {
+		path, _ := lsat.FromContext(ctx, lsat.KeyRequestPath).(string)
+		if path == "" {
+			return nil, fmt.Errorf("request path unknown")
+		}
+		caveats = append(caveats, lsat.NewPathCaveat(path))
+	}
+
+	return caveats, nil
+}
+
+// withClientBinding returns a request whose context carries the IP address
+// and, if available, the TLS channel binding and certificates of the client as
+// well as the path and method of the request, so tokens bound to them can be
+// issued and verified and clients authenticated with their certificate.
+func withClientBinding(r *http.Request, remoteIP net.IP) *http.Request {
+	ctx := lsat.AddToContext(r.Context(), lsat.KeyClientIP, remoteIP)
+	ctx = lsat.AddToContext(ctx, lsat.KeyRequestPath, r.URL.Path)
+	ctx = lsat.AddToContext(ctx, lsat.KeyRequestMethod, r.Method)
+
+	if r.TLS != nil {
+		binding, err := lsat.TLSBinding(r.TLS)
+		if err == nil {
+			ctx = lsat.AddToContext(ctx, lsat.KeyTLSBinding, binding)
+		}
+
+		if len(r.TLS.PeerCertificates) > 0 {
+			ctx = lsat.AddToContext(
+				ctx, lsat.KeyPeerCertificates,
+				r.TLS.PeerCertificates,
+			)
+		}
+	}
+
+	return r.WithContext(ctx)
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// defaultMaxBufferSize is the default maximum size of a buffered
+	// request or response body.
+	defaultMaxBufferSize = 10 * 1024 * 1024
+)
+
+// BufferingConfig holds the options to buffer the request and response bodies
+// of a service instead of streaming them. Streaming keeps the memory usage low
+// and is required for large uploads, server-sent events and gRPC streams.
+// Buffered requests can be retried by the transport if a reused connection to
+// the backend turns out to be closed, and buffered responses are passed on
+// with a Content-Length.
+type BufferingConfig struct {
+	// Request can be set to read the whole request body before it's
+	// forwarded to the backend.
+	Request bool `long:"request" description:"Read the whole request body before forwarding it to the backend"`
+
+	// Response can be set to read the whole response body of the backend
+	// before it's passed on to the client.
+	Response bool `long:"response" description:"Read the whole response body of the backend before passing it on to the client"`
+
+	// MaxRequestSize is the maximum size in bytes of a buffered request
+	// body. Larger requests are rejected.
+	MaxRequestSize int64 `long:"maxrequestsize" description:"The maximum size in bytes of a buffered request body (default 10 MiB)"`
+
+	// MaxResponseSize is the maximum size in bytes of a buffered response
+	// body. Larger responses are replaced by an error.
+	MaxResponseSize int64 `long:"maxresponsesize" description:"The maximum size in bytes of a buffered response body (default 10 MiB)"`
+}
+
+// validate checks the buffering options and sets the default sizes.
+func (c *BufferingConfig) validate() error {
+	if c.MaxRequestSize < 0 || c.MaxResponseSize < 0 {
+		return fmt.Errorf("negative buffer size")
+	}
+	if c.MaxRequestSize == 0 {
+		c.MaxRequestSize = defaultMaxBufferSize
+	}
+	if c.MaxResponseSize == 0 {
+		c.MaxResponseSize = defaultMaxBufferSize
+	}
+
+	return nil
+}
+
+// BufferSizeError is returned if a body that is buffered exceeds the maximum
+// buffer size of its service.
+type BufferSizeError struct {
+	// Max is the maximum buffer size of the service.
+	Max int64
+}
+
+// Error returns a human readable description of the error.
+func (e *BufferSizeError) Error() string {
+	return fmt.Sprintf("body larger than max buffer size (%d)", e.Max)
+}
+
+// readBuffered reads the whole body, up to the given maximum size. If the size
+// of the body is known, it's read into a buffer of that size at once instead of
+// one that grows while it's read.
+func readBuffered(body io.Reader, max, size int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if size > 0 && size <= max {
+		buf.Grow(int(size) + bytes.MinRead)
+	}
+
+	_, err := buf.ReadFrom(io.LimitReader(body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) > max {
+		return nil, &BufferSizeError{Max: max}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// bufferRequest reads the body of the request if the service buffers its
+// requests, so it can be sent again if the transport needs to retry it. If the
+// body can't be read, an error response is sent and false returned.
+func bufferRequest(w http.ResponseWriter, r *http.Request, target *Service,
+	prefixLog *PrefixLog) bool {
+
+	cfg := target.Buffering
+	if !cfg.Request || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+
+	data, err := readBuffered(
+		r.Body, cfg.MaxRequestSize, r.ContentLength,
+	)
+	_ = r.Body.Close()
+	switch err.(type) {
+	case nil:
+
+	case *BufferSizeError:
+		prefixLog.Infof("Request rejected: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusRequestEntityTooLarge,
+			"request body too large",
+		)
+		return false
+
+	default:
+		prefixLog.Debugf("Error reading request body: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusBadRequest,
+			"unable to read request body",
+		)
+		return false
+	}
+
+	r.GetBody = func() (io.ReadCloser, error) {
+		if len(data) == 0 {
+			return http.NoBody, nil
+		}
+
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	r.Body, _ = r.GetBody()
+	r.ContentLength = int64(len(data))
+	r.TransferEncoding = nil
+
+	return true
+}
+
+// bufferResponse reads the body of the response if the service buffers its
+// responses. Responses that are larger than the maximum buffer size of the
+// service are replaced by an error.
+func bufferResponse(res *http.Response) error {
+	target := serviceFromContext(res.Request.Context())
+	if target == nil || !target.Buffering.Response {
+		return nil
+	}
+
+	data, err := readBuffered(
+		res.Body, target.Buffering.MaxResponseSize, res.ContentLength,
+	)
+	_ = res.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	res.Body = ioutil.NopCloser(bytes.NewReader(data))
+	res.ContentLength = int64(len(data))
+	res.TransferEncoding = nil
+	res.Header.Set("Content-Length", strconv.Itoa(len(data)))
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestBuffering tests that the request and response bodies of services that
+// buffer them are read completely and limited in size.
+func TestBuffering(t *testing.T) {
+	target := &Service{Buffering: BufferingConfig{
+		Request:         true,
+		Response:        true,
+		MaxRequestSize:  4,
+		MaxResponseSize: 4,
+	}}
+	require.NoError(t, target.Buffering.validate())
+	_, prefixLog := NewRemoteIPPrefixLog(log, "127.0.0.1:1234")
+
+	newReq := func(body string) *http.Request {
+		req := httptest.NewRequest(
+			"POST", "http://localhost/", strings.NewReader(body),
+		)
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+		return req
+	}
+
+	// A buffered request can be read again.
+	req := newReq("body")
+	rec := httptest.NewRecorder()
+	require.True(t, bufferRequest(rec, req, target, prefixLog))
+	require.EqualValues(t, 4, req.ContentLength)
+	require.Empty(t, req.TransferEncoding)
+	for i := 0; i < 2; i++ {
+		body, err := req.GetBody()
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(body)
+		require.NoError(t, err)
+		require.Equal(t, "body", string(data))
+	}
+
+	// A request that is too large is rejected.
+	rec = httptest.NewRecorder()
+	require.False(t, bufferRequest(rec, newReq("large"), target, prefixLog))
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	// Responses get a Content-Length once they're read.
+	newRes := func(body string) *http.Response {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		return &http.Response{
+			Header: make(http.Header),
+			Body: ioutil.NopCloser(
+				bytes.NewReader([]byte(body)),
+			),
+			ContentLength:    -1,
+			TransferEncoding: []string{"chunked"},
+			Request: req.WithContext(
+				contextWithService(req.Context(), target),
+			),
+		}
+	}
+	res := newRes("body")
+	require.NoError(t, bufferResponse(res))
+	require.EqualValues(t, 4, res.ContentLength)
+	require.Equal(t, "4", res.Header.Get("Content-Length"))
+
+	err := bufferResponse(newRes("large"))
+	require.IsType(t, &BufferSizeError{}, err)
+
+	// Services that stream their bodies aren't affected.
+	target.Buffering = BufferingConfig{}
+	req = newReq("large")
+	require.True(t, bufferRequest(rec, req, target, prefixLog))
+	require.EqualValues(t, -1, req.ContentLength)
+}
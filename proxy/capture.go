@@ -0,0 +1,441 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCaptureSize is the default number of exchanges that are kept
+	// for each service.
+	defaultCaptureSize = 100
+
+	// defaultCaptureBodySize is the default number of bytes of each
+	// request and response body that are kept.
+	defaultCaptureBodySize = 4096
+
+	// maxCaptureSize is the maximum number of exchanges that can be kept
+	// for each service.
+	maxCaptureSize = 10000
+
+	// RedactedValue replaces the values of sensitive header fields in
+	// captured exchanges.
+	RedactedValue = "[redacted]"
+
+	// CaptureAuthOff is the auth outcome of requests to resources that
+	// don't require authentication.
+	CaptureAuthOff = "off"
+
+	// CaptureAuthToken is the auth outcome of requests that were made with
+	// a valid token.
+	CaptureAuthToken = "token"
+
+	// CaptureAuthFreebie is the auth outcome of free requests.
+	CaptureAuthFreebie = "freebie"
+
+	// CaptureAuthSignedURL is the auth outcome of requests that were made
+	// with a signed URL.
+	CaptureAuthSignedURL = "signedurl"
+
+	// CaptureAuthChallenged is the auth outcome of requests that were
+	// answered with a payment challenge.
+	CaptureAuthChallenged = "challenged"
+
+	// CaptureAuthRejected is the auth outcome of requests that were
+	// answered before they were authenticated, for example because they
+	// were filtered or the service is under maintenance.
+	CaptureAuthRejected = "rejected"
+)
+
+var (
+	// sensitiveHeaders are the header fields whose values are always
+	// redacted in captured exchanges since they carry credentials.
+	sensitiveHeaders = []string{
+		"Authorization", "Cookie", "Set-Cookie", "Macaroon",
+		"Grpc-Metadata-Macaroon", "Proxy-Authorization",
+	}
+)
+
+// CaptureConfig holds the options to record the requests of a service and the
+// responses to them for debugging.
+type CaptureConfig struct {
+	// Enabled can be set to record the exchanges of the service.
+	Enabled bool `long:"enabled" description:"Record the requests of the service and their responses for debugging"`
+
+	// Size is the number of the most recent exchanges that are kept.
+	Size int `long:"size" description:"The number of the most recent exchanges that are kept (default: 100)"`
+
+	// MaxBodySize is the number of bytes of each request and response body
+	// that are kept.
+	MaxBodySize int `long:"maxbodysize" description:"The number of bytes of each request and response body that are kept (default: 4096)"`
+
+	// RedactHeaders are additional header fields whose values are
+	// redacted, next to those that carry tokens and cookies.
+	RedactHeaders []string `long:"redactheader" description:"A header field whose value is redacted in the recorded exchanges, next to those carrying tokens and cookies"`
+}
+
+// validate checks the capture options.
+func (c *CaptureConfig) validate() error {
+	switch {
+	case c.Size < 0 || c.Size > maxCaptureSize:
+		return fmt.Errorf("size must be between 0 and %d",
+			maxCaptureSize)
+
+	case c.MaxBodySize < 0:
+		return fmt.Errorf("negative maximum body size")
+	}
+
+	return nil
+}
+
+// size returns the number of exchanges that are kept.
+func (c *CaptureConfig) size() int {
+	if c.Size == 0 {
+		return defaultCaptureSize
+	}
+	return c.Size
+}
+
+// maxBodySize returns the number of bytes of each body that are kept.
+func (c *CaptureConfig) maxBodySize() int {
+	if c.MaxBodySize == 0 {
+		return defaultCaptureBodySize
+	}
+	return c.MaxBodySize
+}
+
+// CapturedExchange is a recorded request of a service and the response to it.
+// The values of sensitive header fields are redacted and the bodies are
+// truncated.
+type CapturedExchange struct {
+	ID       uint64    `json:"id"`
+	Time     time.Time `json:"time"`
+	Duration string    `json:"duration"`
+
+	Method           string      `json:"method"`
+	Host             string      `json:"host"`
+	URI              string      `json:"uri"`
+	Proto            string      `json:"proto"`
+	RequestHeader    http.Header `json:"request_header"`
+	RequestBody      []byte      `json:"request_body,omitempty"`
+	RequestTruncated bool        `json:"request_truncated,omitempty"`
+
+	Status            int         `json:"status"`
+	ResponseHeader    http.Header `json:"response_header"`
+	ResponseBody      []byte      `json:"response_body,omitempty"`
+	ResponseTruncated bool        `json:"response_truncated,omitempty"`
+
+	// Auth is the outcome of the authentication of the request, one of
+	// the CaptureAuth constants or the name of the authenticator other
+	// than lsat that accepted it.
+	Auth string `json:"auth"`
+}
+
+// captureBuffer is a ring buffer of the most recent exchanges of a service.
+type captureBuffer struct {
+	sync.Mutex
+
+	exchanges []*CapturedExchange
+	next      int
+	lastID    uint64
+}
+
+// add adds an exchange to the buffer, replacing the oldest one if it's full.
+func (b *captureBuffer) add(exchange *CapturedExchange, size int) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.lastID++
+	exchange.ID = b.lastID
+
+	if len(b.exchanges) < size {
+		b.exchanges = append(b.exchanges, exchange)
+		return
+	}
+
+	// The size may have been lowered when the services were updated.
+	if len(b.exchanges) > size {
+		b.exchanges = b.list()[len(b.exchanges)-size:]
+		b.next = 0
+	}
+	b.exchanges[b.next] = exchange
+	b.next = (b.next + 1) % size
+}
+
+// list returns the exchanges in the buffer, oldest first. The lock must be
+// held.
+func (b *captureBuffer) list() []*CapturedExchange {
+	exchanges := make([]*CapturedExchange, 0, len(b.exchanges))
+	exchanges = append(exchanges, b.exchanges[b.next:]...)
+	return append(exchanges, b.exchanges[:b.next]...)
+}
+
+// Captures returns the recorded exchanges of the service with the given name,
+// oldest first. False is returned if there is no such service.
+func (p *Proxy) Captures(name string) ([]*CapturedExchange, bool) {
+	if _, ok := p.serviceByName(name); !ok {
+		return nil, false
+	}
+
+	p.capturesMtx.Lock()
+	buffer, ok := p.captures[name]
+	p.capturesMtx.Unlock()
+	if !ok {
+		return []*CapturedExchange{}, true
+	}
+
+	buffer.Lock()
+	defer buffer.Unlock()
+
+	return buffer.list(), true
+}
+
+// ClearCaptures removes the recorded exchanges of the service with the given
+// name. False is returned if there is no such service.
+func (p *Proxy) ClearCaptures(name string) bool {
+	if _, ok := p.serviceByName(name); !ok {
+		return false
+	}
+
+	p.capturesMtx.Lock()
+	defer p.capturesMtx.Unlock()
+
+	delete(p.captures, name)
+	return true
+}
+
+// captureBuffer returns the ring buffer of the service, creating it if needed.
+func (p *Proxy) captureBuffer(name string) *captureBuffer {
+	p.capturesMtx.Lock()
+	defer p.capturesMtx.Unlock()
+
+	if p.captures == nil {
+		p.captures = make(map[string]*captureBuffer)
+	}
+	buffer, ok := p.captures[name]
+	if !ok {
+		buffer = &captureBuffer{}
+		p.captures[name] = buffer
+	}
+
+	return buffer
+}
+
+// captureKey is the key the recorder of a captured exchange is stored under in
+// the context of its request.
+type captureKey struct{}
+
+// captureRecorder records an exchange while it's handled.
+type captureRecorder struct {
+	exchange *CapturedExchange
+	cfg      *CaptureConfig
+	redact   map[string]bool
+	buffer   *captureBuffer
+
+	requestBody *captureBody
+	response    *captureResponseWriter
+}
+
+// startCapture starts recording the exchange of the request if the service
+// captures its exchanges. The returned writer and request must be used to
+// handle the request, and the returned function must be called once it's done.
+func (p *Proxy) startCapture(w http.ResponseWriter, r *http.Request,
+	target *Service) (http.ResponseWriter, *http.Request, func()) {
+
+	if !target.Capture.Enabled {
+		return w, r, func() {}
+	}
+
+	cfg := target.Capture
+	redact := make(map[string]bool)
+	for _, name := range sensitiveHeaders {
+		redact[name] = true
+	}
+	for _, name := range cfg.RedactHeaders {
+		redact[http.CanonicalHeaderKey(name)] = true
+	}
+	if target.apiKeyAuth != nil {
+		redact[target.APIKey.header()] = true
+	}
+	tokenFields := []string{
+		target.TokenHeader, target.MacaroonHeader,
+		target.PreimageHeader,
+	}
+	for _, field := range tokenFields {
+		if field != "" {
+			redact[http.CanonicalHeaderKey(field)] = true
+		}
+	}
+
+	rec := &captureRecorder{
+		exchange: &CapturedExchange{
+			Time:          time.Now(),
+			Method:        r.Method,
+			Host:          r.Host,
+			URI:           r.RequestURI,
+			Proto:         r.Proto,
+			RequestHeader: redactHeader(r.Header, redact),
+		},
+		cfg:    &cfg,
+		redact: redact,
+		buffer: p.captureBuffer(target.Name),
+	}
+	if rec.exchange.URI == "" {
+		rec.exchange.URI = r.URL.RequestURI()
+	}
+
+	if r.Body != nil && r.Body != http.NoBody {
+		rec.requestBody = &captureBody{
+			ReadCloser: r.Body,
+			max:        cfg.maxBodySize(),
+		}
+		r.Body = rec.requestBody
+	}
+	rec.response = &captureResponseWriter{
+		ResponseWriter: w,
+		max:            cfg.maxBodySize(),
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), captureKey{}, rec))
+	return rec.response, r, rec.finish
+}
+
+// recordCaptureAuth records the outcome of the authentication of the request
+// if its exchange is captured.
+func recordCaptureAuth(r *http.Request, outcome string) {
+	rec, ok := r.Context().Value(captureKey{}).(*captureRecorder)
+	if !ok {
+		return
+	}
+
+	rec.exchange.Auth = outcome
+}
+
+// finish completes the exchange and adds it to the buffer of the service.
+func (c *captureRecorder) finish() {
+	exchange := c.exchange
+	exchange.Duration = time.Since(exchange.Time).String()
+
+	if c.requestBody != nil {
+		exchange.RequestBody = c.requestBody.data
+		exchange.RequestTruncated = c.requestBody.truncated
+	}
+
+	exchange.Status = c.response.status
+	if exchange.Status == 0 {
+		exchange.Status = http.StatusOK
+	}
+	exchange.ResponseHeader = redactHeader(
+		c.response.Header(), c.redact,
+	)
+	exchange.ResponseBody = c.response.data
+	exchange.ResponseTruncated = c.response.truncated
+
+	if exchange.Auth == "" {
+		exchange.Auth = CaptureAuthRejected
+		if exchange.Status == http.StatusPaymentRequired {
+			exchange.Auth = CaptureAuthChallenged
+		}
+	}
+
+	c.buffer.add(exchange, c.cfg.size())
+}
+
+// redactHeader returns a copy of the header with the values of the given
+// fields redacted.
+func redactHeader(header http.Header, redact map[string]bool) http.Header {
+	redacted := header.Clone()
+	for name, values := range redacted {
+		if !redact[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		for i := range values {
+			values[i] = RedactedValue
+		}
+	}
+
+	return redacted
+}
+
+// captureBody keeps the beginning of a request body while it's read.
+type captureBody struct {
+	io.ReadCloser
+
+	max       int
+	data      []byte
+	truncated bool
+}
+
+// Read reads from the body and keeps what was read up to the maximum size.
+func (c *captureBody) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.data, c.truncated = appendCapped(c.data, b[:n], c.max, c.truncated)
+	return n, err
+}
+
+// captureResponseWriter keeps the status and the beginning of the body of a
+// response while it's written.
+type captureResponseWriter struct {
+	http.ResponseWriter
+
+	max       int
+	status    int
+	data      []byte
+	truncated bool
+}
+
+// WriteHeader records the status code and sends the header.
+func (c *captureResponseWriter) WriteHeader(statusCode int) {
+	if c.status == 0 {
+		c.status = statusCode
+	}
+	c.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write sends a chunk of the response body and keeps it up to the maximum
+// size.
+func (c *captureResponseWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.data, c.truncated = appendCapped(c.data, b, c.max, c.truncated)
+	return c.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client.
+func (c *captureResponseWriter) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the reverse proxy take over the connection for protocol
+// upgrades. The bytes sent over a hijacked connection aren't captured.
+func (c *captureResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter,
+	error) {
+
+	hijacker, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection can't be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+// appendCapped appends b to data up to a total of max bytes and reports
+// whether anything was left out.
+func appendCapped(data, b []byte, max int, truncated bool) ([]byte, bool) {
+	room := max - len(data)
+	if room <= 0 {
+		return data, truncated || len(b) > 0
+	}
+	if len(b) > room {
+		return append(data, b[:room]...), true
+	}
+	return append(data, b...), truncated
+}
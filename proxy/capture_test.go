@@ -0,0 +1,94 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCapture tests that the exchanges of a service are recorded with their
+// auth outcome, sensitive header fields redacted and bodies truncated, and that
+// only the most recent ones are kept.
+func TestCapture(t *testing.T) {
+	service := testHandlerService(
+		"echo-service", "^/echo/.*$",
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			_, _ = w.Write(body)
+		},
+	)
+	service.Auth = "freebie 1"
+	service.Capture = proxy.CaptureConfig{
+		Enabled:       true,
+		Size:          3,
+		MaxBodySize:   4,
+		RedactHeaders: []string{"x-api-key"},
+	}
+	p, err := proxy.New(auth.NewMockAuthenticator(), []*proxy.Service{
+		service,
+	})
+	require.NoError(t, err)
+
+	serve := func(body, authorization string) {
+		_ = serveTestRequest(
+			p, "POST", "/echo/x?a=b", authorization,
+			strings.NewReader(body),
+			withTestRemoteAddr("192.168.1.1:1234"),
+			withTestHeader("X-Api-Key", "secret"),
+			withTestHeader("X-Other", "visible"),
+		)
+	}
+
+	serve("hello", "")
+	serve("hi", "")
+	serve("hey", "LSAT secret")
+
+	exchanges, ok := p.Captures("echo-service")
+	require.True(t, ok)
+	require.Len(t, exchanges, 3)
+
+	free := exchanges[0]
+	require.EqualValues(t, 1, free.ID)
+	require.Equal(t, "POST", free.Method)
+	require.Equal(t, "/echo/x?a=b", free.URI)
+	require.Equal(t, proxy.CaptureAuthFreebie, free.Auth)
+	require.Equal(t, http.StatusOK, free.Status)
+	require.Equal(t, "hell", string(free.RequestBody))
+	require.True(t, free.RequestTruncated)
+	require.Equal(t, "hell", string(free.ResponseBody))
+	require.True(t, free.ResponseTruncated)
+	require.Equal(
+		t, proxy.RedactedValue, free.RequestHeader.Get("X-Api-Key"),
+	)
+	require.Equal(t, "visible", free.RequestHeader.Get("X-Other"))
+
+	challenged := exchanges[1]
+	require.Equal(t, proxy.CaptureAuthChallenged, challenged.Auth)
+	require.Equal(t, http.StatusPaymentRequired, challenged.Status)
+
+	paid := exchanges[2]
+	require.Equal(t, proxy.CaptureAuthToken, paid.Auth)
+	require.Equal(
+		t, proxy.RedactedValue, paid.RequestHeader.Get("Authorization"),
+	)
+	require.Equal(t, "hey", string(paid.ResponseBody))
+	require.False(t, paid.ResponseTruncated)
+
+	// Only the most recent exchanges are kept.
+	serve("", "LSAT secret")
+	exchanges, _ = p.Captures("echo-service")
+	require.Len(t, exchanges, 3)
+	require.EqualValues(t, 2, exchanges[0].ID)
+	require.EqualValues(t, 4, exchanges[2].ID)
+
+	require.True(t, p.ClearCaptures("echo-service"))
+	exchanges, _ = p.Captures("echo-service")
+	require.Empty(t, exchanges)
+	_, ok = p.Captures("unknown")
+	require.False(t, ok)
+}
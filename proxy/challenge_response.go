@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/golang/protobuf/proto"
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/challengerpc"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// paywallStatusPathPrefix is the prefix of the endpoint that reports
+	// whether the invoice of a challenge was paid. The full path is the
+	// prefix followed by the hex encoded payment hash.
+	paywallStatusPathPrefix = paywallPathPrefix + "status/"
+)
+
+var (
+	// invoiceNetworks are the networks we try to decode invoices for. The
+	// proxy doesn't know which network the backing lnd node runs on, but
+	// each network has its own invoice prefix so only the correct one
+	// succeeds.
+	invoiceNetworks = []*chaincfg.Params{
+		&chaincfg.MainNetParams, &chaincfg.TestNet3Params,
+		&chaincfg.RegressionNetParams, &chaincfg.SimNetParams,
+	}
+)
+
+// challengeResponse is the JSON body of a 402 response for clients that
+// prefer to not parse the WWW-Authenticate header.
+type challengeResponse struct {
+	Macaroon         string `json:"macaroon"`
+	Invoice          string `json:"invoice"`
+	PriceSat         int64  `json:"price_sat"`
+	ExpiresAt        string `json:"expires_at,omitempty"`
+	PaymentStatusURL string `json:"payment_status_url,omitempty"`
+}
+
+// paymentStatusResponse is the JSON body of the payment status endpoint.
+type paymentStatusResponse struct {
+	Settled bool `json:"settled"`
+}
+
+// wantsJSONChallenge returns true if the client asked for a JSON body in the
+// Accept header.
+func wantsJSONChallenge(r *http.Request) bool {
+	if strings.HasPrefix(r.Header.Get(hdrContentType), hdrTypeGrpc) ||
+		isGRPCWebRequest(r) {
+
+		return false
+	}
+
+	return strings.Contains(r.Header.Get(hdrAccept), hdrTypeJSON)
+}
+
+// sendJSONChallenge sends the 402 response with the elements of the challenge
+// header value as JSON body.
+func (p *Proxy) sendJSONChallenge(w http.ResponseWriter, r *http.Request,
+	servicePrice int64, challenge string) {
+
+	matches := challengeRegex.FindStringSubmatch(challenge)
+	if len(matches) != 3 {
+		log.Errorf("Invalid challenge for JSON response: %s", challenge)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"challenge failure",
+		)
+		return
+	}
+
+	response := &challengeResponse{
+		Macaroon: matches[1],
+		Invoice:  matches[2],
+		PriceSat: servicePrice,
+	}
+	if expiry, ok := invoiceExpiry(matches[2]); ok {
+		response.ExpiresAt = expiry.UTC().Format(time.RFC3339)
+	}
+
+	// The status can only be reported if we're able to look it up.
+	if p.preimageFetcher != nil {
+		_, hash, err := parsePaywallMacaroon(matches[1])
+		if err == nil {
+			response.PaymentStatusURL = baseURL(r) +
+				paywallStatusPathPrefix + hash.String()
+		}
+	}
+
+	w.Header().Set(hdrContentType, hdrTypeJSON)
+	w.WriteHeader(http.StatusPaymentRequired)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("Error sending JSON challenge: %v", err)
+	}
+}
+
+// setGRPCChallengeDetails attaches the elements of the challenge header value
+// to the gRPC status of the response as a challengerpc.PaymentChallenge, so
+// gRPC clients can read the challenge without parsing the header.
+func setGRPCChallengeDetails(w http.ResponseWriter, code codes.Code,
+	message string, servicePrice int64, challenge string) {
+
+	matches := challengeRegex.FindStringSubmatch(challenge)
+	if len(matches) != 3 {
+		log.Errorf("Invalid challenge for gRPC status: %s", challenge)
+		return
+	}
+	macBytes, err := base64.StdEncoding.DecodeString(matches[1])
+	if err != nil {
+		log.Errorf("Invalid macaroon for gRPC status: %v", err)
+		return
+	}
+
+	details := &challengerpc.PaymentChallenge{
+		Scheme:   strings.Fields(challenge)[0],
+		Macaroon: macBytes,
+		Invoice:  matches[2],
+		PriceSat: servicePrice,
+	}
+	if expiry, ok := invoiceExpiry(matches[2]); ok {
+		details.ExpiresAt = expiry.Unix()
+	}
+
+	st, err := status.New(code, message).WithDetails(details)
+	if err != nil {
+		log.Errorf("Error adding challenge to gRPC status: %v", err)
+		return
+	}
+	statusBytes, err := proto.Marshal(st.Proto())
+	if err != nil {
+		log.Errorf("Error serializing gRPC status: %v", err)
+		return
+	}
+
+	// Binary header fields are sent base64 encoded without padding.
+	encoded := base64.RawStdEncoding.EncodeToString(statusBytes)
+	w.Header().Set(hdrGrpcDetails, encoded)
+}
+
+// handlePaymentStatus reports whether the invoice with the payment hash in the
+// request path was paid.
+func (p *Proxy) handlePaymentStatus(w http.ResponseWriter, r *http.Request,
+	prefixLog *PrefixLog) {
+
+	if p.preimageFetcher == nil {
+		sendDirectResponse(w, r, http.StatusNotFound, "not found")
+		return
+	}
+
+	hash, err := lntypes.MakeHashFromStr(
+		strings.TrimPrefix(r.URL.Path, paywallStatusPathPrefix),
+	)
+	if err != nil {
+		sendDirectResponse(
+			w, r, http.StatusBadRequest, "invalid payment hash",
+		)
+		return
+	}
+
+	// We never reveal the preimage here, the client that paid the invoice
+	// already knows it.
+	_, err = p.preimageFetcher.FetchPreimage(r.Context(), hash)
+	settled := err == nil
+	switch {
+	// An invoice that isn't paid yet is a valid answer too.
+	case err == auth.ErrInvoiceNotSettled:
+
+	case err == mint.ErrChallengerBusy:
+		sendBusyResponse(w, r)
+		return
+
+	case err != nil:
+		prefixLog.Errorf("Error fetching payment status: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"payment status failure",
+		)
+		return
+	}
+
+	w.Header().Set(hdrContentType, hdrTypeJSON)
+	err = json.NewEncoder(w).Encode(&paymentStatusResponse{
+		Settled: settled,
+	})
+	if err != nil {
+		prefixLog.Errorf("Error sending payment status: %v", err)
+	}
+}
+
+// invoiceExpiry returns the time the given invoice expires at.
+func invoiceExpiry(invoice string) (time.Time, bool) {
+	for _, net := range invoiceNetworks {
+		decoded, err := zpay32.Decode(invoice, net)
+		if err != nil {
+			continue
+		}
+
+		return decoded.Timestamp.Add(decoded.Expiry()), true
+	}
+
+	return time.Time{}, false
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// HeaderForwardedFor is the header field proxies append the address
+	// of the peer they received a request from to.
+	HeaderForwardedFor = "X-Forwarded-For"
+
+	// HeaderCFConnectingIP is the header field Cloudflare tells the IP
+	// address of the client with.
+	HeaderCFConnectingIP = "Cf-Connecting-Ip"
+)
+
+// ClientIPResolver finds the IP address of the original client of requests
+// that are forwarded by trusted proxies, like a CDN in front of aperture. The
+// client IP header field is only read from requests of trusted peers, so
+// clients that connect directly can't spoof their address.
+type ClientIPResolver struct {
+	header  string
+	trusted []*net.IPNet
+}
+
+// NewClientIPResolver creates a resolver that reads the client address from
+// the given header field of requests of the trusted networks. Only the
+// X-Forwarded-For, CF-Connecting-IP and X-Real-IP header fields are supported.
+func NewClientIPResolver(header string,
+	trusted []*net.IPNet) (*ClientIPResolver, error) {
+
+	header = http.CanonicalHeaderKey(header)
+	switch header {
+	case HeaderForwardedFor, HeaderCFConnectingIP, HeaderRealIP:
+	default:
+		return nil, fmt.Errorf("unsupported client IP header %q",
+			header)
+	}
+
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("no trusted proxies")
+	}
+
+	return &ClientIPResolver{
+		header:  header,
+		trusted: trusted,
+	}, nil
+}
+
+// SetClientIPResolver sets the resolver that finds the IP address of clients
+// behind trusted proxies. If it's not set, the address of the peer is used.
+func (p *Proxy) SetClientIPResolver(resolver *ClientIPResolver) {
+	p.clientIPResolver = resolver
+}
+
+// clientAddr returns the address of the client of the request. The address is
+// the one of the peer unless the request was forwarded by a trusted proxy.
+func (p *Proxy) clientAddr(r *http.Request) string {
+	if p.clientIPResolver == nil {
+		return r.RemoteAddr
+	}
+
+	return p.clientIPResolver.RemoteAddr(r)
+}
+
+// RemoteAddr returns the address of the client of the request in host:port
+// form. The port of addresses read from a header field is always zero.
+func (c *ClientIPResolver) RemoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !c.isTrusted(net.ParseIP(host)) {
+		return r.RemoteAddr
+	}
+
+	var ip net.IP
+	if c.header == HeaderForwardedFor {
+		ip = c.forwardedFor(r.Header.Values(c.header))
+	} else {
+		ip = parseHeaderIP(r.Header.Get(c.header))
+	}
+	if ip == nil {
+		return r.RemoteAddr
+	}
+
+	return net.JoinHostPort(ip.String(), "0")
+}
+
+// forwardedFor returns the client address of the X-Forwarded-For header field.
+// Every proxy appends the address of its peer, so the list is walked from the
+// right and the first address that isn't a trusted proxy is the client's.
+// Anything to the left of it may have been made up by the client.
+func (c *ClientIPResolver) forwardedFor(values []string) net.IP {
+	hops := strings.Split(strings.Join(values, ","), ",")
+
+	var client net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHeaderIP(hops[i])
+		if ip == nil {
+			break
+		}
+
+		client = ip
+		if !c.isTrusted(ip) {
+			break
+		}
+	}
+
+	return client
+}
+
+// isTrusted returns true if the IP is in one of the trusted networks.
+func (c *ClientIPResolver) isTrusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range c.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseHeaderIP parses an IP address of a client IP header field, which some
+// proxies send with a port.
+func parseHeaderIP(value string) net.IP {
+	value = strings.TrimSpace(value)
+	if ip := net.ParseIP(value); ip != nil {
+		return ip
+	}
+
+	host, _, err := net.SplitHostPort(value)
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
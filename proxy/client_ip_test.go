@@ -0,0 +1,98 @@
+package proxy_test
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestClientIPResolver tests that the client address is only read from the
+// header fields of requests of trusted proxies.
+func TestClientIPResolver(t *testing.T) {
+	_, cdn, _ := net.ParseCIDR("173.245.48.0/20")
+	_, lb, _ := net.ParseCIDR("10.0.0.0/8")
+	trusted := []*net.IPNet{cdn, lb}
+
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		values     []string
+		expected   string
+	}{{
+		name:       "cloudflare",
+		header:     "CF-Connecting-IP",
+		remoteAddr: "173.245.48.1:443",
+		values:     []string{"198.51.100.7"},
+		expected:   "198.51.100.7:0",
+	}, {
+		name:       "untrusted peer",
+		header:     "CF-Connecting-IP",
+		remoteAddr: "198.51.100.1:1234",
+		values:     []string{"198.51.100.7"},
+		expected:   "198.51.100.1:1234",
+	}, {
+		name:       "invalid value",
+		header:     "X-Real-IP",
+		remoteAddr: "10.0.0.1:1234",
+		values:     []string{"unknown"},
+		expected:   "10.0.0.1:1234",
+	}, {
+		name:       "ipv6 with port",
+		header:     "X-Real-IP",
+		remoteAddr: "10.0.0.1:1234",
+		values:     []string{"[2001:db8::1]:4711"},
+		expected:   "[2001:db8::1]:0",
+	}, {
+		name:       "forwarded for",
+		header:     "X-Forwarded-For",
+		remoteAddr: "10.0.0.1:1234",
+		values: []string{
+			"203.0.113.9, 198.51.100.7", "173.245.48.1",
+		},
+		expected: "198.51.100.7:0",
+	}, {
+		name:       "forwarded for only proxies",
+		header:     "X-Forwarded-For",
+		remoteAddr: "10.0.0.1:1234",
+		values:     []string{"10.0.0.2, 173.245.48.1"},
+		expected:   "10.0.0.2:0",
+	}, {
+		name:       "forwarded for untrusted peer",
+		header:     "X-Forwarded-For",
+		remoteAddr: "198.51.100.1:1234",
+		values:     []string{"203.0.113.9"},
+		expected:   "198.51.100.1:1234",
+	}}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			resolver, err := proxy.NewClientIPResolver(
+				test.header, trusted,
+			)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(
+				"GET", "http://localhost/", nil,
+			)
+			req.RemoteAddr = test.remoteAddr
+			for _, value := range test.values {
+				req.Header.Add(test.header, value)
+			}
+
+			require.Equal(
+				t, test.expected, resolver.RemoteAddr(req),
+			)
+		})
+	}
+
+	_, err := proxy.NewClientIPResolver("Forwarded", trusted)
+	require.Error(t, err)
+
+	_, err = proxy.NewClientIPResolver("X-Forwarded-For", nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,385 @@
+package proxy
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// Header fields that negotiate the compression of HTTP bodies and
+	// gRPC messages.
+	hdrContentEncoding    = "Content-Encoding"
+	hdrAcceptEncoding     = "Accept-Encoding"
+	hdrVary               = "Vary"
+	hdrGrpcEncoding       = "Grpc-Encoding"
+	hdrGrpcAcceptEncoding = "Grpc-Accept-Encoding"
+
+	// encodingIdentity is the encoding of uncompressed data, which is
+	// always allowed.
+	encodingIdentity = "identity"
+
+	// encodingGzip is the encoding responses are compressed with.
+	encodingGzip = "gzip"
+)
+
+// CompressionConfig holds the options that control which content encodings
+// are exchanged with a service and whether aperture decompresses or compresses
+// bodies itself.
+type CompressionConfig struct {
+	// Encodings is the list of content encodings, like gzip or br, that
+	// request bodies and gRPC messages may be compressed with. The
+	// encodings clients accept for responses are narrowed down to the
+	// list before the request is forwarded. If the list is empty, all
+	// encodings are passed through.
+	Encodings []string `long:"encodings" description:"The content encodings allowed for HTTP bodies and gRPC messages, all are passed through if empty"`
+
+	// Decompress can be set to decompress gzip and deflate encoded HTTP
+	// request bodies before the filter rules are applied, so the maximum
+	// body size applies to the decompressed body. The body is then
+	// forwarded to the backend uncompressed.
+	Decompress bool `long:"decompress" description:"Decompress gzip and deflate request bodies before the filter rules are applied and forward them uncompressed"`
+
+	// Compress can be set to ask the backend for uncompressed HTTP
+	// responses and compress them with gzip for clients that accept it.
+	// gRPC and event stream responses are never compressed.
+	Compress bool `long:"compress" description:"Ask the backend for uncompressed responses and compress them with gzip for clients that accept it"`
+}
+
+// validate checks the compression options and normalizes the encodings.
+func (c *CompressionConfig) validate() error {
+	for i, encoding := range c.Encodings {
+		c.Encodings[i] = strings.ToLower(strings.TrimSpace(encoding))
+		if c.Encodings[i] == "" {
+			return fmt.Errorf("empty content encoding")
+		}
+	}
+
+	if c.Compress && !c.allowed(encodingGzip) {
+		return fmt.Errorf("compression requires gzip to be allowed")
+	}
+
+	return nil
+}
+
+// allowed returns true if the given encoding may be used.
+func (c *CompressionConfig) allowed(encoding string) bool {
+	if len(c.Encodings) == 0 || encoding == encodingIdentity {
+		return true
+	}
+
+	for _, allowed := range c.Encodings {
+		if encoding == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// coding is an entry of a list of content encodings with its quality value.
+type coding struct {
+	name    string
+	quality float64
+}
+
+// parseCodings parses the comma separated list of content encodings of the
+// given header fields.
+func parseCodings(values []string) []coding {
+	var codings []coding
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			name, params, err := mime.ParseMediaType(
+				"x/" + strings.TrimSpace(entry),
+			)
+			if err != nil || name == "x/" {
+				continue
+			}
+
+			quality := 1.0
+			if q, ok := params["q"]; ok {
+				quality, err = strconv.ParseFloat(q, 64)
+				if err != nil {
+					continue
+				}
+			}
+			codings = append(codings, coding{
+				name:    strings.TrimPrefix(name, "x/"),
+				quality: quality,
+			})
+		}
+	}
+
+	return codings
+}
+
+// narrowAccepted removes the encodings that aren't allowed from the list of
+// accepted encodings in the given header field.
+func (c *CompressionConfig) narrowAccepted(header http.Header, name string) {
+	values := header.Values(name)
+	if len(c.Encodings) == 0 || len(values) == 0 {
+		return
+	}
+
+	var accepted []string
+	for _, coding := range parseCodings(values) {
+		if !c.allowed(coding.name) {
+			continue
+		}
+
+		entry := coding.name
+		if coding.quality != 1 {
+			entry += ";q=" + strconv.FormatFloat(
+				coding.quality, 'g', -1, 64,
+			)
+		}
+		accepted = append(accepted, entry)
+	}
+
+	header.Del(name)
+	if len(accepted) > 0 {
+		header.Set(name, strings.Join(accepted, ", "))
+	}
+}
+
+// acceptsGzip returns true if the client accepts gzip compressed responses.
+func acceptsGzip(header http.Header) bool {
+	var gzipQuality, wildcardQuality float64 = -1, -1
+	for _, coding := range parseCodings(header.Values(hdrAcceptEncoding)) {
+		switch coding.name {
+		case encodingGzip, "x-gzip":
+			gzipQuality = coding.quality
+
+		case "*":
+			wildcardQuality = coding.quality
+		}
+	}
+
+	if gzipQuality >= 0 {
+		return gzipQuality > 0
+	}
+	return wildcardQuality > 0
+}
+
+// decompressBody replaces the body of the request with its decompressed form
+// if it's encoded with gzip or deflate. If it's encoded with anything else, it
+// is left as it is.
+func decompressBody(r *http.Request, codings []coding) error {
+	for _, coding := range codings {
+		switch coding.name {
+		case encodingGzip, "x-gzip", "deflate", encodingIdentity:
+		default:
+			return nil
+		}
+	}
+
+	// Encodings are listed in the order they were applied, so they are
+	// removed in the reverse order.
+	body := r.Body
+	for i := len(codings) - 1; i >= 0; i-- {
+		switch codings[i].name {
+		case encodingGzip, "x-gzip":
+			reader, err := gzip.NewReader(body)
+			if err != nil {
+				return err
+			}
+			body = &decompressedBody{Reader: reader, body: r.Body}
+
+		case "deflate":
+			body = &decompressedBody{
+				Reader: flate.NewReader(body), body: r.Body,
+			}
+		}
+	}
+
+	r.Body = body
+	r.ContentLength = -1
+	r.Header.Del(hdrContentLength)
+	r.Header.Del(hdrContentEncoding)
+	return nil
+}
+
+// decompressedBody is a decompressed request body that closes the original
+// body.
+type decompressedBody struct {
+	io.Reader
+
+	body io.Closer
+}
+
+// Close closes the original request body.
+func (d *decompressedBody) Close() error {
+	return d.body.Close()
+}
+
+// checkEncodings makes sure the request body and gRPC messages are only
+// compressed with allowed encodings and narrows down the encodings the backend
+// may compress its response with. If the service decompresses request bodies,
+// the body is replaced with its decompressed form. If the request isn't
+// allowed, an error response is sent and false is returned. Otherwise it's
+// returned whether the response should be compressed by us.
+func checkEncodings(w http.ResponseWriter, r *http.Request,
+	target *Service) (bool, bool) {
+
+	cfg := &target.Compression
+
+	// gRPC messages are compressed individually, with the encoding given
+	// in a separate header field. Clients are told which encodings are
+	// supported if they use another one, see the gRPC compression spec.
+	if isGRPCWebRequest(r) || isGRPC(r.Header.Get(hdrContentType)) {
+		encoding := strings.ToLower(r.Header.Get(hdrGrpcEncoding))
+		if encoding != "" && !cfg.allowed(encoding) {
+			w.Header().Set(
+				hdrGrpcAcceptEncoding,
+				strings.Join(cfg.Encodings, ","),
+			)
+			sendStatusResponse(
+				w, r, http.StatusUnsupportedMediaType,
+				codes.Unimplemented, "grpc encoding "+
+					encoding+" not allowed",
+			)
+			return false, false
+		}
+		cfg.narrowAccepted(r.Header, hdrGrpcAcceptEncoding)
+
+		return false, true
+	}
+
+	codings := parseCodings(r.Header.Values(hdrContentEncoding))
+	for _, coding := range codings {
+		if cfg.allowed(coding.name) {
+			continue
+		}
+
+		// Tell the client which encodings are accepted instead, see
+		// RFC 7694.
+		w.Header().Set(
+			hdrAcceptEncoding, strings.Join(cfg.Encodings, ", "),
+		)
+		sendDirectResponse(
+			w, r, http.StatusUnsupportedMediaType,
+			"content encoding "+coding.name+" not allowed",
+		)
+		return false, false
+	}
+
+	if cfg.Decompress && r.Body != nil && len(codings) > 0 {
+		if err := decompressBody(r, codings); err != nil {
+			sendDirectResponse(
+				w, r, http.StatusBadRequest,
+				"invalid compressed body",
+			)
+			return false, false
+		}
+	}
+
+	// Responses we compress ourselves are requested uncompressed from
+	// the backend.
+	if cfg.Compress {
+		compress := acceptsGzip(r.Header)
+		r.Header.Del(hdrAcceptEncoding)
+		return compress, true
+	}
+
+	cfg.narrowAccepted(r.Header, hdrAcceptEncoding)
+	return false, true
+}
+
+// gzipResponseWriter is a response writer that compresses the response body
+// with gzip, unless it's a gRPC or event stream response or already encoded.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+// newGzipResponseWriter creates a new response writer that compresses the
+// response body.
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	return &gzipResponseWriter{ResponseWriter: w}
+}
+
+// WriteHeader decides whether the response is compressed and adjusts the header
+// accordingly.
+func (g *gzipResponseWriter) WriteHeader(statusCode int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+
+	header := g.Header()
+	header.Add(hdrVary, hdrAcceptEncoding)
+
+	contentType := header.Get(hdrContentType)
+	switch {
+	case statusCode < http.StatusOK,
+		statusCode == http.StatusNoContent,
+		statusCode == http.StatusNotModified,
+		header.Get(hdrContentEncoding) != "",
+		isGRPC(contentType),
+		strings.HasPrefix(contentType, hdrTypeGrpcWeb),
+		strings.HasPrefix(contentType, "text/event-stream"):
+
+	default:
+		header.Set(hdrContentEncoding, encodingGzip)
+		header.Del(hdrContentLength)
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+
+	g.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write writes a chunk of the response body, compressed if the response is.
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+
+	if g.gz == nil {
+		return g.ResponseWriter.Write(b)
+	}
+	return g.gz.Write(b)
+}
+
+// Flush sends any buffered data to the client, including the data that is
+// still buffered for compression.
+func (g *gzipResponseWriter) Flush() {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+
+	if g.gz != nil {
+		_ = g.gz.Flush()
+	}
+	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the reverse proxy take over the connection for protocol
+// upgrades.
+func (g *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := g.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection can't be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+// finish writes the end of the compressed response body.
+func (g *gzipResponseWriter) finish() error {
+	if g.gz == nil {
+		return nil
+	}
+	return g.gz.Close()
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+// gzipData compresses the given data with gzip.
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	return buf.Bytes()
+}
+
+// TestCheckEncodings tests that only allowed encodings pass, that the accepted
+// encodings are narrowed down and that bodies are decompressed if configured.
+func TestCheckEncodings(t *testing.T) {
+	target := &Service{
+		Compression: CompressionConfig{
+			Encodings:  []string{"GZIP", "br"},
+			Decompress: true,
+		},
+	}
+	require.NoError(t, target.Compression.validate())
+
+	// Encodings that aren't allowed are rejected with the list of allowed
+	// ones.
+	req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte("x")))
+	req.Header.Set(hdrContentEncoding, "zstd")
+	rec := httptest.NewRecorder()
+	_, ok := checkEncodings(rec, req, target)
+	require.False(t, ok)
+	require.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+	require.Equal(t, "gzip, br", rec.Header().Get(hdrAcceptEncoding))
+
+	// Allowed gzip bodies are decompressed and the accepted encodings
+	// narrowed down.
+	body := []byte("hello world")
+	req = httptest.NewRequest(
+		"POST", "/", bytes.NewReader(gzipData(t, body)),
+	)
+	req.Header.Set(hdrContentEncoding, "gzip")
+	req.Header.Set(hdrAcceptEncoding, "zstd, br;q=0.5, gzip")
+	rec = httptest.NewRecorder()
+	compress, ok := checkEncodings(rec, req, target)
+	require.True(t, ok)
+	require.False(t, compress)
+	require.Equal(t, "br;q=0.5, gzip", req.Header.Get(hdrAcceptEncoding))
+	require.Empty(t, req.Header.Get(hdrContentEncoding))
+	require.Equal(t, int64(-1), req.ContentLength)
+
+	decompressed, err := ioutil.ReadAll(req.Body)
+	require.NoError(t, err)
+	require.Equal(t, body, decompressed)
+
+	// gRPC clients are told the allowed encodings with the unimplemented
+	// status.
+	req = httptest.NewRequest("POST", "/pkg.Service/Method", nil)
+	req.Header.Set(hdrContentType, hdrTypeGrpc)
+	req.Header.Set(hdrGrpcEncoding, "snappy")
+	rec = httptest.NewRecorder()
+	_, ok = checkEncodings(rec, req, target)
+	require.False(t, ok)
+	require.Equal(
+		t, strconv.Itoa(int(codes.Unimplemented)),
+		rec.Header().Get(hdrGrpcStatus),
+	)
+	require.Equal(t, "gzip,br", rec.Header().Get(hdrGrpcAcceptEncoding))
+
+	// Services that compress responses themselves ask the backend for
+	// uncompressed ones.
+	target.Compression.Compress = true
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(hdrAcceptEncoding, "br, gzip;q=0")
+	compress, ok = checkEncodings(httptest.NewRecorder(), req, target)
+	require.True(t, ok)
+	require.False(t, compress)
+	require.Empty(t, req.Header.Get(hdrAcceptEncoding))
+
+	req.Header.Set(hdrAcceptEncoding, "*")
+	compress, ok = checkEncodings(httptest.NewRecorder(), req, target)
+	require.True(t, ok)
+	require.True(t, compress)
+}
+
+// TestGzipResponseWriter tests that responses are compressed unless they are
+// gRPC responses or already encoded.
+func TestGzipResponseWriter(t *testing.T) {
+	body := []byte("hello world")
+
+	rec := httptest.NewRecorder()
+	w := newGzipResponseWriter(rec)
+	w.Header().Set(hdrContentLength, strconv.Itoa(len(body)))
+	_, err := w.Write(body)
+	require.NoError(t, err)
+	require.NoError(t, w.finish())
+
+	require.Equal(t, encodingGzip, rec.Header().Get(hdrContentEncoding))
+	require.Empty(t, rec.Header().Get(hdrContentLength))
+	require.Equal(t, hdrAcceptEncoding, rec.Header().Get(hdrVary))
+
+	gz, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	decompressed, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	require.Equal(t, body, decompressed)
+
+	for _, header := range []http.Header{
+		{hdrContentType: []string{hdrTypeGrpc}},
+		{hdrContentEncoding: []string{"br"}},
+	} {
+		rec = httptest.NewRecorder()
+		w = newGzipResponseWriter(rec)
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		_, err = w.Write(body)
+		require.NoError(t, err)
+		require.NoError(t, w.finish())
+		require.Equal(t, body, rec.Body.Bytes())
+	}
+}
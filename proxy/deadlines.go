@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// hdrGrpcTimeout is the header field gRPC clients send the deadline of
+	// a call in, relative to the start of the call.
+	hdrGrpcTimeout = "Grpc-Timeout"
+
+	// deadlineGracePeriod is the time the backend gets after the deadline
+	// of a call to end it with a proper status before the call is
+	// canceled on its side.
+	deadlineGracePeriod = time.Second
+
+	// maxTimeoutValue is the largest value of the grpc-timeout header
+	// field, which may have at most 8 digits.
+	maxTimeoutValue = 100000000 - 1
+)
+
+// DeadlineConfig holds the maximum durations of the gRPC calls to a service,
+// so abandoned clients don't pin backend resources indefinitely.
+type DeadlineConfig struct {
+	// MaxUnaryDuration is the maximum duration of a unary gRPC call,
+	// including transcoded REST calls. Zero means no limit.
+	MaxUnaryDuration time.Duration `long:"maxunaryduration" description:"The maximum duration of a unary gRPC call, 0 for no limit"`
+
+	// MaxStreamDuration is the maximum duration of a streaming gRPC
+	// call. Calls are only known to be unary if the service has a proto
+	// descriptor file, all others are limited to this duration as well.
+	// Zero means no limit.
+	MaxStreamDuration time.Duration `long:"maxstreamduration" description:"The maximum duration of a streaming gRPC call, 0 for no limit"`
+}
+
+// validate checks the deadline options.
+func (c *DeadlineConfig) validate() error {
+	if c.MaxUnaryDuration < 0 || c.MaxStreamDuration < 0 {
+		return fmt.Errorf("negative maximum call duration")
+	}
+
+	return nil
+}
+
+// parseGRPCTimeout parses the value of a grpc-timeout header field, see the
+// gRPC over HTTP/2 spec.
+func parseGRPCTimeout(value string) (time.Duration, error) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, fmt.Errorf("invalid timeout %q", value)
+	}
+
+	var unit time.Duration
+	switch value[len(value)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, fmt.Errorf("invalid timeout unit in %q", value)
+	}
+
+	amount, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q: %v", value, err)
+	}
+
+	// Timeouts that don't fit a duration are as good as none.
+	if time.Duration(amount) > time.Duration(1<<63-1)/unit {
+		return time.Duration(1<<63 - 1), nil
+	}
+	return time.Duration(amount) * unit, nil
+}
+
+// encodeGRPCTimeout encodes a timeout as the value of a grpc-timeout header
+// field, with the finest unit that fits into the eight digits allowed.
+func encodeGRPCTimeout(timeout time.Duration) string {
+	if timeout <= 0 {
+		return "0n"
+	}
+
+	units := []struct {
+		unit   time.Duration
+		suffix string
+	}{
+		{time.Nanosecond, "n"}, {time.Microsecond, "u"},
+		{time.Millisecond, "m"}, {time.Second, "S"},
+		{time.Minute, "M"},
+	}
+	for _, u := range units {
+		// Round up, so the deadline isn't moved closer.
+		amount := (timeout + u.unit - 1) / u.unit
+		if amount <= maxTimeoutValue {
+			return strconv.FormatInt(int64(amount), 10) + u.suffix
+		}
+	}
+
+	return strconv.FormatInt(int64((timeout+time.Hour-1)/time.Hour), 10) +
+		"H"
+}
+
+// callTimeout returns the time a gRPC call may take, which is the shorter one
+// of the timeout the client asked for and the maximum duration of the service.
+// If neither is set, false is returned.
+func callTimeout(r *http.Request, target *Service) (time.Duration, bool) {
+	method, ok := grpcMethod(r, target)
+	if !ok {
+		return 0, false
+	}
+
+	// Transcoded calls are always unary, native calls are only known to
+	// be if the proto descriptors say so.
+	max := target.Deadlines.MaxStreamDuration
+	if target.transcoder != nil {
+		streaming, known := target.transcoder.streaming[method]
+		if known && !streaming {
+			max = target.Deadlines.MaxUnaryDuration
+		}
+	}
+
+	timeout, err := parseGRPCTimeout(r.Header.Get(hdrGrpcTimeout))
+	switch {
+	// The client didn't ask for a timeout.
+	case err != nil:
+		return max, max > 0
+
+	case max > 0 && timeout > max:
+		return max, true
+
+	default:
+		return timeout, true
+	}
+}
+
+// withDeadline limits the duration of a gRPC call to the timeout the client
+// asked for and the maximum duration of the service. The backend is told about
+// the deadline, and the call is canceled on its side shortly after. The
+// returned function must be called once the call is complete.
+func withDeadline(r *http.Request, target *Service) (*http.Request, func()) {
+	timeout, ok := callTimeout(r, target)
+	if !ok {
+		return r, func() {}
+	}
+
+	ctx, cancel := context.WithTimeout(
+		r.Context(), timeout+deadlineGracePeriod,
+	)
+	r = r.WithContext(ctx)
+	r.Header.Set(hdrGrpcTimeout, encodeGRPCTimeout(timeout))
+
+	return r, cancel
+}
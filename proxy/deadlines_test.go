@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestGRPCTimeout tests that grpc-timeout header values are parsed and encoded
+// as described in the gRPC over HTTP/2 spec.
+func TestGRPCTimeout(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"1H":        time.Hour,
+		"30M":       30 * time.Minute,
+		"5S":        5 * time.Second,
+		"250m":      250 * time.Millisecond,
+		"12u":       12 * time.Microsecond,
+		"99999999n": 99999999,
+	} {
+		timeout, err := parseGRPCTimeout(value)
+		require.NoError(t, err)
+		require.Equal(t, expected, timeout)
+	}
+
+	invalid := []string{"", "S", "5", "5s", "-5S", "123456789S"}
+	for _, value := range invalid {
+		_, err := parseGRPCTimeout(value)
+		require.Error(t, err, value)
+	}
+
+	// Timeouts are encoded with the finest unit that fits, rounded up.
+	require.Equal(t, "0n", encodeGRPCTimeout(-time.Second))
+	require.Equal(t, "1500000n", encodeGRPCTimeout(1500*time.Microsecond))
+	require.Equal(t, "100000u", encodeGRPCTimeout(100*time.Millisecond))
+	require.Equal(t, "10000001u", encodeGRPCTimeout(10*time.Second+1))
+	require.Equal(t, "3600000m", encodeGRPCTimeout(time.Hour))
+}
+
+// TestWithDeadline tests that calls are limited to the shorter one of the
+// timeout of the client and the maximum duration of the service.
+func TestWithDeadline(t *testing.T) {
+	target := &Service{
+		Deadlines: DeadlineConfig{MaxStreamDuration: time.Minute},
+	}
+
+	// Calls that aren't gRPC calls are never limited.
+	req := httptest.NewRequest("GET", "/", nil)
+	_, ok := callTimeout(req, target)
+	require.False(t, ok)
+
+	req = httptest.NewRequest("POST", "/pkg.Service/Method", nil)
+	req.Header.Set(hdrContentType, hdrTypeGrpc)
+	timeout, ok := callTimeout(req, target)
+	require.True(t, ok)
+	require.Equal(t, time.Minute, timeout)
+
+	req.Header.Set(hdrGrpcTimeout, "2H")
+	timeout, ok = callTimeout(req, target)
+	require.True(t, ok)
+	require.Equal(t, time.Minute, timeout)
+
+	req.Header.Set(hdrGrpcTimeout, "5S")
+	timeout, ok = callTimeout(req, target)
+	require.True(t, ok)
+	require.Equal(t, 5*time.Second, timeout)
+
+	// The backend is told about the deadline and the context ends shortly
+	// after it.
+	start := time.Now()
+	req.Header.Set(hdrGrpcTimeout, "2H")
+	req, cancel := withDeadline(req, target)
+	defer cancel()
+	require.Equal(t, "60000000u", req.Header.Get(hdrGrpcTimeout))
+
+	deadline, ok := req.Context().Deadline()
+	require.True(t, ok)
+	require.WithinDuration(
+		t, start.Add(time.Minute+deadlineGracePeriod), deadline,
+		time.Second,
+	)
+
+	// Without any limit, the timeout of the client is passed through.
+	target.Deadlines.MaxStreamDuration = 0
+	req = httptest.NewRequest("POST", "/pkg.Service/Method", nil)
+	req.Header.Set(hdrContentType, hdrTypeGrpc)
+	_, ok = callTimeout(req, target)
+	require.False(t, ok)
+}
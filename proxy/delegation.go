@@ -0,0 +1,671 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
+)
+
+const (
+	// delegatePathPrefix is the prefix of the delegation endpoints. The
+	// delegations of a token for a service are created and listed at the
+	// prefix followed by the service name and revoked at that path
+	// followed by the ID of the delegation.
+	delegatePathPrefix = "/.aperture/delegate/"
+
+	// delegationIDSize is the size in bytes of the random ID of a
+	// delegated token.
+	delegationIDSize = 16
+)
+
+// DelegationConfig holds the options to let the holders of tokens derive
+// restricted tokens from them, for example for CI systems.
+type DelegationConfig struct {
+	// Enabled can be set to let the holders of tokens of the service
+	// create, list and revoke delegated tokens.
+	Enabled bool `long:"enabled" description:"Let the holders of tokens create restricted tokens they can revoke"`
+}
+
+// Delegation is a token that was derived from the token of its owner with a
+// subset of its permissions.
+type Delegation struct {
+	// ID is the hex encoded random ID of the delegated token, which it
+	// carries in a delegation caveat.
+	ID string `json:"id"`
+
+	// Owner is the hex encoded ID of the token the delegated token was
+	// derived from, or the ID of the delegation it was derived from if
+	// that one was delegated itself.
+	Owner string `json:"owner"`
+
+	// Requests is the number of requests that may be made with the
+	// delegated token. Zero means there is no limit.
+	Requests uint64 `json:"requests,omitempty"`
+
+	// Used is the number of requests that were made with the delegated
+	// token so far.
+	Used uint64 `json:"used"`
+
+	// Revoked is true if the owner revoked the delegated token.
+	Revoked bool `json:"revoked"`
+
+	// Created is the time the delegated token was created.
+	Created time.Time `json:"created"`
+}
+
+// DelegationStore is an entity that keeps track of the delegated tokens and
+// the requests made with them.
+type DelegationStore interface {
+	// AddDelegation stores a new delegation.
+	AddDelegation(context.Context, *Delegation) error
+
+	// Delegation returns the delegation with the given ID, or nil if there
+	// is none.
+	Delegation(context.Context, string) (*Delegation, error)
+
+	// Delegations returns the delegations of the given owner.
+	Delegations(context.Context, string) ([]*Delegation, error)
+
+	// RevokeDelegation revokes the delegation with the given ID if it
+	// belongs to the given owner. False is returned if there is no such
+	// delegation.
+	RevokeDelegation(ctx context.Context, owner, id string) (bool, error)
+
+	// UseDelegation atomically records a request made with the delegated
+	// token if it isn't revoked and hasn't used up its requests. False is
+	// returned otherwise.
+	UseDelegation(context.Context, string) (bool, error)
+}
+
+// memDelegationStore is a DelegationStore that keeps the delegations in
+// memory.
+type memDelegationStore struct {
+	sync.Mutex
+	delegations map[string]*Delegation
+}
+
+// A compile-time constraint to ensure memDelegationStore implements
+// DelegationStore.
+var _ DelegationStore = (*memDelegationStore)(nil)
+
+// NewMemDelegationStore creates a new, empty in-memory delegation store.
+func NewMemDelegationStore() DelegationStore {
+	return &memDelegationStore{
+		delegations: make(map[string]*Delegation),
+	}
+}
+
+// AddDelegation stores a new delegation.
+//
+// NOTE: This is part of the DelegationStore interface.
+func (s *memDelegationStore) AddDelegation(_ context.Context,
+	delegation *Delegation) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	stored := *delegation
+	s.delegations[delegation.ID] = &stored
+	return nil
+}
+
+// Delegation returns the delegation with the given ID, or nil if there is none.
+//
+// NOTE: This is part of the DelegationStore interface.
+func (s *memDelegationStore) Delegation(_ context.Context,
+	id string) (*Delegation, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	delegation, ok := s.delegations[id]
+	if !ok {
+		return nil, nil
+	}
+
+	result := *delegation
+	return &result, nil
+}
+
+// Delegations returns the delegations of the given owner.
+//
+// NOTE: This is part of the DelegationStore interface.
+func (s *memDelegationStore) Delegations(_ context.Context,
+	owner string) ([]*Delegation, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	var delegations []*Delegation
+	for _, delegation := range s.delegations {
+		if delegation.Owner != owner {
+			continue
+		}
+
+		result := *delegation
+		delegations = append(delegations, &result)
+	}
+
+	return delegations, nil
+}
+
+// RevokeDelegation revokes the delegation with the given ID if it belongs to
+// the given owner.
+//
+// NOTE: This is part of the DelegationStore interface.
+func (s *memDelegationStore) RevokeDelegation(_ context.Context, owner,
+	id string) (bool, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	delegation, ok := s.delegations[id]
+	if !ok || delegation.Owner != owner {
+		return false, nil
+	}
+
+	delegation.Revoked = true
+	return true, nil
+}
+
+// UseDelegation records a request made with the delegated token if it isn't
+// revoked and hasn't used up its requests.
+//
+// NOTE: This is part of the DelegationStore interface.
+func (s *memDelegationStore) UseDelegation(_ context.Context,
+	id string) (bool, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	delegation, ok := s.delegations[id]
+	if !ok || delegation.Revoked {
+		return false, nil
+	}
+	if delegation.Requests > 0 && delegation.Used >= delegation.Requests {
+		return false, nil
+	}
+
+	delegation.Used++
+	return true, nil
+}
+
+// SetDelegationStore sets the store the delegated tokens are kept in. By
+// default, they are kept in memory.
+func (p *Proxy) SetDelegationStore(store DelegationStore) {
+	p.delegationStore = store
+}
+
+// delegationIDs returns the IDs of the delegation caveats of the token for the
+// service, from the one it was first delegated with to its latest one.
+func delegationIDs(mac *macaroon.Macaroon, target *Service) []string {
+	cond := target.Name + lsat.CondDelegationSuffix
+
+	var ids []string
+	for _, rawCaveat := range mac.Caveats() {
+		caveat, err := lsat.DecodeCaveat(string(rawCaveat.Id))
+		if err != nil {
+			continue
+		}
+		if caveat.Condition == cond {
+			ids = append(ids, caveat.Value)
+		}
+	}
+
+	return ids
+}
+
+// errDelegationChain is returned if the delegation caveats of a token don't
+// form a chain of delegations that were derived from each other.
+var errDelegationChain = errors.New("invalid delegation chain")
+
+// delegationChain looks up the delegations of the token for the service, from
+// the one it was first delegated with to its latest one. Each delegation must
+// be owned by the one before it and the first one by the root token, otherwise
+// a delegate could append the caveat of a delegation it doesn't own to its
+// token. Delegations that don't exist break the chain as well.
+func (p *Proxy) delegationChain(ctx context.Context, mac *macaroon.Macaroon,
+	target *Service, rootID lsat.TokenID) ([]*Delegation, error) {
+
+	ids := delegationIDs(mac, target)
+	chain := make([]*Delegation, 0, len(ids))
+	owner := rootID.String()
+	for _, id := range ids {
+		delegation, err := p.delegationStore.Delegation(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if delegation == nil || delegation.Owner != owner {
+			return nil, errDelegationChain
+		}
+
+		chain = append(chain, delegation)
+		owner = delegation.ID
+	}
+
+	return chain, nil
+}
+
+// checkDelegation makes sure a request made with a delegated token is allowed
+// by all delegations it was derived with and counts it against their request
+// limits. If it isn't, an error response is sent to the client and false is
+// returned.
+func (p *Proxy) checkDelegation(w http.ResponseWriter, r *http.Request,
+	target *Service, prefixLog *PrefixLog) bool {
+
+	mac, _, err := lsat.FromHeader(&r.Header)
+	if err != nil {
+		prefixLog.Errorf("Error reading token for delegation: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "invalid token",
+		)
+		return false
+	}
+	tokenID, err := tokenIDFromHeader(r.Header)
+	if err != nil {
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "invalid token",
+		)
+		return false
+	}
+
+	// Only the delegations the token was really derived with count its
+	// requests, so it can't use up the requests of others.
+	chain, err := p.delegationChain(r.Context(), mac, target, tokenID)
+	switch {
+	case err == errDelegationChain:
+		prefixLog.Infof("Request with invalid delegation chain " +
+			"rejected.")
+		sendDirectResponse(
+			w, r, http.StatusForbidden, "invalid delegation",
+		)
+		return false
+
+	case err != nil:
+		prefixLog.Errorf("Error checking delegation: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"delegation failure",
+		)
+		return false
+	}
+
+	for _, delegation := range chain {
+		id := delegation.ID
+		ok, err := p.delegationStore.UseDelegation(r.Context(), id)
+		if err != nil {
+			prefixLog.Errorf("Error checking delegation: %v", err)
+			sendDirectResponse(
+				w, r, http.StatusInternalServerError,
+				"delegation failure",
+			)
+			return false
+		}
+		if !ok {
+			prefixLog.Infof("Request with revoked or used up "+
+				"delegation %s rejected.", id)
+			sendDirectResponse(
+				w, r, http.StatusForbidden,
+				"delegation revoked or used up",
+			)
+			return false
+		}
+	}
+
+	return true
+}
+
+// delegationRequest is the JSON body of a request to create a delegated token.
+// All restrictions are optional.
+type delegationRequest struct {
+	// Capabilities is the comma separated subset of the capabilities of
+	// the token the delegated token may use.
+	Capabilities string `json:"capabilities"`
+
+	// Path restricts the delegated token to a single resource.
+	Path string `json:"path"`
+
+	// Validity is the time the delegated token is valid for, like "24h".
+	// It never outlives the token it's derived from.
+	Validity string `json:"validity"`
+
+	// Requests is the number of requests the delegated token may make.
+	Requests uint64 `json:"requests"`
+}
+
+// delegationResponse is the JSON body of the response of a created delegated
+// token.
+type delegationResponse struct {
+	*Delegation
+
+	// Macaroon is the base64 encoded macaroon of the delegated token.
+	Macaroon string `json:"macaroon"`
+
+	// Authorization is the value of the Authorization header requests
+	// with the delegated token are made with.
+	Authorization string `json:"authorization"`
+}
+
+// isDelegateRequest returns true if the request is addressed to one of the
+// delegation endpoints.
+func isDelegateRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, delegatePathPrefix)
+}
+
+// handleDelegate creates, lists or revokes the delegated tokens of the token
+// the request is made with. Delegated tokens can only manage the delegations
+// they created themselves.
+func (p *Proxy) handleDelegate(w http.ResponseWriter, r *http.Request,
+	remoteIP net.IP, prefixLog *PrefixLog) {
+
+	parts := strings.Split(
+		strings.TrimPrefix(r.URL.Path, delegatePathPrefix), "/",
+	)
+	target, ok := p.serviceByName(parts[0])
+	if !ok || len(parts) > 2 || !target.Delegation.Enabled {
+		sendDirectResponse(w, r, http.StatusNotFound, "not found")
+		return
+	}
+
+	// Only the holder of a valid token can delegate it.
+	r = withClientBinding(r, remoteIP)
+	r = withGracePeriod(r, target)
+	if !p.accept(r, target.Name) {
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "invalid token",
+		)
+		return
+	}
+	mac, preimage, err := lsat.FromHeader(&r.Header)
+	if err != nil {
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "invalid token",
+		)
+		return
+	}
+	owner, ok := p.delegationOwner(w, r, mac, target, prefixLog)
+	if !ok {
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		p.listDelegations(w, r, owner, prefixLog)
+
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		p.createDelegation(
+			w, r, target, mac, preimage, owner, prefixLog,
+		)
+
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		p.revokeDelegation(w, r, owner, parts[1], prefixLog)
+
+	default:
+		sendDirectResponse(
+			w, r, http.StatusMethodNotAllowed, "method not allowed",
+		)
+	}
+}
+
+// delegationOwner returns the owner of the delegations the token of the request
+// manages, which is its latest delegation if it was delegated itself and the
+// ID of the token otherwise. Revoked delegated tokens and tokens whose
+// delegations weren't derived from each other can't manage anything.
+func (p *Proxy) delegationOwner(w http.ResponseWriter, r *http.Request,
+	mac *macaroon.Macaroon, target *Service,
+	prefixLog *PrefixLog) (string, bool) {
+
+	tokenID, err := tokenIDFromHeader(r.Header)
+	if err != nil {
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "invalid token",
+		)
+		return "", false
+	}
+
+	chain, err := p.delegationChain(r.Context(), mac, target, tokenID)
+	switch {
+	case err == errDelegationChain:
+		prefixLog.Infof("Token with invalid delegation chain rejected.")
+		sendDirectResponse(
+			w, r, http.StatusForbidden, "invalid delegation",
+		)
+		return "", false
+
+	case err != nil:
+		prefixLog.Errorf("Error looking up delegation: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"delegation failure",
+		)
+		return "", false
+	}
+
+	for _, delegation := range chain {
+		if delegation.Revoked {
+			sendDirectResponse(
+				w, r, http.StatusForbidden,
+				"delegation revoked",
+			)
+			return "", false
+		}
+	}
+	if len(chain) > 0 {
+		return chain[len(chain)-1].ID, true
+	}
+
+	return tokenID.String(), true
+}
+
+// createDelegation derives a delegated token with the requested restrictions
+// from the token of the request. The restrictions are added as caveats, so the
+// delegated token can never do more than the token it was derived from.
+func (p *Proxy) createDelegation(w http.ResponseWriter, r *http.Request,
+	target *Service, mac *macaroon.Macaroon, preimage lntypes.Preimage,
+	owner string, prefixLog *PrefixLog) {
+
+	var req delegationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendDirectResponse(
+			w, r, http.StatusBadRequest,
+			"invalid delegation request",
+		)
+		return
+	}
+
+	caveats, err := delegationCaveats(mac, target, &req)
+	if err != nil {
+		sendDirectResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var rawID [delegationIDSize]byte
+	if _, err := rand.Read(rawID[:]); err != nil {
+		prefixLog.Errorf("Error creating delegation ID: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"delegation failure",
+		)
+		return
+	}
+	delegation := &Delegation{
+		ID:       hex.EncodeToString(rawID[:]),
+		Owner:    owner,
+		Requests: req.Requests,
+		Created:  time.Now(),
+	}
+	caveats = append(
+		caveats, lsat.NewDelegationCaveat(target.Name, delegation.ID),
+	)
+
+	child := mac.Clone()
+	if err := lsat.AddFirstPartyCaveats(child, caveats...); err != nil {
+		prefixLog.Errorf("Error adding delegation caveats: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"delegation failure",
+		)
+		return
+	}
+	macBytes, err := child.MarshalBinary()
+	if err != nil {
+		prefixLog.Errorf("Error encoding delegated token: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"delegation failure",
+		)
+		return
+	}
+	header := make(http.Header)
+	if err := lsat.SetHeader(&header, child, preimage); err != nil {
+		prefixLog.Errorf("Error encoding delegated token: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"delegation failure",
+		)
+		return
+	}
+
+	err = p.delegationStore.AddDelegation(r.Context(), delegation)
+	if err != nil {
+		prefixLog.Errorf("Error storing delegation: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"delegation failure",
+		)
+		return
+	}
+
+	prefixLog.Infof("Created delegation %s of %s.", delegation.ID, owner)
+	writeDelegationResponse(w, &delegationResponse{
+		Delegation:    delegation,
+		Macaroon:      base64.StdEncoding.EncodeToString(macBytes),
+		Authorization: header.Get(lsat.HeaderAuthorization),
+	}, prefixLog)
+}
+
+// delegationCaveats returns the caveats that restrict a token delegated from
+// the given one as requested.
+func delegationCaveats(mac *macaroon.Macaroon, target *Service,
+	req *delegationRequest) ([]lsat.Caveat, error) {
+
+	var caveats []lsat.Caveat
+	if req.Capabilities != "" {
+		caveat := lsat.NewCapabilitiesCaveat(
+			target.Name, req.Capabilities,
+		)
+
+		// A token without capabilities caveat may use all of them.
+		cond := target.Name + lsat.CondCapabilitiesSuffix
+		if value, ok := lsat.HasCaveat(mac, cond); ok {
+			satisfier := lsat.NewCapabilitiesSatisfier(
+				target.Name, "",
+			)
+			err := satisfier.SatisfyPrevious(
+				lsat.NewCaveat(cond, value), caveat,
+			)
+			if err != nil {
+				return nil, err
+			}
+		}
+		caveats = append(caveats, caveat)
+	}
+
+	if req.Path != "" {
+		caveats = append(caveats, lsat.NewPathCaveat(req.Path))
+	}
+
+	if req.Validity != "" {
+		validity, err := time.ParseDuration(req.Validity)
+		if err != nil || validity <= 0 {
+			return nil, fmt.Errorf("invalid validity")
+		}
+
+		expiry := time.Now().Add(validity)
+		parentExpiry, ok := lsat.ValidUntil(mac, target.Name)
+		if ok && parentExpiry.Before(expiry) {
+			expiry = parentExpiry
+		}
+		caveats = append(
+			caveats, lsat.NewValidUntilCaveat(target.Name, expiry),
+		)
+	}
+
+	return caveats, nil
+}
+
+// listDelegations sends the delegations of the owner to the client, oldest
+// first.
+func (p *Proxy) listDelegations(w http.ResponseWriter, r *http.Request,
+	owner string, prefixLog *PrefixLog) {
+
+	delegations, err := p.delegationStore.Delegations(r.Context(), owner)
+	if err != nil {
+		prefixLog.Errorf("Error listing delegations: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"delegation failure",
+		)
+		return
+	}
+	sort.Slice(delegations, func(i, j int) bool {
+		return delegations[i].Created.Before(delegations[j].Created)
+	})
+	if delegations == nil {
+		delegations = []*Delegation{}
+	}
+
+	writeDelegationResponse(w, delegations, prefixLog)
+}
+
+// revokeDelegation revokes the delegation with the given ID of the owner.
+// Tokens that were delegated from the revoked one can't be used anymore
+// either.
+func (p *Proxy) revokeDelegation(w http.ResponseWriter, r *http.Request,
+	owner, id string, prefixLog *PrefixLog) {
+
+	ok, err := p.delegationStore.RevokeDelegation(r.Context(), owner, id)
+	if err != nil {
+		prefixLog.Errorf("Error revoking delegation: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"delegation failure",
+		)
+		return
+	}
+	if !ok {
+		sendDirectResponse(
+			w, r, http.StatusNotFound, "unknown delegation",
+		)
+		return
+	}
+
+	prefixLog.Infof("Revoked delegation %s of %s.", id, owner)
+	addCorsHeaders(w.Header())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeDelegationResponse writes the JSON body of a delegation endpoint.
+func writeDelegationResponse(w http.ResponseWriter, response interface{},
+	prefixLog *PrefixLog) {
+
+	addCorsHeaders(w.Header())
+	w.Header().Set(hdrContentType, hdrTypeJSON)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		prefixLog.Errorf("Error sending delegation response: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDelegation tests that the holder of a token can create delegated tokens
+// with a limited number of requests and revoke them, and that delegated tokens
+// can't manage the delegations of others.
+func TestDelegation(t *testing.T) {
+	service := testHandlerService(
+		"ci-service", "^/ci/.*$",
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		},
+	)
+	service.Delegation = proxy.DelegationConfig{Enabled: true}
+	p, err := proxy.New(auth.NewMockAuthenticator(), []*proxy.Service{
+		service,
+	})
+	require.NoError(t, err)
+	master := testAuthHeader(t, lsat.TokenID{1})
+
+	type delegation struct {
+		ID            string `json:"id"`
+		Used          uint64 `json:"used"`
+		Authorization string `json:"authorization"`
+	}
+	delegate := func(header, body string) *delegation {
+		rec := serveTestRequest(
+			p, "POST", "/.aperture/delegate/ci-service", header,
+			strings.NewReader(body),
+		)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var d delegation
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &d))
+		require.NotEmpty(t, d.ID)
+		return &d
+	}
+
+	// A delegated token may only make the requests it was limited to.
+	limited := delegate(master, `{"requests": 2}`)
+	for i := 0; i < 2; i++ {
+		rec := serveTestRequest(
+			p, "GET", "/ci/build", limited.Authorization, nil,
+		)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	rec := serveTestRequest(
+		p, "GET", "/ci/build", limited.Authorization, nil,
+	)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	// Invalid restrictions are rejected.
+	rec = serveTestRequest(
+		p, "POST", "/.aperture/delegate/ci-service", master,
+		strings.NewReader(`{"validity": "forever"}`),
+	)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// A delegated token can delegate further, but can't revoke the
+	// delegations of its owner.
+	other := delegate(master, `{}`)
+	child := delegate(other.Authorization, `{"validity": "1h"}`)
+	rec = serveTestRequest(
+		p, "DELETE", "/.aperture/delegate/ci-service/"+limited.ID,
+		other.Authorization, nil,
+	)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = serveTestRequest(
+		p, "GET", "/.aperture/delegate/ci-service", master, nil,
+	)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var delegations []*delegation
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &delegations))
+	require.Len(t, delegations, 2)
+	require.Equal(t, limited.ID, delegations[0].ID)
+	require.EqualValues(t, 2, delegations[0].Used)
+
+	// A delegated token can't pose as a sibling by adding the sibling's
+	// delegation caveat to it.
+	sibling := delegate(master, `{}`)
+	nephew := delegate(sibling.Authorization, `{}`)
+	header := http.Header{}
+	header.Set("Authorization", other.Authorization)
+	mac, preimage, err := lsat.FromHeader(&header)
+	require.NoError(t, err)
+	err = lsat.AddFirstPartyCaveats(
+		mac, lsat.NewDelegationCaveat("ci-service", sibling.ID),
+	)
+	require.NoError(t, err)
+	require.NoError(t, lsat.SetHeader(&header, mac, preimage))
+	forged := header.Get("Authorization")
+
+	rec = serveTestRequest(
+		p, "DELETE", "/.aperture/delegate/ci-service/"+nephew.ID,
+		forged, nil,
+	)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	rec = serveTestRequest(p, "GET", "/ci/build", forged, nil)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	rec = serveTestRequest(
+		p, "GET", "/ci/build", nephew.Authorization, nil,
+	)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// Revoking a delegated token also revokes the tokens delegated from
+	// it.
+	rec = serveTestRequest(
+		p, "GET", "/ci/build", child.Authorization, nil,
+	)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = serveTestRequest(
+		p, "DELETE", "/.aperture/delegate/ci-service/"+other.ID,
+		master, nil,
+	)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	rec = serveTestRequest(
+		p, "GET", "/ci/build", child.Authorization, nil,
+	)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	// The master token isn't affected.
+	rec = serveTestRequest(p, "GET", "/ci/build", master, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// SRVAddressPrefix is the prefix of service addresses that name the
+	// SRV records the instances of their backend are discovered through.
+	SRVAddressPrefix = "srv+"
+
+	// defaultSRVRefreshInterval is the time the SRV records of backends
+	// are cached for if no DNS resolver is configured.
+	defaultSRVRefreshInterval = 30 * time.Second
+)
+
+// srvLookupFunc looks up the SRV records of a name.
+type srvLookupFunc func(ctx context.Context, name string) ([]*net.SRV, error)
+
+// srvDiscovery discovers the instances of a backend through the SRV records of
+// its address, like the ones the DNS interface of Consul serves for the
+// services in its catalog.
+type srvDiscovery struct {
+	name string
+
+	mtx    sync.Mutex
+	lookup srvLookupFunc
+}
+
+// newSRVDiscovery returns the discovery of the instances of the backend at the
+// given address, or nil if the address doesn't name SRV records.
+func newSRVDiscovery(address string) (*srvDiscovery, error) {
+	if !strings.HasPrefix(address, SRVAddressPrefix) {
+		return nil, nil
+	}
+
+	name := strings.TrimPrefix(address, SRVAddressPrefix)
+	if name == "" || strings.Contains(name, ":") {
+		return nil, fmt.Errorf("invalid SRV address %q", address)
+	}
+
+	return &srvDiscovery{name: name}, nil
+}
+
+// setLookup sets the function the SRV records are looked up with.
+func (d *srvDiscovery) setLookup(lookup srvLookupFunc) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.lookup = lookup
+}
+
+// address returns the address of an instance of the backend. Instances are
+// picked by the priorities and weights of their records.
+func (d *srvDiscovery) address(ctx context.Context) (string, error) {
+	d.mtx.Lock()
+	lookup := d.lookup
+	d.mtx.Unlock()
+	if lookup == nil {
+		return "", fmt.Errorf("discovery of %s not started", d.name)
+	}
+
+	records, err := lookup(ctx, d.name)
+	if err != nil {
+		return "", err
+	}
+
+	record := pickSRV(records)
+	if record == nil {
+		return "", fmt.Errorf("no instance of %s available", d.name)
+	}
+
+	return net.JoinHostPort(
+		strings.TrimSuffix(record.Target, "."),
+		strconv.Itoa(int(record.Port)),
+	), nil
+}
+
+// pickSRV picks one of the records with the lowest priority, each with a
+// probability proportional to its weight as described in RFC 2782. Records of
+// the target "." tell that the service isn't available and are never picked.
+func pickSRV(records []*net.SRV) *net.SRV {
+	var (
+		candidates  []*net.SRV
+		totalWeight int
+	)
+	for _, record := range records {
+		if record.Target == "." {
+			continue
+		}
+
+		if len(candidates) > 0 {
+			switch {
+			case record.Priority > candidates[0].Priority:
+				continue
+
+			case record.Priority < candidates[0].Priority:
+				candidates, totalWeight = nil, 0
+			}
+		}
+
+		candidates = append(candidates, record)
+		totalWeight += int(record.Weight)
+	}
+
+	switch {
+	case len(candidates) == 0:
+		return nil
+
+	case totalWeight == 0:
+		return candidates[rand.Intn(len(candidates))]
+	}
+
+	n := rand.Intn(totalWeight)
+	for _, candidate := range candidates {
+		n -= int(candidate.Weight)
+		if n < 0 {
+			return candidate
+		}
+	}
+
+	return candidates[len(candidates)-1]
+}
+
+// Endpoints is the list of addresses of the instances of a backend that is
+// kept up to date at run time, for example by watching the endpoints of a
+// Kubernetes service. Requests are sent to the instances in turn.
+type Endpoints struct {
+	mtx   sync.RWMutex
+	addrs []string
+	next  uint32
+}
+
+// NewEndpoints creates a list of endpoints with the given addresses.
+func NewEndpoints(addrs []string) *Endpoints {
+	return &Endpoints{addrs: addrs}
+}
+
+// Set replaces the addresses of the endpoints.
+func (e *Endpoints) Set(addrs []string) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	e.addrs = addrs
+}
+
+// Addresses returns the current addresses of the endpoints.
+func (e *Endpoints) Addresses() []string {
+	e.mtx.RLock()
+	defer e.mtx.RUnlock()
+
+	return e.addrs
+}
+
+// address returns the address of the next instance.
+func (e *Endpoints) address() (string, error) {
+	e.mtx.RLock()
+	defer e.mtx.RUnlock()
+
+	if len(e.addrs) == 0 {
+		return "", fmt.Errorf("no ready endpoints")
+	}
+
+	next := atomic.AddUint32(&e.next, 1)
+	return e.addrs[int(next%uint32(len(e.addrs)))], nil
+}
+
+// BackendAddress returns the address requests to the backend of the service
+// are sent to. For services that discover their backend instances through SRV
+// records or have a list of endpoints, the address of one of the instances is
+// returned.
+func (s *Service) BackendAddress(ctx context.Context) (string, error) {
+	switch {
+	case s.Endpoints != nil:
+		return s.Endpoints.address()
+
+	case s.discovery != nil:
+		return s.discovery.address(ctx)
+	}
+
+	return s.Address, nil
+}
+
+// IsDiscovered returns true if the instances of the backend of the service are
+// discovered at run time instead of being reached at a fixed address.
+func (s *Service) IsDiscovered() bool {
+	return s.Endpoints != nil || strings.HasPrefix(
+		s.Address, SRVAddressPrefix,
+	)
+}
+
+// lookupSRV looks up the SRV records of backends with the DNS resolver, or the
+// resolver of the system if none is set.
+func (p *Proxy) lookupSRV(ctx context.Context, name string) ([]*net.SRV,
+	error) {
+
+	if p.dnsResolver != nil {
+		return p.dnsResolver.LookupSRV(ctx, name)
+	}
+
+	return p.srvResolver.LookupSRV(ctx, name)
+}
+
+// backendHost returns the host requests to the backend of the service are sent
+// to. If no instance of a discovered backend can be found, its configured
+// address is returned, which the proxy refuses to dial.
+func backendHost(ctx context.Context, target *Service) string {
+	address, err := target.BackendAddress(ctx)
+	if err != nil {
+		log.Errorf("Unable to discover backend of service %s: %v",
+			target.Name, err)
+		return target.Address
+	}
+
+	return address
+}
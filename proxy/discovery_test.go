@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestPickSRV tests that only the records with the lowest priority are picked,
+// in proportion to their weights.
+func TestPickSRV(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "backup.", Priority: 2, Weight: 100},
+		{Target: "a.", Priority: 1, Weight: 3},
+		{Target: "b.", Priority: 1, Weight: 1},
+		{Target: ".", Priority: 0},
+	}
+
+	picked := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		picked[pickSRV(records).Target]++
+	}
+	require.Zero(t, picked["backup."])
+	require.InDelta(t, 3000, picked["a."], 300)
+	require.InDelta(t, 1000, picked["b."], 300)
+
+	// Records without weights are picked evenly.
+	record := pickSRV([]*net.SRV{{Target: "c."}})
+	require.Equal(t, "c.", record.Target)
+
+	require.Nil(t, pickSRV([]*net.SRV{{Target: "."}}))
+}
+
+// TestSRVDiscovery tests that requests to services with an SRV address are
+// sent to one of the discovered instances of their backend.
+func TestSRVDiscovery(t *testing.T) {
+	_, err := newSRVDiscovery("srv+")
+	require.Error(t, err)
+	_, err = newSRVDiscovery("srv+backend.service.consul:8080")
+	require.Error(t, err)
+
+	target := &Service{
+		Name:    "backend",
+		Address: "srv+backend.service.consul",
+	}
+	target.discovery, err = newSRVDiscovery(target.Address)
+	require.NoError(t, err)
+
+	// No instance can be found before the discovery is started.
+	ctx := context.Background()
+	_, err = target.BackendAddress(ctx)
+	require.Error(t, err)
+
+	var lookupErr error
+	target.discovery.setLookup(func(_ context.Context,
+		name string) ([]*net.SRV, error) {
+
+		require.Equal(t, "backend.service.consul", name)
+		return []*net.SRV{{
+			Target: "0a000001.addr.dc1.consul.",
+			Port:   8080,
+		}}, lookupErr
+	})
+
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	require.Equal(
+		t, "0a000001.addr.dc1.consul:8080",
+		backendHost(req.Context(), target),
+	)
+
+	// The configured address is used if the lookup fails, which the proxy
+	// refuses to dial.
+	lookupErr = fmt.Errorf("no such host")
+	host := backendHost(req.Context(), target)
+	require.Equal(t, target.Address, host)
+
+	p := &Proxy{}
+	_, err = p.dialContext(ctx, "tcp", host+":80")
+	require.Error(t, err)
+
+	// Services with a fixed address aren't affected.
+	address, err := (&Service{Address: "10.0.0.1:80"}).BackendAddress(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1:80", address)
+}
+
+// TestEndpoints tests that requests are sent to the endpoints of a service in
+// turn.
+func TestEndpoints(t *testing.T) {
+	target := &Service{
+		Address:   "k8s+backend.default",
+		Endpoints: NewEndpoints(nil),
+	}
+
+	ctx := context.Background()
+	_, err := target.BackendAddress(ctx)
+	require.Error(t, err)
+
+	target.Endpoints.Set([]string{"10.0.0.1:80", "10.0.0.2:80"})
+	picked := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		address, err := target.BackendAddress(ctx)
+		require.NoError(t, err)
+		picked[address]++
+	}
+	require.Equal(t, map[string]int{
+		"10.0.0.1:80": 2,
+		"10.0.0.2:80": 2,
+	}, picked)
+	require.True(t, target.IsDiscovered())
+}
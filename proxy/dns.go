@@ -0,0 +1,579 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// defaultDNSTimeout is the default time to wait for the answer to a
+	// DNS query.
+	defaultDNSTimeout = 5 * time.Second
+
+	// defaultReresolveInterval is the default maximum time a resolved
+	// address is used before its name is looked up again.
+	defaultReresolveInterval = 5 * time.Minute
+
+	// maxDNSMessageSize is the maximum size of a DNS message we read.
+	maxDNSMessageSize = 65535
+
+	// dohContentType is the media type of DNS messages sent over HTTPS.
+	dohContentType = "application/dns-message"
+)
+
+var (
+	// errNoSuchHost is returned if a name doesn't exist.
+	errNoSuchHost = errors.New("no such host")
+)
+
+// DNSConfig holds the options of the resolver the addresses of backends are
+// looked up with when aperture connects to them.
+type DNSConfig struct {
+	// Enabled can be set to look up the addresses of backends with the
+	// caching resolver instead of the resolver of the system.
+	Enabled bool `long:"enabled" description:"Look up the addresses of backends with a caching resolver"`
+
+	// Nameservers are the DNS servers that are queried. If neither these
+	// nor a DNS over HTTPS server are set, names are looked up with the
+	// resolver of the system.
+	Nameservers []string `long:"nameserver" description:"The IP address of a DNS server to query, with an optional port (default 53)"`
+
+	// DoHURL is the URL of a DNS over HTTPS server that is queried instead
+	// of plain DNS servers.
+	DoHURL string `long:"dohurl" description:"The URL of a DNS over HTTPS server to query instead of plain DNS servers"`
+
+	// Timeout is the time to wait for the answer to a query.
+	Timeout time.Duration `long:"timeout" description:"The time to wait for the answer to a DNS query (default 5s)"`
+
+	// MinTTL is the minimum time an answer is cached, even if its records
+	// have a shorter TTL.
+	MinTTL time.Duration `long:"minttl" description:"The minimum time an answer is cached, even if its TTL is shorter"`
+
+	// ReresolveInterval is the maximum time an answer is cached. Names are
+	// looked up again after this time, even if the TTL of their records
+	// is longer. The TTL isn't known for names that are looked up with
+	// the resolver of the system, so they are cached for this long.
+	ReresolveInterval time.Duration `long:"reresolveinterval" description:"The maximum time an answer is cached before the name is looked up again (default 5m)"`
+}
+
+// validate checks the resolver options and sets the defaults.
+func (c *DNSConfig) validate() error {
+	if c.Timeout < 0 || c.MinTTL < 0 || c.ReresolveInterval < 0 {
+		return fmt.Errorf("negative DNS duration")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultDNSTimeout
+	}
+	if c.ReresolveInterval == 0 {
+		c.ReresolveInterval = defaultReresolveInterval
+	}
+	if c.MinTTL > c.ReresolveInterval {
+		return fmt.Errorf("minimum TTL exceeds re-resolution interval")
+	}
+
+	if c.DoHURL != "" {
+		if len(c.Nameservers) > 0 {
+			return fmt.Errorf("nameservers and DNS over HTTPS " +
+				"server are mutually exclusive")
+		}
+
+		dohURL, err := url.Parse(c.DoHURL)
+		if err != nil {
+			return fmt.Errorf("invalid DNS over HTTPS URL: %v", err)
+		}
+		if dohURL.Scheme != "https" || dohURL.Host == "" {
+			return fmt.Errorf("DNS over HTTPS URL must be an " +
+				"https URL")
+		}
+	}
+
+	for i, nameserver := range c.Nameservers {
+		if net.ParseIP(nameserver) != nil {
+			c.Nameservers[i] = net.JoinHostPort(nameserver, "53")
+			continue
+		}
+
+		host, _, err := net.SplitHostPort(nameserver)
+		if err != nil || net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid nameserver %q", nameserver)
+		}
+	}
+
+	return nil
+}
+
+// dnsEntry is a cached answer of the resolver.
+type dnsEntry struct {
+	ips    []net.IP
+	srvs   []*net.SRV
+	expiry time.Time
+}
+
+// DNSResolver looks up the addresses of backends and caches them for as long
+// as the TTL of their records says, so backends with rotating addresses are
+// reached at their current one without a lookup for every connection.
+type DNSResolver struct {
+	cfg       *DNSConfig
+	dialer    net.Dialer
+	dohClient *http.Client
+
+	mtx   sync.Mutex
+	cache map[string]*dnsEntry
+}
+
+// NewDNSResolver creates a resolver with the given options.
+func NewDNSResolver(cfg *DNSConfig) (*DNSResolver, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return &DNSResolver{
+		cfg:       cfg,
+		dohClient: &http.Client{Timeout: cfg.Timeout},
+		cache:     make(map[string]*dnsEntry),
+	}, nil
+}
+
+// SetDNSResolver sets the resolver the addresses of backends are looked up
+// with. If it's not set, the resolver of the system is used for every
+// connection.
+func (p *Proxy) SetDNSResolver(resolver *DNSResolver) {
+	p.dnsResolver = resolver
+}
+
+// dialContext connects to the address of a backend. The addresses of
+// discovered backends, like srv+name, are only dialed if no instance of them
+// was found. Host names never contain a plus sign, so they are told apart by
+// it.
+func (p *Proxy) dialContext(ctx context.Context, network,
+	addr string) (net.Conn, error) {
+
+	if strings.Contains(addr, "+") {
+		return nil, fmt.Errorf("no instance of %s discovered", addr)
+	}
+
+	if p.dnsResolver == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	return p.dnsResolver.DialContext(ctx, network, addr)
+}
+
+// DialContext connects to the given address. Its host name is looked up with
+// the resolver and its IP addresses are tried in order until a connection is
+// established.
+func (r *DNSResolver) DialContext(ctx context.Context, network,
+	addr string) (net.Conn, error) {
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = r.dialer.DialContext(
+			ctx, network, net.JoinHostPort(ip.String(), port),
+		)
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// LookupIP returns the IP addresses of the given host. Cached answers are used
+// until they expire. If a name can't be looked up again, its expired answer is
+// used until it can, so backends stay reachable while the DNS servers aren't.
+func (r *DNSResolver) LookupIP(ctx context.Context, host string) ([]net.IP,
+	error) {
+
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	host = strings.ToLower(host)
+	entry, err := r.cached(host, func() (*dnsEntry, time.Duration, error) {
+		ips, ttl, err := r.lookupIP(ctx, host)
+		return &dnsEntry{ips: ips}, ttl, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.ips, nil
+}
+
+// LookupSRV returns the SRV records of the given name, which are cached the
+// same way as addresses. The name is looked up as it is, like
+// _grpc._tcp.example.com or backend.service.consul.
+func (r *DNSResolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV,
+	error) {
+
+	name = strings.ToLower(name)
+	entry, err := r.cached("srv "+name, func() (*dnsEntry, time.Duration,
+		error) {
+
+		srvs, ttl, err := r.lookupSRV(ctx, name)
+		return &dnsEntry{srvs: srvs}, ttl, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.srvs, nil
+}
+
+// cached returns the cached entry of the key, or looks it up and caches it for
+// its TTL if it's missing or expired. An expired entry is returned if the
+// lookup fails.
+func (r *DNSResolver) cached(key string, lookup func() (*dnsEntry,
+	time.Duration, error)) (*dnsEntry, error) {
+
+	r.mtx.Lock()
+	entry, ok := r.cache[key]
+	r.mtx.Unlock()
+	if ok && time.Now().Before(entry.expiry) {
+		return entry, nil
+	}
+
+	newEntry, ttl, err := lookup()
+	if err != nil {
+		if ok {
+			log.Warnf("Unable to look up %s again, using expired "+
+				"answer: %v", key, err)
+			return entry, nil
+		}
+		return nil, fmt.Errorf("unable to look up %s: %v", key, err)
+	}
+
+	if ttl < r.cfg.MinTTL {
+		ttl = r.cfg.MinTTL
+	}
+	if ttl > r.cfg.ReresolveInterval {
+		ttl = r.cfg.ReresolveInterval
+	}
+	newEntry.expiry = time.Now().Add(ttl)
+
+	r.mtx.Lock()
+	r.cache[key] = newEntry
+	r.mtx.Unlock()
+
+	return newEntry, nil
+}
+
+// systemResolver returns true if names are looked up with the resolver of the
+// system instead of the configured DNS servers.
+func (r *DNSResolver) systemResolver() bool {
+	return r.cfg.DoHURL == "" && len(r.cfg.Nameservers) == 0
+}
+
+// lookupIP looks up the IPv4 and IPv6 addresses of the host and returns them
+// with the shortest TTL of their records.
+func (r *DNSResolver) lookupIP(ctx context.Context, host string) ([]net.IP,
+	time.Duration, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.Timeout)
+	defer cancel()
+
+	if r.systemResolver() {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		ips := make([]net.IP, 0, len(addrs))
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+		return ips, r.cfg.ReresolveInterval, nil
+	}
+
+	var (
+		ips  []net.IP
+		ttl  = r.cfg.ReresolveInterval
+		errs []error
+	)
+	for _, qtype := range []dnsmessage.Type{
+		dnsmessage.TypeA, dnsmessage.TypeAAAA,
+	} {
+		answers, err := r.query(ctx, host, qtype)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, answer := range answers {
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				ips = append(ips, net.IP(body.A[:]))
+
+			case *dnsmessage.AAAAResource:
+				ips = append(ips, net.IP(body.AAAA[:]))
+
+			default:
+				continue
+			}
+			ttl = minTTL(ttl, answer.Header.TTL)
+		}
+	}
+
+	switch {
+	case len(errs) == 2:
+		return nil, 0, errs[0]
+
+	case len(ips) == 0:
+		return nil, 0, errNoSuchHost
+	}
+
+	return ips, ttl, nil
+}
+
+// lookupSRV looks up the SRV records of the name and returns them with their
+// shortest TTL.
+func (r *DNSResolver) lookupSRV(ctx context.Context, name string) ([]*net.SRV,
+	time.Duration, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.Timeout)
+	defer cancel()
+
+	if r.systemResolver() {
+		_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, 0, err
+		}
+		return srvs, r.cfg.ReresolveInterval, nil
+	}
+
+	answers, err := r.query(ctx, name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		srvs []*net.SRV
+		ttl  = r.cfg.ReresolveInterval
+	)
+	for _, answer := range answers {
+		body, ok := answer.Body.(*dnsmessage.SRVResource)
+		if !ok {
+			continue
+		}
+
+		srvs = append(srvs, &net.SRV{
+			Target:   body.Target.String(),
+			Port:     body.Port,
+			Priority: body.Priority,
+			Weight:   body.Weight,
+		})
+		ttl = minTTL(ttl, answer.Header.TTL)
+	}
+	if len(srvs) == 0 {
+		return nil, 0, errNoSuchHost
+	}
+
+	return srvs, ttl, nil
+}
+
+// minTTL returns the shorter of the duration and the TTL of a record.
+func minTTL(ttl time.Duration, recordTTL uint32) time.Duration {
+	if d := time.Duration(recordTTL) * time.Second; d < ttl {
+		return d
+	}
+
+	return ttl
+}
+
+// query asks the DNS servers for the records of the given type of the host
+// and returns the records of its answer.
+func (r *DNSResolver) query(ctx context.Context, host string,
+	qtype dnsmessage.Type) ([]dnsmessage.Resource, error) {
+
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+
+	// DNS over HTTPS uses the ID zero so answers can be cached by HTTP
+	// caches.
+	var id uint16
+	if r.cfg.DoHURL == "" {
+		var b [2]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		id = binary.BigEndian.Uint16(b[:])
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var answer []byte
+	if r.cfg.DoHURL != "" {
+		answer, err = r.exchangeDoH(ctx, query)
+	} else {
+		answer, err = r.exchange(ctx, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseAnswer(answer, id)
+}
+
+// exchange sends the query to the nameservers in order until one of them
+// answers. Truncated answers over UDP are asked for again over TCP.
+func (r *DNSResolver) exchange(ctx context.Context, query []byte) ([]byte,
+	error) {
+
+	var err error
+	for _, nameserver := range r.cfg.Nameservers {
+		var answer []byte
+		answer, err = r.exchangeConn(ctx, "udp", nameserver, query)
+		if err == nil && len(answer) > 2 && answer[2]&0x02 != 0 {
+			answer, err = r.exchangeConn(
+				ctx, "tcp", nameserver, query,
+			)
+		}
+		if err == nil {
+			return answer, nil
+		}
+	}
+
+	return nil, err
+}
+
+// exchangeConn sends the query to the nameserver over UDP or TCP and reads its
+// answer.
+func (r *DNSResolver) exchangeConn(ctx context.Context, network,
+	nameserver string, query []byte) ([]byte, error) {
+
+	conn, err := r.dialer.DialContext(ctx, network, nameserver)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	// Messages over TCP are prefixed with their length.
+	if network == "tcp" {
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(len(query)))
+		query = append(length[:], query...)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	if network == "udp" {
+		answer := make([]byte, maxDNSMessageSize)
+		n, err := conn.Read(answer)
+		if err != nil {
+			return nil, err
+		}
+		return answer[:n], nil
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return nil, err
+	}
+
+	return answer, nil
+}
+
+// exchangeDoH sends the query to the DNS over HTTPS server and reads its
+// answer.
+func (r *DNSResolver) exchangeDoH(ctx context.Context, query []byte) ([]byte,
+	error) {
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, r.cfg.DoHURL, bytes.NewReader(query),
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := r.dohClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS server answered with "+
+			"status %d", resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize))
+}
+
+// parseAnswer returns the records of the answer to the query with the given ID.
+// The records of the CNAMEs the name points to are part of the answer, so all
+// records of the type that was asked for can be used.
+func parseAnswer(answer []byte, id uint16) ([]dnsmessage.Resource, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(answer)
+	if err != nil {
+		return nil, err
+	}
+	if header.ID != id || !header.Response {
+		return nil, fmt.Errorf("unexpected DNS message")
+	}
+
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+
+	case dnsmessage.RCodeNameError:
+		return nil, errNoSuchHost
+
+	default:
+		return nil, fmt.Errorf("DNS server answered with %v",
+			header.RCode)
+	}
+
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+
+	return parser.AllAnswers()
+}
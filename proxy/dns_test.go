@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testDNSServer answers the A and SRV queries for a single name with the
+// current address and port 8080.
+type testDNSServer struct {
+	mtx     sync.Mutex
+	ip      [4]byte
+	ttl     uint32
+	queries int
+}
+
+// answer builds the answer to the given query.
+func (s *testDNSServer) answer(t *testing.T, query []byte) []byte {
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(query))
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.queries++
+
+	msg.Header.Response = true
+	question := msg.Questions[0]
+	switch {
+	case question.Name.String() != "backend.internal.":
+		msg.Header.RCode = dnsmessage.RCodeNameError
+
+	case question.Type == dnsmessage.TypeA:
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{
+				Name:  question.Name,
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   s.ttl,
+			},
+			Body: &dnsmessage.AResource{A: s.ip},
+		}}
+
+	case question.Type == dnsmessage.TypeSRV:
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{
+				Name:  question.Name,
+				Type:  dnsmessage.TypeSRV,
+				Class: dnsmessage.ClassINET,
+				TTL:   s.ttl,
+			},
+			Body: &dnsmessage.SRVResource{
+				Priority: 1,
+				Weight:   10,
+				Port:     8080,
+				Target:   question.Name,
+			},
+		}}
+	}
+
+	answer, err := msg.Pack()
+	require.NoError(t, err)
+	return answer
+}
+
+// queryCount returns the number of queries the server answered.
+func (s *testDNSServer) queryCount() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.queries
+}
+
+// TestDNSResolver tests that backend names are looked up with the configured
+// DNS servers and cached for the TTL of their records.
+func TestDNSResolver(t *testing.T) {
+	server := &testDNSServer{ip: [4]byte{10, 0, 0, 1}, ttl: 1}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(server.answer(t, buf[:n]), addr)
+		}
+	}()
+
+	resolver, err := NewDNSResolver(&DNSConfig{
+		Nameservers: []string{conn.LocalAddr().String()},
+		Timeout:     time.Second,
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	ips, err := resolver.LookupIP(ctx, "Backend.internal")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1", ips[0].String())
+	require.Equal(t, 2, server.queryCount())
+
+	// The cached answer is used until its TTL expires, then the current
+	// address is looked up.
+	server.mtx.Lock()
+	server.ip = [4]byte{10, 0, 0, 2}
+	server.mtx.Unlock()
+	ips, err = resolver.LookupIP(ctx, "backend.internal")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1", ips[0].String())
+
+	time.Sleep(1100 * time.Millisecond)
+	ips, err = resolver.LookupIP(ctx, "backend.internal")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.2", ips[0].String())
+	require.Equal(t, 4, server.queryCount())
+
+	// SRV records are looked up with the same servers.
+	srvs, err := resolver.LookupSRV(ctx, "backend.internal")
+	require.NoError(t, err)
+	require.Equal(t, []*net.SRV{{
+		Target:   "backend.internal.",
+		Port:     8080,
+		Priority: 1,
+		Weight:   10,
+	}}, srvs)
+
+	// Unknown names are an error.
+	_, err = resolver.LookupIP(ctx, "unknown.internal")
+	require.Error(t, err)
+
+	// The expired answer is used while the DNS server is unreachable.
+	require.NoError(t, conn.Close())
+	time.Sleep(1100 * time.Millisecond)
+	ips, err = resolver.LookupIP(ctx, "backend.internal")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.2", ips[0].String())
+}
+
+// TestDNSResolverDoH tests that names are looked up with a DNS over HTTPS
+// server.
+func TestDNSResolverDoH(t *testing.T) {
+	server := &testDNSServer{ip: [4]byte{10, 0, 0, 1}, ttl: 60}
+	dohServer := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, dohContentType, r.Header.Get(
+				"Content-Type",
+			))
+			query, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+
+			w.Header().Set("Content-Type", dohContentType)
+			_, _ = w.Write(server.answer(t, query))
+		},
+	))
+	defer dohServer.Close()
+
+	resolver, err := NewDNSResolver(&DNSConfig{
+		DoHURL:            dohServer.URL + "/dns-query",
+		ReresolveInterval: time.Minute,
+	})
+	require.NoError(t, err)
+	resolver.dohClient = dohServer.Client()
+
+	ips, err := resolver.LookupIP(context.Background(), "backend.internal")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1", ips[0].String())
+
+	// The answer is cached for its TTL.
+	_, err = resolver.LookupIP(context.Background(), "backend.internal")
+	require.NoError(t, err)
+	require.Equal(t, 2, server.queryCount())
+}
+
+// TestDNSConfigValidate tests that invalid resolver options are rejected.
+func TestDNSConfigValidate(t *testing.T) {
+	cfg := &DNSConfig{Nameservers: []string{"10.0.0.2", "[::1]:5353"}}
+	require.NoError(t, cfg.validate())
+	require.Equal(
+		t, []string{"10.0.0.2:53", "[::1]:5353"}, cfg.Nameservers,
+	)
+	require.Equal(t, defaultReresolveInterval, cfg.ReresolveInterval)
+
+	cfgs := []*DNSConfig{
+		{Nameservers: []string{"dns.example.com"}},
+		{DoHURL: "http://dns.example.com/dns-query"},
+		{
+			Nameservers: []string{"10.0.0.2"},
+			DoHURL:      "https://dns.example.com/dns-query",
+		},
+		{MinTTL: time.Hour},
+		{Timeout: -time.Second},
+	}
+	for _, cfg := range cfgs {
+		require.Error(t, cfg.validate())
+	}
+}
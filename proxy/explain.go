@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+)
+
+const (
+	// PriceRuleStatic is the price rule of services that charge the same
+	// price for all resources.
+	PriceRuleStatic = "static"
+
+	// PriceRulePath is the price rule of resources whose path matches one
+	// of the path prices of their service.
+	PriceRulePath = "path"
+
+	// PriceRuleDynamic is the price rule of services whose prices are
+	// looked up with their price server for every challenge.
+	PriceRuleDynamic = "dynamic"
+)
+
+// RouteExplanation describes how the proxy would handle a request, without
+// sending it anywhere. It's meant to debug the regular expressions of the
+// service configurations.
+type RouteExplanation struct {
+	// Host, Path and Method describe the explained request.
+	Host   string `json:"host"`
+	Path   string `json:"path"`
+	Method string `json:"method"`
+
+	// Endpoint is the name of the built-in endpoint of aperture that
+	// answers the request before it's matched against the services, if
+	// any.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Candidates are the services the request was matched against, in
+	// order, up to and including the matching one.
+	Candidates []*ServiceCandidate `json:"candidates,omitempty"`
+
+	// Service is the name of the matching service. If it's empty, the
+	// request is answered by the local services, like the static file
+	// server.
+	Service string `json:"service,omitempty"`
+
+	// Address and Protocol are the backend the request is forwarded to.
+	// The address is empty for services that are served in process.
+	Address  string `json:"address,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+
+	// Maintenance is true if the service is in maintenance mode and all of
+	// its requests are answered with a 503 response.
+	Maintenance bool `json:"maintenance,omitempty"`
+
+	// Auth is the authentication level that applies to the request.
+	Auth string `json:"auth,omitempty"`
+
+	// Authenticators are the authenticators the request is tried with, in
+	// priority order, if it needs authentication.
+	Authenticators []string `json:"authenticators,omitempty"`
+
+	// AuthWhitelistPath is the whitelist entry that turns authentication
+	// off for the request, if any.
+	AuthWhitelistPath string `json:"authwhitelistpath,omitempty"`
+
+	// Price is the price rule that applies to the token of the request,
+	// if it needs one.
+	Price *PriceExplanation `json:"price,omitempty"`
+
+	// Headers are the changes made to the header fields of the request
+	// before it's forwarded.
+	Headers []*HeaderChange `json:"headers,omitempty"`
+}
+
+// ServiceCandidate describes whether a service matches a request.
+type ServiceCandidate struct {
+	Name        string `json:"name"`
+	HostRegexp  string `json:"hostregexp"`
+	HostMatched bool   `json:"hostmatched"`
+	PathRegexp  string `json:"pathregexp,omitempty"`
+	PathMatched bool   `json:"pathmatched"`
+}
+
+// PriceExplanation describes which price rule applies to a resource.
+type PriceExplanation struct {
+	// Rule is one of the PriceRule constants.
+	Rule string `json:"rule"`
+
+	// PathRegexp is the path price that matched for the path rule.
+	PathRegexp string `json:"pathregexp,omitempty"`
+
+	// Price is the price in satoshis, which is only known in advance for
+	// the static and path rules.
+	Price int64 `json:"price,omitempty"`
+
+	// Surge is true if the price is raised with the load of the service.
+	Surge bool `json:"surge,omitempty"`
+}
+
+// HeaderChange describes a change to a header field of a request before it's
+// forwarded to the backend.
+type HeaderChange struct {
+	Name   string `json:"name"`
+	Change string `json:"change"`
+}
+
+// Explain describes how the proxy would handle a request for the given host,
+// path and method: which service it matches, which authentication level and
+// price rule apply and which header fields are changed before it's forwarded.
+// The request isn't authenticated, so the outcome of conditions that depend on
+// the token or the client, like freebies or country rules, isn't included.
+func (p *Proxy) Explain(host, path, method string) *RouteExplanation {
+	if method == "" {
+		method = http.MethodGet
+	}
+	r := &http.Request{
+		Method: method,
+		Host:   host,
+		URL:    &url.URL{Path: path},
+		Header: make(http.Header),
+	}
+
+	explanation := &RouteExplanation{
+		Host:     host,
+		Path:     path,
+		Method:   method,
+		Endpoint: builtinEndpoint(r),
+	}
+	if explanation.Endpoint != "" {
+		return explanation
+	}
+
+	var target *Service
+	for _, service := range p.currentServices() {
+		matchers := service.matchers()
+		candidate := &ServiceCandidate{
+			Name:        service.Name,
+			HostRegexp:  service.HostRegexp,
+			PathRegexp:  service.PathRegexp,
+			HostMatched: matchers.host.MatchString(host),
+		}
+		candidate.PathMatched = candidate.HostMatched &&
+			(matchers.path == nil ||
+				matchers.path.MatchString(path))
+		explanation.Candidates = append(
+			explanation.Candidates, candidate,
+		)
+
+		if candidate.PathMatched {
+			target = service
+			break
+		}
+	}
+	if target == nil {
+		return explanation
+	}
+
+	explanation.Service = target.Name
+	explanation.Protocol = target.Protocol
+	if target.Handler == nil {
+		explanation.Address = target.Address
+	}
+	explanation.Maintenance = p.maintenance(target).Enabled
+
+	for _, entry := range target.AuthWhitelistPaths {
+		if regexp.MustCompile(entry).MatchString(path) {
+			explanation.AuthWhitelistPath = entry
+			break
+		}
+	}
+	authLevel := target.AuthRequired(r)
+	explanation.Auth = string(authLevel)
+	if !authLevel.IsOff() {
+		explanation.Authenticators = target.authenticatorNames()
+		explanation.Price = explainPrice(target, path)
+	}
+
+	explanation.Headers = explainHeaders(target, !authLevel.IsOff())
+	return explanation
+}
+
+// builtinEndpoint returns the name of the built-in endpoint that answers the
+// request before it's matched against the services, in the same order as
+// ServeHTTP checks them.
+func builtinEndpoint(r *http.Request) string {
+	switch {
+	case r.Method == http.MethodOptions:
+		return "cors preflight"
+
+	case isPaywallRequest(r):
+		return "paywall"
+
+	case isLNURLRequest(r):
+		return "lnurl"
+
+	case isTopUpRequest(r):
+		return "topup"
+
+	case isUpgradeRequest(r):
+		return "upgrade"
+
+	case isUsageRequest(r):
+		return "usage"
+
+	case isDelegateRequest(r):
+		return "delegate"
+
+	case isReceiptRequest(r):
+		return "receipt"
+
+	case isProofKeyRequest(r):
+		return "proof key"
+
+	default:
+		return ""
+	}
+}
+
+// explainPrice returns the price rule of the resource at the given path of the
+// service.
+func explainPrice(target *Service, path string) *PriceExplanation {
+	price := &PriceExplanation{
+		Rule:  PriceRuleStatic,
+		Price: target.Price,
+		Surge: target.Surge.Enabled,
+	}
+	if target.DynamicPrice.Enabled {
+		price.Rule = PriceRuleDynamic
+		price.Price = 0
+		return price
+	}
+
+	for _, pathPrice := range target.PathPrices {
+		if regexp.MustCompile(pathPrice.Path).MatchString(path) {
+			price.Rule = PriceRulePath
+			price.PathRegexp = pathPrice.Path
+			price.Price = pathPrice.Price
+			break
+		}
+	}
+
+	return price
+}
+
+// explainHeaders returns the changes the proxy makes to the header fields of
+// the requests of the service before they're forwarded. The values of the
+// configured header fields aren't included since they may hold credentials.
+func explainHeaders(target *Service, authenticated bool) []*HeaderChange {
+	var changes []*HeaderChange
+	if authenticated {
+		changes = append(changes, &HeaderChange{
+			Name:   "Authorization",
+			Change: "normalized to the LSAT scheme",
+		})
+	}
+
+	if target.Identity.Forward && authenticated {
+		for _, name := range identityHeaders {
+			if name == HeaderAmountPaid &&
+				!target.Identity.AmountPaid {
+
+				continue
+			}
+			changes = append(changes, &HeaderChange{
+				Name:   name,
+				Change: "set to the identity of the token",
+			})
+		}
+	}
+
+	names := make([]string, 0, len(target.Headers))
+	for name := range target.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		changes = append(changes, &HeaderChange{
+			Name:   http.CanonicalHeaderKey(name),
+			Change: "added from the configuration",
+		})
+	}
+
+	return changes
+}
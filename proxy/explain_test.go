@@ -0,0 +1,94 @@
+package proxy_test
+
+import (
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/pricer"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestExplain tests that the explanation of a request names the service it
+// matches and the auth level, price rule and header changes that apply.
+func TestExplain(t *testing.T) {
+	services := []*proxy.Service{{
+		Name:       "other",
+		Address:    testTargetServiceAddress,
+		HostRegexp: "^other.example.com$",
+		Protocol:   "http",
+		Auth:       "on",
+	}, {
+		Name:               "api",
+		Address:            testTargetServiceAddress,
+		HostRegexp:         "^api.example.com$",
+		PathRegexp:         "^/v1/.*$",
+		Protocol:           "https",
+		Auth:               "on",
+		Price:              10,
+		AuthWhitelistPaths: []string{"^/v1/status$"},
+		PathPrices: []*pricer.PathPrice{{
+			Path:  "^/v1/premium/.*$",
+			Price: 100,
+		}},
+		Headers: map[string]string{"x-api-key": "secret"},
+		Identity: proxy.IdentityConfig{
+			Forward: true,
+		},
+	}}
+
+	p, err := proxy.New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	// The first matching service is explained with the path price that
+	// applies. Configured header values aren't revealed.
+	explanation := p.Explain("api.example.com", "/v1/premium/x", "")
+	require.Equal(t, "GET", explanation.Method)
+	require.Equal(t, "api", explanation.Service)
+	require.Equal(t, testTargetServiceAddress, explanation.Address)
+	require.Equal(t, "https", explanation.Protocol)
+	require.Equal(t, "on", explanation.Auth)
+	require.Equal(t, &proxy.PriceExplanation{
+		Rule:       proxy.PriceRulePath,
+		PathRegexp: "^/v1/premium/.*$",
+		Price:      100,
+	}, explanation.Price)
+	require.Len(t, explanation.Candidates, 2)
+	require.False(t, explanation.Candidates[0].HostMatched)
+	require.True(t, explanation.Candidates[1].PathMatched)
+
+	var headers []string
+	for _, change := range explanation.Headers {
+		require.NotContains(t, change.Change, "secret")
+		headers = append(headers, change.Name)
+	}
+	require.Equal(t, []string{
+		"Authorization", proxy.HeaderTokenID, proxy.HeaderPaymentHash,
+		proxy.HeaderTokenTier, "X-Api-Key",
+	}, headers)
+
+	// Other resources cost the price of the service.
+	explanation = p.Explain("api.example.com", "/v1/basic", "POST")
+	require.Equal(t, proxy.PriceRuleStatic, explanation.Price.Rule)
+	require.EqualValues(t, 10, explanation.Price.Price)
+
+	// Whitelisted paths need no token.
+	explanation = p.Explain("api.example.com", "/v1/status", "GET")
+	require.Equal(t, "off", explanation.Auth)
+	require.Equal(t, "^/v1/status$", explanation.AuthWhitelistPath)
+	require.Nil(t, explanation.Price)
+	require.Equal(t, []*proxy.HeaderChange{{
+		Name:   "X-Api-Key",
+		Change: "added from the configuration",
+	}}, explanation.Headers)
+
+	// Requests that don't match any service are left to the local
+	// services, built-in endpoints are recognized before matching.
+	explanation = p.Explain("api.example.com", "/other", "GET")
+	require.Empty(t, explanation.Service)
+	require.Len(t, explanation.Candidates, 2)
+
+	explanation = p.Explain("api.example.com", "/v1/x", "OPTIONS")
+	require.Equal(t, "cors preflight", explanation.Endpoint)
+	require.Empty(t, explanation.Candidates)
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// defaultFaultStatus is the status code of injected errors if none is
+	// set.
+	defaultFaultStatus = http.StatusServiceUnavailable
+
+	// faultMessage is the body of the responses of injected errors.
+	faultMessage = "injected fault"
+)
+
+// FaultConfig holds the faults that are injected into the requests of a
+// service, so operators can verify the retry behavior of clients and their own
+// alerting against a staging instance. Faults can only be injected at run time
+// through the admin API.
+type FaultConfig struct {
+	// Delay is the time each request is held before it's handled.
+	Delay time.Duration `json:"delay,omitempty"`
+
+	// ErrorRate is the fraction of requests, between 0 and 1, that are
+	// answered with an error of status ErrorStatus instead of being
+	// handled.
+	ErrorRate float64 `json:"error_rate,omitempty"`
+
+	// ErrorStatus is the HTTP status code of the injected errors, 503 by
+	// default. gRPC clients receive the matching gRPC status.
+	ErrorStatus int `json:"error_status,omitempty"`
+
+	// ResetRate is the fraction of requests, between 0 and 1, whose
+	// connection is reset instead of answering them.
+	ResetRate float64 `json:"reset_rate,omitempty"`
+}
+
+// validate checks the fault options.
+func (c *FaultConfig) validate() error {
+	switch {
+	case c.Delay < 0:
+		return fmt.Errorf("negative delay")
+
+	case c.ErrorRate < 0 || c.ErrorRate > 1:
+		return fmt.Errorf("error rate must be between 0 and 1")
+
+	case c.ResetRate < 0 || c.ResetRate > 1:
+		return fmt.Errorf("reset rate must be between 0 and 1")
+
+	case c.ErrorStatus != 0 && (c.ErrorStatus < 400 || c.ErrorStatus > 599):
+		return fmt.Errorf("error status must be a 4xx or 5xx code")
+	}
+
+	return nil
+}
+
+// SetFaults sets the faults that are injected into the requests of the service
+// with the given name, or stops injecting them if cfg is nil. The faults are
+// kept when the services are updated. False is returned if there is no such
+// service.
+func (p *Proxy) SetFaults(name string, cfg *FaultConfig) (bool, error) {
+	if cfg != nil {
+		if err := cfg.validate(); err != nil {
+			return false, err
+		}
+	}
+
+	if _, ok := p.serviceByName(name); !ok {
+		return false, nil
+	}
+
+	p.faultsMtx.Lock()
+	defer p.faultsMtx.Unlock()
+
+	if cfg == nil {
+		delete(p.faults, name)
+		return true, nil
+	}
+
+	if p.faults == nil {
+		p.faults = make(map[string]*FaultConfig)
+	}
+	p.faults[name] = cfg
+
+	return true, nil
+}
+
+// Faults returns the faults that are injected into the requests of the service
+// with the given name, which are empty if none were set. False is returned if
+// there is no such service.
+func (p *Proxy) Faults(name string) (*FaultConfig, bool) {
+	if _, ok := p.serviceByName(name); !ok {
+		return nil, false
+	}
+
+	p.faultsMtx.RLock()
+	defer p.faultsMtx.RUnlock()
+
+	if cfg, ok := p.faults[name]; ok {
+		return cfg, true
+	}
+
+	return &FaultConfig{}, true
+}
+
+// injectFault injects the faults that were set for the service into the
+// request. False is returned if the request was answered with an error or its
+// connection was reset, and must not be handled any further.
+func (p *Proxy) injectFault(w http.ResponseWriter, r *http.Request,
+	target *Service, prefixLog *PrefixLog) bool {
+
+	p.faultsMtx.RLock()
+	cfg, ok := p.faults[target.Name]
+	p.faultsMtx.RUnlock()
+	if !ok {
+		return true
+	}
+
+	if cfg.Delay > 0 {
+		select {
+		case <-time.After(cfg.Delay):
+		case <-r.Context().Done():
+			return false
+		}
+	}
+
+	// nolint:gosec
+	if cfg.ResetRate > 0 && rand.Float64() < cfg.ResetRate {
+		prefixLog.Infof("Injecting connection reset for service %s.",
+			target.Name)
+		resetConnection(w)
+		return false
+	}
+
+	// nolint:gosec
+	if cfg.ErrorRate > 0 && rand.Float64() < cfg.ErrorRate {
+		prefixLog.Infof("Injecting error for service %s.", target.Name)
+
+		status := cfg.ErrorStatus
+		if status == 0 {
+			status = defaultFaultStatus
+		}
+		addCorsHeaders(w.Header())
+		sendDirectResponse(w, r, status, faultMessage)
+		return false
+	}
+
+	return true
+}
+
+// resetConnection aborts the response. HTTP/1 connections are taken over and
+// closed with a TCP reset if possible, HTTP/2 streams are reset by aborting
+// the handler.
+func resetConnection(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+
+	// Without lingering, closing the connection sends a reset instead of
+	// a graceful shutdown.
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(0)
+	}
+	_ = conn.Close()
+}
@@ -0,0 +1,89 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFaults tests that the faults set for a service are injected into its
+// requests until they're cleared.
+func TestFaults(t *testing.T) {
+	service := testHandlerService(
+		"free-service", "^/free/.*$",
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		},
+	)
+	service.Auth = "off"
+	p, err := proxy.New(auth.NewMockAuthenticator(), []*proxy.Service{
+		service,
+	})
+	require.NoError(t, err)
+
+	// Connection resets need a real connection, so the requests are sent
+	// to a server.
+
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+
+	get := func() (*http.Response, error) {
+		resp, err := http.Get(server.URL + "/free/x")
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	// Invalid faults and unknown services are rejected.
+	_, err = p.SetFaults("free-service", &proxy.FaultConfig{ErrorRate: 2})
+	require.Error(t, err)
+	ok, err := p.SetFaults("unknown", &proxy.FaultConfig{})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Requests are delayed.
+	ok, err = p.SetFaults("free-service", &proxy.FaultConfig{
+		Delay: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+	start := time.Now()
+	resp, err := get()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.GreaterOrEqual(t, int64(time.Since(start)),
+		int64(100*time.Millisecond))
+
+	// Requests are answered with the injected error.
+	_, err = p.SetFaults("free-service", &proxy.FaultConfig{
+		ErrorRate:   1,
+		ErrorStatus: http.StatusBadGateway,
+	})
+	require.NoError(t, err)
+	resp, err = get()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	// Connections are reset.
+	_, err = p.SetFaults("free-service", &proxy.FaultConfig{ResetRate: 1})
+	require.NoError(t, err)
+	_, err = get()
+	require.Error(t, err)
+
+	// Requests are handled normally once the faults are cleared.
+	ok, err = p.SetFaults("free-service", nil)
+	require.NoError(t, err)
+	require.True(t, ok)
+	cfg, ok := p.Faults("free-service")
+	require.True(t, ok)
+	require.Equal(t, &proxy.FaultConfig{}, cfg)
+	resp, err = get()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// FilterConfig holds the rules requests to a service are filtered with before
+// they are authenticated and forwarded. They are meant to reject obviously
+// malicious requests early, not to replace the input validation of the
+// backend.
+type FilterConfig struct {
+	// DenyPaths is a list of regular expressions. Requests whose path
+	// matches any of them are rejected.
+	DenyPaths []string `long:"denypaths" description:"Reject requests whose path matches any of these regular expressions"`
+
+	// DenyQueries is a list of regular expressions. Requests whose query
+	// string matches any of them, either in its raw or its decoded form,
+	// are rejected.
+	DenyQueries []string `long:"denyqueries" description:"Reject requests whose raw or decoded query string matches any of these regular expressions"`
+
+	// DenyHeaders maps header names to regular expressions. Requests with
+	// a value of the header that matches the expression are rejected.
+	DenyHeaders map[string]string `long:"denyheaders" description:"Reject requests with a header value that matches the regular expression of the header name"`
+
+	// MaxBodySize is the maximum size of a request body in bytes. Zero
+	// means no limit.
+	MaxBodySize int64 `long:"maxbodysize" description:"The maximum size of a request body in bytes (0 for no limit)"`
+
+	// ContentTypes is the list of media types a request body may have. If
+	// it's empty, all types are allowed.
+	ContentTypes []string `long:"contenttypes" description:"The media types allowed for request bodies, all are allowed if empty"`
+
+	// BlockTraversal can be set to reject requests whose path contains
+	// dot segments, encoded dots or slashes or backslashes, which are
+	// used to escape the directory a backend serves files from.
+	BlockTraversal bool `long:"blocktraversal" description:"Reject requests with path traversal sequences"`
+}
+
+// requestFilter is the compiled form of a FilterConfig.
+type requestFilter struct {
+	denyPaths      []*regexp.Regexp
+	denyQueries    []*regexp.Regexp
+	denyHeaders    map[string]*regexp.Regexp
+	maxBodySize    int64
+	contentTypes   map[string]struct{}
+	blockTraversal bool
+}
+
+// newRequestFilter compiles the rules of a filter configuration. If the
+// configuration doesn't contain any rules, nil is returned.
+func newRequestFilter(cfg *FilterConfig) (*requestFilter, error) {
+	if len(cfg.DenyPaths) == 0 && len(cfg.DenyQueries) == 0 &&
+		len(cfg.DenyHeaders) == 0 && cfg.MaxBodySize == 0 &&
+		len(cfg.ContentTypes) == 0 && !cfg.BlockTraversal {
+
+		return nil, nil
+	}
+
+	if cfg.MaxBodySize < 0 {
+		return nil, fmt.Errorf("negative maximum body size")
+	}
+
+	f := &requestFilter{
+		denyHeaders:    make(map[string]*regexp.Regexp),
+		maxBodySize:    cfg.MaxBodySize,
+		contentTypes:   make(map[string]struct{}),
+		blockTraversal: cfg.BlockTraversal,
+	}
+
+	var err error
+	f.denyPaths, err = compileAll(cfg.DenyPaths)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path rule: %v", err)
+	}
+	f.denyQueries, err = compileAll(cfg.DenyQueries)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query rule: %v", err)
+	}
+	for name, expr := range cfg.DenyHeaders {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid header rule for %s: %v",
+				name, err)
+		}
+		f.denyHeaders[http.CanonicalHeaderKey(name)] = re
+	}
+	for _, contentType := range cfg.ContentTypes {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content type %s: %v",
+				contentType, err)
+		}
+		f.contentTypes[mediaType] = struct{}{}
+	}
+
+	return f, nil
+}
+
+// compileAll compiles a list of regular expressions.
+func compileAll(exprs []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// check returns the status code and reason to reject the request with, or zero
+// if the request passes all rules. If the body size is limited, the body of the
+// request is replaced by one that fails once the limit is exceeded, so bodies
+// without a length are limited as well.
+func (f *requestFilter) check(w http.ResponseWriter, r *http.Request) (int,
+	string) {
+
+	if f.blockTraversal && isTraversal(r) {
+		return http.StatusBadRequest, "path traversal"
+	}
+
+	for _, re := range f.denyPaths {
+		if re.MatchString(r.URL.Path) {
+			return http.StatusForbidden, "path denied"
+		}
+	}
+	if len(f.denyQueries) > 0 {
+		decoded, err := url.QueryUnescape(r.URL.RawQuery)
+		if err != nil {
+			decoded = r.URL.RawQuery
+		}
+		for _, re := range f.denyQueries {
+			if re.MatchString(r.URL.RawQuery) ||
+				re.MatchString(decoded) {
+
+				return http.StatusForbidden, "query denied"
+			}
+		}
+	}
+	for name, re := range f.denyHeaders {
+		for _, value := range r.Header.Values(name) {
+			if re.MatchString(value) {
+				return http.StatusForbidden, "header denied"
+			}
+		}
+	}
+
+	if f.maxBodySize > 0 {
+		if r.ContentLength > f.maxBodySize {
+			return http.StatusRequestEntityTooLarge,
+				"request body too large"
+		}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, f.maxBodySize)
+		}
+	}
+
+	// Only requests that actually have a body need an allowed content
+	// type.
+	hasBody := r.ContentLength > 0 || len(r.TransferEncoding) > 0
+	if len(f.contentTypes) > 0 && hasBody {
+		mediaType, _, err := mime.ParseMediaType(
+			r.Header.Get(hdrContentType),
+		)
+		if err != nil {
+			return http.StatusUnsupportedMediaType,
+				"invalid content type"
+		}
+		if _, ok := f.contentTypes[mediaType]; !ok {
+			return http.StatusUnsupportedMediaType,
+				"content type not allowed"
+		}
+	}
+
+	return 0, ""
+}
+
+// isTraversal returns true if the path of the request contains a sequence that
+// is commonly used for path traversal.
+func isTraversal(r *http.Request) bool {
+	for _, segment := range strings.Split(r.URL.Path, "/") {
+		if segment == ".." || segment == "." {
+			return true
+		}
+	}
+
+	// Encoded dots, slashes and backslashes are already decoded in the
+	// path, so they can only be found in its escaped form.
+	escaped := strings.ToLower(r.URL.EscapedPath())
+	return strings.Contains(r.URL.Path, "\\") ||
+		strings.Contains(escaped, "%2e") ||
+		strings.Contains(escaped, "%2f") ||
+		strings.Contains(escaped, "%5c") ||
+		strings.Contains(r.URL.Path, "\x00")
+}
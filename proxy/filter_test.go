@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRequestFilter tests that requests are rejected by the rules of a filter.
+func TestRequestFilter(t *testing.T) {
+	filter, err := newRequestFilter(&FilterConfig{
+		DenyPaths:      []string{`\.php$`},
+		DenyQueries:    []string{`(?i)union\s+select`},
+		DenyHeaders:    map[string]string{"user-agent": "sqlmap"},
+		MaxBodySize:    16,
+		ContentTypes:   []string{"application/json", "application/grpc"},
+		BlockTraversal: true,
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name        string
+		method      string
+		target      string
+		body        string
+		contentType string
+		userAgent   string
+		status      int
+	}{{
+		name:   "plain request",
+		method: "GET",
+		target: "/api/v1/items?id=1",
+	}, {
+		name:   "dot segment",
+		method: "GET",
+		target: "/static/../../etc/passwd",
+		status: http.StatusBadRequest,
+	}, {
+		name:   "encoded dots",
+		method: "GET",
+		target: "/static/%2e%2e/etc/passwd",
+		status: http.StatusBadRequest,
+	}, {
+		name:   "encoded slash",
+		method: "GET",
+		target: "/static/..%2Fetc%2Fpasswd",
+		status: http.StatusBadRequest,
+	}, {
+		name:   "denied path",
+		method: "GET",
+		target: "/wp-login.php",
+		status: http.StatusForbidden,
+	}, {
+		name:   "denied query",
+		method: "GET",
+		target: "/api?id=1%20UNION%20SELECT%20password",
+		status: http.StatusForbidden,
+	}, {
+		name:      "denied header",
+		method:    "GET",
+		target:    "/api",
+		userAgent: "sqlmap/1.4",
+		status:    http.StatusForbidden,
+	}, {
+		name:        "allowed body",
+		method:      "POST",
+		target:      "/api",
+		body:        `{"id": 1}`,
+		contentType: "application/json; charset=utf-8",
+	}, {
+		name:        "body too large",
+		method:      "POST",
+		target:      "/api",
+		body:        `{"id": 1, "name": "too long"}`,
+		contentType: "application/json",
+		status:      http.StatusRequestEntityTooLarge,
+	}, {
+		name:        "disallowed content type",
+		method:      "POST",
+		target:      "/api",
+		body:        "<xml/>",
+		contentType: "application/xml",
+		status:      http.StatusUnsupportedMediaType,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(
+				tc.method, tc.target, strings.NewReader(tc.body),
+			)
+			if tc.contentType != "" {
+				req.Header.Set(hdrContentType, tc.contentType)
+			}
+			if tc.userAgent != "" {
+				req.Header.Set("User-Agent", tc.userAgent)
+			}
+
+			status, _ := filter.check(httptest.NewRecorder(), req)
+			require.Equal(t, tc.status, status)
+		})
+	}
+
+	// Bodies without a length are cut off at the maximum size while they
+	// are read.
+	req := httptest.NewRequest("POST", "/api", nil)
+	req.Body = ioutil.NopCloser(strings.NewReader(strings.Repeat("a", 32)))
+	req.ContentLength = -1
+	req.Header.Set(hdrContentType, "application/json")
+	status, _ := filter.check(httptest.NewRecorder(), req)
+	require.Zero(t, status)
+
+	_, err = ioutil.ReadAll(req.Body)
+	require.Error(t, err)
+
+	// A configuration without rules doesn't need a filter.
+	filter, err = newRequestFilter(&FilterConfig{})
+	require.NoError(t, err)
+	require.Nil(t, filter)
+}
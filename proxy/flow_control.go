@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"fmt"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	// minWindowSize is the smallest flow control window HTTP/2 allows, see
+	// RFC 7540 section 6.9.2.
+	minWindowSize = 65535
+)
+
+// HTTP2Config holds the HTTP/2 flow control options of a service. Large
+// streaming calls are throttled by small flow control windows because the
+// sender has to wait for the receiver to acknowledge each window of data.
+type HTTP2Config struct {
+	// InitialWindowSize is the size in bytes of the flow control window
+	// of each stream. Zero keeps the default.
+	InitialWindowSize int32 `long:"initialwindowsize" description:"The size in bytes of the HTTP/2 flow control window of each stream, 0 for the default"`
+
+	// InitialConnWindowSize is the size in bytes of the flow control
+	// window of each connection, which is shared by all streams of the
+	// connection. Zero keeps the default.
+	InitialConnWindowSize int32 `long:"initialconnwindowsize" description:"The size in bytes of the HTTP/2 flow control window of each connection, 0 for the default"`
+}
+
+// validate makes sure the configured windows are valid HTTP/2 window sizes.
+func (c *HTTP2Config) validate() error {
+	if c.InitialWindowSize != 0 && c.InitialWindowSize < minWindowSize {
+		return fmt.Errorf("initial window size must be at least %d",
+			minWindowSize)
+	}
+	if c.InitialConnWindowSize != 0 &&
+		c.InitialConnWindowSize < minWindowSize {
+
+		return fmt.Errorf("initial connection window size must be at "+
+			"least %d", minWindowSize)
+	}
+
+	return nil
+}
+
+// NewHTTP2Server creates the HTTP/2 server options for the connections of
+// clients. The windows of a connection are negotiated before the service of
+// its requests is known, so the largest windows of all services are used for
+// the data clients send. The service configurations must be validated.
+func NewHTTP2Server(services []*Service) *http2.Server {
+	server := &http2.Server{}
+	for _, service := range services {
+		cfg := service.HTTP2
+		if cfg.InitialWindowSize > server.MaxUploadBufferPerStream {
+			server.MaxUploadBufferPerStream = cfg.InitialWindowSize
+		}
+		if cfg.InitialConnWindowSize >
+			server.MaxUploadBufferPerConnection {
+
+			server.MaxUploadBufferPerConnection =
+				cfg.InitialConnWindowSize
+		}
+	}
+
+	return server
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestNewHTTP2Server tests that the largest windows of all services are used
+// for client connections and that invalid windows are rejected.
+func TestNewHTTP2Server(t *testing.T) {
+	invalid := &HTTP2Config{InitialWindowSize: 1024}
+	require.Error(t, invalid.validate())
+
+	invalid = &HTTP2Config{InitialConnWindowSize: minWindowSize - 1}
+	require.Error(t, invalid.validate())
+
+	services := []*Service{{
+		HTTP2: HTTP2Config{InitialWindowSize: 1 << 22},
+	}, {
+		HTTP2: HTTP2Config{
+			InitialWindowSize:     1 << 20,
+			InitialConnWindowSize: 1 << 24,
+		},
+	}, {}}
+	for _, service := range services {
+		require.NoError(t, service.HTTP2.validate())
+	}
+
+	server := NewHTTP2Server(services)
+	require.EqualValues(t, 1<<22, server.MaxUploadBufferPerStream)
+	require.EqualValues(t, 1<<24, server.MaxUploadBufferPerConnection)
+
+	server = NewHTTP2Server(nil)
+	require.Zero(t, server.MaxUploadBufferPerStream)
+	require.Zero(t, server.MaxUploadBufferPerConnection)
+}
@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	hdrTypeGrpcWeb     = "application/grpc-web"
+	hdrTypeGrpcWebText = "application/grpc-web-text"
+	hdrTrailer         = "Trailer"
+	hdrContentLength   = "Content-Length"
+
+	// grpcWebTrailerFlag is the flag byte that marks a gRPC-Web frame as
+	// containing the trailer fields instead of a message.
+	grpcWebTrailerFlag = 0x80
+)
+
+// isGRPCWebRequest returns true if the request was sent by a gRPC-Web client,
+// either in binary or in base64 text mode.
+func isGRPCWebRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get(hdrContentType), hdrTypeGrpcWeb)
+}
+
+// isGRPCWebTextRequest returns true if the request was sent by a gRPC-Web
+// client in base64 text mode.
+func isGRPCWebTextRequest(r *http.Request) bool {
+	return strings.HasPrefix(
+		r.Header.Get(hdrContentType), hdrTypeGrpcWebText,
+	)
+}
+
+// translateGRPCWebRequest rewrites a gRPC-Web request in place so it can be
+// forwarded to a native gRPC backend. The message framing is the same for both
+// protocols, so only the header fields need to be changed and, in text mode,
+// the body has to be base64 decoded.
+func translateGRPCWebRequest(r *http.Request) {
+	contentType := r.Header.Get(hdrContentType)
+	isText := isGRPCWebTextRequest(r)
+
+	// Keep the message encoding suffix (for example "+proto") of the
+	// content type.
+	suffix := strings.TrimPrefix(contentType, hdrTypeGrpcWeb)
+	if isText {
+		suffix = strings.TrimPrefix(contentType, hdrTypeGrpcWebText)
+	}
+	r.Header.Set(hdrContentType, hdrTypeGrpc+suffix)
+
+	// Native gRPC requires the client to signal that it can handle
+	// trailers. The gRPC-Web specific header fields are of no use to the
+	// backend.
+	r.Header.Set("Te", "trailers")
+	r.Header.Del("X-Grpc-Web")
+	r.Header.Del("X-User-Agent")
+
+	if isText {
+		// The decoded length isn't known in advance.
+		r.Header.Del(hdrContentLength)
+		r.ContentLength = -1
+		r.Body = &readCloser{
+			Reader: &base64QuantumReader{r: r.Body},
+			Closer: r.Body,
+		}
+	}
+}
+
+// grpcWebResponseWriter is a http.ResponseWriter that translates the response
+// of a native gRPC backend into a gRPC-Web response. Because browsers can't
+// access HTTP/2 trailers, gRPC-Web moves them into a special frame at the end
+// of the response body.
+type grpcWebResponseWriter struct {
+	http.ResponseWriter
+
+	contentType  string
+	isText       bool
+	wroteHeader  bool
+	trailerNames []string
+}
+
+// newGRPCWebResponseWriter creates a new response writer that translates the
+// native gRPC response to the given gRPC-Web request. This must be called
+// before the request itself is translated.
+func newGRPCWebResponseWriter(w http.ResponseWriter,
+	r *http.Request) *grpcWebResponseWriter {
+
+	return &grpcWebResponseWriter{
+		ResponseWriter: w,
+		contentType:    r.Header.Get(hdrContentType),
+		isText:         isGRPCWebTextRequest(r),
+	}
+}
+
+// WriteHeader rewrites the response header fields to the gRPC-Web format and
+// remembers which trailers were announced by the backend.
+func (g *grpcWebResponseWriter) WriteHeader(statusCode int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+
+	header := g.Header()
+	for _, names := range header.Values(hdrTrailer) {
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				g.trailerNames = append(g.trailerNames, name)
+			}
+		}
+	}
+	header.Del(hdrTrailer)
+	header.Del(hdrContentLength)
+	header.Set(hdrContentType, g.contentType)
+
+	g.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write writes a chunk of the response body, encoding it in base64 if the
+// client requested text mode.
+func (g *grpcWebResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+
+	if !g.isText {
+		return g.ResponseWriter.Write(b)
+	}
+
+	// Each chunk is encoded separately, including the padding. gRPC-Web
+	// clients decode the body in blocks of four characters so this is
+	// fine to do.
+	encoded := base64.StdEncoding.EncodeToString(b)
+	if _, err := io.WriteString(g.ResponseWriter, encoded); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush sends any buffered data to the client.
+func (g *grpcWebResponseWriter) Flush() {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+
+	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish writes the trailers that were set by the backend as the final frame
+// of the gRPC-Web response body.
+func (g *grpcWebResponseWriter) finish() error {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+
+	// The reverse proxy copies announced trailers into the header map
+	// after the body was written. Trailers that weren't announced are
+	// prefixed with http.TrailerPrefix.
+	header := g.Header()
+	trailers := make(http.Header)
+	for _, name := range g.trailerNames {
+		if values := header.Values(name); len(values) > 0 {
+			trailers[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	for name, values := range header {
+		if !strings.HasPrefix(name, http.TrailerPrefix) {
+			continue
+		}
+		name = strings.TrimPrefix(name, http.TrailerPrefix)
+		trailers[http.CanonicalHeaderKey(name)] = values
+	}
+
+	if len(trailers) == 0 {
+		return nil
+	}
+
+	var payload bytes.Buffer
+	for name, values := range trailers {
+		for _, value := range values {
+			_, _ = fmt.Fprintf(
+				&payload, "%s: %s\r\n", strings.ToLower(name),
+				value,
+			)
+		}
+	}
+
+	frame := make([]byte, 5, 5+payload.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(payload.Len()))
+	frame = append(frame, payload.Bytes()...)
+
+	if _, err := g.Write(frame); err != nil {
+		return err
+	}
+	g.Flush()
+
+	return nil
+}
+
+// readCloser combines a reader with the closer of another stream.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// base64QuantumReader decodes a base64 stream that might contain padding
+// characters in the middle, as is the case if a gRPC-Web text client encodes
+// each message separately. Each quantum of four characters is decoded on its
+// own.
+type base64QuantumReader struct {
+	r       io.Reader
+	buf     [4]byte
+	bufLen  int
+	decoded []byte
+	err     error
+}
+
+// Read reads decoded bytes from the underlying base64 stream.
+func (b *base64QuantumReader) Read(p []byte) (int, error) {
+	for len(b.decoded) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+
+		n, err := b.r.Read(b.buf[b.bufLen:])
+		b.bufLen += n
+		if b.bufLen == len(b.buf) {
+			decoded, decodeErr := base64.StdEncoding.DecodeString(
+				string(b.buf[:]),
+			)
+			if decodeErr != nil {
+				return 0, decodeErr
+			}
+			b.decoded = decoded
+			b.bufLen = 0
+		}
+
+		switch {
+		case err == io.EOF && b.bufLen != 0:
+			b.err = io.ErrUnexpectedEOF
+
+		case err != nil:
+			b.err = err
+		}
+	}
+
+	n := copy(p, b.decoded)
+	b.decoded = b.decoded[n:]
+	return n, nil
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestTranslateGRPCWebRequest tests that gRPC-Web requests in both binary and
+// text mode are properly translated into native gRPC requests.
+func TestTranslateGRPCWebRequest(t *testing.T) {
+	frame1 := []byte{0, 0, 0, 0, 2, 'h', 'i'}
+	frame2 := []byte{0, 0, 0, 0, 1, '!'}
+
+	// A text mode client might encode each message on its own, which
+	// results in padding characters in the middle of the body.
+	body := base64.StdEncoding.EncodeToString(frame1) +
+		base64.StdEncoding.EncodeToString(frame2)
+	req := httptest.NewRequest("POST", "/pkg.Svc/Method", bytes.NewReader(
+		[]byte(body),
+	))
+	req.Header.Set(hdrContentType, "application/grpc-web-text+proto")
+	req.Header.Set("X-Grpc-Web", "1")
+	require.True(t, isGRPCWebRequest(req))
+	require.True(t, isGRPCWebTextRequest(req))
+
+	translateGRPCWebRequest(req)
+	require.Equal(t, "application/grpc+proto", req.Header.Get(hdrContentType))
+	require.Equal(t, "trailers", req.Header.Get("Te"))
+	require.Empty(t, req.Header.Get("X-Grpc-Web"))
+	require.EqualValues(t, -1, req.ContentLength)
+
+	decoded, err := ioutil.ReadAll(req.Body)
+	require.NoError(t, err)
+	require.Equal(t, append(frame1, frame2...), decoded)
+
+	// A binary request only needs its header fields changed.
+	req = httptest.NewRequest("POST", "/pkg.Svc/Method", bytes.NewReader(
+		frame1,
+	))
+	req.Header.Set(hdrContentType, "application/grpc-web")
+	require.False(t, isGRPCWebTextRequest(req))
+
+	translateGRPCWebRequest(req)
+	require.Equal(t, "application/grpc", req.Header.Get(hdrContentType))
+
+	decoded, err = ioutil.ReadAll(req.Body)
+	require.NoError(t, err)
+	require.Equal(t, frame1, decoded)
+}
+
+// TestGRPCWebResponseWriter tests that the trailers of a native gRPC response
+// are appended to the body as a gRPC-Web trailer frame.
+func TestGRPCWebResponseWriter(t *testing.T) {
+	msgFrame := []byte{0, 0, 0, 0, 2, 'h', 'i'}
+	trailers := []byte("grpc-status: 0\r\n")
+	trailerFrame := append(
+		[]byte{grpcWebTrailerFlag, 0, 0, 0, byte(len(trailers))},
+		trailers...,
+	)
+
+	testCases := []struct {
+		name         string
+		contentType  string
+		expectedBody []byte
+	}{{
+		name:         "binary",
+		contentType:  "application/grpc-web+proto",
+		expectedBody: append(append([]byte{}, msgFrame...), trailerFrame...),
+	}, {
+		name:        "text",
+		contentType: "application/grpc-web-text+proto",
+		expectedBody: []byte(
+			base64.StdEncoding.EncodeToString(msgFrame) +
+				base64.StdEncoding.EncodeToString(trailerFrame),
+		),
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/pkg.Svc/Method", nil)
+			req.Header.Set(hdrContentType, tc.contentType)
+
+			rec := httptest.NewRecorder()
+			w := newGRPCWebResponseWriter(rec, req)
+
+			// Simulate what the reverse proxy does with a native
+			// gRPC response: announce the trailers, write the
+			// body and then set the trailer values.
+			w.Header().Set(hdrContentType, "application/grpc")
+			w.Header().Set(hdrTrailer, hdrGrpcStatus)
+			w.WriteHeader(http.StatusOK)
+			_, err := w.Write(msgFrame)
+			require.NoError(t, err)
+			w.Header().Set(hdrGrpcStatus, "0")
+
+			require.NoError(t, w.finish())
+			require.Equal(t, http.StatusOK, rec.Code)
+			require.Equal(
+				t, tc.contentType, rec.Header().Get(
+					hdrContentType,
+				),
+			)
+			require.Empty(t, rec.Header().Get(hdrTrailer))
+			require.Equal(t, tc.expectedBody, rec.Body.Bytes())
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+const (
+	// HeaderPaymentHash is the header field the payment hash of the token
+	// a request was paid with is forwarded to the backend in.
+	HeaderPaymentHash = "X-Aperture-Payment-Hash"
+
+	// HeaderAmountPaid is the header field the amount in satoshis that was
+	// paid for the token of a request is forwarded to the backend in.
+	HeaderAmountPaid = "X-Aperture-Amount-Paid"
+
+	// HeaderTokenTier is the header field the tier of the service the
+	// token of a request grants is forwarded to the backend in.
+	HeaderTokenTier = "X-Aperture-Token-Tier"
+
+	// maxCachedAmounts is the maximum number of paid amounts that are
+	// kept in memory. Once it's reached, the cache starts over.
+	maxCachedAmounts = 10000
+)
+
+var (
+	// identityHeaders are the header fields the identity of the paying
+	// token is forwarded to the backend in.
+	identityHeaders = []string{
+		HeaderTokenID, HeaderPaymentHash, HeaderAmountPaid,
+		HeaderTokenTier,
+	}
+)
+
+// IdentityConfig holds the options to tell the backend of a service which
+// token paid for a request, so it can do its own logging, quotas or
+// personalization per customer.
+type IdentityConfig struct {
+	// Forward can be set to add the token ID, payment hash and tier of the
+	// token a request was made with to the request as header fields, or
+	// gRPC metadata, before it is forwarded. Header fields of the same
+	// names sent by the client are then removed.
+	Forward bool `long:"forward" description:"Forward the token ID, payment hash and tier of the paying token to the backend"`
+
+	// AmountPaid can be set to also forward the amount that was paid for
+	// the token. This requires looking up the invoice of the token once.
+	AmountPaid bool `long:"amountpaid" description:"Also forward the amount paid for the token, which is looked up in lnd"`
+}
+
+// amountCache keeps the amounts that were paid for tokens, so their invoices
+// only need to be looked up once.
+type amountCache struct {
+	sync.Mutex
+	amounts map[lntypes.Hash]int64
+}
+
+// get returns the cached amount paid for the invoice with the given hash.
+func (c *amountCache) get(hash lntypes.Hash) (int64, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	amount, ok := c.amounts[hash]
+	return amount, ok
+}
+
+// put adds the amount paid for the invoice with the given hash to the cache.
+func (c *amountCache) put(hash lntypes.Hash, amount int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.amounts == nil || len(c.amounts) >= maxCachedAmounts {
+		c.amounts = make(map[lntypes.Hash]int64)
+	}
+	c.amounts[hash] = amount
+}
+
+// forwardIdentity removes the identity header fields the client sent, also in
+// the form of transcoded gRPC metadata, and, if the request was authenticated,
+// replaces them with the identity of the token it was made with.
+func (p *Proxy) forwardIdentity(r *http.Request, target *Service,
+	authenticated bool, prefixLog *PrefixLog) {
+
+	stripIdentity(r)
+	if !authenticated {
+		return
+	}
+
+	mac, _, err := lsat.FromHeader(&r.Header)
+	if err != nil {
+		return
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		prefixLog.Errorf("Error decoding token for identity: %v", err)
+		return
+	}
+
+	if value, ok := lsat.HasCaveat(mac, lsat.CondServices); ok {
+		services, err := lsat.DecodeServicesCaveat(lsat.Caveat{
+			Condition: lsat.CondServices,
+			Value:     value,
+		})
+		if err != nil {
+			prefixLog.Errorf("Error decoding services: %v", err)
+		}
+		for _, service := range services {
+			if service.Name != target.Name {
+				continue
+			}
+			r.Header.Set(
+				HeaderTokenTier,
+				strconv.Itoa(int(service.Tier)),
+			)
+		}
+	}
+
+	p.forwardTokenIdentity(r, target, id, prefixLog)
+}
+
+// stripIdentity removes the identity header fields the client sent, also in
+// the form of transcoded gRPC metadata, so it can't pose as another token.
+func stripIdentity(r *http.Request) {
+	for _, name := range identityHeaders {
+		r.Header.Del(name)
+		r.Header.Del(grpcMetadataHeaderPrefix + name)
+	}
+}
+
+// forwardTokenIdentity adds the ID and payment hash of the token with the
+// given identifier to the request and, if the service asks for it, the amount
+// that was paid for it.
+func (p *Proxy) forwardTokenIdentity(r *http.Request, target *Service,
+	id *lsat.Identifier, prefixLog *PrefixLog) {
+
+	r.Header.Set(HeaderTokenID, id.TokenID.String())
+	r.Header.Set(HeaderPaymentHash, id.PaymentHash.String())
+
+	if !target.Identity.AmountPaid || p.paymentFetcher == nil {
+		return
+	}
+	amount, ok := p.amounts.get(id.PaymentHash)
+	if !ok {
+		invoice, err := p.paymentFetcher.FetchInvoice(
+			r.Context(), id.PaymentHash,
+		)
+		if err != nil {
+			prefixLog.Errorf("Error looking up amount paid: %v",
+				err)
+			return
+		}
+		amount = invoice.AmtPaidSat
+		p.amounts.put(id.PaymentHash, amount)
+	}
+	r.Header.Set(HeaderAmountPaid, strconv.FormatInt(amount, 10))
+}
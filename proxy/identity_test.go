@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+// TestForwardIdentity tests that the identity of the paying token replaces the
+// identity header fields sent by the client.
+func TestForwardIdentity(t *testing.T) {
+	id := &lsat.Identifier{
+		Version:     lsat.LatestVersion,
+		PaymentHash: lntypes.Hash{1},
+		TokenID:     lsat.TokenID{2},
+	}
+	var idBytes bytes.Buffer
+	require.NoError(t, lsat.EncodeIdentifier(&idBytes, id))
+	mac, err := macaroon.New(
+		[]byte("key"), idBytes.Bytes(), "lsat", macaroon.LatestVersion,
+	)
+	require.NoError(t, err)
+	servicesCaveat, err := lsat.NewServicesCaveat(
+		lsat.Service{Name: "other", Tier: 2},
+		lsat.Service{Name: "test", Tier: 1},
+	)
+	require.NoError(t, err)
+	require.NoError(t, lsat.AddFirstPartyCaveats(mac, servicesCaveat))
+
+	fetcher := &mockInvoiceFetcher{
+		invoices: map[lntypes.Hash]*lnrpc.Invoice{
+			id.PaymentHash: {AmtPaidSat: 1000},
+		},
+	}
+	p := &Proxy{paymentFetcher: fetcher}
+	target := &Service{
+		Name:     "test",
+		Identity: IdentityConfig{Forward: true, AmountPaid: true},
+	}
+	_, prefixLog := NewRemoteIPPrefixLog(log, "192.0.2.1:1234")
+
+	newReq := func() *http.Request {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set(HeaderTokenID, "spoofed")
+		req.Header.Set(
+			grpcMetadataHeaderPrefix+HeaderAmountPaid, "spoofed",
+		)
+		require.NoError(t, lsat.SetHeader(
+			&req.Header, mac, lntypes.Preimage{},
+		))
+		return req
+	}
+
+	// Without authentication, only the fields of the client are removed.
+	req := newReq()
+	p.forwardIdentity(req, target, false, prefixLog)
+	for _, name := range identityHeaders {
+		require.Empty(t, req.Header.Get(name))
+		require.Empty(t, req.Header.Get(grpcMetadataHeaderPrefix+name))
+	}
+
+	// The amount paid is only looked up once, after that it's taken from
+	// the cache.
+	for i := 0; i < 2; i++ {
+		req = newReq()
+		p.forwardIdentity(req, target, true, prefixLog)
+		require.Equal(
+			t, id.TokenID.String(), req.Header.Get(HeaderTokenID),
+		)
+		require.Equal(
+			t, id.PaymentHash.String(),
+			req.Header.Get(HeaderPaymentHash),
+		)
+		require.Equal(t, "1", req.Header.Get(HeaderTokenTier))
+		require.Equal(t, "1000", req.Header.Get(HeaderAmountPaid))
+		require.Empty(
+			t, req.Header.Get(
+				grpcMetadataHeaderPrefix+HeaderAmountPaid,
+			),
+		)
+
+		delete(fetcher.invoices, id.PaymentHash)
+	}
+}
@@ -0,0 +1,81 @@
+package interoptest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	proxytest "github.com/lightninglabs/aperture/proxy/testdata"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+var (
+	// ErrBackend is the error the greeter returns if a request asks for
+	// one.
+	ErrBackend = errors.New("this is the error you wanted")
+)
+
+// GreeterServer is a simple implementation of the greeter gRPC service that
+// aperture's own tests run against.
+type GreeterServer struct{}
+
+// A compile-time check to make sure GreeterServer implements the greeter
+// service.
+var _ proxytest.GreeterServer = (*GreeterServer)(nil)
+
+// SayHello returns a greeting that contains the name of the request, or
+// ErrBackend if the request asks for an error.
+//
+// NOTE: This is part of the proxytest.GreeterServer interface.
+func (s *GreeterServer) SayHello(_ context.Context,
+	req *proxytest.HelloRequest) (*proxytest.HelloReply, error) {
+
+	if req.ReturnError {
+		return nil, ErrBackend
+	}
+
+	return &proxytest.HelloReply{
+		Message: fmt.Sprintf("Hello %s", req.Name),
+	}, nil
+}
+
+// SayHelloNoAuth behaves like SayHello. It's meant to be whitelisted so it can
+// be called without authentication.
+//
+// NOTE: This is part of the proxytest.GreeterServer interface.
+func (s *GreeterServer) SayHelloNoAuth(ctx context.Context,
+	req *proxytest.HelloRequest) (*proxytest.HelloReply, error) {
+
+	return s.SayHello(ctx, req)
+}
+
+// StartGRPCBackend starts a gRPC server with the greeter service on a random
+// local port and returns its address. The server speaks plain text HTTP/2
+// (h2c), so the proxy reaches it through a service with the http protocol. It
+// is stopped once the test is done.
+func StartGRPCBackend(t *testing.T, opts ...grpc.ServerOption) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := grpc.NewServer(opts...)
+	proxytest.RegisterGreeterServer(server, &GreeterServer{})
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	return listener.Addr().String()
+}
+
+// StartHTTPBackend starts an HTTP server with the given handler on a random
+// local port and returns its address. The server accepts HTTP/1.1 and h2c
+// requests. It is stopped once the test is done.
+func StartHTTPBackend(t *testing.T, handler http.Handler) string {
+	server := httptest.NewServer(NewH2CHandler(handler))
+	t.Cleanup(server.Close)
+
+	return server.Listener.Addr().String()
+}
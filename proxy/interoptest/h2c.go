@@ -0,0 +1,46 @@
+package interoptest
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+)
+
+// NewH2CHandler wraps the given handler so it also serves HTTP/2 requests over
+// plain text connections with prior knowledge (h2c), like gRPC clients send
+// them without TLS.
+func NewH2CHandler(handler http.Handler) http.Handler {
+	return h2c.NewHandler(handler, &http2.Server{})
+}
+
+// NewH2CTransport returns an HTTP/2 transport that sends requests over plain
+// text connections with prior knowledge (h2c).
+func NewH2CTransport() *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn,
+			error) {
+
+			return net.Dial(network, addr)
+		},
+	}
+}
+
+// DialH2C connects a gRPC client to the given address over a plain text
+// connection. The connection is closed once the test is done.
+func DialH2C(t *testing.T, addr string,
+	opts ...grpc.DialOption) *grpc.ClientConn {
+
+	opts = append([]grpc.DialOption{grpc.WithInsecure()}, opts...)
+	conn, err := grpc.Dial(addr, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
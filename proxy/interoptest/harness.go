@@ -0,0 +1,110 @@
+// Package interoptest provides the building blocks to test services behind
+// aperture end to end and in process: a mock Lightning wallet that issues and
+// pays the invoices of payment challenges, a greeter gRPC and HTTP backend,
+// HTTP and gRPC clients that pay challenges automatically and helpers to speak
+// HTTP/2 over plain text connections (h2c).
+package interoptest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+const (
+	// MaxCost is the maximum price in satoshis the clients of the harness
+	// pay for a token.
+	MaxCost btcutil.Amount = 1000000
+
+	// callTimeout is the timeout of the gRPC calls of the clients of the
+	// harness.
+	callTimeout = 10 * time.Second
+)
+
+// Harness is an in-process aperture proxy that authenticates requests with
+// real LSATs, paid through a mock wallet.
+type Harness struct {
+	// Wallet issues the invoices of the payment challenges and pays them
+	// for the clients of the harness.
+	Wallet *Wallet
+
+	// Proxy is the proxy that serves the requests.
+	Proxy *proxy.Proxy
+
+	// Addr is the address the proxy listens on. It accepts HTTP/1.1 and
+	// h2c requests.
+	Addr string
+}
+
+// NewHarness starts an aperture proxy in front of the given services on a
+// random local port. The proxy is shut down once the test is done.
+func NewHarness(t *testing.T, services ...*proxy.Service) *Harness {
+	wallet, err := NewWallet()
+	require.NoError(t, err)
+
+	minter := mint.New(&mint.Config{
+		Secrets:        newSecretStore(),
+		Challenger:     wallet,
+		ServiceLimiter: serviceLimiter{},
+	})
+	authenticator := auth.NewLsatAuthenticator(minter, wallet)
+
+	p, err := proxy.New(authenticator, services)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(NewH2CHandler(p))
+	t.Cleanup(func() {
+		server.Close()
+		_ = p.Close()
+	})
+
+	return &Harness{
+		Wallet: wallet,
+		Proxy:  p,
+		Addr:   server.Listener.Addr().String(),
+	}
+}
+
+// URL returns the base URL of the proxy.
+func (h *Harness) URL() string {
+	return "http://" + h.Addr
+}
+
+// HTTPClient returns an HTTP client that pays the payment challenges of the
+// proxy with the wallet of the harness. Every client pays for its own token,
+// which it then attaches to all of its requests.
+func (h *Harness) HTTPClient() *http.Client {
+	return &http.Client{
+		Transport: lsat.NewTransportWithPayFunc(
+			nil, h.Wallet.Pay, ChainParams, NewTokenStore(),
+			MaxCost, 0,
+		),
+	}
+}
+
+// DialGRPC connects a gRPC client to the proxy over h2c. The client pays the
+// payment challenges of the proxy with the wallet of the harness and attaches
+// its token to all of its calls.
+func (h *Harness) DialGRPC(t *testing.T,
+	opts ...grpc.DialOption) *grpc.ClientConn {
+
+	interceptor := lsat.NewInterceptorWithPayFunc(
+		h.Wallet.Pay, ChainParams, NewTokenStore(), callTimeout,
+		MaxCost, 0, true,
+	)
+	opts = append(
+		opts, grpc.WithUnaryInterceptor(interceptor.UnaryInterceptor),
+		grpc.WithStreamInterceptor(interceptor.StreamInterceptor),
+	)
+
+	return DialH2C(t, h.Addr, opts...)
+}
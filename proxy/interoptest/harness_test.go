@@ -0,0 +1,89 @@
+package interoptest_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightninglabs/aperture/proxy/interoptest"
+	proxytest "github.com/lightninglabs/aperture/proxy/testdata"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestHarnessHTTP tests that HTTP clients of the harness pay for a token once
+// and then reach the backend with it.
+func TestHarnessHTTP(t *testing.T) {
+	backend := interoptest.StartHTTPBackend(t, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("HTTP Hello"))
+		},
+	))
+	h := interoptest.NewHarness(t, &proxy.Service{
+		Name:       "http",
+		Address:    backend,
+		Protocol:   "http",
+		HostRegexp: ".*",
+		PathRegexp: "^/http/.*$",
+		Auth:       "on",
+		Price:      10,
+	})
+
+	// Clients without a token are challenged.
+	resp, err := http.Get(h.URL() + "/http/hello")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusPaymentRequired, resp.StatusCode)
+
+	client := h.HTTPClient()
+	for i := 0; i < 2; i++ {
+		resp, err = client.Get(h.URL() + "/http/hello")
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "HTTP Hello", string(body))
+		require.Equal(t, 1, h.Wallet.NumPayments())
+	}
+}
+
+// TestHarnessGRPC tests that gRPC clients of the harness pay for a token
+// through the proxy and that backend errors are passed through.
+func TestHarnessGRPC(t *testing.T) {
+	backend := interoptest.StartGRPCBackend(t)
+	h := interoptest.NewHarness(t, &proxy.Service{
+		Name:       "grpc",
+		Address:    backend,
+		Protocol:   "http",
+		HostRegexp: ".*",
+		PathRegexp: "^/proxy_test\\.Greeter/.*$",
+		Auth:       "on",
+		Price:      10,
+	})
+
+	// Clients without a token are challenged.
+	ctx := context.Background()
+	req := &proxytest.HelloRequest{Name: "foo"}
+	unpaid := proxytest.NewGreeterClient(interoptest.DialH2C(t, h.Addr))
+	_, err := unpaid.SayHello(ctx, req)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	client := proxytest.NewGreeterClient(h.DialGRPC(t))
+	res, err := client.SayHello(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, "Hello foo", res.Message)
+	require.Equal(t, 1, h.Wallet.NumPayments())
+
+	req.ReturnError = true
+	_, err = client.SayHello(ctx, req)
+	require.Equal(
+		t, interoptest.ErrBackend.Error(),
+		status.Convert(err).Message(),
+	)
+	require.Equal(t, 1, h.Wallet.NumPayments())
+}
@@ -0,0 +1,172 @@
+package interoptest
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+// secretStore is an in-memory store of the LSAT secrets of the harness.
+type secretStore struct {
+	mu      sync.Mutex
+	secrets map[[sha256.Size]byte][lsat.SecretSize]byte
+}
+
+// A compile-time check to make sure secretStore implements mint.SecretStore.
+var _ mint.SecretStore = (*secretStore)(nil)
+
+// newSecretStore creates a new empty secret store.
+func newSecretStore() *secretStore {
+	return &secretStore{
+		secrets: make(map[[sha256.Size]byte][lsat.SecretSize]byte),
+	}
+}
+
+// NewSecret creates a new random secret keyed by the given hash.
+//
+// NOTE: This is part of the mint.SecretStore interface.
+func (s *secretStore) NewSecret(_ context.Context,
+	id [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
+
+	var secret [lsat.SecretSize]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return secret, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.secrets[id] = secret
+	return secret, nil
+}
+
+// GetSecret returns the secret keyed by the given hash or
+// mint.ErrSecretNotFound if there is none.
+//
+// NOTE: This is part of the mint.SecretStore interface.
+func (s *secretStore) GetSecret(_ context.Context,
+	id [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secret, ok := s.secrets[id]
+	if !ok {
+		return secret, mint.ErrSecretNotFound
+	}
+	return secret, nil
+}
+
+// RevokeSecret removes the secret keyed by the given hash.
+//
+// NOTE: This is part of the mint.SecretStore interface.
+func (s *secretStore) RevokeSecret(_ context.Context,
+	id [sha256.Size]byte) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.secrets, id)
+	return nil
+}
+
+// serviceLimiter is a service limiter that doesn't restrict the LSATs of any
+// service.
+type serviceLimiter struct{}
+
+// A compile-time check to make sure serviceLimiter implements
+// mint.ServiceLimiter.
+var _ mint.ServiceLimiter = (*serviceLimiter)(nil)
+
+// ServiceCapabilities returns no capabilities.
+//
+// NOTE: This is part of the mint.ServiceLimiter interface.
+func (serviceLimiter) ServiceCapabilities(context.Context,
+	...lsat.Service) ([]lsat.Caveat, error) {
+
+	return nil, nil
+}
+
+// ServiceConstraints returns no constraints.
+//
+// NOTE: This is part of the mint.ServiceLimiter interface.
+func (serviceLimiter) ServiceConstraints(context.Context,
+	...lsat.Service) ([]lsat.Caveat, error) {
+
+	return nil, nil
+}
+
+// TokenStore is an in-memory LSAT token store for the clients of a test. Like
+// the file store, it holds a single current token that is either pending or
+// paid.
+type TokenStore struct {
+	mu    sync.Mutex
+	token *lsat.Token
+}
+
+// A compile-time check to make sure TokenStore implements lsat.Store.
+var _ lsat.Store = (*TokenStore)(nil)
+
+// NewTokenStore creates a new empty token store.
+func NewTokenStore() *TokenStore {
+	return &TokenStore{}
+}
+
+// CurrentToken returns the current token or lsat.ErrNoToken if there is none.
+//
+// NOTE: This is part of the lsat.Store interface.
+func (s *TokenStore) CurrentToken() (*lsat.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token == nil {
+		return nil, lsat.ErrNoToken
+	}
+	return s.token, nil
+}
+
+// AllTokens returns the current token, keyed by its payment hash.
+//
+// NOTE: This is part of the lsat.Store interface.
+func (s *TokenStore) AllTokens() (map[string]*lsat.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := make(map[string]*lsat.Token)
+	if s.token != nil {
+		tokens[s.token.PaymentHash.String()] = s.token
+	}
+	return tokens, nil
+}
+
+// StoreToken replaces the current token.
+//
+// NOTE: This is part of the lsat.Store interface.
+func (s *TokenStore) StoreToken(token *lsat.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.token = token
+	return nil
+}
+
+// RemovePendingToken removes the current token if it wasn't paid yet or
+// returns lsat.ErrNoToken otherwise.
+//
+// NOTE: This is part of the lsat.Store interface.
+func (s *TokenStore) RemovePendingToken() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token == nil || s.token.Preimage != (lntypes.Preimage{}) {
+		return lsat.ErrNoToken
+	}
+
+	s.token = nil
+	return nil
+}
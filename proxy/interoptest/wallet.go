@@ -0,0 +1,177 @@
+package interoptest
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+)
+
+var (
+	// ChainParams are the parameters of the chain the invoices of the
+	// wallet are issued for.
+	ChainParams = &chaincfg.RegressionNetParams
+)
+
+// invoice is an invoice issued by the wallet.
+type invoice struct {
+	preimage lntypes.Preimage
+	amount   lnwire.MilliSatoshi
+	settled  bool
+}
+
+// Wallet is a mock Lightning node that issues and pays invoices in memory. It
+// can act as the challenger and invoice checker of aperture and as the payment
+// function of LSAT clients at the same time, so the whole payment flow can be
+// tested without a Lightning network.
+type Wallet struct {
+	privKey *btcec.PrivateKey
+
+	mu       sync.Mutex
+	invoices map[lntypes.Hash]*invoice
+}
+
+// A compile-time check to make sure Wallet implements the interfaces aperture
+// needs to issue challenges and check their payment.
+var (
+	_ mint.Challenger     = (*Wallet)(nil)
+	_ auth.InvoiceChecker = (*Wallet)(nil)
+)
+
+// NewWallet creates a new wallet with a random node key.
+func NewWallet() (*Wallet, error) {
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Wallet{
+		privKey:  privKey,
+		invoices: make(map[lntypes.Hash]*invoice),
+	}, nil
+}
+
+// NewChallenge returns a new signed invoice over the given price in satoshis
+// and its payment hash.
+//
+// NOTE: This is part of the mint.Challenger interface.
+func (w *Wallet) NewChallenge(price int64) (string, lntypes.Hash, error) {
+	var preimage lntypes.Preimage
+	if _, err := rand.Read(preimage[:]); err != nil {
+		return "", lntypes.Hash{}, err
+	}
+	hash := preimage.Hash()
+
+	amount := lnwire.NewMSatFromSatoshis(btcutil.Amount(price))
+	opts := []func(*zpay32.Invoice){zpay32.Description("LSAT")}
+	if amount > 0 {
+		opts = append(opts, zpay32.Amount(amount))
+	}
+	payReq, err := zpay32.NewInvoice(ChainParams, hash, time.Now(), opts...)
+	if err != nil {
+		return "", lntypes.Hash{}, err
+	}
+
+	payReqString, err := payReq.Encode(zpay32.MessageSigner{
+		SignCompact: func(hash []byte) ([]byte, error) {
+			return btcec.SignCompact(
+				btcec.S256(), w.privKey, hash, true,
+			)
+		},
+	})
+	if err != nil {
+		return "", lntypes.Hash{}, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.invoices[hash] = &invoice{preimage: preimage, amount: amount}
+	return payReqString, hash, nil
+}
+
+// VerifyInvoiceStatus checks that the invoice identified by the payment hash
+// has the desired status. Payments of the wallet are settled right away, so
+// there is no need to wait for the timeout.
+//
+// NOTE: This is part of the auth.InvoiceChecker interface.
+func (w *Wallet) VerifyInvoiceStatus(hash lntypes.Hash,
+	state lnrpc.Invoice_InvoiceState, _ time.Duration) error {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	inv, ok := w.invoices[hash]
+	if !ok {
+		return fmt.Errorf("no invoice with hash %v", hash)
+	}
+
+	currentState := lnrpc.Invoice_OPEN
+	if inv.settled {
+		currentState = lnrpc.Invoice_SETTLED
+	}
+	if currentState != state {
+		return fmt.Errorf("invoice with hash %v is %v, expected %v",
+			hash, currentState, state)
+	}
+
+	return nil
+}
+
+// Pay settles an invoice issued by the wallet and returns its preimage. It
+// has the signature of an lsat.PayFunc, so it can be used to pay the
+// challenges of LSAT clients.
+func (w *Wallet) Pay(_ context.Context, payReq string,
+	_ btcutil.Amount) (*lsat.PaymentResult, error) {
+
+	decoded, err := zpay32.Decode(payReq, ChainParams)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode invoice: %v", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	inv, ok := w.invoices[*decoded.PaymentHash]
+	if !ok {
+		return nil, fmt.Errorf("invoice %v not issued by this wallet",
+			*decoded.PaymentHash)
+	}
+	if inv.settled {
+		return nil, fmt.Errorf("invoice %v already paid",
+			*decoded.PaymentHash)
+	}
+	inv.settled = true
+
+	return &lsat.PaymentResult{
+		Preimage:   inv.preimage,
+		AmountPaid: inv.amount,
+	}, nil
+}
+
+// NumPayments returns the number of invoices that were paid so far.
+func (w *Wallet) NumPayments() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var numPayments int
+	for _, inv := range w.invoices {
+		if inv.settled {
+			numPayments++
+		}
+	}
+
+	return numPayments
+}
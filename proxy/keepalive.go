@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	// defaultKeepaliveTimeout is the default time to wait for the answer
+	// to a keepalive ping. This is the same as the default of gRPC.
+	defaultKeepaliveTimeout = 20 * time.Second
+)
+
+// KeepaliveConfig holds the options to keep the connections to the backend of
+// a service alive with HTTP/2 pings, so idle streams aren't dropped by
+// intermediaries like load balancers and NAT gateways.
+type KeepaliveConfig struct {
+	// Time is the duration after which an idle connection to the backend
+	// is pinged. Zero disables pings.
+	Time time.Duration `long:"time" description:"Ping the backend after a connection has been idle for this long, 0 to disable pings"`
+
+	// Timeout is the time to wait for the answer to a ping before the
+	// connection is closed.
+	Timeout time.Duration `long:"timeout" description:"Close the connection if a ping isn't answered within this time (default 20s)"`
+
+	// PermitWithoutStream can be set to also ping gRPC connections that
+	// don't have any active calls. It only applies to the gRPC connections
+	// aperture makes itself, for example for health checks. The transport
+	// requests are proxied with always pings idle connections.
+	PermitWithoutStream bool `long:"permitwithoutstream" description:"Also ping the gRPC connections aperture makes itself if they have no active calls"`
+}
+
+// validate checks the keepalive options and sets the default timeout.
+func (c *KeepaliveConfig) validate() error {
+	if c.Time < 0 || c.Timeout < 0 {
+		return fmt.Errorf("negative keepalive duration")
+	}
+	if c.Time > 0 && c.Timeout == 0 {
+		c.Timeout = defaultKeepaliveTimeout
+	}
+
+	return nil
+}
+
+// dialFunc connects to the address of a backend.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// newTLSTransport creates the transport requests to https backends are sent
+// through. Connections are pinged according to the given keepalive options and
+// pooled according to the given pool options.
+func newTLSTransport(tlsConfig *tls.Config, maxHeaderSize int64,
+	keepalive *KeepaliveConfig, pool *PoolConfig,
+	dial dialFunc) (http.RoundTripper, error) {
+
+	var lifetimes *connLifetimes
+	if pool.MaxConnLifetime > 0 {
+		lifetimes = newConnLifetimes(pool.MaxConnLifetime)
+		dial = lifetimes.dial(dial)
+	}
+
+	transport := &http.Transport{
+		DialContext:            dial,
+		ForceAttemptHTTP2:      true,
+		TLSClientConfig:        tlsConfig,
+		MaxResponseHeaderBytes: maxHeaderSize,
+	}
+	pool.configure(transport)
+
+	if keepalive.Time > 0 {
+		h2Transport, err := http2.ConfigureTransports(transport)
+		if err != nil {
+			return nil, err
+		}
+		h2Transport.ReadIdleTimeout = keepalive.Time
+		h2Transport.PingTimeout = keepalive.Timeout
+	}
+
+	if lifetimes != nil {
+		return lifetimes.wrap(transport), nil
+	}
+
+	return transport, nil
+}
+
+// newH2CTransport creates the transport native gRPC requests to plain text
+// backends are sent through with HTTP/2 prior knowledge. Connections are pinged
+// according to the given keepalive options. Of the pool options, only the idle
+// timeout and lifetime apply, since all calls share one connection per
+// address.
+func newH2CTransport(keepalive *KeepaliveConfig, pool *PoolConfig,
+	dial dialFunc) http.RoundTripper {
+
+	var lifetimes *connLifetimes
+	if pool.MaxConnLifetime > 0 {
+		lifetimes = newConnLifetimes(pool.MaxConnLifetime)
+		dial = lifetimes.dial(dial)
+	}
+
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string,
+			_ *tls.Config) (net.Conn, error) {
+
+			return dial(context.Background(), network, addr)
+		},
+		ReadIdleTimeout: keepalive.Time,
+		PingTimeout:     keepalive.Timeout,
+		IdleConnTimeout: pool.IdleTimeout,
+	}
+
+	if lifetimes != nil {
+		return lifetimes.wrap(transport)
+	}
+
+	return transport
+}
+
+// serviceTransport is a round tripper that sends requests through the
+// transport of the service they are forwarded to, if it has its own one, and
+// through a shared transport otherwise.
+type serviceTransport struct {
+	shared   http.RoundTripper
+	services map[*Service]http.RoundTripper
+}
+
+// RoundTrip sends the request through the transport of its service.
+func (s *serviceTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+
+	target := serviceFromContext(req.Context())
+	if transport, ok := s.services[target]; ok {
+		return transport.RoundTrip(req)
+	}
+
+	return s.shared.RoundTrip(req)
+}
+
+// newServiceTransports creates the transports for https and plain text gRPC
+// backends. Services that keep their connections alive or tune their
+// connection pool get their own transports, since both are configured per
+// transport.
+func newServiceTransports(services []*Service, tlsConfig *tls.Config,
+	dial dialFunc) (*serviceTransport, *serviceTransport, error) {
+
+	maxHeaderSize := maxResponseHeaderSize(services)
+	sharedTLS, err := newTLSTransport(
+		tlsConfig, maxHeaderSize, &KeepaliveConfig{}, &PoolConfig{},
+		dial,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsTransport := &serviceTransport{
+		shared:   sharedTLS,
+		services: make(map[*Service]http.RoundTripper),
+	}
+	h2cTransport := &serviceTransport{
+		shared: newH2CTransport(
+			&KeepaliveConfig{}, &PoolConfig{}, dial,
+		),
+		services: make(map[*Service]http.RoundTripper),
+	}
+
+	for _, service := range services {
+		if service.Keepalive.Time == 0 && service.Pool.isDefault() {
+			continue
+		}
+
+		// Each transport keeps its own HTTP/2 connection to an address,
+		// so the streams are spread across the connections of several
+		// transports.
+		var tlsTransports, h2cTransports []http.RoundTripper
+		for i := 0; i < service.Pool.http2Conns(); i++ {
+			transport, err := newTLSTransport(
+				tlsConfig, maxHeaderSize, &service.Keepalive,
+				&service.Pool, dial,
+			)
+			if err != nil {
+				return nil, nil, err
+			}
+			tlsTransports = append(tlsTransports, transport)
+			h2cTransports = append(h2cTransports, newH2CTransport(
+				&service.Keepalive, &service.Pool, dial,
+			))
+		}
+		tlsTransport.services[service] = newSpreadTransport(
+			tlsTransports,
+		)
+		h2cTransport.services[service] = newSpreadTransport(
+			h2cTransports,
+		)
+	}
+
+	return tlsTransport, h2cTransport, nil
+}
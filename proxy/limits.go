@@ -0,0 +1,393 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// defaultMaxResponseHeaderSize is the maximum size of the response
+	// header of a backend if the service doesn't configure one. This is
+	// the same as the default of the Go HTTP transport.
+	defaultMaxResponseHeaderSize = 1 << 20
+
+	// headerFieldOverhead is the number of bytes each header field adds to
+	// the size of a header on top of its name and value, see RFC 7540
+	// section 6.5.2.
+	headerFieldOverhead = 32
+)
+
+// LimitsConfig holds the size limits of the messages exchanged with a service
+// backend, which protect the proxy from pathological frames.
+type LimitsConfig struct {
+	// MaxMessageSize is the maximum size in bytes of a single gRPC message
+	// sent to or received from the backend. Zero means there is no limit,
+	// except for transcoded calls that are always limited to 4 MiB.
+	MaxMessageSize uint32 `long:"maxmessagesize" description:"The maximum size in bytes of a gRPC message in either direction, 0 for no limit"`
+
+	// MaxResponseHeaderSize is the maximum size in bytes of the response
+	// header the backend may send, counted as the length of all names and
+	// values plus 32 bytes per field. Zero means the default of 1 MiB.
+	MaxResponseHeaderSize int64 `long:"maxresponseheadersize" description:"The maximum size in bytes of the backend's response header (default 1 MiB)"`
+}
+
+// validate checks the limits and sets the default of the response header size.
+func (c *LimitsConfig) validate() error {
+	if c.MaxResponseHeaderSize == 0 {
+		c.MaxResponseHeaderSize = defaultMaxResponseHeaderSize
+	}
+	if c.MaxResponseHeaderSize < 0 {
+		return fmt.Errorf("negative response header size limit")
+	}
+
+	return nil
+}
+
+// maxResponseHeaderSize returns the largest response header size limit of all
+// services, which is the limit the shared transport enforces while reading
+// the response. The service configurations must be validated.
+func maxResponseHeaderSize(services []*Service) int64 {
+	var max int64
+	for _, service := range services {
+		if service.Limits.MaxResponseHeaderSize > max {
+			max = service.Limits.MaxResponseHeaderSize
+		}
+	}
+
+	return max
+}
+
+// MessageSizeError is returned if a gRPC message exceeds the maximum message
+// size of a service.
+type MessageSizeError struct {
+	// Size is the size of the message.
+	Size uint32
+
+	// Max is the maximum message size of the service.
+	Max uint32
+}
+
+// Error returns a human readable description of the error.
+func (e *MessageSizeError) Error() string {
+	return fmt.Sprintf("grpc message larger than max (%d vs. %d)", e.Size,
+		e.Max)
+}
+
+// HeaderSizeError is returned if the response header of a backend exceeds the
+// maximum response header size of its service.
+type HeaderSizeError struct {
+	// Size is the size of the response header.
+	Size int64
+
+	// Max is the maximum response header size of the service.
+	Max int64
+}
+
+// Error returns a human readable description of the error.
+func (e *HeaderSizeError) Error() string {
+	return fmt.Sprintf("backend response header larger than max (%d vs. "+
+		"%d)", e.Size, e.Max)
+}
+
+// serviceKey is the context key under which the service a request is forwarded
+// to is stored.
+type serviceKey struct{}
+
+// contextWithService returns a context that carries the service a request is
+// forwarded to.
+func contextWithService(ctx context.Context, service *Service) context.Context {
+	return context.WithValue(ctx, serviceKey{}, service)
+}
+
+// serviceFromContext returns the service a request is forwarded to, or nil if
+// it isn't known.
+func serviceFromContext(ctx context.Context) *Service {
+	service, _ := ctx.Value(serviceKey{}).(*Service)
+	return service
+}
+
+// headerSize returns the size of a header, counted as the length of all names
+// and values plus a fixed overhead per field.
+func headerSize(header http.Header) int64 {
+	var size int64
+	for name, values := range header {
+		for _, value := range values {
+			size += int64(len(name) + len(value) + headerFieldOverhead)
+		}
+	}
+
+	return size
+}
+
+// grpcLimitReader is a reader of a gRPC message stream that checks the header of
+// every message before any of the message is read, and fails as soon as a
+// message isn't allowed to pass.
+type grpcLimitReader struct {
+	io.ReadCloser
+
+	// check is called with the size of each message. If it returns an
+	// error, the stream fails with it.
+	check func(size uint32) error
+
+	// pending holds the bytes of a message header that weren't returned
+	// to the caller yet.
+	pending []byte
+
+	// remaining is the number of bytes of the current message that
+	// weren't read yet.
+	remaining uint32
+
+	// err is the error of the check the stream failed with, if any.
+	err error
+}
+
+// newGRPCLimitReader creates a new reader that checks the gRPC messages read
+// from the given stream.
+func newGRPCLimitReader(body io.ReadCloser,
+	check func(size uint32) error) *grpcLimitReader {
+
+	return &grpcLimitReader{
+		ReadCloser: body,
+		check:      check,
+	}
+}
+
+// maxSizeCheck returns a message check that rejects messages that are larger
+// than the given maximum size.
+func maxSizeCheck(max uint32) func(size uint32) error {
+	return func(size uint32) error {
+		if size > max {
+			return &MessageSizeError{Size: size, Max: max}
+		}
+		return nil
+	}
+}
+
+// Read reads from the message stream.
+func (g *grpcLimitReader) Read(p []byte) (int, error) {
+	if g.err != nil {
+		return 0, g.err
+	}
+
+	if len(g.pending) > 0 {
+		n := copy(p, g.pending)
+		g.pending = g.pending[n:]
+		return n, nil
+	}
+
+	// At the start of a message, we read its header to check the message
+	// before passing on anything of it.
+	if g.remaining == 0 {
+		header := make([]byte, grpcFrameHeaderSize)
+		_, err := io.ReadFull(g.ReadCloser, header)
+		if err != nil {
+			return 0, err
+		}
+
+		size := binary.BigEndian.Uint32(header[1:])
+		if err := g.check(size); err != nil {
+			g.err = err
+			return 0, g.err
+		}
+		g.remaining = size
+
+		n := copy(p, header)
+		g.pending = header[n:]
+		return n, nil
+	}
+
+	if uint32(len(p)) > g.remaining {
+		p = p[:g.remaining]
+	}
+	n, err := g.ReadCloser.Read(p)
+	g.remaining -= uint32(n)
+	return n, err
+}
+
+// limitResponseBody is the body of a gRPC response whose messages are checked.
+// Instead of aborting the response if a message isn't allowed to pass, the
+// stream ends early and the client receives an error status in the trailers.
+type limitResponseBody struct {
+	*grpcLimitReader
+
+	res *http.Response
+
+	// request is the limited message stream of the request, if it is one.
+	request *grpcLimitReader
+}
+
+// Read reads from the response message stream. If it or the request stream
+// failed a check, the response ends.
+func (l *limitResponseBody) Read(p []byte) (int, error) {
+	n, err := l.grpcLimitReader.Read(p)
+	if err != nil && l.limitError() != nil {
+		return n, io.EOF
+	}
+
+	return n, err
+}
+
+// Close closes the response body and replaces the trailers with an error
+// status if a message failed a check.
+func (l *limitResponseBody) Close() error {
+	err := l.grpcLimitReader.Close()
+
+	if limitErr := l.limitError(); limitErr != nil {
+		l.res.Trailer = http.Header{}
+		l.res.Trailer.Set(
+			hdrGrpcStatus, strconv.Itoa(int(limitCode(limitErr))),
+		)
+		l.res.Trailer.Set(hdrGrpcMessage, limitErr.Error())
+	}
+
+	return err
+}
+
+// limitError returns the error of the response or request stream, if either of
+// them failed a check.
+func (l *limitResponseBody) limitError() error {
+	if l.err != nil {
+		return l.err
+	}
+	if l.request != nil && l.request.err != nil {
+		return l.request.err
+	}
+
+	return nil
+}
+
+// limitCode returns the gRPC status code a stream that failed a check with the
+// given error ends with.
+func limitCode(err error) codes.Code {
+	var msgErr *MessageSizeError
+	switch {
+	case errors.As(err, &msgErr), errors.Is(err, ErrBalanceExhausted):
+		return codes.ResourceExhausted
+
+	default:
+		return codes.Internal
+	}
+}
+
+// isGRPC returns true if the given content type is the one of native gRPC.
+func isGRPC(contentType string) bool {
+	return strings.HasPrefix(contentType, hdrTypeGrpc)
+}
+
+// limitRequest limits the size of the gRPC messages of the request's body to
+// the maximum of the target service.
+func limitRequest(r *http.Request, target *Service) {
+	max := target.Limits.MaxMessageSize
+	if max == 0 || r.Body == nil || !isGRPC(r.Header.Get(hdrContentType)) {
+		return
+	}
+
+	r.Body = newGRPCLimitReader(r.Body, maxSizeCheck(max))
+}
+
+// limitResponse checks the size of the response header of a backend and
+// limits the size of the gRPC messages of its body to the maximum of the
+// service of the request. If the messages are billed, each one is deducted
+// from the balance of the token before it's passed on.
+func limitResponse(res *http.Response) error {
+	target := serviceFromContext(res.Request.Context())
+	if target == nil {
+		return nil
+	}
+
+	size := headerSize(res.Header)
+	maxHeader := target.Limits.MaxResponseHeaderSize
+	if maxHeader > 0 && size > maxHeader {
+		return &HeaderSizeError{Size: size, Max: maxHeader}
+	}
+
+	if !isGRPC(res.Header.Get(hdrContentType)) {
+		return nil
+	}
+
+	// Messages that are too large are rejected before they are billed.
+	var checks []func(size uint32) error
+	if max := target.Limits.MaxMessageSize; max > 0 {
+		checks = append(checks, maxSizeCheck(max))
+	}
+	ctx := res.Request.Context()
+	if meter := meterFromContext(ctx); meter != nil {
+		checks = append(checks, func(uint32) error {
+			return meter.spend(ctx)
+		})
+	}
+	if len(checks) == 0 {
+		return nil
+	}
+	check := func(size uint32) error {
+		for _, check := range checks {
+			if err := check(size); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	request, _ := res.Request.Body.(*grpcLimitReader)
+	res.Body = &limitResponseBody{
+		grpcLimitReader: newGRPCLimitReader(res.Body, check),
+		res:             res,
+		request:         request,
+	}
+	return nil
+}
+
+// handleBackendError sends an error response to the client if the request
+// couldn't be forwarded to the backend. Exceeded limits are reported with a
+// clear error and exceeded deadlines as a timeout, all other errors as a bad
+// gateway like the reverse proxy does by default.
+func handleBackendError(w http.ResponseWriter, r *http.Request, err error) {
+	var (
+		msgErr    *MessageSizeError
+		headerErr *HeaderSizeError
+		bufferErr *BufferSizeError
+	)
+	if limiter, ok := r.Body.(*grpcLimitReader); ok && limiter.err != nil {
+		err = limiter.err
+	}
+
+	switch {
+	case errors.As(err, &msgErr) || errors.As(err, &headerErr) ||
+		errors.As(err, &bufferErr):
+
+		log.Infof("Size limit of backend call exceeded: %v", err)
+
+		if isGRPC(r.Header.Get(hdrContentType)) {
+			w.Header().Set(
+				hdrGrpcStatus,
+				strconv.Itoa(int(codes.ResourceExhausted)),
+			)
+			w.Header().Set(hdrGrpcMessage, err.Error())
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusBadGateway)
+
+	// The call took longer than the client or the service allows.
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Debugf("Deadline of backend call exceeded: %v", err)
+
+		sendStatusResponse(
+			w, r, http.StatusGatewayTimeout,
+			codes.DeadlineExceeded, "deadline exceeded",
+		)
+
+	default:
+		log.Errorf("http: proxy error: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+// grpcMessages encodes messages of the given sizes as a gRPC message stream.
+func grpcMessages(sizes ...int) []byte {
+	var stream []byte
+	for _, size := range sizes {
+		header := make([]byte, grpcFrameHeaderSize)
+		binary.BigEndian.PutUint32(header[1:], uint32(size))
+		stream = append(stream, header...)
+		stream = append(stream, bytes.Repeat([]byte{'x'}, size)...)
+	}
+
+	return stream
+}
+
+// TestGRPCLimitReader tests that a gRPC message stream is passed on unchanged
+// up to the first message that is too large.
+func TestGRPCLimitReader(t *testing.T) {
+	stream := grpcMessages(10, 16, 0)
+	reader := newGRPCLimitReader(
+		ioutil.NopCloser(bytes.NewReader(stream)), maxSizeCheck(16),
+	)
+	read, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, stream, read)
+
+	stream = grpcMessages(10, 17, 3)
+	reader = newGRPCLimitReader(
+		ioutil.NopCloser(bytes.NewReader(stream)), maxSizeCheck(16),
+	)
+	read, err = ioutil.ReadAll(reader)
+	require.Equal(t, &MessageSizeError{Size: 17, Max: 16}, err)
+	require.Equal(t, grpcMessages(10), read)
+}
+
+// TestLimitResponse tests that too large response headers are rejected and
+// that a response with a too large message ends with an error status.
+func TestLimitResponse(t *testing.T) {
+	target := &Service{
+		Limits: LimitsConfig{
+			MaxMessageSize:        16,
+			MaxResponseHeaderSize: 128,
+		},
+	}
+	require.NoError(t, target.Limits.validate())
+
+	req := httptest.NewRequest("POST", "/pkg.Service/Method", nil)
+	req = req.WithContext(contextWithService(context.Background(), target))
+
+	res := &http.Response{
+		Header:  http.Header{},
+		Request: req,
+	}
+	res.Header.Set(hdrContentType, hdrTypeGrpc)
+	res.Header.Set("X-Large", strings.Repeat("x", 100))
+	require.Equal(
+		t, &HeaderSizeError{Size: 199, Max: 128}, limitResponse(res),
+	)
+
+	res.Header.Del("X-Large")
+	res.Body = ioutil.NopCloser(bytes.NewReader(grpcMessages(4, 32)))
+	require.NoError(t, limitResponse(res))
+
+	read, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, grpcMessages(4), read)
+
+	require.NoError(t, res.Body.Close())
+	require.Equal(
+		t, strconv.Itoa(int(codes.ResourceExhausted)),
+		res.Trailer.Get(hdrGrpcStatus),
+	)
+	require.Contains(t, res.Trailer.Get(hdrGrpcMessage), "(32 vs. 16)")
+}
+
+// TestHandleBackendError tests that exceeded limits are reported to gRPC
+// clients with the resource exhausted status.
+func TestHandleBackendError(t *testing.T) {
+	req := httptest.NewRequest(
+		"POST", "/pkg.Service/Method",
+		bytes.NewReader(grpcMessages(32)),
+	)
+	req.Header.Set(hdrContentType, hdrTypeGrpc)
+	limitRequest(req, &Service{Limits: LimitsConfig{MaxMessageSize: 16}})
+
+	_, err := ioutil.ReadAll(req.Body)
+	require.Error(t, err)
+
+	// Even if the transport doesn't return the error of the body, the
+	// limit of the request is reported.
+	rec := httptest.NewRecorder()
+	handleBackendError(rec, req, context.Canceled)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(
+		t, strconv.Itoa(int(codes.ResourceExhausted)),
+		rec.Header().Get(hdrGrpcStatus),
+	)
+
+	rec = httptest.NewRecorder()
+	handleBackendError(
+		rec, httptest.NewRequest("GET", "/", nil), context.Canceled,
+	)
+	require.Equal(t, http.StatusBadGateway, rec.Code)
+}
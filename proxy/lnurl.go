@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcutil/bech32"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+const (
+	// lnurlPathPrefix is the prefix of the LNURL-pay endpoints. The full
+	// path is the prefix followed by the hex encoded payment hash of the
+	// challenge's invoice.
+	lnurlPathPrefix = "/.aperture/lnurl/"
+
+	// lnurlCallbackSuffix is appended to the LNURL-pay endpoint path to
+	// get the path of its callback.
+	lnurlCallbackSuffix = "/callback"
+
+	// LNURLMetadata is the metadata that is sent to LNURL wallets. Wallets
+	// verify that the description hash of the invoice matches the hash of
+	// the metadata, so the invoices of all challenges must be created with
+	// LNURLDescriptionHash if LNURL-pay is used.
+	LNURLMetadata = `[["text/plain","LSAT"]]`
+)
+
+// LNURLDescriptionHash returns the description hash the invoices of challenges
+// need to be created with to be payable through LNURL-pay.
+func LNURLDescriptionHash() []byte {
+	hash := sha256.Sum256([]byte(LNURLMetadata))
+	return hash[:]
+}
+
+// lnurlPayResponse is the first response of an LNURL-pay endpoint that tells
+// the wallet what it can pay for.
+type lnurlPayResponse struct {
+	Tag         string `json:"tag"`
+	Callback    string `json:"callback"`
+	MinSendable int64  `json:"minSendable"`
+	MaxSendable int64  `json:"maxSendable"`
+	Metadata    string `json:"metadata"`
+}
+
+// lnurlCallbackResponse is the response of the callback of an LNURL-pay
+// endpoint that contains the invoice to pay.
+type lnurlCallbackResponse struct {
+	PR     string        `json:"pr"`
+	Routes []interface{} `json:"routes"`
+}
+
+// lnurlErrorResponse is the response of an LNURL-pay endpoint in case of an
+// error.
+type lnurlErrorResponse struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// isLNURLRequest returns true if the request is addressed to one of the
+// LNURL-pay endpoints.
+func isLNURLRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, lnurlPathPrefix)
+}
+
+// lnurlEndpoint returns the bech32 encoded LNURL of the LNURL-pay endpoint for
+// the challenge with the given invoice payment hash.
+func lnurlEndpoint(r *http.Request, hash lntypes.Hash) (string, error) {
+	url := baseURL(r) + lnurlPathPrefix + hash.String()
+
+	data, err := bech32.ConvertBits([]byte(url), 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	lnurl, err := bech32.Encode("lnurl", data)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ToUpper(lnurl), nil
+}
+
+// handleLNURL serves the LNURL-pay endpoint and its callback for the challenge
+// identified by the payment hash in the request path. The callback returns the
+// invoice of the challenge itself, so once the wallet paid it, the macaroon of
+// the challenge becomes a valid LSAT.
+func (p *Proxy) handleLNURL(w http.ResponseWriter, r *http.Request,
+	prefixLog *PrefixLog) {
+
+	if p.invoiceFetcher == nil {
+		sendDirectResponse(w, r, http.StatusNotFound, "not found")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, lnurlPathPrefix)
+	isCallback := strings.HasSuffix(path, lnurlCallbackSuffix)
+	hash, err := lntypes.MakeHashFromStr(
+		strings.TrimSuffix(path, lnurlCallbackSuffix),
+	)
+	if err != nil {
+		sendLNURLError(w, "invalid payment hash")
+		return
+	}
+
+	invoice, err := p.invoiceFetcher.FetchInvoice(r.Context(), hash)
+	if err == mint.ErrChallengerBusy {
+		sendLNURLError(w, "service busy, try again later")
+		return
+	}
+	if err != nil {
+		prefixLog.Debugf("Error fetching LNURL invoice: %v", err)
+		sendLNURLError(w, "unknown invoice")
+		return
+	}
+	if invoice.State != lnrpc.Invoice_OPEN {
+		sendLNURLError(w, "invoice is no longer payable")
+		return
+	}
+
+	if !isCallback {
+		sendLNURLResponse(w, &lnurlPayResponse{
+			Tag:         "payRequest",
+			Callback:    baseURL(r) + r.URL.Path + lnurlCallbackSuffix,
+			MinSendable: invoice.ValueMsat,
+			MaxSendable: invoice.ValueMsat,
+			Metadata:    LNURLMetadata,
+		})
+		return
+	}
+
+	// The amount of the invoice is fixed, so the wallet needs to ask for
+	// exactly that amount.
+	amount, err := strconv.ParseInt(r.URL.Query().Get("amount"), 10, 64)
+	if err != nil || amount != invoice.ValueMsat {
+		sendLNURLError(w, fmt.Sprintf(
+			"amount must be %d msat", invoice.ValueMsat,
+		))
+		return
+	}
+
+	prefixLog.Infof("Sending invoice of challenge %v to LNURL wallet",
+		hash)
+	sendLNURLResponse(w, &lnurlCallbackResponse{
+		PR:     invoice.PaymentRequest,
+		Routes: []interface{}{},
+	})
+}
+
+// baseURL returns the scheme and host the client used to reach us.
+func baseURL(r *http.Request) string {
+	if r.TLS == nil {
+		return "http://" + r.Host
+	}
+	return "https://" + r.Host
+}
+
+// sendLNURLError sends an error in the format of the LNURL specification.
+func sendLNURLError(w http.ResponseWriter, reason string) {
+	sendLNURLResponse(w, &lnurlErrorResponse{
+		Status: "ERROR",
+		Reason: reason,
+	})
+}
+
+// sendLNURLResponse sends the given value as JSON response. LNURL wallets
+// expect errors in the body instead of the status code, so the status code is
+// always 200.
+func sendLNURLResponse(w http.ResponseWriter, response interface{}) {
+	w.Header().Set(hdrContentType, "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("Error sending LNURL response: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lightninglabs/aperture/pricer"
+)
+
+const (
+	// latencyWeight is the weight of a new sample in the moving average of
+	// the backend latency.
+	latencyWeight = 0.2
+)
+
+// QueueReporter is an entity that is able to report how many calls are
+// waiting to be processed by lnd, which is part of the load surge pricing is
+// based on.
+type QueueReporter interface {
+	// QueueDepth returns the number of calls that are waiting for lnd.
+	QueueDepth() int
+}
+
+// loadTracker keeps track of the load of a service backend.
+type loadTracker struct {
+	inFlight int64
+
+	latencyMtx sync.Mutex
+	latency    time.Duration
+}
+
+// start records a new request that is forwarded to the backend. The returned
+// response writer records the time the backend takes to send the response
+// header, the returned function must be called once the request is complete.
+func (l *loadTracker) start(w http.ResponseWriter) (http.ResponseWriter,
+	func()) {
+
+	atomic.AddInt64(&l.inFlight, 1)
+	loadWriter := &loadResponseWriter{
+		ResponseWriter: w,
+		tracker:        l,
+		start:          time.Now(),
+	}
+
+	return loadWriter, func() {
+		atomic.AddInt64(&l.inFlight, -1)
+	}
+}
+
+// addLatency adds a latency sample to the moving average.
+func (l *loadTracker) addLatency(latency time.Duration) {
+	l.latencyMtx.Lock()
+	defer l.latencyMtx.Unlock()
+
+	if l.latency == 0 {
+		l.latency = latency
+		return
+	}
+	l.latency = time.Duration(
+		latencyWeight*float64(latency) +
+			(1-latencyWeight)*float64(l.latency),
+	)
+}
+
+// load returns the current load of the backend.
+func (l *loadTracker) load(queue QueueReporter) pricer.Load {
+	l.latencyMtx.Lock()
+	latency := l.latency
+	l.latencyMtx.Unlock()
+
+	load := pricer.Load{
+		InFlight: int(atomic.LoadInt64(&l.inFlight)),
+		Latency:  latency,
+	}
+	if queue != nil {
+		load.QueueDepth = queue.QueueDepth()
+	}
+	return load
+}
+
+// loadResponseWriter is a http.ResponseWriter that measures the time until the
+// response header is written.
+type loadResponseWriter struct {
+	http.ResponseWriter
+
+	tracker     *loadTracker
+	start       time.Time
+	wroteHeader bool
+}
+
+// WriteHeader records the latency of the backend and sends the header.
+func (l *loadResponseWriter) WriteHeader(statusCode int) {
+	if !l.wroteHeader {
+		l.wroteHeader = true
+		l.tracker.addLatency(time.Since(l.start))
+	}
+
+	l.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write sends a chunk of the response body.
+func (l *loadResponseWriter) Write(b []byte) (int, error) {
+	if !l.wroteHeader {
+		l.WriteHeader(http.StatusOK)
+	}
+
+	return l.ResponseWriter.Write(b)
+}
+
+// ReadFrom sends the response body read from src with the ReadFrom method of
+// the wrapped response writer, if it has one.
+func (l *loadResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !l.wroteHeader {
+		l.WriteHeader(http.StatusOK)
+	}
+
+	return readFrom(l.ResponseWriter, src)
+}
+
+// Flush sends any buffered data to the client.
+func (l *loadResponseWriter) Flush() {
+	if !l.wroteHeader {
+		l.WriteHeader(http.StatusOK)
+	}
+
+	if flusher, ok := l.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the reverse proxy take over the connection for protocol
+// upgrades.
+func (l *loadResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := l.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection can't be hijacked")
+	}
+	return hijacker.Hijack()
+}
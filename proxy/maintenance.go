@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultMaintenanceMessage is the default body of the responses of a
+	// service in maintenance mode.
+	defaultMaintenanceMessage = "service under maintenance"
+
+	// defaultMaintenanceRetryAfter is the default time clients are told
+	// to retry a request to a service in maintenance mode after.
+	defaultMaintenanceRetryAfter = 5 * time.Minute
+)
+
+// MaintenanceConfig holds the options of the maintenance mode of a service. A
+// service in maintenance mode answers all requests with a 503 response instead
+// of creating invoices or forwarding them to its backend.
+type MaintenanceConfig struct {
+	// Enabled can be set to put the service into maintenance mode.
+	Enabled bool `long:"enabled" description:"Answer all requests of the service with a 503 response"`
+
+	// Message is the body of the responses, or the gRPC status message
+	// for gRPC clients.
+	Message string `long:"message" description:"The body of the maintenance responses (default: service under maintenance)"`
+
+	// RetryAfter is the time clients are told to retry after with the
+	// Retry-After header field.
+	RetryAfter time.Duration `long:"retryafter" description:"The time clients are told to retry after (default 5m)"`
+}
+
+// validate checks the maintenance options.
+func (c *MaintenanceConfig) validate() error {
+	if c.RetryAfter < 0 {
+		return fmt.Errorf("negative retry after duration")
+	}
+
+	return nil
+}
+
+// SetMaintenance overrides the maintenance mode of the service with the given
+// name at run time, for example to take its backend down for an upgrade. The
+// override is kept when the services are updated, until it's cleared with a
+// nil configuration. False is returned if there is no such service.
+func (p *Proxy) SetMaintenance(name string, cfg *MaintenanceConfig) (bool,
+	error) {
+
+	if cfg != nil {
+		if err := cfg.validate(); err != nil {
+			return false, err
+		}
+	}
+
+	if _, ok := p.serviceByName(name); !ok {
+		return false, nil
+	}
+
+	p.maintenanceMtx.Lock()
+	defer p.maintenanceMtx.Unlock()
+
+	if cfg == nil {
+		delete(p.maintenanceOverrides, name)
+		return true, nil
+	}
+
+	if p.maintenanceOverrides == nil {
+		p.maintenanceOverrides = make(map[string]*MaintenanceConfig)
+	}
+	p.maintenanceOverrides[name] = cfg
+
+	return true, nil
+}
+
+// Maintenance returns the current maintenance mode of the service with the
+// given name, which is either its configured one or the override that was set
+// at run time. False is returned if there is no such service.
+func (p *Proxy) Maintenance(name string) (*MaintenanceConfig, bool) {
+	target, ok := p.serviceByName(name)
+	if !ok {
+		return nil, false
+	}
+
+	return p.maintenance(target), true
+}
+
+// serviceByName returns the current service with the given name.
+func (p *Proxy) serviceByName(name string) (*Service, bool) {
+	for _, service := range p.currentServices() {
+		if service.Name == name {
+			return service, true
+		}
+	}
+
+	return nil, false
+}
+
+// maintenance returns the current maintenance mode of the service.
+func (p *Proxy) maintenance(target *Service) *MaintenanceConfig {
+	p.maintenanceMtx.RLock()
+	defer p.maintenanceMtx.RUnlock()
+
+	if cfg, ok := p.maintenanceOverrides[target.Name]; ok {
+		return cfg
+	}
+
+	return &target.Maintenance
+}
+
+// sendMaintenanceResponse tells the client that the service is under
+// maintenance and when to retry.
+func sendMaintenanceResponse(w http.ResponseWriter, r *http.Request,
+	cfg *MaintenanceConfig) {
+
+	message := cfg.Message
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	retryAfter := cfg.RetryAfter
+	if retryAfter == 0 {
+		retryAfter = defaultMaintenanceRetryAfter
+	}
+
+	// The header field is in whole seconds, which we round up so clients
+	// don't come back too early.
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set(hdrRetryAfter, strconv.FormatInt(seconds, 10))
+	addCorsHeaders(w.Header())
+	sendDirectResponse(w, r, http.StatusServiceUnavailable, message)
+}
@@ -0,0 +1,90 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMaintenance tests that services in maintenance mode answer requests with
+// a 503 response instead of a challenge, and that the configured mode can be
+// overridden at run time.
+func TestMaintenance(t *testing.T) {
+	newServices := func() []*proxy.Service {
+		return []*proxy.Service{{
+			Name:       "test-service",
+			Address:    testTargetServiceAddress,
+			HostRegexp: "^app.example.com$",
+			PathRegexp: testPathRegexpHTTP,
+			Protocol:   "http",
+			Auth:       "on",
+			Maintenance: proxy.MaintenanceConfig{
+				Enabled:    true,
+				RetryAfter: 90 * time.Second,
+			},
+		}}
+	}
+
+	mockAuth := auth.NewMockAuthenticator()
+	p, err := proxy.New(mockAuth, newServices())
+	require.NoError(t, err)
+
+	validate := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.Header.Set(proxy.HeaderOriginalURI, "/http/test")
+		req.Header.Set(proxy.HeaderOriginalHost, "app.example.com")
+
+		rec := httptest.NewRecorder()
+		p.ServeValidation(rec, req)
+		return rec
+	}
+
+	// The configured maintenance mode is used until it's overridden.
+	rec := validate()
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, "90", rec.Header().Get("Retry-After"))
+	require.Contains(t, rec.Body.String(), "service under maintenance")
+	require.Empty(t, rec.Header().Get("WWW-Authenticate"))
+
+	ok, err := p.SetMaintenance("test-service", &proxy.MaintenanceConfig{})
+	require.NoError(t, err)
+	require.True(t, ok)
+	rec = validate()
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+
+	// Overrides are kept when the services are updated.
+	ok, err = p.SetMaintenance("test-service", &proxy.MaintenanceConfig{
+		Enabled: true,
+		Message: "upgrading",
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, p.UpdateServices(newServices()))
+
+	rec = validate()
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, "300", rec.Header().Get("Retry-After"))
+	require.Contains(t, rec.Body.String(), "upgrading")
+
+	// Clearing the override restores the configured mode.
+	ok, err = p.SetMaintenance("test-service", nil)
+	require.NoError(t, err)
+	require.True(t, ok)
+	cfg, ok := p.Maintenance("test-service")
+	require.True(t, ok)
+	require.Equal(t, 90*time.Second, cfg.RetryAfter)
+
+	// Unknown services and invalid modes can't be set.
+	ok, err = p.SetMaintenance("unknown", &proxy.MaintenanceConfig{})
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, err = p.SetMaintenance("test-service", &proxy.MaintenanceConfig{
+		RetryAfter: -time.Second,
+	})
+	require.Error(t, err)
+}
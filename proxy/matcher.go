@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// serviceMatchers are the compiled regular expressions of a service that are
+// tested against every request.
+type serviceMatchers struct {
+	host      *regexp.Regexp
+	path      *regexp.Regexp
+	whitelist []*regexp.Regexp
+}
+
+// compileMatchers compiles the host, path and auth whitelist expressions of the
+// given service.
+func compileMatchers(s *Service) (*serviceMatchers, error) {
+	host, err := regexp.Compile(s.HostRegexp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host regexp: %v", err)
+	}
+	m := &serviceMatchers{host: host}
+
+	if s.PathRegexp != "" {
+		m.path, err = regexp.Compile(s.PathRegexp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path regexp: %v", err)
+		}
+	}
+
+	for _, entry := range s.AuthWhitelistPaths {
+		whitelist, err := regexp.Compile(entry)
+		if err != nil {
+			return nil, fmt.Errorf("error validating auth "+
+				"whitelist: %v", err)
+		}
+		m.whitelist = append(m.whitelist, whitelist)
+	}
+
+	return m, nil
+}
+
+// matchers returns the compiled expressions of the service. They're compiled
+// once when the proxy prepares the service. Services that weren't prepared by
+// a proxy compile them on every call and panic if one is invalid.
+func (s *Service) matchers() *serviceMatchers {
+	if s.compiled != nil {
+		return s.compiled
+	}
+
+	m := &serviceMatchers{host: regexp.MustCompile(s.HostRegexp)}
+	if s.PathRegexp != "" {
+		m.path = regexp.MustCompile(s.PathRegexp)
+	}
+	for _, entry := range s.AuthWhitelistPaths {
+		m.whitelist = append(m.whitelist, regexp.MustCompile(entry))
+	}
+	return m
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMatchers tests that the expressions of services are compiled once and
+// that invalid ones are rejected.
+func TestMatchers(t *testing.T) {
+	services := []*Service{{
+		Name:               "svc1",
+		HostRegexp:         "^api\\.example\\.com$",
+		PathRegexp:         "^/v1/",
+		AuthWhitelistPaths: []string{"^/v1/public"},
+	}, {
+		Name:       "svc2",
+		HostRegexp: ".*",
+	}}
+	_, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+	require.NotNil(t, services[0].compiled)
+
+	req := httptest.NewRequest("GET", "http://api.example.com/v1/foo", nil)
+	target, ok := matchService(req, services)
+	require.True(t, ok)
+	require.Equal(t, "svc1", target.Name)
+	require.True(t, target.AuthRequired(req).IsOn())
+
+	req = httptest.NewRequest(
+		"GET", "http://api.example.com/v1/public", nil,
+	)
+	require.Equal(t, auth.LevelOff, target.AuthRequired(req))
+
+	req = httptest.NewRequest("GET", "http://example.com/v1/foo", nil)
+	target, ok = matchService(req, services)
+	require.True(t, ok)
+	require.Equal(t, "svc2", target.Name)
+
+	for _, service := range []*Service{
+		{HostRegexp: "("},
+		{HostRegexp: ".*", PathRegexp: "("},
+		{HostRegexp: ".*", AuthWhitelistPaths: []string{"("}},
+	} {
+		_, err := New(auth.NewMockAuthenticator(), []*Service{service})
+		require.Error(t, err)
+	}
+}
+
+// BenchmarkMatchService measures matching a request against the last of a
+// number of services.
+func BenchmarkMatchService(b *testing.B) {
+	var services []*Service
+	for i := 0; i < 20; i++ {
+		services = append(services, &Service{
+			Name:       fmt.Sprintf("svc%d", i),
+			HostRegexp: fmt.Sprintf("^svc%d\\.example\\.com$", i),
+			PathRegexp: "^/v1/",
+		})
+	}
+	_, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(b, err)
+
+	req := httptest.NewRequest(
+		"GET", "http://svc19.example.com/v1/foo", nil,
+	)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := matchService(req, services); !ok {
+			b.Fatal("no service matched")
+		}
+	}
+}
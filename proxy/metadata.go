@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// maxMetadataValueSize is the maximum size in bytes of a metadata
+	// value that is copied from a request header. Longer values are
+	// dropped.
+	maxMetadataValueSize = 256
+)
+
+// MetadataConfig holds the metadata that is attached to the new tokens of a
+// service at mint time, so they can be reconciled with external billing
+// systems.
+type MetadataConfig struct {
+	// Values are fixed metadata values of all new tokens of the service,
+	// like the name of the plan they are sold under.
+	Values map[string]string `long:"values" description:"Metadata keys and values attached to all new tokens, like plan:pro"`
+
+	// Headers maps metadata keys to the request header fields their
+	// values are copied from, like a customer reference that a trusted
+	// frontend adds to the request the token is issued for.
+	Headers map[string]string `long:"headers" description:"Metadata keys and the request header fields their values are copied from, like customer:X-Customer-Ref"`
+}
+
+// validate checks the metadata options.
+func (c *MetadataConfig) validate() error {
+	for key := range c.Values {
+		if key == "" {
+			return fmt.Errorf("empty metadata key")
+		}
+	}
+	for key, header := range c.Headers {
+		if key == "" || header == "" {
+			return fmt.Errorf("empty metadata key or header")
+		}
+	}
+
+	return nil
+}
+
+// withMetadata adds the metadata of a new token of the service that is issued
+// for the request to the context of the request. Header values override fixed
+// values of the same key.
+func withMetadata(r *http.Request, target *Service) *http.Request {
+	cfg := target.Metadata
+	if len(cfg.Values) == 0 && len(cfg.Headers) == 0 {
+		return r
+	}
+
+	metadata := make(map[string]string, len(cfg.Values)+len(cfg.Headers))
+	for key, value := range cfg.Values {
+		metadata[key] = value
+	}
+	for key, header := range cfg.Headers {
+		value := r.Header.Get(header)
+		if value == "" || len(value) > maxMetadataValueSize {
+			continue
+		}
+		metadata[key] = value
+	}
+	if len(metadata) == 0 {
+		return r
+	}
+
+	return r.WithContext(lsat.AddToContext(
+		r.Context(), lsat.KeyMetadata, metadata,
+	))
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// MethodsConfig holds the lists of gRPC methods that may or may not be called
+// through a service. This allows exposing only part of a backend, for example
+// the read-only calls of an lnd node.
+type MethodsConfig struct {
+	// Allow is the list of fully qualified gRPC methods that may be
+	// called, for example lnrpc.Lightning/GetInfo. All methods of a gRPC
+	// service are matched by lnrpc.Lightning/*. If the list isn't empty,
+	// any request that doesn't call one of the methods is rejected.
+	Allow []string `long:"allow" description:"The fully qualified gRPC methods that may be called, like lnrpc.Lightning/GetInfo or lnrpc.Lightning/*, all if empty"`
+
+	// Deny is the list of fully qualified gRPC methods that may not be
+	// called, in the same format. It takes precedence over the allowed
+	// methods.
+	Deny []string `long:"deny" description:"The fully qualified gRPC methods that may not be called, like lnrpc.Lightning/SendCoins"`
+}
+
+// methodFilter is the compiled form of a MethodsConfig.
+type methodFilter struct {
+	allow map[string]struct{}
+	deny  map[string]struct{}
+}
+
+// newMethodFilter compiles the lists of a methods configuration. If both lists
+// are empty, nil is returned.
+func newMethodFilter(cfg *MethodsConfig) (*methodFilter, error) {
+	if len(cfg.Allow) == 0 && len(cfg.Deny) == 0 {
+		return nil, nil
+	}
+
+	var err error
+	f := &methodFilter{}
+	f.allow, err = methodSet(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	f.deny, err = methodSet(cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// methodSet validates a list of methods and returns them as a set, without the
+// optional leading slash.
+func methodSet(methods []string) (map[string]struct{}, error) {
+	set := make(map[string]struct{}, len(methods))
+	for _, method := range methods {
+		method = strings.TrimPrefix(strings.TrimSpace(method), "/")
+		if !validMethod(method) {
+			return nil, fmt.Errorf("invalid method %q, must be of "+
+				"the form package.Service/Method", method)
+		}
+		set[method] = struct{}{}
+	}
+
+	return set, nil
+}
+
+// validMethod returns true if the given name is of the form
+// package.Service/Method.
+func validMethod(name string) bool {
+	parts := strings.Split(name, "/")
+	return len(parts) == 2 && parts[0] != "" && parts[1] != ""
+}
+
+// containsMethod returns true if the method or its service is in the set.
+func containsMethod(set map[string]struct{}, method string) bool {
+	if _, ok := set[method]; ok {
+		return true
+	}
+
+	service := method[:strings.LastIndex(method, "/")+1]
+	_, ok := set[service+"*"]
+	return ok
+}
+
+// check returns the gRPC method the request calls and whether it's allowed to
+// call it. Requests that don't call a gRPC method are only allowed if there is
+// no list of allowed methods.
+func (f *methodFilter) check(r *http.Request, target *Service) (string, bool) {
+	method, ok := grpcMethod(r, target)
+	if !ok {
+		return "", len(f.allow) == 0
+	}
+
+	// Malformed paths are never allowed, so they can't be used to get
+	// around the lists.
+	name := strings.TrimPrefix(method, "/")
+	if !validMethod(name) || containsMethod(f.deny, name) {
+		return method, false
+	}
+
+	return method, len(f.allow) == 0 || containsMethod(f.allow, name)
+}
+
+// grpcMethod returns the full name of the gRPC method a request calls, either
+// natively or through gRPC-Web, or through a REST binding of the transcoder.
+func grpcMethod(r *http.Request, target *Service) (string, bool) {
+	if isGRPCWebRequest(r) || isGRPC(r.Header.Get(hdrContentType)) {
+		return r.URL.Path, true
+	}
+
+	if target.transcoder == nil {
+		return "", false
+	}
+	route, _, ok := target.transcoder.match(r)
+	if !ok {
+		return "", false
+	}
+
+	return route.grpcPath(), true
+}
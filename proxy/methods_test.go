@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestMethodFilter tests that gRPC calls are checked against the allowed and
+// denied methods of a service.
+func TestMethodFilter(t *testing.T) {
+	_, err := newMethodFilter(&MethodsConfig{Allow: []string{"GetInfo"}})
+	require.Error(t, err)
+
+	filter, err := newMethodFilter(&MethodsConfig{})
+	require.NoError(t, err)
+	require.Nil(t, filter)
+
+	target := &Service{}
+	call := func(filter *methodFilter, path, contentType string) bool {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Header.Set(hdrContentType, contentType)
+		_, ok := filter.check(req, target)
+		return ok
+	}
+
+	filter, err = newMethodFilter(&MethodsConfig{
+		Allow: []string{"/lnrpc.Lightning/*", "routerrpc.Router/Get"},
+		Deny:  []string{"lnrpc.Lightning/SendCoins"},
+	})
+	require.NoError(t, err)
+
+	const grpc, grpcWeb = hdrTypeGrpc, hdrTypeGrpcWeb
+	require.True(t, call(filter, "/lnrpc.Lightning/GetInfo", grpc))
+	require.True(t, call(filter, "/routerrpc.Router/Get", grpcWeb))
+	require.False(t, call(filter, "/lnrpc.Lightning/SendCoins", grpc))
+	require.False(t, call(filter, "/routerrpc.Router/Send", grpc))
+	require.False(t, call(filter, "/lnrpc.Lightning//SendCoins", grpc))
+
+	// With a list of allowed methods, requests that don't call any method
+	// are rejected.
+	require.False(t, call(filter, "/index.html", "text/html"))
+
+	// With only denied methods, everything else is allowed.
+	filter, err = newMethodFilter(&MethodsConfig{
+		Deny: []string{"lnrpc.Lightning/SendCoins"},
+	})
+	require.NoError(t, err)
+	require.True(t, call(filter, "/lnrpc.Lightning/GetInfo", grpc))
+	require.False(t, call(filter, "/lnrpc.Lightning/SendCoins", grpc))
+	require.True(t, call(filter, "/index.html", "text/html"))
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// hdrNonce is the header field clients send the nonce of a request in.
+	// gRPC clients send it as metadata with the same name.
+	hdrNonce = "Aperture-Nonce"
+)
+
+// NonceStore is an entity that keeps track of the latest nonce that was used
+// with each token, so requests that are replayed with a token can be detected.
+type NonceStore interface {
+	// UseNonce records the nonce as the latest one of the token if it's
+	// greater than all nonces previously used with the token. If it isn't,
+	// false is returned and nothing is changed.
+	UseNonce(context.Context, lsat.TokenID, uint64) (bool, error)
+}
+
+// memNonceStore is a NonceStore that keeps the nonces in memory.
+type memNonceStore struct {
+	sync.Mutex
+	nonces map[lsat.TokenID]uint64
+}
+
+// A compile-time constraint to ensure memNonceStore implements NonceStore.
+var _ NonceStore = (*memNonceStore)(nil)
+
+// newMemNonceStore creates a new, empty in-memory nonce store.
+func newMemNonceStore() *memNonceStore {
+	return &memNonceStore{
+		nonces: make(map[lsat.TokenID]uint64),
+	}
+}
+
+// UseNonce records the nonce as the latest one of the token if it's greater
+// than all nonces previously used with the token.
+//
+// NOTE: This is part of the NonceStore interface.
+func (s *memNonceStore) UseNonce(_ context.Context, tokenID lsat.TokenID,
+	nonce uint64) (bool, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if last, ok := s.nonces[tokenID]; ok && nonce <= last {
+		return false, nil
+	}
+	s.nonces[tokenID] = nonce
+	return true, nil
+}
+
+// needsNonce returns true if the nonce of requests made with the given token
+// must be checked. This is the case if the service requires it or if the token
+// itself carries a nonce caveat, which the holder of a token can add before
+// handing it to someone else.
+func needsNonce(target *Service, header http.Header) bool {
+	if target.RequireNonce {
+		return true
+	}
+
+	mac, _, err := lsat.FromHeader(&header)
+	if err != nil {
+		return false
+	}
+	_, ok := lsat.HasCaveat(mac, lsat.CondNonce)
+	return ok
+}
+
+// checkNonce makes sure an authenticated request carries a nonce that wasn't
+// used with its token before. If it doesn't, an error response is sent to the
+// client and false is returned.
+func (p *Proxy) checkNonce(w http.ResponseWriter, r *http.Request,
+	target *Service, prefixLog *PrefixLog) bool {
+
+	if !needsNonce(target, r.Header) {
+		return true
+	}
+
+	tokenID, err := tokenIDFromHeader(r.Header)
+	if err != nil {
+		prefixLog.Errorf("Error reading token for nonce: %v", err)
+		sendDirectResponse(w, r, http.StatusUnauthorized, "invalid token")
+		return false
+	}
+
+	nonce, err := strconv.ParseUint(r.Header.Get(hdrNonce), 10, 64)
+	if err != nil {
+		prefixLog.Infof("Request without valid nonce rejected.")
+		sendDirectResponse(
+			w, r, http.StatusBadRequest, "nonce required",
+		)
+		return false
+	}
+
+	ok, err := p.nonceStore.UseNonce(r.Context(), tokenID, nonce)
+	if err != nil {
+		prefixLog.Errorf("Error checking nonce: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "nonce failure",
+		)
+		return false
+	}
+	if !ok {
+		prefixLog.Infof("Replayed nonce %d rejected.", nonce)
+		sendDirectResponse(
+			w, r, http.StatusConflict, "nonce already used",
+		)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// HeaderNostrPubKey is the header field the hex encoded nostr public
+	// key that signed the NIP-98 auth event of a request is forwarded to
+	// the backend in.
+	HeaderNostrPubKey = "X-Aperture-Nostr-Pubkey"
+
+	// CaptureAuthNostr is the auth outcome of requests that were only
+	// authenticated with a NIP-98 auth event.
+	CaptureAuthNostr = "nostr"
+)
+
+// NostrConfig holds the options of a service with the "nostr" auth level.
+// Requests to it must carry a NIP-98 HTTP auth event signed by a nostr
+// identity in the Authorization header field.
+type NostrConfig struct {
+	// PubKeys are the npub or hex encoded public keys that are granted
+	// access. Any identity is if none is set.
+	PubKeys []string `long:"pubkey" description:"An npub or hex encoded public key that is granted access, can be given multiple times (default: any)"`
+
+	// RequireLSAT can be set to also require a paid token. It can't be
+	// sent in the Authorization header field next to the auth event, so
+	// it's sent in the Macaroon or custom token header fields instead.
+	RequireLSAT bool `long:"requirelsat" description:"Also require a paid token, sent in the Macaroon or custom token header fields"`
+
+	// MaxAge is the time an auth event may have been created before or
+	// after the request it authenticates.
+	MaxAge time.Duration `long:"maxage" description:"The time an auth event may have been created before or after its request (default 1m)"`
+}
+
+// prepareNostr checks the nostr options of the service and decodes the public
+// keys that are granted access.
+func prepareNostr(service *Service) error {
+	cfg := &service.Nostr
+	if cfg.MaxAge == 0 {
+		cfg.MaxAge = auth.DefaultNIP98MaxAge
+	}
+	if cfg.MaxAge < 0 {
+		return fmt.Errorf("invalid max age %v", cfg.MaxAge)
+	}
+
+	service.nostrPubKeys = nil
+	if len(cfg.PubKeys) == 0 {
+		return nil
+	}
+	service.nostrPubKeys = make(map[string]bool, len(cfg.PubKeys))
+	for _, key := range cfg.PubKeys {
+		pubKey, err := auth.ParseNostrPubKey(key)
+		if err != nil {
+			return err
+		}
+		service.nostrPubKeys[pubKey] = true
+	}
+
+	return nil
+}
+
+// takeNostrAuth removes the NIP-98 auth event from the Authorization header
+// field of a request to a service with the nostr auth level and returns it, so
+// the header field can carry a token instead. The pubkey header field the
+// proxy forwards is removed too, so clients can't set it themselves.
+func takeNostrAuth(r *http.Request, target *Service) string {
+	if !target.Auth.IsNostr() {
+		return ""
+	}
+
+	r.Header.Del(HeaderNostrPubKey)
+	r.Header.Del(grpcMetadataHeaderPrefix + HeaderNostrPubKey)
+
+	value := r.Header.Get(lsat.HeaderAuthorization)
+	if !strings.HasPrefix(value, auth.SchemeNostr+" ") {
+		return ""
+	}
+	r.Header.Del(lsat.HeaderAuthorization)
+
+	return value
+}
+
+// checkNostr verifies the NIP-98 auth event of a request to the target service
+// and forwards the public key that signed it to the backend. Requests without
+// a valid event of an allowed identity are answered and false is returned.
+func checkNostr(w http.ResponseWriter, r *http.Request, target *Service,
+	authHeader string, prefixLog *PrefixLog) bool {
+
+	pubKey, err := auth.VerifyNIP98(
+		authHeader, r, target.Nostr.MaxAge, time.Now(),
+	)
+	if err != nil {
+		prefixLog.Infof("Invalid nostr auth event: %v", err)
+		traceFromRequest(r).logf("Invalid nostr auth event: %v", err)
+		w.Header().Set(hdrWWWAuthenticate, auth.SchemeNostr)
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized,
+			"valid nostr auth event required",
+		)
+		return false
+	}
+
+	if target.nostrPubKeys != nil && !target.nostrPubKeys[pubKey] {
+		prefixLog.Infof("Nostr public key %s not allowed", pubKey)
+		traceFromRequest(r).logf("Nostr public key %s not allowed",
+			pubKey)
+		sendDirectResponse(
+			w, r, http.StatusForbidden,
+			"nostr public key not allowed",
+		)
+		return false
+	}
+
+	traceFromRequest(r).logf("Nostr auth event of %s accepted", pubKey)
+	r.Header.Set(HeaderNostrPubKey, pubKey)
+	return true
+}
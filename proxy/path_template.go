@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// templateSegment is a single segment of a google.api.http path template.
+type templateSegment struct {
+	// literal is the literal value the path segment must have. It is empty
+	// for wildcard segments.
+	literal string
+
+	// wildcard is true if the segment matches exactly one path segment
+	// ("*").
+	wildcard bool
+
+	// deepWildcard is true if the segment matches zero or more path
+	// segments ("**"). It can only be the last segment of a template.
+	deepWildcard bool
+
+	// fieldPath is the dot separated path of the request message field the
+	// matched segment is bound to. It is empty if the segment isn't part of
+	// a variable.
+	fieldPath string
+}
+
+// pathTemplate is a parsed google.api.http path template, for example
+// "/v1/{name=shelves/*}/books/{book_id}:publish".
+type pathTemplate struct {
+	segments []templateSegment
+	verb     string
+}
+
+// parsePathTemplate parses a path template as defined in the google.api.http
+// annotation specification.
+func parsePathTemplate(template string) (*pathTemplate, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("path template %s must start with /",
+			template)
+	}
+	rest := template[1:]
+
+	// A verb can only follow the last segment, which means there must not
+	// be any slash or closing brace after it.
+	verb := ""
+	if idx := strings.LastIndex(rest, ":"); idx >= 0 &&
+		idx > strings.LastIndex(rest, "/") &&
+		idx > strings.LastIndex(rest, "}") {
+
+		verb = rest[idx+1:]
+		rest = rest[:idx]
+	}
+
+	t := &pathTemplate{verb: verb}
+	for len(rest) > 0 {
+		// A variable can contain slashes so we need to parse until the
+		// closing brace.
+		if rest[0] == '{' {
+			end := strings.Index(rest, "}")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated variable "+
+					"in path template %s", template)
+			}
+
+			variable := rest[1:end]
+			rest = rest[end+1:]
+
+			fieldPath, pattern := variable, "*"
+			if idx := strings.Index(variable, "="); idx >= 0 {
+				fieldPath = variable[:idx]
+				pattern = variable[idx+1:]
+			}
+			if fieldPath == "" {
+				return nil, fmt.Errorf("empty variable name "+
+					"in path template %s", template)
+			}
+
+			for _, part := range strings.Split(pattern, "/") {
+				segment, err := newTemplateSegment(part)
+				if err != nil {
+					return nil, err
+				}
+				segment.fieldPath = fieldPath
+				t.segments = append(t.segments, segment)
+			}
+		} else {
+			end := strings.Index(rest, "/")
+			if end < 0 {
+				end = len(rest)
+			}
+
+			segment, err := newTemplateSegment(rest[:end])
+			if err != nil {
+				return nil, err
+			}
+			t.segments = append(t.segments, segment)
+			rest = rest[end:]
+		}
+
+		switch {
+		case len(rest) == 0:
+
+		case rest[0] == '/':
+			rest = rest[1:]
+			if len(rest) == 0 {
+				return nil, fmt.Errorf("path template %s must "+
+					"not end with /", template)
+			}
+
+		default:
+			return nil, fmt.Errorf("unexpected character in path "+
+				"template %s", template)
+		}
+	}
+
+	// Make sure a deep wildcard is only used at the very end.
+	for i, segment := range t.segments {
+		if segment.deepWildcard && i != len(t.segments)-1 {
+			return nil, fmt.Errorf("** must be the last segment in "+
+				"path template %s", template)
+		}
+	}
+
+	return t, nil
+}
+
+// newTemplateSegment creates a template segment from its string form.
+func newTemplateSegment(s string) (templateSegment, error) {
+	switch {
+	case s == "":
+		return templateSegment{}, fmt.Errorf("empty path segment")
+
+	case s == "*":
+		return templateSegment{wildcard: true}, nil
+
+	case s == "**":
+		return templateSegment{deepWildcard: true}, nil
+
+	case strings.ContainsAny(s, "{}*="):
+		return templateSegment{}, fmt.Errorf("invalid path segment %s",
+			s)
+
+	default:
+		return templateSegment{literal: s}, nil
+	}
+}
+
+// match checks whether the given URL path matches the template. If it does,
+// the values of all variables are returned, keyed by their field path.
+func (t *pathTemplate) match(path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	path = path[1:]
+
+	if t.verb != "" {
+		if !strings.HasSuffix(path, ":"+t.verb) {
+			return nil, false
+		}
+		path = strings.TrimSuffix(path, ":"+t.verb)
+	}
+
+	var parts []string
+	if path != "" {
+		parts = strings.Split(path, "/")
+	}
+
+	values := make(map[string][]string)
+	for i, segment := range t.segments {
+		if segment.deepWildcard {
+			if i > len(parts) {
+				return nil, false
+			}
+			if segment.fieldPath != "" && i < len(parts) {
+				values[segment.fieldPath] = append(
+					values[segment.fieldPath], parts[i:]...,
+				)
+			}
+			parts = parts[:i]
+			break
+		}
+
+		if i >= len(parts) {
+			return nil, false
+		}
+		if !segment.wildcard && segment.literal != parts[i] {
+			return nil, false
+		}
+
+		if segment.fieldPath != "" {
+			values[segment.fieldPath] = append(
+				values[segment.fieldPath], parts[i],
+			)
+		}
+	}
+
+	// All path segments must have been consumed by the template, unless
+	// the last segment was a deep wildcard.
+	lastIsDeep := len(t.segments) > 0 &&
+		t.segments[len(t.segments)-1].deepWildcard
+	if !lastIsDeep && len(parts) != len(t.segments) {
+		return nil, false
+	}
+
+	result := make(map[string]string, len(values))
+	for fieldPath, segments := range values {
+		value, err := url.PathUnescape(strings.Join(segments, "/"))
+		if err != nil {
+			return nil, false
+		}
+		result[fieldPath] = value
+	}
+
+	return result, true
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestPathTemplateMatch makes sure google.api.http path templates are parsed
+// and matched correctly.
+func TestPathTemplateMatch(t *testing.T) {
+	testCases := []struct {
+		name     string
+		template string
+		path     string
+		match    bool
+		vars     map[string]string
+	}{{
+		name:     "literal only",
+		template: "/v1/info",
+		path:     "/v1/info",
+		match:    true,
+		vars:     map[string]string{},
+	}, {
+		name:     "literal mismatch",
+		template: "/v1/info",
+		path:     "/v1/infos",
+		match:    false,
+	}, {
+		name:     "simple variable",
+		template: "/v1/invoice/{r_hash_str}",
+		path:     "/v1/invoice/abcd",
+		match:    true,
+		vars:     map[string]string{"r_hash_str": "abcd"},
+	}, {
+		name:     "too many segments",
+		template: "/v1/invoice/{r_hash_str}",
+		path:     "/v1/invoice/abcd/efgh",
+		match:    false,
+	}, {
+		name:     "nested field and escaping",
+		template: "/v1/shelves/{shelf.id}/books/{book}",
+		path:     "/v1/shelves/1/books/a%20b",
+		match:    true,
+		vars: map[string]string{
+			"shelf.id": "1",
+			"book":     "a b",
+		},
+	}, {
+		name:     "variable with pattern",
+		template: "/v1/{name=shelves/*}/books",
+		path:     "/v1/shelves/s1/books",
+		match:    true,
+		vars:     map[string]string{"name": "shelves/s1"},
+	}, {
+		name:     "deep wildcard",
+		template: "/v1/files/{path=**}",
+		path:     "/v1/files/a/b/c",
+		match:    true,
+		vars:     map[string]string{"path": "a/b/c"},
+	}, {
+		name:     "deep wildcard empty",
+		template: "/v1/files/{path=**}",
+		path:     "/v1/files",
+		match:    true,
+		vars:     map[string]string{},
+	}, {
+		name:     "verb",
+		template: "/v1/{name}:publish",
+		path:     "/v1/book:publish",
+		match:    true,
+		vars:     map[string]string{"name": "book"},
+	}, {
+		name:     "verb missing",
+		template: "/v1/{name}:publish",
+		path:     "/v1/book",
+		match:    false,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			template, err := parsePathTemplate(tc.template)
+			require.NoError(t, err)
+
+			vars, ok := template.match(tc.path)
+			require.Equal(t, tc.match, ok)
+			if tc.match {
+				require.Equal(t, tc.vars, vars)
+			}
+		})
+	}
+}
+
+// TestParsePathTemplateInvalid makes sure invalid path templates are rejected.
+func TestParsePathTemplateInvalid(t *testing.T) {
+	invalid := []string{
+		"v1/info",
+		"/v1/info/",
+		"/v1/{name",
+		"/v1/{=*}",
+		"/v1/**/books",
+		"/v1//info",
+	}
+	for _, template := range invalid {
+		_, err := parsePathTemplate(template)
+		require.Error(t, err, template)
+	}
+}
@@ -0,0 +1,417 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightninglabs/aperture/qrcode"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
+)
+
+const (
+	// paywallPathPrefix is the prefix of all endpoints that belong to the
+	// payment page and the paywall script.
+	paywallPathPrefix = "/.aperture/paywall/"
+
+	// paywallSettlePath is the path of the endpoint the payment page sends
+	// the macaroon and optionally the preimage to once the invoice is
+	// paid.
+	paywallSettlePath = paywallPathPrefix + "settle"
+
+	// paywallCookieMaxAge is the time a browser keeps the LSAT cookie that
+	// is set after the payment.
+	paywallCookieMaxAge = 365 * 24 * time.Hour
+
+	// hdrAccept is the HTTP header field a browser uses to announce the
+	// content types it understands.
+	hdrAccept = "Accept"
+
+	// qrCodeBorder is the number of light modules around the QR code of
+	// the invoice.
+	qrCodeBorder = 4
+
+	// hdrWWWAuthenticate is the HTTP header field that contains the LSAT
+	// challenge.
+	hdrWWWAuthenticate = "WWW-Authenticate"
+)
+
+var (
+	// challengeRegex extracts the macaroon and the invoice from an LSAT
+	// challenge header value.
+	challengeRegex = regexp.MustCompile(
+		"(?:LSAT|L402) macaroon=\"(.*?)\", invoice=\"(.*?)\"",
+	)
+
+	// paymentPageTemplate is the page that is shown to browsers that
+	// request a resource that requires payment.
+	paymentPageTemplate = template.Must(template.New("paywall").Parse(
+		paymentPageHTML,
+	))
+)
+
+// paymentPageData is the data the payment page template is rendered with.
+type paymentPageData struct {
+	Service    string
+	Price      int64
+	Macaroon   string
+	Invoice    string
+	QRCode     template.HTML
+	LNURL      string
+	SettlePath string
+}
+
+// wantsPaymentPage returns true if the request was most likely sent by a
+// browser that navigated to a page directly and can display a HTML payment
+// page instead of the plain 402 answer.
+func wantsPaymentPage(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	if strings.HasPrefix(r.Header.Get(hdrContentType), hdrTypeGrpc) ||
+		isGRPCWebRequest(r) {
+
+		return false
+	}
+
+	return strings.Contains(r.Header.Get(hdrAccept), "text/html")
+}
+
+// isPaywallRequest returns true if the request is addressed to one of the
+// endpoints of the payment page or the paywall script.
+func isPaywallRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, paywallPathPrefix)
+}
+
+// handlePaywall dispatches a request to the endpoint of the payment page or the
+// paywall script it is addressed to.
+func (p *Proxy) handlePaywall(w http.ResponseWriter, r *http.Request,
+	prefixLog *PrefixLog) {
+
+	switch {
+	case r.URL.Path == paywallSettlePath:
+		p.handlePaywallSettle(w, r, prefixLog)
+
+	case r.URL.Path == PaywallScriptPath:
+		sendPaywallScript(w, r)
+
+	case r.URL.Path == paywallQRCodePath:
+		sendInvoiceQRCode(w, r)
+
+	case strings.HasPrefix(r.URL.Path, paywallStatusPathPrefix):
+		p.handlePaymentStatus(w, r, prefixLog)
+
+	default:
+		sendDirectResponse(w, r, http.StatusNotFound, "not found")
+	}
+}
+
+// sendPaymentPage renders the payment page for the given challenge header
+// value. The page is sent with the 402 status code, so clients that don't
+// render it still know a payment is required.
+func (p *Proxy) sendPaymentPage(w http.ResponseWriter, r *http.Request,
+	serviceName string, servicePrice int64, challenge string) {
+
+	matches := challengeRegex.FindStringSubmatch(challenge)
+	if len(matches) != 3 {
+		log.Errorf("Invalid challenge for payment page: %s", challenge)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"challenge failure",
+		)
+		return
+	}
+
+	// Wallets that only speak LNURL can pay the invoice through the
+	// LNURL-pay endpoint of the challenge.
+	var lnurl string
+	if p.invoiceFetcher != nil {
+		_, hash, err := parsePaywallMacaroon(matches[1])
+		if err == nil {
+			lnurl, err = lnurlEndpoint(r, hash)
+		}
+		if err != nil {
+			log.Errorf("Error creating LNURL: %v", err)
+		}
+	}
+
+	// We render into a buffer first so a template error doesn't leave us
+	// with a half written response.
+	var buf bytes.Buffer
+	err := paymentPageTemplate.Execute(&buf, &paymentPageData{
+		Service:    serviceName,
+		Price:      servicePrice,
+		Macaroon:   matches[1],
+		Invoice:    matches[2],
+		QRCode:     invoiceQRCode(matches[2]),
+		LNURL:      lnurl,
+		SettlePath: paywallSettlePath,
+	})
+	if err != nil {
+		log.Errorf("Error rendering payment page: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"challenge failure",
+		)
+		return
+	}
+
+	w.Header().Set(hdrContentType, "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusPaymentRequired)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// invoiceQRCode renders the invoice as an SVG QR code that can be scanned by
+// mobile wallets. The invoice is encoded as upper case lightning: URI because
+// that allows the more compact alphanumeric mode of the QR code. If the code
+// can't be created, the page is shown without it.
+func invoiceQRCode(invoice string) template.HTML {
+	code, err := qrcode.Encode(
+		"LIGHTNING:"+strings.ToUpper(invoice), qrcode.Medium,
+	)
+	if err != nil {
+		log.Errorf("Error creating invoice QR code: %v", err)
+		return ""
+	}
+
+	// The SVG is created by us and only consists of fixed markup and
+	// numbers, so it's safe to embed directly.
+	return template.HTML(code.SVG(qrCodeBorder))
+}
+
+// MacaroonVerifier is an entity that makes sure macaroons were minted by us,
+// like the mint.
+type MacaroonVerifier interface {
+	// VerifyMacaroon ensures the macaroon was minted by us and wasn't
+	// revoked, without requiring the preimage of its invoice. The
+	// first-party caveats of the macaroon are returned, but not checked.
+	VerifyMacaroon(context.Context, *macaroon.Macaroon) ([]lsat.Caveat,
+		error)
+}
+
+// handlePaywallSettle handles the requests of the payment page to the settle
+// endpoint. The page either sends the macaroon together with the preimage it
+// got from a WebLN wallet or only the macaroon, in which case the preimage is
+// looked up with the preimage fetcher once the invoice is paid. The preimage
+// is only looked up for macaroons we minted ourselves, so the endpoint can't
+// be used to learn the preimage of any other invoice of the node. If the
+// preimage is known, the LSAT is set as a cookie so the browser can access the
+// protected resource from now on.
+func (p *Proxy) handlePaywallSettle(w http.ResponseWriter, r *http.Request,
+	prefixLog *PrefixLog) {
+
+	if r.Method != http.MethodPost {
+		sendDirectResponse(
+			w, r, http.StatusMethodNotAllowed, "method not allowed",
+		)
+		return
+	}
+
+	mac, hash, err := parsePaywallMacaroon(r.PostFormValue("macaroon"))
+	if err != nil {
+		prefixLog.Debugf("Invalid paywall settle request: %v", err)
+		sendDirectResponse(w, r, http.StatusBadRequest, "invalid macaroon")
+		return
+	}
+
+	var preimage lntypes.Preimage
+	switch preimageHex := r.PostFormValue("preimage"); {
+	// The wallet told us the preimage, we only need to make sure it
+	// actually belongs to the macaroon's invoice.
+	case preimageHex != "":
+		preimage, err = lntypes.MakePreimageFromStr(preimageHex)
+		if err != nil || !preimage.Matches(hash) {
+			sendDirectResponse(
+				w, r, http.StatusBadRequest, "invalid preimage",
+			)
+			return
+		}
+
+	// Without a way to look up the preimage, the client can only wait for
+	// the payment page to send it.
+	case p.preimageFetcher == nil || p.macaroonVerifier == nil:
+		sendDirectResponse(
+			w, r, http.StatusPaymentRequired, "payment required",
+		)
+		return
+
+	default:
+		_, err := p.macaroonVerifier.VerifyMacaroon(r.Context(), mac)
+		if err != nil {
+			prefixLog.Debugf("Invalid paywall settle macaroon: %v",
+				err)
+			sendDirectResponse(
+				w, r, http.StatusBadRequest, "invalid macaroon",
+			)
+			return
+		}
+
+		preimage, err = p.preimageFetcher.FetchPreimage(
+			r.Context(), hash,
+		)
+		switch {
+		case err == auth.ErrInvoiceNotSettled:
+			sendDirectResponse(
+				w, r, http.StatusPaymentRequired,
+				"payment required",
+			)
+			return
+
+		case err == mint.ErrChallengerBusy:
+			sendBusyResponse(w, r)
+			return
+
+		case err != nil:
+			prefixLog.Errorf("Error fetching preimage: %v", err)
+			sendDirectResponse(
+				w, r, http.StatusInternalServerError,
+				"preimage lookup failure",
+			)
+			return
+		}
+	}
+
+	value, err := lsat.CookieValue(mac, preimage)
+	if err != nil {
+		prefixLog.Errorf("Error encoding LSAT cookie: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "cookie failure",
+		)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     lsat.CookieName,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(paywallCookieMaxAge.Seconds()),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	prefixLog.Infof("Payment page LSAT settled for payment hash %v", hash)
+	w.WriteHeader(http.StatusOK)
+}
+
+// parsePaywallMacaroon decodes the base64 encoded macaroon the payment page
+// sends and returns its payment hash.
+func parsePaywallMacaroon(macBase64 string) (*macaroon.Macaroon,
+	lntypes.Hash, error) {
+
+	macBytes, err := base64.StdEncoding.DecodeString(macBase64)
+	if err != nil {
+		return nil, lntypes.Hash{}, err
+	}
+	mac := &macaroon.Macaroon{}
+	if err := mac.UnmarshalBinary(macBytes); err != nil {
+		return nil, lntypes.Hash{}, err
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return nil, lntypes.Hash{}, err
+	}
+
+	return mac, id.PaymentHash, nil
+}
+
+// paymentPageHTML is the template of the payment page. It shows the invoice
+// as text and QR code, offers to pay it through a WebLN enabled browser wallet,
+// any wallet that handles lightning: links or an LNURL wallet and polls the
+// settle endpoint until the payment was received. The page is then reloaded, this time with the LSAT cookie set.
+const paymentPageHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Payment required</title>
+  <style>
+    body { font-family: sans-serif; max-width: 40em; margin: 3em auto;
+      padding: 0 1em; color: #222; }
+    .qrcode svg { width: 100%; max-width: 20em; display: block;
+      margin: 1em auto; }
+    .invoice { word-break: break-all; font-family: monospace;
+      background: #f3f3f3; padding: 1em; border-radius: 4px; }
+    .actions a, .actions button { display: inline-block; margin: 1em 1em 0 0;
+      padding: .6em 1.2em; font-size: 1em; }
+    #status { margin-top: 2em; color: #666; }
+  </style>
+</head>
+<body>
+  <h1>Payment required</h1>
+  <p>Access to <strong>{{.Service}}</strong> costs {{.Price}} satoshis.
+    Pay the following Lightning invoice to continue.</p>
+  {{if .QRCode}}<div class="qrcode">{{.QRCode}}</div>{{end}}
+  <div class="invoice" id="invoice">{{.Invoice}}</div>
+  <div class="actions">
+    <a href="lightning:{{.Invoice}}">Open in wallet</a>
+    {{if .LNURL}}<a href="lightning:{{.LNURL}}">Pay with LNURL</a>{{end}}
+    <button id="webln" hidden>Pay with browser wallet</button>
+  </div>
+  <p id="status">Waiting for payment...</p>
+  <script>
+    (function() {
+      var macaroon = {{.Macaroon}};
+      var invoice = {{.Invoice}};
+      var settlePath = {{.SettlePath}};
+      var status = document.getElementById("status");
+      var done = false;
+
+      function settle(preimage) {
+        var body = new URLSearchParams();
+        body.append("macaroon", macaroon);
+        if (preimage) {
+          body.append("preimage", preimage);
+        }
+        return fetch(settlePath, {
+          method: "POST",
+          credentials: "same-origin",
+          body: body
+        }).then(function(resp) {
+          if (resp.status === 200 && !done) {
+            done = true;
+            status.textContent = "Payment received, loading...";
+            window.location.reload();
+          }
+          return resp.status === 200;
+        });
+      }
+
+      function poll() {
+        if (done) {
+          return;
+        }
+        settle("").catch(function() {}).then(function() {
+          setTimeout(poll, 2000);
+        });
+      }
+
+      if (window.webln) {
+        var button = document.getElementById("webln");
+        button.hidden = false;
+        button.addEventListener("click", function() {
+          window.webln.enable().then(function() {
+            return window.webln.sendPayment(invoice);
+          }).then(function(result) {
+            return settle(result.preimage);
+          }).catch(function(err) {
+            status.textContent = "Payment failed: " + err.message;
+          });
+        });
+      }
+
+      setTimeout(poll, 2000);
+    })();
+  </script>
+</body>
+</html>
+`
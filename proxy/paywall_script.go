@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/lightninglabs/aperture/qrcode"
+)
+
+const (
+	// PaywallScriptPath is the path the paywall script is served at, for
+	// pages that include it.
+	PaywallScriptPath = paywallPathPrefix + "lsat.js"
+
+	// paywallQRCodePath is the path of the endpoint that renders the QR
+	// code of an invoice for the paywall script.
+	paywallQRCodePath = paywallPathPrefix + "qrcode.svg"
+)
+
+// sendPaywallScript sends the paywall script that web pages can include to
+// handle LSAT challenges of their fetch and XMLHttpRequest calls.
+func sendPaywallScript(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sendDirectResponse(
+			w, r, http.StatusMethodNotAllowed, "method not allowed",
+		)
+		return
+	}
+
+	w.Header().Set(hdrContentType, "application/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	_, _ = w.Write([]byte(paywallScriptJS))
+}
+
+// sendInvoiceQRCode renders the invoice in the query of the request as SVG QR
+// code.
+func sendInvoiceQRCode(w http.ResponseWriter, r *http.Request) {
+	invoice := r.URL.Query().Get("invoice")
+	if !strings.HasPrefix(strings.ToLower(invoice), "ln") {
+		sendDirectResponse(w, r, http.StatusBadRequest, "invalid invoice")
+		return
+	}
+
+	code, err := qrcode.Encode(
+		"LIGHTNING:"+strings.ToUpper(invoice), qrcode.Medium,
+	)
+	if err != nil {
+		sendDirectResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set(hdrContentType, "image/svg+xml")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	_, _ = w.Write([]byte(code.SVG(qrCodeBorder)))
+}
+
+// paywallScriptJS is the paywall script. It wraps window.fetch and
+// XMLHttpRequest so that any request that is answered with an LSAT challenge
+// opens a dialog with the invoice. The dialog offers to pay through WebLN and
+// polls the settle endpoint until the invoice is paid. Once the LSAT cookie is
+// set, the original request is sent again and its caller only ever sees the
+// final response. If the user closes the dialog, the caller gets the 402
+// response instead.
+const paywallScriptJS = `(function() {
+  "use strict";
+
+  var settlePath = "` + paywallSettlePath + `";
+  var qrCodePath = "` + paywallQRCodePath + `";
+  var challengeRegex = /(?:LSAT|L402) macaroon="([^"]*)", invoice="([^"]*)"/;
+
+  // Every challenge contains a new invoice, but one paid LSAT is enough for
+  // all of them. Requests that are challenged while a payment is in progress
+  // therefore wait for that payment.
+  var payment = null;
+
+  function findChallenge(header) {
+    var matches = header ? challengeRegex.exec(header) : null;
+    if (!matches) {
+      return null;
+    }
+    return {macaroon: matches[1], invoice: matches[2]};
+  }
+
+  function settle(macaroon, preimage) {
+    var body = new URLSearchParams();
+    body.append("macaroon", macaroon);
+    if (preimage) {
+      body.append("preimage", preimage);
+    }
+    return origFetch(settlePath, {
+      method: "POST",
+      credentials: "same-origin",
+      body: body
+    }).then(function(resp) {
+      return resp.status === 200;
+    });
+  }
+
+  function element(tag, style, text) {
+    var el = document.createElement(tag);
+    el.style.cssText = style || "";
+    if (text) {
+      el.textContent = text;
+    }
+    return el;
+  }
+
+  function showDialog(challenge) {
+    return new Promise(function(resolve, reject) {
+      var overlay = element("div", "position:fixed;top:0;left:0;" +
+        "right:0;bottom:0;z-index:2147483647;display:flex;" +
+        "align-items:center;justify-content:center;" +
+        "background:rgba(0,0,0,.6);font-family:sans-serif;");
+      var box = element("div", "background:#fff;color:#222;" +
+        "max-width:24em;width:90%;padding:1.5em;border-radius:6px;" +
+        "text-align:center;");
+      var qrCode = element("img", "width:100%;max-width:16em;");
+      qrCode.src = qrCodePath + "?invoice=" +
+        encodeURIComponent(challenge.invoice);
+      qrCode.alt = "Invoice QR code";
+      var invoice = element("div", "word-break:break-all;" +
+        "font-family:monospace;font-size:.8em;background:#f3f3f3;" +
+        "padding:.5em;margin:.5em 0;", challenge.invoice);
+      var link = element("a", "display:inline-block;margin:.5em;",
+        "Open in wallet");
+      link.href = "lightning:" + challenge.invoice;
+      var status = element("p", "color:#666;", "Waiting for payment...");
+      var cancel = element("button", "margin:.5em;", "Cancel");
+
+      box.appendChild(element("h2", "margin-top:0;", "Payment required"));
+      box.appendChild(qrCode);
+      box.appendChild(invoice);
+      box.appendChild(link);
+
+      var done = false;
+      var timer = null;
+      function finish(paid) {
+        if (done) {
+          return;
+        }
+        done = true;
+        clearTimeout(timer);
+        document.body.removeChild(overlay);
+        if (paid) {
+          resolve();
+        } else {
+          reject(new Error("payment cancelled"));
+        }
+      }
+
+      function poll() {
+        settle(challenge.macaroon, "").then(function(paid) {
+          if (paid) {
+            finish(true);
+          }
+        }, function() {}).then(function() {
+          if (!done) {
+            timer = setTimeout(poll, 2000);
+          }
+        });
+      }
+
+      if (window.webln) {
+        var webln = element("button", "margin:.5em;",
+          "Pay with browser wallet");
+        webln.addEventListener("click", function() {
+          window.webln.enable().then(function() {
+            return window.webln.sendPayment(challenge.invoice);
+          }).then(function(result) {
+            return settle(challenge.macaroon, result.preimage);
+          }).then(function(paid) {
+            if (paid) {
+              finish(true);
+            }
+          }).catch(function(err) {
+            status.textContent = "Payment failed: " + err.message;
+          });
+        });
+        box.appendChild(webln);
+      }
+
+      cancel.addEventListener("click", function() {
+        finish(false);
+      });
+      box.appendChild(cancel);
+      box.appendChild(status);
+      overlay.appendChild(box);
+      document.body.appendChild(overlay);
+
+      timer = setTimeout(poll, 2000);
+    });
+  }
+
+  function pay(challenge) {
+    if (!payment) {
+      payment = showDialog(challenge).then(function() {
+        payment = null;
+      }, function(err) {
+        payment = null;
+        throw err;
+      });
+    }
+    return payment;
+  }
+
+  var origFetch = window.fetch.bind(window);
+  window.fetch = function(input, init) {
+    // A request object can only be sent once, so we keep a copy for the
+    // retry.
+    var retry = input instanceof Request ? input.clone() : input;
+    return origFetch(input, init).then(function(resp) {
+      var challenge = resp.status === 402 &&
+        findChallenge(resp.headers.get("WWW-Authenticate"));
+      if (!challenge) {
+        return resp;
+      }
+      return pay(challenge).then(function() {
+        return origFetch(retry, init);
+      }, function() {
+        return resp;
+      });
+    });
+  };
+
+  // To hide the challenge from the caller of an XMLHttpRequest, we need to
+  // be the first event listener of every instance, so we already register it
+  // in the constructor.
+  var OrigXHR = window.XMLHttpRequest;
+  var origOpen = OrigXHR.prototype.open;
+  var origSend = OrigXHR.prototype.send;
+  var origSetRequestHeader = OrigXHR.prototype.setRequestHeader;
+
+  function hookXHR(xhr) {
+    function intercept(event) {
+      var state = xhr._lsat;
+      if (!state || xhr.readyState !== 4) {
+        return;
+      }
+      if (state.suppress) {
+        event.stopImmediatePropagation();
+        return;
+      }
+      if (event.type !== "readystatechange" || state.retried ||
+        xhr.status !== 402) {
+
+        return;
+      }
+      var challenge = findChallenge(
+        xhr.getResponseHeader("WWW-Authenticate"));
+      if (!challenge) {
+        return;
+      }
+
+      // Hide all events of the challenged request and send it again
+      // once the payment is done.
+      state.suppress = true;
+      event.stopImmediatePropagation();
+      pay(challenge).then(function() {
+        state.suppress = false;
+        state.retried = true;
+        origOpen.apply(xhr, state.open);
+        state.headers.forEach(function(header) {
+          origSetRequestHeader.apply(xhr, header);
+        });
+        origSend.call(xhr, state.body);
+      }, function() {
+        // The caller gets to see the challenge after all.
+        state.suppress = false;
+        state.retried = true;
+        ["readystatechange", "load", "loadend"].forEach(function(type) {
+          xhr.dispatchEvent(new Event(type));
+        });
+      });
+    }
+
+    ["readystatechange", "load", "loadend"].forEach(function(type) {
+      xhr.addEventListener(type, intercept);
+    });
+  }
+
+  function LSATXMLHttpRequest() {
+    var xhr = new OrigXHR();
+    hookXHR(xhr);
+    return xhr;
+  }
+  LSATXMLHttpRequest.prototype = OrigXHR.prototype;
+  ["UNSENT", "OPENED", "HEADERS_RECEIVED", "LOADING", "DONE"].forEach(
+    function(name) {
+      LSATXMLHttpRequest[name] = OrigXHR[name];
+    });
+  window.XMLHttpRequest = LSATXMLHttpRequest;
+
+  OrigXHR.prototype.open = function() {
+    this._lsat = {
+      open: arguments,
+      headers: [],
+      suppress: false,
+      retried: false
+    };
+    return origOpen.apply(this, arguments);
+  };
+  OrigXHR.prototype.setRequestHeader = function(name, value) {
+    if (this._lsat) {
+      this._lsat.headers.push([name, value]);
+    }
+    return origSetRequestHeader.apply(this, arguments);
+  };
+  OrigXHR.prototype.send = function(body) {
+    if (this._lsat) {
+      this._lsat.body = body;
+    }
+    return origSend.apply(this, arguments);
+  };
+})();
+`
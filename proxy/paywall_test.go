@@ -0,0 +1,395 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcutil/bech32"
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+// mockPreimageFetcher is a preimage fetcher that knows the preimages of a fixed
+// set of paid invoices.
+type mockPreimageFetcher struct {
+	preimages map[lntypes.Hash]lntypes.Preimage
+}
+
+// FetchPreimage returns the preimage of a paid invoice.
+func (m *mockPreimageFetcher) FetchPreimage(_ context.Context,
+	hash lntypes.Hash) (lntypes.Preimage, error) {
+
+	preimage, ok := m.preimages[hash]
+	if !ok {
+		return lntypes.Preimage{}, auth.ErrInvoiceNotSettled
+	}
+	return preimage, nil
+}
+
+// mockInvoiceFetcher is an invoice fetcher that knows a fixed set of invoices.
+type mockInvoiceFetcher struct {
+	invoices map[lntypes.Hash]*lnrpc.Invoice
+}
+
+// FetchInvoice returns the invoice with the given payment hash.
+func (m *mockInvoiceFetcher) FetchInvoice(_ context.Context,
+	hash lntypes.Hash) (*lnrpc.Invoice, error) {
+
+	invoice, ok := m.invoices[hash]
+	if !ok {
+		return nil, fmt.Errorf("invoice not found")
+	}
+	return invoice, nil
+}
+
+// mockMacaroonVerifier is a macaroon verifier that accepts the macaroons
+// minted with a fixed root key.
+type mockMacaroonVerifier struct {
+	rootKey []byte
+}
+
+// VerifyMacaroon checks the signature of the macaroon against the root key and
+// returns its caveats.
+func (m *mockMacaroonVerifier) VerifyMacaroon(_ context.Context,
+	mac *macaroon.Macaroon) ([]lsat.Caveat, error) {
+
+	rawCaveats, err := mac.VerifySignature(m.rootKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	caveats := make([]lsat.Caveat, 0, len(rawCaveats))
+	for _, rawCaveat := range rawCaveats {
+		caveat, err := lsat.DecodeCaveat(rawCaveat)
+		if err != nil {
+			return nil, err
+		}
+		caveats = append(caveats, caveat)
+	}
+	return caveats, nil
+}
+
+// paywallRootKey is the root key the macaroons of the payment page tests are
+// minted with.
+var paywallRootKey = []byte("aabbccddeeff00112233445566778899")
+
+// newPaywallMacaroon creates a base64 encoded LSAT macaroon for the given
+// payment hash.
+func newPaywallMacaroon(t *testing.T, hash lntypes.Hash) (*macaroon.Macaroon,
+	string) {
+
+	var buf strings.Builder
+	err := lsat.EncodeIdentifier(&buf, &lsat.Identifier{
+		Version:     lsat.LatestVersion,
+		PaymentHash: hash,
+	})
+	require.NoError(t, err)
+
+	mac, err := macaroon.New(
+		paywallRootKey, []byte(buf.String()), "LSAT",
+		macaroon.LatestVersion,
+	)
+	require.NoError(t, err)
+	macBytes, err := mac.MarshalBinary()
+	require.NoError(t, err)
+
+	return mac, base64.StdEncoding.EncodeToString(macBytes)
+}
+
+// serveTestRequest serves a request to the given path with the proxy, like the
+// helper of the external tests. The Authorization header field is only set if
+// a value is given.
+func serveTestRequest(p *Proxy, method, path, authHeader string,
+	body io.Reader) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(method, "http://localhost:8081"+path, body)
+	if authHeader != "" {
+		req.Header.Set("Authorization", authHeader)
+	}
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestPaymentPage makes sure browsers get the payment page with the invoice and
+// all other clients the plain 402 response.
+func TestPaymentPage(t *testing.T) {
+	challenge := fmt.Sprintf(
+		"LSAT macaroon=\"%s\", invoice=\"%s\"", "bWFj", "lnbc1invoice",
+	)
+
+	req := httptest.NewRequest(http.MethodGet, "/resource", nil)
+	require.False(t, wantsPaymentPage(req))
+
+	req.Header.Set(hdrAccept, "text/html,application/xhtml+xml")
+	require.True(t, wantsPaymentPage(req))
+
+	rec := httptest.NewRecorder()
+	p := &Proxy{}
+	p.sendPaymentPage(rec, req, "service1", 123, challenge)
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	require.Contains(t, rec.Header().Get(hdrContentType), "text/html")
+
+	body := rec.Body.String()
+	require.Contains(t, body, "lightning:lnbc1invoice")
+	require.Contains(t, body, "<svg")
+	require.Contains(t, body, "service1")
+	require.Contains(t, body, "webln.sendPayment")
+	require.Contains(t, body, paywallSettlePath)
+
+	// gRPC clients never get the page, even if they claim to accept HTML.
+	req.Header.Set(hdrContentType, hdrTypeGrpc)
+	require.False(t, wantsPaymentPage(req))
+}
+
+// TestPaywallSettle makes sure the settle endpoint only sets the LSAT cookie if
+// the invoice was paid and the resulting cookie can be parsed as LSAT.
+func TestPaywallSettle(t *testing.T) {
+	preimage := lntypes.Preimage{1, 2, 3}
+	hash := preimage.Hash()
+	mac, macBase64 := newPaywallMacaroon(t, hash)
+
+	fetcher := &mockPreimageFetcher{
+		preimages: make(map[lntypes.Hash]lntypes.Preimage),
+	}
+	p := &Proxy{}
+
+	settle := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(
+			http.MethodPost, paywallSettlePath,
+			strings.NewReader(form.Encode()),
+		)
+		req.Header.Set(
+			hdrContentType, "application/x-www-form-urlencoded",
+		)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// A wrong preimage is rejected.
+	rec := settle(url.Values{
+		"macaroon": {macBase64},
+		"preimage": {lntypes.Preimage{9}.String()},
+	})
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Without a preimage and without a fetcher, we can't know if the
+	// invoice was paid.
+	rec = settle(url.Values{"macaroon": {macBase64}})
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+
+	// Neither without a way to make sure the macaroon is ours.
+	p.SetPreimageFetcher(fetcher)
+	fetcher.preimages[hash] = preimage
+	rec = settle(url.Values{"macaroon": {macBase64}})
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+
+	// The preimage of a paid invoice isn't revealed for a macaroon that
+	// wasn't minted by us.
+	p.SetMacaroonVerifier(&mockMacaroonVerifier{
+		rootKey: []byte("00112233445566778899aabbccddeeff"),
+	})
+	rec = settle(url.Values{"macaroon": {macBase64}})
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Empty(t, rec.Result().Cookies())
+
+	// With a fetcher, the invoice needs to be settled first.
+	p.SetMacaroonVerifier(&mockMacaroonVerifier{rootKey: paywallRootKey})
+	delete(fetcher.preimages, hash)
+	rec = settle(url.Values{"macaroon": {macBase64}})
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+
+	checkCookie := func(rec *httptest.ResponseRecorder) {
+		t.Helper()
+
+		require.Equal(t, http.StatusOK, rec.Code)
+		cookies := rec.Result().Cookies()
+		require.Len(t, cookies, 1)
+		require.Equal(t, lsat.CookieName, cookies[0].Name)
+		require.True(t, cookies[0].HttpOnly)
+
+		header := http.Header{}
+		header.Set("Cookie", lsat.CookieName+"="+cookies[0].Value)
+		cookieMac, cookiePreimage, err := lsat.FromHeader(&header)
+		require.NoError(t, err)
+		require.Equal(t, preimage, cookiePreimage)
+		require.Equal(t, mac.Id(), cookieMac.Id())
+	}
+
+	fetcher.preimages[hash] = preimage
+	checkCookie(settle(url.Values{"macaroon": {macBase64}}))
+
+	// The preimage sent by a WebLN wallet is accepted as well.
+	p.SetPreimageFetcher(nil)
+	checkCookie(settle(url.Values{
+		"macaroon": {macBase64},
+		"preimage": {preimage.String()},
+	}))
+}
+
+// TestLNURL makes sure the LNURL-pay endpoint of a challenge hands out the
+// invoice of the challenge to wallets that ask for the correct amount.
+func TestLNURL(t *testing.T) {
+	hash := lntypes.Preimage{1, 2, 3}.Hash()
+	fetcher := &mockInvoiceFetcher{
+		invoices: map[lntypes.Hash]*lnrpc.Invoice{
+			hash: {
+				PaymentRequest: "lnbc1invoice",
+				ValueMsat:      5000,
+				State:          lnrpc.Invoice_OPEN,
+			},
+		},
+	}
+	p := &Proxy{}
+
+	get := func(url string, response interface{}) {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), response))
+	}
+
+	// The LNURL decodes to the endpoint of the challenge.
+	req := httptest.NewRequest(http.MethodGet, "/resource", nil)
+	lnurl, err := lnurlEndpoint(req, hash)
+	require.NoError(t, err)
+	hrp, data, err := bech32.Decode(strings.ToLower(lnurl))
+	require.NoError(t, err)
+	require.Equal(t, "lnurl", hrp)
+	urlBytes, err := bech32.ConvertBits(data, 5, 8, false)
+	require.NoError(t, err)
+	endpoint := string(urlBytes)
+	require.Equal(
+		t, "http://example.com"+lnurlPathPrefix+hash.String(), endpoint,
+	)
+
+	// Without an invoice fetcher, LNURL-pay is disabled.
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, endpoint, nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	p.SetInvoiceFetcher(fetcher)
+	var payResp lnurlPayResponse
+	get(endpoint, &payResp)
+	require.Equal(t, "payRequest", payResp.Tag)
+	require.Equal(t, int64(5000), payResp.MinSendable)
+	require.Equal(t, int64(5000), payResp.MaxSendable)
+	require.Equal(t, LNURLMetadata, payResp.Metadata)
+	require.Equal(t, endpoint+lnurlCallbackSuffix, payResp.Callback)
+
+	var errResp lnurlErrorResponse
+	get(payResp.Callback+"?amount=1000", &errResp)
+	require.Equal(t, "ERROR", errResp.Status)
+
+	var callbackResp lnurlCallbackResponse
+	get(payResp.Callback+"?amount=5000", &callbackResp)
+	require.Equal(t, "lnbc1invoice", callbackResp.PR)
+
+	// Once the invoice is paid, it can't be handed out anymore.
+	fetcher.invoices[hash].State = lnrpc.Invoice_SETTLED
+	errResp = lnurlErrorResponse{}
+	get(payResp.Callback+"?amount=5000", &errResp)
+	require.Equal(t, "ERROR", errResp.Status)
+}
+
+// TestPaywallScript makes sure the paywall script and the QR codes it shows are
+// served.
+func TestPaywallScript(t *testing.T) {
+	p := &Proxy{}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(
+		http.MethodGet, PaywallScriptPath, nil,
+	))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(
+		t, rec.Header().Get(hdrContentType), "application/javascript",
+	)
+	require.Contains(t, rec.Body.String(), paywallSettlePath)
+
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(
+		http.MethodGet, paywallQRCodePath+"?invoice=lnbc1invoice", nil,
+	))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "image/svg+xml", rec.Header().Get(hdrContentType))
+	require.Contains(t, rec.Body.String(), "<svg")
+
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(
+		http.MethodGet, paywallQRCodePath+"?invoice=foo", nil,
+	))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+// TestJSONChallenge makes sure clients that accept JSON get the challenge as
+// JSON body and can poll the payment status.
+func TestJSONChallenge(t *testing.T) {
+	preimage := lntypes.Preimage{1, 2, 3}
+	hash := preimage.Hash()
+	_, macBase64 := newPaywallMacaroon(t, hash)
+	challenge := fmt.Sprintf(
+		"LSAT macaroon=\"%s\", invoice=\"%s\"", macBase64,
+		"lnbc1invoice",
+	)
+
+	req := httptest.NewRequest(http.MethodGet, "/resource", nil)
+	require.False(t, wantsJSONChallenge(req))
+	req.Header.Set(hdrAccept, hdrTypeJSON)
+	require.True(t, wantsJSONChallenge(req))
+
+	fetcher := &mockPreimageFetcher{
+		preimages: make(map[lntypes.Hash]lntypes.Preimage),
+	}
+	p := &Proxy{}
+	p.SetPreimageFetcher(fetcher)
+
+	rec := httptest.NewRecorder()
+	p.sendJSONChallenge(rec, req, 123, challenge)
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	require.Equal(t, hdrTypeJSON, rec.Header().Get(hdrContentType))
+
+	var resp challengeResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Equal(t, macBase64, resp.Macaroon)
+	require.Equal(t, "lnbc1invoice", resp.Invoice)
+	require.Equal(t, int64(123), resp.PriceSat)
+	require.Equal(
+		t, "http://example.com"+paywallStatusPathPrefix+hash.String(),
+		resp.PaymentStatusURL,
+	)
+
+	checkStatus := func(expected bool) {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(
+			http.MethodGet, resp.PaymentStatusURL, nil,
+		))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var status paymentStatusResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		require.Equal(t, expected, status.Settled)
+	}
+
+	checkStatus(false)
+	fetcher.preimages[hash] = preimage
+	checkStatus(true)
+}
@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PoolConfig holds the options of the pool of connections to the backend of a
+// service. Zero values keep the defaults of the Go HTTP client, which only
+// keeps two idle connections per backend address.
+type PoolConfig struct {
+	// MaxIdleConns is the maximum number of idle connections kept open to
+	// each address of the backend.
+	MaxIdleConns int `long:"maxidleconns" description:"The maximum number of idle connections kept open to each backend address (default 2)"`
+
+	// IdleTimeout is the time after which idle connections are closed.
+	IdleTimeout time.Duration `long:"idletimeout" description:"Close connections that have been idle for this long, 0 to keep them open"`
+
+	// MaxConnsPerHost limits the number of connections to each address of
+	// the backend. Requests wait for a connection once it's reached.
+	MaxConnsPerHost int `long:"maxconnsperhost" description:"The maximum number of connections to each backend address, 0 for no limit"`
+
+	// MaxConnLifetime is the time after which connections are closed once
+	// their current requests are complete, so new instances behind a load
+	// balancer get their share of the traffic.
+	MaxConnLifetime time.Duration `long:"maxconnlifetime" description:"Close connections after this long once their requests are complete, 0 to keep them open"`
+
+	// HTTP2Conns is the number of HTTP/2 connections to each address of
+	// the backend the streams are spread across in turn, for backends that
+	// perform poorly if all streams are multiplexed over one connection.
+	// The connection limits apply to each of them separately.
+	HTTP2Conns int `long:"http2conns" description:"Spread the HTTP/2 streams to each backend address across this many connections (default 1)"`
+}
+
+// validate checks the connection pool options.
+func (c *PoolConfig) validate() error {
+	if c.MaxIdleConns < 0 || c.MaxConnsPerHost < 0 || c.HTTP2Conns < 0 {
+		return fmt.Errorf("negative number of connections")
+	}
+	if c.IdleTimeout < 0 || c.MaxConnLifetime < 0 {
+		return fmt.Errorf("negative connection duration")
+	}
+
+	return nil
+}
+
+// isDefault returns true if none of the options are set.
+func (c *PoolConfig) isDefault() bool {
+	return *c == PoolConfig{}
+}
+
+// http2Conns returns the number of HTTP/2 connections to each address.
+func (c *PoolConfig) http2Conns() int {
+	if c.HTTP2Conns == 0 {
+		return 1
+	}
+
+	return c.HTTP2Conns
+}
+
+// configure applies the options to the transport.
+func (c *PoolConfig) configure(transport *http.Transport) {
+	transport.MaxIdleConnsPerHost = c.MaxIdleConns
+	transport.IdleConnTimeout = c.IdleTimeout
+	transport.MaxConnsPerHost = c.MaxConnsPerHost
+}
+
+// spreadTransport sends requests through a set of transports in turn.
+type spreadTransport struct {
+	transports []http.RoundTripper
+	next       uint32
+}
+
+// newSpreadTransport creates a round tripper that spreads the requests across
+// the given transports.
+func newSpreadTransport(transports []http.RoundTripper) http.RoundTripper {
+	if len(transports) == 1 {
+		return transports[0]
+	}
+
+	return &spreadTransport{transports: transports}
+}
+
+// RoundTrip sends the request through the next transport.
+func (s *spreadTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+
+	next := atomic.AddUint32(&s.next, 1)
+	transport := s.transports[int(next%uint32(len(s.transports)))]
+	return transport.RoundTrip(req)
+}
+
+// connLifetimes closes the connections of a transport once they have reached
+// their maximum lifetime and have no active requests anymore. Connections are
+// dialed through it and requests sent through the round tripper it wraps.
+type connLifetimes struct {
+	lifetime time.Duration
+
+	mtx   sync.Mutex
+	conns map[string]*lifetimeConn
+}
+
+// newConnLifetimes creates a tracker of the lifetime of connections.
+func newConnLifetimes(lifetime time.Duration) *connLifetimes {
+	return &connLifetimes{
+		lifetime: lifetime,
+		conns:    make(map[string]*lifetimeConn),
+	}
+}
+
+// dial returns a dial function that tracks the connections it dials.
+func (l *connLifetimes) dial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn,
+		error) {
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		// The transport wraps the connections to TLS backends, so
+		// they're looked up by their local address again.
+		key := conn.LocalAddr().String()
+		tracked := &lifetimeConn{Conn: conn}
+		tracked.onClose = func() {
+			l.mtx.Lock()
+			defer l.mtx.Unlock()
+
+			if l.conns[key] == tracked {
+				delete(l.conns, key)
+			}
+		}
+
+		l.mtx.Lock()
+		l.conns[key] = tracked
+		l.mtx.Unlock()
+
+		time.AfterFunc(l.lifetime, tracked.expire)
+
+		return tracked, nil
+	}
+}
+
+// lookup returns the tracked connection the transport used.
+func (l *connLifetimes) lookup(conn net.Conn) *lifetimeConn {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.conns[conn.LocalAddr().String()]
+}
+
+// wrap returns a round tripper that marks the connections the requests are
+// sent through as active until their responses are read.
+func (l *connLifetimes) wrap(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response,
+		error) {
+
+		var conn *lifetimeConn
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				// A request is retried on another connection
+				// if the first one was closed meanwhile.
+				if conn != nil {
+					conn.release()
+				}
+
+				conn = l.lookup(info.Conn)
+				if conn != nil {
+					conn.acquire()
+				}
+			},
+		}
+		req = req.WithContext(
+			httptrace.WithClientTrace(req.Context(), trace),
+		)
+
+		resp, err := next.RoundTrip(req)
+		if conn == nil {
+			return resp, err
+		}
+		if err != nil {
+			conn.release()
+			return nil, err
+		}
+
+		// Upgraded connections are never reused and stay open until
+		// the client is done with them.
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+
+		resp.Body = &releasingBody{ReadCloser: resp.Body, conn: conn}
+		return resp, nil
+	})
+}
+
+// roundTripperFunc is a function that implements http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip calls the function.
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+
+	return f(req)
+}
+
+// lifetimeConn is a connection that is closed once it has expired and has no
+// active requests.
+type lifetimeConn struct {
+	net.Conn
+
+	onClose func()
+
+	mtx     sync.Mutex
+	active  int
+	expired bool
+	closed  bool
+}
+
+// acquire marks a request as active on the connection.
+func (c *lifetimeConn) acquire() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.active++
+}
+
+// release marks a request as complete and closes the connection if it has
+// expired and was the last one.
+func (c *lifetimeConn) release() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.active--
+	c.closeIfUnused()
+}
+
+// expire marks the connection as expired and closes it if it has no active
+// requests.
+func (c *lifetimeConn) expire() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.expired = true
+	c.closeIfUnused()
+}
+
+// closeIfUnused closes the connection if it has expired and has no active
+// requests. The mutex must be held.
+func (c *lifetimeConn) closeIfUnused() {
+	if !c.expired || c.active > 0 || c.closed {
+		return
+	}
+
+	c.closed = true
+	_ = c.Conn.Close()
+	c.onClose()
+}
+
+// Close closes the connection.
+func (c *lifetimeConn) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	c.closed = true
+	c.onClose()
+	return c.Conn.Close()
+}
+
+// releasingBody is a response body that releases its connection once it's
+// closed.
+type releasingBody struct {
+	io.ReadCloser
+
+	conn *lifetimeConn
+	once sync.Once
+}
+
+// Close closes the body and releases its connection.
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.conn.release)
+	return err
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestConnLifetime tests that connections are closed once they have reached
+// their lifetime, but only after their active requests are complete.
+func TestConnLifetime(t *testing.T) {
+	var (
+		conns   int32
+		release = make(chan struct{})
+	)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				<-release
+			}
+		},
+	))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	var dialer net.Dialer
+	transport, err := newTLSTransport(
+		nil, 0, &KeepaliveConfig{}, &PoolConfig{
+			MaxConnLifetime: 100 * time.Millisecond,
+		}, func(ctx context.Context, network, addr string) (net.Conn,
+			error) {
+
+			return dialer.DialContext(ctx, network, addr)
+		},
+	)
+	require.NoError(t, err)
+	client := &http.Client{Transport: transport}
+
+	get := func(path string) *http.Response {
+		resp, err := client.Get(server.URL + path)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// Connections are reused within their lifetime.
+	for i := 0; i < 2; i++ {
+		resp := get("/")
+		_, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+	require.EqualValues(t, 1, atomic.LoadInt32(&conns))
+
+	// An expired connection isn't closed while a response is still being
+	// read from it.
+	slow := get("/slow")
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	_, err = ioutil.ReadAll(slow.Body)
+	require.NoError(t, err)
+	require.NoError(t, slow.Body.Close())
+
+	// Once its last request is complete, the next one needs a new
+	// connection.
+	resp := get("/")
+	require.NoError(t, resp.Body.Close())
+	require.EqualValues(t, 2, atomic.LoadInt32(&conns))
+}
+
+// TestSpreadTransport tests that requests are spread across the transports in
+// turn.
+func TestSpreadTransport(t *testing.T) {
+	counts := make([]int, 3)
+	var transports []http.RoundTripper
+	for i := range counts {
+		i := i
+		transports = append(transports, roundTripperFunc(
+			func(*http.Request) (*http.Response, error) {
+				counts[i]++
+				return &http.Response{}, nil
+			},
+		))
+	}
+
+	transport := newSpreadTransport(transports)
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	for i := 0; i < 6; i++ {
+		_, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+	}
+	require.Equal(t, []int{2, 2, 2}, counts)
+
+	// A single transport isn't wrapped.
+	_, ok := newSpreadTransport(transports[:1]).(*spreadTransport)
+	require.False(t, ok)
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lightninglabs/aperture/proof"
+)
+
+const (
+	// proofKeyPath is the path the public key that response proofs are
+	// signed with is published under.
+	proofKeyPath = "/.aperture/proof-key"
+
+	// hdrProofTimestamp is the header field that contains the timestamp of
+	// a signed response as a unix timestamp.
+	hdrProofTimestamp = "Aperture-Proof-Timestamp"
+
+	// hdrProofDigest is the trailer field that contains the base64 encoded
+	// SHA-256 digest of the response body.
+	hdrProofDigest = "Aperture-Proof-Digest"
+
+	// hdrProofSignature is the trailer field that contains the base64
+	// encoded signature of the proof statement of a response.
+	hdrProofSignature = "Aperture-Proof-Signature"
+)
+
+// isProofKeyRequest returns true if the request asks for the public key that
+// response proofs are signed with.
+func isProofKeyRequest(r *http.Request) bool {
+	return r.URL.Path == proofKeyPath
+}
+
+// handleProofKey sends the hex encoded public key response proofs are signed
+// with to the client.
+func (p *Proxy) handleProofKey(w http.ResponseWriter, r *http.Request) {
+	if p.responseSigner == nil {
+		sendDirectResponse(w, r, http.StatusNotFound, "not found")
+		return
+	}
+
+	pubKey, ok := p.responseSigner.Public().(ed25519.PublicKey)
+	if !ok {
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "invalid key",
+		)
+		return
+	}
+
+	w.Header().Set(hdrContentType, "text/plain")
+	_, _ = fmt.Fprintln(w, hex.EncodeToString(pubKey))
+}
+
+// proofResponseWriter is a http.ResponseWriter that hashes the response body
+// and signs a proof statement about the response once it's complete. Because
+// the statement covers the whole body, the signature is sent as a trailer.
+type proofResponseWriter struct {
+	http.ResponseWriter
+
+	signer      crypto.Signer
+	statement   proof.Statement
+	digest      hash.Hash
+	wroteHeader bool
+	http1       bool
+}
+
+// newProofResponseWriter creates a new response writer that signs a proof of
+// the response to the given request, which was paid with the token with the
+// given ID.
+func newProofResponseWriter(w http.ResponseWriter, r *http.Request,
+	signer crypto.Signer, tokenID string) *proofResponseWriter {
+
+	return &proofResponseWriter{
+		ResponseWriter: w,
+		signer:         signer,
+		statement: proof.Statement{
+			TokenID:    tokenID,
+			Method:     r.Method,
+			Host:       r.Host,
+			RequestURI: r.URL.RequestURI(),
+		},
+		digest: sha256.New(),
+		http1:  r.ProtoMajor == 1,
+	}
+}
+
+// WriteHeader records the status and content type of the response and
+// announces the proof trailers.
+func (p *proofResponseWriter) WriteHeader(statusCode int) {
+	if p.wroteHeader {
+		return
+	}
+	p.wroteHeader = true
+
+	header := p.Header()
+	p.statement.Timestamp = time.Now()
+	p.statement.Status = statusCode
+	p.statement.ContentType = header.Get(hdrContentType)
+
+	header.Set(
+		hdrProofTimestamp,
+		strconv.FormatInt(p.statement.Timestamp.Unix(), 10),
+	)
+	header.Add(hdrTrailer, hdrProofDigest)
+	header.Add(hdrTrailer, hdrProofSignature)
+
+	// HTTP/1.1 can only send trailers with a chunked body.
+	if p.http1 {
+		header.Del(hdrContentLength)
+	}
+
+	p.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write adds a chunk of the response body to the digest and sends it.
+func (p *proofResponseWriter) Write(b []byte) (int, error) {
+	if !p.wroteHeader {
+		p.WriteHeader(http.StatusOK)
+	}
+
+	n, err := p.ResponseWriter.Write(b)
+	p.digest.Write(b[:n])
+	return n, err
+}
+
+// Flush sends any buffered data to the client.
+func (p *proofResponseWriter) Flush() {
+	if !p.wroteHeader {
+		p.WriteHeader(http.StatusOK)
+	}
+
+	if flusher, ok := p.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the reverse proxy take over the connection for protocol
+// upgrades. The upgraded connection isn't covered by a proof.
+func (p *proofResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := p.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection can't be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+// finish signs the proof statement of the complete response and sets the
+// trailers.
+func (p *proofResponseWriter) finish() error {
+	if !p.wroteHeader {
+		p.WriteHeader(http.StatusOK)
+	}
+
+	copy(p.statement.BodyDigest[:], p.digest.Sum(nil))
+	sig, err := proof.Sign(p.signer, &p.statement)
+	if err != nil {
+		return err
+	}
+
+	header := p.Header()
+	header.Set(
+		hdrProofDigest,
+		base64.StdEncoding.EncodeToString(p.statement.BodyDigest[:]),
+	)
+	header.Set(hdrProofSignature, base64.StdEncoding.EncodeToString(sig))
+	return nil
+}
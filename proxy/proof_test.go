@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/proof"
+	"github.com/stretchr/testify/require"
+)
+
+// TestProofResponseWriter tests that the proof of a response is sent in its
+// trailers and can be verified by the client.
+func TestProofResponseWriter(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	const body = `{"price": 12345}`
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			proofWriter := newProofResponseWriter(w, r, key, "abcd")
+			defer func() {
+				require.NoError(t, proofWriter.finish())
+			}()
+
+			// A content length set by the backend must not
+			// prevent the trailers from being sent.
+			header := proofWriter.Header()
+			header.Set(hdrContentType, "application/json")
+			header.Set(hdrContentLength, strconv.Itoa(len(body)))
+			_, _ = proofWriter.Write([]byte(body))
+		},
+	))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/price?pair=btcusd")
+	require.NoError(t, err)
+	respBody, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, body, string(respBody))
+
+	timestamp, err := strconv.ParseInt(
+		resp.Header.Get(hdrProofTimestamp), 10, 64,
+	)
+	require.NoError(t, err)
+	sig, err := base64.StdEncoding.DecodeString(
+		resp.Trailer.Get(hdrProofSignature),
+	)
+	require.NoError(t, err)
+
+	statement := &proof.Statement{
+		Timestamp:   time.Unix(timestamp, 0),
+		TokenID:     "abcd",
+		Method:      "GET",
+		Host:        resp.Request.URL.Host,
+		RequestURI:  "/price?pair=btcusd",
+		Status:      http.StatusOK,
+		ContentType: "application/json",
+		BodyDigest:  sha256.Sum256(respBody),
+	}
+	pubKey := key.Public().(ed25519.PublicKey)
+	require.NoError(t, proof.Verify(pubKey, statement, sig))
+}
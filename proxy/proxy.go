@@ -1,18 +1,25 @@
 package proxy
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httputil"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/freebie"
 	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightninglabs/aperture/pricer"
 	"google.golang.org/grpc/codes"
 )
 
@@ -26,7 +33,13 @@ const (
 	hdrContentType = "Content-Type"
 	hdrGrpcStatus  = "Grpc-Status"
 	hdrGrpcMessage = "Grpc-Message"
+	hdrGrpcDetails = "Grpc-Status-Details-Bin"
 	hdrTypeGrpc    = "application/grpc"
+	hdrRetryAfter  = "Retry-After"
+
+	// busyRetryAfter is the number of seconds after which a client should
+	// retry a request the challenger was too busy for.
+	busyRetryAfter = "1"
 )
 
 // LocalService is an interface that describes a service that is handled
@@ -69,10 +82,156 @@ func (l *localService) IsHandling(r *http.Request) bool {
 // a challenge to the client or forwards the request to another server and
 // proxies the response back to the client.
 type Proxy struct {
-	proxyBackend  *httputil.ReverseProxy
 	localServices []LocalService
 	authenticator auth.Authenticator
+
+	// servicesMtx guards the services and the transports to reach them,
+	// which are replaced when the services are updated at run time.
+	servicesMtx   sync.RWMutex
+	proxyBackend  *httputil.ReverseProxy
 	services      []*Service
+	grpcTransport *grpcTransport
+
+	// preimageFetcher is used by the payment page to look up the preimage
+	// of paid invoices. If it's nil, the preimage must be sent by the
+	// payment page itself.
+	preimageFetcher auth.PreimageFetcher
+
+	// macaroonVerifier is used by the payment page to make sure the
+	// macaroons it looks up the preimage for were minted by us. If it's
+	// nil, the payment page can't look up preimages.
+	macaroonVerifier MacaroonVerifier
+
+	// invoiceFetcher is used by the LNURL-pay endpoints to look up the
+	// invoice of a challenge. If it's nil, LNURL-pay is disabled.
+	invoiceFetcher auth.InvoiceFetcher
+
+	// paymentFetcher is used to look up the amount paid for the tokens of
+	// services that forward it to their backend. If it's nil, the amount
+	// isn't forwarded.
+	paymentFetcher auth.InvoiceFetcher
+
+	// amounts caches the amounts paid for tokens.
+	amounts amountCache
+
+	// newFreebieDB creates the freebie stores of the services.
+	newFreebieDB freebie.DBCreator
+
+	// countryResolver looks up the country of clients. If it's nil, the
+	// country of clients is unknown.
+	countryResolver CountryResolver
+
+	// dnsResolver looks up the addresses of backends. If it's nil, the
+	// resolver of the system is used.
+	dnsResolver *DNSResolver
+
+	// srvResolver looks up the SRV records of discovered backends if no
+	// DNS resolver is set.
+	srvResolver *DNSResolver
+
+	// clientIPResolver finds the address of clients behind trusted
+	// proxies. If it's nil, the address of the peer is used.
+	clientIPResolver *ClientIPResolver
+
+	// nonceStore keeps track of the nonces used with each token to detect
+	// replayed requests.
+	nonceStore NonceStore
+
+	// balanceStore keeps track of the messages delivered with each token
+	// for the services that are billed per message.
+	balanceStore BalanceStore
+
+	// delegationStore keeps track of the tokens that were delegated by
+	// their holders.
+	delegationStore DelegationStore
+
+	// usageStore counts the requests made with each token for the
+	// services that report the usage of their tokens.
+	usageStore UsageStore
+
+	// topUpStore keeps track of the top-ups of the message balances of
+	// tokens.
+	topUpStore TopUpStore
+
+	// topUpChallenger creates the invoices of top-ups. If it's nil, the
+	// balances of tokens can't be topped up.
+	topUpChallenger mint.Challenger
+
+	// upgradeStore keeps track of the pending tier upgrades of tokens.
+	upgradeStore UpgradeStore
+
+	// upgradeChallenger creates the invoices of tier upgrades. If it or
+	// the token issuer is nil, tokens can't be upgraded.
+	upgradeChallenger mint.Challenger
+
+	// tokenIssuer issues the upgraded tokens.
+	tokenIssuer TokenIssuer
+
+	// trialIssuer mints the trial tokens of the services with the trial
+	// auth level. If it's nil, no trial tokens are issued.
+	trialIssuer TrialIssuer
+
+	// trials holds the rate limiters of the trial tokens in use by token
+	// ID.
+	trialsMtx    sync.Mutex
+	trials       map[lsat.TokenID]*trialLimiter
+	trialsPruned time.Time
+
+	// transferStore keeps track of the response bytes sent with each token
+	// for the services with a transfer quota.
+	transferStore TransferStore
+
+	// responseSigner signs the proofs of the responses of services that
+	// have response signing enabled. If it's nil, no proofs are signed.
+	responseSigner crypto.Signer
+
+	// urlSigningKey is the key signed URLs of paid resources are signed
+	// with. If it's nil, no signed URLs are issued or accepted.
+	urlSigningKey []byte
+
+	// tokenChecker makes sure the tokens signed URLs were issued for
+	// weren't revoked since. If it's nil, no signed URLs are issued or
+	// accepted.
+	tokenChecker TokenChecker
+
+	// queueReporter reports the number of calls waiting for lnd for surge
+	// pricing. If it's nil, the queue is considered empty.
+	queueReporter QueueReporter
+
+	// maintenanceOverrides holds the maintenance modes that were set at
+	// run time by service name. They take precedence over the configured
+	// ones and are kept when the services are updated.
+	maintenanceMtx       sync.RWMutex
+	maintenanceOverrides map[string]*MaintenanceConfig
+
+	// faults holds the faults that are injected into the requests of the
+	// services by service name. They can only be set at run time.
+	faultsMtx sync.RWMutex
+	faults    map[string]*FaultConfig
+
+	// captures holds the recorded exchanges of the services that capture
+	// them by service name.
+	capturesMtx sync.Mutex
+	captures    map[string]*captureBuffer
+
+	// traceCfg holds the options to trace single requests. If it's nil,
+	// no requests are traced.
+	traceCfg *TraceConfig
+
+	// copyBuffers are the buffers response bodies are copied to the client
+	// with. They're guarded by servicesMtx.
+	copyBuffers *copyBufferPool
+
+	// activity counts the requests in flight of the services.
+	activity activityTracker
+}
+
+// CountryResolver is an entity that is able to look up the country an IP
+// address is located in.
+type CountryResolver interface {
+	// Country returns the ISO 3166-1 alpha-2 code of the country the IP
+	// address is located in, or an empty string if it isn't known.
+	Country(net.IP) (string, error)
 }
 
 // New returns a new Proxy instance that proxies between the services specified,
@@ -81,12 +240,49 @@ type Proxy struct {
 func New(auth auth.Authenticator, services []*Service,
 	localServices ...LocalService) (*Proxy, error) {
 
+	return NewWithFreebieDB(auth, services, nil, localServices...)
+}
+
+// NewWithFreebieDB returns a new Proxy instance like New that uses the given
+// function to create the freebie stores of its services. This allows multiple
+// instances to share the freebie counters. If newFreebieDB is nil, each service
+// counts its free requests in memory.
+func NewWithFreebieDB(auth auth.Authenticator, services []*Service,
+	newFreebieDB freebie.DBCreator,
+	localServices ...LocalService) (*Proxy, error) {
+
+	if newFreebieDB == nil {
+		newFreebieDB = func(_ string, numFreebies freebie.Count) freebie.DB {
+			return freebie.NewMemIPMaskStore(numFreebies)
+		}
+	}
+
+	// Without a configured DNS resolver, the SRV records of discovered
+	// backends are looked up with the resolver of the system and cached
+	// for a while.
+	srvResolver, err := NewDNSResolver(&DNSConfig{
+		ReresolveInterval: defaultSRVRefreshInterval,
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	proxy := &Proxy{
-		localServices: localServices,
-		authenticator: auth,
-		services:      services,
+		localServices:   localServices,
+		authenticator:   auth,
+		newFreebieDB:    newFreebieDB,
+		nonceStore:      newMemNonceStore(),
+		balanceStore:    newMemBalanceStore(),
+		topUpStore:      newMemTopUpStore(),
+		usageStore:      newMemUsageStore(),
+		delegationStore: NewMemDelegationStore(),
+		transferStore:   newMemTransferStore(),
+		upgradeStore:    newMemUpgradeStore(),
+		trials:          make(map[lsat.TokenID]*trialLimiter),
+		srvResolver:     srvResolver,
+		copyBuffers:     newCopyBufferPool(DefaultCopyBufferSize),
 	}
-	err := proxy.UpdateServices(services)
+	err = proxy.UpdateServices(services)
 	if err != nil {
 		return nil, err
 	}
@@ -94,18 +290,94 @@ func New(auth auth.Authenticator, services []*Service,
 	return proxy, nil
 }
 
+// SetPreimageFetcher sets the entity the payment page uses to look up the
+// preimage of invoices that were paid with a wallet that doesn't reveal it to
+// the browser.
+func (p *Proxy) SetPreimageFetcher(fetcher auth.PreimageFetcher) {
+	p.preimageFetcher = fetcher
+}
+
+// SetMacaroonVerifier sets the entity the payment page uses to make sure the
+// macaroons it looks up the preimage of were minted by us.
+func (p *Proxy) SetMacaroonVerifier(verifier MacaroonVerifier) {
+	p.macaroonVerifier = verifier
+}
+
+// SetInvoiceFetcher sets the entity the LNURL-pay endpoints use to look up the
+// invoices of challenges. Setting it enables LNURL-pay, which requires the
+// invoices to be created with the description hash of the LNURL metadata.
+func (p *Proxy) SetInvoiceFetcher(fetcher auth.InvoiceFetcher) {
+	p.invoiceFetcher = fetcher
+}
+
+// SetPaymentFetcher sets the entity the amount paid for a token is looked up
+// with for the services that forward it to their backend.
+func (p *Proxy) SetPaymentFetcher(fetcher auth.InvoiceFetcher) {
+	p.paymentFetcher = fetcher
+}
+
+// SetCountryResolver sets the entity that is used to look up the country of
+// clients for the country rules of the services and their pricers.
+func (p *Proxy) SetCountryResolver(resolver CountryResolver) {
+	p.countryResolver = resolver
+}
+
+// SetNonceStore sets the store the nonces of requests are checked against. This
+// allows multiple instances to detect requests that are replayed between them.
+// By default, the nonces are kept in memory.
+func (p *Proxy) SetNonceStore(store NonceStore) {
+	p.nonceStore = store
+}
+
+// SetTopUpStore sets the store the top-ups of the message balances of tokens
+// are kept in. By default, they are kept in memory.
+func (p *Proxy) SetTopUpStore(store TopUpStore) {
+	p.topUpStore = store
+}
+
+// SetTopUpChallenger sets the challenger the invoices of top-ups of message
+// balances are created with. Setting it enables top-ups for the services that
+// allow them, which also requires a preimage fetcher to check their payment.
+func (p *Proxy) SetTopUpChallenger(challenger mint.Challenger) {
+	p.topUpChallenger = challenger
+}
+
+// SetBalanceStore sets the store the messages delivered with each token are
+// deducted in. This allows multiple instances to share the balances of tokens.
+// By default, the balances are kept in memory.
+func (p *Proxy) SetBalanceStore(store BalanceStore) {
+	p.balanceStore = store
+}
+
+// SetResponseSigner sets the Ed25519 key the proofs of the responses of
+// services with response signing enabled are signed with.
+func (p *Proxy) SetResponseSigner(signer crypto.Signer) {
+	p.responseSigner = signer
+}
+
+// SetQueueReporter sets the entity that reports the number of calls waiting for
+// lnd, which surge pricing takes into account.
+func (p *Proxy) SetQueueReporter(reporter QueueReporter) {
+	p.queueReporter = reporter
+}
+
 // ServeHTTP checks a client's headers for appropriate authorization and either
 // returns a challenge or forwards their request to the target backend service.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Parse and log the remote IP address. We also need the parsed IP
-	// address for the freebie count.
-	remoteIP, prefixLog := NewRemoteIPPrefixLog(log, r.RemoteAddr)
+	// address for the freebie count. Behind trusted proxies, it's the
+	// address of the original client.
+	remoteIP, prefixLog := NewRemoteIPPrefixLog(log, p.clientAddr(r))
 	logRequest := func() {
 		prefixLog.Infof(formatPattern, r.Method, r.RequestURI, r.Proto,
 			r.Referer(), r.UserAgent())
 	}
 	defer logRequest()
 
+	// Operators can trace single requests in detail with the trace secret.
+	r, trace := p.startTrace(w, r, prefixLog)
+	defer trace.logf("Request handled")
+
 	// For OPTIONS requests we only need to set the CORS headers, not serve
 	// any content;
 	if r.Method == "OPTIONS" {
@@ -114,12 +386,68 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The payment page and the paywall script send the paid LSAT to us
+	// so we can store it in a cookie for the browser. This is independent
+	// of any backend.
+	if isPaywallRequest(r) {
+		p.handlePaywall(w, r, prefixLog)
+		return
+	}
+
+	// LNURL wallets pay challenges through their own endpoints.
+	if isLNURLRequest(r) {
+		p.handleLNURL(w, r, prefixLog)
+		return
+	}
+
+	// Holders of tokens with a message balance can top it up without
+	// buying a new token.
+	if isTopUpRequest(r) {
+		p.handleTopUp(w, r, remoteIP, prefixLog)
+		return
+	}
+
+	// Holders of tokens can upgrade them to a higher tier by paying the
+	// difference.
+	if isUpgradeRequest(r) {
+		p.handleUpgrade(w, r, remoteIP, prefixLog)
+		return
+	}
+
+	// Holders of tokens can look up how much of what they paid for is
+	// left.
+	if isUsageRequest(r) {
+		p.handleUsage(w, r, remoteIP, prefixLog)
+		return
+	}
+
+	// Holders of tokens can hand out restricted tokens derived from them.
+	if isDelegateRequest(r) {
+		p.handleDelegate(w, r, remoteIP, prefixLog)
+		return
+	}
+
+	// Holders of tokens can download a signed receipt of their payment.
+	if isReceiptRequest(r) {
+		p.handleReceipt(w, r, remoteIP, prefixLog)
+		return
+	}
+
+	// Clients need the public key response proofs are signed with to
+	// verify them.
+	if isProofKeyRequest(r) {
+		p.handleProofKey(w, r)
+		return
+	}
+
 	// Requests that can't be matched to a service backend will be
 	// dispatched to the static file server. If the file exists in the
 	// static file folder it will be served, otherwise the static server
 	// will return a 404 for us.
-	target, ok := matchService(r, p.services)
+	target, ok := matchService(r, p.currentServices())
 	if !ok {
+		trace.logf("No service matched, dispatching to local services")
+
 		// This isn't a request for any configured remote backend that
 		// we are proxying for. So we give it to the local service that
 		// claims is responsible for it.
@@ -141,11 +469,245 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	trace.logf("Matched service %s with host expression %q and path "+
+		"expression %q", target.Name, target.HostRegexp,
+		target.PathRegexp)
+
+	// Record the exchange for debugging if the service asks for it.
+	w, r, finishCapture := p.startCapture(w, r, target)
+	defer finishCapture()
+
+	// Services in maintenance mode are neither billed nor reached.
+	if maintenance := p.maintenance(target); maintenance.Enabled {
+		prefixLog.Debugf("Service %s is under maintenance.",
+			target.Name)
+		trace.logf("Service is under maintenance")
+		sendMaintenanceResponse(w, r, maintenance)
+		return
+	}
+
+	// Services outside their availability windows are closed, unless
+	// they charge another price then.
+	if !checkAvailability(w, r, target) {
+		prefixLog.Debugf("Service %s is closed.", target.Name)
+		trace.logf("Service is outside its availability windows")
+		return
+	}
+
+	// Operators can inject faults to test how clients cope with them.
+	if !p.injectFault(w, r, target, prefixLog) {
+		return
+	}
+
+	// Only allowed content encodings may reach the backend. Bodies are
+	// decompressed before the filter sees them if the service asks for it.
+	compress, ok := checkEncodings(w, r, target)
+	if !ok {
+		return
+	}
+
+	// Reject obviously malicious requests before they cost us an invoice
+	// or reach the backend.
+	if target.filter != nil {
+		status, reason := target.filter.check(w, r)
+		if status != 0 {
+			prefixLog.Infof("Request rejected by filter: %s", reason)
+			trace.logf("Rejected by filter: %s", reason)
+			sendDirectResponse(w, r, status, reason)
+			return
+		}
+	}
+
+	// Only the allowed gRPC methods of the service may be called.
+	if target.methods != nil {
+		method, ok := target.methods.check(r, target)
+		if !ok {
+			prefixLog.Infof("Call of method '%s' denied.", method)
+			trace.logf("Call of method %s denied", method)
+			sendDirectResponse(
+				w, r, http.StatusForbidden, "method not allowed",
+			)
+			return
+		}
+	}
+
+	// Make sure the request is allowed to reach the service. If it isn't,
+	// the response has already been written to the client.
+	r, ok = p.authorize(w, r, target, remoteIP, prefixLog)
+	if !ok {
+		return
+	}
+
+	// Count the bytes sent to the client against the transfer quota of the
+	// token if the service has one.
+	if meter := transferMeterFromContext(r.Context()); meter != nil {
+		var record func()
+		w, record = meter.writer(w, prefixLog)
+		defer record()
+	}
+
+	// Compress the response for the client if the service asks for it.
+	// The proof below covers the uncompressed response.
+	if compress {
+		gzipWriter := newGzipResponseWriter(w)
+		defer func() {
+			if err := gzipWriter.finish(); err != nil {
+				prefixLog.Errorf("Error compressing response: "+
+					"%v", err)
+			}
+		}()
+		w = gzipWriter
+	}
+
+	// Sign a proof of the response once it's complete, so the client can
+	// later prove what the service returned.
+	if target.SignResponses && p.responseSigner != nil {
+		var tokenID string
+		if id, err := tokenIDFromHeader(r.Header); err == nil {
+			tokenID = id.String()
+		}
+
+		proofWriter := newProofResponseWriter(
+			w, r, p.responseSigner, tokenID,
+		)
+		defer func() {
+			if err := proofWriter.finish(); err != nil {
+				prefixLog.Errorf("Error signing response "+
+					"proof: %v", err)
+			}
+		}()
+		w = proofWriter
+	}
+
+	// The service is needed again to check the response of the backend.
+	r = r.WithContext(contextWithService(r.Context(), target))
+
+	// gRPC calls end once the deadline of the client or the maximum call
+	// duration of the service is reached, so abandoned calls don't pin
+	// backend resources.
+	r, cancel := withDeadline(r, target)
+	defer cancel()
+
+	// Count the request while it's in flight, so operators can see what
+	// a restart would interrupt.
+	defer p.activity.start(target, r)()
+
+	// Track the load of the backend for surge pricing.
+	if target.load != nil {
+		var done func()
+		w, done = target.load.start(w)
+		defer done()
+	}
+
+	// Services that are served in process have no backend to forward the
+	// request to.
+	if target.Handler != nil {
+		trace.logf("Serving request in process")
+		target.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	// REST requests to a gRPC backend are transcoded if there is a binding
+	// for the requested path in the proto descriptors of the service.
+	if target.transcoder != nil &&
+		!strings.HasPrefix(r.Header.Get(hdrContentType), hdrTypeGrpc) {
+
+		route, vars, ok := target.transcoder.match(r)
+		if ok {
+			p.transcode(w, r, target, route, vars, prefixLog)
+			return
+		}
+	}
+
+	// Browsers can't speak native gRPC, so gRPC-Web requests need to be
+	// translated for the backend and the response back for the client.
+	if target.GRPCWeb && isGRPCWebRequest(r) {
+		grpcWebWriter := newGRPCWebResponseWriter(w, r)
+		translateGRPCWebRequest(r)
+		limitRequest(r, target)
+
+		p.currentProxyBackend().ServeHTTP(grpcWebWriter, r)
+		if err := grpcWebWriter.finish(); err != nil {
+			prefixLog.Errorf("Error writing gRPC-Web trailers: %v",
+				err)
+		}
+		return
+	}
+
+	// Read the whole request body first if the service buffers it.
+	if !bufferRequest(w, r, target, prefixLog) {
+		return
+	}
+
+	// If we got here, it means everything is OK to pass the request to the
+	// service backend via the reverse proxy.
+	trace.logf("Forwarding request to backend %s", target.Address)
+	limitRequest(r, target)
+	p.currentProxyBackend().ServeHTTP(w, r)
+}
+
+// authorize checks whether the given request is allowed to access the target
+// service. If it is, the request is returned with the context it needs on its
+// way to the backend. If it isn't, a response (for example a payment challenge)
+// is sent to the client and false is returned.
+func (p *Proxy) authorize(w http.ResponseWriter, r *http.Request,
+	target *Service, remoteIP net.IP,
+	prefixLog *PrefixLog) (*http.Request, bool) {
+
 	resourceName := target.ResourceName(r.URL.Path)
 
+	// NIP-98 auth events are sent in the Authorization header field, so
+	// they're taken out before tokens are looked for in it.
+	nostrAuth := takeNostrAuth(r, target)
+
+	// Some clients can only send their token in a custom header field.
+	moveTokenHeader(r, target)
+
+	// Tokens may be bound to the client they were issued to, so the
+	// properties of the client need to be known to issue and verify them.
+	r = withClientBinding(r, remoteIP)
+	r = withGracePeriod(r, target)
+
+	// Look up the country of the client, so it can be checked against the
+	// country rules of the service and used by its pricer.
+	var country string
+	if p.countryResolver != nil && remoteIP != nil {
+		var err error
+		country, err = p.countryResolver.Country(remoteIP)
+		if err != nil {
+			prefixLog.Errorf("Error looking up country: %v", err)
+		}
+	}
+	if target.HasCountryRules() && !target.CountryAllowed(country) {
+		prefixLog.Infof("Access from country '%s' denied.", country)
+		sendDirectResponse(
+			w, r, http.StatusForbidden, "service not available "+
+				"in your country",
+		)
+		return nil, false
+	}
+	if country != "" {
+		r = r.WithContext(
+			pricer.ContextWithCountry(r.Context(), country),
+		)
+	}
+
+	// Requests made with a signed URL of a resource were already paid for
+	// with a token.
+	if target.SignedURLs.Enabled && hasSignedURL(r) {
+		return p.authorizeSignedURL(w, r, target, remoteIP, prefixLog)
+	}
+
 	// Determine auth level required to access service and dispatch request
 	// accordingly.
+	var (
+		authenticated   bool
+		authenticatedBy string
+	)
 	authLevel := target.AuthRequired(r)
+	trace := traceFromRequest(r)
+	trace.logf("Auth level %q applies to resource %s", authLevel,
+		resourceName)
 	switch {
 	case authLevel.IsOn():
 		// Determine if the header contains the authentication
@@ -153,37 +715,25 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// called in each case body rather than outside the switch so
 		// as to avoid calling this possibly expensive call for static
 		// resources.
-		acceptAuth := p.authenticator.Accept(&r.Header, resourceName)
-		if !acceptAuth {
-			price, err := target.pricer.GetPrice(
-				r.Context(), r.URL.Path,
-			)
-			if err != nil {
-				prefixLog.Errorf("error getting "+
-					"resource price: %v", err)
-				sendDirectResponse(
-					w, r, http.StatusInternalServerError,
-					"failure fetching "+
-						"resource price",
-				)
-				return
-			}
-
-			// If the price returned is zero, then break out of the
-			// switch statement and allow access to the service.
-			if price == 0 {
-				break
-			}
+		var acceptAuth bool
+		authenticatedBy, acceptAuth = p.authenticate(
+			r, target, resourceName,
+		)
+		authenticated = authenticatedBy == AuthenticatorLSAT
+		if !acceptAuth &&
+			p.challenge(w, r, target, resourceName, prefixLog) {
 
-			prefixLog.Infof("Authentication failed. Sending 402.")
-			p.handlePaymentRequired(w, r, resourceName, price)
-			return
+			return nil, false
 		}
 
 	case authLevel.IsFreebie():
 		// We only need to respect the freebie counter if the user
 		// is not authenticated at all.
-		acceptAuth := p.authenticator.Accept(&r.Header, resourceName)
+		var acceptAuth bool
+		authenticatedBy, acceptAuth = p.authenticate(
+			r, target, resourceName,
+		)
+		authenticated = authenticatedBy == AuthenticatorLSAT
 		if !acceptAuth {
 			ok, err := target.freebieDb.CanPass(r, remoteIP)
 			if err != nil {
@@ -193,92 +743,389 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					w, r, http.StatusInternalServerError,
 					"freebie DB failure",
 				)
-				return
+				return nil, false
 			}
-			if !ok {
-				price, err := target.pricer.GetPrice(
-					r.Context(), r.URL.Path,
+			if ok {
+				ok, err = target.freebieDb.TallyFreebie(
+					r, remoteIP,
 				)
 				if err != nil {
-					prefixLog.Errorf("error getting "+
-						"resource price: %v", err)
+					prefixLog.Errorf("Error updating "+
+						"freebie db: %v", err)
 					sendDirectResponse(
-						w, r, http.StatusInternalServerError,
-						"failure fetching "+
-							"resource price",
+						w, r,
+						http.StatusInternalServerError,
+						"freebie DB failure",
 					)
-					return
+					return nil, false
 				}
+			}
 
-				// If the price returned is zero, then break
-				// out of the switch statement and allow access
-				// to the service.
-				if price == 0 {
-					break
+			// The free requests may also have been used up by a
+			// concurrent request, possibly on another instance,
+			// in the meantime.
+			if !ok {
+				trace.logf("Free requests used up")
+				if p.challenge(
+					w, r, target, resourceName, prefixLog,
+				) {
+
+					return nil, false
 				}
+			}
+		}
 
-				p.handlePaymentRequired(
-					w, r, resourceName, target.Price,
-				)
-				return
+	case authLevel.IsTrial():
+		// Clients without a valid token get a trial token if they
+		// didn't use up theirs yet.
+		var acceptAuth bool
+		authenticatedBy, acceptAuth = p.authenticate(
+			r, target, resourceName,
+		)
+		authenticated = authenticatedBy == AuthenticatorLSAT
+		if !acceptAuth {
+			trialReq, ok := p.issueTrialToken(
+				w, r, target, resourceName, remoteIP,
+				prefixLog,
+			)
+			if ok {
+				r = trialReq
+				authenticatedBy = AuthenticatorLSAT
+				authenticated = true
+				break
 			}
-			_, err = target.freebieDb.TallyFreebie(r, remoteIP)
-			if err != nil {
-				prefixLog.Errorf("Error updating freebie db: "+
-					"%v", err)
-				sendDirectResponse(
-					w, r, http.StatusInternalServerError,
-					"freebie DB failure",
-				)
-				return
+
+			trace.logf("No trial token left")
+			if p.challenge(w, r, target, resourceName, prefixLog) {
+				return nil, false
+			}
+		}
+
+	case authLevel.IsNostr():
+		// The nostr identity of the client is checked first, so only
+		// allowed identities are asked to pay.
+		if !checkNostr(w, r, target, nostrAuth, prefixLog) {
+			return nil, false
+		}
+		if !target.Nostr.RequireLSAT {
+			authenticatedBy = CaptureAuthNostr
+			break
+		}
+
+		var acceptAuth bool
+		authenticatedBy, acceptAuth = p.authenticate(
+			r, target, resourceName,
+		)
+		authenticated = authenticatedBy == AuthenticatorLSAT
+		if !acceptAuth {
+			trace.logf("Nostr identity accepted")
+			if p.challenge(w, r, target, resourceName, prefixLog) {
+				return nil, false
 			}
+
+			// Free resources only need the nostr identity.
+			authenticatedBy = CaptureAuthNostr
 		}
 	}
 
-	// If we got here, it means everything is OK to pass the request to the
-	// service backend via the reverse proxy.
-	p.proxyBackend.ServeHTTP(w, r)
+	// Captured and traced requests record how they were let through.
+	switch {
+	case authenticated:
+		recordCaptureAuth(r, CaptureAuthToken)
+		trace.logf("Request authenticated with a valid token")
+
+	// Requests accepted by other authenticators don't carry a token, so
+	// none of the token features below apply to them.
+	case authenticatedBy != "":
+		recordCaptureAuth(r, authenticatedBy)
+		trace.logf("Request authenticated by the %s authenticator",
+			authenticatedBy)
+
+	case authLevel.IsFreebie():
+		recordCaptureAuth(r, CaptureAuthFreebie)
+		trace.logf("Request granted as a free request")
+
+	default:
+		recordCaptureAuth(r, CaptureAuthOff)
+		trace.logf("Request passes without a token")
+	}
+
+	// Trial tokens may only make a limited number of requests per minute.
+	if authenticated && !p.checkTrialRate(w, r, target, prefixLog) {
+		return nil, false
+	}
+
+	// Requests made with a token may need to prove they aren't replayed.
+	if authenticated && !p.checkNonce(w, r, target, prefixLog) {
+		return nil, false
+	}
+
+	// Delegated tokens can be revoked and may only make a limited number
+	// of requests.
+	if authenticated && target.Delegation.Enabled &&
+		!p.checkDelegation(w, r, target, prefixLog) {
+
+		return nil, false
+	}
+
+	// The application may apply its own rules, like the limits of a plan,
+	// to the request before it's forwarded and counted.
+	if target.Authz.URL != "" &&
+		!checkAuthz(w, r, target, authenticated, remoteIP, prefixLog) {
+
+		return nil, false
+	}
+
+	// The requests made with a token are reported to its holder if the
+	// service asks for it.
+	if authenticated && target.Usage.Enabled {
+		p.countRequest(r, prefixLog)
+	}
+
+	// Clients that paid for a resource can fetch it again through a signed
+	// URL without the token if the service hands them out.
+	if authenticated && target.SignedURLs.Enabled {
+		p.issueSignedURL(w, r, target)
+	}
+
+	// Streams established with a token are billed per message if the
+	// service asks for it.
+	if authenticated && target.Billing.PerMessage {
+		var ok bool
+		r, ok = p.meterMessages(w, r, target, prefixLog)
+		if !ok {
+			return nil, false
+		}
+	}
+
+	// Responses to requests made with a token count against its transfer
+	// quota if the service has one.
+	if authenticated && target.Quota.Bytes > 0 {
+		tokenID, err := tokenIDFromHeader(r.Header)
+		if err != nil {
+			prefixLog.Errorf("Error reading token for quota: %v",
+				err)
+			sendDirectResponse(
+				w, r, http.StatusUnauthorized, "invalid token",
+			)
+			return nil, false
+		}
+
+		var ok bool
+		r, ok = p.meterTransfer(w, r, target, tokenID, prefixLog)
+		if !ok {
+			return nil, false
+		}
+	}
+
+	// Tell the backend which token paid for the request if it wants to
+	// know.
+	if target.Identity.Forward {
+		p.forwardIdentity(r, target, authenticated, prefixLog)
+	}
+
+	return r, true
 }
 
 // UpdateServices re-configures the proxy to use a new set of backend services.
+// Instances that are already served keep their state, so changes made to them
+// in place aren't picked up.
 func (p *Proxy) UpdateServices(services []*Service) error {
-	err := prepareServices(services)
+	// The instances that are already served were prepared before.
+	// Preparing them again would replace their pricers without closing
+	// them and wrap them in the surge and closed pricers once more, so
+	// only the new instances are prepared.
+	current := p.currentServices()
+	fresh := make([]*Service, 0, len(services))
+	for _, service := range services {
+		if !containsService(current, service) {
+			fresh = append(fresh, service)
+		}
+	}
+
+	err := prepareServices(fresh, p.newFreebieDB)
 	if err != nil {
 		return err
 	}
 
+	// New instances with the same configuration as one they replace, like
+	// the ones of a fleet configuration that was published again, take
+	// over its state instead of starting over.
+	inherited := make(map[*Service]bool)
+	created := make([]*Service, 0, len(fresh))
+	for _, service := range fresh {
+		old := replacedService(current, services, service, inherited)
+		if old == nil {
+			created = append(created, service)
+			continue
+		}
+
+		service.inheritState(old)
+		inherited[old] = true
+	}
+
+	// The instances of discovered backends are looked up with the
+	// resolver of the proxy.
+	for _, service := range fresh {
+		if service.discovery != nil {
+			service.discovery.setLookup(p.lookupSRV)
+		}
+	}
+
+	// Surge pricing raises the prices of the pricers with the load of the
+	// backend, which is tracked per service.
+	for _, service := range created {
+		load := service.load
+		if load == nil {
+			continue
+		}
+
+		service.pricer = pricer.NewSurgePricer(
+			service.pricer, &service.Surge, func() pricer.Load {
+				return load.load(p.queueReporter)
+			},
+		)
+	}
+
+	// Services with availability windows may charge another price while
+	// they are closed.
+	for _, service := range created {
+		price := service.Availability.ClosedPrice
+		if service.availability == nil || price == 0 {
+			continue
+		}
+
+		service.pricer = &closedPricer{
+			base:         service.pricer,
+			availability: service.availability,
+			price:        price,
+		}
+	}
+
 	certPool, err := certPool(services)
 	if err != nil {
 		return err
 	}
-	transport := &http.Transport{
-		ForceAttemptHTTP2: true,
-		TLSClientConfig: &tls.Config{
+	transport, h2cTransport, err := newServiceTransports(
+		services, &tls.Config{
 			RootCAs:            certPool,
 			InsecureSkipVerify: true,
-		},
+		}, p.dialContext,
+	)
+	if err != nil {
+		return err
 	}
 
-	p.proxyBackend = &httputil.ReverseProxy{
+	proxyBackend := &httputil.ReverseProxy{
 		Director:  p.director,
 		Transport: &trailerFixingTransport{next: transport},
 		ModifyResponse: func(res *http.Response) error {
+			if err := limitResponse(res); err != nil {
+				return err
+			}
+			if err := bufferResponse(res); err != nil {
+				return err
+			}
 			addCorsHeaders(res.Header)
 			return nil
 		},
+		ErrorHandler: handleBackendError,
 
 		// A negative value means to flush immediately after each write
 		// to the client.
 		FlushInterval: -1,
 	}
 
+	p.servicesMtx.Lock()
+	proxyBackend.BufferPool = p.copyBuffers
+	oldServices := p.services
+	p.services = services
+	p.grpcTransport = newGRPCTransport(transport, h2cTransport)
+	p.proxyBackend = proxyBackend
+	p.servicesMtx.Unlock()
+
+	// The pricers of the replaced services are no longer used. Instances
+	// that are served again keep theirs and copies inherit them, so we
+	// only close those that are gone.
+	for _, old := range oldServices {
+		if containsService(services, old) || inherited[old] {
+			continue
+		}
+		if err := old.pricer.Close(); err != nil {
+			log.Errorf("error while closing the pricer of "+
+				"service %s: %v", old.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// currentServices returns the services the proxy currently forwards to.
+func (p *Proxy) currentServices() []*Service {
+	p.servicesMtx.RLock()
+	defer p.servicesMtx.RUnlock()
+
+	return p.services
+}
+
+// Services returns the services the proxy currently serves. The returned slice
+// must not be modified.
+func (p *Proxy) Services() []*Service {
+	return p.currentServices()
+}
+
+// currentProxyBackend returns the reverse proxy for the current services.
+func (p *Proxy) currentProxyBackend() *httputil.ReverseProxy {
+	p.servicesMtx.RLock()
+	defer p.servicesMtx.RUnlock()
+
+	return p.proxyBackend
+}
+
+// currentGRPCTransport returns the gRPC transport for the current services.
+func (p *Proxy) currentGRPCTransport() *grpcTransport {
+	p.servicesMtx.RLock()
+	defer p.servicesMtx.RUnlock()
+
+	return p.grpcTransport
+}
+
+// replacedService returns the instance of the current services that is
+// replaced by the given new instance with the same configuration, or nil if
+// there is none. Instances that are part of the new services or whose state
+// was already inherited aren't replaced.
+func replacedService(current, services []*Service, service *Service,
+	inherited map[*Service]bool) *Service {
+
+	if service.config == "" {
+		return nil
+	}
+	for _, old := range current {
+		if old.config != service.config || inherited[old] ||
+			containsService(services, old) {
+
+			continue
+		}
+		return old
+	}
 	return nil
 }
 
+// containsService returns true if the given service instance is part of the
+// list.
+func containsService(services []*Service, service *Service) bool {
+	for _, s := range services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
 // Close cleans up the Proxy by closing any remaining open connections.
 func (p *Proxy) Close() error {
 	var returnErr error
-	for _, s := range p.services {
+	for _, s := range p.currentServices() {
 		if err := s.pricer.Close(); err != nil {
 			log.Errorf("error while closing the pricer of "+
 				"service %s: %v", s.Name, err)
@@ -292,12 +1139,19 @@ func (p *Proxy) Close() error {
 // director is a method that rewrites an incoming request to be forwarded to a
 // backend service.
 func (p *Proxy) director(req *http.Request) {
-	target, ok := matchService(req, p.services)
+	// The service was already matched when the request was authorized, so
+	// it doesn't need to be matched again.
+	target := serviceFromContext(req.Context())
+	ok := target != nil
+	if !ok {
+		target, ok = matchService(req, p.currentServices())
+	}
 	if ok {
 		// Rewrite address and protocol in the request so the
 		// real service is called instead.
-		req.Host = target.Address
-		req.URL.Host = target.Address
+		host := backendHost(req.Context(), target)
+		req.Host = host
+		req.URL.Host = host
 		req.URL.Scheme = target.Protocol
 
 		// Make sure we always forward the authorization in the correct/
@@ -347,21 +1201,22 @@ func certPool(services []*Service) (*x509.CertPool, error) {
 // expression matching the host and path.
 func matchService(req *http.Request, services []*Service) (*Service, bool) {
 	for _, service := range services {
-		hostRegexp := regexp.MustCompile(service.HostRegexp)
+		matchers := service.matchers()
+		hostRegexp := matchers.host
 		if !hostRegexp.MatchString(req.Host) {
 			log.Tracef("Req host [%s] doesn't match [%s].",
 				req.Host, hostRegexp)
 			continue
 		}
 
-		if service.PathRegexp == "" {
+		pathRegexp := matchers.path
+		if pathRegexp == nil {
 			log.Debugf("Host [%s] matched pattern [%s] and path "+
 				"expression is empty. Using service [%s].",
 				req.Host, hostRegexp, service.Address)
 			return service, true
 		}
 
-		pathRegexp := regexp.MustCompile(service.PathRegexp)
 		if !pathRegexp.MatchString(req.URL.Path) {
 			log.Tracef("Req path [%s] doesn't match [%s].",
 				req.URL.Path, pathRegexp)
@@ -388,21 +1243,128 @@ func addCorsHeaders(header http.Header) {
 
 	header.Add("Access-Control-Allow-Origin", "*")
 	header.Add("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	header.Add("Access-Control-Expose-Headers", "WWW-Authenticate")
+	header.Add(
+		"Access-Control-Expose-Headers",
+		"WWW-Authenticate, Grpc-Status, Grpc-Message, "+
+			hdrSignedURL+", "+HeaderRenews,
+	)
 	header.Add(
 		"Access-Control-Allow-Headers",
-		"Authorization, Grpc-Metadata-macaroon, WWW-Authenticate",
+		"Authorization, Grpc-Metadata-macaroon, WWW-Authenticate, "+
+			"Content-Type, X-Grpc-Web, X-User-Agent, Grpc-Timeout",
 	)
 }
 
+// accept returns whether the request is authenticated for the given resource.
+// Authenticators that support it are given the request context, so tokens bound
+// to the client can be verified.
+func (p *Proxy) accept(r *http.Request, resourceName string) bool {
+	ctxAuth, ok := p.authenticator.(auth.ContextAuthenticator)
+	if ok {
+		return ctxAuth.AcceptContext(r.Context(), &r.Header, resourceName)
+	}
+
+	return p.authenticator.Accept(&r.Header, resourceName)
+}
+
+// tokenIDFromHeader returns the ID of the token that was sent in the given
+// header.
+func tokenIDFromHeader(header http.Header) (lsat.TokenID, error) {
+	mac, _, err := lsat.FromHeader(&header)
+	if err != nil {
+		return lsat.TokenID{}, err
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return lsat.TokenID{}, err
+	}
+
+	return id.TokenID, nil
+}
+
+// challenge sends the client a payment challenge for the resource of the
+// service at its current price, renewing the expired token of the request if
+// there is one. It returns false without a response if the resource is free,
+// so the request is allowed to pass.
+func (p *Proxy) challenge(w http.ResponseWriter, r *http.Request,
+	target *Service, resourceName string, prefixLog *PrefixLog) bool {
+
+	price, err := target.pricer.GetPrice(r.Context(), r.URL.Path)
+	if err != nil {
+		prefixLog.Errorf("error getting resource price: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"failure fetching resource price",
+		)
+		return true
+	}
+
+	// If the price returned is zero, access to the service is allowed.
+	if price == 0 {
+		return false
+	}
+
+	// Clients with an expired token are asked to renew it.
+	price = p.renewalPrice(w, r, target, resourceName, price, prefixLog)
+
+	prefixLog.Infof("Authentication failed. Sending 402.")
+	traceFromRequest(r).logf("Sending payment challenge for %d satoshis",
+		price)
+	p.handlePaymentRequired(w, r, target, resourceName, price)
+
+	return true
+}
+
 // handlePaymentRequired returns fresh challenge header fields and status code
 // to the client signaling that a payment is required to fulfil the request.
+// Browsers are shown a payment page instead if the target service has it
+// enabled.
 func (p *Proxy) handlePaymentRequired(w http.ResponseWriter, r *http.Request,
-	serviceName string, servicePrice int64) {
+	target *Service, serviceName string, servicePrice int64) {
 
 	addCorsHeaders(r.Header)
 
-	header, err := p.authenticator.FreshChallengeHeader(r, serviceName, servicePrice)
+	// Bind the new token to the client if the service asks for it, and let
+	// it expire if the service's tokens need to be renewed.
+	bindingCaveats, err := target.Binding.caveats(r.Context())
+	if err != nil {
+		log.Infof("Unable to bind token for %s: %v", serviceName, err)
+		sendDirectResponse(
+			w, r, http.StatusBadRequest, "client binding failure",
+		)
+		return
+	}
+	bindingCaveats = append(
+		bindingCaveats, target.Renewal.caveats(serviceName)...,
+	)
+	if len(bindingCaveats) > 0 {
+		r = r.WithContext(lsat.AddToContext(
+			r.Context(), lsat.KeyBindingCaveats, bindingCaveats,
+		))
+	}
+
+	// The operator may want to know what the token was sold for later.
+	r = withMetadata(r, target)
+
+	header, err := p.serviceAuthenticator(target).FreshChallengeHeader(
+		r, serviceName, servicePrice,
+	)
+
+	// Services without an authenticator that issues challenges can only
+	// tell the client that it isn't authenticated.
+	if err == auth.ErrNoChallenge {
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized,
+			"authentication required",
+		)
+		return
+	}
+	if err == mint.ErrChallengerBusy {
+		log.Warnf("Challenger busy, rejecting request for %s",
+			serviceName)
+		sendBusyResponse(w, r)
+		return
+	}
 	if err != nil {
 		log.Errorf("Error creating new challenge header: %v", err)
 		sendDirectResponse(
@@ -419,31 +1381,123 @@ func (p *Proxy) handlePaymentRequired(w http.ResponseWriter, r *http.Request,
 		}
 	}
 
-	sendDirectResponse(w, r, http.StatusPaymentRequired, "payment required")
+	switch {
+	case target.PaymentPage && wantsPaymentPage(r):
+		p.sendPaymentPage(
+			w, r, serviceName, servicePrice,
+			header.Get(hdrWWWAuthenticate),
+		)
+		return
+
+	// Clients that don't want to parse the header can ask for the same
+	// information as JSON body.
+	case wantsJSONChallenge(r):
+		p.sendJSONChallenge(
+			w, r, servicePrice, header.Get(hdrWWWAuthenticate),
+		)
+		return
+	}
+
+	// gRPC clients receive the challenge in the response metadata and as
+	// detail of the status.
+	grpcStatus := codes.Unauthenticated
+	if target.LegacyGRPCChallenge {
+		grpcStatus = codes.Internal
+	}
+	if isGRPCWebRequest(r) || isGRPC(r.Header.Get(hdrContentType)) {
+		setGRPCChallengeDetails(
+			w, grpcStatus, "payment required", servicePrice,
+			header.Get(hdrWWWAuthenticate),
+		)
+	}
+	sendStatusResponse(
+		w, r, http.StatusPaymentRequired, grpcStatus, "payment required",
+	)
 }
 
 // sendDirectResponse sends a response directly to the client without proxying
 // anything to a backend. The given error is transported in a way the client can
 // understand. This means, for a gRPC client it is sent as specific header
-// fields.
+// fields, with the gRPC status code corresponding to the HTTP status code.
 func sendDirectResponse(w http.ResponseWriter, r *http.Request,
 	statusCode int, errInfo string) {
 
+	sendStatusResponse(w, r, statusCode, grpcCode(statusCode), errInfo)
+}
+
+// sendStatusResponse sends a response directly to the client like
+// sendDirectResponse, but with the given status code for gRPC clients.
+func sendStatusResponse(w http.ResponseWriter, r *http.Request,
+	statusCode int, grpcStatus codes.Code, errInfo string) {
+
 	// Find out if the client is a normal HTTP or a gRPC client. Every gRPC
 	// request should have the Content-Type header field set accordingly
 	// so we can use that.
 	switch {
-	case strings.HasPrefix(r.Header.Get(hdrContentType), hdrTypeGrpc):
-		w.Header().Set(hdrGrpcStatus, strconv.Itoa(int(codes.Internal)))
+	// gRPC and gRPC-Web clients only read the status of a gRPC error from
+	// a valid gRPC response. We therefore send a trailers-only response
+	// where the status is part of the header fields. The HTTP status code
+	// needs to be 200 for the clients to look at those fields at all,
+	// otherwise they only see an unexpected HTTP status.
+	case isGRPCWebRequest(r) || isGRPC(r.Header.Get(hdrContentType)):
+		w.Header().Set(hdrContentType, r.Header.Get(hdrContentType))
+		w.Header().Set(hdrGrpcStatus, strconv.Itoa(int(grpcStatus)))
 		w.Header().Set(hdrGrpcMessage, errInfo)
 
-		w.WriteHeader(statusCode)
+		w.WriteHeader(http.StatusOK)
 
 	default:
 		http.Error(w, errInfo, statusCode)
 	}
 }
 
+// grpcCode returns the gRPC status code that corresponds to the HTTP status
+// code of a direct response.
+func grpcCode(statusCode int) codes.Code {
+	switch statusCode {
+	case http.StatusOK:
+		return codes.OK
+
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+
+	// A payment challenge is an authentication failure that the client
+	// can resolve by paying for a token.
+	case http.StatusUnauthorized, http.StatusPaymentRequired:
+		return codes.Unauthenticated
+
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+
+	case http.StatusNotFound:
+		return codes.Unimplemented
+
+	case http.StatusConflict:
+		return codes.Aborted
+
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+
+	default:
+		return codes.Internal
+	}
+}
+
+// sendBusyResponse tells the client to retry a request later, because the
+// challenger is too busy to create or look up invoices right now.
+func sendBusyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(hdrRetryAfter, busyRetryAfter)
+	sendDirectResponse(
+		w, r, http.StatusServiceUnavailable, "challenger busy",
+	)
+}
+
 type trailerFixingTransport struct {
 	next http.RoundTripper
 }
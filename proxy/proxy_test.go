@@ -1,20 +1,28 @@
 package proxy_test
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"path"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/challengerpc"
+	"github.com/lightninglabs/aperture/freebie"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/pricer"
 	"github.com/lightninglabs/aperture/proxy"
 	proxytest "github.com/lightninglabs/aperture/proxy/testdata"
 	"github.com/lightningnetwork/lnd/cert"
@@ -189,6 +197,263 @@ func runHTTPTest(t *testing.T, tc *testCase) {
 	require.Equal(t, testHTTPResponseBody, string(bodyBytes))
 }
 
+// staticCountryResolver resolves the countries of IP addresses from a map.
+type staticCountryResolver map[string]string
+
+// Country returns the country of the IP address from the map.
+func (s staticCountryResolver) Country(ip net.IP) (string, error) {
+	return s[ip.String()], nil
+}
+
+// TestCountryRules tests that clients are denied access to a service based on
+// the country they are located in.
+func TestCountryRules(t *testing.T) {
+	services := []*proxy.Service{{
+		Address:        testTargetServiceAddress,
+		HostRegexp:     testHostRegexp,
+		PathRegexp:     "^/allow/.*$",
+		Protocol:       "http",
+		Auth:           "on",
+		Price:          10,
+		AllowCountries: []string{"ch", "li"},
+	}, {
+		Address:       testTargetServiceAddress,
+		HostRegexp:    testHostRegexp,
+		PathRegexp:    "^/deny/.*$",
+		Protocol:      "http",
+		Auth:          "on",
+		Price:         10,
+		DenyCountries: []string{"XX"},
+	}}
+
+	p, err := proxy.New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+	p.SetCountryResolver(staticCountryResolver{
+		"192.0.2.1": "CH",
+		"192.0.2.2": "XX",
+	})
+
+	testCases := []struct {
+		path       string
+		remoteAddr string
+		status     int
+	}{
+		{"/allow/test", "192.0.2.1:1234", http.StatusPaymentRequired},
+		{"/allow/test", "192.0.2.2:1234", http.StatusForbidden},
+		{"/allow/test", "192.0.2.3:1234", http.StatusForbidden},
+		{"/deny/test", "192.0.2.1:1234", http.StatusPaymentRequired},
+		{"/deny/test", "192.0.2.2:1234", http.StatusForbidden},
+		{"/deny/test", "192.0.2.3:1234", http.StatusPaymentRequired},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(
+			"GET", "http://localhost:8081"+tc.path, nil,
+		)
+		req.RemoteAddr = tc.remoteAddr
+		rec := httptest.NewRecorder()
+
+		p.ServeHTTP(rec, req)
+		require.Equal(t, tc.status, rec.Code, "%s from %s", tc.path,
+			tc.remoteAddr)
+	}
+}
+
+// racingFreebieDB is a freebie store whose last free request is always used
+// up by a concurrent request before it can be tallied.
+type racingFreebieDB struct{}
+
+// CanPass always lets the request pass.
+func (racingFreebieDB) CanPass(*http.Request, net.IP) (bool, error) {
+	return true, nil
+}
+
+// TallyFreebie always loses the race for the last free request.
+func (racingFreebieDB) TallyFreebie(*http.Request, net.IP) (bool, error) {
+	return false, nil
+}
+
+// TestFreebieRace tests that a client that loses the race for the last free
+// request is asked to pay the price of the resource it requested.
+func TestFreebieRace(t *testing.T) {
+	services := []*proxy.Service{{
+		Address:    testTargetServiceAddress,
+		HostRegexp: testHostRegexp,
+		Protocol:   "http",
+		Auth:       "freebie 1",
+		Price:      10,
+		PathPrices: []*pricer.PathPrice{{
+			Path:  "^/expensive/.*$",
+			Price: 500,
+		}},
+	}}
+	p, err := proxy.NewWithFreebieDB(
+		auth.NewMockAuthenticator(), services,
+		func(string, freebie.Count) freebie.DB {
+			return racingFreebieDB{}
+		},
+	)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(
+		"GET", "http://localhost:8081/expensive/test", nil,
+	)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+
+	var challenge struct {
+		PriceSat int64 `json:"price_sat"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &challenge))
+	require.Equal(t, int64(500), challenge.PriceSat)
+}
+
+// testHandlerService returns a paid service that serves the requests to the
+// paths matching the given expression with the given handler.
+func testHandlerService(name, pathRegexp string,
+	handler http.HandlerFunc) *proxy.Service {
+
+	return &proxy.Service{
+		Name:       name,
+		HostRegexp: testHostRegexp,
+		PathRegexp: pathRegexp,
+		Auth:       "on",
+		Price:      10,
+		Handler:    handler,
+	}
+}
+
+// testAuthHeader returns the Authorization header value of an LSAT with the
+// given token ID, which the mock authenticator accepts.
+func testAuthHeader(t *testing.T, tokenID lsat.TokenID) string {
+	t.Helper()
+
+	var id bytes.Buffer
+	err := lsat.EncodeIdentifier(&id, &lsat.Identifier{
+		Version: lsat.LatestVersion,
+		TokenID: tokenID,
+	})
+	require.NoError(t, err)
+	mac, err := macaroon.New(
+		[]byte("secret"), id.Bytes(), "lsat", macaroon.LatestVersion,
+	)
+	require.NoError(t, err)
+	macBytes, err := mac.MarshalBinary()
+	require.NoError(t, err)
+
+	return fmt.Sprintf(
+		"LSAT %s:%s", base64.StdEncoding.EncodeToString(macBytes),
+		strings.Repeat("00", 32),
+	)
+}
+
+// serveTestRequest serves a request to the given path with the proxy. The
+// Authorization header field is only set if a value is given. The options can
+// change the request further before it's served.
+func serveTestRequest(p *proxy.Proxy, method, path, authHeader string,
+	body io.Reader,
+	opts ...func(*http.Request)) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(method, "http://localhost:8081"+path, body)
+	if authHeader != "" {
+		req.Header.Set("Authorization", authHeader)
+	}
+	for _, opt := range opts {
+		opt(req)
+	}
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	return rec
+}
+
+// withTestHeader returns a request option that sets the header field to the
+// value if it isn't empty.
+func withTestHeader(name, value string) func(*http.Request) {
+	return func(r *http.Request) {
+		if value != "" {
+			r.Header.Set(name, value)
+		}
+	}
+}
+
+// withTestRemoteAddr returns a request option that sets the address the
+// request is made from.
+func withTestRemoteAddr(addr string) func(*http.Request) {
+	return func(r *http.Request) {
+		r.RemoteAddr = addr
+	}
+}
+
+// TestServiceHandler tests that requests to a service with a handler are
+// served in process once they are authenticated.
+func TestServiceHandler(t *testing.T) {
+	services := []*proxy.Service{testHandlerService(
+		"", "^/local/.*$",
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.URL.Path))
+		},
+	)}
+
+	p, err := proxy.New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	rec := serveTestRequest(p, "GET", "/local/x", "", nil)
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+
+	rec = serveTestRequest(p, "GET", "/local/x", "LSAT dummy", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "/local/x", rec.Body.String())
+}
+
+// TestRequireNonce tests that authenticated requests to a service that
+// requires nonces are only accepted with a nonce that wasn't used before.
+func TestRequireNonce(t *testing.T) {
+	services := []*proxy.Service{{
+		Address:      testTargetServiceAddress,
+		HostRegexp:   testHostRegexp,
+		PathRegexp:   "^/nonce/.*$",
+		Protocol:     "http",
+		Auth:         "on",
+		Price:        10,
+		RequireNonce: true,
+	}}
+	p, err := proxy.New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+	authHeader := testAuthHeader(t, lsat.TokenID{})
+
+	// The backend isn't running, so requests that pass the nonce check are
+	// answered with a bad gateway error.
+	testCases := []struct {
+		auth   bool
+		nonce  string
+		status int
+	}{
+		{false, "", http.StatusPaymentRequired},
+		{true, "", http.StatusBadRequest},
+		{true, "invalid", http.StatusBadRequest},
+		{true, "5", http.StatusBadGateway},
+		{true, "5", http.StatusConflict},
+		{true, "4", http.StatusConflict},
+		{true, "6", http.StatusBadGateway},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(
+			"GET", "http://localhost:8081/nonce/test", nil,
+		)
+		if tc.auth {
+			req.Header.Set("Authorization", authHeader)
+		}
+		if tc.nonce != "" {
+			req.Header.Set("Aperture-Nonce", tc.nonce)
+		}
+		rec := httptest.NewRecorder()
+
+		p.ServeHTTP(rec, req)
+		require.Equal(t, tc.status, rec.Code, "nonce %s", tc.nonce)
+	}
+}
+
 // TestProxyHTTP tests that the proxy can forward gRPC requests to a backend
 // service and handle LSAT authentication correctly.
 func TestProxyGRPC(t *testing.T) {
@@ -306,7 +571,7 @@ func runGRPCTest(t *testing.T, tc *testCase) {
 	statusErr, ok := status.FromError(err)
 	require.True(t, ok)
 	require.Equal(t, "payment required", statusErr.Message())
-	require.Equal(t, codes.Internal, statusErr.Code())
+	require.Equal(t, codes.Unauthenticated, statusErr.Code())
 
 	// We expect the WWW-Authenticate header field to be set to an LSAT
 	// auth response.
@@ -320,6 +585,16 @@ func runGRPCTest(t *testing.T, tc *testCase) {
 		capturedHeader[0],
 	)
 
+	// The challenge is also attached to the status as detail, so clients
+	// don't need to parse the header.
+	details := statusErr.Details()
+	require.Len(t, details, 1)
+	challenge, ok := details[0].(*challengerpc.PaymentChallenge)
+	require.True(t, ok)
+	require.Equal(t, "LSAT", challenge.Scheme)
+	require.NotEmpty(t, challenge.Macaroon)
+	require.Contains(t, capturedHeader[0], challenge.Invoice)
+
 	// Make sure that if we query an URL that is on the whitelist, we don't
 	// get the 402 response.
 	if len(tc.authWhitelist) > 0 {
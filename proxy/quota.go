@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// transferRecordTimeout is the maximum time it may take to record the
+	// bytes of a response once it's complete.
+	transferRecordTimeout = 5 * time.Second
+)
+
+// QuotaConfig holds the transfer quota of the tokens of a service.
+type QuotaConfig struct {
+	// Bytes is the number of response bytes a token pays for. Once they
+	// are used up, new requests made with the token are answered with a
+	// fresh challenge. Responses that are in flight when the quota is
+	// reached are completed. Zero means there is no quota.
+	Bytes uint64 `long:"bytes" description:"The number of response bytes a token pays for, like 10000000000 for 10 GB (default 0, no quota)"`
+}
+
+// TransferStore is an entity that keeps track of the number of response bytes
+// that were sent with each token, so the transfer quota of a token can be
+// enforced.
+type TransferStore interface {
+	// Transferred returns the number of response bytes that were sent
+	// with the token so far.
+	Transferred(context.Context, lsat.TokenID) (uint64, error)
+
+	// AddTransferred adds the given number of bytes to the bytes that
+	// were sent with the token.
+	AddTransferred(context.Context, lsat.TokenID, uint64) error
+}
+
+// memTransferStore is a TransferStore that keeps the transferred bytes in
+// memory.
+type memTransferStore struct {
+	sync.Mutex
+	transferred map[lsat.TokenID]uint64
+}
+
+// A compile-time constraint to ensure memTransferStore implements
+// TransferStore.
+var _ TransferStore = (*memTransferStore)(nil)
+
+// newMemTransferStore creates a new, empty in-memory transfer store.
+func newMemTransferStore() *memTransferStore {
+	return &memTransferStore{
+		transferred: make(map[lsat.TokenID]uint64),
+	}
+}
+
+// Transferred returns the number of response bytes that were sent with the
+// token so far.
+//
+// NOTE: This is part of the TransferStore interface.
+func (s *memTransferStore) Transferred(_ context.Context,
+	tokenID lsat.TokenID) (uint64, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.transferred[tokenID], nil
+}
+
+// AddTransferred adds the given number of bytes to the bytes that were sent
+// with the token.
+//
+// NOTE: This is part of the TransferStore interface.
+func (s *memTransferStore) AddTransferred(_ context.Context,
+	tokenID lsat.TokenID, n uint64) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.transferred[tokenID] += n
+	return nil
+}
+
+// SetTransferStore sets the store the transferred bytes of tokens are kept in
+// for the services with a transfer quota. Instances that share the store also
+// share the quota of a token.
+func (p *Proxy) SetTransferStore(store TransferStore) {
+	p.transferStore = store
+}
+
+// transferMeter records the bytes of a response to a request that was made
+// with a token of a service with a transfer quota.
+type transferMeter struct {
+	store   TransferStore
+	tokenID lsat.TokenID
+}
+
+// transferMeterKey is the context key under which the transfer meter of a
+// request is stored.
+type transferMeterKey struct{}
+
+// transferMeterFromContext returns the meter the bytes of the response are
+// recorded with, or nil if they aren't metered.
+func transferMeterFromContext(ctx context.Context) *transferMeter {
+	meter, _ := ctx.Value(transferMeterKey{}).(*transferMeter)
+	return meter
+}
+
+// meterTransfer attaches a transfer meter to a request made with the given
+// token to a service with a transfer quota, so the bytes of the response are
+// counted against the quota of the token. If the quota is already used up, a
+// fresh challenge is sent to the client and false is returned.
+func (p *Proxy) meterTransfer(w http.ResponseWriter, r *http.Request,
+	target *Service, tokenID lsat.TokenID,
+	prefixLog *PrefixLog) (*http.Request, bool) {
+
+	transferred, err := p.transferStore.Transferred(r.Context(), tokenID)
+	if err != nil {
+		prefixLog.Errorf("Error querying transferred bytes: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "quota failure",
+		)
+		return nil, false
+	}
+	if transferred >= target.Quota.Bytes {
+		price, err := target.pricer.GetPrice(r.Context(), r.URL.Path)
+		if err != nil {
+			prefixLog.Errorf("error getting resource price: %v",
+				err)
+			sendDirectResponse(
+				w, r, http.StatusInternalServerError,
+				"failure fetching resource price",
+			)
+			return nil, false
+		}
+
+		prefixLog.Infof("Transfer quota of token used up. Sending 402.")
+		p.handlePaymentRequired(
+			w, r, target, target.ResourceName(r.URL.Path), price,
+		)
+		return nil, false
+	}
+
+	meter := &transferMeter{
+		store:   p.transferStore,
+		tokenID: tokenID,
+	}
+	ctx := context.WithValue(r.Context(), transferMeterKey{}, meter)
+	return r.WithContext(ctx), true
+}
+
+// writer returns a response writer that counts the bytes written to the given
+// one and a function that records them once the response is complete.
+func (m *transferMeter) writer(w http.ResponseWriter,
+	prefixLog *PrefixLog) (http.ResponseWriter, func()) {
+
+	counter := &countingResponseWriter{ResponseWriter: w}
+	return counter, func() {
+		if counter.written == 0 {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(
+			context.Background(), transferRecordTimeout,
+		)
+		defer cancel()
+
+		err := m.store.AddTransferred(ctx, m.tokenID, counter.written)
+		if err != nil {
+			prefixLog.Errorf("Error recording transferred bytes: "+
+				"%v", err)
+		}
+	}
+}
+
+// countingResponseWriter is a http.ResponseWriter that counts the bytes of the
+// response body.
+type countingResponseWriter struct {
+	http.ResponseWriter
+
+	written uint64
+}
+
+// Write sends a chunk of the response body.
+func (c *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(b)
+	c.written += uint64(n)
+	return n, err
+}
+
+// ReadFrom sends the response body read from src. It's passed on to the
+// response writer of the HTTP server, which can send files without copying
+// them through user space.
+func (c *countingResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	n, err := readFrom(c.ResponseWriter, src)
+	c.written += uint64(n)
+	return n, err
+}
+
+// Flush sends any buffered data to the client.
+func (c *countingResponseWriter) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the reverse proxy take over the connection for protocol
+// upgrades. The bytes sent over a hijacked connection aren't counted.
+func (c *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter,
+	error) {
+
+	hijacker, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection can't be hijacked")
+	}
+	return hijacker.Hijack()
+}
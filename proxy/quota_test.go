@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/pricer"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTransferQuota tests that the response bytes sent with a token are
+// recorded and that the token is challenged again once its quota is used up.
+func TestTransferQuota(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		store   = newMemTransferStore()
+		tokenID = lsat.TokenID{1}
+		target  = &Service{
+			Name:   "downloads",
+			Quota:  QuotaConfig{Bytes: 10},
+			pricer: pricer.NewDefaultPricer(100),
+		}
+		p = &Proxy{
+			authenticator: auth.NewMockAuthenticator(),
+			transferStore: store,
+		}
+	)
+
+	download := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/files/a.zip", nil)
+		_, prefixLog := NewRemoteIPPrefixLog(log, req.RemoteAddr)
+		req, ok := p.meterTransfer(rec, req, target, tokenID, prefixLog)
+		if !ok {
+			return rec
+		}
+
+		meter := transferMeterFromContext(req.Context())
+		require.NotNil(t, meter)
+		w, record := meter.writer(rec, prefixLog)
+		_, err := w.Write([]byte(body))
+		require.NoError(t, err)
+		record()
+
+		return rec
+	}
+
+	// Downloads are allowed until the quota is used up. The download that
+	// exceeds it is still completed.
+	rec := download("0123456")
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = download("0123456")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	transferred, err := store.Transferred(ctx, tokenID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(14), transferred)
+
+	// Further downloads are answered with a fresh challenge.
+	rec = download("0123456")
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	require.NotEmpty(t, rec.Header().Get(hdrWWWAuthenticate))
+
+	transferred, err = store.Transferred(ctx, tokenID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(14), transferred)
+
+	// Other tokens have their own quota.
+	transferred, err = store.Transferred(ctx, lsat.TokenID{2})
+	require.NoError(t, err)
+	require.Zero(t, transferred)
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/proof"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+const (
+	// receiptPathPrefix is the prefix of the receipt endpoint. The receipt
+	// of a token is downloaded at the prefix followed by the name of the
+	// service the token was issued for.
+	receiptPathPrefix = "/.aperture/receipt/"
+)
+
+// receiptResponse is the JSON body of the response of the receipt endpoint.
+type receiptResponse struct {
+	Service     string    `json:"service"`
+	TokenID     string    `json:"token_id"`
+	PaymentHash string    `json:"payment_hash"`
+	Preimage    string    `json:"preimage"`
+	Amount      int64     `json:"amount"`
+	Settled     time.Time `json:"settled"`
+	PublicKey   string    `json:"public_key"`
+	Signature   string    `json:"signature"`
+}
+
+// isReceiptRequest returns true if the request is addressed to the receipt
+// endpoint.
+func isReceiptRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, receiptPathPrefix)
+}
+
+// handleReceipt sends a signed receipt of the payment of the token the request
+// is made with to its holder. The receipt is generated from the settled
+// invoice of the token and signed with the key response proofs are signed
+// with, so it can be verified with the published proof key.
+func (p *Proxy) handleReceipt(w http.ResponseWriter, r *http.Request,
+	remoteIP net.IP, prefixLog *PrefixLog) {
+
+	if r.Method != http.MethodGet {
+		sendDirectResponse(
+			w, r, http.StatusMethodNotAllowed, "method not allowed",
+		)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, receiptPathPrefix)
+	target, ok := p.serviceByName(name)
+	if !ok || !target.Receipts || p.responseSigner == nil ||
+		p.paymentFetcher == nil {
+
+		sendDirectResponse(w, r, http.StatusNotFound, "not found")
+		return
+	}
+
+	// Only the holder of a valid token can get its receipt.
+	r = withClientBinding(r, remoteIP)
+	r = withGracePeriod(r, target)
+	if !p.accept(r, target.Name) {
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "invalid token",
+		)
+		return
+	}
+	mac, preimage, err := lsat.FromHeader(&r.Header)
+	if err != nil {
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "invalid token",
+		)
+		return
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "invalid token",
+		)
+		return
+	}
+
+	invoice, err := p.paymentFetcher.FetchInvoice(
+		r.Context(), id.PaymentHash,
+	)
+	if err != nil {
+		prefixLog.Errorf("Error looking up invoice for receipt: %v",
+			err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "receipt failure",
+		)
+		return
+	}
+	if invoice.State != lnrpc.Invoice_SETTLED {
+		sendDirectResponse(
+			w, r, http.StatusPaymentRequired, "invoice not paid",
+		)
+		return
+	}
+
+	receipt := &proof.Receipt{
+		Settled:     time.Unix(invoice.SettleDate, 0).UTC(),
+		TokenID:     id.TokenID.String(),
+		Service:     target.Name,
+		PaymentHash: id.PaymentHash.String(),
+		Preimage:    preimage.String(),
+		Amount:      invoice.AmtPaidSat,
+	}
+	sig, err := proof.Sign(p.responseSigner, receipt)
+	if err != nil {
+		prefixLog.Errorf("Error signing receipt: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "receipt failure",
+		)
+		return
+	}
+	pubKey, _ := p.responseSigner.Public().(ed25519.PublicKey)
+
+	addCorsHeaders(w.Header())
+	w.Header().Set(hdrContentType, hdrTypeJSON)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(
+		"attachment; filename=\"receipt-%s.json\"", receipt.PaymentHash,
+	))
+	err = json.NewEncoder(w).Encode(&receiptResponse{
+		Service:     receipt.Service,
+		TokenID:     receipt.TokenID,
+		PaymentHash: receipt.PaymentHash,
+		Preimage:    receipt.Preimage,
+		Amount:      receipt.Amount,
+		Settled:     receipt.Settled,
+		PublicKey:   hex.EncodeToString(pubKey),
+		Signature:   base64.StdEncoding.EncodeToString(sig),
+	})
+	if err != nil {
+		prefixLog.Errorf("Error sending receipt: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/proof"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+)
+
+// TestReceipt makes sure the holder of a paid token gets a receipt of its
+// payment that can be verified with the proof key.
+func TestReceipt(t *testing.T) {
+	preimage := lntypes.Preimage{1, 2, 3}
+	hash := preimage.Hash()
+	_, macBase64 := newPaywallMacaroon(t, hash)
+
+	services := []*Service{{
+		Name:       "oracle",
+		HostRegexp: ".*",
+		Auth:       "on",
+		Price:      100,
+		Receipts:   true,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	pubKey, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	p.SetResponseSigner(key)
+
+	fetcher := &mockInvoiceFetcher{
+		invoices: make(map[lntypes.Hash]*lnrpc.Invoice),
+	}
+	p.SetPaymentFetcher(fetcher)
+
+	authHeader := "LSAT " + macBase64 + ":" + preimage.String()
+	serve := func() *httptest.ResponseRecorder {
+		return serveTestRequest(
+			p, http.MethodGet, "/.aperture/receipt/oracle",
+			authHeader, nil,
+		)
+	}
+
+	// There is no receipt for an unpaid invoice.
+	fetcher.invoices[hash] = &lnrpc.Invoice{State: lnrpc.Invoice_OPEN}
+	require.Equal(t, http.StatusPaymentRequired, serve().Code)
+
+	fetcher.invoices[hash] = &lnrpc.Invoice{
+		State:      lnrpc.Invoice_SETTLED,
+		SettleDate: 1600000000,
+		AmtPaidSat: 100,
+	}
+	rec := serve()
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var resp receiptResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Equal(t, hash.String(), resp.PaymentHash)
+	require.Equal(t, preimage.String(), resp.Preimage)
+	require.EqualValues(t, 100, resp.Amount)
+	require.Equal(t, hex.EncodeToString(pubKey), resp.PublicKey)
+
+	sig, err := base64.StdEncoding.DecodeString(resp.Signature)
+	require.NoError(t, err)
+	receipt := &proof.Receipt{
+		Settled:     time.Unix(1600000000, 0),
+		TokenID:     resp.TokenID,
+		Service:     "oracle",
+		PaymentHash: resp.PaymentHash,
+		Preimage:    resp.Preimage,
+		Amount:      resp.Amount,
+	}
+	require.NoError(t, proof.Verify(pubKey, receipt, sig))
+}
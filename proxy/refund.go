@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"gopkg.in/macaroon.v2"
+)
+
+var (
+	// ErrNoBalance is returned if the unused balance of a token of a
+	// service is requested that doesn't bill per message.
+	ErrNoBalance = errors.New("service has no prepaid balances")
+
+	// ErrNoRefunds is returned if a balance is to be refunded without a
+	// way to verify the token and look up what was paid for it.
+	ErrNoRefunds = errors.New("refunds not supported")
+)
+
+// Refund is the unused balance of a token that is refunded.
+type Refund struct {
+	// TokenID is the ID of the token whose balance is refunded.
+	TokenID lsat.TokenID
+
+	// Messages is the number of messages that were left of the balance.
+	Messages uint64
+
+	// Amount is the value of the messages in satoshis at the price the
+	// token was paid with, rounded down. It's never more than the amount
+	// paid for the token, which is its share of the invoice if it was
+	// minted in a batch.
+	Amount int64
+}
+
+// ExhaustBalance marks the message balance of the token of the given service as
+// used up and returns what was left of it, so it can be refunded. The balance
+// can't be spent anymore afterwards, so it's refunded at most once. Only the
+// balances of tokens that were minted by us for the service and whose invoice
+// was paid are refunded, at the price per message the token was paid with.
+func (p *Proxy) ExhaustBalance(ctx context.Context, serviceName string,
+	mac *macaroon.Macaroon) (*Refund, error) {
+
+	target, ok := p.serviceByName(serviceName)
+	if !ok {
+		return nil, fmt.Errorf("unknown service %s", serviceName)
+	}
+	if !target.Billing.PerMessage {
+		return nil, ErrNoBalance
+	}
+	if p.macaroonVerifier == nil || p.paymentFetcher == nil {
+		return nil, ErrNoRefunds
+	}
+
+	caveats, err := p.macaroonVerifier.VerifyMacaroon(ctx, mac)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+	if !caveatsAllowService(caveats, target.Name) {
+		return nil, fmt.Errorf("token not valid for service %s",
+			target.Name)
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+
+	invoice, err := p.paymentFetcher.FetchInvoice(ctx, id.PaymentHash)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up invoice: %v", err)
+	}
+	if invoice.State != lnrpc.Invoice_SETTLED {
+		return nil, fmt.Errorf("invoice of token not paid")
+	}
+
+	// The messages are valued at the price per message of the balance
+	// the token was paid with. Top-ups add to the balance, but the refund
+	// never exceeds what was paid for the token itself.
+	paidMessages, err := tokenMessages(mac, target)
+	if err != nil || paidMessages == 0 {
+		return nil, fmt.Errorf("invalid messages caveat")
+	}
+	balance := paidMessages
+	if target.Billing.TopUp {
+		credited, err := p.topUpStore.Credited(ctx, id.TokenID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to query top-ups: %v",
+				err)
+		}
+		balance += credited
+	}
+
+	left, err := p.balanceStore.SpendAll(ctx, id.TokenID, balance)
+	if err != nil {
+		return nil, fmt.Errorf("unable to exhaust balance: %v", err)
+	}
+
+	// The tokens of a batch share one invoice, so each of them was only
+	// paid its share of it.
+	paid := invoice.AmtPaidSat / batchSize(caveats)
+	amount := int64(left) * paid / int64(paidMessages)
+	if amount > paid {
+		amount = paid
+	}
+
+	return &Refund{
+		TokenID:  id.TokenID,
+		Messages: left,
+		Amount:   amount,
+	}, nil
+}
+
+// caveatsAllowService returns true if the given caveats contain a services
+// caveat and all of them include the service.
+func caveatsAllowService(caveats []lsat.Caveat, serviceName string) bool {
+	found := false
+	for _, caveat := range caveats {
+		if caveat.Condition != lsat.CondServices {
+			continue
+		}
+
+		services, err := lsat.DecodeServicesCaveat(caveat)
+		if err != nil || !containsServiceName(services, serviceName) {
+			return false
+		}
+		found = true
+	}
+
+	return found
+}
+
+// batchSize returns the number of tokens that share the invoice of a token with
+// the given caveats. Holders can only add caveats, so the largest size is used,
+// which can only lower what they are refunded.
+func batchSize(caveats []lsat.Caveat) int64 {
+	size := int64(1)
+	for _, caveat := range caveats {
+		if caveat.Condition != lsat.CondBatch {
+			continue
+		}
+
+		value, err := strconv.ParseInt(caveat.Value, 10, 64)
+		if err == nil && value > size {
+			size = value
+		}
+	}
+
+	return size
+}
+
+// containsServiceName returns true if the service with the given name is part
+// of the list.
+func containsServiceName(services []lsat.Service, name string) bool {
+	for _, service := range services {
+		if service.Name == name {
+			return true
+		}
+	}
+	return false
+}
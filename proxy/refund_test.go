@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+// newRefundToken returns a token of the service with the given ID that is paid
+// for with the invoice of the given hash and is signed with the root key of the
+// paywall tests.
+func newRefundToken(t *testing.T, service string, hash lntypes.Hash,
+	tokenID byte, caveats ...lsat.Caveat) *macaroon.Macaroon {
+
+	var buf bytes.Buffer
+	err := lsat.EncodeIdentifier(&buf, &lsat.Identifier{
+		Version:     lsat.LatestVersion,
+		PaymentHash: hash,
+		TokenID:     lsat.TokenID{tokenID},
+	})
+	require.NoError(t, err)
+
+	mac, err := macaroon.New(
+		paywallRootKey, buf.Bytes(), "LSAT", macaroon.LatestVersion,
+	)
+	require.NoError(t, err)
+
+	servicesCaveat, err := lsat.NewServicesCaveat(lsat.Service{
+		Name: service,
+	})
+	require.NoError(t, err)
+	caveats = append([]lsat.Caveat{servicesCaveat}, caveats...)
+	require.NoError(t, lsat.AddFirstPartyCaveats(mac, caveats...))
+
+	return mac
+}
+
+// TestExhaustBalance tests that only the balances of paid tokens of the service
+// are refunded, at most at the amount paid for them.
+func TestExhaustBalance(t *testing.T) {
+	ctx := context.Background()
+	service := &Service{
+		Name:       "stream",
+		HostRegexp: ".*",
+		Price:      1000,
+		Billing: BillingConfig{
+			PerMessage: true,
+			Messages:   100,
+		},
+	}
+	p, err := New(auth.NewMockAuthenticator(), []*Service{service})
+	require.NoError(t, err)
+
+	hash := lntypes.Preimage{1}.Hash()
+	mac := newRefundToken(t, service.Name, hash, 1)
+
+	// Without a way to verify tokens, nothing is refunded.
+	_, err = p.ExhaustBalance(ctx, service.Name, mac)
+	require.Equal(t, ErrNoRefunds, err)
+
+	invoices := &mockInvoiceFetcher{
+		invoices: map[lntypes.Hash]*lnrpc.Invoice{
+			hash: {State: lnrpc.Invoice_OPEN},
+		},
+	}
+	p.SetPaymentFetcher(invoices)
+	p.SetMacaroonVerifier(&mockMacaroonVerifier{
+		rootKey: []byte("00112233445566778899aabbccddeeff"),
+	})
+
+	// Tokens we didn't mint aren't refunded.
+	_, err = p.ExhaustBalance(ctx, service.Name, mac)
+	require.Error(t, err)
+
+	// Neither are those of other services or that weren't paid for.
+	p.SetMacaroonVerifier(&mockMacaroonVerifier{rootKey: paywallRootKey})
+	other, _ := newPaywallMacaroon(t, hash)
+	_, err = p.ExhaustBalance(ctx, service.Name, other)
+	require.Error(t, err)
+
+	_, err = p.ExhaustBalance(ctx, service.Name, mac)
+	require.Error(t, err)
+
+	// The messages left are valued at the price the token was paid with,
+	// not the current price of the service.
+	invoices.invoices[hash] = &lnrpc.Invoice{
+		State:      lnrpc.Invoice_SETTLED,
+		AmtPaidSat: 500,
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	require.NoError(t, err)
+	for i := 0; i < 40; i++ {
+		ok, err := p.balanceStore.Spend(ctx, id.TokenID, 100)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+	refund, err := p.ExhaustBalance(ctx, service.Name, mac)
+	require.NoError(t, err)
+	require.Equal(t, id.TokenID, refund.TokenID)
+	require.Equal(t, uint64(60), refund.Messages)
+	require.Equal(t, int64(300), refund.Amount)
+
+	// The balance is only refunded once.
+	refund, err = p.ExhaustBalance(ctx, service.Name, mac)
+	require.NoError(t, err)
+	require.Zero(t, refund.Amount)
+
+	// Top-ups add to the balance, but no more than the amount paid for the
+	// token is refunded.
+	service.Billing.TopUp = true
+	topUpHash := lntypes.Preimage{2}.Hash()
+	topUpMac := newRefundToken(t, service.Name, topUpHash, 2)
+	invoices.invoices[topUpHash] = &lnrpc.Invoice{
+		State:      lnrpc.Invoice_SETTLED,
+		AmtPaidSat: 500,
+	}
+	id, err = lsat.DecodeIdentifier(bytes.NewReader(topUpMac.Id()))
+	require.NoError(t, err)
+	paymentHash := lntypes.Preimage{3}.Hash()
+	err = p.topUpStore.AddTopUp(ctx, paymentHash, id.TokenID, 200)
+	require.NoError(t, err)
+	_, ok, err := p.topUpStore.ClaimTopUp(ctx, paymentHash, id.TokenID)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	refund, err = p.ExhaustBalance(ctx, service.Name, topUpMac)
+	require.NoError(t, err)
+	require.Equal(t, uint64(300), refund.Messages)
+	require.Equal(t, int64(500), refund.Amount)
+
+	// The tokens of a batch are only refunded their share of the invoice,
+	// even if their holders claim a smaller batch.
+	batchHash := lntypes.Preimage{4}.Hash()
+	invoices.invoices[batchHash] = &lnrpc.Invoice{
+		State:      lnrpc.Invoice_SETTLED,
+		AmtPaidSat: 5000,
+	}
+	batchMac := newRefundToken(
+		t, service.Name, batchHash, 3, lsat.NewBatchCaveat(10),
+		lsat.NewBatchCaveat(1),
+	)
+	refund, err = p.ExhaustBalance(ctx, service.Name, batchMac)
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), refund.Messages)
+	require.Equal(t, int64(500), refund.Amount)
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// HeaderRenews is the header field of a payment challenge that holds
+	// the ID of the expired token the new token renews.
+	HeaderRenews = "Aperture-Renews"
+)
+
+// RenewalConfig holds the options of the tokens of a service that expire and
+// need to be renewed, like those of a subscription.
+type RenewalConfig struct {
+	// Validity is the time new tokens are valid for. Zero means tokens
+	// never expire.
+	Validity time.Duration `long:"validity" description:"The time new tokens are valid for, 0 for tokens that never expire"`
+
+	// GracePeriod is the time expired tokens are still accepted for, so
+	// clients can renew them without an interruption.
+	GracePeriod time.Duration `long:"graceperiod" description:"The time expired tokens are still accepted for"`
+
+	// Discount is the discount in percent on the price of a token that
+	// renews an expired one.
+	Discount uint32 `long:"discount" description:"The discount in percent on the price of a token that renews an expired one"`
+}
+
+// validate checks the renewal options.
+func (c *RenewalConfig) validate() error {
+	if c.Validity < 0 || c.GracePeriod < 0 {
+		return fmt.Errorf("negative renewal duration")
+	}
+	if c.Discount > 100 {
+		return fmt.Errorf("discount of more than 100 percent")
+	}
+
+	return nil
+}
+
+// caveats returns the caveats that let a new token for the given service name
+// expire once its validity is over.
+func (c *RenewalConfig) caveats(serviceName string) []lsat.Caveat {
+	if c.Validity == 0 {
+		return nil
+	}
+
+	return []lsat.Caveat{lsat.NewValidUntilCaveat(
+		serviceName, time.Now().Add(c.Validity),
+	)}
+}
+
+// withGracePeriod adds the grace period of expired tokens of the service to the
+// context of the request, so they are still accepted during it.
+func withGracePeriod(r *http.Request, target *Service) *http.Request {
+	if target.Renewal.GracePeriod == 0 {
+		return r
+	}
+
+	return r.WithContext(lsat.AddToContext(
+		r.Context(), lsat.KeyGracePeriod, target.Renewal.GracePeriod,
+	))
+}
+
+// renewalPrice returns the price of the token the client is challenged to pay
+// for. If the request was made with a token that expired, the challenge renews
+// it at the discounted price and references it in the response.
+func (p *Proxy) renewalPrice(w http.ResponseWriter, r *http.Request,
+	target *Service, serviceName string, price int64,
+	prefixLog *PrefixLog) int64 {
+
+	renewalAuth, ok := p.authenticator.(auth.RenewalAuthenticator)
+	if !ok || target.Renewal.Validity == 0 || !target.acceptsTokens() {
+		return price
+	}
+
+	tokenID, expiry, ok := renewalAuth.ExpiredToken(
+		r.Context(), &r.Header, serviceName,
+	)
+	if !ok {
+		return price
+	}
+
+	prefixLog.Infof("Renewing token %v that expired at %v.", tokenID,
+		expiry)
+	w.Header().Set(HeaderRenews, tokenID.String())
+
+	return price * int64(100-target.Renewal.Discount) / 100
+}
@@ -1,12 +1,13 @@
 package proxy
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"regexp"
 	"strings"
 
 	"github.com/btcsuite/btcutil"
@@ -40,8 +41,10 @@ type Service struct {
 	// TLSCertPath is the optional path to the service's TLS certificate.
 	TLSCertPath string `long:"tlscertpath" description:"Path to the service's TLS certificate"`
 
-	// Address is the service's IP address and port.
-	Address string `long:"address" description:"service instance rpc address"`
+	// Address is the service's IP address and port. Addresses of the form
+	// srv+name discover the instances of the backend through the SRV
+	// records of the name, like backend.service.consul.
+	Address string `long:"address" description:"service instance rpc address, or srv+name to discover the instances through SRV records"`
 
 	// Protocol is the protocol that should be used to connect to the
 	// service. Currently supported is http and https.
@@ -49,10 +52,49 @@ type Service struct {
 
 	// Auth is the authentication level required for this service to be
 	// accessed. Valid values are "on" for full authentication, "freebie X"
-	// for X free requests per IP address before authentication is required
-	// or "off" for no authentication.
+	// for X free requests per IP address before authentication is required,
+	// "trial" for a free, restricted trial token per IP address before
+	// authentication is required, "nostr" for a NIP-98 signed nostr auth
+	// event or "off" for no authentication.
 	Auth auth.Level `long:"auth" description:"required authentication"`
 
+	// Authenticators are the names of the authenticators the requests of
+	// the service are tried with, in priority order. The first one that
+	// accepts a request wins, challenges are issued by the last one that
+	// can issue them. Only LSATs are accepted if none is set.
+	Authenticators []string `long:"authenticator" description:"An authenticator the requests of the service are tried with, in priority order, can be given multiple times (default: lsat)" choice:"apikey" choice:"mtls" choice:"lsat"`
+
+	// APIKey holds the keys that are accepted by the apikey authenticator.
+	APIKey APIKeyConfig `long:"apikey" description:"The keys accepted by the apikey authenticator"`
+
+	// ClientCert holds the certificate authorities whose client
+	// certificates are accepted by the mtls authenticator.
+	ClientCert ClientCertConfig `long:"clientcert" description:"The client certificates accepted by the mtls authenticator"`
+
+	// TokenHeader is a header field the tokens of the service are read
+	// from instead of the standard ones, for clients that can't be changed
+	// to use those. Tokens found in it are moved to the Authorization
+	// header field before the request is authenticated.
+	TokenHeader string `long:"tokenheader" description:"A header field like X-Api-Token that carries the tokens of the service, in any of the formats of the standard header fields"`
+
+	// MacaroonHeader is a header field the macaroons of the tokens of the
+	// service are read from, base64 or hex encoded, for clients and
+	// gateways that can't send the combined format of the Authorization
+	// header field. It's used together with PreimageHeader.
+	MacaroonHeader string `long:"macaroonheader" description:"A header field like X-Macaroon that carries the base64 or hex encoded macaroon of the tokens of the service, used together with preimageheader"`
+
+	// PreimageHeader is a header field the hex encoded preimages of the
+	// tokens of the service are read from. It's used together with
+	// MacaroonHeader.
+	PreimageHeader string `long:"preimageheader" description:"A header field like X-Preimage that carries the hex encoded preimage of the tokens of the service, used together with macaroonheader"`
+
+	// Trial holds the restrictions of the trial tokens of a service with
+	// the "trial" auth level.
+	Trial TrialConfig `long:"trial" description:"The restrictions of the trial tokens of a service with the trial auth level"`
+
+	// Nostr holds the options of a service with the "nostr" auth level.
+	Nostr NostrConfig `long:"nostr" description:"The identities granted access to a service with the nostr auth level"`
+
 	// HostRegexp is a regular expression that is tested against the 'Host'
 	// HTTP header field to find out if this service should be used.
 	HostRegexp string `long:"hostregexp" description:"Regular expression to match the host against"`
@@ -70,7 +112,7 @@ type Service struct {
 	// of that file is sent to the backend with each call (hex encoded).
 	// If the value starts with the prefix "!file+base64:", the content of
 	// the file is sent encoded as base64.
-	Headers map[string]string `long:"headers" description:"Header fields to always pass to the service"`
+	Headers map[string]string `long:"headers" description:"Header fields to always pass to the service" secret:"true"`
 
 	// Capabilities is the list of capabilities authorized for the service
 	// at the base tier.
@@ -85,10 +127,20 @@ type Service struct {
 	// service's endpoint.
 	Price int64 `long:"price" description:"Static LSAT value in satoshis to be used for this service"`
 
+	// Tiers are the tiers of the service above the base tier, numbered
+	// from 1. Tokens can be upgraded to a higher tier by paying the
+	// difference of the prices.
+	Tiers []*TierConfig `long:"tier" description:"Tiers of the service above the base tier that tokens can be upgraded to"`
+
 	// DynamicPrice holds the config options needed for initialising
 	// the pricer if a gPRC server is to be used for price data.
 	DynamicPrice pricer.Config `long:"dynamicprice" description:"Configuration for connecting to the gRPC server to use for the pricer backend"`
 
+	// PathPrices are the prices of the resources of the service whose
+	// path matches a regular expression. The first match wins, resources
+	// that don't match any of them cost Price.
+	PathPrices []*pricer.PathPrice `long:"pathprice" description:"Prices of the resources whose path matches a regular expression"`
+
 	// AuthWhitelistPaths is an optional list of regular expressions that
 	// are matched against the path of the URL of a request. If the request
 	// URL matches any of those regular expressions, the call is treated as
@@ -97,8 +149,238 @@ type Service struct {
 	// /package_name.ServiceName/MethodName
 	AuthWhitelistPaths []string `long:"authwhitelistpaths" description:"List of regular expressions for paths that don't require authentication'"`
 
-	freebieDb freebie.DB
-	pricer    pricer.Pricer
+	// GRPCWeb can be set to translate requests of gRPC-Web clients (for
+	// example browsers) into native gRPC requests before they are sent to
+	// the backend. The responses are translated back accordingly. This
+	// should only be enabled for native gRPC backends.
+	GRPCWeb bool `long:"grpcweb" description:"Translate gRPC-Web requests to native gRPC for this backend"`
+
+	// ProtoDescriptorFile is the optional path to a file containing the
+	// serialized FileDescriptorSet of the backend's gRPC services, as
+	// created by protoc with the --include_imports and
+	// --descriptor_set_out flags. If set, REST requests that match a
+	// google.api.http annotation of any of the methods are transcoded into
+	// native gRPC calls to the backend.
+	ProtoDescriptorFile string `long:"protodescriptorfile" description:"Path to a protobuf descriptor set file of the backend's gRPC services that is used to transcode REST requests to gRPC"`
+
+	// Reflection can be set to include the gRPC server reflection data of
+	// this backend in the aggregated reflection service of aperture. This
+	// requires the backend to offer the server reflection service itself.
+	Reflection bool `long:"reflection" description:"Include this gRPC backend in the aggregated server reflection service"`
+
+	// HealthCheck can be set to periodically check the health of this
+	// backend through the gRPC health checking protocol. The result is
+	// reported under the name of this service by the health checking
+	// service of aperture.
+	HealthCheck bool `long:"healthcheck" description:"Periodically check the health of this gRPC backend"`
+
+	// PaymentPage can be set to show a payment page to browsers that
+	// request a resource of this service without a valid LSAT. The page
+	// displays the invoice, can pay it through WebLN and stores the LSAT
+	// in a cookie once the payment is received.
+	PaymentPage bool `long:"paymentpage" description:"Show a payment page to browsers that request a resource without a valid LSAT"`
+
+	// AllowCountries is an optional list of ISO 3166-1 alpha-2 country
+	// codes. If set, only clients located in one of these countries may
+	// access the service. This requires a GeoIP database.
+	AllowCountries []string `long:"allowcountries" description:"Only allow clients from these countries (ISO 3166-1 alpha-2 codes) to access the service"`
+
+	// DenyCountries is an optional list of ISO 3166-1 alpha-2 country
+	// codes of clients that may not access the service. This requires a
+	// GeoIP database.
+	DenyCountries []string `long:"denycountries" description:"Deny clients from these countries (ISO 3166-1 alpha-2 codes) access to the service"`
+
+	// Filter holds the rules that reject obviously malicious requests
+	// before they are authenticated and forwarded to the backend.
+	Filter FilterConfig `long:"filter" description:"Rules to reject malicious requests before they reach the backend"`
+
+	// Methods holds the lists of gRPC methods that may or may not be
+	// called through the service.
+	Methods MethodsConfig `long:"methods" description:"The gRPC methods that may or may not be called through the service"`
+
+	// Binding holds the options to bind new tokens of this service to the
+	// client that pays for them.
+	Binding BindingConfig `long:"binding" description:"Options to bind new tokens to the client they are issued to"`
+
+	// RequireNonce can be set to protect the service against replayed
+	// requests. Each authenticated request must then carry a nonce in the
+	// Aperture-Nonce header that is greater than the nonces of all
+	// previous requests made with the same token.
+	RequireNonce bool `long:"requirenonce" description:"Require a strictly increasing nonce with each authenticated request to prevent replays"`
+
+	// LegacyGRPCChallenge can be set to signal payment challenges to gRPC
+	// clients with the INTERNAL status code instead of UNAUTHENTICATED,
+	// like older versions of aperture did. This is only needed for clients
+	// that don't recognize the new status code yet.
+	LegacyGRPCChallenge bool `long:"legacygrpcchallenge" description:"Signal payment challenges to gRPC clients with the INTERNAL status code for clients that predate UNAUTHENTICATED"`
+
+	// SignResponses can be set to sign a proof of each response of the
+	// service, which covers the request, the status, the content type and
+	// a digest of the body. The signature is sent as trailer.
+	SignResponses bool `long:"signresponses" description:"Sign a proof of each response that clients can use to prove what the service returned"`
+
+	// Receipts can be set to let the holders of tokens download a receipt
+	// of their payment that is signed with the key of the response proofs.
+	Receipts bool `long:"receipts" description:"Let token holders download a signed receipt of their payment for expense reporting"`
+
+	// Surge holds the options to raise the price of the service with its
+	// current load, so demand is throttled economically during spikes.
+	Surge pricer.SurgeConfig `long:"surge" description:"Options to raise the price of the service with its load"`
+
+	// HTTP2 holds the HTTP/2 flow control windows used for the streams of
+	// the service, so large streaming calls aren't throttled by the
+	// conservative defaults.
+	HTTP2 HTTP2Config `long:"http2" description:"HTTP/2 flow control options for the streams of the service"`
+
+	// Limits holds the size limits of the gRPC messages and the response
+	// header exchanged with the backend.
+	Limits LimitsConfig `long:"limits" description:"Size limits of the messages exchanged with the backend"`
+
+	// Keepalive holds the options to ping idle connections to the backend
+	// so long-lived streams aren't dropped by intermediaries.
+	Keepalive KeepaliveConfig `long:"keepalive" description:"Options to keep the connections to the backend alive with pings"`
+
+	// Pool holds the options of the pool of connections to the backend,
+	// which high traffic services can tune to reuse more connections.
+	Pool PoolConfig `long:"pool" description:"Options of the pool of connections to the backend"`
+
+	// Buffering holds the options to buffer the request and response
+	// bodies of the service instead of streaming them.
+	Buffering BufferingConfig `long:"buffering" description:"Options to buffer request and response bodies instead of streaming them"`
+
+	// Renewal holds the options of tokens that expire and need to be
+	// renewed, like those of a subscription.
+	Renewal RenewalConfig `long:"renewal" description:"Options of tokens that expire and need to be renewed"`
+
+	// Billing holds the options to charge for the messages of gRPC
+	// streams instead of for the calls to the service.
+	Billing BillingConfig `long:"billing" description:"Options to charge per message delivered on gRPC streams"`
+
+	// Identity holds the options to forward the identity of the token a
+	// request was paid with to the backend.
+	Identity IdentityConfig `long:"identity" description:"Options to forward the identity of the paying token to the backend"`
+
+	// Compression holds the options that control the content encodings
+	// exchanged with the backend.
+	Compression CompressionConfig `long:"compression" description:"Options to control the compression of requests and responses"`
+
+	// Deadlines holds the maximum durations of the gRPC calls to the
+	// service.
+	Deadlines DeadlineConfig `long:"deadlines" description:"The maximum durations of unary and streaming gRPC calls"`
+
+	// SignedURLs holds the options to hand out signed, expiring URLs of
+	// the resources of the service once they are paid for.
+	SignedURLs SignedURLConfig `long:"signedurls" description:"Options to issue signed URLs of paid resources that can be fetched without the token"`
+
+	// Quota holds the number of response bytes each token of the service
+	// pays for, for example the downloads of a static mount.
+	Quota QuotaConfig `long:"quota" description:"The transfer quota of the tokens of the service"`
+
+	// Usage holds the options to let clients query the usage of their own
+	// tokens.
+	Usage UsageConfig `long:"usage" description:"Options to let clients query the usage of their tokens"`
+
+	// Metadata holds the metadata that is attached to the new tokens of
+	// the service and kept next to their secrets.
+	Metadata MetadataConfig `long:"metadata" description:"Metadata attached to new tokens, queryable through the admin API"`
+
+	// Delegation holds the options to let the holders of tokens derive
+	// restricted tokens from them.
+	Delegation DelegationConfig `long:"delegation" description:"Options to let token holders create restricted tokens they can revoke"`
+
+	// Maintenance holds the options to answer the requests of the service
+	// with a 503 response while its backend is unavailable.
+	Maintenance MaintenanceConfig `long:"maintenance" description:"Options to put the service into maintenance mode"`
+
+	// Availability holds the windows of time the service is open in.
+	Availability AvailabilityConfig `long:"availability" description:"The windows of time the service is open in"`
+
+	// Capture holds the options to record the requests of the service and
+	// the responses to them, which can be retrieved through the admin API.
+	Capture CaptureConfig `long:"capture" description:"Options to record requests and responses for debugging"`
+
+	// Authz holds the options to let the application decide whether a
+	// request may pass before it's forwarded.
+	Authz AuthzConfig `long:"authz" description:"Options to call an authorization endpoint of the application before requests are forwarded"`
+
+	// Handler can be set to serve the requests of the service in process
+	// instead of forwarding them to a backend at Address. The requests are
+	// authenticated like those of any other service.
+	Handler http.Handler `json:"-" yaml:"-"`
+
+	// Endpoints can be set to the addresses of the instances of the
+	// backend if they are discovered at run time. Requests are then sent
+	// to them in turn instead of to Address.
+	Endpoints *Endpoints `json:"-" yaml:"-"`
+
+	freebieDb  freebie.DB
+	trialDb    freebie.DB
+	apiKeyAuth *auth.APIKeyAuthenticator
+	pricer     pricer.Pricer
+	transcoder *transcoder
+	filter     *requestFilter
+	methods    *methodFilter
+	load       *loadTracker
+	discovery  *srvDiscovery
+
+	clientCertAuth *auth.ClientCertAuthenticator
+
+	nostrPubKeys map[string]bool
+	availability *availability
+
+	// compiled are the compiled regular expressions of the service, so
+	// they don't need to be compiled for every request.
+	compiled *serviceMatchers
+
+	// config is the encoded configuration of the service before it was
+	// prepared. It tells whether a new instance of the service is only a
+	// copy of the one it replaces.
+	config string
+}
+
+// inheritState takes over the state of the replaced instance of the service
+// with the same configuration, so the freebie counts and the load of the
+// backend aren't lost. The pricer created for this instance isn't used then
+// and is closed.
+func (s *Service) inheritState(old *Service) {
+	if err := s.pricer.Close(); err != nil {
+		log.Errorf("error while closing the pricer of service %s: %v",
+			s.Name, err)
+	}
+
+	s.freebieDb = old.freebieDb
+	s.trialDb = old.trialDb
+	s.pricer = old.pricer
+
+	// The surge pricer of the old instance reports the load it tracks.
+	s.load = old.load
+}
+
+// HasCountryRules returns true if access to the service is restricted by the
+// country of the client.
+func (s *Service) HasCountryRules() bool {
+	return len(s.AllowCountries) > 0 || len(s.DenyCountries) > 0
+}
+
+// CountryAllowed returns true if a client from the given country may access
+// the service. If the country is unknown, it's only allowed if there is no
+// allow list.
+func (s *Service) CountryAllowed(country string) bool {
+	for _, denied := range s.DenyCountries {
+		if denied == country {
+			return false
+		}
+	}
+
+	if len(s.AllowCountries) == 0 {
+		return true
+	}
+	for _, allowed := range s.AllowCountries {
+		if allowed == country {
+			return true
+		}
+	}
+	return false
 }
 
 // ResourceName returns the string to be used to identify which resource a
@@ -114,11 +396,16 @@ func (s *Service) ResourceName(resourcePath string) string {
 	return s.Name
 }
 
+// GetPrice returns the price of the resource at the given path from the pricer
+// of the service, which also prices the challenges of its requests.
+func (s *Service) GetPrice(ctx context.Context, path string) (int64, error) {
+	return s.pricer.GetPrice(ctx, path)
+}
+
 // AuthRequired determines the auth level required for a given request.
 func (s *Service) AuthRequired(r *http.Request) auth.Level {
 	// Does the request match any whitelist entry?
-	for _, pathRegexp := range s.AuthWhitelistPaths {
-		pathRegexp := regexp.MustCompile(pathRegexp)
+	for _, pathRegexp := range s.matchers().whitelist {
 		if pathRegexp.MatchString(r.URL.Path) {
 			log.Tracef("Req path [%s] matches whitelist entry "+
 				"[%s].", r.URL.Path, pathRegexp)
@@ -132,12 +419,22 @@ func (s *Service) AuthRequired(r *http.Request) auth.Level {
 
 // prepareServices prepares the backend service configurations to be used by the
 // proxy.
-func prepareServices(services []*Service) error {
+func prepareServices(services []*Service,
+	newFreebieDB freebie.DBCreator) error {
+
 	for _, service := range services {
+		// The configuration is recorded before the defaults are filled
+		// in. A configuration that can't be encoded is never equal to
+		// another one.
+		config, err := json.Marshal(service)
+		if err == nil {
+			service.config = string(config)
+		}
+
 		// Each freebie enabled service gets its own store.
 		if service.Auth.IsFreebie() {
-			service.freebieDb = freebie.NewMemIPMaskStore(
-				service.Auth.FreebieCount(),
+			service.freebieDb = newFreebieDB(
+				service.Name, service.Auth.FreebieCount(),
 			)
 		}
 
@@ -178,15 +475,176 @@ func prepareServices(services []*Service) error {
 			}
 		}
 
-		// Make sure all whitelist regular expression entries actually
-		// compile so we run into an eventual panic during startup and
-		// not only when the request happens.
-		for _, entry := range service.AuthWhitelistPaths {
-			_, err := regexp.Compile(entry)
+		// Country codes are compared in upper case.
+		for i, country := range service.AllowCountries {
+			service.AllowCountries[i] = strings.ToUpper(country)
+		}
+		for i, country := range service.DenyCountries {
+			service.DenyCountries[i] = strings.ToUpper(country)
+		}
+
+		// The regular expressions are compiled once, so we run into
+		// invalid ones during startup and not only when the request
+		// happens.
+		compiled, err := compileMatchers(service)
+		if err != nil {
+			return fmt.Errorf("error validating service %s: %v",
+				service.Name, err)
+		}
+		service.compiled = compiled
+
+		if err := validateTokenHeader(service); err != nil {
+			return fmt.Errorf("error validating token header of "+
+				"service %s: %v", service.Name, err)
+		}
+
+		if err := prepareAuthenticators(service); err != nil {
+			return fmt.Errorf("error validating authenticators of "+
+				"service %s: %v", service.Name, err)
+		}
+
+		if err := prepareTrial(service, newFreebieDB); err != nil {
+			return fmt.Errorf("error validating trial of service "+
+				"%s: %v", service.Name, err)
+		}
+
+		if err := prepareNostr(service); err != nil {
+			return fmt.Errorf("error validating nostr of service "+
+				"%s: %v", service.Name, err)
+		}
+
+		filter, err := newRequestFilter(&service.Filter)
+		if err != nil {
+			return fmt.Errorf("error validating filter of service "+
+				"%s: %v", service.Name, err)
+		}
+		service.filter = filter
+
+		methods, err := newMethodFilter(&service.Methods)
+		if err != nil {
+			return fmt.Errorf("error validating methods of "+
+				"service %s: %v", service.Name, err)
+		}
+		service.methods = methods
+
+		// The load of the backend is only tracked for surge pricing.
+		service.load = nil
+		if service.Surge.Enabled {
+			if err := service.Surge.Validate(); err != nil {
+				return fmt.Errorf("error validating surge "+
+					"pricing of service %s: %v",
+					service.Name, err)
+			}
+			service.load = &loadTracker{}
+		}
+
+		if err := service.Binding.validate(); err != nil {
+			return fmt.Errorf("error validating binding of service "+
+				"%s: %v", service.Name, err)
+		}
+
+		if err := service.HTTP2.validate(); err != nil {
+			return fmt.Errorf("error validating HTTP/2 options of "+
+				"service %s: %v", service.Name, err)
+		}
+
+		if err := service.Limits.validate(); err != nil {
+			return fmt.Errorf("error validating limits of service "+
+				"%s: %v", service.Name, err)
+		}
+
+		if err := service.Keepalive.validate(); err != nil {
+			return fmt.Errorf("error validating keepalive of "+
+				"service %s: %v", service.Name, err)
+		}
+
+		if err := service.Renewal.validate(); err != nil {
+			return fmt.Errorf("error validating renewal of "+
+				"service %s: %v", service.Name, err)
+		}
+
+		err = validateTiers(service.Price, service.Tiers)
+		if err != nil {
+			return fmt.Errorf("error validating tiers of service "+
+				"%s: %v", service.Name, err)
+		}
+
+		if err := service.Metadata.validate(); err != nil {
+			return fmt.Errorf("error validating metadata of "+
+				"service %s: %v", service.Name, err)
+		}
+
+		if err := service.Buffering.validate(); err != nil {
+			return fmt.Errorf("error validating buffering of "+
+				"service %s: %v", service.Name, err)
+		}
+
+		if err := service.Pool.validate(); err != nil {
+			return fmt.Errorf("error validating connection "+
+				"pool of service %s: %v", service.Name, err)
+		}
+
+		if err := service.Billing.validate(); err != nil {
+			return fmt.Errorf("error validating billing of "+
+				"service %s: %v", service.Name, err)
+		}
+
+		if err := service.Compression.validate(); err != nil {
+			return fmt.Errorf("error validating compression of "+
+				"service %s: %v", service.Name, err)
+		}
+
+		if err := service.Deadlines.validate(); err != nil {
+			return fmt.Errorf("error validating deadlines of "+
+				"service %s: %v", service.Name, err)
+		}
+
+		if err := service.SignedURLs.validate(); err != nil {
+			return fmt.Errorf("error validating signed URLs of "+
+				"service %s: %v", service.Name, err)
+		}
+
+		if err := service.Maintenance.validate(); err != nil {
+			return fmt.Errorf("error validating maintenance of "+
+				"service %s: %v", service.Name, err)
+		}
+
+		windows, err := newAvailability(&service.Availability)
+		if err != nil {
+			return fmt.Errorf("error validating availability of "+
+				"service %s: %v", service.Name, err)
+		}
+		service.availability = windows
+
+		if err := service.Capture.validate(); err != nil {
+			return fmt.Errorf("error validating capture of "+
+				"service %s: %v", service.Name, err)
+		}
+
+		if err := service.Authz.validate(); err != nil {
+			return fmt.Errorf("error validating authz of "+
+				"service %s: %v", service.Name, err)
+		}
+
+		discovery, err := newSRVDiscovery(service.Address)
+		if err != nil {
+			return fmt.Errorf("error validating address of "+
+				"service %s: %v", service.Name, err)
+		}
+		service.discovery = discovery
+
+		// Load the REST bindings of the backend's gRPC methods if
+		// transcoding is enabled.
+		if service.ProtoDescriptorFile != "" {
+			transcoder, err := newTranscoder(
+				service.ProtoDescriptorFile,
+			)
 			if err != nil {
-				return fmt.Errorf("error validating auth "+
-					"whitelist: %v", err)
+				return fmt.Errorf("error loading proto "+
+					"descriptors for service %s: %v",
+					service.Name, err)
 			}
+			service.transcoder = transcoder
 		}
 
 		// If dynamic prices are enabled then use the provided
@@ -222,6 +680,30 @@ func prepareServices(services []*Service) error {
 				"service %s", service.Name)
 		}
 
+		// Resources are priced by their path if there are path
+		// prices, otherwise all resources in a server are given the
+		// same price.
+		if len(service.PathPrices) > 0 {
+			pathPricer, err := pricer.NewPathPricer(
+				service.Price, service.PathPrices,
+			)
+			if err != nil {
+				return fmt.Errorf("error validating path "+
+					"prices of service %s: %v",
+					service.Name, err)
+			}
+			for _, pathPrice := range service.PathPrices {
+				if pathPrice.Price > maxServicePrice {
+					return fmt.Errorf("maximum price "+
+						"exceeded for path %s of "+
+						"service %s", pathPrice.Path,
+						service.Name)
+				}
+			}
+			service.pricer = pathPricer
+			continue
+		}
+
 		// Initialise a default pricer where all resources in a server
 		// are given the same price.
 		service.pricer = pricer.NewDefaultPricer(service.Price)
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/pricer"
+	"github.com/stretchr/testify/require"
+)
+
+// TestUpdateServicesKeepsInstances tests that services that are served again
+// aren't prepared again, so their pricers and freebie stores are kept.
+func TestUpdateServicesKeepsInstances(t *testing.T) {
+	service := &Service{
+		Name:       "svc1",
+		HostRegexp: "^svc1$",
+		Auth:       "freebie 1",
+		Surge: pricer.SurgeConfig{
+			Enabled: true,
+		},
+	}
+	p, err := New(auth.NewMockAuthenticator(), []*Service{service})
+	require.NoError(t, err)
+
+	servicePricer := service.pricer
+	freebieDb := service.freebieDb
+
+	err = p.UpdateServices([]*Service{service, {
+		Name:       "svc2",
+		HostRegexp: "^svc2$",
+	}})
+	require.NoError(t, err)
+	require.Equal(t, servicePricer, service.pricer)
+	require.Equal(t, freebieDb, service.freebieDb)
+}
+
+// TestUpdateServicesKeepsState tests that the freebie counts of a service
+// survive an update that only changes its endpoints, whether the instance is
+// kept or replaced by a copy with the same configuration.
+func TestUpdateServicesKeepsState(t *testing.T) {
+	newService := func(price int64, addrs ...string) *Service {
+		return &Service{
+			Name:       "svc1",
+			HostRegexp: "^svc1$",
+			Auth:       "freebie 1",
+			Price:      price,
+			Endpoints:  NewEndpoints(addrs),
+		}
+	}
+	service := newService(0, "10.0.0.1:8080")
+	p, err := New(auth.NewMockAuthenticator(), []*Service{service})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "http://svc1/", nil)
+	ip := net.ParseIP("192.168.1.1")
+	canPass := func(service *Service) bool {
+		t.Helper()
+
+		ok, err := service.freebieDb.CanPass(req, ip)
+		require.NoError(t, err)
+		return ok
+	}
+	ok, err := service.freebieDb.TallyFreebie(req, ip)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.False(t, canPass(service))
+
+	// The endpoints of the instance are updated together with another
+	// service, like the ones discovered in Kubernetes.
+	service.Endpoints.Set([]string{"10.0.0.2:8080"})
+	err = p.UpdateServices([]*Service{service, {
+		Name:       "svc2",
+		HostRegexp: "^svc2$",
+	}})
+	require.NoError(t, err)
+	require.False(t, canPass(service))
+
+	// A copy with other endpoints takes over the counter and the pricer.
+	servicePricer := service.pricer
+	copied := newService(0, "10.0.0.3:8080")
+	require.NoError(t, p.UpdateServices([]*Service{copied}))
+	require.False(t, canPass(copied))
+	require.Equal(t, servicePricer, copied.pricer)
+
+	// A service with another configuration starts over.
+	changed := newService(2, "10.0.0.3:8080")
+	require.NoError(t, p.UpdateServices([]*Service{changed}))
+	require.True(t, canPass(changed))
+}
@@ -0,0 +1,353 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
+)
+
+const (
+	// defaultSignedURLExpiry is the default time a signed URL can be used
+	// for after it was issued.
+	defaultSignedURLExpiry = time.Hour
+
+	// hdrSignedURL is the header field of a response to a paid request
+	// that contains a signed URL of the same resource.
+	hdrSignedURL = "Aperture-Signed-Url"
+
+	// paramSignedURLExpiry is the query parameter of a signed URL that
+	// contains the unix timestamp it expires at.
+	paramSignedURLExpiry = "aperture_expires"
+
+	// paramSignedURLSignature is the query parameter of a signed URL that
+	// contains the base64 encoded signature of the URL.
+	paramSignedURLSignature = "aperture_signature"
+
+	// paramSignedURLToken is the query parameter of a signed URL that
+	// contains the ID of the token the resource was paid with, so the
+	// transfer quota of the token also covers the URL.
+	paramSignedURLToken = "aperture_token"
+
+	// paramSignedURLPaymentHash is the query parameter of a signed URL
+	// that contains the payment hash of the token the resource was paid
+	// with, so the token can be looked up to make sure it wasn't revoked.
+	paramSignedURLPaymentHash = "aperture_payment_hash"
+)
+
+// TokenChecker checks that the tokens signed URLs were issued for weren't
+// revoked since.
+type TokenChecker interface {
+	// HasLSAT returns true if the LSAT with the given identifier was
+	// minted by us and wasn't revoked since.
+	HasLSAT(context.Context, *lsat.Identifier) (bool, error)
+}
+
+// SignedURLConfig holds the options to hand out signed URLs of the resources
+// of a service after they were paid for.
+type SignedURLConfig struct {
+	// Enabled can be set to send a signed URL of the requested resource
+	// with each response to a request that was paid with a token. The
+	// URL can be fetched without the token until it expires, for example
+	// by a download manager or another device.
+	Enabled bool `long:"enabled" description:"Send a signed URL of the resource that can be fetched without the token with each paid response"`
+
+	// Expiry is the time a signed URL can be used for after it was
+	// issued.
+	Expiry time.Duration `long:"expiry" description:"The time a signed URL can be used for after it was issued (default 1h)"`
+}
+
+// validate checks the signed URL options and sets the default expiry.
+func (c *SignedURLConfig) validate() error {
+	if c.Expiry == 0 {
+		c.Expiry = defaultSignedURLExpiry
+	}
+	if c.Expiry < 0 {
+		return fmt.Errorf("negative signed URL expiry %v", c.Expiry)
+	}
+
+	return nil
+}
+
+// SetURLSigningKey sets the key the signed URLs of the resources of services
+// are signed with. Instances that share the key accept the URLs signed by
+// each other. Signed URLs are only issued once a key is set.
+func (p *Proxy) SetURLSigningKey(key []byte) {
+	p.urlSigningKey = key
+}
+
+// SetTokenChecker sets the entity the tokens of signed URLs are looked up with
+// to make sure they weren't revoked since the URLs were issued. Signed URLs are
+// only issued and accepted once it is set.
+func (p *Proxy) SetTokenChecker(checker TokenChecker) {
+	p.tokenChecker = checker
+}
+
+// urlSignature returns the signature of the URL of the given resource of a
+// service that was paid with the given token and expires at the given time.
+// The URL is only valid for the method and the canonical query it was issued
+// for.
+func (p *Proxy) urlSignature(service, method, path, query, tokenID,
+	paymentHash string, expiry int64) []byte {
+
+	mac := hmac.New(sha256.New, p.urlSigningKey)
+	_, _ = fmt.Fprintf(
+		mac, "%s\n%s\n%s\n%s\n%s\n%s\n%d", service, method, path,
+		query, tokenID, paymentHash, expiry,
+	)
+	return mac.Sum(nil)
+}
+
+// signedURLSupported returns false if the requests of the service need checks
+// that can only be made with the token itself, like nonces or per message
+// billing, so they can't be made through a signed URL.
+func signedURLSupported(target *Service) bool {
+	return !target.RequireNonce && !target.Billing.PerMessage
+}
+
+// signableToken returns the macaroon and the identifier of the token a request
+// was made with, if a signed URL may be issued for it. Trial tokens and tokens
+// with caveats that restrict their use in ways a signed URL can't enforce,
+// like delegations, message balances, nonces or client bindings, don't get
+// one.
+func signableToken(r *http.Request, target *Service) (*macaroon.Macaroon,
+	*lsat.Identifier, bool) {
+
+	mac, _, err := lsat.FromHeader(&r.Header)
+	if err != nil {
+		return nil, nil, false
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil || lsat.IsTrialIdentifier(id) {
+		return nil, nil, false
+	}
+
+	for _, cond := range []string{
+		lsat.CondNonce, lsat.CondClientIP, lsat.CondTLSBinding,
+		target.Name + lsat.CondMessagesSuffix,
+		target.Name + lsat.CondDelegationSuffix,
+	} {
+		if _, ok := lsat.HasCaveat(mac, cond); ok {
+			return nil, nil, false
+		}
+	}
+
+	return mac, id, true
+}
+
+// signedURLQuery returns the query of the URL of a request without the
+// parameters of a signed URL, in the canonical form that is signed.
+func signedURLQuery(u *url.URL) url.Values {
+	query := u.Query()
+	query.Del(paramSignedURLExpiry)
+	query.Del(paramSignedURLSignature)
+	query.Del(paramSignedURLToken)
+	query.Del(paramSignedURLPaymentHash)
+	return query
+}
+
+// issueSignedURL adds a signed URL of the requested resource to the header of
+// the response, if the token of the request may get one. The URL expires with
+// the token at the latest.
+func (p *Proxy) issueSignedURL(w http.ResponseWriter, r *http.Request,
+	target *Service) {
+
+	if p.urlSigningKey == nil || p.tokenChecker == nil ||
+		!signedURLSupported(target) {
+
+		return
+	}
+	mac, id, ok := signableToken(r, target)
+	if !ok {
+		return
+	}
+
+	expiry := time.Now().Add(target.SignedURLs.Expiry)
+	validUntil, ok := lsat.ValidUntil(mac, target.Name)
+	if ok && validUntil.Before(expiry) {
+		expiry = validUntil
+	}
+
+	query := signedURLQuery(r.URL)
+	signature := p.urlSignature(
+		target.Name, r.Method, r.URL.Path, query.Encode(),
+		id.TokenID.String(), id.PaymentHash.String(), expiry.Unix(),
+	)
+
+	query.Set(paramSignedURLToken, id.TokenID.String())
+	query.Set(paramSignedURLPaymentHash, id.PaymentHash.String())
+	query.Set(paramSignedURLExpiry, strconv.FormatInt(expiry.Unix(), 10))
+	query.Set(
+		paramSignedURLSignature,
+		base64.RawURLEncoding.EncodeToString(signature),
+	)
+	signedURL := url.URL{
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		RawQuery: query.Encode(),
+	}
+	w.Header().Set(hdrSignedURL, signedURL.String())
+}
+
+// hasSignedURL returns true if the request was made with a signed URL.
+func hasSignedURL(r *http.Request) bool {
+	return r.URL.Query().Get(paramSignedURLSignature) != ""
+}
+
+// verifySignedURL checks that the request was made with a signed URL of the
+// requested resource of the target service that didn't expire yet. If it was,
+// the request is returned without the signature in its query, so it isn't
+// passed to the backend, along with the identifier of the token the resource
+// was paid with.
+func (p *Proxy) verifySignedURL(r *http.Request,
+	target *Service) (*http.Request, lsat.Identifier, error) {
+
+	if p.urlSigningKey == nil {
+		return nil, lsat.Identifier{}, fmt.Errorf("no URL signing key")
+	}
+
+	params := r.URL.Query()
+	expiry, err := strconv.ParseInt(
+		params.Get(paramSignedURLExpiry), 10, 64,
+	)
+	if err != nil {
+		return nil, lsat.Identifier{}, fmt.Errorf("invalid expiry: %v",
+			err)
+	}
+	if time.Now().Unix() > expiry {
+		return nil, lsat.Identifier{}, fmt.Errorf("signed URL expired")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(
+		params.Get(paramSignedURLSignature),
+	)
+	if err != nil {
+		return nil, lsat.Identifier{}, fmt.Errorf("invalid "+
+			"signature: %v", err)
+	}
+	token := params.Get(paramSignedURLToken)
+	paymentHash := params.Get(paramSignedURLPaymentHash)
+	query := signedURLQuery(r.URL).Encode()
+	expected := p.urlSignature(
+		target.Name, r.Method, r.URL.Path, query, token, paymentHash,
+		expiry,
+	)
+	if !hmac.Equal(signature, expected) {
+		return nil, lsat.Identifier{}, fmt.Errorf("signature mismatch")
+	}
+
+	id := lsat.Identifier{Version: lsat.LatestVersion}
+	id.TokenID, err = lsat.MakeIDFromString(token)
+	if err != nil {
+		return nil, lsat.Identifier{}, fmt.Errorf("invalid token ID: "+
+			"%v", err)
+	}
+	id.PaymentHash, err = lntypes.MakeHashFromStr(paymentHash)
+	if err != nil {
+		return nil, lsat.Identifier{}, fmt.Errorf("invalid payment "+
+			"hash: %v", err)
+	}
+
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = query
+	r.RequestURI = r.URL.RequestURI()
+
+	return r, id, nil
+}
+
+// authorizeSignedURL checks a request made with a signed URL of a resource
+// that was paid for with a token. The request gets the checks of the service
+// that a request made with the token itself gets, as far as they don't need
+// the token. Signed URLs aren't issued for tokens that need the others.
+func (p *Proxy) authorizeSignedURL(w http.ResponseWriter, r *http.Request,
+	target *Service, remoteIP net.IP,
+	prefixLog *PrefixLog) (*http.Request, bool) {
+
+	if p.tokenChecker == nil || !signedURLSupported(target) {
+		prefixLog.Infof("Signed URL of service without support for " +
+			"them rejected.")
+		sendDirectResponse(
+			w, r, http.StatusForbidden, "invalid signed URL",
+		)
+		return nil, false
+	}
+
+	signedReq, id, err := p.verifySignedURL(r, target)
+	if err != nil {
+		prefixLog.Infof("Invalid signed URL: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusForbidden, "invalid signed URL",
+		)
+		return nil, false
+	}
+
+	// The URL is only valid as long as its token is, so revoking the token
+	// also revokes the URLs issued for it.
+	ok, err := p.tokenChecker.HasLSAT(signedReq.Context(), &id)
+	if err != nil {
+		prefixLog.Errorf("Error looking up token of signed URL: %v",
+			err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"failure looking up token",
+		)
+		return nil, false
+	}
+	if !ok {
+		prefixLog.Infof("Signed URL of revoked token %v rejected.",
+			id.TokenID)
+		sendDirectResponse(
+			w, r, http.StatusForbidden, "invalid signed URL",
+		)
+		return nil, false
+	}
+	recordCaptureAuth(signedReq, CaptureAuthSignedURL)
+
+	// The request carries no token itself, so the ID of the token the URL
+	// was issued for is kept with it, for example for the validator.
+	tokenID := id.TokenID
+	signedReq = signedReq.WithContext(lsat.AddToContext(
+		signedReq.Context(), lsat.KeyTokenID, tokenID,
+	))
+
+	// The application may apply its own rules to the token the URL was
+	// issued for, like to a request made with the token itself.
+	if target.Authz.URL != "" && !checkAuthzToken(
+		w, signedReq, target, tokenID.String(), remoteIP, prefixLog,
+	) {
+
+		return nil, false
+	}
+
+	// The requests made through a signed URL are reported as requests
+	// of its token.
+	if target.Usage.Enabled {
+		p.countTokenRequest(signedReq.Context(), tokenID, prefixLog)
+	}
+
+	// The backend is told which token the URL was issued for instead of
+	// what the client claims.
+	if target.Identity.Forward {
+		stripIdentity(signedReq)
+		p.forwardTokenIdentity(signedReq, target, &id, prefixLog)
+	}
+
+	// The downloads of a signed URL count against the transfer quota of
+	// the token it was issued for.
+	if target.Quota.Bytes > 0 {
+		return p.meterTransfer(w, signedReq, target, tokenID, prefixLog)
+	}
+
+	return signedReq, true
+}
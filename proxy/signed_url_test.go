@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+// mockTokenChecker is a token checker that knows all tokens that weren't
+// revoked.
+type mockTokenChecker struct {
+	revoked map[lsat.TokenID]bool
+}
+
+// HasLSAT returns true if the LSAT with the given identifier wasn't revoked.
+func (c *mockTokenChecker) HasLSAT(_ context.Context,
+	id *lsat.Identifier) (bool, error) {
+
+	return !c.revoked[id.TokenID], nil
+}
+
+// TestSignedURL tests that signed URLs are only accepted for the resource,
+// method, query and service they were issued for and only until they expire.
+func TestSignedURL(t *testing.T) {
+	p := &Proxy{
+		urlSigningKey: []byte("key"),
+		tokenChecker:  &mockTokenChecker{},
+	}
+	service := &Service{
+		Name:       "downloads",
+		SignedURLs: SignedURLConfig{Enabled: true},
+	}
+	require.NoError(t, service.SignedURLs.validate())
+	require.Equal(t, defaultSignedURLExpiry, service.SignedURLs.Expiry)
+
+	mac, _ := newPaywallMacaroon(t, lntypes.Preimage{1}.Hash())
+	issue := func(mac *macaroon.Macaroon, target string) string {
+		t.Helper()
+
+		req := httptest.NewRequest("GET", target, nil)
+		err := lsat.SetHeader(&req.Header, mac, lntypes.Preimage{1})
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		p.issueSignedURL(rec, req, service)
+		return rec.Header().Get(hdrSignedURL)
+	}
+	signedURL := issue(mac, "/files/a.zip?version=2")
+	require.NotEmpty(t, signedURL)
+
+	// The signed URL is accepted and its signature removed before the
+	// request is forwarded.
+	req := httptest.NewRequest("GET", signedURL, nil)
+	require.True(t, hasSignedURL(req))
+	signedReq, _, err := p.verifySignedURL(req, service)
+	require.NoError(t, err)
+	require.Equal(t, "version=2", signedReq.URL.RawQuery)
+	require.Equal(t, "/files/a.zip?version=2", signedReq.RequestURI)
+
+	// It's not valid for other files, queries, methods, services or expiry
+	// times.
+	parsed, err := url.Parse(signedURL)
+	require.NoError(t, err)
+	query := parsed.Query()
+
+	otherFile := "/files/b.zip?" + query.Encode()
+	_, _, err = p.verifySignedURL(
+		httptest.NewRequest("GET", otherFile, nil), service,
+	)
+	require.Error(t, err)
+
+	_, _, err = p.verifySignedURL(
+		httptest.NewRequest("GET", signedURL+"&admin=1", nil), service,
+	)
+	require.Error(t, err)
+
+	_, _, err = p.verifySignedURL(
+		httptest.NewRequest("DELETE", signedURL, nil), service,
+	)
+	require.Error(t, err)
+
+	otherService := &Service{Name: "other"}
+	_, _, err = p.verifySignedURL(
+		httptest.NewRequest("GET", signedURL, nil), otherService,
+	)
+	require.Error(t, err)
+
+	expiry, err := strconv.ParseInt(query.Get(paramSignedURLExpiry), 10, 64)
+	require.NoError(t, err)
+	query.Set(paramSignedURLExpiry, strconv.FormatInt(expiry+3600, 10))
+	_, _, err = p.verifySignedURL(httptest.NewRequest(
+		"GET", "/files/a.zip?"+query.Encode(), nil,
+	), service)
+	require.Error(t, err)
+
+	// The URL expires with its token.
+	expiring := mac.Clone()
+	validUntil := time.Now().Add(time.Minute).Truncate(time.Second)
+	err = lsat.AddFirstPartyCaveats(
+		expiring, lsat.NewValidUntilCaveat(service.Name, validUntil),
+	)
+	require.NoError(t, err)
+	parsed, err = url.Parse(issue(expiring, "/files/a.zip"))
+	require.NoError(t, err)
+	require.Equal(
+		t, strconv.FormatInt(validUntil.Unix(), 10),
+		parsed.Query().Get(paramSignedURLExpiry),
+	)
+
+	// Tokens with caveats a signed URL can't enforce don't get one, and
+	// neither do the tokens of services that need checks signed URLs
+	// can't be given.
+	delegated := mac.Clone()
+	err = lsat.AddFirstPartyCaveats(
+		delegated, lsat.NewDelegationCaveat(service.Name, "abcd"),
+	)
+	require.NoError(t, err)
+	require.Empty(t, issue(delegated, "/files/a.zip"))
+
+	service.Billing.PerMessage = true
+	require.Empty(t, issue(mac, "/files/a.zip"))
+	service.Billing.PerMessage = false
+
+	// Requests without a token don't get a signed URL.
+	rec := httptest.NewRecorder()
+	p.issueSignedURL(
+		rec, httptest.NewRequest("GET", "/files/a.zip", nil), service,
+	)
+	require.Empty(t, rec.Header().Get(hdrSignedURL))
+
+	// Once it expired, it's rejected.
+	service.SignedURLs.Expiry = -time.Minute
+	_, _, err = p.verifySignedURL(httptest.NewRequest(
+		"GET", issue(mac, "/files/a.zip"), nil,
+	), service)
+	require.EqualError(t, err, "signed URL expired")
+}
+
+// TestAuthorizeSignedURL tests that the requests made with a signed URL are
+// only let through while its token isn't revoked and that the backend is told
+// the token of the URL instead of what the client claims.
+func TestAuthorizeSignedURL(t *testing.T) {
+	checker := &mockTokenChecker{revoked: make(map[lsat.TokenID]bool)}
+	p := &Proxy{urlSigningKey: []byte("key"), tokenChecker: checker}
+	service := &Service{
+		Name:       "downloads",
+		SignedURLs: SignedURLConfig{Enabled: true},
+		Identity:   IdentityConfig{Forward: true},
+	}
+	require.NoError(t, service.SignedURLs.validate())
+
+	mac, _ := newPaywallMacaroon(t, lntypes.Preimage{1}.Hash())
+	req := httptest.NewRequest("GET", "/files/a.zip", nil)
+	err := lsat.SetHeader(&req.Header, mac, lntypes.Preimage{1})
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	p.issueSignedURL(rec, req, service)
+	signedURL := rec.Header().Get(hdrSignedURL)
+	require.NotEmpty(t, signedURL)
+
+	_, prefixLog := NewRemoteIPPrefixLog(log, "192.0.2.1:1234")
+	authorize := func() (*httptest.ResponseRecorder, *http.Request) {
+		req := httptest.NewRequest("GET", signedURL, nil)
+		req.Header.Set(HeaderTokenID, "forged")
+		req.Header.Set(grpcMetadataHeaderPrefix+HeaderTokenTier, "9")
+
+		rec := httptest.NewRecorder()
+		signedReq, _ := p.authorizeSignedURL(
+			rec, req, service, nil, prefixLog,
+		)
+		return rec, signedReq
+	}
+
+	parsed, err := url.Parse(signedURL)
+	require.NoError(t, err)
+	_, signedReq := authorize()
+	require.NotNil(t, signedReq)
+	require.Equal(
+		t, parsed.Query().Get(paramSignedURLToken),
+		signedReq.Header.Get(HeaderTokenID),
+	)
+	require.Equal(
+		t, lntypes.Preimage{1}.Hash().String(),
+		signedReq.Header.Get(HeaderPaymentHash),
+	)
+	require.Empty(
+		t, signedReq.Header.Get(grpcMetadataHeaderPrefix+
+			HeaderTokenTier),
+	)
+
+	// Once the token is revoked, its URLs are rejected too.
+	tokenID, err := lsat.MakeIDFromString(
+		parsed.Query().Get(paramSignedURLToken),
+	)
+	require.NoError(t, err)
+	checker.revoked[tokenID] = true
+	rec, signedReq = authorize()
+	require.Nil(t, signedReq)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+// TestValidateSignedURL tests that the validator tells the application server
+// the ID of the token a signed URL was issued for.
+func TestValidateSignedURL(t *testing.T) {
+	services := []*Service{{
+		Name:       "downloads",
+		HostRegexp: "^app.example.com$",
+		Auth:       "on",
+		Price:      10,
+		SignedURLs: SignedURLConfig{Enabled: true},
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+	p.SetURLSigningKey([]byte("key"))
+	p.SetTokenChecker(&mockTokenChecker{})
+
+	mac, _ := newPaywallMacaroon(t, lntypes.Preimage{1}.Hash())
+	req := httptest.NewRequest("GET", "/files/a.zip", nil)
+	err = lsat.SetHeader(&req.Header, mac, lntypes.Preimage{1})
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	p.issueSignedURL(rec, req, services[0])
+	signedURL, err := url.Parse(rec.Header().Get(hdrSignedURL))
+	require.NoError(t, err)
+
+	req = httptest.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set(HeaderOriginalURI, signedURL.RequestURI())
+	req.Header.Set(HeaderOriginalHost, "app.example.com")
+	rec = httptest.NewRecorder()
+	p.ServeValidation(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(
+		t, signedURL.Query().Get(paramSignedURLToken),
+		rec.Header().Get(HeaderTokenID),
+	)
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	// DefaultCopyBufferSize is the default size of the buffers response
+	// bodies are copied to the client with.
+	DefaultCopyBufferSize = 32 * 1024
+
+	// minCopyBufferSize is the smallest copy buffer size that can be
+	// configured.
+	minCopyBufferSize = 1024
+)
+
+// copyBufferPool is a pool of the buffers the reverse proxy copies response
+// bodies with. Without it, a new buffer is allocated for every response, which
+// adds up for services with many concurrent downloads.
+type copyBufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// newCopyBufferPool creates a pool of buffers of the given size.
+func newCopyBufferPool(size int) *copyBufferPool {
+	p := &copyBufferPool{size: size}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, p.size)
+		return &buf
+	}
+	return p
+}
+
+// Get returns a buffer from the pool.
+//
+// NOTE: This is part of the httputil.BufferPool interface.
+func (p *copyBufferPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+// Put returns a buffer to the pool. Buffers of another size, which were taken
+// before the size was changed, are dropped.
+//
+// NOTE: This is part of the httputil.BufferPool interface.
+func (p *copyBufferPool) Put(buf []byte) {
+	if len(buf) != p.size {
+		return
+	}
+	p.pool.Put(&buf)
+}
+
+// SetCopyBufferSize sets the size of the buffers response bodies are copied to
+// the client with. Larger buffers need fewer system calls for large downloads,
+// at the cost of more memory per concurrent response.
+func (p *Proxy) SetCopyBufferSize(size int) {
+	if size < minCopyBufferSize {
+		size = minCopyBufferSize
+	}
+	pool := newCopyBufferPool(size)
+
+	// The reverse proxy might already be in use, so it's replaced by a
+	// copy with the new pool instead of being changed in place.
+	p.servicesMtx.Lock()
+	defer p.servicesMtx.Unlock()
+
+	p.copyBuffers = pool
+	if p.proxyBackend != nil {
+		backend := *p.proxyBackend
+		backend.BufferPool = pool
+		p.proxyBackend = &backend
+	}
+}
+
+// readFrom copies src to the given writer with its ReadFrom method if it has
+// one. The response writer of the HTTP server implements it, which lets it
+// send files without copying them through user space.
+func readFrom(w io.Writer, src io.Reader) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(w, src)
+}
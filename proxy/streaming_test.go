@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// readerFromRecorder is a response recorder that records whether the body was
+// sent with ReadFrom.
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+
+	readFrom bool
+}
+
+// ReadFrom sends the body read from src.
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+// TestStreaming tests that the pass-through response writers hand bodies to
+// the ReadFrom method of the underlying writer and that copy buffers are
+// reused.
+func TestStreaming(t *testing.T) {
+	rec := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	tracker := &loadTracker{}
+	w, done := tracker.start(rec)
+	counter := &countingResponseWriter{ResponseWriter: w}
+
+	// The files of in-process handlers are sent like this by
+	// http.ServeContent.
+	n, err := io.CopyN(counter, strings.NewReader("body"), 4)
+	done()
+	require.NoError(t, err)
+	require.EqualValues(t, 4, n)
+	require.True(t, rec.readFrom)
+	require.EqualValues(t, 4, counter.written)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "body", rec.Body.String())
+
+	// Without a ReadFrom method, the body is written.
+	plain := httptest.NewRecorder()
+	counter = &countingResponseWriter{ResponseWriter: plain}
+	_, err = io.CopyN(counter, strings.NewReader("body"), 4)
+	require.NoError(t, err)
+	require.Equal(t, "body", plain.Body.String())
+
+	// Buffers of the configured size are handed out, buffers of another
+	// size aren't taken back.
+	pool := newCopyBufferPool(minCopyBufferSize)
+	buf := pool.Get()
+	require.Len(t, buf, minCopyBufferSize)
+	pool.Put(make([]byte, 10))
+	require.Len(t, pool.Get(), minCopyBufferSize)
+
+	// Responses of a known size are buffered at once.
+	data, err := readBuffered(strings.NewReader("body"), 10, 4)
+	require.NoError(t, err)
+	require.Equal(t, "body", string(data))
+	_, err = readBuffered(strings.NewReader("large body"), 4, 10)
+	require.IsType(t, &BufferSizeError{}, err)
+}
+
+// BenchmarkLargeResponse measures the throughput and allocations of proxying
+// a large response body from a backend to a client.
+func BenchmarkLargeResponse(b *testing.B) {
+	const size = 64 * 1024 * 1024
+	payload := bytes.Repeat([]byte("a"), size)
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(hdrContentLength, strconv.Itoa(size))
+			_, _ = w.Write(payload)
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp: ".*",
+		Protocol:   "http",
+		Auth:       "off",
+	}})
+	require.NoError(b, err)
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	for _, bufferSize := range []int{DefaultCopyBufferSize, 256 * 1024} {
+		p.SetCopyBufferSize(bufferSize)
+
+		b.Run(strconv.Itoa(bufferSize), func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(server.URL + "/file")
+				require.NoError(b, err)
+				n, err := io.Copy(ioutil.Discard, resp.Body)
+				require.NoError(b, err)
+				require.NoError(b, resp.Body.Close())
+				require.EqualValues(b, size, n)
+			}
+		})
+	}
+}
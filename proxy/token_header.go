@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"golang.org/x/net/http/httpguts"
+)
+
+// validateTokenHeader checks the header fields the service reads tokens from.
+func validateTokenHeader(service *Service) error {
+	fields := []string{
+		service.TokenHeader, service.MacaroonHeader,
+		service.PreimageHeader,
+	}
+	for _, field := range fields {
+		if field == "" {
+			continue
+		}
+
+		if !httpguts.ValidHeaderFieldName(field) {
+			return fmt.Errorf("invalid token header %q", field)
+		}
+		if http.CanonicalHeaderKey(field) == "Cookie" {
+			return fmt.Errorf("tokens can't be read from the " +
+				"cookie header")
+		}
+	}
+
+	if (service.MacaroonHeader == "") != (service.PreimageHeader == "") {
+		return fmt.Errorf("macaroon and preimage header must be set " +
+			"together")
+	}
+	if service.MacaroonHeader != "" &&
+		http.CanonicalHeaderKey(service.MacaroonHeader) ==
+			http.CanonicalHeaderKey(service.PreimageHeader) {
+
+		return fmt.Errorf("macaroon and preimage header must differ")
+	}
+
+	return nil
+}
+
+// moveTokenHeader moves the token of a request to a service that reads tokens
+// from custom header fields into the Authorization header field, where the
+// rest of the proxy and the backend expect it. Tokens in the token header may
+// be sent in any of the formats of the standard header fields: with the LSAT
+// or L402 scheme, as <macBase64>:<preimageHex> without a scheme or as a hex
+// encoded macaroon with a preimage caveat. Tokens may also be split into a
+// base64 or hex encoded macaroon in the macaroon header and a hex encoded
+// preimage in the preimage header. Tokens in the custom header fields take
+// precedence over those in the standard ones.
+func moveTokenHeader(r *http.Request, target *Service) {
+	tokenHeader := customTokenHeader(r, target)
+	if tokenHeader == nil {
+		return
+	}
+
+	mac, preimage, err := lsat.FromHeader(&tokenHeader)
+	if err != nil {
+		log.Debugf("Invalid token in custom header fields: %v", err)
+		traceFromRequest(r).logf("Invalid token in custom header "+
+			"fields: %v", err)
+		return
+	}
+
+	// The other header fields can't carry a token anymore, or they would
+	// be read instead.
+	fields := []string{
+		target.TokenHeader, target.MacaroonHeader,
+		target.PreimageHeader, lsat.HeaderMacaroonMD,
+		lsat.HeaderMacaroon,
+	}
+	for _, field := range fields {
+		if field != "" {
+			r.Header.Del(field)
+		}
+	}
+	if err := lsat.SetHeader(&r.Header, mac, preimage); err != nil {
+		log.Errorf("Unable to set token header: %v", err)
+	}
+}
+
+// customTokenHeader returns the token of the request found in the custom
+// header fields of the target service as it would be sent in the standard
+// header fields, or nil if there is none.
+func customTokenHeader(r *http.Request, target *Service) http.Header {
+	var value string
+	if target.TokenHeader != "" {
+		value = strings.TrimSpace(r.Header.Get(target.TokenHeader))
+	}
+
+	// The value is parsed as if it was sent in the standard header field
+	// of its format.
+	tokenHeader := make(http.Header)
+	switch {
+	case strings.Contains(value, " "):
+		tokenHeader.Set(lsat.HeaderAuthorization, value)
+
+	case strings.Contains(value, ":"):
+		tokenHeader.Set(
+			lsat.HeaderAuthorization, lsat.SchemeLSAT+" "+value,
+		)
+
+	case value != "":
+		tokenHeader.Set(lsat.HeaderMacaroon, value)
+
+	// A token split into two header fields is joined in the format of the
+	// Authorization header field.
+	case target.MacaroonHeader != "":
+		macValue := strings.TrimSpace(
+			r.Header.Get(target.MacaroonHeader),
+		)
+		preimage := strings.TrimSpace(
+			r.Header.Get(target.PreimageHeader),
+		)
+		if macValue == "" || preimage == "" {
+			return nil
+		}
+
+		// Macaroons are accepted hex encoded like in the Macaroon
+		// header field too.
+		if macBytes, err := hex.DecodeString(macValue); err == nil {
+			macValue = base64.StdEncoding.EncodeToString(macBytes)
+		}
+		tokenHeader.Set(
+			lsat.HeaderAuthorization,
+			lsat.SchemeLSAT+" "+macValue+":"+preimage,
+		)
+
+	default:
+		return nil
+	}
+
+	return tokenHeader
+}
@@ -0,0 +1,165 @@
+package proxy_test
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+// testToken splits a token in the macaroon:preimage form of the Authorization
+// header field into its macaroon and hex encoded preimage.
+func testToken(t *testing.T, token string) (*macaroon.Macaroon, string) {
+	t.Helper()
+
+	parts := strings.Split(token, ":")
+	require.Len(t, parts, 2)
+	macBytes, err := base64.StdEncoding.DecodeString(parts[0])
+	require.NoError(t, err)
+	mac := &macaroon.Macaroon{}
+	require.NoError(t, mac.UnmarshalBinary(macBytes))
+
+	return mac, parts[1]
+}
+
+// TestTokenHeader tests that tokens sent in the custom token header field of a
+// service are accepted in all formats and reach the backend in the
+// Authorization header field.
+func TestTokenHeader(t *testing.T) {
+	token := strings.TrimPrefix(testAuthHeader(t, lsat.TokenID{1}), "LSAT ")
+	mac, preimage := testToken(t, token)
+	err := lsat.AddFirstPartyCaveats(
+		mac, lsat.NewCaveat(lsat.PreimageKey, preimage),
+	)
+	require.NoError(t, err)
+	macWithPreimage, err := mac.MarshalBinary()
+	require.NoError(t, err)
+
+	service := testHandlerService(
+		"sdk", "", func(w http.ResponseWriter, r *http.Request) {
+			require.Empty(t, r.Header.Get("X-Api-Token"))
+			_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+		},
+	)
+	service.TokenHeader = "X-Api-Token"
+	p, err := proxy.New(auth.NewMockAuthenticator(), []*proxy.Service{
+		service,
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		value  string
+		status int
+	}{{
+		name:   "no token",
+		status: http.StatusPaymentRequired,
+	}, {
+		name:   "scheme",
+		value:  "L402 " + token,
+		status: http.StatusOK,
+	}, {
+		name:   "no scheme",
+		value:  token,
+		status: http.StatusOK,
+	}, {
+		name:   "macaroon with preimage",
+		value:  hex.EncodeToString(macWithPreimage),
+		status: http.StatusOK,
+	}, {
+		name:   "invalid",
+		value:  "not-a-token",
+		status: http.StatusPaymentRequired,
+	}}
+	for _, tc := range testCases {
+		rec := serveTestRequest(
+			p, "GET", "/x", "", nil,
+			withTestHeader("X-Api-Token", tc.value),
+		)
+		require.Equal(t, tc.status, rec.Code, tc.name)
+		if tc.status == http.StatusOK {
+			require.True(t, strings.HasPrefix(
+				rec.Body.String(), "LSAT ",
+			), tc.name)
+		}
+	}
+}
+
+// TestSplitTokenHeaders tests that tokens split into the custom macaroon and
+// preimage header fields of a service are accepted and reach the backend in
+// the Authorization header field.
+func TestSplitTokenHeaders(t *testing.T) {
+	authHeader := testAuthHeader(t, lsat.TokenID{1})
+	mac, preimage := testToken(t, strings.TrimPrefix(authHeader, "LSAT "))
+	macBytes, err := mac.MarshalBinary()
+	require.NoError(t, err)
+
+	service := testHandlerService(
+		"gateway", "", func(w http.ResponseWriter, r *http.Request) {
+			require.Empty(t, r.Header.Get("X-Macaroon"))
+			require.Empty(t, r.Header.Get("X-Preimage"))
+			_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+		},
+	)
+	service.MacaroonHeader = "X-Macaroon"
+	service.PreimageHeader = "X-Preimage"
+	p, err := proxy.New(auth.NewMockAuthenticator(), []*proxy.Service{
+		service,
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		macaroon string
+		preimage string
+		status   int
+	}{{
+		name:   "no token",
+		status: http.StatusPaymentRequired,
+	}, {
+		name:     "base64 macaroon",
+		macaroon: base64.StdEncoding.EncodeToString(macBytes),
+		preimage: preimage,
+		status:   http.StatusOK,
+	}, {
+		name:     "hex macaroon",
+		macaroon: hex.EncodeToString(macBytes),
+		preimage: preimage,
+		status:   http.StatusOK,
+	}, {
+		name:     "no preimage",
+		macaroon: hex.EncodeToString(macBytes),
+		status:   http.StatusPaymentRequired,
+	}, {
+		name:     "invalid preimage",
+		macaroon: hex.EncodeToString(macBytes),
+		preimage: "not-a-preimage",
+		status:   http.StatusPaymentRequired,
+	}}
+	for _, tc := range testCases {
+		rec := serveTestRequest(
+			p, "GET", "/x", "", nil,
+			withTestHeader("X-Macaroon", tc.macaroon),
+			withTestHeader("X-Preimage", tc.preimage),
+		)
+		require.Equal(t, tc.status, rec.Code, tc.name)
+		if tc.status == http.StatusOK {
+			require.Equal(t, authHeader, rec.Body.String(), tc.name)
+		}
+	}
+
+	// Only one of the split header fields is rejected.
+	err = p.UpdateServices([]*proxy.Service{{
+		Name:           "invalid",
+		HostRegexp:     testHostRegexp,
+		MacaroonHeader: "X-Macaroon",
+	}})
+	require.Error(t, err)
+}
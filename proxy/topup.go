@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+const (
+	// topUpPathPrefix is the prefix of the top-up endpoints. Top-ups for a
+	// service are requested at the prefix followed by the service name and
+	// claimed at that path followed by the hex encoded payment hash of the
+	// top-up invoice.
+	topUpPathPrefix = "/.aperture/topup/"
+)
+
+// TopUpStore is an entity that keeps track of the pending top-ups of the
+// message balances of tokens and the messages that were credited to them.
+type TopUpStore interface {
+	// AddTopUp records a pending top-up of the balance of the token by
+	// the given number of messages once the invoice with the given payment
+	// hash is paid.
+	AddTopUp(context.Context, lntypes.Hash, lsat.TokenID, uint64) error
+
+	// ClaimTopUp atomically removes the pending top-up of the invoice with
+	// the given payment hash and credits its messages to the balance of
+	// its token, which must be the given one. The number of credited
+	// messages is returned, or false if there is no such pending top-up.
+	ClaimTopUp(context.Context, lntypes.Hash, lsat.TokenID) (uint64, bool,
+		error)
+
+	// Credited returns the number of messages that were credited to the
+	// balance of the token by top-ups.
+	Credited(context.Context, lsat.TokenID) (uint64, error)
+}
+
+// topUp is a pending top-up of the balance of a token.
+type topUp struct {
+	tokenID  lsat.TokenID
+	messages uint64
+}
+
+// memTopUpStore is a TopUpStore that keeps the top-ups in memory.
+type memTopUpStore struct {
+	sync.Mutex
+	pending  map[lntypes.Hash]topUp
+	credited map[lsat.TokenID]uint64
+}
+
+// A compile-time constraint to ensure memTopUpStore implements TopUpStore.
+var _ TopUpStore = (*memTopUpStore)(nil)
+
+// newMemTopUpStore creates a new, empty in-memory top-up store.
+func newMemTopUpStore() *memTopUpStore {
+	return &memTopUpStore{
+		pending:  make(map[lntypes.Hash]topUp),
+		credited: make(map[lsat.TokenID]uint64),
+	}
+}
+
+// AddTopUp records a pending top-up of the balance of the token.
+//
+// NOTE: This is part of the TopUpStore interface.
+func (s *memTopUpStore) AddTopUp(_ context.Context, hash lntypes.Hash,
+	tokenID lsat.TokenID, messages uint64) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.pending[hash] = topUp{tokenID: tokenID, messages: messages}
+	return nil
+}
+
+// ClaimTopUp removes the pending top-up and credits its messages to the
+// balance of its token.
+//
+// NOTE: This is part of the TopUpStore interface.
+func (s *memTopUpStore) ClaimTopUp(_ context.Context, hash lntypes.Hash,
+	tokenID lsat.TokenID) (uint64, bool, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	pending, ok := s.pending[hash]
+	if !ok || pending.tokenID != tokenID {
+		return 0, false, nil
+	}
+
+	delete(s.pending, hash)
+	s.credited[tokenID] += pending.messages
+	return pending.messages, true, nil
+}
+
+// Credited returns the number of messages that were credited to the balance of
+// the token.
+//
+// NOTE: This is part of the TopUpStore interface.
+func (s *memTopUpStore) Credited(_ context.Context,
+	tokenID lsat.TokenID) (uint64, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.credited[tokenID], nil
+}
+
+// topUpResponse is the JSON body of the responses of the top-up endpoints.
+type topUpResponse struct {
+	Invoice     string `json:"invoice,omitempty"`
+	PaymentHash string `json:"payment_hash,omitempty"`
+	Messages    uint64 `json:"messages"`
+}
+
+// isTopUpRequest returns true if the request is addressed to one of the top-up
+// endpoints.
+func isTopUpRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, topUpPathPrefix)
+}
+
+// handleTopUp creates the invoice of a top-up of the message balance of the
+// token the request is made with, or credits a paid top-up to its balance. The
+// token stays the same, so clients don't need to replace it.
+func (p *Proxy) handleTopUp(w http.ResponseWriter, r *http.Request,
+	remoteIP net.IP, prefixLog *PrefixLog) {
+
+	if r.Method != http.MethodPost {
+		sendDirectResponse(
+			w, r, http.StatusMethodNotAllowed, "method not allowed",
+		)
+		return
+	}
+
+	parts := strings.Split(
+		strings.TrimPrefix(r.URL.Path, topUpPathPrefix), "/",
+	)
+	target, ok := p.serviceByName(parts[0])
+	if !ok || len(parts) > 2 || !target.Billing.TopUp ||
+		p.topUpChallenger == nil || p.preimageFetcher == nil {
+
+		sendDirectResponse(w, r, http.StatusNotFound, "not found")
+		return
+	}
+
+	// Only the holder of a valid token can top it up.
+	r = withClientBinding(r, remoteIP)
+	r = withGracePeriod(r, target)
+	if !p.accept(r, target.Name) {
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "invalid token",
+		)
+		return
+	}
+	tokenID, err := tokenIDFromHeader(r.Header)
+	if err != nil {
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "invalid token",
+		)
+		return
+	}
+
+	if len(parts) == 2 {
+		p.claimTopUp(w, r, tokenID, parts[1], prefixLog)
+		return
+	}
+
+	price, err := target.pricer.GetPrice(r.Context(), r.URL.Path)
+	if err != nil {
+		prefixLog.Errorf("Error getting top-up price: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"failure fetching resource price",
+		)
+		return
+	}
+
+	invoice, hash, err := p.topUpChallenger.NewChallenge(price)
+	switch {
+	case err == mint.ErrChallengerBusy:
+		sendBusyResponse(w, r)
+		return
+
+	case err != nil:
+		prefixLog.Errorf("Error creating top-up invoice: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "top-up failure",
+		)
+		return
+	}
+
+	messages := target.Billing.Messages
+	err = p.topUpStore.AddTopUp(r.Context(), hash, tokenID, messages)
+	if err != nil {
+		prefixLog.Errorf("Error storing top-up: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "top-up failure",
+		)
+		return
+	}
+
+	prefixLog.Infof("Created top-up of %d messages for token %v.",
+		messages, tokenID)
+	writeTopUpResponse(w, &topUpResponse{
+		Invoice:     invoice,
+		PaymentHash: hash.String(),
+		Messages:    messages,
+	})
+}
+
+// claimTopUp credits the messages of the paid top-up with the given payment
+// hash to the balance of the token. A top-up can only be claimed once.
+func (p *Proxy) claimTopUp(w http.ResponseWriter, r *http.Request,
+	tokenID lsat.TokenID, hashStr string, prefixLog *PrefixLog) {
+
+	hash, err := lntypes.MakeHashFromStr(hashStr)
+	if err != nil {
+		sendDirectResponse(
+			w, r, http.StatusBadRequest, "invalid payment hash",
+		)
+		return
+	}
+
+	_, err = p.preimageFetcher.FetchPreimage(r.Context(), hash)
+	switch {
+	case err == auth.ErrInvoiceNotSettled:
+		sendDirectResponse(
+			w, r, http.StatusPaymentRequired, "top-up not paid",
+		)
+		return
+
+	case err == mint.ErrChallengerBusy:
+		sendBusyResponse(w, r)
+		return
+
+	case err != nil:
+		prefixLog.Errorf("Error fetching top-up status: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "top-up failure",
+		)
+		return
+	}
+
+	messages, ok, err := p.topUpStore.ClaimTopUp(
+		r.Context(), hash, tokenID,
+	)
+	if err != nil {
+		prefixLog.Errorf("Error claiming top-up: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "top-up failure",
+		)
+		return
+	}
+	if !ok {
+		sendDirectResponse(w, r, http.StatusNotFound, "unknown top-up")
+		return
+	}
+
+	prefixLog.Infof("Credited top-up of %d messages to token %v.",
+		messages, tokenID)
+	writeTopUpResponse(w, &topUpResponse{
+		PaymentHash: hash.String(),
+		Messages:    messages,
+	})
+}
+
+// writeTopUpResponse writes the JSON body of a top-up endpoint.
+func writeTopUpResponse(w http.ResponseWriter, response *topUpResponse) {
+	addCorsHeaders(w.Header())
+	w.Header().Set(hdrContentType, hdrTypeJSON)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("Error sending top-up response: %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// DefaultTraceHeader is the default header field that carries the
+	// secret that enables the trace of a request.
+	DefaultTraceHeader = "Aperture-Debug"
+
+	// HeaderTraceID is the header field the ID of a traced request is
+	// returned in, which prefixes all log lines of its trace.
+	HeaderTraceID = "Aperture-Trace-Id"
+
+	// minTraceSecretLength is the minimum length of the secret that
+	// enables the trace of a request, so it can't be guessed.
+	minTraceSecretLength = 16
+)
+
+// TraceConfig holds the options to trace single requests for debugging. A
+// request that carries the secret in the header field is logged in detail at
+// the info level, independent of the debug level.
+type TraceConfig struct {
+	// Header is the header field that carries the secret.
+	Header string `long:"header" description:"The header field that carries the secret (default: Aperture-Debug)"`
+
+	// Secret is the value of the header field that enables the trace.
+	// Tracing is disabled if it's empty.
+	Secret string `long:"secret" description:"The secret that enables the trace of a request, at least 16 characters. Tracing is disabled if empty." secret:"true"`
+}
+
+// Validate checks the trace options.
+func (c *TraceConfig) Validate() error {
+	if c.Secret != "" && len(c.Secret) < minTraceSecretLength {
+		return fmt.Errorf("trace secret must have at least %d "+
+			"characters", minTraceSecretLength)
+	}
+
+	return nil
+}
+
+// header returns the header field that carries the secret.
+func (c *TraceConfig) header() string {
+	if c.Header == "" {
+		return DefaultTraceHeader
+	}
+	return c.Header
+}
+
+// SetTraceConfig sets the options to trace single requests for debugging.
+func (p *Proxy) SetTraceConfig(cfg *TraceConfig) {
+	p.traceCfg = cfg
+}
+
+// requestTrace logs the steps of the handling of a single request.
+type requestTrace struct {
+	id        string
+	start     time.Time
+	prefixLog *PrefixLog
+}
+
+// logf logs a step of the request with the time since it arrived. It does
+// nothing if the request isn't traced.
+func (t *requestTrace) logf(format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+
+	t.prefixLog.Infof("[trace %s +%v] %s", t.id,
+		time.Since(t.start).Round(time.Microsecond),
+		fmt.Sprintf(format, args...))
+}
+
+// startTrace starts the trace of the request if it carries the trace secret.
+// The header field with the secret is removed, so it isn't forwarded, and the
+// ID of the trace is returned to the client. The returned trace is nil if the
+// request isn't traced.
+func (p *Proxy) startTrace(w http.ResponseWriter, r *http.Request,
+	prefixLog *PrefixLog) (*http.Request, *requestTrace) {
+
+	cfg := p.traceCfg
+	if cfg == nil || cfg.Secret == "" {
+		return r, nil
+	}
+
+	header := cfg.header()
+	secret := r.Header.Get(header)
+	if secret == "" {
+		return r, nil
+	}
+	r.Header.Del(header)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(cfg.Secret)) != 1 {
+		return r, nil
+	}
+
+	var rawID [8]byte
+	if _, err := rand.Read(rawID[:]); err != nil {
+		prefixLog.Errorf("Unable to create trace ID: %v", err)
+		return r, nil
+	}
+	trace := &requestTrace{
+		id:        hex.EncodeToString(rawID[:]),
+		start:     time.Now(),
+		prefixLog: prefixLog,
+	}
+	w.Header().Set(HeaderTraceID, trace.id)
+
+	trace.logf("%s %s%s %s from %s", r.Method, r.Host, r.RequestURI,
+		r.Proto, r.RemoteAddr)
+
+	// The authenticator and the mint record their checks through the
+	// context, as do the connections to the backend.
+	ctx := context.WithValue(r.Context(), traceKey{}, trace)
+	ctx = lsat.AddToContext(ctx, lsat.KeyTrace, lsat.TraceFunc(trace.logf))
+	ctx = httptrace.WithClientTrace(ctx, trace.clientTrace())
+
+	return r.WithContext(ctx), trace
+}
+
+// clientTrace returns the hooks that trace the exchange with the backend.
+func (t *requestTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			t.logf("Connecting to backend %s", hostPort)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.logf("Got connection to backend %v, reused: %v",
+				info.Conn.RemoteAddr(), info.Reused)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			t.logf("Resolved backend to %v, error: %v", info.Addrs,
+				info.Err)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.logf("Connected to backend %s %s, error: %v", network,
+				addr, err)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.logf("TLS handshake with backend done, error: %v",
+				err)
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			t.logf("Sent request to backend, error: %v", info.Err)
+		},
+		GotFirstResponseByte: func() {
+			t.logf("Got first response byte from backend")
+		},
+	}
+}
+
+// traceKey is the key the trace of a request is stored under in its context.
+type traceKey struct{}
+
+// traceFromRequest returns the trace of the request, or nil if it isn't
+// traced.
+func traceFromRequest(r *http.Request) *requestTrace {
+	trace, _ := r.Context().Value(traceKey{}).(*requestTrace)
+	return trace
+}
@@ -0,0 +1,56 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTrace tests that requests carrying the trace secret are answered with a
+// trace ID and that the header field with the secret never reaches the
+// backend.
+func TestTrace(t *testing.T) {
+	const secret = "0123456789abcdef"
+
+	service := testHandlerService(
+		"free-service", "^/free/.*$",
+		func(w http.ResponseWriter, r *http.Request) {
+			require.Empty(t, r.Header.Get("X-Debug"))
+			_, _ = w.Write([]byte("ok"))
+		},
+	)
+	service.Auth = "off"
+	p, err := proxy.New(auth.NewMockAuthenticator(), []*proxy.Service{
+		service,
+	})
+	require.NoError(t, err)
+
+	require.Error(t, (&proxy.TraceConfig{Secret: "short"}).Validate())
+	cfg := &proxy.TraceConfig{Header: "X-Debug", Secret: secret}
+	require.NoError(t, cfg.Validate())
+	p.SetTraceConfig(cfg)
+
+	serve := func(value string) *httptest.ResponseRecorder {
+		rec := serveTestRequest(
+			p, "GET", "/free/x", "", nil,
+			withTestHeader("X-Debug", value),
+		)
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec
+	}
+
+	// Only requests with the right secret are traced.
+	rec := serve(secret)
+	require.Len(t, rec.Header().Get(proxy.HeaderTraceID), 16)
+	require.NotEqual(
+		t, rec.Header().Get(proxy.HeaderTraceID),
+		serve(secret).Header().Get(proxy.HeaderTraceID),
+	)
+
+	require.Empty(t, serve("wrong").Header().Get(proxy.HeaderTraceID))
+	require.Empty(t, serve("").Header().Get(proxy.HeaderTraceID))
+}
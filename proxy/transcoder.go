@@ -0,0 +1,790 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	gateway "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/lightninglabs/aperture/lsat"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	// httpRuleFieldNumber is the field number of the google.api.http
+	// extension of the method options. We parse the extension ourselves so
+	// we don't need to depend on the generated annotations package.
+	httpRuleFieldNumber = 72295728
+
+	// grpcFrameHeaderSize is the size of the header in front of each gRPC
+	// message: one byte compression flag and four bytes message length.
+	grpcFrameHeaderSize = 5
+
+	// maxTranscodeMessageSize is the maximum size of a REST request body
+	// or gRPC response message that we are going to transcode. This is the
+	// same as the default maximum message size of gRPC.
+	maxTranscodeMessageSize = 4 * 1024 * 1024
+
+	// grpcMetadataHeaderPrefix is the prefix of HTTP header fields that
+	// should be forwarded to the gRPC backend as metadata.
+	grpcMetadataHeaderPrefix = "Grpc-Metadata-"
+
+	hdrTypeJSON = "application/json"
+)
+
+var (
+	// transcodeMarshalOptions are the options used to render a gRPC
+	// response as JSON. These are the same as used by the REST proxy of
+	// the hashmail server.
+	transcodeMarshalOptions = protojson.MarshalOptions{
+		UseProtoNames:   true,
+		EmitUnpopulated: true,
+	}
+)
+
+// httpRule is the parsed content of a google.api.http annotation.
+type httpRule struct {
+	method       string
+	path         string
+	body         string
+	responseBody string
+}
+
+// transcodeRoute is a single REST binding of a gRPC method.
+type transcodeRoute struct {
+	method       protoreflect.MethodDescriptor
+	httpMethod   string
+	template     *pathTemplate
+	body         string
+	responseBody string
+}
+
+// grpcPath returns the HTTP/2 path of the gRPC method of the route.
+func (t *transcodeRoute) grpcPath() string {
+	return fmt.Sprintf("/%s/%s", t.method.Parent().FullName(),
+		t.method.Name())
+}
+
+// transcoder translates REST requests into gRPC calls according to the
+// google.api.http annotations of a set of proto descriptors, in the same way
+// grpc-gateway does it.
+type transcoder struct {
+	routes []*transcodeRoute
+
+	// streaming holds the gRPC paths of all methods of the descriptors,
+	// mapped to whether the method is a streaming one.
+	streaming map[string]bool
+}
+
+// newTranscoder creates a new transcoder from a file that contains a
+// serialized FileDescriptorSet, as created by protoc with the
+// --include_imports and --descriptor_set_out flags.
+func newTranscoder(descriptorFile string) (*transcoder, error) {
+	descriptorBytes, err := ioutil.ReadFile(descriptorFile)
+	if err != nil {
+		return nil, err
+	}
+
+	descriptorSet := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(descriptorBytes, descriptorSet); err != nil {
+		return nil, fmt.Errorf("unable to parse descriptor set %s: %v",
+			descriptorFile, err)
+	}
+	files, err := protodesc.NewFiles(descriptorSet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set %s: %v",
+			descriptorFile, err)
+	}
+
+	t := &transcoder{
+		streaming: make(map[string]bool),
+	}
+	files.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		services := file.Services()
+		for i := 0; i < services.Len(); i++ {
+			methods := services.Get(i).Methods()
+			for j := 0; j < methods.Len(); j++ {
+				method := methods.Get(j)
+				path := fmt.Sprintf("/%s/%s",
+					services.Get(i).FullName(), method.Name())
+				streaming := method.IsStreamingClient() ||
+					method.IsStreamingServer()
+				t.streaming[path] = streaming
+
+				var routes []*transcodeRoute
+				routes, err = routesForMethod(method)
+				if err != nil {
+					return false
+				}
+				t.routes = append(t.routes, routes...)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Loaded %d REST routes from descriptor set %s",
+		len(t.routes), descriptorFile)
+
+	return t, nil
+}
+
+// routesForMethod creates a route for each REST binding of the given gRPC
+// method.
+func routesForMethod(method protoreflect.MethodDescriptor) ([]*transcodeRoute,
+	error) {
+
+	// Only unary methods can be transcoded.
+	if method.IsStreamingClient() || method.IsStreamingServer() {
+		return nil, nil
+	}
+
+	options, ok := method.Options().(*descriptorpb.MethodOptions)
+	if !ok || options == nil {
+		return nil, nil
+	}
+
+	// The annotation is either kept as an unknown field or, if the
+	// annotations package was linked into the binary, as an extension.
+	// Both end up in the serialized form.
+	rawOptions, err := proto.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := parseHTTPRules(
+		rawOptions, httpRuleFieldNumber, method.FullName(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make([]*transcodeRoute, 0, len(rules))
+	for _, rule := range rules {
+		template, err := parsePathTemplate(rule.path)
+		if err != nil {
+			return nil, fmt.Errorf("method %s: %v",
+				method.FullName(), err)
+		}
+
+		input := method.Input()
+		if rule.body != "" && rule.body != "*" &&
+			input.Fields().ByName(protoreflect.Name(rule.body)) == nil {
+
+			return nil, fmt.Errorf("method %s: unknown body field "+
+				"%s", method.FullName(), rule.body)
+		}
+
+		if rule.responseBody != "" {
+			field := method.Output().Fields().ByName(
+				protoreflect.Name(rule.responseBody),
+			)
+			if field == nil || field.Message() == nil ||
+				field.IsList() || field.IsMap() {
+
+				return nil, fmt.Errorf("method %s: response "+
+					"body %s must be a message field",
+					method.FullName(), rule.responseBody)
+			}
+		}
+
+		routes = append(routes, &transcodeRoute{
+			method:       method,
+			httpMethod:   rule.method,
+			template:     template,
+			body:         rule.body,
+			responseBody: rule.responseBody,
+		})
+	}
+
+	return routes, nil
+}
+
+// parseHTTPRules extracts all google.api.http rules, including the additional
+// bindings, that are encoded in the given field of a serialized message.
+func parseHTTPRules(b []byte, fieldNumber protowire.Number,
+	name protoreflect.FullName) ([]*httpRule, error) {
+
+	var rules []*httpRule
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if num != fieldNumber || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		value, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		rule, additional, err := parseHTTPRule(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http rule for method "+
+				"%s: %v", name, err)
+		}
+		if rule.path != "" {
+			rules = append(rules, rule)
+		}
+		rules = append(rules, additional...)
+	}
+
+	return rules, nil
+}
+
+// parseHTTPRule parses a single serialized google.api.HttpRule message and
+// returns it together with its additional bindings.
+func parseHTTPRule(b []byte) (*httpRule, []*httpRule, error) {
+	var (
+		rule       = &httpRule{}
+		additional []*httpRule
+	)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		value, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return nil, nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch num {
+		case 2:
+			rule.method, rule.path = http.MethodGet, string(value)
+		case 3:
+			rule.method, rule.path = http.MethodPut, string(value)
+		case 4:
+			rule.method, rule.path = http.MethodPost, string(value)
+		case 5:
+			rule.method, rule.path = http.MethodDelete, string(value)
+		case 6:
+			rule.method, rule.path = http.MethodPatch, string(value)
+		case 7:
+			rule.body = string(value)
+		case 8:
+			kind, path, err := parseCustomHTTPPattern(value)
+			if err != nil {
+				return nil, nil, err
+			}
+			rule.method, rule.path = kind, path
+		case 11:
+			binding, nested, err := parseHTTPRule(value)
+			if err != nil {
+				return nil, nil, err
+			}
+			additional = append(additional, binding)
+			additional = append(additional, nested...)
+		case 12:
+			rule.responseBody = string(value)
+		}
+	}
+
+	return rule, additional, nil
+}
+
+// parseCustomHTTPPattern parses a serialized google.api.CustomHttpPattern
+// message.
+func parseCustomHTTPPattern(b []byte) (string, string, error) {
+	var kind, path string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return "", "", protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		value, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch num {
+		case 1:
+			kind = strings.ToUpper(string(value))
+		case 2:
+			path = string(value)
+		}
+	}
+
+	return kind, path, nil
+}
+
+// match returns the route that matches the given REST request, together with
+// the values of the path variables.
+func (t *transcoder) match(r *http.Request) (*transcodeRoute,
+	map[string]string, bool) {
+
+	for _, route := range t.routes {
+		if route.httpMethod != r.Method {
+			continue
+		}
+
+		vars, ok := route.template.match(r.URL.Path)
+		if ok {
+			return route, vars, true
+		}
+	}
+
+	return nil, nil, false
+}
+
+// buildRequest creates the gRPC request message for the given REST request
+// from its body, path variables and query parameters.
+func (t *transcodeRoute) buildRequest(r *http.Request,
+	vars map[string]string) (proto.Message, error) {
+
+	msg := dynamicpb.NewMessage(t.method.Input())
+
+	body, err := ioutil.ReadAll(
+		io.LimitReader(r.Body, maxTranscodeMessageSize+1),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxTranscodeMessageSize {
+		return nil, fmt.Errorf("request body too large")
+	}
+
+	switch {
+	case t.body == "" || len(bytes.TrimSpace(body)) == 0:
+
+	case t.body == "*":
+		if err := protojson.Unmarshal(body, msg); err != nil {
+			return nil, err
+		}
+
+	// If only a single field is mapped to the body, we wrap the body in a
+	// JSON object so we can still use the JSON unmarshaler for all types.
+	default:
+		wrapped := make([]byte, 0, len(body)+len(t.body)+5)
+		wrapped = append(wrapped, []byte(`{"`+t.body+`":`)...)
+		wrapped = append(wrapped, body...)
+		wrapped = append(wrapped, '}')
+		if err := protojson.Unmarshal(wrapped, msg); err != nil {
+			return nil, err
+		}
+	}
+
+	for fieldPath, value := range vars {
+		if err := setFieldValue(msg, fieldPath, value); err != nil {
+			return nil, err
+		}
+	}
+
+	// Query parameters are only considered if not all fields are mapped
+	// to the body already.
+	if t.body == "*" {
+		return msg, nil
+	}
+	for fieldPath, values := range r.URL.Query() {
+		if _, ok := vars[fieldPath]; ok {
+			continue
+		}
+		for _, value := range values {
+			err := setFieldValue(msg, fieldPath, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return msg, nil
+}
+
+// setFieldValue parses the string value and sets it on the (possibly nested)
+// field of the message identified by the dot separated path.
+func setFieldValue(msg protoreflect.Message, fieldPath, value string) error {
+	names := strings.Split(fieldPath, ".")
+	for i, name := range names {
+		fields := msg.Descriptor().Fields()
+		field := fields.ByName(protoreflect.Name(name))
+		if field == nil {
+			field = fields.ByJSONName(name)
+		}
+		if field == nil {
+			return fmt.Errorf("unknown field %s in %s", name,
+				msg.Descriptor().FullName())
+		}
+
+		// Navigate down to the nested message.
+		if i < len(names)-1 {
+			if field.Message() == nil || field.IsList() ||
+				field.IsMap() {
+
+				return fmt.Errorf("field %s is not a message",
+					name)
+			}
+			msg = msg.Mutable(field).Message()
+			continue
+		}
+
+		if field.IsMap() {
+			return fmt.Errorf("map field %s cannot be set from a "+
+				"string", name)
+		}
+
+		v, err := parseFieldValue(field, value)
+		if err != nil {
+			return fmt.Errorf("invalid value for field %s: %v",
+				name, err)
+		}
+		if field.IsList() {
+			msg.Mutable(field).List().Append(v)
+		} else {
+			msg.Set(field, v)
+		}
+	}
+
+	return nil
+}
+
+// parseFieldValue parses a string into a value of the scalar type of the
+// given field.
+func parseFieldValue(field protoreflect.FieldDescriptor,
+	s string) (protoreflect.Value, error) {
+
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		v, err := strconv.ParseBool(s)
+		return protoreflect.ValueOfBool(v), err
+
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind,
+		protoreflect.Sfixed32Kind:
+
+		v, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfInt32(int32(v)), err
+
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind,
+		protoreflect.Sfixed64Kind:
+
+		v, err := strconv.ParseInt(s, 10, 64)
+		return protoreflect.ValueOfInt64(v), err
+
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		v, err := strconv.ParseUint(s, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(v)), err
+
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		v, err := strconv.ParseUint(s, 10, 64)
+		return protoreflect.ValueOfUint64(v), err
+
+	case protoreflect.FloatKind:
+		v, err := strconv.ParseFloat(s, 32)
+		return protoreflect.ValueOfFloat32(float32(v)), err
+
+	case protoreflect.DoubleKind:
+		v, err := strconv.ParseFloat(s, 64)
+		return protoreflect.ValueOfFloat64(v), err
+
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(s), nil
+
+	case protoreflect.BytesKind:
+		v, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			v, err = base64.URLEncoding.DecodeString(s)
+		}
+		return protoreflect.ValueOfBytes(v), err
+
+	case protoreflect.EnumKind:
+		enumValue := field.Enum().Values().ByName(protoreflect.Name(s))
+		if enumValue != nil {
+			return protoreflect.ValueOfEnum(enumValue.Number()), nil
+		}
+		v, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(v)), err
+
+	default:
+		return protoreflect.Value{}, fmt.Errorf("unsupported field "+
+			"kind %v", field.Kind())
+	}
+}
+
+// grpcTransport is a round tripper for native gRPC requests. Plain text
+// backends are reached through HTTP/2 with prior knowledge (h2c) since gRPC
+// doesn't work over HTTP/1.
+type grpcTransport struct {
+	tls http.RoundTripper
+	h2c http.RoundTripper
+}
+
+// newGRPCTransport creates a new gRPC round tripper that uses the given TLS
+// capable transport for https backends and the given h2c transport for plain
+// text backends.
+func newGRPCTransport(tlsTransport,
+	h2cTransport http.RoundTripper) *grpcTransport {
+
+	return &grpcTransport{
+		tls: tlsTransport,
+		h2c: h2cTransport,
+	}
+}
+
+// RoundTrip sends the gRPC request to the backend.
+func (g *grpcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return g.h2c.RoundTrip(req)
+	}
+	return g.tls.RoundTrip(req)
+}
+
+// transcode translates a REST request into a unary gRPC call to the backend of
+// the target service and renders the response as JSON.
+func (p *Proxy) transcode(w http.ResponseWriter, r *http.Request,
+	target *Service, route *transcodeRoute, vars map[string]string,
+	prefixLog *PrefixLog) {
+
+	addCorsHeaders(w.Header())
+
+	reqMsg, err := route.buildRequest(r, vars)
+	if err != nil {
+		prefixLog.Debugf("Unable to transcode request: %v", err)
+		writeTranscodeError(w, codes.InvalidArgument, err.Error())
+		return
+	}
+	payload, err := proto.Marshal(reqMsg)
+	if err != nil {
+		writeTranscodeError(w, codes.Internal, err.Error())
+		return
+	}
+
+	maxSize := uint32(maxTranscodeMessageSize)
+	if max := target.Limits.MaxMessageSize; max != 0 && max < maxSize {
+		maxSize = max
+	}
+	if uint32(len(payload)) > maxSize {
+		sizeErr := &MessageSizeError{
+			Size: uint32(len(payload)),
+			Max:  maxSize,
+		}
+		writeTranscodeError(w, codes.ResourceExhausted, sizeErr.Error())
+		return
+	}
+
+	frame := make([]byte, grpcFrameHeaderSize, grpcFrameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	frame = append(frame, payload...)
+
+	backendURL := &url.URL{
+		Scheme: target.Protocol,
+		Host:   backendHost(r.Context(), target),
+		Path:   route.grpcPath(),
+	}
+	grpcReq, err := http.NewRequestWithContext(
+		r.Context(), http.MethodPost, backendURL.String(),
+		bytes.NewReader(frame),
+	)
+	if err != nil {
+		writeTranscodeError(w, codes.Internal, err.Error())
+		return
+	}
+	grpcReq.Header.Set(hdrContentType, hdrTypeGrpc)
+	grpcReq.Header.Set("Te", "trailers")
+	if timeout := r.Header.Get(hdrGrpcTimeout); timeout != "" {
+		grpcReq.Header.Set(hdrGrpcTimeout, timeout)
+	}
+
+	// Forward the authentication in the default format, all explicit
+	// metadata fields and the identity of the paying token to the backend,
+	// then apply the configured header fields.
+	mac, preimage, err := lsat.FromHeader(&r.Header)
+	if err == nil {
+		if err := lsat.SetHeader(&grpcReq.Header, mac, preimage); err != nil {
+			prefixLog.Errorf("could not set header: %v", err)
+		}
+	}
+	for name, values := range r.Header {
+		if !strings.HasPrefix(name, grpcMetadataHeaderPrefix) {
+			continue
+		}
+		mdName := strings.TrimPrefix(name, grpcMetadataHeaderPrefix)
+		for _, value := range values {
+			grpcReq.Header.Add(mdName, value)
+		}
+	}
+	if target.Identity.Forward {
+		for _, name := range identityHeaders {
+			if value := r.Header.Get(name); value != "" {
+				grpcReq.Header.Set(name, value)
+			}
+		}
+	}
+	for name, value := range target.Headers {
+		grpcReq.Header.Add(name, value)
+	}
+
+	resp, err := p.currentGRPCTransport().RoundTrip(grpcReq)
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeTranscodeError(w, codes.DeadlineExceeded, err.Error())
+		return
+	}
+	if err != nil {
+		prefixLog.Errorf("Error calling gRPC backend: %v", err)
+		writeTranscodeError(w, codes.Unavailable, "backend unavailable")
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	size := headerSize(resp.Header)
+	maxHeader := target.Limits.MaxResponseHeaderSize
+	if maxHeader > 0 && size > maxHeader {
+		sizeErr := &HeaderSizeError{Size: size, Max: maxHeader}
+		writeTranscodeError(w, codes.ResourceExhausted, sizeErr.Error())
+		return
+	}
+
+	// The trailers are only available after the body was read completely.
+	respBody, err := ioutil.ReadAll(
+		io.LimitReader(resp.Body, int64(maxSize)+grpcFrameHeaderSize+1),
+	)
+	if err != nil {
+		writeTranscodeError(w, codes.Unavailable, err.Error())
+		return
+	}
+
+	code, message := grpcStatusFromResponse(resp)
+	if code != codes.OK {
+		writeTranscodeError(w, code, message)
+		return
+	}
+
+	if len(respBody) < grpcFrameHeaderSize || respBody[0] != 0 {
+		writeTranscodeError(
+			w, codes.Internal, "invalid response from backend",
+		)
+		return
+	}
+	msgLen := binary.BigEndian.Uint32(respBody[1:grpcFrameHeaderSize])
+	if msgLen > maxSize {
+		sizeErr := &MessageSizeError{Size: msgLen, Max: maxSize}
+		writeTranscodeError(w, codes.ResourceExhausted, sizeErr.Error())
+		return
+	}
+	if int(msgLen) != len(respBody)-grpcFrameHeaderSize {
+		writeTranscodeError(
+			w, codes.Internal, "invalid response from backend",
+		)
+		return
+	}
+
+	respMsg := dynamicpb.NewMessage(route.method.Output())
+	err = proto.Unmarshal(respBody[grpcFrameHeaderSize:], respMsg)
+	if err != nil {
+		writeTranscodeError(w, codes.Internal, err.Error())
+		return
+	}
+
+	var out proto.Message = respMsg
+	if route.responseBody != "" {
+		field := respMsg.Descriptor().Fields().ByName(
+			protoreflect.Name(route.responseBody),
+		)
+		out = respMsg.Get(field).Message().Interface()
+	}
+
+	jsonBytes, err := transcodeMarshalOptions.Marshal(out)
+	if err != nil {
+		writeTranscodeError(w, codes.Internal, err.Error())
+		return
+	}
+
+	w.Header().Set(hdrContentType, hdrTypeJSON)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonBytes)
+}
+
+// grpcStatusFromResponse extracts the gRPC status code and message from either
+// the trailers or, for trailers-only responses, the headers of a response.
+func grpcStatusFromResponse(resp *http.Response) (codes.Code, string) {
+	source := resp.Trailer
+	if source.Get(hdrGrpcStatus) == "" {
+		source = resp.Header
+	}
+
+	statusStr := source.Get(hdrGrpcStatus)
+	if statusStr == "" {
+		return codes.Unknown, fmt.Sprintf("backend returned HTTP "+
+			"status %d without gRPC status", resp.StatusCode)
+	}
+	code, err := strconv.Atoi(statusStr)
+	if err != nil {
+		return codes.Unknown, fmt.Sprintf("invalid gRPC status %s",
+			statusStr)
+	}
+
+	message, err := url.PathUnescape(source.Get(hdrGrpcMessage))
+	if err != nil {
+		message = source.Get(hdrGrpcMessage)
+	}
+
+	return codes.Code(code), message
+}
+
+// writeTranscodeError writes a gRPC error as a JSON response with a matching
+// HTTP status code, in the same format as grpc-gateway does.
+func writeTranscodeError(w http.ResponseWriter, code codes.Code,
+	message string) {
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"code":    int(code),
+		"message": message,
+		"details": []interface{}{},
+	})
+
+	w.Header().Set(hdrContentType, hdrTypeJSON)
+	w.WriteHeader(gateway.HTTPStatusFromCode(code))
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/aperture/freebie"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"golang.org/x/time/rate"
+	"gopkg.in/macaroon.v2"
+)
+
+const (
+	// HeaderTrialToken is the header field of the response a new trial
+	// token is sent to the client in, in the format of the Authorization
+	// header field it has to be sent back in.
+	HeaderTrialToken = "Aperture-Trial-Token"
+
+	// defaultTrialValidity is the default time a trial token is valid for.
+	defaultTrialValidity = time.Hour
+
+	// defaultTrialRate is the default number of requests per minute that
+	// can be made with a trial token.
+	defaultTrialRate = 10
+
+	// defaultTrialPerClient is the default number of trial tokens a client
+	// can get.
+	defaultTrialPerClient = 1
+
+	// trialDBSuffix is the suffix of the name of the store that counts the
+	// trial tokens of the clients of a service.
+	trialDBSuffix = "-trial"
+
+	// trialPruneInterval is the interval in which the rate limiters of
+	// expired trial tokens are removed.
+	trialPruneInterval = time.Minute
+)
+
+var (
+	// defaultTrialMethods are the HTTP methods trial tokens can be used
+	// with by default.
+	defaultTrialMethods = []string{http.MethodGet, http.MethodHead}
+)
+
+// TrialConfig holds the options of the trial tokens of a service with the
+// "trial" auth level. Clients that don't send a token get a free one that is
+// restricted by these options on their first request, so they can evaluate
+// the service before paying for it.
+type TrialConfig struct {
+	// Validity is the time a trial token is valid for.
+	Validity time.Duration `long:"validity" description:"The time a trial token is valid for (default 1h)"`
+
+	// Rate is the number of requests per minute that can be made with a
+	// trial token.
+	Rate int `long:"rate" description:"The number of requests per minute that can be made with a trial token (default 10)"`
+
+	// Methods are the HTTP methods trial tokens can be used with.
+	Methods []string `long:"method" description:"An HTTP method trial tokens can be used with, can be given multiple times (default GET and HEAD)"`
+
+	// PerClient is the number of trial tokens each client IP address can
+	// get before it's asked to pay.
+	PerClient int `long:"perclient" description:"The number of trial tokens each client can get (default 1)"`
+}
+
+// validate checks the trial options and sets the defaults.
+func (c *TrialConfig) validate() error {
+	if c.Validity == 0 {
+		c.Validity = defaultTrialValidity
+	}
+	if c.Rate == 0 {
+		c.Rate = defaultTrialRate
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = append([]string(nil), defaultTrialMethods...)
+	}
+	if c.PerClient == 0 {
+		c.PerClient = defaultTrialPerClient
+	}
+
+	if c.Validity < time.Second {
+		return fmt.Errorf("validity must be at least one second")
+	}
+	if c.Rate < 0 {
+		return fmt.Errorf("invalid rate %d", c.Rate)
+	}
+	if c.PerClient < 0 || c.PerClient > math.MaxUint16 {
+		return fmt.Errorf("invalid number of trial tokens per "+
+			"client %d", c.PerClient)
+	}
+	for i, method := range c.Methods {
+		if method == "" || strings.Contains(method, ",") {
+			return fmt.Errorf("invalid method %q", method)
+		}
+		c.Methods[i] = strings.ToUpper(method)
+	}
+
+	return nil
+}
+
+// allowsMethod returns true if trial tokens can be used with the given HTTP
+// method.
+func (c *TrialConfig) allowsMethod(method string) bool {
+	for _, allowed := range c.Methods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareTrial checks the trial options of the service and creates the store
+// that counts the trial tokens of its clients.
+func prepareTrial(service *Service, newFreebieDB freebie.DBCreator) error {
+	service.trialDb = nil
+	if err := service.Trial.validate(); err != nil {
+		return err
+	}
+
+	if service.Auth.IsTrial() {
+		service.trialDb = newFreebieDB(
+			service.Name+trialDBSuffix,
+			freebie.Count(service.Trial.PerClient),
+		)
+	}
+
+	return nil
+}
+
+// TrialIssuer is an entity that mints trial tokens, like the mint.
+type TrialIssuer interface {
+	// MintTrialLSAT mints a new trial LSAT for the target services that
+	// doesn't need to be paid for and returns it with its preimage.
+	MintTrialLSAT(context.Context, ...lsat.Service) (*macaroon.Macaroon,
+		lntypes.Preimage, error)
+}
+
+// SetTrialIssuer sets the entity trial tokens are minted with. If it isn't
+// set, clients of services with the trial auth level are asked to pay right
+// away.
+func (p *Proxy) SetTrialIssuer(issuer TrialIssuer) {
+	p.trialIssuer = issuer
+}
+
+// trialLimiter limits the rate of the requests made with a trial token.
+type trialLimiter struct {
+	limiter *rate.Limiter
+	expiry  time.Time
+}
+
+// issueTrialToken mints a trial token for a client of the target service that
+// didn't send a valid token and returns the request authenticated with it. The
+// token is sent to the client in the HeaderTrialToken header field. False is
+// returned if the client can't get a trial token, for example because it used
+// up its trial tokens.
+func (p *Proxy) issueTrialToken(w http.ResponseWriter, r *http.Request,
+	target *Service, resourceName string, remoteIP net.IP,
+	prefixLog *PrefixLog) (*http.Request, bool) {
+
+	cfg := &target.Trial
+	if p.trialIssuer == nil || target.trialDb == nil ||
+		!cfg.allowsMethod(r.Method) {
+
+		return nil, false
+	}
+
+	ok, err := target.trialDb.CanPass(r, remoteIP)
+	if err != nil {
+		prefixLog.Errorf("Error querying trial db: %v", err)
+		return nil, false
+	}
+	if !ok {
+		traceFromRequest(r).logf("Trial tokens used up")
+		return nil, false
+	}
+
+	// Trial tokens are bound to the client like any other token of the
+	// service and restricted further on top.
+	caveats, err := target.Binding.caveats(r.Context())
+	if err != nil {
+		prefixLog.Infof("Unable to bind trial token: %v", err)
+		return nil, false
+	}
+	caveats = append(
+		caveats,
+		lsat.NewValidUntilCaveat(
+			resourceName, time.Now().Add(cfg.Validity),
+		),
+		lsat.NewMethodsCaveat(resourceName, cfg.Methods...),
+	)
+
+	ok, err = target.trialDb.TallyFreebie(r, remoteIP)
+	if err != nil {
+		prefixLog.Errorf("Error updating trial db: %v", err)
+		return nil, false
+	}
+
+	// A concurrent request, possibly on another instance, got the last
+	// trial token of the client.
+	if !ok {
+		return nil, false
+	}
+
+	ctx := lsat.AddToContext(r.Context(), lsat.KeyBindingCaveats, caveats)
+	mac, preimage, err := p.trialIssuer.MintTrialLSAT(ctx, lsat.Service{
+		Name: resourceName,
+		Tier: lsat.BaseTier,
+	})
+	if err != nil {
+		prefixLog.Errorf("Error minting trial token: %v", err)
+		return nil, false
+	}
+
+	// The request continues as if the client had sent the new token.
+	r.Header.Del(lsat.HeaderMacaroonMD)
+	r.Header.Del(lsat.HeaderMacaroon)
+	if err := lsat.SetHeader(&r.Header, mac, preimage); err != nil {
+		prefixLog.Errorf("Error setting trial token: %v", err)
+		return nil, false
+	}
+	w.Header().Set(
+		HeaderTrialToken, r.Header.Get(lsat.HeaderAuthorization),
+	)
+
+	if id, err := lsat.DecodeIdentifier(
+		bytes.NewReader(mac.Id()),
+	); err == nil {
+		prefixLog.Infof("Issued trial token %v", id.TokenID)
+	}
+	traceFromRequest(r).logf("Issued trial token valid for %v",
+		cfg.Validity)
+
+	return r, true
+}
+
+// checkTrialRate makes sure requests made with a trial token don't exceed the
+// rate of the trial tokens of the target service. Requests over the rate are
+// answered with a 429 response and false is returned.
+func (p *Proxy) checkTrialRate(w http.ResponseWriter, r *http.Request,
+	target *Service, prefixLog *PrefixLog) bool {
+
+	mac, _, err := lsat.FromHeader(&r.Header)
+	if err != nil {
+		return true
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil || !lsat.IsTrialIdentifier(id) {
+		return true
+	}
+
+	if p.trialAllow(id.TokenID, &target.Trial) {
+		return true
+	}
+
+	prefixLog.Infof("Trial token %v over its rate", id.TokenID)
+	traceFromRequest(r).logf("Trial token over its rate of %d requests "+
+		"per minute", target.Trial.Rate)
+	w.Header().Set(hdrRetryAfter, "1")
+	sendDirectResponse(
+		w, r, http.StatusTooManyRequests, "trial rate exceeded",
+	)
+	return false
+}
+
+// trialAllow returns true if another request can be made with the trial token
+// of the given ID now.
+func (p *Proxy) trialAllow(tokenID lsat.TokenID, cfg *TrialConfig) bool {
+	if cfg.Rate <= 0 {
+		return true
+	}
+
+	p.trialsMtx.Lock()
+	defer p.trialsMtx.Unlock()
+
+	now := time.Now()
+	if now.Sub(p.trialsPruned) > trialPruneInterval {
+		for id, limiter := range p.trials {
+			if now.After(limiter.expiry) {
+				delete(p.trials, id)
+			}
+		}
+		p.trialsPruned = now
+	}
+
+	limiter, ok := p.trials[tokenID]
+	if !ok {
+		limiter = &trialLimiter{
+			limiter: rate.NewLimiter(
+				rate.Every(time.Minute/time.Duration(cfg.Rate)),
+				cfg.Rate,
+			),
+			expiry: now.Add(cfg.Validity),
+		}
+		p.trials[tokenID] = limiter
+	}
+
+	return limiter.limiter.AllowN(now, 1)
+}
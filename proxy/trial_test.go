@@ -0,0 +1,131 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+// mockTrialIssuer mints trial tokens and records the caveats they were minted
+// with.
+type mockTrialIssuer struct {
+	caveats []lsat.Caveat
+}
+
+// MintTrialLSAT mints a new trial LSAT with a trial identifier.
+func (m *mockTrialIssuer) MintTrialLSAT(ctx context.Context,
+	_ ...lsat.Service) (*macaroon.Macaroon, lntypes.Preimage, error) {
+
+	m.caveats, _ = lsat.FromContext(
+		ctx, lsat.KeyBindingCaveats,
+	).([]lsat.Caveat)
+
+	var tokenID lsat.TokenID
+	if _, err := rand.Read(tokenID[:]); err != nil {
+		return nil, lntypes.Preimage{}, err
+	}
+	preimage := lsat.TrialPreimage(tokenID)
+
+	var id bytes.Buffer
+	err := lsat.EncodeIdentifier(&id, &lsat.Identifier{
+		Version:     lsat.LatestVersion,
+		PaymentHash: preimage.Hash(),
+		TokenID:     tokenID,
+	})
+	if err != nil {
+		return nil, lntypes.Preimage{}, err
+	}
+	mac, err := macaroon.New(
+		make([]byte, 32), id.Bytes(), "lsat", macaroon.LatestVersion,
+	)
+	if err != nil {
+		return nil, lntypes.Preimage{}, err
+	}
+
+	return mac, preimage, nil
+}
+
+// TestTrialTokens tests that clients of a service with the trial auth level get
+// a restricted trial token on their first request, are asked to pay once they
+// used it up and can't exceed its rate.
+func TestTrialTokens(t *testing.T) {
+	service := testHandlerService(
+		"trial", "", func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		},
+	)
+	service.Auth = "trial"
+	service.Trial = proxy.TrialConfig{Rate: 2}
+
+	p, err := proxy.New(auth.NewMockAuthenticator(), []*proxy.Service{
+		service,
+	})
+	require.NoError(t, err)
+
+	send := func(method, remoteAddr,
+		token string) *httptest.ResponseRecorder {
+
+		return serveTestRequest(
+			p, method, "/x", token, nil,
+			withTestRemoteAddr(remoteAddr),
+		)
+	}
+
+	// Without a trial issuer, clients are asked to pay right away.
+	rec := send("GET", "192.0.2.1:1234", "")
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+
+	// The first request of a client gets a trial token restricted to the
+	// configured methods.
+	issuer := &mockTrialIssuer{}
+	p.SetTrialIssuer(issuer)
+	rec = send("GET", "192.0.2.1:1234", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	token := rec.Header().Get(proxy.HeaderTrialToken)
+	require.Contains(t, token, "LSAT ")
+
+	conditions := make(map[string]string, len(issuer.caveats))
+	for _, caveat := range issuer.caveats {
+		conditions[caveat.Condition] = caveat.Value
+	}
+	require.Equal(t, "GET,HEAD", conditions["trial_methods"])
+	require.Contains(t, conditions, "trial_valid_until")
+
+	// The client only gets a single trial token.
+	rec = send("GET", "192.0.2.1:1234", "")
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	require.Empty(t, rec.Header().Get(proxy.HeaderTrialToken))
+
+	// The token can make two requests per minute, one of which was the
+	// request it was issued with.
+	rec = send("GET", "192.0.2.1:1234", token)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = send("GET", "192.0.2.1:1234", token)
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+
+	// Other clients don't get a trial token for methods it can't be used
+	// with.
+	rec = send("POST", "198.51.100.1:1234", "")
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+
+	// Invalid trial options are rejected.
+	err = p.UpdateServices([]*proxy.Service{{
+		Name:       "invalid",
+		HostRegexp: testHostRegexp,
+		Auth:       "trial",
+		Trial: proxy.TrialConfig{
+			Rate: -1,
+		},
+	}})
+	require.Error(t, err)
+}
@@ -0,0 +1,434 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
+)
+
+const (
+	// upgradePathPrefix is the prefix of the tier upgrade endpoints.
+	// Upgrades of the tokens of a service are requested at the prefix
+	// followed by the service name and claimed at that path followed by
+	// the hex encoded payment hash of the upgrade invoice.
+	upgradePathPrefix = "/.aperture/upgrade/"
+)
+
+// TierConfig holds the options of a tier of a service above the base tier.
+// The tiers of a service are numbered from 1 in the order they're configured.
+type TierConfig struct {
+	// Capabilities is the list of capabilities authorized for the service
+	// at the tier.
+	Capabilities string `long:"capabilities" description:"A comma-separated list of the service capabilities authorized for the tier"`
+
+	// Constraints is the set of constraints that will take form of caveats
+	// for the service at the tier.
+	Constraints map[string]string `long:"constraints" description:"The service constraints to enforce at the tier"`
+
+	// Price is the full price in satoshis of a token of the tier. Tokens
+	// of a lower tier are upgraded by paying the difference.
+	Price int64 `long:"price" description:"The full price in satoshis of a token of the tier"`
+}
+
+// validateTiers checks that each tier of a service costs more than the one
+// below it.
+func validateTiers(basePrice int64, tiers []*TierConfig) error {
+	if len(tiers) > 255 {
+		return fmt.Errorf("too many tiers")
+	}
+
+	price := basePrice
+	for i, tier := range tiers {
+		if tier.Price <= price {
+			return fmt.Errorf("tier %d must cost more than the "+
+				"tier below it", i+1)
+		}
+		price = tier.Price
+	}
+
+	return nil
+}
+
+// tierPrice returns the full price of a token of the given tier of the
+// service, or false if there is no such tier.
+func (s *Service) tierPrice(tier lsat.ServiceTier) (int64, bool) {
+	switch {
+	case tier == lsat.BaseTier:
+		return s.Price, true
+
+	case int(tier) > len(s.Tiers):
+		return 0, false
+
+	default:
+		return s.Tiers[tier-1].Price, true
+	}
+}
+
+// TokenIssuer is an entity that re-issues tokens, like the mint.
+type TokenIssuer interface {
+	// IssueLSAT mints a new LSAT for the target services that is paid for
+	// with the invoice of the given payment hash.
+	IssueLSAT(context.Context, lntypes.Hash,
+		...lsat.Service) (*macaroon.Macaroon, error)
+
+	// RevokeLSAT revokes the LSAT, so it can't be used anymore.
+	RevokeLSAT(context.Context, *macaroon.Macaroon) error
+}
+
+// UpgradeStore is an entity that keeps track of the pending tier upgrades of
+// tokens.
+type UpgradeStore interface {
+	// AddUpgrade records a pending upgrade of the token to the given tier
+	// once the invoice with the given payment hash is paid.
+	AddUpgrade(context.Context, lntypes.Hash, lsat.TokenID,
+		lsat.ServiceTier) error
+
+	// ClaimUpgrade atomically removes the pending upgrade of the invoice
+	// with the given payment hash, which must be one of the given token.
+	// The tier of the upgrade is returned, or false if there is no such
+	// pending upgrade.
+	ClaimUpgrade(context.Context, lntypes.Hash, lsat.TokenID) (
+		lsat.ServiceTier, bool, error)
+}
+
+// upgrade is a pending tier upgrade of a token.
+type upgrade struct {
+	tokenID lsat.TokenID
+	tier    lsat.ServiceTier
+}
+
+// memUpgradeStore is an UpgradeStore that keeps the upgrades in memory.
+type memUpgradeStore struct {
+	sync.Mutex
+	pending map[lntypes.Hash]upgrade
+}
+
+// A compile-time constraint to ensure memUpgradeStore implements
+// UpgradeStore.
+var _ UpgradeStore = (*memUpgradeStore)(nil)
+
+// newMemUpgradeStore creates a new, empty in-memory upgrade store.
+func newMemUpgradeStore() *memUpgradeStore {
+	return &memUpgradeStore{
+		pending: make(map[lntypes.Hash]upgrade),
+	}
+}
+
+// AddUpgrade records a pending upgrade of the token.
+//
+// NOTE: This is part of the UpgradeStore interface.
+func (s *memUpgradeStore) AddUpgrade(_ context.Context, hash lntypes.Hash,
+	tokenID lsat.TokenID, tier lsat.ServiceTier) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.pending[hash] = upgrade{tokenID: tokenID, tier: tier}
+	return nil
+}
+
+// ClaimUpgrade removes the pending upgrade of the token.
+//
+// NOTE: This is part of the UpgradeStore interface.
+func (s *memUpgradeStore) ClaimUpgrade(_ context.Context, hash lntypes.Hash,
+	tokenID lsat.TokenID) (lsat.ServiceTier, bool, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	pending, ok := s.pending[hash]
+	if !ok || pending.tokenID != tokenID {
+		return 0, false, nil
+	}
+
+	delete(s.pending, hash)
+	return pending.tier, true, nil
+}
+
+// SetUpgradeStore sets the store the pending tier upgrades of tokens are kept
+// in. By default, they are kept in memory.
+func (p *Proxy) SetUpgradeStore(store UpgradeStore) {
+	p.upgradeStore = store
+}
+
+// SetUpgradeChallenger sets the challenger the invoices of tier upgrades are
+// created with. Setting it together with a token issuer enables upgrades for
+// the services with tiers, which also requires a preimage fetcher to check
+// their payment.
+func (p *Proxy) SetUpgradeChallenger(challenger mint.Challenger) {
+	p.upgradeChallenger = challenger
+}
+
+// SetTokenIssuer sets the entity upgraded tokens are issued with.
+func (p *Proxy) SetTokenIssuer(issuer TokenIssuer) {
+	p.tokenIssuer = issuer
+}
+
+// upgradeRequest is the JSON body of a request for a tier upgrade.
+type upgradeRequest struct {
+	Tier lsat.ServiceTier `json:"tier"`
+}
+
+// upgradeResponse is the JSON body of the responses of the upgrade endpoints.
+type upgradeResponse struct {
+	Tier          lsat.ServiceTier `json:"tier"`
+	Price         int64            `json:"price,omitempty"`
+	Invoice       string           `json:"invoice,omitempty"`
+	PaymentHash   string           `json:"payment_hash"`
+	Authorization string           `json:"authorization,omitempty"`
+}
+
+// isUpgradeRequest returns true if the request is addressed to one of the
+// upgrade endpoints.
+func isUpgradeRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, upgradePathPrefix)
+}
+
+// handleUpgrade creates the invoice of the upgrade of the token the request is
+// made with to a higher tier, which costs the difference of the prices of the
+// tiers, or re-issues the token at the higher tier once the invoice is paid.
+// Caveats can't be widened, so the upgraded token replaces the old one, which
+// is revoked.
+func (p *Proxy) handleUpgrade(w http.ResponseWriter, r *http.Request,
+	remoteIP net.IP, prefixLog *PrefixLog) {
+
+	if r.Method != http.MethodPost {
+		sendDirectResponse(
+			w, r, http.StatusMethodNotAllowed, "method not allowed",
+		)
+		return
+	}
+
+	parts := strings.Split(
+		strings.TrimPrefix(r.URL.Path, upgradePathPrefix), "/",
+	)
+	target, ok := p.serviceByName(parts[0])
+	if !ok || len(parts) > 2 || len(target.Tiers) == 0 ||
+		p.upgradeChallenger == nil || p.tokenIssuer == nil ||
+		p.preimageFetcher == nil {
+
+		sendDirectResponse(w, r, http.StatusNotFound, "not found")
+		return
+	}
+
+	// Only the holder of a valid token can upgrade it.
+	r = withClientBinding(r, remoteIP)
+	r = withGracePeriod(r, target)
+	if !p.accept(r, target.Name) {
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "invalid token",
+		)
+		return
+	}
+	mac, _, err := lsat.FromHeader(&r.Header)
+	if err != nil {
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "invalid token",
+		)
+		return
+	}
+	tokenID, err := tokenIDFromHeader(r.Header)
+	if err != nil {
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "invalid token",
+		)
+		return
+	}
+
+	if len(parts) == 2 {
+		p.claimUpgrade(w, r, target, mac, tokenID, parts[1], prefixLog)
+		return
+	}
+
+	var req upgradeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendDirectResponse(
+			w, r, http.StatusBadRequest, "invalid upgrade request",
+		)
+		return
+	}
+	price, ok := target.tierPrice(req.Tier)
+	if !ok {
+		sendDirectResponse(w, r, http.StatusBadRequest, "unknown tier")
+		return
+	}
+	current := tokenTier(mac, target.Name)
+	currentPrice, _ := target.tierPrice(current)
+	if req.Tier <= current || price <= currentPrice {
+		sendDirectResponse(
+			w, r, http.StatusBadRequest, "not a higher tier",
+		)
+		return
+	}
+
+	difference := price - currentPrice
+	invoice, hash, err := p.upgradeChallenger.NewChallenge(difference)
+	switch {
+	case err == mint.ErrChallengerBusy:
+		sendBusyResponse(w, r)
+		return
+
+	case err != nil:
+		prefixLog.Errorf("Error creating upgrade invoice: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "upgrade failure",
+		)
+		return
+	}
+
+	err = p.upgradeStore.AddUpgrade(r.Context(), hash, tokenID, req.Tier)
+	if err != nil {
+		prefixLog.Errorf("Error storing upgrade: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "upgrade failure",
+		)
+		return
+	}
+
+	prefixLog.Infof("Created upgrade of token %v to tier %d for %d sats.",
+		tokenID, req.Tier, difference)
+	writeUpgradeResponse(w, &upgradeResponse{
+		Tier:        req.Tier,
+		Price:       difference,
+		Invoice:     invoice,
+		PaymentHash: hash.String(),
+	})
+}
+
+// claimUpgrade re-issues the token at the tier of the paid upgrade with the
+// given payment hash and revokes the old token. An upgrade can only be claimed
+// once.
+func (p *Proxy) claimUpgrade(w http.ResponseWriter, r *http.Request,
+	target *Service, mac *macaroon.Macaroon, tokenID lsat.TokenID,
+	hashStr string, prefixLog *PrefixLog) {
+
+	hash, err := lntypes.MakeHashFromStr(hashStr)
+	if err != nil {
+		sendDirectResponse(
+			w, r, http.StatusBadRequest, "invalid payment hash",
+		)
+		return
+	}
+
+	preimage, err := p.preimageFetcher.FetchPreimage(r.Context(), hash)
+	switch {
+	case err == auth.ErrInvoiceNotSettled:
+		sendDirectResponse(
+			w, r, http.StatusPaymentRequired, "upgrade not paid",
+		)
+		return
+
+	case err == mint.ErrChallengerBusy:
+		sendBusyResponse(w, r)
+		return
+
+	case err != nil:
+		prefixLog.Errorf("Error fetching upgrade status: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "upgrade failure",
+		)
+		return
+	}
+
+	ctx := withMetadata(r, target).Context()
+	tier, ok, err := p.upgradeStore.ClaimUpgrade(ctx, hash, tokenID)
+	if err != nil {
+		prefixLog.Errorf("Error claiming upgrade: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "upgrade failure",
+		)
+		return
+	}
+	if !ok {
+		sendDirectResponse(w, r, http.StatusNotFound, "unknown upgrade")
+		return
+	}
+
+	// If the upgraded token can't be issued, the upgrade is restored so
+	// the claim can be retried.
+	price, _ := target.tierPrice(tier)
+	upgraded, err := p.tokenIssuer.IssueLSAT(ctx, hash, lsat.Service{
+		Name:  target.Name,
+		Tier:  tier,
+		Price: price,
+	})
+	if err != nil {
+		prefixLog.Errorf("Error issuing upgraded token: %v", err)
+		err := p.upgradeStore.AddUpgrade(ctx, hash, tokenID, tier)
+		if err != nil {
+			prefixLog.Errorf("Error restoring upgrade %v: %v", hash,
+				err)
+		}
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "upgrade failure",
+		)
+		return
+	}
+
+	if err := p.tokenIssuer.RevokeLSAT(ctx, mac); err != nil {
+		prefixLog.Errorf("Error revoking upgraded token %v: %v",
+			tokenID, err)
+	}
+
+	macBytes, err := upgraded.MarshalBinary()
+	if err != nil {
+		prefixLog.Errorf("Error serializing upgraded token: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "upgrade failure",
+		)
+		return
+	}
+
+	prefixLog.Infof("Upgraded token %v to tier %d.", tokenID, tier)
+	writeUpgradeResponse(w, &upgradeResponse{
+		Tier:        tier,
+		PaymentHash: hash.String(),
+		Authorization: fmt.Sprintf(
+			"LSAT %s:%s", base64.StdEncoding.EncodeToString(
+				macBytes,
+			), preimage.String(),
+		),
+	})
+}
+
+// tokenTier returns the tier of the given service the token was issued for.
+func tokenTier(mac *macaroon.Macaroon, serviceName string) lsat.ServiceTier {
+	value, ok := lsat.HasCaveat(mac, lsat.CondServices)
+	if !ok {
+		return lsat.BaseTier
+	}
+	services, err := lsat.DecodeServicesCaveat(lsat.Caveat{
+		Condition: lsat.CondServices,
+		Value:     value,
+	})
+	if err != nil {
+		return lsat.BaseTier
+	}
+	for _, service := range services {
+		if service.Name == serviceName {
+			return service.Tier
+		}
+	}
+
+	return lsat.BaseTier
+}
+
+// writeUpgradeResponse writes the JSON body of an upgrade endpoint.
+func writeUpgradeResponse(w http.ResponseWriter, response *upgradeResponse) {
+	addCorsHeaders(w.Header())
+	w.Header().Set(hdrContentType, hdrTypeJSON)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("Error sending upgrade response: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+// mockUpgradeChallenger creates invoices with a fixed payment hash and
+// remembers their price.
+type mockUpgradeChallenger struct {
+	hash  lntypes.Hash
+	price int64
+}
+
+// NewChallenge returns an invoice with the fixed payment hash.
+func (m *mockUpgradeChallenger) NewChallenge(price int64) (string,
+	lntypes.Hash, error) {
+
+	m.price = price
+	return "lnbc1upgrade", m.hash, nil
+}
+
+// mockTokenIssuer issues tokens for the services they were requested for and
+// remembers the revoked ones.
+type mockTokenIssuer struct {
+	revoked []*macaroon.Macaroon
+}
+
+// IssueLSAT mints a token carrying a services caveat.
+func (m *mockTokenIssuer) IssueLSAT(_ context.Context, hash lntypes.Hash,
+	services ...lsat.Service) (*macaroon.Macaroon, error) {
+
+	mac, err := macaroon.New(
+		[]byte("secret"), hash[:], "lsat", macaroon.LatestVersion,
+	)
+	if err != nil {
+		return nil, err
+	}
+	caveat, err := lsat.NewServicesCaveat(services...)
+	if err != nil {
+		return nil, err
+	}
+	return mac, lsat.AddFirstPartyCaveats(mac, caveat)
+}
+
+// RevokeLSAT remembers the revoked token.
+func (m *mockTokenIssuer) RevokeLSAT(_ context.Context,
+	mac *macaroon.Macaroon) error {
+
+	m.revoked = append(m.revoked, mac)
+	return nil
+}
+
+// TestTierUpgrade makes sure a token can be upgraded to a higher tier for the
+// difference of the prices once, after the upgrade was paid.
+func TestTierUpgrade(t *testing.T) {
+	preimage := lntypes.Preimage{1, 2, 3}
+	_, macBase64 := newPaywallMacaroon(t, preimage.Hash())
+
+	services := []*Service{{
+		Name:       "oracle",
+		HostRegexp: ".*",
+		Auth:       "on",
+		Price:      100,
+		Tiers: []*TierConfig{
+			{Capabilities: "read,write", Price: 250},
+		},
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	upgradePreimage := lntypes.Preimage{4, 5, 6}
+	challenger := &mockUpgradeChallenger{hash: upgradePreimage.Hash()}
+	issuer := &mockTokenIssuer{}
+	fetcher := &mockPreimageFetcher{
+		preimages: make(map[lntypes.Hash]lntypes.Preimage),
+	}
+	p.SetUpgradeChallenger(challenger)
+	p.SetTokenIssuer(issuer)
+	p.SetPreimageFetcher(fetcher)
+
+	authHeader := "LSAT " + macBase64 + ":" + preimage.String()
+	serve := func(path, body string) *httptest.ResponseRecorder {
+		return serveTestRequest(
+			p, http.MethodPost, "/.aperture/upgrade/oracle"+path,
+			authHeader, strings.NewReader(body),
+		)
+	}
+
+	// There is no tier above the first one.
+	require.Equal(t, http.StatusBadRequest, serve("", `{"tier": 2}`).Code)
+
+	rec := serve("", `{"tier": 1}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.EqualValues(t, 150, challenger.price)
+
+	var resp upgradeResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	claimPath := "/" + resp.PaymentHash
+
+	// The upgrade can only be claimed once it's paid.
+	rec = serve(claimPath, "")
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+
+	fetcher.preimages[upgradePreimage.Hash()] = upgradePreimage
+	rec = serve(claimPath, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Equal(t, lsat.ServiceTier(1), resp.Tier)
+	require.True(t, strings.HasSuffix(
+		resp.Authorization, ":"+upgradePreimage.String(),
+	))
+	require.Len(t, issuer.revoked, 1)
+
+	header := http.Header{}
+	header.Set("Authorization", resp.Authorization)
+	upgraded, _, err := lsat.FromHeader(&header)
+	require.NoError(t, err)
+	require.Equal(t, lsat.ServiceTier(1), tokenTier(upgraded, "oracle"))
+
+	// The upgrade can't be claimed again.
+	require.Equal(t, http.StatusNotFound, serve(claimPath, "").Code)
+}
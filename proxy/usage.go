@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// usagePathPrefix is the prefix of the usage endpoint. The usage of a
+	// token is queried at the prefix followed by the name of the service
+	// the token was issued for.
+	usagePathPrefix = "/.aperture/usage/"
+)
+
+// UsageConfig holds the options to let clients query the usage of their own
+// tokens.
+type UsageConfig struct {
+	// Enabled can be set to count the requests made with each token of
+	// the service and let its holder query them together with the
+	// remaining balance, quota and expiry of the token.
+	Enabled bool `long:"enabled" description:"Count the requests of each token and let clients query the usage of their tokens"`
+}
+
+// UsageStore is an entity that keeps track of the number of requests that were
+// made with each token.
+type UsageStore interface {
+	// Requests returns the number of requests that were made with the
+	// token so far.
+	Requests(context.Context, lsat.TokenID) (uint64, error)
+
+	// AddRequest records a request that was made with the token.
+	AddRequest(context.Context, lsat.TokenID) error
+}
+
+// memUsageStore is a UsageStore that keeps the number of requests in memory.
+type memUsageStore struct {
+	sync.Mutex
+	requests map[lsat.TokenID]uint64
+}
+
+// A compile-time constraint to ensure memUsageStore implements UsageStore.
+var _ UsageStore = (*memUsageStore)(nil)
+
+// newMemUsageStore creates a new, empty in-memory usage store.
+func newMemUsageStore() *memUsageStore {
+	return &memUsageStore{
+		requests: make(map[lsat.TokenID]uint64),
+	}
+}
+
+// Requests returns the number of requests that were made with the token so
+// far.
+//
+// NOTE: This is part of the UsageStore interface.
+func (s *memUsageStore) Requests(_ context.Context,
+	tokenID lsat.TokenID) (uint64, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.requests[tokenID], nil
+}
+
+// AddRequest records a request that was made with the token.
+//
+// NOTE: This is part of the UsageStore interface.
+func (s *memUsageStore) AddRequest(_ context.Context,
+	tokenID lsat.TokenID) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.requests[tokenID]++
+	return nil
+}
+
+// SetUsageStore sets the store the requests made with each token are counted
+// in for the services with usage reporting. By default, they are kept in
+// memory.
+func (p *Proxy) SetUsageStore(store UsageStore) {
+	p.usageStore = store
+}
+
+// countRequest records a request that was made with a token. Failing to count
+// it doesn't fail the request.
+func (p *Proxy) countRequest(r *http.Request, prefixLog *PrefixLog) {
+	tokenID, err := tokenIDFromHeader(r.Header)
+	if err != nil {
+		prefixLog.Errorf("Error reading token for usage: %v", err)
+		return
+	}
+
+	p.countTokenRequest(r.Context(), tokenID, prefixLog)
+}
+
+// countTokenRequest counts a request made with the token of the given ID.
+func (p *Proxy) countTokenRequest(ctx context.Context, tokenID lsat.TokenID,
+	prefixLog *PrefixLog) {
+
+	if err := p.usageStore.AddRequest(ctx, tokenID); err != nil {
+		prefixLog.Errorf("Error counting request: %v", err)
+	}
+}
+
+// usageResponse is the JSON body of the response of the usage endpoint.
+type usageResponse struct {
+	Service  string         `json:"service"`
+	TokenID  string         `json:"token_id"`
+	Requests uint64         `json:"requests"`
+	Messages *messagesUsage `json:"messages,omitempty"`
+	Quota    *quotaUsage    `json:"quota,omitempty"`
+	Expiry   *time.Time     `json:"expiry,omitempty"`
+}
+
+// messagesUsage is the message balance of a token of a service that is billed
+// per message.
+type messagesUsage struct {
+	Balance   uint64 `json:"balance"`
+	Spent     uint64 `json:"spent"`
+	Remaining uint64 `json:"remaining"`
+}
+
+// quotaUsage is the transfer quota of a token of a service with a quota.
+type quotaUsage struct {
+	Bytes       uint64 `json:"bytes"`
+	Transferred uint64 `json:"transferred"`
+	Remaining   uint64 `json:"remaining"`
+}
+
+// isUsageRequest returns true if the request is addressed to the usage
+// endpoint.
+func isUsageRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, usagePathPrefix)
+}
+
+// handleUsage sends the usage of the token the request is made with to its
+// holder, so clients can check how much of what they paid for is left without
+// asking the operator of the service.
+func (p *Proxy) handleUsage(w http.ResponseWriter, r *http.Request,
+	remoteIP net.IP, prefixLog *PrefixLog) {
+
+	if r.Method != http.MethodGet {
+		sendDirectResponse(
+			w, r, http.StatusMethodNotAllowed, "method not allowed",
+		)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, usagePathPrefix)
+	target, ok := p.serviceByName(name)
+	if !ok || !target.Usage.Enabled {
+		sendDirectResponse(w, r, http.StatusNotFound, "not found")
+		return
+	}
+
+	// Only the holder of a valid token may see its usage.
+	r = withClientBinding(r, remoteIP)
+	r = withGracePeriod(r, target)
+	if !p.accept(r, target.Name) {
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "invalid token",
+		)
+		return
+	}
+	mac, _, err := lsat.FromHeader(&r.Header)
+	if err != nil {
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "invalid token",
+		)
+		return
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "invalid token",
+		)
+		return
+	}
+
+	ctx := r.Context()
+	response := &usageResponse{
+		Service: target.Name,
+		TokenID: id.TokenID.String(),
+	}
+	sendFailure := func(what string, err error) {
+		prefixLog.Errorf("Error querying %s for usage: %v", what, err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "usage failure",
+		)
+	}
+
+	response.Requests, err = p.usageStore.Requests(ctx, id.TokenID)
+	if err != nil {
+		sendFailure("requests", err)
+		return
+	}
+
+	if target.Billing.PerMessage {
+		balance, err := tokenMessages(mac, target)
+		if err != nil {
+			sendDirectResponse(
+				w, r, http.StatusUnauthorized, "invalid token",
+			)
+			return
+		}
+		if target.Billing.TopUp {
+			credited, err := p.topUpStore.Credited(ctx, id.TokenID)
+			if err != nil {
+				sendFailure("top-ups", err)
+				return
+			}
+			balance += credited
+		}
+		spent, err := p.balanceStore.Spent(ctx, id.TokenID)
+		if err != nil {
+			sendFailure("message balance", err)
+			return
+		}
+
+		response.Messages = &messagesUsage{
+			Balance:   balance,
+			Spent:     spent,
+			Remaining: remaining(balance, spent),
+		}
+	}
+
+	if target.Quota.Bytes > 0 {
+		transferred, err := p.transferStore.Transferred(ctx, id.TokenID)
+		if err != nil {
+			sendFailure("transferred bytes", err)
+			return
+		}
+
+		response.Quota = &quotaUsage{
+			Bytes:       target.Quota.Bytes,
+			Transferred: transferred,
+			Remaining:   remaining(target.Quota.Bytes, transferred),
+		}
+	}
+
+	if expiry, ok := lsat.ValidUntil(mac, target.Name); ok {
+		response.Expiry = &expiry
+	}
+
+	addCorsHeaders(w.Header())
+	w.Header().Set(hdrContentType, hdrTypeJSON)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		prefixLog.Errorf("Error sending usage response: %v", err)
+	}
+}
+
+// remaining returns how much of the given total is left after the given amount
+// was used.
+func remaining(total, used uint64) uint64 {
+	if used >= total {
+		return 0
+	}
+
+	return total - used
+}
@@ -0,0 +1,76 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestUsage tests that the holder of a token can query the requests made with
+// it and its remaining transfer quota.
+func TestUsage(t *testing.T) {
+	service := testHandlerService(
+		"usage-service", "^/usage/.*$",
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("0123456789"))
+		},
+	)
+	service.Quota = proxy.QuotaConfig{Bytes: 100}
+	service.Usage = proxy.UsageConfig{Enabled: true}
+	p, err := proxy.New(auth.NewMockAuthenticator(), []*proxy.Service{
+		service,
+	})
+	require.NoError(t, err)
+	tokenID := lsat.TokenID{1}
+	authHeader := testAuthHeader(t, tokenID)
+
+	for i := 0; i < 3; i++ {
+		rec := serveTestRequest(p, "GET", "/usage/x", authHeader, nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	// The usage is only reported to the holder of a token and only for
+	// services that enable it.
+	rec := serveTestRequest(
+		p, "GET", "/.aperture/usage/usage-service", "", nil,
+	)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = serveTestRequest(
+		p, "GET", "/.aperture/usage/unknown", authHeader, nil,
+	)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	rec = serveTestRequest(
+		p, "POST", "/.aperture/usage/usage-service", authHeader, nil,
+	)
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	rec = serveTestRequest(
+		p, "GET", "/.aperture/usage/usage-service", authHeader, nil,
+	)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var usage struct {
+		Service  string          `json:"service"`
+		TokenID  string          `json:"token_id"`
+		Requests uint64          `json:"requests"`
+		Messages json.RawMessage `json:"messages"`
+		Quota    struct {
+			Bytes       uint64 `json:"bytes"`
+			Transferred uint64 `json:"transferred"`
+			Remaining   uint64 `json:"remaining"`
+		} `json:"quota"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &usage))
+	require.Equal(t, "usage-service", usage.Service)
+	require.Equal(t, tokenID.String(), usage.TokenID)
+	require.EqualValues(t, 3, usage.Requests)
+	require.Nil(t, usage.Messages)
+	require.EqualValues(t, 100, usage.Quota.Bytes)
+	require.EqualValues(t, 30, usage.Quota.Transferred)
+	require.EqualValues(t, 70, usage.Quota.Remaining)
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// HeaderOriginalURI is the header field an application server uses to
+	// tell the validator which request URI its client originally asked
+	// for. The URI is matched against the configured services to find out
+	// which service and price apply.
+	HeaderOriginalURI = "X-Original-Uri"
+
+	// HeaderOriginalMethod is the header field an application server uses
+	// to tell the validator which HTTP method its client originally used.
+	HeaderOriginalMethod = "X-Original-Method"
+
+	// HeaderOriginalHost is the header field an application server uses
+	// to tell the validator which host its client originally asked for.
+	HeaderOriginalHost = "X-Forwarded-Host"
+
+	// HeaderRealIP is the header field an application server uses to tell
+	// the validator the IP address of its client. This is used for the
+	// freebie count.
+	HeaderRealIP = "X-Real-Ip"
+
+	// HeaderServiceName is the header field the validator sets on a
+	// successful verification to tell the application server which
+	// service the request was matched to.
+	HeaderServiceName = "X-Aperture-Service"
+
+	// HeaderTokenID is the header field the validator sets on a successful
+	// verification to tell the application server the ID of the token
+	// that was presented by the client, if there was one.
+	HeaderTokenID = "X-Aperture-Token-Id"
+)
+
+// ServeValidation is a HTTP handler that only validates the LSAT of a request
+// instead of proxying it to a backend service. It is meant to be called by an
+// application server that is colocated with aperture and forwards the
+// authentication headers of its own client request. The original request URI,
+// method and host are read from the X-Original-Uri, X-Original-Method and
+// X-Forwarded-Host header fields. If the request is allowed to pass, an empty
+// 200 response is returned that contains the name of the matched service and
+// the token ID as additional header fields the application server can use to
+// enrich its own request. Otherwise the same challenge response as the proxy
+// would send is returned, which the application server can relay to its
+// client.
+func (p *Proxy) ServeValidation(w http.ResponseWriter, r *http.Request) {
+	// The application server needs a status other than 200 to reject the
+	// request, so the response is always a plain HTTP one, even if its
+	// client speaks gRPC.
+	r.Header.Del(hdrContentType)
+
+	// The validator is only supposed to be reachable by the colocated
+	// application server, so we trust it to tell us the IP address of its
+	// client. If trusted proxies are configured, the application server
+	// must be one of them instead.
+	remoteAddr := r.RemoteAddr
+	realIP := r.Header.Get(HeaderRealIP)
+	switch {
+	case p.clientIPResolver != nil:
+		remoteAddr = p.clientIPResolver.RemoteAddr(r)
+
+	case realIP != "":
+		remoteAddr = realIP + ":0"
+	}
+	remoteIP, prefixLog := NewRemoteIPPrefixLog(log, remoteAddr)
+
+	origReq, err := originalRequest(r)
+	if err != nil {
+		prefixLog.Errorf("Invalid validation request: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusBadRequest, "invalid original URI",
+		)
+		return
+	}
+
+	prefixLog.Infof(formatPattern, origReq.Method, origReq.RequestURI,
+		origReq.Proto, origReq.Referer(), origReq.UserAgent())
+
+	target, ok := matchService(origReq, p.currentServices())
+	if !ok {
+		sendDirectResponse(
+			w, r, http.StatusNotFound, "no matching service",
+		)
+		return
+	}
+
+	if maintenance := p.maintenance(target); maintenance.Enabled {
+		sendMaintenanceResponse(w, r, maintenance)
+		return
+	}
+
+	authReq, ok := p.authorize(w, origReq, target, remoteIP, prefixLog)
+	if !ok {
+		return
+	}
+
+	// The request is allowed to pass, let the application server know
+	// what service it was matched to and which token was used, if any.
+	w.Header().Set(HeaderServiceName, target.Name)
+	if tokenID, ok := requestTokenID(authReq); ok {
+		w.Header().Set(HeaderTokenID, tokenID.String())
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// requestTokenID returns the ID of the token an authorized request was made
+// with. Requests made with a signed URL carry the ID of the token the URL was
+// issued for instead of a token.
+func requestTokenID(r *http.Request) (lsat.TokenID, bool) {
+	tokenID, ok := lsat.FromContext(
+		r.Context(), lsat.KeyTokenID,
+	).(lsat.TokenID)
+	if ok {
+		return tokenID, true
+	}
+
+	mac, _, err := lsat.FromHeader(&r.Header)
+	if err != nil {
+		return lsat.TokenID{}, false
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return lsat.TokenID{}, false
+	}
+
+	return id.TokenID, true
+}
+
+// originalRequest reconstructs the request the application server received
+// from its client from the header fields of the validation request.
+func originalRequest(r *http.Request) (*http.Request, error) {
+	origReq := r.Clone(r.Context())
+
+	if uri := r.Header.Get(HeaderOriginalURI); uri != "" {
+		origURL, err := url.ParseRequestURI(uri)
+		if err != nil {
+			return nil, err
+		}
+		origReq.URL.Path = origURL.Path
+		origReq.URL.RawPath = origURL.RawPath
+		origReq.URL.RawQuery = origURL.RawQuery
+		origReq.RequestURI = uri
+	}
+
+	if method := r.Header.Get(HeaderOriginalMethod); method != "" {
+		origReq.Method = method
+	}
+
+	if host := r.Header.Get(HeaderOriginalHost); host != "" {
+		origReq.Host = host
+	}
+
+	return origReq, nil
+}
@@ -0,0 +1,68 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestServeValidation tests that the validation-only handler matches the
+// original request to a service and either returns a challenge or lets the
+// request pass without proxying it.
+func TestServeValidation(t *testing.T) {
+	services := []*proxy.Service{{
+		Name:       "test-service",
+		Address:    testTargetServiceAddress,
+		HostRegexp: "^app.example.com$",
+		PathRegexp: testPathRegexpHTTP,
+		Protocol:   "http",
+		Auth:       "on",
+	}}
+
+	mockAuth := auth.NewMockAuthenticator()
+	p, err := proxy.New(mockAuth, services)
+	require.NoError(t, err)
+
+	newReq := func(uri string) *http.Request {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.Header.Set(proxy.HeaderOriginalURI, uri)
+		req.Header.Set(proxy.HeaderOriginalHost, "app.example.com")
+		return req
+	}
+
+	// A request for a path that isn't matched by any service should be
+	// rejected.
+	rec := httptest.NewRecorder()
+	p.ServeValidation(rec, newReq("/unknown"))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	// Without any authentication we expect the challenge to be returned.
+	rec = httptest.NewRecorder()
+	p.ServeValidation(rec, newReq("/http/test"))
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	require.Contains(t, rec.Header().Get("WWW-Authenticate"), "LSAT")
+
+	// The challenge of a gRPC client must be rejected with an HTTP status
+	// as well, otherwise the application server would let it pass.
+	req := newReq("/http/test")
+	req.Header.Set("Content-Type", "application/grpc")
+	rec = httptest.NewRecorder()
+	p.ServeValidation(rec, req)
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+
+	// With authentication the request should pass and the service name
+	// should be returned to the application server.
+	req = newReq("/http/test?foo=bar")
+	req.Header.Set("Authorization", "foobar")
+	rec = httptest.NewRecorder()
+	p.ServeValidation(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(
+		t, "test-service", rec.Header().Get(proxy.HeaderServiceName),
+	)
+	require.Empty(t, rec.Header().Get(proxy.HeaderTokenID))
+}
@@ -0,0 +1,324 @@
+package aperture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultProxyHeaderTimeout is the default maximum time to wait for
+	// the PROXY protocol header of a connection.
+	defaultProxyHeaderTimeout = 5 * time.Second
+
+	// proxyV1MaxLen is the maximum length of a version 1 header, including
+	// the CRLF at its end.
+	proxyV1MaxLen = 107
+
+	// proxyV2HeaderLen is the length of the fixed part of a version 2
+	// header.
+	proxyV2HeaderLen = 16
+
+	// PROXY protocol version 2 commands and address families the
+	// listener looks at.
+	proxyV2Version = 0x20
+	proxyV2Local   = 0x00
+	proxyV2Proxy   = 0x01
+	proxyV2TCP4    = 0x11
+	proxyV2TCP6    = 0x21
+)
+
+var (
+	// proxyV1Prefix is the start of a version 1 header.
+	proxyV1Prefix = []byte("PROXY ")
+
+	// proxyV2Signature is the start of a version 2 header.
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	// errNoProxyHeader is returned if a connection that must start with a
+	// PROXY protocol header doesn't.
+	errNoProxyHeader = errors.New("missing PROXY protocol header")
+)
+
+// parseNetworks parses the given list of networks in CIDR notation. Single IP
+// addresses are accepted as networks of their own.
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	parsed := make([]*net.IPNet, 0, len(networks))
+	for _, network := range networks {
+		if ip := net.ParseIP(network); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			parsed = append(parsed, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(bits, bits),
+			})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %v",
+				network, err)
+		}
+		parsed = append(parsed, ipNet)
+	}
+
+	return parsed, nil
+}
+
+// containsIP returns true if one of the networks contains the IP of the given
+// address. An empty list contains no addresses.
+func containsIP(networks []*net.IPNet, addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// proxyProtocolListener reads the PROXY protocol header load balancers send in
+// front of the connections they forward, so the address of the original
+// client is reported as the remote address of the connection.
+type proxyProtocolListener struct {
+	net.Listener
+
+	cfg     *ProxyProtocolConfig
+	trusted []*net.IPNet
+}
+
+// newProxyProtocolListener wraps the given listener to read the PROXY protocol
+// headers of its connections.
+func newProxyProtocolListener(listener net.Listener,
+	cfg *ProxyProtocolConfig) (*proxyProtocolListener, error) {
+
+	trusted, err := parseNetworks(cfg.TrustedSources)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyProtocolListener{
+		Listener: listener,
+		cfg:      cfg,
+		trusted:  trusted,
+	}, nil
+}
+
+// Accept waits for the next connection and wraps it. Only connections from
+// trusted sources may carry a header, others are passed on as they are. The
+// header is read once the connection is first used, so a slow client doesn't
+// hold up the others.
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !containsIP(l.trusted, conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	timeout := l.cfg.HeaderTimeout
+	if timeout == 0 {
+		timeout = defaultProxyHeaderTimeout
+	}
+
+	return &proxyProtocolConn{
+		Conn:     conn,
+		reader:   bufio.NewReaderSize(conn, 512),
+		timeout:  timeout,
+		required: l.cfg.Required,
+	}, nil
+}
+
+// proxyProtocolConn is a connection that may start with a PROXY protocol
+// header.
+type proxyProtocolConn struct {
+	net.Conn
+
+	reader   *bufio.Reader
+	timeout  time.Duration
+	required bool
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+// Read reads from the connection after its header.
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the address of the client the header was sent for, or
+// the address of the peer if there is none.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads the header of the connection. The connection is closed if
+// the header is invalid or missing although it's required.
+func (c *proxyProtocolConn) readHeader() {
+	_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	defer func() {
+		_ = c.Conn.SetReadDeadline(time.Time{})
+	}()
+
+	c.remoteAddr, c.err = readProxyHeader(c.reader, c.required)
+	if c.err != nil {
+		log.Debugf("Closing connection of %v: %v", c.Conn.RemoteAddr(),
+			c.err)
+		_ = c.Conn.Close()
+	}
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header and returns the
+// address of the client it was sent for. The address is nil if the header
+// doesn't tell it, for example for health checks of the load balancer, or if
+// there is no header and it isn't required.
+func readProxyHeader(r *bufio.Reader, required bool) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV1Prefix))
+	switch {
+	case err == nil && bytes.Equal(start, proxyV1Prefix):
+		return readProxyV1Header(r)
+
+	case err == nil && start[0] == proxyV2Signature[0]:
+		signature, err := r.Peek(len(proxyV2Signature))
+		if err == nil && bytes.Equal(signature, proxyV2Signature) {
+			return readProxyV2Header(r)
+		}
+	}
+
+	// Connections that are closed before they sent anything don't need a
+	// header.
+	if _, err := r.Peek(1); err == io.EOF {
+		return nil, nil
+	}
+	if required {
+		return nil, errNoProxyHeader
+	}
+
+	return nil, nil
+}
+
+// readProxyV1Header reads a header in the text format of version 1, like
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) <= proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read PROXY "+
+				"header: %v", err)
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if len(line) > proxyV1MaxLen {
+		return nil, fmt.Errorf("PROXY header too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("invalid PROXY header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid PROXY source %v:%v", fields[2],
+			fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2Header reads a header in the binary format of version 2. Its
+// type-length-value extensions are skipped.
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	var header [proxyV2HeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("unable to read PROXY header: %v", err)
+	}
+	if header[12]&0xf0 != proxyV2Version {
+		return nil, fmt.Errorf("unsupported PROXY version %x",
+			header[12]>>4)
+	}
+
+	length := binary.BigEndian.Uint16(header[14:])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("unable to read PROXY addresses: %v",
+			err)
+	}
+
+	// Connections of the load balancer itself, like health checks, don't
+	// have a client.
+	command := header[12] & 0x0f
+	if command == proxyV2Local {
+		return nil, nil
+	}
+	if command != proxyV2Proxy {
+		return nil, fmt.Errorf("unsupported PROXY command %x", command)
+	}
+
+	var ipLen int
+	switch header[13] {
+	case proxyV2TCP4:
+		ipLen = net.IPv4len
+
+	case proxyV2TCP6:
+		ipLen = net.IPv6len
+
+	// Other transports and address families don't tell an IP address.
+	default:
+		return nil, nil
+	}
+
+	if len(payload) < 2*ipLen+4 {
+		return nil, fmt.Errorf("PROXY addresses too short")
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, payload[:ipLen])
+	port := binary.BigEndian.Uint16(payload[2*ipLen:])
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
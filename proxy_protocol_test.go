@@ -0,0 +1,146 @@
+package aperture
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// proxyV2Header returns a version 2 header with the given command and source
+// address.
+func proxyV2Header(command byte, src *net.TCPAddr) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, proxyV2Version|command, proxyV2TCP4, 0, 12)
+	header = append(header, src.IP.To4()...)
+	header = append(header, 127, 0, 0, 1)
+	header = append(header, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-4:], uint16(src.Port))
+	binary.BigEndian.PutUint16(header[len(header)-2:], 443)
+	return header
+}
+
+// TestProxyProtocolListener tests that the client addresses of the PROXY
+// protocol headers of trusted sources are reported as the remote addresses of
+// their connections.
+func TestProxyProtocolListener(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	v6Client := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}
+	trusted := []string{"127.0.0.1"}
+
+	tests := []struct {
+		name       string
+		cfg        *ProxyProtocolConfig
+		data       string
+		remoteAddr *net.TCPAddr
+		body       string
+		closed     bool
+	}{{
+		name: "v1",
+		cfg:  &ProxyProtocolConfig{TrustedSources: trusted},
+		data: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n" +
+			"GET / HTTP/1.1\r\n",
+		remoteAddr: client,
+		body:       "GET / HTTP/1.1\r\n",
+	}, {
+		name: "v1 tcp6",
+		cfg:  &ProxyProtocolConfig{TrustedSources: trusted},
+		data: "PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n" +
+			"data",
+		remoteAddr: v6Client,
+		body:       "data",
+	}, {
+		name: "v2",
+		cfg:  &ProxyProtocolConfig{TrustedSources: trusted},
+		data: string(proxyV2Header(proxyV2Proxy, client)) +
+			"data",
+		remoteAddr: client,
+		body:       "data",
+	}, {
+		name: "v2 local",
+		cfg: &ProxyProtocolConfig{
+			Required:       true,
+			TrustedSources: trusted,
+		},
+		data: string(proxyV2Header(proxyV2Local, client)) + "data",
+		body: "data",
+	}, {
+		name: "no header",
+		cfg:  &ProxyProtocolConfig{TrustedSources: trusted},
+		data: "GET / HTTP/1.1\r\n",
+		body: "GET / HTTP/1.1\r\n",
+	}, {
+		name: "required header",
+		cfg: &ProxyProtocolConfig{
+			Required:       true,
+			TrustedSources: trusted,
+		},
+		data:   "GET / HTTP/1.1\r\n",
+		closed: true,
+	}, {
+		name:   "invalid header",
+		cfg:    &ProxyProtocolConfig{TrustedSources: trusted},
+		data:   "PROXY TCP4 192.0.2.1\r\ndata",
+		closed: true,
+	}, {
+		name: "untrusted source",
+		cfg: &ProxyProtocolConfig{
+			TrustedSources: []string{"10.0.0.0/8"},
+		},
+		data: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+		body: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+	}, {
+		name: "no trusted sources",
+		cfg:  &ProxyProtocolConfig{Required: true},
+		data: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+		body: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+	}}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			listener, err := newProxyProtocolListener(
+				tcpListener, test.cfg,
+			)
+			require.NoError(t, err)
+			defer listener.Close()
+
+			go func() {
+				conn, err := net.Dial(
+					"tcp", listener.Addr().String(),
+				)
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte(test.data))
+				_ = conn.Close()
+			}()
+
+			conn, err := listener.Accept()
+			require.NoError(t, err)
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			body, err := ioutil.ReadAll(conn)
+			if test.closed {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.body, string(body))
+
+			remoteAddr := conn.RemoteAddr().(*net.TCPAddr)
+			if test.remoteAddr == nil {
+				require.True(t, remoteAddr.IP.IsLoopback())
+				return
+			}
+			require.True(t, test.remoteAddr.IP.Equal(remoteAddr.IP))
+			require.Equal(t, test.remoteAddr.Port, remoteAddr.Port)
+		})
+	}
+}
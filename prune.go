@@ -0,0 +1,296 @@
+package aperture
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// defaultPruneInterval is the default interval in which expired and
+	// revoked tokens are pruned.
+	defaultPruneInterval = 24 * time.Hour
+
+	// defaultPruneRetention is the default time expired and revoked tokens
+	// are kept before they are pruned.
+	defaultPruneRetention = 30 * 24 * time.Hour
+)
+
+var (
+	// tokensPrefix is the key we'll use to prefix the index of all minted
+	// tokens with when storing it in an etcd cluster.
+	tokensPrefix = "tokens"
+)
+
+// tokenKey returns the full key of the index entry of a token in the database.
+// An empty token ID returns the prefix of the index entries of all tokens.
+//
+// The resulting path of the index entry of the token with the ID "abc" within
+// etcd would look like:
+//
+//	lsat/proxy/tokens/abc
+func tokenKey(tokenID string) string {
+	return strings.Join(
+		[]string{topLevelKey, tokensPrefix, tokenID}, etcdKeyDelimeter,
+	)
+}
+
+// indexedToken is the index entry of a minted token.
+type indexedToken struct {
+	// IDHash is the hex encoded hash the secret of the token is keyed by.
+	IDHash string `json:"id_hash"`
+
+	// Expiry is the time after which the token can't be used anymore. It's
+	// zero if the token doesn't expire.
+	Expiry time.Time `json:"expiry"`
+
+	// Revoked is the time the secret of the token was first found to be
+	// revoked by the pruner.
+	Revoked time.Time `json:"revoked"`
+}
+
+// tokenIndex is an index of all minted tokens backed by an etcd cluster.
+type tokenIndex struct {
+	*clientv3.Client
+}
+
+// A compile-time constraint to ensure tokenIndex implements mint.TokenIndex.
+var _ mint.TokenIndex = (*tokenIndex)(nil)
+
+// newTokenIndex creates a new token index backed by the given etcd client.
+func newTokenIndex(client *clientv3.Client) *tokenIndex {
+	return &tokenIndex{Client: client}
+}
+
+// AddToken records a new token in the index.
+//
+// NOTE: This is part of the mint.TokenIndex interface.
+func (i *tokenIndex) AddToken(ctx context.Context, tokenID lsat.TokenID,
+	idHash [sha256.Size]byte, expiry time.Time) error {
+
+	value, err := json.Marshal(&indexedToken{
+		IDHash: hex.EncodeToString(idHash[:]),
+		Expiry: expiry,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = i.Put(ctx, tokenKey(tokenID.String()), string(value))
+	return err
+}
+
+// PruningConfig holds the options of the job that prunes expired and revoked
+// tokens.
+type PruningConfig struct {
+	// Enabled can be set to index all new tokens and periodically remove
+	// the secrets and state of those that are expired or revoked.
+	Enabled bool `long:"enabled" description:"Whether to index new tokens and periodically remove the secrets and state of expired and revoked ones."`
+
+	// Interval is the interval in which tokens are pruned.
+	Interval time.Duration `long:"interval" description:"The interval in which expired and revoked tokens are pruned (default: 24h)."`
+
+	// Retention is the time tokens are kept after they expired or were
+	// revoked.
+	Retention time.Duration `long:"retention" description:"The time expired and revoked tokens are kept before they are pruned (default: 720h)."`
+}
+
+// validate checks the pruning options.
+func (c *PruningConfig) validate() error {
+	if c.Interval < 0 || c.Retention < 0 {
+		return fmt.Errorf("negative pruning interval or retention")
+	}
+
+	return nil
+}
+
+// pruneReport is what a single pruning pass removed.
+type pruneReport struct {
+	expired int
+	revoked int
+}
+
+// tokenPruner periodically removes the secrets and the state of all indexed
+// tokens that expired or were revoked longer than the retention ago.
+type tokenPruner struct {
+	client    *clientv3.Client
+	secrets   mint.SecretStore
+	interval  time.Duration
+	retention time.Duration
+}
+
+// newTokenPruner creates a new pruner of the tokens in the index of the given
+// etcd client whose secrets are kept in the given store.
+func newTokenPruner(cfg *PruningConfig, client *clientv3.Client,
+	secrets mint.SecretStore) *tokenPruner {
+
+	p := &tokenPruner{
+		client:    client,
+		secrets:   secrets,
+		interval:  cfg.Interval,
+		retention: cfg.Retention,
+	}
+	if p.interval == 0 {
+		p.interval = defaultPruneInterval
+	}
+	if p.retention == 0 {
+		p.retention = defaultPruneRetention
+	}
+
+	return p
+}
+
+// run prunes tokens periodically until the context is canceled. A failed pass
+// is retried with the next one.
+func (p *tokenPruner) run(ctx context.Context) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := p.prune(ctx, time.Now())
+		switch {
+		case err != nil && ctx.Err() == nil:
+			log.Errorf("Error pruning tokens: %v", err)
+
+		case err == nil:
+			log.Infof("Pruned %d expired and %d revoked tokens.",
+				report.expired, report.revoked)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// prune removes all tokens that expired or were revoked longer than the
+// retention before the given time. Tokens whose secret was found to be revoked
+// are marked, so they are pruned once the retention passed.
+func (p *tokenPruner) prune(ctx context.Context,
+	now time.Time) (*pruneReport, error) {
+
+	prefix := tokenKey("")
+	resp, err := p.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	report := &pruneReport{}
+	for _, kv := range resp.Kvs {
+		tokenID, err := lsat.MakeIDFromString(
+			strings.TrimPrefix(string(kv.Key), prefix),
+		)
+		if err != nil {
+			log.Errorf("Invalid token index key %s: %v", kv.Key,
+				err)
+			continue
+		}
+		token := &indexedToken{}
+		if err := json.Unmarshal(kv.Value, token); err != nil {
+			log.Errorf("Invalid token index entry %s: %v", kv.Key,
+				err)
+			continue
+		}
+		var idHash [sha256.Size]byte
+		_, err = hex.Decode(idHash[:], []byte(token.IDHash))
+		if err != nil {
+			log.Errorf("Invalid token index entry %s: %v", kv.Key,
+				err)
+			continue
+		}
+
+		expired := !token.Expiry.IsZero() &&
+			now.After(token.Expiry.Add(p.retention))
+		if expired {
+			if err := p.remove(ctx, tokenID, idHash); err != nil {
+				return nil, err
+			}
+			report.expired++
+			continue
+		}
+
+		if !token.Revoked.IsZero() {
+			if now.After(token.Revoked.Add(p.retention)) {
+				err := p.remove(ctx, tokenID, idHash)
+				if err != nil {
+					return nil, err
+				}
+				report.revoked++
+			}
+			continue
+		}
+
+		// The secret of a revoked token is gone already, but its
+		// state is kept for the retention from now on.
+		_, err = p.secrets.GetSecret(ctx, idHash)
+		switch {
+		case err == mint.ErrSecretNotFound:
+			token.Revoked = now
+			value, err := json.Marshal(token)
+			if err != nil {
+				return nil, err
+			}
+			_, err = p.client.Put(
+				ctx, string(kv.Key), string(value),
+			)
+			if err != nil {
+				return nil, err
+			}
+
+		case err != nil:
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// remove revokes the secret of the token and removes all of its state,
+// including the tokens delegated from it and its index entry.
+func (p *tokenPruner) remove(ctx context.Context, tokenID lsat.TokenID,
+	idHash [sha256.Size]byte) error {
+
+	if err := p.secrets.RevokeSecret(ctx, idHash); err != nil {
+		return err
+	}
+
+	owner := ownerKey(tokenID.String(), "")
+	resp, err := p.client.Get(
+		ctx, owner, clientv3.WithPrefix(), clientv3.WithKeysOnly(),
+	)
+	if err != nil {
+		return err
+	}
+
+	ops := []clientv3.Op{
+		clientv3.OpDelete(balanceKey(tokenID)),
+		clientv3.OpDelete(creditKey(tokenID)),
+		clientv3.OpDelete(requestsKey(tokenID)),
+		clientv3.OpDelete(transferKey(tokenID)),
+		clientv3.OpDelete(nonceKey(tokenID)),
+		clientv3.OpDelete(metadataKey(tokenID.String())),
+		clientv3.OpDelete(owner, clientv3.WithPrefix()),
+		clientv3.OpDelete(tokenKey(tokenID.String())),
+	}
+	for _, kv := range resp.Kvs {
+		id := strings.TrimPrefix(string(kv.Key), owner)
+		ops = append(ops, clientv3.OpDelete(delegationKey(id)))
+	}
+
+	if _, err := p.client.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return err
+	}
+
+	log.Debugf("Pruned token %v.", tokenID)
+	return nil
+}
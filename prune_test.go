@@ -0,0 +1,86 @@
+package aperture
+
+import (
+	"context"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTokenPruner tests that the secrets and state of expired and revoked
+// tokens are pruned after the retention, while active tokens are kept.
+func TestTokenPruner(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	var (
+		ctx       = context.Background()
+		now       = time.Now()
+		retention = time.Hour
+		secrets   = newSecretStore(etcdClient)
+		index     = newTokenIndex(etcdClient)
+		balances  = newBalanceStore(etcdClient)
+		pruner    = newTokenPruner(&PruningConfig{
+			Retention: retention,
+		}, etcdClient, secrets)
+
+		expired = lsat.TokenID{1}
+		active  = lsat.TokenID{2}
+		revoked = lsat.TokenID{3}
+		forever = lsat.TokenID{4}
+	)
+
+	addToken := func(tokenID lsat.TokenID,
+		expiry time.Time) [sha256.Size]byte {
+
+		idHash := sha256.Sum256(tokenID[:])
+		_, err := secrets.NewSecret(ctx, idHash)
+		require.NoError(t, err)
+		require.NoError(t, index.AddToken(ctx, tokenID, idHash, expiry))
+
+		_, err = balances.Spend(ctx, tokenID, 10)
+		require.NoError(t, err)
+		return idHash
+	}
+	expiredHash := addToken(expired, now.Add(-2*retention))
+	activeHash := addToken(active, now.Add(retention))
+	revokedHash := addToken(revoked, time.Time{})
+	addToken(forever, time.Time{})
+	require.NoError(t, secrets.RevokeSecret(ctx, revokedHash))
+
+	// The expired token is pruned right away, the revoked one only after
+	// the retention.
+	report, err := pruner.prune(ctx, now)
+	require.NoError(t, err)
+	require.Equal(t, &pruneReport{expired: 1}, report)
+
+	_, err = secrets.GetSecret(ctx, expiredHash)
+	require.Equal(t, mint.ErrSecretNotFound, err)
+	spent, err := balances.Spent(ctx, expired)
+	require.NoError(t, err)
+	require.Zero(t, spent)
+
+	report, err = pruner.prune(ctx, now.Add(retention/2))
+	require.NoError(t, err)
+	require.Equal(t, &pruneReport{}, report)
+
+	report, err = pruner.prune(ctx, now.Add(3*retention))
+	require.NoError(t, err)
+	require.Equal(t, &pruneReport{expired: 1, revoked: 1}, report)
+
+	spent, err = balances.Spent(ctx, revoked)
+	require.NoError(t, err)
+	require.Zero(t, spent)
+
+	// Only the token that never expires is left.
+	_, err = secrets.GetSecret(ctx, activeHash)
+	require.Equal(t, mint.ErrSecretNotFound, err)
+	spent, err = balances.Spent(ctx, forever)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, spent)
+}
@@ -0,0 +1,649 @@
+// Package qrcode implements a minimal QR code encoder that is just capable
+// enough to render Lightning invoices. It supports the byte and alphanumeric
+// encoding modes, all four error correction levels and all 40 versions.
+package qrcode
+
+import (
+	"errors"
+	"strings"
+)
+
+// Level is the error correction level of a QR code.
+type Level int
+
+const (
+	// Low allows about 7% of the code words to be restored.
+	Low Level = iota
+
+	// Medium allows about 15% of the code words to be restored.
+	Medium
+
+	// Quartile allows about 25% of the code words to be restored.
+	Quartile
+
+	// High allows about 30% of the code words to be restored.
+	High
+)
+
+const (
+	minVersion = 1
+	maxVersion = 40
+
+	// alphanumericCharset is the character set of the alphanumeric mode,
+	// the index of a character is its value.
+	alphanumericCharset = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:"
+)
+
+var (
+	// ErrDataTooLong is returned if the data doesn't fit into a QR code of
+	// the largest version.
+	ErrDataTooLong = errors.New("data too long for QR code")
+)
+
+// formatBits returns the two bits that identify the level in the format
+// information of a code.
+func (l Level) formatBits() int {
+	switch l {
+	case Low:
+		return 1
+	case Medium:
+		return 0
+	case Quartile:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// Code is an encoded QR code.
+type Code struct {
+	size       int
+	modules    [][]bool
+	isFunction [][]bool
+}
+
+// Encode creates the QR code of the smallest version that can hold the given
+// content at the given error correction level. The alphanumeric mode is used
+// if the content only consists of characters of its character set (for
+// example an upper case Lightning invoice), the byte mode otherwise.
+func Encode(content string, level Level) (*Code, error) {
+	bits := &bitBuffer{}
+	alphanumeric := isAlphanumeric(content)
+
+	// Find the smallest version the data fits into.
+	version := minVersion
+	for ; version <= maxVersion; version++ {
+		capacity := numDataCodewords(version, level) * 8
+		if segmentBits(content, alphanumeric, version) <= capacity {
+			break
+		}
+	}
+	if version > maxVersion {
+		return nil, ErrDataTooLong
+	}
+
+	// Encode the data segment with its mode and character count.
+	countBits := charCountBits(alphanumeric, version)
+	if alphanumeric {
+		bits.append(0x2, 4)
+		bits.append(len(content), countBits)
+		for i := 0; i+1 < len(content); i += 2 {
+			value := strings.IndexByte(alphanumericCharset, content[i])
+			value = value*45 + strings.IndexByte(
+				alphanumericCharset, content[i+1],
+			)
+			bits.append(value, 11)
+		}
+		if len(content)%2 == 1 {
+			bits.append(strings.IndexByte(
+				alphanumericCharset, content[len(content)-1],
+			), 6)
+		}
+	} else {
+		bits.append(0x4, 4)
+		bits.append(len(content), countBits)
+		for i := 0; i < len(content); i++ {
+			bits.append(int(content[i]), 8)
+		}
+	}
+
+	// Add the terminator, align to a full byte and fill up the remaining
+	// capacity with the alternating pad bytes.
+	capacity := numDataCodewords(version, level) * 8
+	terminator := capacity - bits.len()
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-bits.len()%8)%8)
+	for pad := 0xEC; bits.len() < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	code := newCode(version)
+	code.drawFunctionPatterns(version)
+	code.drawCodewords(addECCAndInterleave(bits.bytes(), version, level))
+
+	// Choose the mask with the lowest penalty score.
+	bestMask, minPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		code.applyMask(mask)
+		code.drawFormatBits(level, mask)
+		penalty := code.penaltyScore()
+		if minPenalty < 0 || penalty < minPenalty {
+			bestMask, minPenalty = mask, penalty
+		}
+
+		// Masks are applied with XOR, so applying the same mask again
+		// undoes it.
+		code.applyMask(mask)
+	}
+	code.applyMask(bestMask)
+	code.drawFormatBits(level, bestMask)
+
+	return code, nil
+}
+
+// Size returns the number of modules along one side of the code.
+func (c *Code) Size() int {
+	return c.size
+}
+
+// Module returns true if the module at the given coordinates is dark. The top
+// left module is at 0, 0. Coordinates outside of the code are always light.
+func (c *Code) Module(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.size || y >= c.size {
+		return false
+	}
+	return c.modules[y][x]
+}
+
+// newCode creates an empty code of the given version.
+func newCode(version int) *Code {
+	size := version*4 + 17
+	c := &Code{
+		size:       size,
+		modules:    make([][]bool, size),
+		isFunction: make([][]bool, size),
+	}
+	for i := 0; i < size; i++ {
+		c.modules[i] = make([]bool, size)
+		c.isFunction[i] = make([]bool, size)
+	}
+
+	return c
+}
+
+// setFunction sets a module that belongs to a function pattern and must
+// therefore not be used for data or be masked.
+func (c *Code) setFunction(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.isFunction[y][x] = true
+}
+
+// drawFunctionPatterns draws the timing, finder and alignment patterns as well
+// as the version information. The format information is only reserved.
+func (c *Code) drawFunctionPatterns(version int) {
+	for i := 0; i < c.size; i++ {
+		c.setFunction(6, i, i%2 == 0)
+		c.setFunction(i, 6, i%2 == 0)
+	}
+
+	c.drawFinderPattern(3, 3)
+	c.drawFinderPattern(c.size-4, 3)
+	c.drawFinderPattern(3, c.size-4)
+
+	positions := alignmentPositions(version)
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// The corners with the finder patterns are skipped.
+			if (i == 0 && j == 0) || (i == 0 && j == last) ||
+				(i == last && j == 0) {
+
+				continue
+			}
+			c.drawAlignmentPattern(x, y)
+		}
+	}
+
+	c.drawFormatBits(Low, 0)
+	c.drawVersion(version)
+}
+
+// drawFinderPattern draws a finder pattern including its separator around the
+// given center.
+func (c *Code) drawFinderPattern(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= c.size || yy >= c.size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			c.setFunction(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+// drawAlignmentPattern draws an alignment pattern around the given center.
+func (c *Code) drawAlignmentPattern(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// drawFormatBits draws both copies of the format information for the given
+// level and mask.
+func (c *Code) drawFormatBits(level Level, mask int) {
+	data := level.formatBits()<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+
+	// The first copy is around the top left finder pattern.
+	for i := 0; i <= 5; i++ {
+		c.setFunction(8, i, bit(bits, i))
+	}
+	c.setFunction(8, 7, bit(bits, 6))
+	c.setFunction(8, 8, bit(bits, 7))
+	c.setFunction(7, 8, bit(bits, 8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(14-i, 8, bit(bits, i))
+	}
+
+	// The second copy is split between the other two finder patterns.
+	for i := 0; i < 8; i++ {
+		c.setFunction(c.size-1-i, 8, bit(bits, i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(8, c.size-15+i, bit(bits, i))
+	}
+	c.setFunction(8, c.size-8, true)
+}
+
+// drawVersion draws both copies of the version information, which is only
+// present from version 7 onwards.
+func (c *Code) drawVersion(version int) {
+	if version < 7 {
+		return
+	}
+
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := version<<12 | rem
+
+	for i := 0; i < 18; i++ {
+		a, b := c.size-11+i%3, i/3
+		c.setFunction(a, b, bit(bits, i))
+		c.setFunction(b, a, bit(bits, i))
+	}
+}
+
+// drawCodewords places the data and error correction code words in the zig
+// zag pattern of two module wide columns, skipping all function modules.
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.size - 1; right >= 1; right -= 2 {
+		// The vertical timing pattern is skipped completely.
+		if right == 6 {
+			right = 5
+		}
+
+		for vert := 0; vert < c.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.size - 1 - vert
+				}
+
+				if c.isFunction[y][x] || i >= len(data)*8 {
+					continue
+				}
+				c.modules[y][x] = bit(int(data[i>>3]), 7-i&7)
+				i++
+			}
+		}
+	}
+}
+
+// applyMask flips all data modules that are selected by the given mask.
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			if c.isFunction[y][x] {
+				continue
+			}
+
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			default:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			c.modules[y][x] = c.modules[y][x] != invert
+		}
+	}
+}
+
+// penaltyScore calculates the penalty of the current module arrangement as
+// specified for the mask selection. A lower score means the code is easier
+// to read.
+func (c *Code) penaltyScore() int {
+	var (
+		penalty int
+		dark    int
+	)
+
+	// Finder like patterns in any row or column are penalized because
+	// they confuse readers.
+	finderLike := [][]bool{
+		{true, false, true, true, true, false, true, false, false,
+			false, false},
+		{false, false, false, false, true, false, true, true, true,
+			false, true},
+	}
+
+	for a := 0; a < c.size; a++ {
+		rowRun, colRun := 1, 1
+		for b := 0; b < c.size; b++ {
+			if c.modules[a][b] {
+				dark++
+			}
+
+			// Runs of five or more modules of the same color.
+			if b > 0 {
+				if c.modules[a][b] == c.modules[a][b-1] {
+					rowRun++
+				} else {
+					rowRun = 1
+				}
+				if c.modules[b][a] == c.modules[b-1][a] {
+					colRun++
+				} else {
+					colRun = 1
+				}
+				if rowRun == 5 {
+					penalty += 3
+				} else if rowRun > 5 {
+					penalty++
+				}
+				if colRun == 5 {
+					penalty += 3
+				} else if colRun > 5 {
+					penalty++
+				}
+			}
+
+			// Blocks of 2x2 modules of the same color.
+			if a > 0 && b > 0 {
+				color := c.modules[a][b]
+				if color == c.modules[a-1][b] &&
+					color == c.modules[a][b-1] &&
+					color == c.modules[a-1][b-1] {
+
+					penalty += 3
+				}
+			}
+
+			for _, pattern := range finderLike {
+				if b+len(pattern) > c.size {
+					continue
+				}
+				rowMatch, colMatch := true, true
+				for k, want := range pattern {
+					if c.modules[a][b+k] != want {
+						rowMatch = false
+					}
+					if c.modules[b+k][a] != want {
+						colMatch = false
+					}
+				}
+				if rowMatch {
+					penalty += 40
+				}
+				if colMatch {
+					penalty += 40
+				}
+			}
+		}
+	}
+
+	// The further the ratio of dark modules is away from 50%, the higher
+	// the penalty.
+	total := c.size * c.size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	penalty += k * 10
+
+	return penalty
+}
+
+// isAlphanumeric returns true if the content can be encoded in the
+// alphanumeric mode.
+func isAlphanumeric(content string) bool {
+	for i := 0; i < len(content); i++ {
+		if strings.IndexByte(alphanumericCharset, content[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// charCountBits returns the length of the character count field of a segment
+// in the given mode and version.
+func charCountBits(alphanumeric bool, version int) int {
+	switch {
+	case alphanumeric && version <= 9:
+		return 9
+	case alphanumeric && version <= 26:
+		return 11
+	case alphanumeric:
+		return 13
+	case version <= 9:
+		return 8
+	default:
+		return 16
+	}
+}
+
+// segmentBits returns the number of bits needed to encode the content in a
+// single segment, including the mode indicator and character count.
+func segmentBits(content string, alphanumeric bool, version int) int {
+	bits := 4 + charCountBits(alphanumeric, version)
+	if alphanumeric {
+		return bits + len(content)/2*11 + len(content)%2*6
+	}
+	return bits + len(content)*8
+}
+
+// numRawDataModules returns the number of modules that are available for data
+// and error correction code words in a code of the given version.
+func numRawDataModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		numAlign := version/7 + 2
+		result -= (25*numAlign-10)*numAlign - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+// numDataCodewords returns the number of data code words a code of the given
+// version and level can hold.
+func numDataCodewords(version int, level Level) int {
+	return numRawDataModules(version)/8 -
+		eccCodewordsPerBlock[level][version]*
+			numErrorCorrectionBlocks[level][version]
+}
+
+// alignmentPositions returns the coordinates of the centers of the alignment
+// patterns in both dimensions.
+func alignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+
+	numAlign := version/7 + 2
+	step := (version*8 + numAlign*3 + 5) / (numAlign*4 - 4) * 2
+	positions := make([]int, numAlign)
+	positions[0] = 6
+	for i, pos := numAlign-1, version*4+10; i > 0; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+	return positions
+}
+
+// addECCAndInterleave splits the data into blocks, calculates the error
+// correction code words of each block and interleaves all of them.
+func addECCAndInterleave(data []byte, version int, level Level) []byte {
+	numBlocks := numErrorCorrectionBlocks[level][version]
+	blockECCLen := eccCodewordsPerBlock[level][version]
+	rawCodewords := numRawDataModules(version) / 8
+	numShortBlocks := numBlocks - rawCodewords%numBlocks
+	shortBlockLen := rawCodewords / numBlocks
+
+	divisor := reedSolomonDivisor(blockECCLen)
+	blocks := make([][]byte, numBlocks)
+	for i, k := 0, 0; i < numBlocks; i++ {
+		datLen := shortBlockLen - blockECCLen
+		if i >= numShortBlocks {
+			datLen++
+		}
+		dat := data[k : k+datLen]
+		k += datLen
+
+		// Short blocks get a dummy byte so all blocks have the same
+		// length, it is skipped when interleaving.
+		block := make([]byte, 0, shortBlockLen+1)
+		block = append(block, dat...)
+		if i < numShortBlocks {
+			block = append(block, 0)
+		}
+		block = append(block, reedSolomonRemainder(dat, divisor)...)
+		blocks[i] = block
+	}
+
+	result := make([]byte, 0, rawCodewords)
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			if i != shortBlockLen-blockECCLen || j >= numShortBlocks {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+// reedSolomonDivisor returns the generator polynomial of the given degree,
+// without the leading coefficient.
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// reedSolomonRemainder returns the error correction code words of the given
+// data.
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range divisor {
+			result[i] ^= gfMultiply(coef, factor)
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies two elements of the Galois field GF(2^8) modulo the
+// polynomial 0x11D.
+func gfMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// bitBuffer is an append only sequence of bits.
+type bitBuffer struct {
+	bits []bool
+}
+
+// append adds the lowest n bits of the value, most significant bit first.
+func (b *bitBuffer) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		b.bits = append(b.bits, (value>>uint(i))&1 != 0)
+	}
+}
+
+// len returns the number of bits in the buffer.
+func (b *bitBuffer) len() int {
+	return len(b.bits)
+}
+
+// bytes packs the bits into bytes, the length must be a multiple of eight.
+func (b *bitBuffer) bytes() []byte {
+	result := make([]byte, len(b.bits)/8)
+	for i, set := range b.bits {
+		if set {
+			result[i>>3] |= 1 << uint(7-i&7)
+		}
+	}
+	return result
+}
+
+// bit returns true if the bit at the given index of the value is set.
+func bit(value, i int) bool {
+	return (value>>uint(i))&1 != 0
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
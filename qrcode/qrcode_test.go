@@ -0,0 +1,208 @@
+package qrcode
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestCapacity makes sure the error correction tables result in the data
+// capacities of the specification.
+func TestCapacity(t *testing.T) {
+	require.Equal(t, 3706, numRawDataModules(40)/8)
+	require.Equal(t, 16, numDataCodewords(1, Medium))
+	require.Equal(t, 108, numDataCodewords(5, Low))
+	require.Equal(t, 86, numDataCodewords(5, Medium))
+	require.Equal(t, 62, numDataCodewords(5, Quartile))
+	require.Equal(t, 46, numDataCodewords(5, High))
+	require.Equal(t, 216, numDataCodewords(10, Medium))
+	require.Equal(t, 2956, numDataCodewords(40, Low))
+	require.Equal(t, 1276, numDataCodewords(40, High))
+
+	require.Equal(t, []int{6, 22, 38}, alignmentPositions(7))
+	require.Equal(t, []int{6, 34, 60, 86, 112, 138}, alignmentPositions(32))
+}
+
+// TestHelloWorld compares the code words of the well known "HELLO WORLD"
+// example at version 1 and level M with the expected values.
+func TestHelloWorld(t *testing.T) {
+	code, err := Encode("HELLO WORLD", Medium)
+	require.NoError(t, err)
+	require.Equal(t, 21, code.Size())
+
+	// A single block means there's no interleaving, so the code words
+	// are the data followed by the error correction code words.
+	expected := []byte{
+		32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17,
+		236, 17, 196, 35, 39, 119, 235, 215, 231, 226, 93, 23,
+	}
+	require.Equal(t, expected, readCodewords(t, code, Medium))
+}
+
+// TestEncodeRoundTrip makes sure codes of different sizes and levels contain
+// valid error correction code words and the encoded content.
+func TestEncodeRoundTrip(t *testing.T) {
+	invoice := "LIGHTNING:LNBC1" + strings.Repeat(
+		"QPZRY9X8GF2TVDW0S3JN54KHCE6MUA7L", 12,
+	)
+	contents := []string{
+		"hello, world",
+		invoice,
+		strings.ToLower(invoice),
+	}
+
+	for _, content := range contents {
+		for _, level := range []Level{Low, Medium, Quartile, High} {
+			code, err := Encode(content, level)
+			require.NoError(t, err)
+
+			data := readCodewords(t, code, level)
+			require.Equal(t, content, decodeSegment(
+				t, data, (code.Size()-17)/4,
+			))
+		}
+	}
+
+	_, err := Encode(strings.Repeat("x", 3000), Low)
+	require.Equal(t, ErrDataTooLong, err)
+}
+
+// readCodewords reads the format information, removes the mask and returns
+// the de-interleaved code words of all blocks after verifying their error
+// correction code words.
+func readCodewords(t *testing.T, code *Code, level Level) []byte {
+	t.Helper()
+
+	version := (code.Size() - 17) / 4
+
+	// Read the first copy of the format information.
+	var bits int
+	for i := 0; i <= 5; i++ {
+		bits |= boolBit(code.Module(8, i)) << uint(i)
+	}
+	bits |= boolBit(code.Module(8, 7)) << 6
+	bits |= boolBit(code.Module(8, 8)) << 7
+	bits |= boolBit(code.Module(7, 8)) << 8
+	for i := 9; i < 15; i++ {
+		bits |= boolBit(code.Module(14-i, 8)) << uint(i)
+	}
+	data := (bits ^ 0x5412) >> 10
+	require.Equal(t, level.formatBits(), data>>3)
+	mask := data & 7
+
+	// Build a fresh code of the same version to know where the function
+	// patterns are, then read the unmasked data modules.
+	unmasked := newCode(version)
+	unmasked.drawFunctionPatterns(version)
+	for y := 0; y < code.size; y++ {
+		copy(unmasked.modules[y], code.modules[y])
+	}
+	unmasked.applyMask(mask)
+
+	raw := make([]byte, numRawDataModules(version)/8)
+	i := 0
+	for right := code.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < code.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = code.size - 1 - vert
+				}
+				if unmasked.isFunction[y][x] || i >= len(raw)*8 {
+					continue
+				}
+				if unmasked.modules[y][x] {
+					raw[i>>3] |= 1 << uint(7-i&7)
+				}
+				i++
+			}
+		}
+	}
+
+	// De-interleave the blocks and verify each of them.
+	numBlocks := numErrorCorrectionBlocks[level][version]
+	blockECCLen := eccCodewordsPerBlock[level][version]
+	numShortBlocks := numBlocks - len(raw)%numBlocks
+	shortBlockLen := len(raw) / numBlocks
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := 0; i < shortBlockLen+1; i++ {
+		for j := 0; j < numBlocks; j++ {
+			if i == shortBlockLen-blockECCLen && j < numShortBlocks {
+				continue
+			}
+			blocks[j] = append(blocks[j], raw[k])
+			k++
+		}
+	}
+	require.Equal(t, len(raw), k)
+
+	var result, ecc []byte
+	divisor := reedSolomonDivisor(blockECCLen)
+	for _, block := range blocks {
+		dat := block[:len(block)-blockECCLen]
+		require.Equal(
+			t, reedSolomonRemainder(dat, divisor),
+			block[len(dat):],
+		)
+		result = append(result, dat...)
+		ecc = append(ecc, block[len(dat):]...)
+	}
+
+	if numBlocks == 1 {
+		return append(result, ecc...)
+	}
+	return result
+}
+
+// decodeSegment decodes the single segment in the given data code words.
+func decodeSegment(t *testing.T, data []byte, version int) string {
+	t.Helper()
+
+	pos := 0
+	read := func(n int) int {
+		var value int
+		for i := 0; i < n; i++ {
+			b := data[pos>>3] >> uint(7-pos&7) & 1
+			value = value<<1 | int(b)
+			pos++
+		}
+		return value
+	}
+
+	var result strings.Builder
+	switch mode := read(4); mode {
+	case 0x2:
+		count := read(charCountBits(true, version))
+		for ; count >= 2; count -= 2 {
+			value := read(11)
+			result.WriteByte(alphanumericCharset[value/45])
+			result.WriteByte(alphanumericCharset[value%45])
+		}
+		if count == 1 {
+			result.WriteByte(alphanumericCharset[read(6)])
+		}
+
+	case 0x4:
+		count := read(charCountBits(false, version))
+		for i := 0; i < count; i++ {
+			result.WriteByte(byte(read(8)))
+		}
+
+	default:
+		t.Fatalf("unexpected mode %d", mode)
+	}
+
+	return result.String()
+}
+
+func boolBit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,33 @@
+package qrcode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SVG renders the code as a scalable SVG image with the given number of light
+// modules as quiet zone around it. The specification requires a quiet zone of
+// at least four modules.
+func (c *Code) SVG(border int) string {
+	dim := c.size + border*2
+
+	var path strings.Builder
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			if c.modules[y][x] {
+				fmt.Fprintf(
+					&path, "M%d,%dh1v1h-1z", x+border,
+					y+border,
+				)
+			}
+		}
+	}
+
+	return fmt.Sprintf(
+		`<svg xmlns="http://www.w3.org/2000/svg" version="1.1" `+
+			`viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+			`<rect width="100%%" height="100%%" fill="#ffffff"/>`+
+			`<path d="%s" fill="#000000"/></svg>`,
+		dim, dim, path.String(),
+	)
+}
@@ -0,0 +1,244 @@
+package aperture
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// reflectionGRPCPrefix is the prefix a gRPC request URI has when it is
+	// meant for the server reflection service.
+	reflectionGRPCPrefix = "/grpc.reflection.v1alpha.ServerReflection/"
+)
+
+// reflectionBackend is a gRPC backend that takes part in the aggregated server
+// reflection.
+type reflectionBackend struct {
+	name    string
+	conn    *grpc.ClientConn
+	headers metadata.MD
+}
+
+// reflectionStreams are the reflection streams to each of the backends that
+// belong to a single client stream.
+type reflectionStreams []rpb.ServerReflection_ServerReflectionInfoClient
+
+// reflectionServer is an implementation of the gRPC server reflection service
+// that aggregates the reflection data of multiple gRPC backends. Requests for
+// a list of all services are answered with the union of all backend services,
+// all other requests are answered by the first backend that knows the
+// requested symbol or file.
+type reflectionServer struct {
+	backends []*reflectionBackend
+}
+
+// A compile-time check to make sure reflectionServer implements the server
+// reflection service.
+var _ rpb.ServerReflectionServer = (*reflectionServer)(nil)
+
+// newReflectionServer creates a new aggregating reflection server for all
+// services that opted in to server reflection.
+func newReflectionServer(services []*proxy.Service) (*reflectionServer,
+	error) {
+
+	server := &reflectionServer{}
+	for _, service := range services {
+		if !service.Reflection {
+			continue
+		}
+
+		conn, headers, err := dialService(service)
+		if err != nil {
+			server.stop()
+			return nil, err
+		}
+
+		server.backends = append(server.backends, &reflectionBackend{
+			name:    service.Name,
+			conn:    conn,
+			headers: headers,
+		})
+	}
+
+	return server, nil
+}
+
+// stop closes all backend connections.
+func (s *reflectionServer) stop() {
+	for _, backend := range s.backends {
+		if err := backend.conn.Close(); err != nil {
+			log.Errorf("Error closing reflection connection to "+
+				"service %s: %v", backend.name, err)
+		}
+	}
+}
+
+// ServerReflectionInfo is the reflection stream of a single client. For each
+// client stream we open one stream to each of the backends.
+//
+// NOTE: This is part of the rpb.ServerReflectionServer interface.
+func (s *reflectionServer) ServerReflectionInfo(
+	stream rpb.ServerReflection_ServerReflectionInfoServer) error {
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	backendStreams := make(reflectionStreams, len(s.backends))
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			// The client closing its side of the stream is the
+			// normal way to end it.
+			if err == io.EOF || status.Code(err) == codes.Canceled {
+				return nil
+			}
+			return err
+		}
+
+		resp := s.handleRequest(ctx, req, backendStreams)
+		resp.ValidHost = req.Host
+		resp.OriginalRequest = req
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// handleRequest creates the aggregated response to a single reflection
+// request.
+func (s *reflectionServer) handleRequest(ctx context.Context,
+	req *rpb.ServerReflectionRequest,
+	backendStreams reflectionStreams) *rpb.ServerReflectionResponse {
+
+	// The list of services is the union of the services of all backends.
+	_, isList := req.MessageRequest.(*rpb.ServerReflectionRequest_ListServices)
+	if isList {
+		var (
+			known    = make(map[string]struct{})
+			services []*rpb.ServiceResponse
+		)
+		for i, backend := range s.backends {
+			resp, err := s.queryBackend(
+				ctx, i, req, backendStreams,
+			)
+			if err != nil {
+				log.Debugf("Unable to list services of "+
+					"service %s: %v", backend.name, err)
+				continue
+			}
+
+			list := resp.GetListServicesResponse()
+			for _, service := range list.GetService() {
+				if _, ok := known[service.Name]; ok {
+					continue
+				}
+				known[service.Name] = struct{}{}
+				services = append(services, service)
+			}
+		}
+
+		listResp := &rpb.ServerReflectionResponse_ListServicesResponse{
+			ListServicesResponse: &rpb.ListServiceResponse{
+				Service: services,
+			},
+		}
+		return &rpb.ServerReflectionResponse{
+			MessageResponse: listResp,
+		}
+	}
+
+	// All other requests are for a specific file or symbol. We return the
+	// answer of the first backend that knows about it.
+	for i, backend := range s.backends {
+		resp, err := s.queryBackend(ctx, i, req, backendStreams)
+		if err != nil {
+			log.Debugf("Unable to query reflection of service %s: "+
+				"%v", backend.name, err)
+			continue
+		}
+
+		if resp.GetErrorResponse() != nil {
+			continue
+		}
+
+		return resp
+	}
+
+	return &rpb.ServerReflectionResponse{
+		MessageResponse: &rpb.ServerReflectionResponse_ErrorResponse{
+			ErrorResponse: &rpb.ErrorResponse{
+				ErrorCode:    int32(codes.NotFound),
+				ErrorMessage: "not found in any backend",
+			},
+		},
+	}
+}
+
+// queryBackend forwards a reflection request to the backend with the given
+// index, opening a new reflection stream to it if necessary. A stream that
+// fails is reset so the next request opens a new one.
+func (s *reflectionServer) queryBackend(ctx context.Context, idx int,
+	req *rpb.ServerReflectionRequest,
+	backendStreams reflectionStreams) (*rpb.ServerReflectionResponse,
+	error) {
+
+	backend := s.backends[idx]
+	if backendStreams[idx] == nil {
+		client := rpb.NewServerReflectionClient(backend.conn)
+		streamCtx := metadata.NewOutgoingContext(ctx, backend.headers)
+		backendStream, err := client.ServerReflectionInfo(streamCtx)
+		if err != nil {
+			return nil, err
+		}
+		backendStreams[idx] = backendStream
+	}
+
+	if err := backendStreams[idx].Send(req); err != nil {
+		backendStreams[idx] = nil
+		return nil, err
+	}
+	resp, err := backendStreams[idx].Recv()
+	if err != nil {
+		backendStreams[idx] = nil
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// createReflectionServer creates the gRPC server for the aggregated server
+// reflection service.
+func createReflectionServer(services []*proxy.Service) (proxy.LocalService,
+	func(), error) {
+
+	reflectionServer, err := newReflectionServer(services)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reflectionGRPC := grpc.NewServer()
+	rpb.RegisterServerReflectionServer(reflectionGRPC, reflectionServer)
+
+	cleanup := func() {
+		reflectionGRPC.Stop()
+		reflectionServer.stop()
+	}
+	localService := proxy.NewLocalService(
+		reflectionGRPC, func(r *http.Request) bool {
+			return strings.HasPrefix(
+				r.URL.Path, reflectionGRPCPrefix,
+			)
+		},
+	)
+
+	return localService, cleanup, nil
+}
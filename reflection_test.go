@@ -0,0 +1,144 @@
+package aperture
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightninglabs/lightning-node-connect/hashmailrpc"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+)
+
+// startReflectionBackend starts a gRPC server with server reflection enabled
+// and returns its address.
+func startReflectionBackend(t *testing.T, register func(*grpc.Server)) string {
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	register(server)
+	reflection.Register(server)
+
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	t.Cleanup(server.Stop)
+
+	return lis.Addr().String()
+}
+
+// TestReflectionServerAggregation makes sure the reflection server combines the
+// reflection data of all backends that opted in.
+func TestReflectionServerAggregation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	healthAddr := startReflectionBackend(t, func(s *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(s, health.NewServer())
+	})
+	mailServer := newHashMailServer(hashMailServerConfig{
+		msgRate:           time.Millisecond,
+		msgBurstAllowance: 10,
+	})
+	defer mailServer.Stop()
+	mailAddr := startReflectionBackend(t, func(s *grpc.Server) {
+		hashmailrpc.RegisterHashMailServer(s, mailServer)
+	})
+
+	services := []*proxy.Service{{
+		Name:       "health",
+		Address:    healthAddr,
+		Protocol:   "http",
+		Reflection: true,
+	}, {
+		Name:       "mail",
+		Address:    mailAddr,
+		Protocol:   "http",
+		Reflection: true,
+	}, {
+		Name:     "hidden",
+		Address:  "localhost:1",
+		Protocol: "http",
+	}}
+	localService, cleanup, err := createReflectionServer(services)
+	require.NoError(t, err)
+	defer cleanup()
+
+	// Serve the reflection service over h2c, the same way aperture does
+	// in insecure mode.
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	server := &http.Server{
+		Handler: h2c.NewHandler(localService, &http2.Server{}),
+	}
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	defer func() {
+		_ = server.Close()
+	}()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	client := rpb.NewServerReflectionClient(conn)
+	stream, err := client.ServerReflectionInfo(ctx)
+	require.NoError(t, err)
+
+	// The service list must contain the services of both backends.
+	err = stream.Send(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{
+			ListServices: "*",
+		},
+	})
+	require.NoError(t, err)
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+
+	var names []string
+	for _, service := range resp.GetListServicesResponse().GetService() {
+		names = append(names, service.Name)
+	}
+	require.Contains(t, names, "grpc.health.v1.Health")
+	require.Contains(t, names, "hashmailrpc.HashMail")
+
+	// A symbol of the second backend must be found as well.
+	err = stream.Send(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{
+			FileContainingSymbol: "hashmailrpc.HashMail",
+		},
+	})
+	require.NoError(t, err)
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	require.NotEmpty(
+		t, resp.GetFileDescriptorResponse().GetFileDescriptorProto(),
+	)
+
+	// And an unknown symbol results in an error response.
+	err = stream.Send(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{
+			FileContainingSymbol: "does.not.Exist",
+		},
+	})
+	require.NoError(t, err)
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(
+		t, int32(codes.NotFound), resp.GetErrorResponse().GetErrorCode(),
+	)
+}
@@ -0,0 +1,169 @@
+package aperture
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/record"
+	"google.golang.org/grpc"
+	"gopkg.in/macaroon.v2"
+)
+
+const (
+	// defaultMaxRefundFee is the default maximum routing fee in satoshis
+	// of a refund.
+	defaultMaxRefundFee = 10
+
+	// refundTimeout is the maximum time a refund payment may take.
+	refundTimeout = time.Minute
+
+	// pubKeySize is the size in bytes of a compressed node public key.
+	pubKeySize = 33
+)
+
+// RefundClient is the part of the lnd client refunds are sent with.
+type RefundClient interface {
+	// SendPaymentSync sends a payment and waits for its result.
+	SendPaymentSync(ctx context.Context, in *lnrpc.SendRequest,
+		opts ...grpc.CallOption) (*lnrpc.SendResponse, error)
+}
+
+// adminRefund is a refund of the unused balance of a token in the admin API.
+type adminRefund struct {
+	Service     string `json:"service"`
+	Macaroon    string `json:"macaroon,omitempty"`
+	TokenID     string `json:"token_id"`
+	PubKey      string `json:"pubkey"`
+	Messages    uint64 `json:"messages"`
+	Amount      int64  `json:"amount"`
+	PaymentHash string `json:"payment_hash,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// refundsEnabled returns true if the unused balances of tokens can be refunded
+// through the admin API.
+func (a *Aperture) refundsEnabled() bool {
+	return a.cfg.Admin != nil && a.cfg.Admin.RefundMacaroon != ""
+}
+
+// handleRefund refunds the unused message balance of a token to the node with
+// the given public key via keysend and marks the balance as used up. The token
+// is identified by its base64 encoded macaroon, so only tokens we minted and
+// that were paid for can be refunded. The balance is used up before the
+// payment is sent, so a failed payment isn't retried automatically and has to
+// be settled by the operator.
+func (a *Aperture) handleRefund(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.refundClient == nil {
+		http.Error(w, "refunds not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req adminRefund
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	macBytes, err := base64.StdEncoding.DecodeString(req.Macaroon)
+	if err != nil {
+		http.Error(w, "invalid macaroon", http.StatusBadRequest)
+		return
+	}
+	mac := &macaroon.Macaroon{}
+	if err := mac.UnmarshalBinary(macBytes); err != nil {
+		http.Error(w, "invalid macaroon", http.StatusBadRequest)
+		return
+	}
+	pubKey, err := hex.DecodeString(req.PubKey)
+	if err != nil || len(pubKey) != pubKeySize {
+		http.Error(w, "invalid public key", http.StatusBadRequest)
+		return
+	}
+
+	refund, err := a.proxy.ExhaustBalance(r.Context(), req.Service, mac)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tokenID := refund.TokenID
+	req.Macaroon = ""
+	req.TokenID = tokenID.String()
+	req.Messages = refund.Messages
+	req.Amount = refund.Amount
+
+	log.Infof("Refunding %d messages of token %v of service %s, worth %d "+
+		"sats, to %s.", refund.Messages, tokenID, req.Service,
+		refund.Amount, req.PubKey)
+
+	if refund.Amount > 0 {
+		hash, err := a.keysend(r.Context(), pubKey, refund.Amount)
+		if err != nil {
+			log.Errorf("Refund of token %v failed after its "+
+				"balance was used up: %v", tokenID, err)
+
+			req.Error = err.Error()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			writeAdminJSON(w, req)
+			return
+		}
+		req.PaymentHash = hash.String()
+	}
+
+	writeAdminJSON(w, req)
+}
+
+// keysend sends a spontaneous payment of the given amount to the node with the
+// given public key.
+func (a *Aperture) keysend(ctx context.Context, pubKey []byte,
+	amount int64) (lntypes.Hash, error) {
+
+	var preimage lntypes.Preimage
+	if _, err := rand.Read(preimage[:]); err != nil {
+		return lntypes.Hash{}, err
+	}
+	hash := preimage.Hash()
+
+	maxFee := a.cfg.Admin.MaxRefundFee
+	if maxFee == 0 {
+		maxFee = defaultMaxRefundFee
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, refundTimeout)
+	defer cancel()
+
+	resp, err := a.refundClient.SendPaymentSync(ctx, &lnrpc.SendRequest{
+		Dest:        pubKey,
+		Amt:         amount,
+		PaymentHash: hash[:],
+		DestCustomRecords: map[uint64][]byte{
+			record.KeySendType: preimage[:],
+		},
+		FeeLimit: &lnrpc.FeeLimit{
+			Limit: &lnrpc.FeeLimit_Fixed{Fixed: maxFee},
+		},
+	})
+	if err != nil {
+		return lntypes.Hash{}, err
+	}
+	if resp.PaymentError != "" {
+		return lntypes.Hash{}, fmt.Errorf("payment failed: %v",
+			resp.PaymentError)
+	}
+
+	return hash, nil
+}
+
+// A compile-time constraint to ensure the lnd client can send refunds.
+var _ RefundClient = (lnrpc.LightningClient)(nil)
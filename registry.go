@@ -0,0 +1,238 @@
+package aperture
+
+import (
+	"context"
+	"encoding/json"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// registryDir is the directory we'll use to register all running
+	// instances in.
+	registryDir = "instances"
+
+	// registryTTL is the time after which the registration of an instance
+	// that stopped sending heartbeats is removed.
+	registryTTL = 30 * time.Second
+
+	// registryHeartbeatInterval is the interval in which an instance
+	// refreshes its registration.
+	registryHeartbeatInterval = registryTTL / 3
+
+	// instanceHealthServing is the health of an instance that accepts
+	// requests.
+	instanceHealthServing = "serving"
+
+	// instanceHealthDraining is the health of an instance that handed its
+	// sockets over to an upgraded binary and only finishes its open
+	// connections.
+	instanceHealthDraining = "draining"
+)
+
+// instanceInfo is the registration of a running instance.
+type instanceInfo struct {
+	ID            string    `json:"id"`
+	Version       string    `json:"version"`
+	ListenAddrs   []string  `json:"listen_addrs"`
+	OnionAddrs    []string  `json:"onion_addrs,omitempty"`
+	Health        string    `json:"health"`
+	Leader        bool      `json:"leader"`
+	StartedAt     time.Time `json:"started_at"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+}
+
+// registryKey returns the key of the registration of the instance with the
+// given ID.
+//
+// The resulting path of the instance "eu-1" within etcd would look like:
+//
+//	lsat/proxy/instances/eu-1
+func registryKey(id string) string {
+	return strings.Join(
+		[]string{topLevelKey, registryDir, id}, etcdKeyDelimeter,
+	)
+}
+
+// instanceRegistry keeps the registration of this instance in etcd up to date.
+// The registration is bound to a lease, so it disappears once the instance
+// stops sending heartbeats.
+type instanceRegistry struct {
+	client    *clientv3.Client
+	id        string
+	info      func() *instanceInfo
+	startedAt time.Time
+
+	// mtx guards the lease, since heartbeats can also be sent outside of
+	// the regular interval.
+	mtx   sync.Mutex
+	lease clientv3.LeaseID
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newInstanceRegistry creates a new registry for the instance with the given
+// ID. The info function is called on every heartbeat to get the current state
+// of the instance.
+func newInstanceRegistry(client *clientv3.Client, id string,
+	info func() *instanceInfo) *instanceRegistry {
+
+	return &instanceRegistry{
+		client:    client,
+		id:        id,
+		info:      info,
+		startedAt: time.Now(),
+		quit:      make(chan struct{}),
+	}
+}
+
+// Start registers the instance and keeps sending heartbeats in the background.
+func (r *instanceRegistry) Start() error {
+	if err := r.heartbeat(); err != nil {
+		return err
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(registryHeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.heartbeat(); err != nil {
+					log.Errorf("Error refreshing instance "+
+						"registration: %v", err)
+				}
+
+			case <-r.quit:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops sending heartbeats and removes the registration.
+func (r *instanceRegistry) Stop() {
+	close(r.quit)
+	r.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), registryHeartbeatInterval,
+	)
+	defer cancel()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, err := r.client.Revoke(ctx, r.lease); err != nil {
+		log.Errorf("Error removing instance registration: %v", err)
+	}
+}
+
+// heartbeat writes the current state of the instance and refreshes its lease.
+// If the lease expired in the meantime, a new one is created.
+func (r *instanceRegistry) heartbeat() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), registryHeartbeatInterval,
+	)
+	defer cancel()
+
+	if r.lease != clientv3.NoLease {
+		_, err := r.client.KeepAliveOnce(ctx, r.lease)
+		if err != nil {
+			log.Debugf("Unable to refresh registry lease, "+
+				"creating new one: %v", err)
+			r.lease = clientv3.NoLease
+		}
+	}
+	if r.lease == clientv3.NoLease {
+		resp, err := r.client.Grant(ctx, int64(registryTTL.Seconds()))
+		if err != nil {
+			return err
+		}
+		r.lease = resp.ID
+	}
+
+	info := r.info()
+	info.ID = r.id
+	info.StartedAt = r.startedAt
+	info.LastHeartbeat = time.Now()
+	value, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.Put(
+		ctx, registryKey(r.id), string(value), clientv3.WithLease(r.lease),
+	)
+	return err
+}
+
+// listInstances returns the registrations of all running instances, sorted by
+// their ID. The current leader is determined from the leader election, so it's
+// correct even if the leader didn't send a heartbeat since it was elected.
+func listInstances(ctx context.Context,
+	client *clientv3.Client) ([]*instanceInfo, error) {
+
+	resp, err := client.Get(
+		ctx, registryKey(""), clientv3.WithPrefix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]*instanceInfo, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		info := &instanceInfo{}
+		if err := json.Unmarshal(kv.Value, info); err != nil {
+			log.Errorf("Invalid instance registration %s: %v",
+				kv.Key, err)
+			continue
+		}
+		instances = append(instances, info)
+	}
+
+	// The oldest candidate of the election is the leader. Without a leader
+	// election there are no candidates and every instance reports itself
+	// as leader, since it runs the singleton tasks on its own.
+	leaderResp, err := client.Get(
+		ctx, leaderPrefix(), clientv3.WithFirstCreate()...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(leaderResp.Kvs) > 0 {
+		leader := string(leaderResp.Kvs[0].Value)
+		for _, info := range instances {
+			info.Leader = info.ID == leader
+		}
+	}
+
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].ID < instances[j].ID
+	})
+	return instances, nil
+}
+
+// buildVersion returns the version of the aperture module this binary was
+// built from.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	return info.Main.Version
+}
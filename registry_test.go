@@ -0,0 +1,84 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+)
+
+// TestInstanceRegistry tests that instances show up in the registry with their
+// current state and disappear once they stop.
+func TestInstanceRegistry(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	health := instanceHealthServing
+	newRegistry := func(id string) *instanceRegistry {
+		return newInstanceRegistry(etcdClient, id, func() *instanceInfo {
+			return &instanceInfo{
+				Version:     "v1",
+				ListenAddrs: []string{"127.0.0.1:8081"},
+				Health:      health,
+				Leader:      true,
+			}
+		})
+	}
+
+	registries := []*instanceRegistry{newRegistry("b"), newRegistry("a")}
+	for _, registry := range registries {
+		if err := registry.Start(); err != nil {
+			t.Fatalf("unable to start registry: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+	instances, err := listInstances(ctx, etcdClient)
+	if err != nil {
+		t.Fatalf("unable to list instances: %v", err)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("expected 2 instances, got %d", len(instances))
+	}
+	if instances[0].ID != "a" || instances[1].ID != "b" {
+		t.Fatalf("unexpected instances %v, %v", instances[0].ID,
+			instances[1].ID)
+	}
+	for _, instance := range instances {
+		if instance.Health != instanceHealthServing {
+			t.Fatalf("unexpected health %v", instance.Health)
+		}
+		if !instance.Leader {
+			t.Fatalf("expected instance without leader election to " +
+				"be leader")
+		}
+		if instance.StartedAt.IsZero() || instance.LastHeartbeat.IsZero() {
+			t.Fatalf("expected timestamps to be set")
+		}
+	}
+
+	// A heartbeat reports the new state of an instance.
+	health = instanceHealthDraining
+	if err := registries[0].heartbeat(); err != nil {
+		t.Fatalf("unable to send heartbeat: %v", err)
+	}
+	instances, err = listInstances(ctx, etcdClient)
+	if err != nil {
+		t.Fatalf("unable to list instances: %v", err)
+	}
+	if instances[1].Health != instanceHealthDraining {
+		t.Fatalf("expected instance b to be draining, got %v",
+			instances[1].Health)
+	}
+
+	// A stopped instance is removed from the registry.
+	registries[0].Stop()
+	instances, err = listInstances(ctx, etcdClient)
+	if err != nil {
+		t.Fatalf("unable to list instances: %v", err)
+	}
+	if len(instances) != 1 || instances[0].ID != "a" {
+		t.Fatalf("expected only instance a to be registered")
+	}
+
+	registries[1].Stop()
+}
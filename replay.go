@@ -0,0 +1,182 @@
+package aperture
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/lightninglabs/aperture/proxy"
+)
+
+const (
+	// replayCommand is the name of the command that re-sends the captured
+	// requests of a service to another backend.
+	replayCommand = "replay"
+)
+
+var (
+	// replaySkipHeaders are the header fields of captured requests that
+	// aren't replayed since they belong to the original connection.
+	replaySkipHeaders = map[string]bool{
+		"Connection":        true,
+		"Content-Length":    true,
+		"Keep-Alive":        true,
+		"Te":                true,
+		"Transfer-Encoding": true,
+		"Upgrade":           true,
+	}
+)
+
+// replayConfig holds the options of the replay command.
+type replayConfig struct {
+	AdminAddr          string        `long:"adminaddr" description:"The address of the admin API of the aperture instance that captured the requests." default:"localhost:8082"`
+	Service            string        `long:"service" description:"The name of the service whose captured requests are replayed." required:"true"`
+	Target             string        `long:"target" description:"The base URL of the backend the requests are sent to, like http://localhost:8080." required:"true"`
+	IDs                []uint64      `long:"id" description:"The ID of a captured exchange to replay, can be given multiple times. All captured exchanges are replayed if none is given."`
+	Timeout            time.Duration `long:"timeout" description:"The timeout of each request." default:"10s"`
+	InsecureSkipVerify bool          `long:"insecureskipverify" description:"Don't verify the TLS certificate of the target."`
+}
+
+// runReplay parses the options of the replay command from the given arguments,
+// fetches the captured exchanges of the service from the admin API, sends
+// their requests to the target and writes a comparison of the status codes to
+// the given writer. Header fields that were redacted when they were captured
+// are left out, so the target must not require the credentials of aperture.
+func runReplay(args []string, out io.Writer) error {
+	cfg := &replayConfig{}
+	if _, err := flags.ParseArgs(cfg, args); err != nil {
+		return fmt.Errorf("unable to parse replay options: %w", err)
+	}
+
+	exchanges, err := fetchCaptures(cfg)
+	if err != nil {
+		return err
+	}
+
+	ids := make(map[uint64]bool, len(cfg.IDs))
+	for _, id := range cfg.IDs {
+		ids[id] = true
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify, // nolint:gosec
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   cfg.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(
+		w, "ID\tMETHOD\tURI\tCAPTURED\tREPLAYED\tDURATION\tNOTE",
+	)
+	for _, exchange := range exchanges {
+		if len(ids) > 0 && !ids[exchange.ID] {
+			continue
+		}
+
+		start := time.Now()
+		status, err := replayExchange(client, cfg.Target, exchange)
+		duration := time.Since(start)
+
+		replayed := fmt.Sprintf("%d", status)
+		var note string
+		switch {
+		case err != nil:
+			replayed = "-"
+			note = err.Error()
+
+		case exchange.RequestTruncated:
+			note = "request body was truncated"
+		}
+
+		_, _ = fmt.Fprintf(
+			w, "%d\t%s\t%s\t%d\t%s\t%v\t%s\n", exchange.ID,
+			exchange.Method, exchange.URI, exchange.Status,
+			replayed, duration.Round(time.Millisecond), note,
+		)
+	}
+
+	return w.Flush()
+}
+
+// fetchCaptures fetches the captured exchanges of the service from the admin
+// API.
+func fetchCaptures(cfg *replayConfig) ([]*proxy.CapturedExchange, error) {
+	capturesURL := url.URL{
+		Scheme: "http",
+		Host:   cfg.AdminAddr,
+		Path: adminServicesPath + url.PathEscape(cfg.Service) +
+			adminCapturesSuffix,
+	}
+
+	client := &http.Client{Timeout: cfg.Timeout}
+	resp, err := client.Get(capturesURL.String())
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach admin API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("admin API returned %v: %s",
+			resp.Status, bytes.TrimSpace(body))
+	}
+
+	var captures struct {
+		Exchanges []*proxy.CapturedExchange `json:"exchanges"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&captures); err != nil {
+		return nil, fmt.Errorf("unable to decode captures: %v", err)
+	}
+
+	return captures.Exchanges, nil
+}
+
+// replayExchange sends the captured request to the target and returns the
+// status code of the response.
+func replayExchange(client *http.Client, target string,
+	exchange *proxy.CapturedExchange) (int, error) {
+
+	req, err := http.NewRequest(
+		exchange.Method, strings.TrimSuffix(target, "/")+exchange.URI,
+		bytes.NewReader(exchange.RequestBody),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	for name, values := range exchange.RequestHeader {
+		if replaySkipHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		for _, value := range values {
+			if value == proxy.RedactedValue {
+				continue
+			}
+			req.Header.Add(name, value)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,243 @@
+package aperture
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+)
+
+const (
+	// configSchemaCommand is the name of the command that writes a JSON
+	// Schema of the config file.
+	configSchemaCommand = "configschema"
+
+	// jsonSchemaVersion is the draft of JSON Schema the schema is written
+	// in, which is the one most editors and validators support.
+	jsonSchemaVersion = "http://json-schema.org/draft-07/schema#"
+
+	// durationPattern matches the durations of the config file, like 1m30s.
+	durationPattern = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$|^0$`
+)
+
+var (
+	// durationType is the type of durations, which are written as strings
+	// in the config file.
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// jsonSchema is a subset of JSON Schema that is enough to describe the config
+// file.
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 interface{}            `json:"type,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	Minimum              *int                   `json:"minimum,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	AdditionalProperties interface{}            `json:"additionalProperties,omitempty"`
+}
+
+// runConfigSchema parses the options of the configschema command from the
+// given arguments and writes the JSON Schema of the config file to the given
+// writer, so editors and CI pipelines can validate config files before they're
+// deployed. Like the strictconfig option, the schema rejects unknown fields.
+func runConfigSchema(args []string, out io.Writer) error {
+	if _, err := flags.ParseArgs(&struct{}{}, args); err != nil {
+		return fmt.Errorf("unable to parse configschema options: %w",
+			err)
+	}
+
+	schema, err := configSchema()
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(schema)
+}
+
+// configSchema returns the JSON Schema of the config file.
+func configSchema() (*jsonSchema, error) {
+	schema, err := typeSchema(
+		reflect.TypeOf(Config{}), make(map[reflect.Type]bool),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	schema.Schema = jsonSchemaVersion
+	schema.Title = "aperture configuration"
+	return schema, nil
+}
+
+// typeSchema returns the schema of the values of the given type, as they're
+// decoded from YAML. The types that are currently being described are tracked
+// in visiting, so recursive types end in a schema that allows any value.
+func typeSchema(t reflect.Type, visiting map[reflect.Type]bool) (*jsonSchema,
+	error) {
+
+	if t == durationType {
+		return &jsonSchema{
+			Type:    []string{"string", "integer"},
+			Pattern: durationPattern,
+		}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), visiting)
+
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}, nil
+
+	case reflect.String:
+		return &jsonSchema{Type: "string"}, nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+
+		return &jsonSchema{Type: "integer"}, nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+
+		minimum := 0
+		return &jsonSchema{Type: "integer", Minimum: &minimum}, nil
+
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}, nil
+
+	case reflect.Slice, reflect.Array:
+		items, err := typeSchema(t.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonSchema{Type: "array", Items: items}, nil
+
+	case reflect.Map:
+		values, err := typeSchema(t.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonSchema{
+			Type:                 "object",
+			AdditionalProperties: values,
+		}, nil
+
+	case reflect.Struct:
+		if visiting[t] {
+			return &jsonSchema{}, nil
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+
+		return structSchema(t, visiting)
+
+	// Values like handlers can't be set in the config file, so fields of
+	// these types must be excluded by their yaml tag.
+	default:
+		return nil, fmt.Errorf("unsupported config type %v", t)
+	}
+}
+
+// structSchema returns the schema of a struct with one property per field,
+// named like the YAML decoder names them.
+func structSchema(t reflect.Type, visiting map[reflect.Type]bool) (*jsonSchema,
+	error) {
+
+	schema := &jsonSchema{
+		Type:                 "object",
+		Properties:           make(map[string]*jsonSchema),
+		AdditionalProperties: false,
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := strings.ToLower(field.Name)
+		yamlTag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		switch yamlTag {
+		case "-":
+			continue
+
+		case "":
+
+		default:
+			name = yamlTag
+		}
+
+		fieldSchema, err := typeSchema(field.Type, visiting)
+		if err != nil {
+			return nil, fmt.Errorf("%v.%v: %v", t.Name(),
+				field.Name, err)
+		}
+
+		// The options of the command line have the same descriptions
+		// and choices as the fields of the file.
+		fieldSchema.Description = field.Tag.Get("description")
+		if choices := tagValues(field.Tag, "choice"); len(choices) > 0 {
+			if fieldSchema.Items != nil {
+				fieldSchema.Items.Enum = choices
+			} else {
+				fieldSchema.Enum = choices
+			}
+		}
+
+		schema.Properties[name] = fieldSchema
+	}
+
+	return schema, nil
+}
+
+// tagValues returns all values of the given key in the struct tag. Unlike
+// reflect.StructTag.Get, it returns the values of keys that are repeated, like
+// the choices of an option.
+func tagValues(tag reflect.StructTag, key string) []string {
+	var values []string
+	for tag != "" {
+		// The tag is a list of key:"value" pairs separated by spaces.
+		tag = reflect.StructTag(strings.TrimLeft(string(tag), " "))
+		colon := strings.Index(string(tag), ":")
+		if colon <= 0 || colon+1 >= len(tag) || tag[colon+1] != '"' {
+			break
+		}
+		name := string(tag[:colon])
+		tag = tag[colon+1:]
+
+		// Find the closing quote of the value, skipping escaped ones.
+		end := 1
+		for end < len(tag) && tag[end] != '"' {
+			if tag[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(tag) {
+			break
+		}
+
+		value, err := strconv.Unquote(string(tag[:end+1]))
+		if err != nil {
+			break
+		}
+		tag = tag[end+1:]
+
+		if name == key {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,100 @@
+package aperture
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TestConfigSchema tests that the JSON Schema of the config file names the
+// fields like the YAML decoder, carries their descriptions and choices and
+// rejects unknown fields.
+func TestConfigSchema(t *testing.T) {
+	var out bytes.Buffer
+	if err := runConfigSchema(nil, &out); err != nil {
+		t.Fatalf("unable to write schema: %v", err)
+	}
+
+	var schema jsonSchema
+	if err := json.Unmarshal(out.Bytes(), &schema); err != nil {
+		t.Fatalf("unable to decode schema: %v", err)
+	}
+	if schema.Schema != jsonSchemaVersion {
+		t.Fatalf("unexpected schema version %q", schema.Schema)
+	}
+	if schema.AdditionalProperties != false {
+		t.Fatalf("unknown fields aren't rejected")
+	}
+
+	listenAddr := schema.Properties["listenaddr"]
+	if listenAddr == nil || listenAddr.Type != "string" ||
+		listenAddr.Description == "" {
+
+		t.Fatalf("unexpected listenaddr schema %+v", listenAddr)
+	}
+	if _, ok := schema.Properties["staticfs"]; ok {
+		t.Fatalf("field excluded from YAML is part of the schema")
+	}
+
+	network := schema.Properties["authenticator"].Properties["network"]
+	expectedChoices := []string{"regtest", "simnet", "testnet", "mainnet"}
+	if !reflect.DeepEqual(network.Enum, expectedChoices) {
+		t.Fatalf("unexpected network choices %v", network.Enum)
+	}
+
+	services := schema.Properties["services"]
+	if services.Type != "array" || services.Items == nil {
+		t.Fatalf("unexpected services schema %+v", services)
+	}
+	if _, ok := services.Items.Properties["hostregexp"]; !ok {
+		t.Fatalf("service schema has no hostregexp")
+	}
+	if _, ok := services.Items.Properties["handler"]; ok {
+		t.Fatalf("service handler is part of the schema")
+	}
+
+	timeout := schema.Properties["dns"].Properties["timeout"]
+	if timeout.Pattern != durationPattern {
+		t.Fatalf("unexpected duration schema %+v", timeout)
+	}
+}
+
+// TestSampleConfigStrict tests that the sample config only uses fields that
+// exist, so it passes strict parsing.
+func TestSampleConfigStrict(t *testing.T) {
+	b, err := ioutil.ReadFile("sample-conf.yaml")
+	if err != nil {
+		t.Fatalf("unable to read sample config: %v", err)
+	}
+
+	if err := yaml.UnmarshalStrict(b, &Config{}); err != nil {
+		t.Fatalf("sample config isn't strict: %v", err)
+	}
+
+	misspelled := []byte("listenadr: localhost:8081")
+	err = yaml.UnmarshalStrict(misspelled, &Config{})
+	if err == nil {
+		t.Fatalf("misspelled field was accepted")
+	}
+}
+
+// TestTagValues tests that all values of repeated struct tag keys are found.
+func TestTagValues(t *testing.T) {
+	tag := reflect.StructTag(
+		`long:"x" choice:"a" description:"say \"b\"" choice:"c d"`,
+	)
+
+	choices := tagValues(tag, "choice")
+	if !reflect.DeepEqual(choices, []string{"a", "c d"}) {
+		t.Fatalf("unexpected choices %v", choices)
+	}
+
+	descriptions := tagValues(tag, "description")
+	if !reflect.DeepEqual(descriptions, []string{`say "b"`}) {
+		t.Fatalf("unexpected description %v", descriptions)
+	}
+}
@@ -0,0 +1,235 @@
+package aperture
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// secretCacheRetryDelay is the time we wait before watching the
+	// secrets again after the watch failed.
+	secretCacheRetryDelay = 5 * time.Second
+)
+
+// cachedSecretStore is a secret store backed by an etcd cluster that keeps the
+// secrets it looked up in memory, so tokens can be verified without a round
+// trip to etcd. A watch on the secrets prefix removes revoked secrets from the
+// cache, also when they're revoked by another instance. While the watch isn't
+// running, secrets are always looked up in etcd.
+type cachedSecretStore struct {
+	*secretStore
+
+	// size is the maximum number of cached secrets.
+	size int
+
+	mu sync.RWMutex
+
+	// secrets are the cached secrets, keyed by the etcd key of their
+	// identifier.
+	secrets map[string][lsat.SecretSize]byte
+
+	// watching is true while the watch is running, so the cache is up to
+	// date up to watchedRev.
+	watching bool
+
+	// watchedRev is the last etcd revision the watch has seen.
+	watchedRev int64
+
+	// invalidations counts the secrets that were revoked since the watch
+	// started, so a lookup that raced with a revocation isn't cached.
+	invalidations uint64
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// A compile-time constraint to ensure cachedSecretStore implements
+// mint.SecretStore.
+var _ mint.SecretStore = (*cachedSecretStore)(nil)
+
+// newCachedSecretStore creates a new secret store that caches up to size
+// secrets of the given store.
+func newCachedSecretStore(store *secretStore, size int) *cachedSecretStore {
+	return &cachedSecretStore{
+		secretStore: store,
+		size:        size,
+		secrets:     make(map[string][lsat.SecretSize]byte),
+		quit:        make(chan struct{}),
+	}
+}
+
+// GetSecret returns the secret that corresponds to the given hash from the
+// cache, or looks it up in etcd and caches it if it isn't cached yet.
+//
+// NOTE: This is part of the mint.SecretStore interface.
+func (s *cachedSecretStore) GetSecret(ctx context.Context,
+	id [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
+
+	key := idKey(id)
+
+	s.mu.RLock()
+	secret, ok := s.secrets[key]
+	watching := s.watching
+	watchedRev := s.watchedRev
+	invalidations := s.invalidations
+	s.mu.RUnlock()
+	if ok {
+		return secret, nil
+	}
+
+	secret, rev, err := s.lookupSecret(ctx, id)
+	if err != nil || !watching {
+		return secret, err
+	}
+
+	// The secret is only cached if the lookup saw all revocations the
+	// watch has seen and none were seen while it was looked up, otherwise
+	// a revoked secret could end up in the cache.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.watching || rev < watchedRev ||
+		s.invalidations != invalidations {
+
+		return secret, nil
+	}
+	if len(s.secrets) >= s.size {
+		for evicted := range s.secrets {
+			delete(s.secrets, evicted)
+			break
+		}
+	}
+	s.secrets[key] = secret
+
+	return secret, nil
+}
+
+// RevokeSecret removes the secret that corresponds to the given hash from etcd
+// and the cache.
+//
+// NOTE: This is part of the mint.SecretStore interface.
+func (s *cachedSecretStore) RevokeSecret(ctx context.Context,
+	id [sha256.Size]byte) error {
+
+	if err := s.secretStore.RevokeSecret(ctx, id); err != nil {
+		return err
+	}
+
+	s.invalidate(idKey(id))
+	return nil
+}
+
+// invalidate removes the secret with the given key from the cache.
+func (s *cachedSecretStore) invalidate(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.secrets, key)
+	s.invalidations++
+}
+
+// setWatching marks the watch as running as of the given revision, or as
+// stopped. Secrets may be revoked without us noticing while it's stopped, so
+// the cache is cleared then.
+func (s *cachedSecretStore) setWatching(watching bool, rev int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.watching = watching
+	if rev > s.watchedRev {
+		s.watchedRev = rev
+	}
+	if !watching {
+		s.secrets = make(map[string][lsat.SecretSize]byte)
+	}
+}
+
+// Start watches the secrets prefix for revoked secrets in the background.
+func (s *cachedSecretStore) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		for {
+			err := s.watch()
+			s.setWatching(false, 0)
+
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+
+			log.Errorf("Error watching secrets, retrying in %v: %v",
+				secretCacheRetryDelay, err)
+
+			select {
+			case <-time.After(secretCacheRetryDelay):
+			case <-s.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops watching the secrets.
+func (s *cachedSecretStore) Stop() {
+	close(s.quit)
+	s.wg.Wait()
+}
+
+// watch removes the secrets that are deleted in etcd from the cache until
+// we're shutting down or the watch fails. The cache is only used once the
+// watch is established.
+func (s *cachedSecretStore) watch() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-s.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	prefix := strings.Join(
+		[]string{topLevelKey, secretsPrefix, ""}, etcdKeyDelimeter,
+	)
+	watchChan := s.Client.Watch(
+		clientv3.WithRequireLeader(ctx), prefix, clientv3.WithPrefix(),
+		clientv3.WithCreatedNotify(),
+	)
+	for resp := range watchChan {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+
+		// Secrets are only ever created and deleted, so every event
+		// other than the creation of a secret invalidates it.
+		for _, event := range resp.Events {
+			if event.Type == clientv3.EventTypePut &&
+				event.IsCreate() {
+
+				continue
+			}
+			s.invalidate(string(event.Kv.Key))
+			log.Debugf("Removed secret %s from cache", event.Kv.Key)
+		}
+
+		s.setWatching(true, resp.Header.Revision)
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.New("watch closed")
+}
@@ -35,6 +35,13 @@ func idKey(id [sha256.Size]byte) string {
 // secretStore is a store of LSAT secrets backed by an etcd cluster.
 type secretStore struct {
 	*clientv3.Client
+
+	// readClient is the client secrets are looked up with. It can be
+	// connected to a nearer endpoint than the main client.
+	readClient *clientv3.Client
+
+	// readOpts are the options of secret lookups.
+	readOpts []clientv3.OpOption
 }
 
 // A compile-time constraint to ensure secretStore implements mint.SecretStore.
@@ -43,7 +50,25 @@ var _ mint.SecretStore = (*secretStore)(nil)
 // newSecretStore instantiates a new LSAT secrets store backed by an etcd
 // cluster.
 func newSecretStore(client *clientv3.Client) *secretStore {
-	return &secretStore{Client: client}
+	return &secretStore{Client: client, readClient: client}
+}
+
+// newSecretStoreWithReads instantiates a new LSAT secrets store that looks up
+// secrets through the given read client. If serializable is true, lookups are
+// answered by the etcd member the read client is connected to, even if it's a
+// follower, instead of going through the cluster leader. Such a member might
+// not know about a secret that was just created or revoked yet, so a secret
+// that isn't found is looked up again through the leader.
+func newSecretStoreWithReads(client, readClient *clientv3.Client,
+	serializable bool) *secretStore {
+
+	store := &secretStore{Client: client, readClient: readClient}
+	if serializable {
+		store.readOpts = append(
+			store.readOpts, clientv3.WithSerializable(),
+		)
+	}
+	return store
 }
 
 // NewSecret creates a new cryptographically random secret which is keyed by the
@@ -65,21 +90,39 @@ func (s *secretStore) NewSecret(ctx context.Context,
 func (s *secretStore) GetSecret(ctx context.Context,
 	id [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
 
-	resp, err := s.Get(ctx, idKey(id))
+	secret, _, err := s.lookupSecret(ctx, id)
+	return secret, err
+}
+
+// lookupSecret returns the secret that corresponds to the given hash and the
+// etcd revision it was read at.
+func (s *secretStore) lookupSecret(ctx context.Context,
+	id [sha256.Size]byte) ([lsat.SecretSize]byte, int64, error) {
+
+	key := idKey(id)
+	resp, err := s.readClient.Get(ctx, key, s.readOpts...)
+
+	// Only the leader is guaranteed to know about all secrets, so we ask
+	// it before we reject a token.
+	if (err != nil || len(resp.Kvs) == 0) &&
+		(s.readClient != s.Client || len(s.readOpts) > 0) {
+
+		resp, err = s.Get(ctx, key)
+	}
 	if err != nil {
-		return [lsat.SecretSize]byte{}, err
+		return [lsat.SecretSize]byte{}, 0, err
 	}
 	if len(resp.Kvs) == 0 {
-		return [lsat.SecretSize]byte{}, mint.ErrSecretNotFound
+		return [lsat.SecretSize]byte{}, 0, mint.ErrSecretNotFound
 	}
 	if len(resp.Kvs[0].Value) != lsat.SecretSize {
-		return [lsat.SecretSize]byte{}, fmt.Errorf("invalid secret "+
+		return [lsat.SecretSize]byte{}, 0, fmt.Errorf("invalid secret "+
 			"size %v", len(resp.Kvs[0].Value))
 	}
 
 	var secret [lsat.SecretSize]byte
 	copy(secret[:], resp.Kvs[0].Value)
-	return secret, nil
+	return secret, resp.Header.Revision, nil
 }
 
 // RevokeSecret removes the cryptographically random secret that corresponds to
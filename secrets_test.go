@@ -3,6 +3,7 @@ package aperture
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
 	"crypto/sha256"
 	"io/ioutil"
 	"net/url"
@@ -64,7 +65,7 @@ func etcdSetup(t *testing.T) (*clientv3.Client, func()) {
 // assertSecretExists is a helper to determine if a secret for the given
 // identifier exists in the store. If it exists, its value is compared against
 // the expected secret.
-func assertSecretExists(t *testing.T, store *secretStore, id [sha256.Size]byte,
+func assertSecretExists(t *testing.T, store mint.SecretStore, id [sha256.Size]byte,
 	expSecret *[lsat.SecretSize]byte) {
 
 	t.Helper()
@@ -86,14 +87,31 @@ func assertSecretExists(t *testing.T, store *secretStore, id [sha256.Size]byte,
 }
 
 // TestSecretStore ensures the different operations of the secretStore behave as
-// expected.
+// expected, both with linearizable and with serializable secret lookups.
 func TestSecretStore(t *testing.T) {
 	etcdClient, serverCleanup := etcdSetup(t)
 	defer etcdClient.Close()
 	defer serverCleanup()
 
+	stores := []mint.SecretStore{
+		newSecretStore(etcdClient),
+		newSecretStoreWithReads(etcdClient, etcdClient, true),
+		newKMSSecretStore(etcdClient, &mockSigner{}),
+	}
+	for _, store := range stores {
+		testSecretStore(t, store)
+	}
+}
+
+// TestMemSecretStore ensures the operations of the in-memory secret store
+// behave like those of the etcd-based one.
+func TestMemSecretStore(t *testing.T) {
+	testSecretStore(t, newMemSecretStore())
+}
+
+// testSecretStore runs the secret store operations against the given store.
+func testSecretStore(t *testing.T, store mint.SecretStore) {
 	ctx := context.Background()
-	store := newSecretStore(etcdClient)
 
 	// Create a test ID and ensure a secret doesn't exist for it yet as we
 	// haven't created one.
@@ -114,3 +132,78 @@ func TestSecretStore(t *testing.T) {
 	}
 	assertSecretExists(t, store, id, nil)
 }
+
+// mockSigner is a KMS signer that uses a fixed HMAC key.
+type mockSigner struct{}
+
+// MAC returns the HMAC-SHA256 of the given data.
+func (m *mockSigner) MAC(_ context.Context, data []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, []byte("root key"))
+	_, _ = mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// TestCachedSecretStore ensures secrets are served from the cache once they
+// were looked up, and removed from it when they're revoked, both locally and
+// by another instance.
+func TestCachedSecretStore(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	store := newCachedSecretStore(newSecretStore(etcdClient), 10)
+	store.Start()
+	defer store.Stop()
+
+	testSecretStore(t, store)
+
+	// Wait for the watch to be established, otherwise secrets aren't
+	// cached.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		store.mu.RLock()
+		watching := store.watching
+		store.mu.RUnlock()
+		if watching {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("secrets aren't watched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx := context.Background()
+	var id [sha256.Size]byte
+	copy(id[:], bytes.Repeat([]byte("B"), 32))
+	secret, err := store.NewSecret(ctx, id)
+	if err != nil {
+		t.Fatalf("unable to generate new secret: %v", err)
+	}
+	assertSecretExists(t, store, id, &secret)
+
+	cached := func() bool {
+		store.mu.RLock()
+		defer store.mu.RUnlock()
+
+		_, ok := store.secrets[idKey(id)]
+		return ok
+	}
+	if !cached() {
+		t.Fatalf("expected secret to be cached")
+	}
+
+	// A secret revoked by another instance is removed from the cache by
+	// the watch.
+	if err := newSecretStore(etcdClient).RevokeSecret(ctx, id); err != nil {
+		t.Fatalf("unable to revoke secret: %v", err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for cached() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected revoked secret to be removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertSecretExists(t, store, id, nil)
+}
@@ -0,0 +1,261 @@
+package aperture
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightninglabs/lndclient"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/tor"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// selfTestTimeout is the maximum time a single self-test check may
+	// take.
+	selfTestTimeout = 10 * time.Second
+
+	// selfTestServiceName is the name of the service the throwaway token
+	// is minted for if no services are configured.
+	selfTestServiceName = "aperture-selftest"
+)
+
+// selfTestResult is the result of a single self-test check.
+type selfTestResult struct {
+	name   string
+	err    error
+	detail string
+}
+
+// selfTest checks all external dependencies of the configuration without
+// serving any requests.
+type selfTest struct {
+	cfg        *Config
+	etcdClient *clientv3.Client
+	results    []*selfTestResult
+}
+
+// runSelfTest runs all self-test checks, writes a summary to the given writer
+// and returns an error if any of the checks failed.
+func runSelfTest(cfg *Config, out io.Writer) error {
+	s := &selfTest{cfg: cfg}
+	defer func() {
+		if s.etcdClient != nil {
+			_ = s.etcdClient.Close()
+		}
+	}()
+
+	if cfg.Store != storeMemory {
+		s.check("etcd", s.checkEtcd)
+	}
+	s.check("token", s.checkToken)
+	if !cfg.Authenticator.Disable && !cfg.Dev {
+		s.check("lnd", s.checkLnd)
+	}
+	if cfg.Tor != nil && (cfg.Tor.V2 || cfg.Tor.V3) {
+		s.check("tor", s.checkTor)
+	}
+	for _, service := range cfg.Services {
+		address := service.Address
+		s.check("backend "+service.Name, func() (string, error) {
+			return checkBackend(address)
+		})
+	}
+
+	var failed int
+	for _, result := range s.results {
+		status, detail := "PASS", result.detail
+		if result.err != nil {
+			status, detail = "FAIL", result.err.Error()
+			failed++
+		}
+		_, _ = fmt.Fprintf(out, "%s  %-24s %s\n", status, result.name,
+			detail)
+	}
+	_, _ = fmt.Fprintf(out, "%d checks passed, %d failed\n",
+		len(s.results)-failed, failed)
+
+	if failed > 0 {
+		return fmt.Errorf("self-test failed")
+	}
+	return nil
+}
+
+// check runs a single check and records its result.
+func (s *selfTest) check(name string, fn func() (string, error)) {
+	detail, err := fn()
+	s.results = append(s.results, &selfTestResult{
+		name:   name,
+		err:    err,
+		detail: detail,
+	})
+}
+
+// checkEtcd connects to all configured etcd endpoints.
+func (s *selfTest) checkEtcd() (string, error) {
+	endpoints := etcdEndpoints(s.cfg.Etcd)
+	client, err := newEtcdClient(s.cfg.Etcd, endpoints)
+	if err != nil {
+		return "", err
+	}
+
+	for _, endpoint := range endpoints {
+		ctx, cancel := context.WithTimeout(
+			context.Background(), selfTestTimeout,
+		)
+		_, err := client.Status(ctx, endpoint)
+		cancel()
+		if err != nil {
+			_ = client.Close()
+			return "", fmt.Errorf("%s: %v", endpoint, err)
+		}
+	}
+
+	s.etcdClient = client
+	return fmt.Sprintf("reached %v", endpoints), nil
+}
+
+// checkToken mints a throwaway token, verifies it and revokes its secret
+// again. This makes sure the secrets can be written to and read from etcd.
+func (s *selfTest) checkToken() (string, error) {
+	var secrets mint.SecretStore = newMemSecretStore()
+	if s.cfg.Store != storeMemory {
+		if s.etcdClient == nil {
+			return "", fmt.Errorf("etcd unavailable")
+		}
+		secrets = newSecretStore(s.etcdClient)
+	}
+
+	challenger := &selfTestChallenger{}
+	minter := mint.New(&mint.Config{
+		Challenger:     challenger,
+		Secrets:        secrets,
+		ServiceLimiter: newStaticServiceLimiter(s.cfg.Services),
+	})
+
+	service := lsat.Service{Name: selfTestServiceName, Tier: lsat.BaseTier}
+	if len(s.cfg.Services) > 0 {
+		service.Name = s.cfg.Services[0].Name
+		service.Price = s.cfg.Services[0].Price
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), selfTestTimeout,
+	)
+	defer cancel()
+
+	mac, _, err := minter.MintLSAT(ctx, service)
+	if err != nil {
+		return "", fmt.Errorf("unable to mint token: %v", err)
+	}
+	defer func() {
+		_ = secrets.RevokeSecret(ctx, sha256.Sum256(mac.Id()))
+	}()
+
+	err = minter.VerifyLSAT(ctx, &mint.VerificationParams{
+		Macaroon:      mac,
+		Preimage:      challenger.preimage,
+		TargetService: service.Name,
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to verify token: %v", err)
+	}
+
+	return fmt.Sprintf("minted and verified token for %s", service.Name),
+		nil
+}
+
+// checkLnd creates a test invoice with the configured macaroon and cancels it
+// right away.
+func (s *selfTest) checkLnd() (string, error) {
+	auth := s.cfg.Authenticator
+	conn, err := lndclient.NewBasicConn(
+		auth.LndHost, auth.TLSPath, auth.MacDir, auth.Network,
+		lndclient.MacFilename(invoiceMacaroonName),
+	)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), selfTestTimeout,
+	)
+	defer cancel()
+
+	resp, err := lnrpc.NewLightningClient(conn).AddInvoice(
+		ctx, &lnrpc.Invoice{
+			Memo:   "aperture self-test",
+			Value:  1,
+			Expiry: 60,
+		},
+	)
+	if err != nil {
+		return "", fmt.Errorf("unable to create invoice: %v", err)
+	}
+
+	_, err = invoicesrpc.NewInvoicesClient(conn).CancelInvoice(
+		ctx, &invoicesrpc.CancelInvoiceMsg{PaymentHash: resp.RHash},
+	)
+	if err != nil {
+		return "", fmt.Errorf("unable to cancel invoice: %v", err)
+	}
+
+	return fmt.Sprintf("created and canceled invoice at %s",
+		auth.LndHost), nil
+}
+
+// checkTor connects to the Tor control port.
+func (s *selfTest) checkTor() (string, error) {
+	controller := tor.NewController(s.cfg.Tor.Control, "", "")
+	if err := controller.Start(); err != nil {
+		return "", err
+	}
+	if err := controller.Stop(); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("connected to %s", s.cfg.Tor.Control), nil
+}
+
+// checkBackend opens a TCP connection to the address of a backend.
+func checkBackend(address string) (string, error) {
+	conn, err := net.DialTimeout("tcp", address, selfTestTimeout)
+	if err != nil {
+		return "", err
+	}
+	_ = conn.Close()
+
+	return fmt.Sprintf("reached %s", address), nil
+}
+
+// selfTestChallenger is a challenger that doesn't create invoices but knows the
+// preimage of the last challenge, so the token of the challenge can be
+// verified.
+type selfTestChallenger struct {
+	preimage lntypes.Preimage
+}
+
+// NewChallenge returns an empty payment request and the hash of a random
+// preimage.
+//
+// NOTE: This is part of the mint.Challenger interface.
+func (c *selfTestChallenger) NewChallenge(_ int64) (string, lntypes.Hash,
+	error) {
+
+	if _, err := rand.Read(c.preimage[:]); err != nil {
+		return "", lntypes.ZeroHash, err
+	}
+	return "", c.preimage.Hash(), nil
+}
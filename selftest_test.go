@@ -0,0 +1,61 @@
+package aperture
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSelfTest tests that the self-test reports reachable dependencies as
+// passed and unreachable backends as failed.
+func TestSelfTest(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+
+	// Find an address nobody listens on by closing a listener again.
+	unreachable, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachableAddr := unreachable.Addr().String()
+	require.NoError(t, unreachable.Close())
+
+	cfg := &Config{
+		Etcd: &EtcdConfig{
+			Host: etcdClient.Endpoints()[0],
+		},
+		Authenticator: &AuthConfig{Disable: true},
+		Services: []*proxy.Service{{
+			Name:    "up",
+			Address: backend.Addr().String(),
+			Price:   1,
+		}},
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, runSelfTest(cfg, &out))
+	require.Contains(t, out.String(), "3 checks passed, 0 failed")
+
+	cfg.Services = append(cfg.Services, &proxy.Service{
+		Name:    "down",
+		Address: unreachableAddr,
+	})
+	out.Reset()
+	require.Error(t, runSelfTest(cfg, &out))
+
+	var failed []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "FAIL") {
+			failed = append(failed, line)
+		}
+	}
+	require.Len(t, failed, 1)
+	require.Contains(t, failed[0], "backend down")
+}
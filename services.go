@@ -2,13 +2,23 @@ package aperture
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
 
 	"github.com/lightninglabs/aperture/lsat"
 	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightninglabs/aperture/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 )
 
-// staticServiceLimiter provides static restrictions for services.
+// staticServiceLimiter provides static restrictions for services. The
+// restrictions are looked up by the name and tier of a service, so they
+// apply to tokens of any price.
 //
 // TODO(wilmer): use etcd instead.
 type staticServiceLimiter struct {
@@ -28,9 +38,8 @@ func newStaticServiceLimiter(proxyServices []*proxy.Service) *staticServiceLimit
 
 	for _, proxyService := range proxyServices {
 		s := lsat.Service{
-			Name:  proxyService.Name,
-			Tier:  lsat.BaseTier,
-			Price: proxyService.Price,
+			Name: proxyService.Name,
+			Tier: lsat.BaseTier,
 		}
 		capabilities[s] = lsat.NewCapabilitiesCaveat(
 			proxyService.Name, proxyService.Capabilities,
@@ -39,6 +48,52 @@ func newStaticServiceLimiter(proxyServices []*proxy.Service) *staticServiceLimit
 			caveat := lsat.Caveat{Condition: cond, Value: value}
 			constraints[s] = append(constraints[s], caveat)
 		}
+
+		// Each tier replaces the capabilities and constraints of the
+		// base tier with its own, the other constraints below apply to
+		// all tiers.
+		tiers := []lsat.Service{s}
+		for i, tierCfg := range proxyService.Tiers {
+			tier := lsat.Service{
+				Name: proxyService.Name,
+				Tier: lsat.ServiceTier(i + 1),
+			}
+			capabilities[tier] = lsat.NewCapabilitiesCaveat(
+				proxyService.Name, tierCfg.Capabilities,
+			)
+			for cond, value := range tierCfg.Constraints {
+				caveat := lsat.Caveat{
+					Condition: cond,
+					Value:     value,
+				}
+				constraints[tier] = append(
+					constraints[tier], caveat,
+				)
+			}
+			tiers = append(tiers, tier)
+		}
+
+		for _, s := range tiers {
+			// The nonce requirement is also added to the tokens
+			// themselves, so it stays in place for any service a
+			// token is used with.
+			if proxyService.RequireNonce {
+				caveat := lsat.NewCaveat(
+					lsat.CondNonce, "required",
+				)
+				constraints[s] = append(constraints[s], caveat)
+			}
+
+			// Tokens of services billed per message carry the
+			// number of messages they pay for.
+			if proxyService.Billing.PerMessage {
+				caveat := lsat.NewMessagesCaveat(
+					proxyService.Name,
+					proxyService.Billing.Messages,
+				)
+				constraints[s] = append(constraints[s], caveat)
+			}
+		}
 	}
 
 	return &staticServiceLimiter{
@@ -54,7 +109,7 @@ func (l *staticServiceLimiter) ServiceCapabilities(ctx context.Context,
 
 	res := make([]lsat.Caveat, 0, len(services))
 	for _, service := range services {
-		capabilities, ok := l.capabilities[service]
+		capabilities, ok := l.capabilities[limiterKey(service)]
 		if !ok {
 			continue
 		}
@@ -71,7 +126,7 @@ func (l *staticServiceLimiter) ServiceConstraints(ctx context.Context,
 
 	res := make([]lsat.Caveat, 0, len(services))
 	for _, service := range services {
-		constraints, ok := l.constraints[service]
+		constraints, ok := l.constraints[limiterKey(service)]
 		if !ok {
 			continue
 		}
@@ -80,3 +135,113 @@ func (l *staticServiceLimiter) ServiceConstraints(ctx context.Context,
 
 	return res, nil
 }
+
+// limiterKey returns the key the restrictions of the given service are looked
+// up with, which is its name and tier.
+func limiterKey(service lsat.Service) lsat.Service {
+	return lsat.Service{Name: service.Name, Tier: service.Tier}
+}
+
+// dialService creates a gRPC client connection to the backend of the given
+// service. The returned metadata contains the header fields that are configured
+// to be sent to the backend with each call.
+func dialService(service *proxy.Service) (*grpc.ClientConn, metadata.MD,
+	error) {
+
+	var opts []grpc.DialOption
+	switch {
+	case service.Protocol != "https":
+		opts = append(opts, grpc.WithInsecure())
+
+	case service.TLSCertPath != "":
+		creds, err := credentials.NewClientTLSFromFile(
+			service.TLSCertPath, "",
+		)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to load TLS cert "+
+				"of service %s: %v", service.Name, err)
+		}
+		opts = append(opts, grpc.WithTransportCredentials(creds))
+
+	// Without a certificate we use the same behavior as the proxy itself
+	// and don't validate the backend's certificate.
+	default:
+		opts = append(opts, grpc.WithTransportCredentials(
+			credentials.NewTLS(&tls.Config{
+				InsecureSkipVerify: true,
+			}),
+		))
+	}
+
+	// Large streaming calls need bigger flow control windows than the
+	// defaults of gRPC to make use of the available bandwidth.
+	if service.HTTP2.InitialWindowSize != 0 {
+		opts = append(opts, grpc.WithInitialWindowSize(
+			service.HTTP2.InitialWindowSize,
+		))
+	}
+	if service.HTTP2.InitialConnWindowSize != 0 {
+		opts = append(opts, grpc.WithInitialConnWindowSize(
+			service.HTTP2.InitialConnWindowSize,
+		))
+	}
+
+	// The message size limit of the service applies to the calls we make
+	// ourselves as well.
+	if max := int(service.Limits.MaxMessageSize); max != 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(max), grpc.MaxCallSendMsgSize(max),
+		))
+	}
+
+	if ka := service.Keepalive; ka.Time != 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(
+			keepalive.ClientParameters{
+				Time:                ka.Time,
+				Timeout:             ka.Timeout,
+				PermitWithoutStream: ka.PermitWithoutStream,
+			},
+		))
+	}
+
+	// The instances of discovered backends are looked up whenever a new
+	// connection is made, so a replaced instance is found on reconnect.
+	if contextDialer := discoveryDialer(service); contextDialer != nil {
+		opts = append(opts, grpc.WithContextDialer(contextDialer))
+	}
+
+	// The connection is established lazily, so a backend that is not up
+	// yet is no reason to fail here.
+	conn, err := grpc.Dial(service.Address, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to dial service %s: %v",
+			service.Name, err)
+	}
+
+	headers := metadata.MD{}
+	for key, value := range service.Headers {
+		headers.Set(strings.ToLower(key), value)
+	}
+
+	return conn, headers, nil
+}
+
+// discoveryDialer returns the dialer of the gRPC connections to a service that
+// discovers the instances of its backend, or nil if it has a fixed address.
+func discoveryDialer(service *proxy.Service) func(context.Context,
+	string) (net.Conn, error) {
+
+	if !service.IsDiscovered() {
+		return nil
+	}
+
+	return func(ctx context.Context, _ string) (net.Conn, error) {
+		address, err := service.BackendAddress(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+}
@@ -0,0 +1,470 @@
+package aperture
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultBucketRegion is the region of a bucket if none is configured.
+	defaultBucketRegion = "us-east-1"
+
+	// bucketRequestTimeout is the maximum time a request to a bucket may
+	// take until its response header is received.
+	bucketRequestTimeout = 30 * time.Second
+
+	// amzDateFormat is the format of the time stamps of signed requests.
+	amzDateFormat = "20060102T150405Z"
+
+	// emptyPayloadHash is the SHA256 hash of an empty request body.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca" +
+		"495991b7852b855"
+)
+
+// StaticBucket is an S3-compatible bucket that static files are served from
+// instead of a local directory.
+type StaticBucket struct {
+	// Endpoint is the URL of the S3 API. It defaults to the AWS endpoint
+	// of the region.
+	Endpoint string `long:"endpoint" description:"The URL of the S3-compatible API, like https://minio.example.com. Defaults to the AWS S3 endpoint of the region."`
+
+	// Bucket is the name of the bucket.
+	Bucket string `long:"bucket" description:"The name of the bucket that contains the files."`
+
+	// Prefix is the key prefix of the files within the bucket.
+	Prefix string `long:"prefix" description:"The key prefix of the files within the bucket, like site/."`
+
+	// Region is the region the bucket lives in.
+	Region string `long:"region" description:"The region of the bucket. Defaults to the AWS_REGION environment variable or us-east-1."`
+
+	// AccessKeyID and SecretAccessKey are the credentials requests are
+	// signed with. Requests to public buckets don't need them.
+	AccessKeyID     string `long:"accesskeyid" description:"The access key ID requests are signed with. Defaults to the AWS_ACCESS_KEY_ID environment variable. Public buckets are read without signature if there is none."`
+	SecretAccessKey string `long:"secretaccesskey" description:"The secret access key requests are signed with. Defaults to the AWS_SECRET_ACCESS_KEY environment variable." secret:"true"`
+}
+
+// enabled returns true if a bucket is configured.
+func (b *StaticBucket) enabled() bool {
+	return b != nil && b.Bucket != ""
+}
+
+// bucketCredentials are the credentials requests to a bucket are signed with.
+type bucketCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// bucketFileSystem is a file system that reads the objects of an S3-compatible
+// bucket. Buckets don't have directories, so a directory only exists if it
+// contains an index file.
+type bucketFileSystem struct {
+	client   *http.Client
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	region   string
+	creds    *bucketCredentials
+}
+
+// newBucketFileSystem creates a file system for the objects of the given
+// bucket.
+func newBucketFileSystem(cfg *StaticBucket) (*bucketFileSystem, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("static bucket has no name")
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = defaultBucketRegion
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint of static bucket: %v",
+			err)
+	}
+	if endpointURL.Scheme != "http" && endpointURL.Scheme != "https" {
+		return nil, fmt.Errorf("endpoint of static bucket must be an "+
+			"http or https URL, got %s", endpoint)
+	}
+
+	fs := &bucketFileSystem{
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: bucketRequestTimeout,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   16,
+		}},
+		endpoint: endpointURL,
+		bucket:   cfg.Bucket,
+		prefix:   strings.TrimPrefix(cfg.Prefix, "/"),
+		region:   region,
+	}
+
+	accessKeyID := cfg.AccessKeyID
+	secretAccessKey := cfg.SecretAccessKey
+	if accessKeyID == "" {
+		accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if accessKeyID != "" {
+		fs.creds = &bucketCredentials{
+			accessKeyID:     accessKeyID,
+			secretAccessKey: secretAccessKey,
+			sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	}
+
+	return fs, nil
+}
+
+// Open opens the named file. Objects are only fetched once the file is read.
+//
+// NOTE: This is part of the http.FileSystem interface.
+func (fs *bucketFileSystem) Open(name string) (http.File, error) {
+	key := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if key != "" {
+		info, err := fs.head(key)
+		if err == nil {
+			return &bucketFile{fs: fs, key: key, info: info}, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	// There is no object with the name, but there might be an index file
+	// below it.
+	_, err := fs.head(path.Join(key, staticIndexFile))
+	if err != nil {
+		return nil, err
+	}
+
+	return &bucketFile{fs: fs, key: key, info: &bucketFileInfo{
+		name: path.Base("/" + key),
+		dir:  true,
+	}}, nil
+}
+
+// head returns information about the object with the given key.
+func (fs *bucketFileSystem) head(key string) (*bucketFileInfo, error) {
+	resp, err := fs.do(http.MethodHead, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &bucketFileInfo{
+		name:    path.Base("/" + key),
+		size:    resp.ContentLength,
+		modTime: modTime,
+	}, nil
+}
+
+// do sends a request for the object with the given key. Answers for objects
+// that don't exist are returned as os.ErrNotExist. Without permission to list
+// the bucket, S3 answers those with 403 instead of 404.
+func (fs *bucketFileSystem) do(method, key string,
+	header http.Header) (*http.Response, error) {
+
+	objectURL := *fs.endpoint
+	objectPath := path.Join(
+		"/", fs.endpoint.Path, fs.bucket, fs.prefix+key,
+	)
+	objectURL.Path = objectPath
+	objectURL.RawPath = escapeObjectPath(objectPath)
+
+	req, err := http.NewRequest(method, objectURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if fs.creds != nil {
+		signBucketRequest(req, fs.creds, fs.region, time.Now())
+	}
+
+	resp, err := fs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return resp, nil
+
+	case http.StatusNotFound, http.StatusForbidden:
+		_ = resp.Body.Close()
+		return nil, os.ErrNotExist
+
+	default:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unable to read %s from bucket: %s", key,
+			resp.Status)
+	}
+}
+
+// escapeObjectPath escapes all characters of the given path except the
+// unreserved ones and slashes, like S3 expects it in signed requests.
+func escapeObjectPath(p string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z',
+			'0' <= c && c <= '9',
+			strings.IndexByte("-_.~/", c) >= 0:
+
+			escaped.WriteByte(c)
+
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+
+	return escaped.String()
+}
+
+// signBucketRequest signs a request without body with the AWS signature
+// version 4, which S3-compatible APIs authenticate requests with.
+func signBucketRequest(req *http.Request, creds *bucketCredentials,
+	region string, now time.Time) {
+
+	amzDate := now.UTC().Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	// The host, the range and all of the amz header fields are signed.
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lowerName := strings.ToLower(name)
+		if lowerName == "range" ||
+			strings.HasPrefix(lowerName, "x-amz-") {
+
+			headers[lowerName] = strings.TrimSpace(
+				req.Header.Get(name),
+			)
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + creds.secretAccessKey)
+	scopeParts := []string{amzDate[:8], region, "s3", "aws4_request"}
+	for _, part := range scopeParts {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, "+
+			"Signature=%s", creds.accessKeyID, scope, signedHeaders,
+		signature,
+	))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the data under the given key.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// bucketFile is an object of a bucket. Its content is fetched from the offset
+// it's read at, so range requests only download the requested part.
+type bucketFile struct {
+	fs   *bucketFileSystem
+	key  string
+	info *bucketFileInfo
+
+	offset int64
+	body   io.ReadCloser
+}
+
+// Read reads the content of the object from the current offset.
+//
+// NOTE: This is part of the io.Reader interface.
+func (f *bucketFile) Read(p []byte) (int, error) {
+	if f.info.dir {
+		return 0, fmt.Errorf("%s is a directory", f.key)
+	}
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+
+	if f.body == nil {
+		resp, err := f.fs.do(http.MethodGet, f.key, http.Header{
+			"Range": {"bytes=" + strconv.FormatInt(f.offset, 10) +
+				"-"},
+		})
+		if err != nil {
+			return 0, err
+		}
+		f.body = resp.Body
+
+		// Servers that don't support ranges send the whole object.
+		if resp.StatusCode == http.StatusOK && f.offset > 0 {
+			_, err := io.CopyN(ioutil.Discard, f.body, f.offset)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+// Seek sets the offset the object is read at next.
+//
+// NOTE: This is part of the io.Seeker interface.
+func (f *bucketFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	if offset != f.offset && f.body != nil {
+		_ = f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+
+	return offset, nil
+}
+
+// Close closes the connection the object is read through, if any.
+//
+// NOTE: This is part of the io.Closer interface.
+func (f *bucketFile) Close() error {
+	if f.body == nil {
+		return nil
+	}
+
+	err := f.body.Close()
+	f.body = nil
+	return err
+}
+
+// Readdir returns no files, the content of bucket directories isn't listed.
+//
+// NOTE: This is part of the http.File interface.
+func (f *bucketFile) Readdir(int) ([]os.FileInfo, error) {
+	return nil, errors.New("bucket directories can't be listed")
+}
+
+// Stat returns information about the object.
+//
+// NOTE: This is part of the http.File interface.
+func (f *bucketFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// bucketFileInfo describes an object of a bucket.
+type bucketFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+// Name returns the base name of the object.
+func (i *bucketFileInfo) Name() string { return i.name }
+
+// Size returns the size of the object in bytes.
+func (i *bucketFileInfo) Size() int64 { return i.size }
+
+// Mode returns the file mode of the object.
+func (i *bucketFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+// ModTime returns the time the object was last modified.
+func (i *bucketFileInfo) ModTime() time.Time { return i.modTime }
+
+// IsDir returns true if the info describes a directory.
+func (i *bucketFileInfo) IsDir() bool { return i.dir }
+
+// Sys returns nil, there is no underlying data source.
+func (i *bucketFileInfo) Sys() interface{} { return nil }
+
+// staticFileSystem returns the file system static files are served from. A
+// file system passed by an embedder takes precedence over a bucket, which takes
+// precedence over a local directory.
+func staticFileSystem(root string, bucket *StaticBucket,
+	embedded http.FileSystem) (http.FileSystem, error) {
+
+	switch {
+	case embedded != nil:
+		return embedded, nil
+
+	case bucket.enabled():
+		return newBucketFileSystem(bucket)
+
+	case strings.TrimSpace(root) != "":
+		return http.Dir(root), nil
+
+	default:
+		return nil, errors.New("no static root, bucket or file system")
+	}
+}
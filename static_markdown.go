@@ -0,0 +1,212 @@
+package aperture
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// markdownIndexFile is the file that is rendered for a directory
+	// without an index.html if Markdown files are rendered.
+	markdownIndexFile = "index.md"
+
+	// hdrContentType is the header field of the media type of a response.
+	hdrContentType = "Content-Type"
+)
+
+// defaultMarkdownTemplate is the template Markdown pages are rendered with if
+// no other one is configured. It styles the document for reading.
+var defaultMarkdownTemplate = template.Must(template.New("markdown").Parse(
+	`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { max-width: 48rem; margin: 2rem auto; padding: 0 1rem; color: #24292e;
+  font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif;
+  line-height: 1.6; }
+a { color: #0366d6; }
+code, pre { font-family: SFMono-Regular, Menlo, Consolas, monospace;
+  background: #f6f8fa; border-radius: 3px; }
+code { padding: .2em .4em; }
+pre { padding: 1rem; overflow: auto; }
+pre code { padding: 0; }
+blockquote { margin: 0; padding: 0 1rem; color: #6a737d;
+  border-left: .25rem solid #dfe2e5; }
+table { border-collapse: collapse; }
+th, td { padding: .4rem .8rem; border: 1px solid #dfe2e5; }
+img { max-width: 100%; }
+</style>
+</head>
+<body>
+{{.Content}}
+</body>
+</html>
+`))
+
+// markdownPage is the data Markdown pages are rendered into their template
+// with.
+type markdownPage struct {
+	// Title is the text of the first top-level heading of the document,
+	// or the name of its file if it has none.
+	Title string
+
+	// Path is the URL path of the page below the static root or mount.
+	Path string
+
+	// Content is the document rendered as HTML.
+	Content template.HTML
+}
+
+// markdownPages renders the Markdown files of a static root as HTML pages.
+type markdownPages struct {
+	fs       http.FileSystem
+	template *template.Template
+}
+
+// enableMarkdown lets the server render the Markdown files as HTML pages with
+// the template in the given file, or the default template if it's empty.
+func (s *staticServer) enableMarkdown(templateFile string) error {
+	tmpl := defaultMarkdownTemplate
+	if templateFile != "" {
+		var err error
+		tmpl, err = template.ParseFiles(templateFile)
+		if err != nil {
+			return fmt.Errorf("unable to parse Markdown template: "+
+				"%v", err)
+		}
+	}
+
+	s.markdown = &markdownPages{fs: s.fs, template: tmpl}
+	return nil
+}
+
+// pageName returns the name of the Markdown file the request reads, if it
+// reads one. Requests for directories without an index.html read their
+// index.md.
+func (m *markdownPages) pageName(r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", false
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") {
+		index, err := m.fs.Open(path.Join(name, staticIndexFile))
+		if err == nil {
+			_ = index.Close()
+			return "", false
+		}
+		name = path.Join(name, markdownIndexFile)
+	}
+
+	ext := path.Ext(name)
+	return name, ext == ".md" || ext == ".markdown"
+}
+
+// serve renders the Markdown file the request reads as an HTML page and sends
+// it. Clients that prefer text/markdown over text/html get the file itself.
+// False is returned if the request doesn't read a Markdown file, so it can be
+// served by the file server instead.
+func (m *markdownPages) serve(w http.ResponseWriter, r *http.Request) bool {
+	name, ok := m.pageName(r)
+	if !ok {
+		return false
+	}
+
+	f, err := m.fs.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		return false
+	}
+
+	// The same URL is served as HTML or Markdown, so caches must tell
+	// them apart.
+	w.Header().Add("Vary", "Accept")
+	if prefersMarkdown(r) {
+		w.Header().Set(hdrContentType, "text/markdown; charset=utf-8")
+		http.ServeContent(w, r, name, stat.ModTime(), f)
+		return true
+	}
+
+	src, err := ioutil.ReadAll(f)
+	if err != nil {
+		log.Errorf("Error reading Markdown page %s: %v", name, err)
+		http.Error(w, "error reading page",
+			http.StatusInternalServerError)
+		return true
+	}
+
+	content, title := renderMarkdown(string(src))
+	if title == "" {
+		title = strings.TrimSuffix(path.Base(name), path.Ext(name))
+	}
+
+	var page bytes.Buffer
+	err = m.template.Execute(&page, &markdownPage{
+		Title:   title,
+		Path:    r.URL.Path,
+		Content: template.HTML(content),
+	})
+	if err != nil {
+		log.Errorf("Error rendering Markdown page %s: %v", name, err)
+		http.Error(w, "error rendering page",
+			http.StatusInternalServerError)
+		return true
+	}
+
+	// The template is only parsed on startup, so the page only changes
+	// with its file.
+	w.Header().Set(hdrContentType, "text/html; charset=utf-8")
+	http.ServeContent(
+		w, r, name, stat.ModTime(), bytes.NewReader(page.Bytes()),
+	)
+	return true
+}
+
+// prefersMarkdown returns true if the client accepts text/markdown with a
+// higher quality than text/html.
+func prefersMarkdown(r *http.Request) bool {
+	var markdownQuality, htmlQuality float64
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accepted)
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		switch mediaType {
+		case "text/markdown", "text/x-markdown":
+			if quality > markdownQuality {
+				markdownQuality = quality
+			}
+
+		case "text/html":
+			if quality > htmlQuality {
+				htmlQuality = quality
+			}
+		}
+	}
+
+	return markdownQuality > htmlQuality
+}
@@ -0,0 +1,166 @@
+package aperture
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRenderMarkdown tests that the block and inline elements of Markdown
+// documents are rendered as HTML.
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		html     string
+	}{{
+		name: "headings",
+		markdown: "# API *v1*\n\n## Usage ##\n\nSetext\n---\n\n" +
+			"## Usage",
+		html: "<h1 id=\"api-v1\">API <em>v1</em></h1>\n" +
+			"<h2 id=\"usage\">Usage</h2>\n" +
+			"<h2 id=\"setext\">Setext</h2>\n" +
+			"<h2 id=\"usage-1\">Usage</h2>\n",
+	}, {
+		name: "paragraphs",
+		markdown: "Some **bold**, _em_ and `co*de`\ntext.  \n" +
+			"snake_case_name\n\n---",
+		html: "<p>Some <strong>bold</strong>, <em>em</em> and " +
+			"<code>co*de</code>\ntext.<br>\nsnake_case_name</p>\n" +
+			"<hr>\n",
+	}, {
+		name: "links",
+		markdown: "[docs](/docs \"Docs\"), ![logo](logo.png), " +
+			"<https://example.com> and [bad](javascript:alert(1))",
+		html: "<p><a href=\"/docs\" title=\"Docs\">docs</a>, " +
+			"<img src=\"logo.png\" alt=\"logo\">, " +
+			"<a href=\"https://example.com\">https://example.com" +
+			"</a> and <a href=\"#\">bad</a></p>\n",
+	}, {
+		name:     "escaped html",
+		markdown: "<script>alert(1)</script> \\*a\\* & b",
+		html: "<p>&lt;script&gt;alert(1)&lt;/script&gt; *a* " +
+			"&amp; b</p>\n",
+	}, {
+		name:     "code",
+		markdown: "```go\nfmt.Println(\"<hi>\")\n```\n\n    indented\n",
+		html: "<pre><code class=\"language-go\">fmt.Println(" +
+			"&#34;&lt;hi&gt;&#34;)\n</code></pre>\n" +
+			"<pre><code>indented\n</code></pre>\n",
+	}, {
+		name:     "lists",
+		markdown: "- a\n- b\n  1. c\n  2. d\n\n3. e\n\n4. f",
+		html: "<ul>\n<li>a</li>\n<li>b<ol>\n<li>c</li>\n<li>d</li>\n" +
+			"</ol>\n</li>\n</ul>\n" +
+			"<ol start=\"3\">\n<li><p>e</p>\n</li>\n" +
+			"<li><p>f</p>\n</li>\n</ol>\n",
+	}, {
+		name:     "blockquote",
+		markdown: "> quoted\nlazy\n\n> # title",
+		html: "<blockquote>\n<p>quoted\nlazy</p>\n</blockquote>\n" +
+			"<blockquote>\n<h1 id=\"title\">title</h1>\n" +
+			"</blockquote>\n",
+	}, {
+		name: "table",
+		markdown: "| Method | Price |\n|:--|--:|\n| `GET` | 10 |\n" +
+			"| a\\|b |",
+		html: "<table>\n<thead>\n<tr>\n" +
+			"<th style=\"text-align: left\">Method</th>\n" +
+			"<th style=\"text-align: right\">Price</th>\n" +
+			"</tr>\n</thead>\n<tbody>\n<tr>\n" +
+			"<td style=\"text-align: left\"><code>GET</code>" +
+			"</td>\n<td style=\"text-align: right\">10</td>\n" +
+			"</tr>\n<tr>\n" +
+			"<td style=\"text-align: left\">a|b</td>\n" +
+			"<td style=\"text-align: right\"></td>\n</tr>\n" +
+			"</tbody>\n</table>\n",
+	}}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			html, _ := renderMarkdown(test.markdown)
+			require.Equal(t, test.html, html)
+		})
+	}
+
+	_, title := renderMarkdown("intro\n\n# The *API* & more\n\n# Other")
+	require.Equal(t, "The API & more", title)
+}
+
+// TestStaticMarkdown tests that the Markdown files of the static root are
+// served as rendered pages, or as they are to clients that prefer Markdown.
+func TestStaticMarkdown(t *testing.T) {
+	root, err := ioutil.TempDir("", "static")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	writeFile := func(name, content string) {
+		err := ioutil.WriteFile(
+			filepath.Join(root, name), []byte(content), 0600,
+		)
+		require.NoError(t, err)
+	}
+	writeFile("index.md", "# Docs")
+	writeFile("terms.md", "No *refunds*.")
+	writeFile("page.tmpl", "<title>{{.Title}}</title>{{.Content}}")
+	require.NoError(t, os.Mkdir(filepath.Join(root, "site"), 0700))
+	writeFile("site/index.html", "html index")
+	writeFile("site/index.md", "# Unused")
+
+	server := newStaticServer(http.Dir(root), false, false, nil)
+	err = server.enableMarkdown(filepath.Join(root, "page.tmpl"))
+	require.NoError(t, err)
+
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Directories without an index.html show their index.md.
+	rec := get("/", "text/html,*/*;q=0.8")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(
+		t, "<title>Docs</title><h1 id=\"docs\">Docs</h1>\n",
+		rec.Body.String(),
+	)
+	require.Equal(
+		t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"),
+	)
+	require.Equal(t, "Accept", rec.Header().Get("Vary"))
+
+	// Documents without a heading are titled by their file name.
+	rec = get("/terms.md", "")
+	require.Equal(
+		t, "<title>terms</title><p>No <em>refunds</em>.</p>\n",
+		rec.Body.String(),
+	)
+
+	// Clients that prefer Markdown get the file itself.
+	rec = get("/terms.md", "text/markdown, text/html;q=0.5")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "No *refunds*.", rec.Body.String())
+	require.Equal(
+		t, "text/markdown; charset=utf-8",
+		rec.Header().Get("Content-Type"),
+	)
+
+	// An index.html takes precedence over an index.md.
+	rec = get("/site/", "")
+	require.Equal(t, "html index", rec.Body.String())
+
+	// A broken template is reported on startup.
+	writeFile("broken.tmpl", "{{.Content")
+	err = server.enableMarkdown(filepath.Join(root, "broken.tmpl"))
+	require.Error(t, err)
+}
@@ -0,0 +1,578 @@
+package aperture
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/pricer"
+	"github.com/lightninglabs/aperture/proxy"
+)
+
+const (
+	// staticIndexFile is the file that is served for a directory of the
+	// static root.
+	staticIndexFile = "index.html"
+
+	// hdrETag is the header field of the entity tag of a static file.
+	hdrETag = "Etag"
+
+	// staticRootService is the name of the service LSATs for the
+	// protected files of the static root are minted for.
+	staticRootService = "static"
+
+	// pricedServiceSuffix is appended to the service name of a static
+	// mount for the service of its files that have their own price. The
+	// tokens of that service are bound to a single file, so it must not
+	// share its name with a service whose tokens unlock all files.
+	pricedServiceSuffix = "-files"
+)
+
+// noListingFileSystem is a file system that hides directories without an index
+// file, so the file server can't list their content.
+type noListingFileSystem struct {
+	http.FileSystem
+}
+
+// Open opens the named file. Directories are only returned if they contain an
+// index file.
+//
+// NOTE: This is part of the http.FileSystem interface.
+func (fs noListingFileSystem) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return f, nil
+	}
+
+	index, err := fs.FileSystem.Open(path.Join(name, staticIndexFile))
+	if err != nil {
+		_ = f.Close()
+		return nil, os.ErrNotExist
+	}
+	_ = index.Close()
+
+	return f, nil
+}
+
+// staticServer serves the files of the static root. Single-page apps route on
+// the client side, so it can serve the index file of the root for paths that
+// don't exist instead of a 404 answer.
+type staticServer struct {
+	fs          http.FileSystem
+	fileServer  http.Handler
+	spaFallback bool
+
+	// templates renders the HTML files as templates, if it is set.
+	templates *staticTemplates
+
+	// markdown renders the Markdown files as HTML pages, if it is set.
+	markdown *markdownPages
+}
+
+// newStaticServer creates a new server for the files of the given file system.
+// If the page data function is set, HTML files are rendered as templates with
+// the data it returns.
+func newStaticServer(fs http.FileSystem, spaFallback, dirListing bool,
+	pageData func() *staticPageData) *staticServer {
+
+	if !dirListing {
+		fs = noListingFileSystem{FileSystem: fs}
+	}
+
+	server := &staticServer{
+		fs:          fs,
+		fileServer:  http.FileServer(fs),
+		spaFallback: spaFallback,
+	}
+	if pageData != nil {
+		server.templates = newStaticTemplates(fs, pageData)
+	}
+
+	return server
+}
+
+// ServeHTTP serves the requested file, or the index file of the root if the
+// file doesn't exist and the fallback for single-page apps is enabled. The file
+// server answers range requests and conditional requests based on the
+// modification time and the entity tag of the file.
+//
+// NOTE: This is part of the http.Handler interface.
+func (s *staticServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The file server redirects requests for the index file itself to the
+	// directory, so we ask for the root directly.
+	if s.spaFallback && s.isMissing(r) {
+		r = r.Clone(r.Context())
+		r.URL.Path = "/"
+		r.URL.RawPath = ""
+	}
+
+	if s.templates != nil {
+		name, ok := pageName(r)
+		if ok && s.templates.serve(w, r, name) {
+			return
+		}
+	}
+
+	if s.markdown != nil && s.markdown.serve(w, r) {
+		return
+	}
+
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		s.setETag(w, r)
+	}
+	s.fileServer.ServeHTTP(w, r)
+}
+
+// setETag sets the entity tag of the file that is served for the request. The
+// tag is derived from the size and the modification time of the file, so
+// conditional and range requests only succeed as long as it doesn't change.
+// The file server uses the tag to evaluate If-Match, If-None-Match and
+// If-Range.
+func (s *staticServer) setETag(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Path)
+	stat, err := s.stat(name)
+	if err != nil {
+		return
+	}
+
+	// Directories are served as their index file.
+	if stat.IsDir() {
+		stat, err = s.stat(path.Join(name, staticIndexFile))
+		if err != nil {
+			return
+		}
+	}
+
+	w.Header().Set(hdrETag, fmt.Sprintf(
+		`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size(),
+	))
+}
+
+// stat returns information about the named file.
+func (s *staticServer) stat(name string) (os.FileInfo, error) {
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return f.Stat()
+}
+
+// isMissing returns true if the request reads a file that doesn't exist.
+func (s *staticServer) isMissing(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	f, err := s.fs.Open(path.Clean("/" + r.URL.Path))
+	if err != nil {
+		return errors.Is(err, os.ErrNotExist)
+	}
+	_ = f.Close()
+
+	return false
+}
+
+// StaticMount is a directory of static files that is served below a URL path
+// prefix, with its own authentication level.
+type StaticMount struct {
+	// Name is the name of the service the files are paid for under. It
+	// defaults to "static" followed by the prefix.
+	Name string `long:"name" description:"The service name LSATs for the files are minted for, static<prefix> by default"`
+
+	// Prefix is the URL path prefix the directory is mounted at, like
+	// /docs. Requests are matched to the mount with the longest prefix.
+	Prefix string `long:"prefix" description:"The URL path prefix the directory is served at, like /docs"`
+
+	// Root is the directory that contains the files.
+	Root string `long:"root" description:"The directory that contains the files"`
+
+	// Bucket is an S3-compatible bucket the files are read from instead
+	// of the root directory.
+	Bucket *StaticBucket `long:"bucket" description:"An S3-compatible bucket the files are read from instead of the root directory"`
+
+	// Auth is the authentication level required to read the files, with
+	// the same values as the one of a service.
+	Auth auth.Level `long:"auth" description:"Required authentication: on, off or freebie X"`
+
+	// Price is the price in satoshis of an LSAT for the files.
+	Price int64 `long:"price" description:"Static LSAT value in satoshis for the files"`
+
+	// SPA can be set to serve the index.html of the mount for paths that
+	// don't exist, for single-page app routing.
+	SPA bool `long:"spa" description:"Serve the index.html of the mount for paths that don't exist"`
+
+	// NoListing can be set to answer requests for directories without an
+	// index.html with a 404 instead of a listing of their content.
+	NoListing bool `long:"nolisting" description:"Don't list the content of directories that don't contain an index.html"`
+
+	// Protected is a list of path patterns of files of the mount that
+	// require a paid LSAT, whatever the auth level of the mount is. See
+	// globRegexp for the syntax of the patterns.
+	Protected []string `long:"protected" description:"Path patterns of files below the prefix that require a paid LSAT, like /reports/*.pdf or /**.zip"`
+
+	// Prices maps path patterns of files of the mount to the price in
+	// satoshis of each of the matching files. An LSAT bought for such a
+	// file only unlocks that file.
+	Prices map[string]int64 `long:"prices" description:"Path patterns of files below the prefix that are sold one by one, mapped to the price of each file"`
+
+	// SignedURLs holds the options to hand out signed, expiring URLs of
+	// the paid files of the mount.
+	SignedURLs proxy.SignedURLConfig `long:"signedurls" description:"Options to issue signed URLs of paid files that can be fetched without the token"`
+
+	// Quota holds the number of bytes of the files of the mount each LSAT
+	// pays for. Once they are downloaded, a new LSAT has to be bought.
+	Quota proxy.QuotaConfig `long:"quota" description:"The transfer quota of the LSATs of the mount"`
+
+	// Templates can be set to render the HTML files of the mount as
+	// templates with the live configuration of the proxy.
+	Templates bool `long:"templates" description:"Render the HTML files of the mount as templates with the live configuration"`
+
+	// Markdown can be set to render the Markdown files of the mount as
+	// HTML pages.
+	Markdown bool `long:"markdown" description:"Render the Markdown files of the mount as styled HTML pages"`
+
+	// MarkdownTemplate is the HTML template file the Markdown pages of the
+	// mount are rendered with instead of the built-in one.
+	MarkdownTemplate string `long:"markdowntemplate" description:"The HTML template file Markdown pages are rendered with instead of the built-in one"`
+}
+
+// staticMountHandler serves the files of a static mount, with the prefix of
+// the mount removed from the request path.
+type staticMountHandler struct {
+	prefix string
+	server *staticServer
+}
+
+// ServeHTTP serves the requested file of the mount.
+//
+// NOTE: This is part of the http.Handler interface.
+func (h *staticMountHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+
+	filePath := strings.TrimPrefix(r.URL.Path, h.prefix)
+
+	// The root of the mount is a directory, which the file server would
+	// redirect to relative to the wrong path.
+	if filePath == "" {
+		http.Redirect(w, r, h.prefix+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	// Paths are matched against the protected patterns before they reach
+	// us, so only clean paths are served. Others are redirected to their
+	// clean form, which is then matched again.
+	cleanPath := path.Clean(filePath)
+	if strings.HasSuffix(filePath, "/") && cleanPath != "/" {
+		cleanPath += "/"
+	}
+	if cleanPath != filePath {
+		http.Redirect(
+			w, r, h.prefix+cleanPath, http.StatusMovedPermanently,
+		)
+		return
+	}
+
+	mountReq := r.Clone(r.Context())
+	mountReq.URL.Path = filePath
+	mountReq.URL.RawPath = ""
+	h.server.ServeHTTP(w, mountReq)
+}
+
+// staticMountServices creates a service for each of the static mounts that
+// serves its files in process, so they are authenticated like the requests of
+// any backend. The services are ordered by their prefix, longest first, so
+// the most specific mount matches a request. The HTML files of mounts with
+// templates are rendered with the data returned by the page data function.
+func staticMountServices(mounts []*StaticMount,
+	pageData func() *staticPageData) ([]*proxy.Service, error) {
+
+	services := make([]*proxy.Service, 0, len(mounts))
+	prefixes := make(map[string]struct{}, len(mounts))
+	for _, mount := range mounts {
+		prefix := strings.TrimSuffix(mount.Prefix, "/")
+		if !strings.HasPrefix(mount.Prefix, "/") {
+			return nil, fmt.Errorf("prefix %q of static mount "+
+				"must start with /", mount.Prefix)
+		}
+		if _, ok := prefixes[prefix]; ok {
+			return nil, fmt.Errorf("duplicate static mount prefix "+
+				"%q", mount.Prefix)
+		}
+		prefixes[prefix] = struct{}{}
+
+		if strings.TrimSpace(mount.Root) == "" &&
+			!mount.Bucket.enabled() {
+
+			return nil, fmt.Errorf("static mount %q has no root",
+				mount.Prefix)
+		}
+		fs, err := staticFileSystem(mount.Root, mount.Bucket, nil)
+		if err != nil {
+			return nil, fmt.Errorf("static mount %q: %v",
+				mount.Prefix, err)
+		}
+
+		name := mount.Name
+		if name == "" {
+			name = "static" + prefix
+		}
+
+		var mountData func() *staticPageData
+		if mount.Templates {
+			mountData = pageData
+		}
+		server := newStaticServer(
+			fs, mount.SPA, !mount.NoListing, mountData,
+		)
+		if mount.Markdown {
+			err := server.enableMarkdown(mount.MarkdownTemplate)
+			if err != nil {
+				return nil, fmt.Errorf("static mount %q: %v",
+					mount.Prefix, err)
+			}
+		}
+		handler := &staticMountHandler{
+			prefix: prefix,
+			server: server,
+		}
+
+		// The priced and protected paths are matched first, so they
+		// always require a paid LSAT.
+		var mountServices []*proxy.Service
+		if len(mount.Prices) > 0 {
+			mountServices = append(
+				mountServices, pricedStaticService(
+					name, mount.Prices, handler,
+				),
+			)
+		}
+		if len(mount.Protected) > 0 {
+			mountServices = append(
+				mountServices, protectedStaticService(
+					name, mount.Protected, mount.Price,
+					handler,
+				),
+			)
+		}
+		mountServices = append(mountServices, &proxy.Service{
+			Name:       name,
+			Auth:       mount.Auth,
+			Price:      mount.Price,
+			HostRegexp: ".*",
+			PathRegexp: "^" + regexp.QuoteMeta(prefix) + "(/|$)",
+			Handler:    handler,
+		})
+
+		for _, service := range mountServices {
+			service.SignedURLs = mount.SignedURLs
+			service.Quota = mount.Quota
+		}
+		services = append(services, mountServices...)
+	}
+
+	prefixLen := func(i int) int {
+		return len(services[i].Handler.(*staticMountHandler).prefix)
+	}
+	sort.SliceStable(services, func(i, j int) bool {
+		return prefixLen(i) > prefixLen(j)
+	})
+
+	return services, nil
+}
+
+// protectedStaticService creates a service that requires a paid LSAT for the
+// files of a static mount that match one of the given patterns.
+func protectedStaticService(name string, patterns []string, price int64,
+	handler *staticMountHandler) *proxy.Service {
+
+	expressions := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, "/") {
+			pattern = "/" + pattern
+		}
+		expressions = append(expressions, globRegexp(pattern))
+	}
+
+	return &proxy.Service{
+		Name:       name,
+		Auth:       "on",
+		Price:      price,
+		HostRegexp: ".*",
+		PathRegexp: "^" + regexp.QuoteMeta(handler.prefix) + "(" +
+			strings.Join(expressions, "|") + ")$",
+		Handler: handler,
+	}
+}
+
+// pricedStaticService creates a service that sells each of the files of a
+// static mount that match one of the given patterns for the price of the
+// pattern. Its tokens are bound to the path of the file they are bought for.
+// Longer patterns are matched first, as they're usually the more specific ones.
+func pricedStaticService(name string, prices map[string]int64,
+	handler *staticMountHandler) *proxy.Service {
+
+	patterns := make([]string, 0, len(prices))
+	for pattern := range prices {
+		patterns = append(patterns, pattern)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+
+	var (
+		maxPrice    int64
+		pathPrices  = make([]*pricer.PathPrice, 0, len(patterns))
+		expressions = make([]string, 0, len(patterns))
+	)
+	prefix := regexp.QuoteMeta(handler.prefix)
+	for _, pattern := range patterns {
+		price := prices[pattern]
+		if price > maxPrice {
+			maxPrice = price
+		}
+
+		if !strings.HasPrefix(pattern, "/") {
+			pattern = "/" + pattern
+		}
+		expr := globRegexp(pattern)
+		expressions = append(expressions, expr)
+		pathPrices = append(pathPrices, &pricer.PathPrice{
+			Path:  "^" + prefix + expr + "$",
+			Price: price,
+		})
+	}
+
+	return &proxy.Service{
+		Name:       name + pricedServiceSuffix,
+		Auth:       "on",
+		Price:      maxPrice,
+		PathPrices: pathPrices,
+		Binding:    proxy.BindingConfig{Path: true},
+		HostRegexp: ".*",
+		PathRegexp: "^" + prefix + "(" + strings.Join(expressions, "|") +
+			")$",
+		Handler: handler,
+	}
+}
+
+// globRegexp translates a path pattern to a regular expression. In the
+// pattern, ** matches any characters, * any characters except / and ? a single
+// character except /. All other characters match themselves.
+func globRegexp(pattern string) string {
+	var expr strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+
+		case pattern[i] == '*':
+			expr.WriteString("[^/]*")
+
+		case pattern[i] == '?':
+			expr.WriteString("[^/]")
+
+		default:
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+
+	return expr.String()
+}
+
+// newStaticServices creates the services of the static mounts and the ones of
+// the priced and protected paths of the static root, if there are any. The
+// rest of the static root is served as a local service.
+func newStaticServices(cfg *Config,
+	pageData func() *staticPageData) ([]*proxy.Service, error) {
+
+	services, err := staticMountServices(cfg.StaticMounts, pageData)
+	if err != nil {
+		return nil, err
+	}
+
+	if !cfg.ServeStatic ||
+		len(cfg.StaticProtected) == 0 && len(cfg.StaticPrices) == 0 {
+
+		return services, nil
+	}
+
+	server, err := newRootStaticServer(cfg, pageData)
+	if err != nil {
+		return nil, err
+	}
+	handler := &staticMountHandler{server: server}
+	var rootServices []*proxy.Service
+	if len(cfg.StaticPrices) > 0 {
+		rootServices = append(rootServices, pricedStaticService(
+			staticRootService, cfg.StaticPrices, handler,
+		))
+	}
+	if len(cfg.StaticProtected) > 0 {
+		rootServices = append(rootServices, protectedStaticService(
+			staticRootService, cfg.StaticProtected,
+			cfg.StaticPrice, handler,
+		))
+	}
+	if cfg.StaticSignedURLs != nil {
+		for _, service := range rootServices {
+			service.SignedURLs = *cfg.StaticSignedURLs
+		}
+	}
+	if cfg.StaticQuota != nil {
+		for _, service := range rootServices {
+			service.Quota = *cfg.StaticQuota
+		}
+	}
+
+	return append(services, rootServices...), nil
+}
+
+// newRootStaticServer creates the server of the files of the static root, which
+// are read from the file system of an embedder, a bucket or a local directory.
+func newRootStaticServer(cfg *Config,
+	pageData func() *staticPageData) (*staticServer, error) {
+
+	fs, err := staticFileSystem(
+		cfg.StaticRoot, cfg.StaticBucket, cfg.StaticFS,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if !cfg.StaticTemplates {
+		pageData = nil
+	}
+
+	server := newStaticServer(
+		fs, cfg.StaticSPA, !cfg.StaticNoListing, pageData,
+	)
+	if cfg.StaticMarkdown {
+		err := server.enableMarkdown(cfg.StaticMarkdownTemplate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return server, nil
+}
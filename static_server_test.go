@@ -0,0 +1,260 @@
+package aperture
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/pricer"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStaticServer tests the single-page app fallback and the directory
+// listing toggle of the static file server.
+func TestStaticServer(t *testing.T) {
+	root, err := ioutil.TempDir("", "static")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	writeFile := func(name, content string) {
+		name = filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), 0700))
+		err := ioutil.WriteFile(name, []byte(content), 0600)
+		require.NoError(t, err)
+	}
+	writeFile("index.html", "index")
+	writeFile("app.js", "app")
+	writeFile("assets/logo.svg", "logo")
+
+	get := func(h http.Handler, method, path string) (int, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	// By default, unknown paths are not found and directories are listed.
+	server := newStaticServer(http.Dir(root), false, true, nil)
+	code, _ := get(server, "GET", "/app/route")
+	require.Equal(t, http.StatusNotFound, code)
+	code, body := get(server, "GET", "/assets/")
+	require.Equal(t, http.StatusOK, code)
+	require.Contains(t, body, "logo.svg")
+
+	// With the fallback, unknown paths get the index, existing files are
+	// served as they are.
+	server = newStaticServer(http.Dir(root), true, false, nil)
+	code, body = get(server, "GET", "/app/route")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "index", body)
+	code, body = get(server, "GET", "/app.js")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "app", body)
+
+	// Other methods aren't redirected to the index.
+	code, _ = get(server, "POST", "/app/route")
+	require.Equal(t, http.StatusNotFound, code)
+
+	// Directories without an index aren't listed, with the fallback they
+	// get the index of the root instead.
+	code, body = get(server, "GET", "/assets/")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "index", body)
+
+	server = newStaticServer(http.Dir(root), false, false, nil)
+	code, _ = get(server, "GET", "/assets/")
+	require.Equal(t, http.StatusNotFound, code)
+	code, body = get(server, "GET", "/assets/logo.svg")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "logo", body)
+}
+
+// TestStaticMountServices tests that static mounts are matched by their
+// longest prefix and serve their files without the prefix.
+func TestStaticMountServices(t *testing.T) {
+	docs, err := ioutil.TempDir("", "docs")
+	require.NoError(t, err)
+	defer os.RemoveAll(docs)
+	err = ioutil.WriteFile(
+		filepath.Join(docs, "api.md"), []byte("api"), 0600,
+	)
+	require.NoError(t, err)
+
+	services, err := staticMountServices([]*StaticMount{{
+		Prefix: "/",
+		Root:   docs,
+		Auth:   "off",
+	}, {
+		Prefix: "/docs/",
+		Root:   docs,
+		Auth:   "on",
+		Price:  10,
+	}}, nil)
+	require.NoError(t, err)
+	require.Len(t, services, 2)
+	require.Equal(t, "static/docs", services[0].Name)
+	require.Equal(t, "static", services[1].Name)
+
+	rec := httptest.NewRecorder()
+	services[0].Handler.ServeHTTP(
+		rec, httptest.NewRequest("GET", "/docs/api.md", nil),
+	)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "api", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	services[0].Handler.ServeHTTP(
+		rec, httptest.NewRequest("GET", "/docs", nil),
+	)
+	require.Equal(t, http.StatusMovedPermanently, rec.Code)
+	require.Equal(t, "/docs/", rec.Header().Get("Location"))
+
+	// Mounts need an absolute and unique prefix and a root.
+	for _, mounts := range [][]*StaticMount{
+		{{Prefix: "docs", Root: docs}},
+		{{Prefix: "/docs", Root: docs}, {Prefix: "/docs/", Root: docs}},
+		{{Prefix: "/docs"}},
+	} {
+		_, err := staticMountServices(mounts, nil)
+		require.Error(t, err)
+	}
+}
+
+// TestProtectedStaticPaths tests that the protected files of a mount are
+// served by a service that requires a paid LSAT and that paths that aren't
+// clean are redirected before they are served.
+func TestProtectedStaticPaths(t *testing.T) {
+	services, err := staticMountServices([]*StaticMount{{
+		Prefix:    "/downloads",
+		Root:      "/tmp",
+		Auth:      "off",
+		Price:     100,
+		Protected: []string{"*.zip", "/reports/**"},
+	}}, nil)
+	require.NoError(t, err)
+	require.Len(t, services, 2)
+
+	protected, free := services[0], services[1]
+	require.True(t, protected.Auth.IsOn())
+	require.Equal(t, int64(100), protected.Price)
+	require.True(t, free.Auth.IsOff())
+
+	pathRegexp := regexp.MustCompile(protected.PathRegexp)
+	for path, match := range map[string]bool{
+		"/downloads/file.zip":        true,
+		"/downloads/dir/file.zip":    false,
+		"/downloads/reports/2020/q1": true,
+		"/downloads/file.zipx":       false,
+		"/downloads/file.txt":        false,
+		"/other/file.zip":            false,
+	} {
+		require.Equal(t, match, pathRegexp.MatchString(path), path)
+	}
+
+	// Paths that would be cleaned to a protected path by the file server
+	// are redirected, so they are matched again.
+	rec := httptest.NewRecorder()
+	free.Handler.ServeHTTP(rec, httptest.NewRequest(
+		"GET", "/downloads/dir/../file.zip", nil,
+	))
+	require.Equal(t, http.StatusMovedPermanently, rec.Code)
+	require.Equal(t, "/downloads/file.zip", rec.Header().Get("Location"))
+}
+
+// TestPricedStaticPaths tests that the files of a mount with their own price
+// are served by a service that binds its tokens to the path of a file and
+// prices each file by the most specific pattern that matches it.
+func TestPricedStaticPaths(t *testing.T) {
+	services, err := staticMountServices([]*StaticMount{{
+		Prefix: "/downloads",
+		Root:   "/tmp",
+		Name:   "downloads",
+		Auth:   "off",
+		Prices: map[string]int64{
+			"/*.zip":       100,
+			"/large/*.zip": 1000,
+		},
+	}}, nil)
+	require.NoError(t, err)
+	require.Len(t, services, 2)
+
+	priced := services[0]
+	require.Equal(t, "downloads-files", priced.Name)
+	require.True(t, priced.Auth.IsOn())
+	require.True(t, priced.Binding.Path)
+	require.Equal(t, int64(1000), priced.Price)
+
+	pathRegexp := regexp.MustCompile(priced.PathRegexp)
+	pathPricer, err := pricer.NewPathPricer(0, priced.PathPrices)
+	require.NoError(t, err)
+	for path, price := range map[string]int64{
+		"/downloads/file.zip":       100,
+		"/downloads/large/file.zip": 1000,
+		"/downloads/file.txt":       0,
+	} {
+		require.Equal(t, price > 0, pathRegexp.MatchString(path), path)
+		if price == 0 {
+			continue
+		}
+
+		filePrice, err := pathPricer.GetPrice(
+			context.Background(), path,
+		)
+		require.NoError(t, err)
+		require.Equal(t, price, filePrice, path)
+	}
+}
+
+// TestStaticConditionalRequests tests that static files carry an entity tag and
+// that conditional and range requests are answered based on it.
+func TestStaticConditionalRequests(t *testing.T) {
+	root, err := ioutil.TempDir("", "static")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	fileName := filepath.Join(root, "data.bin")
+	err = ioutil.WriteFile(fileName, []byte("0123456789"), 0600)
+	require.NoError(t, err)
+	server := newStaticServer(http.Dir(root), false, true, nil)
+
+	do := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/data.bin", nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	etag := rec.Header().Get("Etag")
+	require.NotEmpty(t, etag)
+	require.NotEmpty(t, rec.Header().Get("Last-Modified"))
+	require.Equal(t, "bytes", rec.Header().Get("Accept-Ranges"))
+
+	rec = do(http.Header{"If-None-Match": {etag}})
+	require.Equal(t, http.StatusNotModified, rec.Code)
+
+	// A range is only served if the file didn't change.
+	rec = do(http.Header{"Range": {"bytes=2-4"}, "If-Range": {etag}})
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	require.Equal(t, "234", rec.Body.String())
+
+	rec = do(http.Header{"Range": {"bytes=2-4"}, "If-Range": {`"old"`}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "0123456789", rec.Body.String())
+
+	// Once the file changes, so does its tag.
+	modTime := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(fileName, modTime, modTime))
+	rec = do(http.Header{"If-None-Match": {etag}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotEqual(t, etag, rec.Header().Get("Etag"))
+}
@@ -0,0 +1,190 @@
+package aperture
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+)
+
+// errNoPage is returned if a request doesn't read a templated page.
+var errNoPage = errors.New("no such page")
+
+// staticPageService is the part of a service that is available to templated
+// static pages.
+type staticPageService struct {
+	// Name is the name of the service.
+	Name string
+
+	// Price is the price in satoshis of an LSAT for the service.
+	Price int64
+
+	// Auth is the authentication level of the service.
+	Auth string
+}
+
+// staticPageData is the data templated static pages are rendered with.
+type staticPageData struct {
+	// Services are the services the proxy currently serves.
+	Services []staticPageService
+
+	// OnionAddrs are the addresses of the onion services of the proxy, if
+	// they are registered.
+	OnionAddrs []string
+
+	// ServerName is the domain name of the proxy, if configured.
+	ServerName string
+
+	// PaywallScript is the path of the paywall script, which shows the
+	// payment dialog for the LSAT challenges of requests made by a page.
+	PaywallScript string
+}
+
+// newStaticPageData returns the data templated pages are currently rendered
+// with.
+func (a *Aperture) newStaticPageData() *staticPageData {
+	var services []*proxy.Service
+	if a.proxy != nil {
+		services = a.proxy.Services()
+	}
+
+	data := &staticPageData{
+		Services:      make([]staticPageService, 0, len(services)),
+		ServerName:    a.cfg.ServerName,
+		PaywallScript: proxy.PaywallScriptPath,
+	}
+	for _, service := range services {
+		data.Services = append(data.Services, staticPageService{
+			Name:  service.Name,
+			Price: service.Price,
+			Auth:  string(service.Auth),
+		})
+	}
+
+	a.stateMtx.Lock()
+	data.OnionAddrs = append([]string(nil), a.onionAddrs...)
+	a.stateMtx.Unlock()
+
+	return data
+}
+
+// cachedTemplate is a parsed page template along with the modification time
+// of its file, so it's only parsed again once the file changes.
+type cachedTemplate struct {
+	modTime  time.Time
+	template *template.Template
+}
+
+// staticTemplates renders the HTML files of a static root as templates.
+type staticTemplates struct {
+	fs   http.FileSystem
+	data func() *staticPageData
+
+	mu        sync.Mutex
+	templates map[string]*cachedTemplate
+}
+
+// newStaticTemplates creates templates for the HTML files of the given file
+// system that are rendered with the data returned by the given function.
+func newStaticTemplates(fs http.FileSystem,
+	data func() *staticPageData) *staticTemplates {
+
+	return &staticTemplates{
+		fs:        fs,
+		data:      data,
+		templates: make(map[string]*cachedTemplate),
+	}
+}
+
+// pageName returns the name of the HTML file the request reads, if it reads
+// one. Requests for directories read their index file.
+func pageName(r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", false
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") {
+		name = path.Join(name, staticIndexFile)
+	}
+
+	return name, path.Ext(name) == ".html"
+}
+
+// serve renders the named page and sends it. False is returned if there is no
+// such page, so the request can be served by the file server instead. The
+// rendered page changes with the configuration, so it's sent without a
+// modification time or an entity tag.
+func (t *staticTemplates) serve(w http.ResponseWriter, r *http.Request,
+	name string) bool {
+
+	tmpl, err := t.template(name)
+	switch {
+	case err == errNoPage:
+		return false
+
+	case err != nil:
+		log.Errorf("Error parsing static page %s: %v", name, err)
+		http.Error(w, "error parsing page",
+			http.StatusInternalServerError)
+		return true
+	}
+
+	var page bytes.Buffer
+	if err := tmpl.Execute(&page, t.data()); err != nil {
+		log.Errorf("Error rendering static page %s: %v", name, err)
+		http.Error(w, "error rendering page",
+			http.StatusInternalServerError)
+		return true
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	content := bytes.NewReader(page.Bytes())
+	http.ServeContent(w, r, name, time.Time{}, content)
+	return true
+}
+
+// template returns the parsed template of the named page, parsing it again if
+// the file changed. If there is no such page, errNoPage is returned.
+func (t *staticTemplates) template(name string) (*template.Template, error) {
+	f, err := t.fs.Open(name)
+	if err != nil {
+		return nil, errNoPage
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		return nil, errNoPage
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cached, ok := t.templates[name]
+	if ok && cached.modTime.Equal(stat.ModTime()) {
+		return cached.template, nil
+	}
+
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(name).Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+
+	t.templates[name] = &cachedTemplate{
+		modTime:  stat.ModTime(),
+		template: tmpl,
+	}
+	return tmpl, nil
+}
@@ -0,0 +1,78 @@
+package aperture
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestStaticTemplates tests that the HTML files of the static root are
+// rendered with the current page data and other files are served as they are.
+func TestStaticTemplates(t *testing.T) {
+	root, err := ioutil.TempDir("", "static")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	writeFile := func(name, content string) {
+		err := ioutil.WriteFile(
+			filepath.Join(root, name), []byte(content), 0600,
+		)
+		require.NoError(t, err)
+	}
+	writeFile("index.html", `{{range .Services}}{{.Name}}={{.Price}} `+
+		`{{end}}{{.ServerName}}`)
+	writeFile("app.js", "{{.ServerName}}")
+	writeFile("broken.html", "{{.Services")
+
+	data := &staticPageData{
+		Services:   []staticPageService{{Name: "svc", Price: 10}},
+		ServerName: "example.com",
+	}
+	pageData := func() *staticPageData {
+		return data
+	}
+	server := newStaticServer(http.Dir(root), true, true, pageData)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	rec := get("/")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "svc=10 example.com", rec.Body.String())
+	require.Empty(t, rec.Header().Get("Etag"))
+
+	// The fallback of single-page apps is rendered as well.
+	rec = get("/app/route")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "svc=10 example.com", rec.Body.String())
+
+	// Pages reflect changes of the configuration without a restart.
+	data = &staticPageData{ServerName: "other.com"}
+	rec = get("/")
+	require.Equal(t, "other.com", rec.Body.String())
+
+	// Changed files are parsed again.
+	writeFile("index.html", "new {{.ServerName}}")
+	modTime := time.Now().Add(time.Hour)
+	err = os.Chtimes(filepath.Join(root, "index.html"), modTime, modTime)
+	require.NoError(t, err)
+	rec = get("/")
+	require.Equal(t, "new other.com", rec.Body.String())
+
+	// Other files aren't templates.
+	rec = get("/app.js")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "{{.ServerName}}", rec.Body.String())
+
+	rec = get("/broken.html")
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+}
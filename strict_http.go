@@ -0,0 +1,652 @@
+package aperture
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// strictMaxHeaderBytes is the maximum size of a request header block
+	// that is inspected. It's a bit larger than the default limit of the
+	// HTTP server, so the server can reject oversized headers itself.
+	strictMaxHeaderBytes = http.DefaultMaxHeaderBytes + 4096
+
+	// strictMaxChunkLineBytes is the maximum size of a chunk size line,
+	// including chunk extensions.
+	strictMaxChunkLineBytes = 4096
+
+	// strictHandshakeTimeout is the maximum time a client may take to
+	// complete the TLS handshake.
+	strictHandshakeTimeout = 10 * time.Second
+
+	// strictRejectRequest is a malformed request line that replaces a
+	// request that violates the strict rules. The HTTP server answers it
+	// with 400 and closes the connection, in order with the responses to
+	// previous requests on the same connection.
+	strictRejectRequest = "STRICT-HTTP-VIOLATION\r\n\r\n"
+)
+
+// h2Preface is the start of an HTTP/2 connection with prior knowledge.
+var h2Preface = []byte("PRI * HTTP/2.0\r\n\r\n")
+
+// strictState is the part of an HTTP/1.x message the inspector expects next.
+type strictState uint8
+
+const (
+	stateHeaders strictState = iota
+	stateBody
+	stateChunkLine
+	stateChunkData
+	stateChunkEnd
+	stateTrailers
+	statePassthrough
+)
+
+// http1Inspector follows the framing of the HTTP/1.x requests on a connection
+// and rejects requests that could be framed differently by aperture and a
+// backend. Header blocks are held back until they are complete and valid, so
+// the HTTP server never sees a request that violates the rules.
+type http1Inspector struct {
+	state     strictState
+	buf       []byte
+	remaining int64
+	failed    bool
+}
+
+// inspect validates the given bytes read from a connection and returns the
+// ones that may be passed on to the HTTP server. If a request violates the
+// rules, it's replaced by a malformed request, all further input is dropped
+// and the violation is returned.
+func (i *http1Inspector) inspect(data []byte) ([]byte, error) {
+	if i.failed {
+		return nil, nil
+	}
+
+	var out []byte
+	for len(data) > 0 {
+		var (
+			n   int
+			err error
+		)
+		switch i.state {
+		case stateHeaders:
+			n, out, err = i.readHeaders(data, out)
+
+		case stateBody, stateChunkData:
+			n = len(data)
+			if int64(n) > i.remaining {
+				n = int(i.remaining)
+			}
+			out = append(out, data[:n]...)
+			i.remaining -= int64(n)
+			if i.remaining == 0 && i.state == stateChunkData {
+				i.state = stateChunkEnd
+			} else if i.remaining == 0 {
+				i.state = stateHeaders
+			}
+
+		case stateChunkLine, stateChunkEnd, stateTrailers:
+			n, out, err = i.readChunkFraming(data, out)
+
+		case statePassthrough:
+			n = len(data)
+			out = append(out, data...)
+		}
+		if err != nil {
+			i.failed = true
+			i.buf = nil
+			return append(out, strictRejectRequest...), err
+		}
+
+		data = data[n:]
+	}
+
+	return out, nil
+}
+
+// readLine accumulates the given data until a full CRLF terminated line is
+// buffered. It returns the number of bytes consumed and the last line without
+// its terminator, or nil if the line isn't complete yet.
+func (i *http1Inspector) readLine(data []byte, limit int) (int, []byte,
+	error) {
+
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		i.buf = append(i.buf, data...)
+		if len(i.buf) > limit {
+			return 0, nil, fmt.Errorf("line too long")
+		}
+		return len(data), nil, nil
+	}
+
+	i.buf = append(i.buf, data[:end+1]...)
+	if len(i.buf) > limit {
+		return 0, nil, fmt.Errorf("line too long")
+	}
+
+	// The buffer can contain previous lines of the same header block.
+	line := i.buf[:len(i.buf)-1]
+	line = line[bytes.LastIndexByte(line, '\n')+1:]
+	if len(line) == 0 || line[len(line)-1] != '\r' {
+		return 0, nil, fmt.Errorf("line not terminated by CRLF")
+	}
+	line = line[:len(line)-1]
+	if bytes.IndexByte(line, '\r') >= 0 {
+		return 0, nil, fmt.Errorf("bare CR in line")
+	}
+
+	return end + 1, line, nil
+}
+
+// readHeaders buffers the header block of a request and passes it on once it's
+// complete and valid.
+func (i *http1Inspector) readHeaders(data, out []byte) (int, []byte, error) {
+	consumed := 0
+	for consumed < len(data) {
+		n, line, err := i.readLine(data[consumed:], strictMaxHeaderBytes)
+		if err != nil {
+			return 0, out, err
+		}
+		consumed += n
+		if line == nil {
+			return consumed, out, nil
+		}
+
+		if len(line) > 0 {
+			continue
+		}
+
+		// Empty lines before the request line are passed on as they
+		// are.
+		if len(i.buf) == 2 {
+			out = append(out, i.buf...)
+			i.buf = nil
+			continue
+		}
+
+		block := i.buf
+		i.buf = nil
+		framing, err := validateHeaderBlock(block)
+		if err != nil {
+			return 0, out, err
+		}
+
+		out = append(out, block...)
+		switch {
+		case framing.upgrade:
+			i.state = statePassthrough
+
+		case framing.chunked:
+			i.state = stateChunkLine
+
+		case framing.contentLength > 0:
+			i.state = stateBody
+			i.remaining = framing.contentLength
+		}
+		return consumed, out, nil
+	}
+
+	return consumed, out, nil
+}
+
+// readChunkFraming validates the size lines, the terminators and the trailers
+// of chunked bodies.
+func (i *http1Inspector) readChunkFraming(data, out []byte) (int, []byte,
+	error) {
+
+	n, line, err := i.readLine(data, strictMaxChunkLineBytes)
+	if err != nil {
+		return 0, out, err
+	}
+	if line == nil {
+		return n, out, nil
+	}
+
+	lineBytes := i.buf
+	i.buf = nil
+
+	switch i.state {
+	case stateChunkEnd:
+		if len(line) != 0 {
+			return 0, out, fmt.Errorf("chunk data longer than its " +
+				"size")
+		}
+		i.state = stateChunkLine
+
+	case stateChunkLine:
+		sizeHex := string(line)
+		if idx := strings.IndexByte(sizeHex, ';'); idx >= 0 {
+			sizeHex = sizeHex[:idx]
+		}
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil || size < 0 || len(sizeHex) > 15 {
+			return 0, out, fmt.Errorf("invalid chunk size %q",
+				sizeHex)
+		}
+
+		if size == 0 {
+			i.state = stateTrailers
+		} else {
+			i.state = stateChunkData
+			i.remaining = size
+		}
+
+	case stateTrailers:
+		if len(line) == 0 {
+			i.state = stateHeaders
+			break
+		}
+		if _, _, err := parseHeaderLine(string(line)); err != nil {
+			return 0, out, err
+		}
+	}
+
+	return n, append(out, lineBytes...), nil
+}
+
+// requestFraming describes how the body of a request is framed.
+type requestFraming struct {
+	contentLength int64
+	chunked       bool
+	upgrade       bool
+}
+
+// validateHeaderBlock checks a complete header block, including the request
+// line and the empty line at the end, against the strict rules and returns the
+// framing of the request body.
+func validateHeaderBlock(block []byte) (*requestFraming, error) {
+	// A client speaking HTTP/2 with prior knowledge doesn't send HTTP/1.x
+	// requests at all.
+	if bytes.Equal(block, h2Preface) {
+		return &requestFraming{upgrade: true}, nil
+	}
+
+	lines := strings.Split(
+		strings.TrimSuffix(string(block), "\r\n\r\n"), "\r\n",
+	)
+
+	parts := strings.Split(lines[0], " ")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed request line")
+	}
+	method, target, version := parts[0], parts[1], parts[2]
+	if !isToken(method) {
+		return nil, fmt.Errorf("malformed method")
+	}
+	if version != "HTTP/1.1" && version != "HTTP/1.0" {
+		return nil, fmt.Errorf("unsupported version %q", version)
+	}
+	if err := validateRequestTarget(method, target); err != nil {
+		return nil, err
+	}
+
+	var (
+		framing        requestFraming
+		contentLengths []string
+		encodings      []string
+		hosts          int
+	)
+	for _, line := range lines[1:] {
+		name, value, err := parseHeaderLine(line)
+		if err != nil {
+			return nil, err
+		}
+
+		switch strings.ToLower(name) {
+		case "content-length":
+			contentLengths = append(contentLengths, value)
+
+		case "transfer-encoding":
+			encodings = append(encodings, value)
+
+		case "host":
+			hosts++
+
+		case "upgrade":
+			framing.upgrade = true
+		}
+	}
+
+	if hosts > 1 || (version == "HTTP/1.1" && hosts == 0) {
+		return nil, fmt.Errorf("request must contain exactly one host")
+	}
+
+	switch {
+	case len(encodings) > 0 && len(contentLengths) > 0:
+		return nil, fmt.Errorf("both content-length and " +
+			"transfer-encoding set")
+
+	case len(encodings) > 0:
+		if version != "HTTP/1.1" {
+			return nil, fmt.Errorf("transfer-encoding requires " +
+				"HTTP/1.1")
+		}
+		if len(encodings) != 1 ||
+			!strings.EqualFold(encodings[0], "chunked") {
+
+			return nil, fmt.Errorf("unsupported transfer-encoding")
+		}
+		framing.chunked = true
+
+	case len(contentLengths) > 0:
+		for _, value := range contentLengths {
+			if value != contentLengths[0] {
+				return nil, fmt.Errorf("conflicting " +
+					"content-length values")
+			}
+		}
+		length, err := strconv.ParseInt(contentLengths[0], 10, 64)
+		if err != nil || length < 0 ||
+			strings.TrimLeft(contentLengths[0], "0123456789") != "" {
+
+			return nil, fmt.Errorf("invalid content-length")
+		}
+		framing.contentLength = length
+	}
+
+	// Once a connection switches protocols, it no longer carries HTTP/1.x
+	// requests. We only let GET requests without a body switch, so the
+	// header can't be abused to stop the inspection of a connection.
+	if framing.upgrade && (method != http.MethodGet || framing.chunked ||
+		framing.contentLength > 0) {
+
+		return nil, fmt.Errorf("upgrade only allowed for GET requests " +
+			"without body")
+	}
+
+	return &framing, nil
+}
+
+// validateRequestTarget makes sure the request target is in origin-form, or
+// asterisk-form for the OPTIONS method. Absolute-form and authority-form
+// targets are only meant for forward proxies and can carry a host that differs
+// from the Host header.
+func validateRequestTarget(method, target string) error {
+	if target == "*" && method == http.MethodOptions {
+		return nil
+	}
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		return fmt.Errorf("request target must be in origin-form")
+	}
+	return nil
+}
+
+// parseHeaderLine splits a header line into its name and value and checks both
+// against the strict rules.
+func parseHeaderLine(line string) (string, string, error) {
+	if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+		return "", "", fmt.Errorf("obsolete line folding")
+	}
+
+	idx := strings.IndexByte(line, ':')
+	if idx <= 0 {
+		return "", "", fmt.Errorf("malformed header line")
+	}
+	name, value := line[:idx], strings.Trim(line[idx+1:], " \t")
+	if err := validateHeaderName(name); err != nil {
+		return "", "", err
+	}
+	for _, c := range []byte(value) {
+		if (c < 0x20 && c != '\t') || c == 0x7f {
+			return "", "", fmt.Errorf("control character in "+
+				"header %s", name)
+		}
+	}
+
+	return name, value, nil
+}
+
+// validateHeaderName checks that a header name is a token without underscores.
+// Some servers treat underscores like dashes, so a header like
+// Content_Length could be interpreted differently by a backend.
+func validateHeaderName(name string) error {
+	if !isToken(name) || strings.ContainsRune(name, '_') {
+		return fmt.Errorf("malformed header name %q", name)
+	}
+	return nil
+}
+
+// isToken returns true if the string is a token as defined in RFC 7230.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range []byte(s) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z',
+			c >= '0' && c <= '9':
+
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// strictConn inspects the HTTP/1.x requests read from a connection.
+type strictConn struct {
+	net.Conn
+
+	// tlsConn is set if the connection is encrypted, so the TLS state can
+	// still be given to the handlers.
+	tlsConn *tls.Conn
+
+	inspector http1Inspector
+	readBuf   []byte
+	pending   []byte
+	readErr   error
+	mtx       sync.Mutex
+}
+
+// newStrictConn wraps a connection to inspect the requests read from it.
+func newStrictConn(conn net.Conn) *strictConn {
+	c := &strictConn{Conn: conn}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		c.tlsConn = tlsConn
+	}
+	return c
+}
+
+// Read returns the next inspected bytes of the connection.
+func (c *strictConn) Read(p []byte) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+
+		if len(c.readBuf) < len(p) {
+			c.readBuf = make([]byte, len(p))
+		}
+		n, err := c.Conn.Read(c.readBuf[:len(p)])
+
+		out, violation := c.inspector.inspect(c.readBuf[:n])
+		if violation != nil {
+			log.Infof("Rejecting request from %v in strict HTTP "+
+				"mode: %v", c.RemoteAddr(), violation)
+			err = io.EOF
+		}
+
+		c.pending = out
+		c.readErr = err
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// strictListener wraps the connections of a listener to inspect the requests
+// read from them.
+type strictListener struct {
+	net.Listener
+}
+
+// Accept waits for the next connection and wraps it.
+func (l *strictListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newStrictConn(conn), nil
+}
+
+// strictTLSListener terminates TLS itself, so the decrypted HTTP/1.x requests
+// can be inspected. The HTTP server only recognizes unwrapped TLS connections,
+// so connections that negotiated another protocol like HTTP/2 are returned
+// as they are.
+type strictTLSListener struct {
+	net.Listener
+
+	config *tls.Config
+	conns  chan net.Conn
+	errs   chan error
+	quit   chan struct{}
+	once   sync.Once
+}
+
+// newStrictTLSListener creates a listener that completes the TLS handshake of
+// accepted connections with the given configuration before returning them.
+func newStrictTLSListener(listener net.Listener,
+	config *tls.Config) *strictTLSListener {
+
+	config = config.Clone()
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	l := &strictTLSListener{
+		Listener: listener,
+		config:   config,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error, 1),
+		quit:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+
+	return l
+}
+
+// acceptLoop accepts connections and completes their handshakes in the
+// background, so a slow client doesn't block others.
+func (l *strictTLSListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.quit:
+			}
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				continue
+			}
+			return
+		}
+
+		go l.handshake(conn)
+	}
+}
+
+// handshake completes the TLS handshake of a connection and hands it to the
+// HTTP server.
+func (l *strictTLSListener) handshake(conn net.Conn) {
+	tlsConn := tls.Server(conn, l.config)
+
+	_ = tlsConn.SetDeadline(time.Now().Add(strictHandshakeTimeout))
+	err := tlsConn.Handshake()
+	_ = tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		log.Debugf("TLS handshake with %v failed: %v", conn.RemoteAddr(),
+			err)
+		_ = conn.Close()
+		return
+	}
+
+	var result net.Conn = tlsConn
+	switch tlsConn.ConnectionState().NegotiatedProtocol {
+	case "", "http/1.1":
+		result = newStrictConn(tlsConn)
+	}
+
+	select {
+	case l.conns <- result:
+	case <-l.quit:
+		_ = conn.Close()
+	}
+}
+
+// Accept returns the next connection whose handshake was completed.
+func (l *strictTLSListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.quit:
+		return nil, fmt.Errorf("listener closed")
+	}
+}
+
+// Close stops accepting connections.
+func (l *strictTLSListener) Close() error {
+	l.once.Do(func() { close(l.quit) })
+	return l.Listener.Close()
+}
+
+// strictConnKey is the context key of the connection a request was read from.
+type strictConnKey struct{}
+
+// strictConnContext remembers the connection of the requests in their context,
+// so the TLS state of inspected connections can be restored.
+func strictConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if c, ok := conn.(*strictConn); ok && c.tlsConn != nil {
+		return context.WithValue(ctx, strictConnKey{}, c)
+	}
+	return ctx
+}
+
+// strictHTTPHandler rejects requests that violate the strict rules but can
+// still be detected after they were parsed, which is all that's possible for
+// HTTP/2 and HTTP/3 requests. For inspected TLS connections it also restores
+// the TLS state of the requests.
+func strictHTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := r.Context().Value(strictConnKey{}).(*strictConn); ok {
+			state := c.tlsConn.ConnectionState()
+			r.TLS = &state
+		}
+
+		err := validateRequestTarget(r.Method, r.RequestURI)
+		if err == nil {
+			for name := range r.Header {
+				if err = validateHeaderName(name); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			log.Infof("Rejecting request from %v in strict HTTP "+
+				"mode: %v", r.RemoteAddr, err)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,170 @@
+package aperture
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestHTTP1Inspector tests that requests that violate the strict rules are
+// detected no matter how they are split into reads, and that valid requests are
+// passed on unchanged.
+func TestHTTP1Inspector(t *testing.T) {
+	testCases := []struct {
+		name    string
+		request string
+		valid   bool
+	}{{
+		name:    "simple get",
+		request: "GET /path?q=1 HTTP/1.1\r\nHost: a\r\n\r\n",
+		valid:   true,
+	}, {
+		name: "pipelined requests with bodies",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n" +
+			"\r\nhelloPOST / HTTP/1.1\r\nHost: a\r\n" +
+			"Transfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n" +
+			"0\r\nTrailer: x\r\n\r\nGET / HTTP/1.0\r\n\r\n",
+		valid: true,
+	}, {
+		name:    "websocket upgrade",
+		request: "GET /ws HTTP/1.1\r\nHost: a\r\nUpgrade: websocket\r\n\r\n\x81\x00\n",
+		valid:   true,
+	}, {
+		name:    "http2 prior knowledge",
+		request: "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00\x00\n",
+		valid:   true,
+	}, {
+		name: "content-length and transfer-encoding",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\n" +
+			"Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+	}, {
+		name: "differing content-lengths",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\n" +
+			"Content-Length: 5\r\n\r\nhello",
+	}, {
+		name: "smuggled request in body",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 0\r\n" +
+			"\r\nGET / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: " +
+			"chunked\r\nContent-Length: 3\r\n\r\n",
+	}, {
+		name:    "unsupported transfer-encoding",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip, chunked\r\n\r\n",
+	}, {
+		name:    "underscore in header name",
+		request: "GET / HTTP/1.1\r\nHost: a\r\nContent_Length: 5\r\n\r\n",
+	}, {
+		name:    "space before colon",
+		request: "GET / HTTP/1.1\r\nHost: a\r\nContent-Length : 5\r\n\r\n",
+	}, {
+		name:    "obsolete line folding",
+		request: "GET / HTTP/1.1\r\nHost: a\r\nX-Foo: a\r\n b\r\n\r\n",
+	}, {
+		name:    "bare line feed",
+		request: "GET / HTTP/1.1\nHost: a\n\n",
+	}, {
+		name:    "absolute-form target",
+		request: "GET http://evil/ HTTP/1.1\r\nHost: a\r\n\r\n",
+	}, {
+		name:    "missing host",
+		request: "GET / HTTP/1.1\r\n\r\n",
+	}, {
+		name: "invalid chunk size",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: " +
+			"chunked\r\n\r\n-5\r\nhello\r\n0\r\n\r\n",
+	}, {
+		name: "chunk longer than its size",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: " +
+			"chunked\r\n\r\n2\r\nhello\r\n0\r\n\r\n",
+	}, {
+		name: "upgrade with body",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nUpgrade: foo\r\n" +
+			"Content-Length: 1\r\n\r\nx",
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			for _, chunkSize := range []int{1, 3, len(tc.request)} {
+				var (
+					inspector http1Inspector
+					out       []byte
+					violation error
+				)
+				data := []byte(tc.request)
+				for len(data) > 0 && violation == nil {
+					n := chunkSize
+					if n > len(data) {
+						n = len(data)
+					}
+
+					var chunk []byte
+					chunk, violation = inspector.inspect(
+						data[:n],
+					)
+					out = append(out, chunk...)
+					data = data[n:]
+				}
+
+				if tc.valid {
+					require.NoError(t, violation)
+					require.Equal(t, tc.request, string(out))
+					continue
+				}
+
+				require.Error(t, violation)
+				require.True(t, strings.HasSuffix(
+					string(out), strictRejectRequest,
+				))
+			}
+		})
+	}
+}
+
+// TestStrictListener tests that the HTTP server rejects requests on an
+// inspected connection with 400 while answering previous requests normally.
+func TestStrictListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &http.Server{
+		Handler: strictHTTPHandler(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				_, _ = ioutil.ReadAll(r.Body)
+				_, _ = fmt.Fprint(w, "ok")
+			},
+		)),
+		ConnContext: strictConnContext,
+	}
+	go func() {
+		_ = server.Serve(&strictListener{Listener: listener})
+	}()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = fmt.Fprint(conn, "POST / HTTP/1.1\r\nHost: a\r\n"+
+		"Content-Length: 2\r\n\r\nhi"+
+		"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\n"+
+		"Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n")
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "ok", string(body))
+
+	resp, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,211 @@
+package aperture
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightningnetwork/lnd/lntypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	// topUpPrefix is the key we'll use to prefix the pending top-ups of
+	// the message balances of tokens with when storing them in an etcd
+	// cluster.
+	topUpPrefix = "topup"
+
+	// creditPrefix is the key we'll use to prefix the number of messages
+	// credited to tokens by top-ups with.
+	creditPrefix = "credit"
+
+	// errCreditConflict is returned if a pending top-up or the credited
+	// messages of its token were changed by someone else while claiming
+	// it.
+	errCreditConflict = fmt.Errorf("credit changed concurrently")
+)
+
+// topUpKey returns the full key to store the pending top-up with the given
+// payment hash in the database.
+//
+// The resulting path of the top-up with the payment hash "abc" within etcd
+// would look like:
+//
+//	lsat/proxy/topup/abc
+func topUpKey(hash lntypes.Hash) string {
+	return strings.Join(
+		[]string{topLevelKey, topUpPrefix, hash.String()},
+		etcdKeyDelimeter,
+	)
+}
+
+// creditKey returns the full key to store the number of messages credited to a
+// token in the database.
+//
+// The resulting path of the credit of the token with the ID "abc" within etcd
+// would look like:
+//
+//	lsat/proxy/credit/abc
+func creditKey(tokenID lsat.TokenID) string {
+	return strings.Join(
+		[]string{topLevelKey, creditPrefix, tokenID.String()},
+		etcdKeyDelimeter,
+	)
+}
+
+// topUpStore is a top-up store backed by an etcd cluster. All aperture
+// instances that share the cluster also share the top-ups, so a top-up created
+// by one instance can be claimed against any other, but only once.
+type topUpStore struct {
+	*clientv3.Client
+}
+
+// A compile-time constraint to ensure topUpStore implements proxy.TopUpStore.
+var _ proxy.TopUpStore = (*topUpStore)(nil)
+
+// newTopUpStore creates a new top-up store backed by the given etcd client.
+func newTopUpStore(client *clientv3.Client) *topUpStore {
+	return &topUpStore{Client: client}
+}
+
+// AddTopUp records a pending top-up of the balance of the token.
+//
+// NOTE: This is part of the proxy.TopUpStore interface.
+func (s *topUpStore) AddTopUp(ctx context.Context, hash lntypes.Hash,
+	tokenID lsat.TokenID, messages uint64) error {
+
+	var value [lsat.TokenIDSize + 8]byte
+	copy(value[:], tokenID[:])
+	binary.BigEndian.PutUint64(value[lsat.TokenIDSize:], messages)
+
+	_, err := s.Put(ctx, topUpKey(hash), string(value[:]))
+	return err
+}
+
+// ClaimTopUp atomically removes the pending top-up and credits its messages to
+// the balance of its token. If the credit of the token was changed
+// concurrently, the claim is retried.
+//
+// NOTE: This is part of the proxy.TopUpStore interface.
+func (s *topUpStore) ClaimTopUp(ctx context.Context, hash lntypes.Hash,
+	tokenID lsat.TokenID) (uint64, bool, error) {
+
+	for {
+		messages, ok, err := s.claim(ctx, hash, tokenID)
+		switch {
+		case err == errCreditConflict:
+			continue
+
+		case err != nil:
+			return 0, false, err
+
+		default:
+			return messages, ok, nil
+		}
+	}
+}
+
+// claim tries to claim the pending top-up with the given payment hash once.
+func (s *topUpStore) claim(ctx context.Context, hash lntypes.Hash,
+	tokenID lsat.TokenID) (uint64, bool, error) {
+
+	key := topUpKey(hash)
+	resp, err := s.Get(ctx, key)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, false, nil
+	}
+
+	value := resp.Kvs[0].Value
+	if len(value) != lsat.TokenIDSize+8 {
+		return 0, false, fmt.Errorf("invalid top-up size %v",
+			len(value))
+	}
+	var owner lsat.TokenID
+	copy(owner[:], value)
+	if owner != tokenID {
+		return 0, false, nil
+	}
+	messages := binary.BigEndian.Uint64(value[lsat.TokenIDSize:])
+	topUpRevision := resp.Kvs[0].ModRevision
+
+	credit := creditKey(tokenID)
+	resp, err = s.Get(ctx, credit)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// A mod revision of zero means the token wasn't credited yet.
+	var (
+		credited       uint64
+		creditRevision int64
+	)
+	if len(resp.Kvs) > 0 {
+		credited, err = decodeCredited(resp.Kvs[0].Value)
+		if err != nil {
+			return 0, false, err
+		}
+		creditRevision = resp.Kvs[0].ModRevision
+	}
+
+	// The top-up is only removed and credited if neither it nor the
+	// credit of its token were modified since we read them.
+	var newCredited [8]byte
+	binary.BigEndian.PutUint64(newCredited[:], credited+messages)
+	txnResp, err := s.Txn(ctx).
+		If(
+			clientv3.Compare(
+				clientv3.ModRevision(key), "=", topUpRevision,
+			),
+			clientv3.Compare(
+				clientv3.ModRevision(credit), "=",
+				creditRevision,
+			),
+		).
+		Then(
+			clientv3.OpDelete(key),
+			clientv3.OpPut(credit, string(newCredited[:])),
+		).
+		Commit()
+	if err != nil {
+		return 0, false, err
+	}
+	if !txnResp.Succeeded {
+		return 0, false, errCreditConflict
+	}
+
+	return messages, true, nil
+}
+
+// Credited returns the number of messages that were credited to the balance of
+// the token.
+//
+// NOTE: This is part of the proxy.TopUpStore interface.
+func (s *topUpStore) Credited(ctx context.Context,
+	tokenID lsat.TokenID) (uint64, error) {
+
+	resp, err := s.Get(ctx, creditKey(tokenID))
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+
+	return decodeCredited(resp.Kvs[0].Value)
+}
+
+// decodeCredited decodes the number of credited messages stored in the
+// database.
+func decodeCredited(value []byte) (uint64, error) {
+	if len(value) != 8 {
+		return 0, fmt.Errorf("invalid credit size %v", len(value))
+	}
+
+	return binary.BigEndian.Uint64(value), nil
+}
@@ -0,0 +1,78 @@
+package aperture
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTopUpStore tests that the etcd backed top-up stores of two instances
+// share the top-ups of tokens and credit each of them only once, even if it's
+// claimed concurrently.
+func TestTopUpStore(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	var (
+		ctx    = context.Background()
+		stores = []*topUpStore{
+			newTopUpStore(etcdClient), newTopUpStore(etcdClient),
+		}
+		tokenID    = lsat.TokenID{1}
+		otherToken = lsat.TokenID{2}
+		hashes     = []lntypes.Hash{{1}, {2}}
+	)
+
+	for _, hash := range hashes {
+		err := stores[0].AddTopUp(ctx, hash, tokenID, 5)
+		require.NoError(t, err)
+	}
+
+	// A top-up can't be claimed for another token.
+	_, ok, err := stores[1].ClaimTopUp(ctx, hashes[0], otherToken)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Claim both top-ups several times concurrently on both instances.
+	// Each may only be credited once.
+	var (
+		wg      sync.WaitGroup
+		mtx     sync.Mutex
+		claimed int
+	)
+	for i := 0; i < 10; i++ {
+		store := stores[i%len(stores)]
+		hash := hashes[i%len(hashes)]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, ok, err := store.ClaimTopUp(ctx, hash, tokenID)
+			if err != nil {
+				t.Errorf("unable to claim top-up: %v", err)
+				return
+			}
+			if ok {
+				mtx.Lock()
+				claimed++
+				mtx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 2, claimed)
+
+	credited, err := stores[1].Credited(ctx, tokenID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), credited)
+
+	credited, err = stores[0].Credited(ctx, otherToken)
+	require.NoError(t, err)
+	require.Zero(t, credited)
+}
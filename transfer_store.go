@@ -0,0 +1,144 @@
+package aperture
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/proxy"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	// transferPrefix is the key we'll use to prefix the number of response
+	// bytes sent with all tokens with when storing them in an etcd
+	// cluster.
+	transferPrefix = "transfer"
+
+	// errTransferConflict is returned if the transferred bytes of a token
+	// were changed by someone else between reading and updating them.
+	errTransferConflict = fmt.Errorf("transferred bytes changed " +
+		"concurrently")
+)
+
+// transferKey returns the full key to store the number of response bytes sent
+// with a token in the database.
+//
+// The resulting path of the transferred bytes of the token with the ID "abc"
+// within etcd would look like:
+//
+//	lsat/proxy/transfer/abc
+func transferKey(tokenID lsat.TokenID) string {
+	return strings.Join(
+		[]string{topLevelKey, transferPrefix, tokenID.String()},
+		etcdKeyDelimeter,
+	)
+}
+
+// transferStore is a transfer store backed by an etcd cluster. All aperture
+// instances that share the cluster also share the transferred bytes, so the
+// quota of a token can't be downloaded again from a different instance.
+type transferStore struct {
+	*clientv3.Client
+}
+
+// A compile-time constraint to ensure transferStore implements
+// proxy.TransferStore.
+var _ proxy.TransferStore = (*transferStore)(nil)
+
+// newTransferStore creates a new transfer store backed by the given etcd
+// client.
+func newTransferStore(client *clientv3.Client) *transferStore {
+	return &transferStore{Client: client}
+}
+
+// Transferred returns the number of response bytes that were sent with the
+// token so far.
+//
+// NOTE: This is part of the proxy.TransferStore interface.
+func (s *transferStore) Transferred(ctx context.Context,
+	tokenID lsat.TokenID) (uint64, error) {
+
+	resp, err := s.Get(ctx, transferKey(tokenID))
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+
+	return decodeTransferred(resp.Kvs[0].Value)
+}
+
+// AddTransferred atomically adds the given number of bytes to the bytes that
+// were sent with the token. If a concurrent response was recorded in the
+// meantime, the update is retried with the new value.
+//
+// NOTE: This is part of the proxy.TransferStore interface.
+func (s *transferStore) AddTransferred(ctx context.Context,
+	tokenID lsat.TokenID, n uint64) error {
+
+	key := transferKey(tokenID)
+	for {
+		err := s.addTransferred(ctx, key, n)
+		if err == errTransferConflict {
+			continue
+		}
+
+		return err
+	}
+}
+
+// addTransferred tries to add the given number of bytes to the transferred
+// bytes with the given key once.
+func (s *transferStore) addTransferred(ctx context.Context, key string,
+	n uint64) error {
+
+	resp, err := s.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	// Only write the new value if the key wasn't modified since we read
+	// it. A mod revision of zero means the key doesn't exist yet.
+	var (
+		transferred uint64
+		modRevision int64
+	)
+	if len(resp.Kvs) > 0 {
+		transferred, err = decodeTransferred(resp.Kvs[0].Value)
+		if err != nil {
+			return err
+		}
+		modRevision = resp.Kvs[0].ModRevision
+	}
+
+	var newTransferred [8]byte
+	binary.BigEndian.PutUint64(newTransferred[:], transferred+n)
+	txnResp, err := s.Txn(ctx).
+		If(clientv3.Compare(
+			clientv3.ModRevision(key), "=", modRevision,
+		)).
+		Then(clientv3.OpPut(key, string(newTransferred[:]))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !txnResp.Succeeded {
+		return errTransferConflict
+	}
+
+	return nil
+}
+
+// decodeTransferred decodes the number of transferred bytes stored in the
+// database.
+func decodeTransferred(value []byte) (uint64, error) {
+	if len(value) != 8 {
+		return 0, fmt.Errorf("invalid transfer size %v", len(value))
+	}
+
+	return binary.BigEndian.Uint64(value), nil
+}
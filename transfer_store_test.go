@@ -0,0 +1,58 @@
+package aperture
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTransferStore tests that the etcd backed transfer stores of two
+// instances share the transferred bytes of tokens and don't lose any bytes if
+// responses are recorded concurrently.
+func TestTransferStore(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	var (
+		ctx    = context.Background()
+		stores = []*transferStore{
+			newTransferStore(etcdClient), newTransferStore(etcdClient),
+		}
+		tokenID    = lsat.TokenID{1}
+		otherToken = lsat.TokenID{2}
+	)
+
+	transferred, err := stores[0].Transferred(ctx, tokenID)
+	require.NoError(t, err)
+	require.Zero(t, transferred)
+
+	// Record responses concurrently on both instances.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		store := stores[i%len(stores)]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := store.AddTransferred(ctx, tokenID, 100)
+			if err != nil {
+				t.Errorf("unable to record transfer: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	transferred, err = stores[1].Transferred(ctx, tokenID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1000), transferred)
+
+	// The transferred bytes of other tokens are independent.
+	transferred, err = stores[0].Transferred(ctx, otherToken)
+	require.NoError(t, err)
+	require.Zero(t, transferred)
+}
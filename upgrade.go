@@ -0,0 +1,291 @@
+package aperture
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// listenFDsEnv is the environment variable that tells a process how
+	// many listening sockets it inherited. We use the same variables as
+	// systemd's socket activation, so aperture can be started by systemd
+	// with its sockets as well.
+	listenFDsEnv = "LISTEN_FDS"
+
+	// listenFDNamesEnv is the environment variable that contains the
+	// colon separated names of the inherited sockets. See the listener
+	// name constants for the names we use.
+	listenFDNamesEnv = "LISTEN_FDNAMES"
+
+	// listenPIDEnv is the environment variable systemd uses to indicate
+	// which process the sockets are meant for.
+	listenPIDEnv = "LISTEN_PID"
+
+	// upgradeReadyFDEnv is the environment variable that contains the file
+	// descriptor an upgraded process signals its readiness on.
+	upgradeReadyFDEnv = "APERTURE_UPGRADE_READY_FD"
+
+	// listenFDsStart is the first file descriptor of inherited sockets.
+	listenFDsStart = 3
+
+	// upgradeReadyTimeout is the maximum time we wait for an upgraded
+	// process to start serving before we give up on the upgrade.
+	upgradeReadyTimeout = 2 * time.Minute
+
+	// mainListenerName is the name of the socket of the main server.
+	mainListenerName = "main"
+
+	// torListenerName is the name of the socket of the server behind the
+	// onion services.
+	torListenerName = "tor"
+)
+
+var (
+	// inheritedListeners are the listening sockets that were handed over
+	// to us by the process we're replacing, mapped by their name.
+	inheritedListeners map[string]net.Listener
+
+	// inheritedListenersOnce makes sure the inherited sockets are only
+	// taken over once.
+	inheritedListenersOnce sync.Once
+)
+
+// listen returns a listener for the given TCP address. If we inherited a
+// socket with the given name, that socket is used instead, otherwise a new one
+// is created.
+func listen(name, addr string) (net.Listener, error) {
+	inheritedListenersOnce.Do(func() {
+		var err error
+		inheritedListeners, err = takeInheritedListeners()
+		if err != nil {
+			log.Errorf("Unable to take over inherited sockets: %v",
+				err)
+		}
+	})
+
+	if listener, ok := inheritedListeners[name]; ok {
+		log.Infof("Taking over inherited %s socket listening on %s",
+			name, listener.Addr())
+		delete(inheritedListeners, name)
+		return listener, nil
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// takeInheritedListeners creates listeners for all sockets that were passed
+// to us through the socket activation environment variables.
+func takeInheritedListeners() (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener)
+
+	numFDs, err := strconv.Atoi(os.Getenv(listenFDsEnv))
+	if err != nil || numFDs == 0 {
+		return listeners, nil
+	}
+
+	// The sockets might be meant for another process, if someone just
+	// left the variables in the environment.
+	pid := os.Getenv(listenPIDEnv)
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return listeners, nil
+	}
+
+	names := strings.Split(os.Getenv(listenFDNamesEnv), ":")
+	if len(names) != numFDs {
+		return nil, fmt.Errorf("got %d socket names for %d sockets",
+			len(names), numFDs)
+	}
+
+	// Our own children must not inherit the variables.
+	_ = os.Unsetenv(listenFDsEnv)
+	_ = os.Unsetenv(listenFDNamesEnv)
+	_ = os.Unsetenv(listenPIDEnv)
+
+	for i, name := range names {
+		file := os.NewFile(uintptr(listenFDsStart+i), name)
+		listener, err := net.FileListener(file)
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid inherited socket %s: %v",
+				name, err)
+		}
+		listeners[name] = listener
+	}
+
+	return listeners, nil
+}
+
+// notifyUpgradeReady tells the process we're replacing that we're serving
+// requests now, so it can stop accepting new connections.
+func notifyUpgradeReady() {
+	fd, err := strconv.Atoi(os.Getenv(upgradeReadyFDEnv))
+	if err != nil {
+		return
+	}
+	_ = os.Unsetenv(upgradeReadyFDEnv)
+
+	file := os.NewFile(uintptr(fd), "upgrade-ready")
+	if _, err := file.Write([]byte{1}); err != nil {
+		log.Errorf("Unable to signal upgrade readiness: %v", err)
+	}
+	_ = file.Close()
+}
+
+// fileListener is a listener that can return a duplicate of its socket's file
+// descriptor, like net.TCPListener.
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+// Upgrade starts the aperture binary again and hands our listening sockets over
+// to the new process. Once the new process is serving requests, our servers
+// stop accepting new connections and we wait for the open ones to finish, so
+// long-lived streams the clients paid for aren't interrupted. The caller
+// should stop aperture once this returns without an error. If the new process
+// fails to start, we keep serving as before.
+func (a *Aperture) Upgrade() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// Hand over all listening sockets, followed by a pipe the new process
+	// signals its readiness on.
+	var (
+		files []*os.File
+		names []string
+	)
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}()
+	for name, listener := range a.listeners {
+		l, ok := listener.(fileListener)
+		if !ok {
+			return fmt.Errorf("%s socket can't be handed over",
+				name)
+		}
+		file, err := l.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+		names = append(names, name)
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = readyReader.Close()
+	}()
+	files = append(files, readyWriter)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(
+		os.Environ(),
+		fmt.Sprintf("%s=%d", listenFDsEnv, len(names)),
+		fmt.Sprintf("%s=%s", listenFDNamesEnv, strings.Join(names, ":")),
+		fmt.Sprintf("%s=%d", upgradeReadyFDEnv,
+			listenFDsStart+len(names)),
+	)
+
+	log.Infof("Starting upgraded aperture binary %s", executable)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to start upgraded binary: %v", err)
+	}
+
+	// Once the new process has its copies, we need to close ours so we
+	// notice if it exits without signaling readiness.
+	for _, file := range files {
+		_ = file.Close()
+	}
+	files = nil
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyReader.Read(buf)
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			_ = cmd.Wait()
+			return fmt.Errorf("upgraded binary exited before "+
+				"serving requests: %v", err)
+		}
+
+	case <-time.After(upgradeReadyTimeout):
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("upgraded binary didn't start serving "+
+			"requests within %v", upgradeReadyTimeout)
+	}
+
+	// The new process is running on its own from now on.
+	log.Infof("Upgraded aperture (pid %d) is serving requests, waiting "+
+		"for open connections to finish", cmd.Process.Pid)
+	_ = cmd.Process.Release()
+
+	a.drain()
+	return nil
+}
+
+// drain stops our servers from accepting new connections and waits for all
+// open connections to finish, at most for the configured drain timeout.
+func (a *Aperture) drain() {
+	a.stateMtx.Lock()
+	a.draining = true
+	a.stateMtx.Unlock()
+
+	// Let the registry show that we're no longer accepting requests right
+	// away instead of on the next heartbeat.
+	if a.registry != nil {
+		if err := a.registry.heartbeat(); err != nil {
+			log.Errorf("Error updating instance registration: %v",
+				err)
+		}
+	}
+
+	ctx := context.Background()
+	if a.cfg.DrainTimeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, a.cfg.DrainTimeout)
+		defer cancel()
+	}
+
+	var wg sync.WaitGroup
+	for _, server := range []*http.Server{a.httpsServer, a.torHTTPServer} {
+		if server == nil {
+			continue
+		}
+
+		server := server
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := server.Shutdown(ctx); err != nil {
+				log.Warnf("Not all connections finished in "+
+					"time: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package aperture
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// upgradeSignal returns a channel that receives a value whenever the operator
+// asks for a binary upgrade by sending SIGUSR2.
+func upgradeSignal() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	return signals
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package aperture
+
+import (
+	"os"
+)
+
+// upgradeSignal returns a channel that never receives a value because handing
+// over sockets to an upgraded binary isn't supported on Windows.
+func upgradeSignal() <-chan os.Signal {
+	return nil
+}
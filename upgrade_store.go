@@ -0,0 +1,106 @@
+package aperture
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightningnetwork/lnd/lntypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	// upgradePrefix is the key we'll use to prefix the pending tier
+	// upgrades of tokens with when storing them in an etcd cluster.
+	upgradePrefix = "upgrade"
+)
+
+// upgradeKey returns the full key to store the pending upgrade with the given
+// payment hash in the database.
+//
+// The resulting path of the upgrade with the payment hash "abc" within etcd
+// would look like:
+//
+//	lsat/proxy/upgrade/abc
+func upgradeKey(hash lntypes.Hash) string {
+	return strings.Join(
+		[]string{topLevelKey, upgradePrefix, hash.String()},
+		etcdKeyDelimeter,
+	)
+}
+
+// upgradeStore is an upgrade store backed by an etcd cluster. All aperture
+// instances that share the cluster also share the upgrades, so an upgrade
+// created by one instance can be claimed against any other, but only once.
+type upgradeStore struct {
+	*clientv3.Client
+}
+
+// A compile-time constraint to ensure upgradeStore implements
+// proxy.UpgradeStore.
+var _ proxy.UpgradeStore = (*upgradeStore)(nil)
+
+// newUpgradeStore creates a new upgrade store backed by the given etcd client.
+func newUpgradeStore(client *clientv3.Client) *upgradeStore {
+	return &upgradeStore{Client: client}
+}
+
+// AddUpgrade records a pending upgrade of the token.
+//
+// NOTE: This is part of the proxy.UpgradeStore interface.
+func (s *upgradeStore) AddUpgrade(ctx context.Context, hash lntypes.Hash,
+	tokenID lsat.TokenID, tier lsat.ServiceTier) error {
+
+	var value [lsat.TokenIDSize + 1]byte
+	copy(value[:], tokenID[:])
+	value[lsat.TokenIDSize] = byte(tier)
+
+	_, err := s.Put(ctx, upgradeKey(hash), string(value[:]))
+	return err
+}
+
+// ClaimUpgrade atomically removes the pending upgrade of the token. Only one
+// of several concurrent claims of the same upgrade succeeds.
+//
+// NOTE: This is part of the proxy.UpgradeStore interface.
+func (s *upgradeStore) ClaimUpgrade(ctx context.Context, hash lntypes.Hash,
+	tokenID lsat.TokenID) (lsat.ServiceTier, bool, error) {
+
+	key := upgradeKey(hash)
+	resp, err := s.Get(ctx, key)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, false, nil
+	}
+
+	value := resp.Kvs[0].Value
+	if len(value) != lsat.TokenIDSize+1 {
+		return 0, false, fmt.Errorf("invalid upgrade size %v",
+			len(value))
+	}
+	var owner lsat.TokenID
+	copy(owner[:], value)
+	if owner != tokenID {
+		return 0, false, nil
+	}
+
+	// The upgrade is only removed if it wasn't claimed since we read it.
+	txnResp, err := s.Txn(ctx).
+		If(clientv3.Compare(
+			clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision,
+		)).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	if err != nil {
+		return 0, false, err
+	}
+	if !txnResp.Succeeded {
+		return 0, false, nil
+	}
+
+	return lsat.ServiceTier(value[lsat.TokenIDSize]), true, nil
+}
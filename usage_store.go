@@ -0,0 +1,136 @@
+package aperture
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/proxy"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	// requestsPrefix is the key we'll use to prefix the number of requests
+	// made with all tokens with when storing them in an etcd cluster.
+	requestsPrefix = "requests"
+
+	// errRequestsConflict is returned if the number of requests of a token
+	// was changed by someone else between reading and updating it.
+	errRequestsConflict = fmt.Errorf("requests changed concurrently")
+)
+
+// requestsKey returns the full key to store the number of requests made with a
+// token in the database.
+//
+// The resulting path of the requests of the token with the ID "abc" within etcd
+// would look like:
+//
+//	lsat/proxy/requests/abc
+func requestsKey(tokenID lsat.TokenID) string {
+	return strings.Join(
+		[]string{topLevelKey, requestsPrefix, tokenID.String()},
+		etcdKeyDelimeter,
+	)
+}
+
+// usageStore is a usage store backed by an etcd cluster. All aperture instances
+// that share the cluster count the requests of a token together.
+type usageStore struct {
+	*clientv3.Client
+}
+
+// A compile-time constraint to ensure usageStore implements proxy.UsageStore.
+var _ proxy.UsageStore = (*usageStore)(nil)
+
+// newUsageStore creates a new usage store backed by the given etcd client.
+func newUsageStore(client *clientv3.Client) *usageStore {
+	return &usageStore{Client: client}
+}
+
+// Requests returns the number of requests that were made with the token so
+// far.
+//
+// NOTE: This is part of the proxy.UsageStore interface.
+func (s *usageStore) Requests(ctx context.Context,
+	tokenID lsat.TokenID) (uint64, error) {
+
+	resp, err := s.Get(ctx, requestsKey(tokenID))
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+
+	return decodeRequests(resp.Kvs[0].Value)
+}
+
+// AddRequest atomically records a request that was made with the token. If a
+// concurrent request was recorded in the meantime, the update is retried with
+// the new value.
+//
+// NOTE: This is part of the proxy.UsageStore interface.
+func (s *usageStore) AddRequest(ctx context.Context,
+	tokenID lsat.TokenID) error {
+
+	key := requestsKey(tokenID)
+	for {
+		err := s.addRequest(ctx, key)
+		if err == errRequestsConflict {
+			continue
+		}
+
+		return err
+	}
+}
+
+// addRequest tries to increment the number of requests with the given key
+// once.
+func (s *usageStore) addRequest(ctx context.Context, key string) error {
+	resp, err := s.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	// Only write the new value if the key wasn't modified since we read
+	// it. A mod revision of zero means the key doesn't exist yet.
+	var (
+		requests    uint64
+		modRevision int64
+	)
+	if len(resp.Kvs) > 0 {
+		requests, err = decodeRequests(resp.Kvs[0].Value)
+		if err != nil {
+			return err
+		}
+		modRevision = resp.Kvs[0].ModRevision
+	}
+
+	var newRequests [8]byte
+	binary.BigEndian.PutUint64(newRequests[:], requests+1)
+	txnResp, err := s.Txn(ctx).
+		If(clientv3.Compare(
+			clientv3.ModRevision(key), "=", modRevision,
+		)).
+		Then(clientv3.OpPut(key, string(newRequests[:]))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !txnResp.Succeeded {
+		return errRequestsConflict
+	}
+
+	return nil
+}
+
+// decodeRequests decodes the number of requests stored in the database.
+func decodeRequests(value []byte) (uint64, error) {
+	if len(value) != 8 {
+		return 0, fmt.Errorf("invalid requests size %v", len(value))
+	}
+
+	return binary.BigEndian.Uint64(value), nil
+}
@@ -0,0 +1,270 @@
+package aperture
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightninglabs/aperture/vault"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// vaultTimeout is the maximum time we wait for Vault when reading
+	// credentials on startup.
+	vaultTimeout = 10 * time.Second
+
+	// vaultCertReloadInterval is the interval in which the TLS certificate
+	// is read from Vault again, so renewed certificates are picked up
+	// without a restart.
+	vaultCertReloadInterval = time.Hour
+)
+
+// applyVaultEtcdCredentials replaces the etcd user and password of the
+// configuration with the ones stored in Vault.
+func applyVaultEtcdCredentials(client *vault.Client, path string,
+	cfg *EtcdConfig) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+
+	data, err := client.Read(ctx, path)
+	if err != nil {
+		return fmt.Errorf("unable to read etcd credentials: %v", err)
+	}
+
+	cfg.User = data["user"]
+	cfg.Password = data["password"]
+	return nil
+}
+
+// macaroonCredential is a gRPC credential that sends a macaroon with every
+// call.
+type macaroonCredential struct {
+	macaroonHex string
+}
+
+// GetRequestMetadata returns the macaroon in the metadata lnd expects.
+//
+// NOTE: This is part of the credentials.PerRPCCredentials interface.
+func (m *macaroonCredential) GetRequestMetadata(_ context.Context,
+	_ ...string) (map[string]string, error) {
+
+	return map[string]string{"macaroon": m.macaroonHex}, nil
+}
+
+// RequireTransportSecurity makes sure the macaroon is never sent in clear
+// text.
+//
+// NOTE: This is part of the credentials.PerRPCCredentials interface.
+func (m *macaroonCredential) RequireTransportSecurity() bool {
+	return true
+}
+
+// newVaultLndClient connects to lnd with the invoice macaroon and the TLS
+// certificate stored in Vault, so neither of them needs to be on disk.
+func newVaultLndClient(client *vault.Client, path,
+	lndHost string) (lnrpc.LightningClient, *grpc.ClientConn, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+
+	data, err := client.Read(ctx, path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read lnd credentials: %v",
+			err)
+	}
+	if _, err := hex.DecodeString(data["macaroon"]); err != nil ||
+		data["macaroon"] == "" {
+
+		return nil, nil, fmt.Errorf("lnd credentials in %s must "+
+			"contain the hex encoded macaroon", path)
+	}
+
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM([]byte(data["tlscert"])) {
+		return nil, nil, fmt.Errorf("lnd credentials in %s must "+
+			"contain the PEM encoded TLS certificate", path)
+	}
+
+	conn, err := grpc.Dial(
+		lndHost,
+		grpc.WithTransportCredentials(
+			credentials.NewClientTLSFromCert(certPool, ""),
+		),
+		grpc.WithPerRPCCredentials(&macaroonCredential{
+			macaroonHex: data["macaroon"],
+		}),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to connect to lnd: %v", err)
+	}
+
+	return lnrpc.NewLightningClient(conn), conn, nil
+}
+
+// vaultCertificate serves the TLS certificate stored in Vault and reads it
+// again periodically.
+type vaultCertificate struct {
+	client *vault.Client
+	path   string
+
+	cert     *tls.Certificate
+	loadedAt time.Time
+	mtx      sync.Mutex
+}
+
+// newVaultTLSConfig returns a TLS configuration that uses the certificate and
+// key stored in Vault.
+func newVaultTLSConfig(client *vault.Client, path string) (*tls.Config,
+	error) {
+
+	certificate := &vaultCertificate{client: client, path: path}
+	if err := certificate.load(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetCertificate: certificate.GetCertificate,
+		CipherSuites:   http2TLSCipherSuites,
+		MinVersion:     tls.VersionTLS10,
+	}, nil
+}
+
+// load reads the certificate and key from Vault.
+func (v *vaultCertificate) load() error {
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+
+	data, err := v.client.Read(ctx, v.path)
+	if err != nil {
+		return fmt.Errorf("unable to read TLS certificate: %v", err)
+	}
+
+	cert, err := tls.X509KeyPair([]byte(data["cert"]), []byte(data["key"]))
+	if err != nil {
+		return fmt.Errorf("invalid TLS certificate in %s: %v", v.path,
+			err)
+	}
+
+	v.mtx.Lock()
+	v.cert = &cert
+	v.loadedAt = time.Now()
+	v.mtx.Unlock()
+
+	return nil
+}
+
+// GetCertificate returns the current certificate. If it was loaded a while ago,
+// it's read from Vault again first. If that fails, the previous certificate is
+// used until the next attempt.
+func (v *vaultCertificate) GetCertificate(_ *tls.ClientHelloInfo) (
+	*tls.Certificate, error) {
+
+	v.mtx.Lock()
+	cert, loadedAt := v.cert, v.loadedAt
+	v.mtx.Unlock()
+
+	if time.Since(loadedAt) > vaultCertReloadInterval {
+		if err := v.load(); err != nil {
+			log.Errorf("Unable to reload TLS certificate from "+
+				"vault: %v", err)
+
+			// Don't try again on every handshake.
+			v.mtx.Lock()
+			v.loadedAt = time.Now()
+			v.mtx.Unlock()
+		} else {
+			v.mtx.Lock()
+			cert = v.cert
+			v.mtx.Unlock()
+		}
+	}
+
+	return cert, nil
+}
+
+// vaultSecretStore is a store of LSAT secrets backed by the KV secrets engine
+// of Vault.
+type vaultSecretStore struct {
+	client *vault.Client
+	path   string
+}
+
+// A compile-time constraint to ensure vaultSecretStore implements
+// mint.SecretStore.
+var _ mint.SecretStore = (*vaultSecretStore)(nil)
+
+// newVaultSecretStore instantiates a new LSAT secrets store that keeps the
+// secrets below the given KV path.
+func newVaultSecretStore(client *vault.Client, path string) *vaultSecretStore {
+	return &vaultSecretStore{client: client, path: path}
+}
+
+// secretPath returns the KV path of the secret of an LSAT identifier.
+//
+// The resulting path of the identifier bff4ee83 below aperture/secrets would
+// look like:
+//
+//	aperture/secrets/bff4ee83
+func (s *vaultSecretStore) secretPath(id [sha256.Size]byte) string {
+	return s.path + "/" + hex.EncodeToString(id[:])
+}
+
+// NewSecret creates a new cryptographically random secret which is keyed by the
+// given hash.
+func (s *vaultSecretStore) NewSecret(ctx context.Context,
+	id [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
+
+	var secret [lsat.SecretSize]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return secret, err
+	}
+
+	err := s.client.Write(ctx, s.secretPath(id), map[string]string{
+		"secret": hex.EncodeToString(secret[:]),
+	})
+	return secret, err
+}
+
+// GetSecret returns the cryptographically random secret that corresponds to the
+// given hash. If there is no secret, then mint.ErrSecretNotFound is returned.
+func (s *vaultSecretStore) GetSecret(ctx context.Context,
+	id [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
+
+	value, err := s.client.ReadField(ctx, s.secretPath(id), "secret")
+	if err == vault.ErrNotFound {
+		return [lsat.SecretSize]byte{}, mint.ErrSecretNotFound
+	}
+	if err != nil {
+		return [lsat.SecretSize]byte{}, err
+	}
+
+	secretBytes, err := hex.DecodeString(value)
+	if err != nil || len(secretBytes) != lsat.SecretSize {
+		return [lsat.SecretSize]byte{}, fmt.Errorf("invalid secret "+
+			"size %v", len(secretBytes))
+	}
+
+	var secret [lsat.SecretSize]byte
+	copy(secret[:], secretBytes)
+	return secret, nil
+}
+
+// RevokeSecret removes the cryptographically random secret that corresponds to
+// the given hash. This acts as a NOP if the secret does not exist.
+func (s *vaultSecretStore) RevokeSecret(ctx context.Context,
+	id [sha256.Size]byte) error {
+
+	return s.client.Delete(ctx, s.secretPath(id))
+}
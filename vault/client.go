@@ -0,0 +1,283 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenEnv is the environment variable the Vault token is read from if
+	// no token file is configured.
+	tokenEnv = "VAULT_TOKEN"
+
+	// requestTimeout is the maximum time a single request to Vault may
+	// take.
+	requestTimeout = 10 * time.Second
+
+	// minRenewInterval is the minimum time between two token renewals.
+	minRenewInterval = 5 * time.Second
+
+	// renewRetryDelay is the time we wait before we retry a failed token
+	// renewal.
+	renewRetryDelay = 10 * time.Second
+)
+
+var (
+	// ErrNotFound is returned if a secret doesn't exist.
+	ErrNotFound = errors.New("secret not found in vault")
+)
+
+// Client is a minimal client of the Vault HTTP API that reads and writes
+// secrets of a KV version 2 secrets engine and keeps its token alive.
+type Client struct {
+	addr  string
+	mount string
+	http  *http.Client
+
+	token    string
+	tokenMtx sync.RWMutex
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewClient creates a client for the Vault server at the given address that
+// uses the KV secrets engine mounted at the given path. The token is read from
+// the given file, or from the VAULT_TOKEN environment variable if no file is
+// given.
+func NewClient(addr, tokenFile, mount string) (*Client, error) {
+	token := os.Getenv(tokenEnv)
+	if tokenFile != "" {
+		tokenBytes, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read vault token: %v",
+				err)
+		}
+		token = strings.TrimSpace(string(tokenBytes))
+	}
+	if token == "" {
+		return nil, fmt.Errorf("vault token required, set %s or a "+
+			"token file", tokenEnv)
+	}
+	if mount == "" {
+		mount = "secret"
+	}
+
+	return &Client{
+		addr:  strings.TrimSuffix(addr, "/"),
+		mount: strings.Trim(mount, "/"),
+		http:  &http.Client{Timeout: requestTimeout},
+		token: token,
+		quit:  make(chan struct{}),
+	}, nil
+}
+
+// Start looks up the token and, if it's renewable, keeps renewing it in the
+// background before it expires.
+func (c *Client) Start() error {
+	var lookup struct {
+		Data struct {
+			TTL       int64 `json:"ttl"`
+			Renewable bool  `json:"renewable"`
+		} `json:"data"`
+	}
+	err := c.do(
+		context.Background(), http.MethodGet, "auth/token/lookup-self",
+		nil, &lookup,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to look up vault token: %v", err)
+	}
+
+	// Tokens without a TTL, like root tokens, never expire.
+	if !lookup.Data.Renewable || lookup.Data.TTL == 0 {
+		return nil
+	}
+
+	c.wg.Add(1)
+	go c.renewToken(time.Duration(lookup.Data.TTL) * time.Second)
+
+	return nil
+}
+
+// Stop stops renewing the token.
+func (c *Client) Stop() {
+	close(c.quit)
+	c.wg.Wait()
+}
+
+// renewToken renews the token whenever half of its TTL has passed.
+//
+// NOTE: This must be run as a goroutine.
+func (c *Client) renewToken(ttl time.Duration) {
+	defer c.wg.Done()
+
+	for {
+		delay := ttl / 2
+		if delay < minRenewInterval {
+			delay = minRenewInterval
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-c.quit:
+			return
+		}
+
+		var renewal struct {
+			Auth struct {
+				ClientToken   string `json:"client_token"`
+				LeaseDuration int64  `json:"lease_duration"`
+			} `json:"auth"`
+		}
+		err := c.do(
+			context.Background(), http.MethodPost,
+			"auth/token/renew-self", struct{}{}, &renewal,
+		)
+		if err != nil {
+			log.Errorf("Unable to renew vault token, retrying in "+
+				"%v: %v", renewRetryDelay, err)
+			ttl = 2 * renewRetryDelay
+			continue
+		}
+
+		if renewal.Auth.ClientToken != "" {
+			c.tokenMtx.Lock()
+			c.token = renewal.Auth.ClientToken
+			c.tokenMtx.Unlock()
+		}
+		ttl = time.Duration(renewal.Auth.LeaseDuration) * time.Second
+		log.Debugf("Renewed vault token, valid for %v", ttl)
+	}
+}
+
+// Read returns the fields of the latest version of the secret at the given
+// path. If the secret doesn't exist, ErrNotFound is returned.
+func (c *Client) Read(ctx context.Context, path string) (map[string]string,
+	error) {
+
+	var resp struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, c.kvPath("data", path), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Data.Data == nil {
+		return nil, ErrNotFound
+	}
+
+	return resp.Data.Data, nil
+}
+
+// ReadField returns a single field of the secret at the given path.
+func (c *Client) ReadField(ctx context.Context, path, field string) (string,
+	error) {
+
+	data, err := c.Read(ctx, path)
+	if err != nil {
+		return "", err
+	}
+
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no field %s", path, field)
+	}
+	return value, nil
+}
+
+// Write stores the given fields as a new version of the secret at the given
+// path.
+func (c *Client) Write(ctx context.Context, path string,
+	data map[string]string) error {
+
+	body := struct {
+		Data map[string]string `json:"data"`
+	}{data}
+	return c.do(ctx, http.MethodPost, c.kvPath("data", path), body, nil)
+}
+
+// Delete removes all versions of the secret at the given path. This acts as a
+// NOP if the secret doesn't exist.
+func (c *Client) Delete(ctx context.Context, path string) error {
+	err := c.do(ctx, http.MethodDelete, c.kvPath("metadata", path), nil, nil)
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// kvPath returns the API path of a secret in the KV secrets engine.
+func (c *Client) kvPath(kind, path string) string {
+	return c.mount + "/" + kind + "/" + strings.Trim(path, "/")
+}
+
+// do sends a request to the Vault API and decodes the JSON response into the
+// given value, if it isn't nil.
+func (c *Client) do(ctx context.Context, method, path string, body,
+	result interface{}) error {
+
+	var reqBody io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(bodyBytes)
+	}
+
+	req, err := http.NewRequest(method, c.addr+"/v1/"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	c.tokenMtx.RLock()
+	req.Header.Set("X-Vault-Token", c.token)
+	c.tokenMtx.RUnlock()
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+
+	case resp.StatusCode >= 300:
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.Unmarshal(respBody, &vaultErr)
+		return fmt.Errorf("vault returned status %d: %s",
+			resp.StatusCode, strings.Join(vaultErr.Errors, ", "))
+
+	case result == nil || len(respBody) == 0:
+		return nil
+
+	default:
+		return json.Unmarshal(respBody, result)
+	}
+}
@@ -0,0 +1,112 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mockVault is a minimal in-memory implementation of the KV version 2 API.
+type mockVault struct {
+	secrets map[string]map[string]string
+	mtx     sync.Mutex
+}
+
+func (m *mockVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if r.Header.Get("X-Vault-Token") != "token" {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/v1/auth/token/lookup-self":
+		_, _ = w.Write([]byte(`{"data":{"ttl":0,"renewable":false}}`))
+
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/data/"):
+		path := strings.TrimPrefix(r.URL.Path, "/v1/kv/data/")
+		switch r.Method {
+		case http.MethodGet:
+			data, ok := m.secrets[path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"data": data},
+			})
+
+		case http.MethodPost:
+			var body struct {
+				Data map[string]string `json:"data"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			m.secrets[path] = body.Data
+		}
+
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/metadata/"):
+		path := strings.TrimPrefix(r.URL.Path, "/v1/kv/metadata/")
+		delete(m.secrets, path)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// TestClient tests reading, writing and deleting secrets.
+func TestClient(t *testing.T) {
+	server := httptest.NewServer(&mockVault{
+		secrets: make(map[string]map[string]string),
+	})
+	defer server.Close()
+
+	os.Setenv(tokenEnv, "token")
+	defer os.Unsetenv(tokenEnv)
+
+	client, err := NewClient(server.URL, "", "kv")
+	require.NoError(t, err)
+	require.NoError(t, client.Start())
+	defer client.Stop()
+
+	ctx := context.Background()
+	_, err = client.Read(ctx, "aperture/etcd")
+	require.Equal(t, ErrNotFound, err)
+
+	err = client.Write(ctx, "aperture/etcd", map[string]string{
+		"user": "u", "password": "p",
+	})
+	require.NoError(t, err)
+
+	data, err := client.Read(ctx, "aperture/etcd")
+	require.NoError(t, err)
+	require.Equal(t, "u", data["user"])
+
+	value, err := client.ReadField(ctx, "aperture/etcd", "password")
+	require.NoError(t, err)
+	require.Equal(t, "p", value)
+	_, err = client.ReadField(ctx, "aperture/etcd", "missing")
+	require.Error(t, err)
+
+	require.NoError(t, client.Delete(ctx, "aperture/etcd"))
+	_, err = client.Read(ctx, "aperture/etcd")
+	require.Equal(t, ErrNotFound, err)
+
+	// Requests with an invalid token report Vault's error.
+	os.Setenv(tokenEnv, "invalid")
+	badClient, err := NewClient(server.URL, "", "kv")
+	require.NoError(t, err)
+	_, err = badClient.Read(ctx, "aperture/etcd")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "permission denied")
+}
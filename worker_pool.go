@@ -0,0 +1,100 @@
+package aperture
+
+import (
+	"context"
+	"sync"
+
+	"github.com/lightninglabs/aperture/mint"
+)
+
+const (
+	// defaultWorkerQueueSize is the default number of calls to lnd that can
+	// wait for a free worker.
+	defaultWorkerQueueSize = 100
+)
+
+// workerPool runs calls to lnd with a bounded number of workers. Calls that
+// find the queue full are rejected right away, so an overloaded lnd doesn't
+// accumulate an unbounded number of waiting requests.
+type workerPool struct {
+	jobs chan func()
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newWorkerPool creates a pool with the given number of workers and number of
+// calls that can wait for a free worker.
+func newWorkerPool(numWorkers, queueSize int) *workerPool {
+	if queueSize == 0 {
+		queueSize = defaultWorkerQueueSize
+	}
+
+	p := &workerPool{
+		jobs: make(chan func(), queueSize),
+		quit: make(chan struct{}),
+	}
+
+	p.wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer p.wg.Done()
+
+			for {
+				select {
+				case job := <-p.jobs:
+					job()
+
+				case <-p.quit:
+					return
+				}
+			}
+		}()
+	}
+
+	return p
+}
+
+// Stop stops all workers. Calls that are still queued are never run.
+func (p *workerPool) Stop() {
+	close(p.quit)
+	p.wg.Wait()
+}
+
+// queueDepth returns the number of calls that wait for a free worker.
+func (p *workerPool) queueDepth() int {
+	return len(p.jobs)
+}
+
+// run runs the given function on one of the workers and waits for it to
+// finish. If the queue is full, mint.ErrChallengerBusy is returned without
+// running the function.
+func (p *workerPool) run(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	job := func() {
+		// Don't bother lnd if the caller already gave up while the job
+		// was queued.
+		if err := ctx.Err(); err != nil {
+			done <- err
+			return
+		}
+		done <- fn()
+	}
+
+	select {
+	case p.jobs <- job:
+	default:
+		return mint.ErrChallengerBusy
+	}
+
+	select {
+	case err := <-done:
+		return err
+
+	case <-ctx.Done():
+		return ctx.Err()
+
+	case <-p.quit:
+		return mint.ErrChallengerBusy
+	}
+}